@@ -0,0 +1,146 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// builtinAliases are upstream renames of Alpine packages, configs and habits from before
+// them keep working
+var builtinAliases = map[string]string{
+	"python":       "python3",
+	"python-dev":   "python3-dev",
+	"py-pip":       "py3-pip",
+	"pip":          "py3-pip",
+	"nodejs-npm":   "npm",
+	"mysql":        "mariadb",
+	"mysql-client": "mariadb-client",
+}
+
+// maxAliasChain bounds how many renames in a row a name is followed through
+const maxAliasChain = 8
+
+// alias returns what name was renamed to. The aliases of the config take precedence over
+// the built-in ones, an empty one disables the built-in one.
+func (cfg *Config) alias(name string) (string, bool) {
+	if to, ok := cfg.Aliases[name]; ok {
+		return to, to != ""
+	}
+	to, ok := builtinAliases[name]
+	return to, ok
+}
+
+// validateAliases checks that no alias renames a package to itself, directly or through others
+func validateAliases(cfg *Config) error {
+	names := make([]string, 0, len(cfg.Aliases))
+	for name := range cfg.Aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if strings.TrimSpace(name) == "" {
+			return fmt.Errorf("aliases: empty package name")
+		}
+		chain := []string{name}
+		for cur, ok := cfg.alias(name); ok; cur, ok = cfg.alias(cur) {
+			chain = append(chain, cur)
+			if cur == name {
+				return fmt.Errorf("aliases %s form a cycle", strings.Join(chain, " -> "))
+			}
+			if len(chain) > maxAliasChain {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// resolveAlias returns the package name stands for: itself while an index has it, else
+// where its renames lead to a package an index has, or itself if they lead nowhere
+func resolveAlias(cfg *Config, name string, pkgMap map[string]APKPackage) string {
+	cur := name
+	for i := 0; i < maxAliasChain; i++ {
+		if _, ok := pkgMap[cur]; ok {
+			return cur
+		}
+		next, ok := cfg.alias(cur)
+		if !ok {
+			break
+		}
+		cur = next
+	}
+	if _, ok := pkgMap[cur]; ok {
+		return cur
+	}
+	return name
+}
+
+// renamesLeadTo reports whether the renames of name lead to pkg
+func (cfg *Config) renamesLeadTo(name, pkg string) bool {
+	cur := name
+	for i := 0; i < maxAliasChain; i++ {
+		next, ok := cfg.alias(cur)
+		if !ok {
+			return false
+		}
+		if next == pkg {
+			return true
+		}
+		cur = next
+	}
+	return false
+}
+
+// resolveAliases returns the configured packages with the ones no index has replaced by what
+// they were renamed to, so an installed package upgrades into its new name and the old one is
+// uninstalled. cfg keeps the names as configured, the renames are recorded in cfg.renamed.
+func resolveAliases(cfg *Config, pkgMap map[string]APKPackage) []string {
+	cfg.renamed = nil
+	packages := make([]string, len(cfg.Packages))
+	for i, name := range cfg.Packages {
+		packages[i] = name
+		to := resolveAlias(cfg, name, pkgMap)
+		if to == name {
+			continue
+		}
+		printf("%s was renamed to %s, using that\n", name, to)
+		if cfg.renamed == nil {
+			cfg.renamed = map[string]string{}
+		}
+		cfg.renamed[name] = to
+		packages[i] = to
+	}
+	return packages
+}
+
+// configuredAs returns the name pkg is configured under, the one it was renamed from
+// if it was, so the package options of the old name carry over
+func (cfg *Config) configuredAs(pkg string) string {
+	names := make([]string, 0, len(cfg.renamed))
+	for name, to := range cfg.renamed {
+		if to == pkg {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return pkg
+	}
+	sort.Strings(names)
+	return names[0]
+}
+
+// optionsOf returns the package options of pkg, those of the name it was renamed from when
+// it has none of its own
+func (cfg *Config) optionsOf(pkg string) PackageOptions {
+	if opts, ok := cfg.PackageOptions[pkg]; ok {
+		return opts
+	}
+	return cfg.PackageOptions[cfg.configuredAs(pkg)]
+}
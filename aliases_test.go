@@ -0,0 +1,77 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolveAliases(t *testing.T) {
+	oldState := stateDir
+	stateDir = t.TempDir()
+	defer func() { stateDir = oldState }()
+	pkgMap := map[string]APKPackage{
+		"python3":  {Name: "python3", Version: "3.12.3-r1"},
+		"npm":      {Name: "npm", Version: "10.8.0-r0"},
+		"mysql":    {Name: "mysql", Version: "8.0-r0"},
+		"newtool3": {Name: "newtool3", Version: "3.0-r0"},
+	}
+	cfg := &Config{
+		Aliases: map[string]string{"oldtool": "newtool2", "newtool2": "newtool3", "nodejs-npm": ""},
+	}
+	for name, want := range map[string]string{
+		"python":     "python3", // built-in
+		"mysql":      "mysql",   // still in the index, no rename
+		"oldtool":    "newtool3",
+		"nodejs-npm": "nodejs-npm", // built-in disabled by the config
+		"nothing":    "nothing",
+	} {
+		if got := resolveAlias(cfg, name, pkgMap); got != want {
+			t.Errorf("resolveAlias(%s) = %s, want %s", name, got, want)
+		}
+	}
+
+	// An installed package upstream renamed upgrades into its new name
+	cfg.Packages = []string{"python"}
+	cfg.PackageOptions = map[string]PackageOptions{"python": {NoStrip: true}}
+	cfg.Repos = []string{"https://internal/repo"}
+	cfg.pins = map[string]string{"python": "https://internal/repo"}
+	toInstall, err := resolveInstallSet(cfg, pkgMap, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := computePlan(cfg, pkgMap, map[string]string{"python": "2.7.18-r0"}, toInstall)
+	if len(plan.Installs) != 1 || plan.Installs[0].Name != "python3" || len(plan.Removals) != 1 || plan.Removals[0].Name != "python" {
+		t.Errorf("unexpected plan: installs %+v, removals %+v", plan.Installs, plan.Removals)
+	}
+	if strings.Join(cfg.Packages, " ") != "python" || len(cfg.PackageOptions) != 1 {
+		t.Errorf("the config was changed: %v, %v", cfg.Packages, cfg.PackageOptions)
+	}
+	if !cfg.optionsOf("python3").NoStrip {
+		t.Error("package options didn't carry over")
+	}
+	if cfg.pinnedRepo("python3") != "https://internal/repo" {
+		t.Error("the pin didn't carry over")
+	}
+	oldCfg := globalConfig
+	globalConfig = cfg
+	defer func() { globalConfig = oldCfg }()
+	if err := checkPins(cfg.Repos, pkgMap, map[string]string{"python3": "https://other/repo"}); err == nil {
+		t.Error("expected python3 from another repo to break the pin of python")
+	}
+	if err := checkPins(cfg.Repos, pkgMap, map[string]string{"python3": "https://internal/repo"}); err != nil {
+		t.Errorf("checkPins = %v", err)
+	}
+
+	if err := validateAliases(&Config{Aliases: map[string]string{"a": "b", "b": "a"}}); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("expected a cycle error, got %v", err)
+	}
+	if err := validateAliases(cfg); err != nil {
+		t.Errorf("validateAliases = %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"io"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// alpineRepoPrefix starts the repo shorthand alpine:<branch>/<repo>, e.g. alpine:v3.20/main
+const alpineRepoPrefix = "alpine:"
+
+// defaultAlpineMirror is the mirror base the shorthand expands to without alpine_mirror
+const defaultAlpineMirror = "https://dl-cdn.alpinelinux.org/alpine"
+
+// defaultAlpineArchive is where alpine: repos of end-of-life branches are fetched from once
+// the mirror dropped them, without alpine_archive
+const defaultAlpineArchive = "https://archive.alpinelinux.org/alpine"
+
+// alpineRepoSpec matches the part after alpine:, a branch (edge, latest-stable or vX.Y)
+// and a repo
+var alpineRepoSpec = regexp.MustCompile(`^(edge|latest-stable|v\d+\.\d+)/([a-z]+)$`)
+
+// alpineArches maps GOARCH to the Alpine arch packages of the host are built for
+var alpineArches = map[string]string{
+	"amd64":   "x86_64",
+	"386":     "x86",
+	"arm64":   "aarch64",
+	"arm":     "armv7",
+	"riscv64": "riscv64",
+	"ppc64le": "ppc64le",
+	"s390x":   "s390x",
+	"loong64": "loongarch64",
+}
+
+// repoArch is the arch the shorthand expands to: arch from the config, $arch when
+// build-matrix substitutes it, otherwise the host's
+func repoArch(cfg *Config) string {
+	switch {
+	case cfg.Arch != "":
+		return cfg.Arch
+	case len(cfg.Arches) > 0:
+		return archPlaceholder
+	case alpineArches[runtime.GOARCH] != "":
+		return alpineArches[runtime.GOARCH]
+	}
+	return runtime.GOARCH
+}
+
+// alpineMirror returns the mirror base of cfg: alpine_mirror, the picked one for auto or the default
+func alpineMirror(cfg *Config) string {
+	switch mirror := strings.TrimSuffix(cfg.AlpineMirror, "/"); mirror {
+	case "":
+		return defaultAlpineMirror
+	case autoMirror:
+		return pickedMirror()
+	default:
+		return mirror
+	}
+}
+
+// expandAlpineRepos replaces the alpine: shorthands of cfg.Repos by their mirror URL,
+// keeping the repos as written for writeConfig. Malformed shorthands are left alone for
+// validateRepoURLs to report.
+func expandAlpineRepos(cfg *Config) {
+	mirror := alpineMirror(cfg)
+	archive := strings.TrimSuffix(cfg.AlpineArchive, "/")
+	if archive == "" {
+		archive = defaultAlpineArchive
+	}
+	var expanded []string
+	for i, repo := range cfg.Repos {
+		spec, ok := strings.CutPrefix(repo, alpineRepoPrefix)
+		if !ok || !alpineRepoSpec.MatchString(spec) {
+			continue
+		}
+		if expanded == nil {
+			expanded = append([]string(nil), cfg.Repos...)
+		}
+		expanded[i] = mirror + "/" + spec + "/" + repoArch(cfg)
+		if archive != "off" {
+			alpineArchives[expanded[i]] = archive + "/" + spec + "/" + repoArch(cfg)
+		}
+	}
+	if expanded != nil {
+		cfg.repoSpecs = cfg.Repos
+		cfg.Repos = expanded
+	}
+}
+
+// alpineArchives maps the expanded alpine: repos to the same repo on the archive
+var alpineArchives = make(map[string]string)
+
+// archiveSources keeps the archive fallback sources of this run, so a repo that fell
+// back does it once
+var archiveSources = make(map[string]*archiveSource)
+
+// archiveSource is an alpine: repo that moves to the archive when its mirror doesn't
+// have the branch (anymore), as happens to end-of-life branches
+type archiveSource struct {
+	repo     string
+	mirror   httpSource
+	archive  httpSource
+	archived bool
+}
+
+// archiveSourceFor returns the fallback source of repo
+func archiveSourceFor(repo, archive string) *archiveSource {
+	if s, ok := archiveSources[repo]; ok {
+		return s
+	}
+	s := &archiveSource{repo: repo, mirror: httpSource(strings.TrimRight(repo, "/")), archive: httpSource(archive)}
+	archiveSources[repo] = s
+	return s
+}
+
+// fallBack switches to the archive if err says the mirror lacks the index of the repo,
+// any other failure (e.g. a package missing during a mirror sync) is left to the caller
+func (s *archiveSource) fallBack(err error) bool {
+	if s.archived || !isNotFound(err) {
+		return false
+	}
+	s.archived = true
+	banner := strings.Repeat("*", 72)
+	eprintf("%s\n", banner)
+	eprintf("[WARN] %s is not on the mirror anymore, the branch is probably end-of-life. Using %s instead, it gets no security fixes.\n", s.repo, string(s.archive))
+	eprintf("%s\n", banner)
+	return true
+}
+
+func (s *archiveSource) FetchIndex(dest string) error {
+	if !s.archived {
+		err := s.mirror.FetchIndex(dest)
+		if !s.fallBack(err) {
+			return err
+		}
+	}
+	return s.archive.FetchIndex(dest)
+}
+
+// current is the archive once the index came from it, the mirror otherwise
+func (s *archiveSource) current() httpSource {
+	if s.archived {
+		return s.archive
+	}
+	return s.mirror
+}
+
+func (s *archiveSource) Fetch(filename, dest string) (string, error) {
+	return s.current().Fetch(filename, dest)
+}
+
+func (s *archiveSource) Open(filename string) (io.ReadCloser, error) {
+	return s.current().Open(filename)
+}
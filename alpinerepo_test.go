@@ -0,0 +1,113 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAlpineRepoShorthand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apkg.yaml")
+	data := "repos:\n  - alpine:v3.20/main\n  - alpine:edge/community\n  - https://example.com/local\narch: aarch64\nalpine_mirror: https://mirror.example.com/alpine/\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := readConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"https://mirror.example.com/alpine/v3.20/main/aarch64",
+		"https://mirror.example.com/alpine/edge/community/aarch64",
+		"https://example.com/local",
+	}
+	if strings.Join(cfg.Repos, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v", cfg.Repos)
+	}
+
+	// The shorthands are written back as they were
+	if err := writeConfig(path, cfg); err != nil {
+		t.Fatal(err)
+	}
+	written, _ := os.ReadFile(path)
+	if !strings.Contains(string(written), "alpine:edge/community") || strings.Contains(string(written), "mirror.example.com/alpine/edge") {
+		t.Errorf("written config:\n%s", written)
+	}
+
+	// build-matrix substitutes the arch
+	cfg = &Config{Repos: []string{"alpine:latest-stable/main"}, Arches: []string{"x86_64"}}
+	expandAlpineRepos(cfg)
+	if cfg.Repos[0] != defaultAlpineMirror+"/latest-stable/main/$arch" {
+		t.Errorf("matrix repo: %s", cfg.Repos[0])
+	}
+
+	cfg = &Config{Repos: []string{"alpine:3.20/main"}}
+	expandAlpineRepos(cfg)
+	if err := validateRepoURLs(cfg); err == nil || !strings.Contains(err.Error(), "alpine:<branch>/<repo>") {
+		t.Errorf("malformed shorthand: %v", err)
+	}
+}
+
+func TestAlpineArchiveFallback(t *testing.T) {
+	gone := httptest.NewServer(http.NotFoundHandler())
+	defer gone.Close()
+	archive := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/v3.12/main/x86_64/") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("archived " + r.URL.Path))
+	}))
+	defer archive.Close()
+	defer func() { alpineArchives, archiveSources = map[string]string{}, map[string]*archiveSource{} }()
+
+	cfg := &Config{Repos: []string{"alpine:v3.12/main"}, AlpineMirror: gone.URL, AlpineArchive: archive.URL, Arch: "x86_64"}
+	expandAlpineRepos(cfg)
+	src := sourceFor(cfg.Repos[0])
+	dir := t.TempDir()
+	if err := src.FetchIndex(filepath.Join(dir, "index")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Fetch("foo-1.0-r0.apk", filepath.Join(dir, "foo.apk")); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "foo.apk")); string(data) != "archived /v3.12/main/x86_64/foo-1.0-r0.apk" {
+		t.Errorf("package from %q", data)
+	}
+
+	// A package missing from a mirror that has the index is an error, not a reason to fall back
+	syncing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/APKINDEX.tar.gz") {
+			w.Write([]byte("P:foo\nV:1.0-r0\n\n"))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer syncing.Close()
+	cfg = &Config{Repos: []string{"alpine:v3.12/main"}, AlpineMirror: syncing.URL, AlpineArchive: archive.URL, Arch: "x86_64"}
+	archiveSources = map[string]*archiveSource{}
+	expandAlpineRepos(cfg)
+	src = sourceFor(cfg.Repos[0])
+	if err := src.FetchIndex(filepath.Join(dir, "index")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := src.Fetch("foo-1.0-r0.apk", filepath.Join(dir, "foo.apk")); err == nil {
+		t.Error("a package missing from the mirror was fetched from the archive")
+	}
+
+	// Without the fallback the missing branch is an error
+	cfg = &Config{Repos: []string{"alpine:v3.11/main"}, AlpineMirror: gone.URL, AlpineArchive: "off", Arch: "x86_64"}
+	expandAlpineRepos(cfg)
+	if err := sourceFor(cfg.Repos[0]).FetchIndex(filepath.Join(dir, "index")); err == nil {
+		t.Errorf("fetched the index of a missing branch")
+	}
+}
@@ -0,0 +1,254 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// alternativesFile is the state file tracking every managed alternative
+const alternativesFile = "alternatives.yaml"
+
+// Alternative records which packages ship a managed path and which one the
+// path currently points at
+type Alternative struct {
+	Path      string   `yaml:"path"`
+	Providers []string `yaml:"providers"`
+	Selected  string   `yaml:"selected"`
+}
+
+// isAlternativePath reports whether rel is managed through the alternatives mechanism
+func isAlternativePath(rel string) bool {
+	if globalConfig == nil {
+		return false
+	}
+	_, ok := globalConfig.Alternatives[filepath.ToSlash(rel)]
+	return ok
+}
+
+// alternativeTarget returns the path a provider's copy of rel is diverted to
+func alternativeTarget(rel, pkg string) string {
+	return rel + ".apkg-" + pkg
+}
+
+// readAlternatives reads the alternatives state file (alternatives.yaml)
+func readAlternatives(path string) (map[string]*Alternative, error) {
+	alts := make(map[string]*Alternative)
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return alts, nil // treat as empty
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var list []*Alternative
+	dec := yaml.NewDecoder(f)
+	if err := dec.Decode(&list); err != nil {
+		return nil, err
+	}
+	for _, a := range list {
+		alts[a.Path] = a
+	}
+	return alts, nil
+}
+
+// writeAlternatives writes the alternatives state file (alternatives.yaml)
+func writeAlternatives(path string, alts map[string]*Alternative) error {
+	list := make([]*Alternative, 0, len(alts))
+	for _, a := range alts {
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc := yaml.NewEncoder(f)
+	return enc.Encode(list)
+}
+
+// pickProvider chooses which provider an alternative should point at: the one
+// preferred in the config if it is installed, otherwise the current selection,
+// otherwise the first provider
+func pickProvider(a *Alternative) string {
+	if globalConfig != nil {
+		if pref, ok := globalConfig.Alternatives[a.Path]; ok {
+			for _, p := range a.Providers {
+				if p == pref {
+					return p
+				}
+			}
+		}
+	}
+	for _, p := range a.Providers {
+		if p == a.Selected {
+			return p
+		}
+	}
+	if len(a.Providers) > 0 {
+		return a.Providers[0]
+	}
+	return ""
+}
+
+// linkAlternative points the managed path at the selected provider's copy
+func linkAlternative(installDir string, a *Alternative) error {
+	link := filepath.Join(installDir, a.Path)
+	if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if a.Selected == "" {
+		return nil
+	}
+	return os.Symlink(filepath.Base(alternativeTarget(a.Path, a.Selected)), link)
+}
+
+// registerAlternatives records pkg as a provider of its managed paths and relinks them
+func registerAlternatives(installDir, pkg string, paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	alts, err := readAlternatives(statePath(alternativesFile))
+	if err != nil {
+		return err
+	}
+	for _, rel := range paths {
+		rel = filepath.ToSlash(rel)
+		a, ok := alts[rel]
+		if !ok {
+			a = &Alternative{Path: rel}
+			alts[rel] = a
+		}
+		known := false
+		for _, p := range a.Providers {
+			if p == pkg {
+				known = true
+				break
+			}
+		}
+		if !known {
+			a.Providers = append(a.Providers, pkg)
+		}
+		a.Selected = pickProvider(a)
+		if err := linkAlternative(installDir, a); err != nil {
+			return fmt.Errorf("failed to link %s: %w", rel, err)
+		}
+	}
+	return writeAlternatives(statePath(alternativesFile), alts)
+}
+
+// unregisterAlternatives drops pkg from every alternative it provides, switching
+// to another provider or removing the link when none are left
+func unregisterAlternatives(installDir, pkg string) error {
+	alts, err := readAlternatives(statePath(alternativesFile))
+	if err != nil {
+		return err
+	}
+	changed := false
+	for rel, a := range alts {
+		providers := []string{}
+		for _, p := range a.Providers {
+			if p != pkg {
+				providers = append(providers, p)
+			}
+		}
+		if len(providers) == len(a.Providers) {
+			continue
+		}
+		changed = true
+		a.Providers = providers
+		a.Selected = pickProvider(a)
+		if err := linkAlternative(installDir, a); err != nil {
+			eprintf("[WARN] Failed to relink %s: %v\n", rel, err)
+		}
+		if len(providers) == 0 {
+			delete(alts, rel)
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return writeAlternatives(statePath(alternativesFile), alts)
+}
+
+// cmdAlternatives implements `apkg alternatives [list | set <path> <pkg>]`
+func cmdAlternatives(configPath string, args []string) int {
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		eprintf("[FATAL] Failed to read config: %v\n", err)
+		return 1
+	}
+	globalConfig = cfg
+	alts, err := readAlternatives(statePath(alternativesFile))
+	if err != nil {
+		eprintf("[FATAL] Failed to read %s: %v\n", statePath(alternativesFile), err)
+		return 1
+	}
+	if len(args) == 0 || args[0] == "list" {
+		if len(alts) == 0 {
+			printf("No alternatives registered.\n")
+			return 0
+		}
+		paths := make([]string, 0, len(alts))
+		for p := range alts {
+			paths = append(paths, p)
+		}
+		sort.Strings(paths)
+		for _, p := range paths {
+			a := alts[p]
+			printf("  %s -> %s (providers: %v)\n", a.Path, a.Selected, a.Providers)
+		}
+		return 0
+	}
+	if args[0] != "set" || len(args) < 3 {
+		eprintf("Usage: %s [flags] alternatives [list | set <path> <package>]\n", os.Args[0])
+		return 1
+	}
+	rel, pkg := filepath.ToSlash(args[1]), args[2]
+	a, ok := alts[rel]
+	if !ok {
+		eprintf("[ERROR] %s is not a registered alternative\n", rel)
+		return 1
+	}
+	found := false
+	for _, p := range a.Providers {
+		if p == pkg {
+			found = true
+			break
+		}
+	}
+	if !found {
+		eprintf("[ERROR] %s does not provide %s (providers: %v)\n", pkg, rel, a.Providers)
+		return 1
+	}
+	// Persist the preference so the next apply doesn't switch it back
+	if cfg.Alternatives == nil {
+		cfg.Alternatives = make(map[string]string)
+	}
+	cfg.Alternatives[rel] = pkg
+	if err := writeConfig(configPath, cfg); err != nil {
+		eprintf("[FATAL] Failed to write config: %v\n", err)
+		return 1
+	}
+	a.Selected = pkg
+	if err := linkAlternative(cfg.InstallDir, a); err != nil {
+		eprintf("[ERROR] Failed to link %s: %v\n", rel, err)
+		return 1
+	}
+	if err := writeAlternatives(statePath(alternativesFile), alts); err != nil {
+		eprintf("[WARN] Failed to update %s: %v\n", statePath(alternativesFile), err)
+	}
+	printf("%s now points to %s\n", rel, pkg)
+	return 0
+}
@@ -0,0 +1,48 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAlternativesSwitchProvider(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	globalConfig = &Config{Alternatives: map[string]string{"usr/bin/vi": "vim"}}
+	defer func() { globalConfig = nil }()
+
+	root := filepath.Join(dir, "root")
+	os.MkdirAll(filepath.Join(root, "usr/bin"), 0755)
+	if err := registerAlternatives(root, "busybox", []string{"usr/bin/vi"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := registerAlternatives(root, "vim", []string{"usr/bin/vi"}); err != nil {
+		t.Fatal(err)
+	}
+	if target, _ := os.Readlink(filepath.Join(root, "usr/bin/vi")); target != "vi.apkg-vim" {
+		t.Errorf("expected link to preferred provider, got %q", target)
+	}
+	if err := unregisterAlternatives(root, "vim"); err != nil {
+		t.Fatal(err)
+	}
+	if target, _ := os.Readlink(filepath.Join(root, "usr/bin/vi")); target != "vi.apkg-busybox" {
+		t.Errorf("expected fallback to remaining provider, got %q", target)
+	}
+	if err := unregisterAlternatives(root, "busybox"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(root, "usr/bin/vi")); !os.IsNotExist(err) {
+		t.Errorf("expected link to be removed with the last provider")
+	}
+}
@@ -0,0 +1,145 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// AuditEntry is one line of the audit log
+type AuditEntry struct {
+	Time         string `json:"time"`
+	Transaction  string `json:"transaction"`
+	Package      string `json:"package,omitempty"`
+	Path         string `json:"path"`
+	Action       string `json:"action"`
+	BeforeSHA256 string `json:"before_sha256,omitempty"`
+	AfterSHA256  string `json:"after_sha256,omitempty"`
+}
+
+// fileSHA256 returns the hex sha256 of a regular file, or "" if it can't be read
+func fileSHA256(p string) string {
+	info, err := os.Lstat(p)
+	if err != nil || !info.Mode().IsRegular() {
+		return ""
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeAuditLog appends every change of a committing transaction to the audit log,
+// the backups still hold the "before" content at this point
+func writeAuditLog(tx *Transaction) error {
+	if globalConfig == nil || globalConfig.AuditLog == "" || len(tx.entries) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(globalConfig.AuditLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	now := time.Now().UTC().Format(time.RFC3339)
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range tx.entries {
+		if e.action == txSave {
+			continue // the change was audited with the file's first entry
+		}
+		entry := AuditEntry{Time: now, Transaction: tx.ID, Package: e.pkg, Path: filepath.ToSlash(e.rel), Action: e.action}
+		switch e.action {
+		case txCreate:
+			entry.AfterSHA256 = fileSHA256(installPath(tx.installDir, e.rel))
+		case txReplace:
+			entry.BeforeSHA256 = fileSHA256(tx.backupPath(e.rel))
+			entry.AfterSHA256 = fileSHA256(installPath(tx.installDir, e.rel))
+		case txRemove:
+			entry.BeforeSHA256 = fileSHA256(tx.backupPath(e.rel))
+		}
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// cmdAudit implements `apkg audit [-tx <id>] [-package <pkg>] [-path <glob>]`
+func cmdAudit(configPath string, args []string) int {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	txID := fs.String("tx", "", "Only show changes of this transaction")
+	pkg := fs.String("package", "", "Only show changes made for this package")
+	pathGlob := fs.String("path", "", "Only show changes to paths matching this glob")
+	fs.Parse(args)
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		eprintf("[FATAL] Failed to read config: %v\n", err)
+		return 1
+	}
+	if cfg.AuditLog == "" {
+		eprintf("[ERROR] audit_log is not set in the config\n")
+		return 1
+	}
+	f, err := os.Open(cfg.AuditLog)
+	if err != nil {
+		eprintf("[ERROR] Failed to open audit log: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			eprintf("[WARN] Skipping malformed audit entry: %v\n", err)
+			continue
+		}
+		if *txID != "" && e.Transaction != *txID {
+			continue
+		}
+		if *pkg != "" && e.Package != *pkg {
+			continue
+		}
+		if *pathGlob != "" {
+			if ok, _ := path.Match(*pathGlob, e.Path); !ok {
+				continue
+			}
+		}
+		printf("%s %s %-7s %s %s", e.Time, e.Transaction, e.Action, e.Package, e.Path)
+		if e.BeforeSHA256 != "" {
+			printf(" before=%s", e.BeforeSHA256)
+		}
+		if e.AfterSHA256 != "" {
+			printf(" after=%s", e.AfterSHA256)
+		}
+		fmt.Println()
+	}
+	if err := sc.Err(); err != nil {
+		eprintf("[ERROR] Failed to read audit log: %v\n", err)
+		return 1
+	}
+	return 0
+}
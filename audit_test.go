@@ -0,0 +1,78 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	oldConfig, oldState := globalConfig, stateDir
+	defer func() { globalConfig, stateDir = oldConfig, oldState }()
+	stateDir = t.TempDir()
+	logPath := filepath.Join(t.TempDir(), "audit.log")
+	globalConfig = &Config{AuditLog: logPath}
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "etc"), 0755)
+	os.WriteFile(filepath.Join(root, "etc/foo.conf"), []byte("old"), 0644)
+	os.WriteFile(filepath.Join(root, "etc/gone.conf"), []byte("gone"), 0644)
+	oldSum, goneSum := fileSHA256(filepath.Join(root, "etc/foo.conf")), fileSHA256(filepath.Join(root, "etc/gone.conf"))
+
+	tx, err := beginTransaction(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.setPackage("foo")
+	for _, rel := range []string{"etc/foo.conf", "etc/new.conf"} {
+		if err := tx.prepareWrite(rel); err != nil {
+			t.Fatal(err)
+		}
+		os.WriteFile(filepath.Join(root, rel), []byte("new"), 0644)
+	}
+	tx.setPackage("bar")
+	if err := tx.removeFile("etc/gone.conf"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries := map[string]AuditEntry{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries[e.Path] = e
+	}
+	newSum := fileSHA256(filepath.Join(root, "etc/foo.conf"))
+	if e := entries["etc/foo.conf"]; e.Action != txReplace || e.Package != "foo" || e.AfterSHA256 != newSum || e.BeforeSHA256 != oldSum {
+		t.Errorf("replace entry %+v", e)
+	}
+	if e := entries["etc/new.conf"]; e.Action != txCreate || e.AfterSHA256 != newSum || e.BeforeSHA256 != "" {
+		t.Errorf("create entry %+v", e)
+	}
+	if e := entries["etc/gone.conf"]; e.Action != txRemove || e.Package != "bar" || e.BeforeSHA256 != goneSum || e.AfterSHA256 != "" || e.Transaction != tx.ID {
+		t.Errorf("remove entry %+v", e)
+	}
+
+	configPath := filepath.Join(t.TempDir(), "apkg.yaml")
+	os.WriteFile(configPath, []byte("repos: [https://example.com/test]\npackages: [foo]\naudit_log: "+logPath+"\n"), 0644)
+	if code := cmdAudit(configPath, []string{"-package", "foo", "-path", "etc/*.conf"}); code != 0 {
+		t.Errorf("audit = %d", code)
+	}
+}
@@ -0,0 +1,206 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+)
+
+// defaultAutoUpgradeInterval is how often `apkg auto-upgrade` checks for upgrades
+const defaultAutoUpgradeInterval = 6 * time.Hour
+
+// onlyUpgrade is set by -only-upgrade, upgrades of installed packages not in it are held back
+var onlyUpgrade map[string]bool
+
+// AutoUpgradeConfig is the policy of `apkg auto-upgrade`
+type AutoUpgradeConfig struct {
+	// Interval between two checks (default 6h)
+	Interval string `yaml:"interval,omitempty"`
+	// Allow lists packages (globs) upgraded even when the upgrade fixes no known CVE
+	Allow []string `yaml:"allow,omitempty"`
+	// Notify is a shell command run after every round that changed something or failed,
+	// with the summary on stdin
+	Notify string `yaml:"notify,omitempty"`
+}
+
+// interval returns the configured check interval
+func (a AutoUpgradeConfig) interval() time.Duration {
+	if d, err := time.ParseDuration(a.Interval); err == nil && d > 0 {
+		return d
+	}
+	return defaultAutoUpgradeInterval
+}
+
+// allows reports whether pkg is on the allowlist
+func (a AutoUpgradeConfig) allows(pkg string) bool {
+	for _, pattern := range a.Allow {
+		if ok, _ := path.Match(pattern, pkg); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// holdUpgrades restricts toInstall to the installed packages with the upgrades -only-upgrade
+// allows, packages the config added since aren't installed by such a round
+func holdUpgrades(toInstall []string, pkgMap map[string]APKPackage, installedPkgs map[string]string) []string {
+	if onlyUpgrade == nil {
+		return toInstall
+	}
+	kept := toInstall[:0]
+	for _, pkg := range toInstall {
+		cur, installed := installedPkgs[pkg]
+		if !installed {
+			printf("Not installing %s, -only-upgrade only upgrades installed packages\n", pkg)
+			continue
+		}
+		if info, ok := pkgMap[pkg]; ok && installed && cur != info.Version && !onlyUpgrade[pkg] {
+			printf("Holding back %s (%s, %s is available)\n", pkg, cur, info.Version)
+			continue
+		}
+		kept = append(kept, pkg)
+	}
+	return kept
+}
+
+// autoUpgradeCandidates picks the upgrades the policy applies: security fixes and allowed packages
+func autoUpgradeCandidates(cfg *Config, outdated []OutdatedPkg) []OutdatedPkg {
+	var picked []OutdatedPkg
+	for _, o := range outdated {
+		if o.Security || cfg.AutoUpgrade.allows(o.Name) {
+			picked = append(picked, o)
+		}
+	}
+	return picked
+}
+
+// autoUpgradeRound applies the upgrades the policy picks by running apkg with -only-upgrade,
+// it returns what it tried to upgrade
+func autoUpgradeRound(configPath string) ([]OutdatedPkg, error) {
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	globalConfig = cfg
+	installedPkgs, err := readInstalledPkgs(statePath("installed.yaml"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read installed.yaml: %w", err)
+	}
+	pkgMap, sourceRepo, err := fetchAndParseAllAPKIndexes(cfg.Repos)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching APKINDEX: %w", err)
+	}
+	var secdb secdbFixes
+	if len(cfg.Secdb) > 0 {
+		if secdb, err = loadSecdb(cfg.Secdb); err != nil {
+			return nil, fmt.Errorf("failed to load the secdb: %w", err)
+		}
+	}
+	picked := autoUpgradeCandidates(cfg, findOutdated(installedPkgs, pkgMap, sourceRepo, secdb))
+	if len(picked) == 0 {
+		return nil, nil
+	}
+	names := make([]string, len(picked))
+	for i, o := range picked {
+		names[i] = o.Name
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return picked, err
+	}
+	args := []string{"-config", configPath, "-state-dir", stateDir, "-only-upgrade", strings.Join(names, ",")}
+	if configKeyring != "" {
+		args = append(args, "-config-keyring", configKeyring)
+	}
+	cmd := exec.Command(self, args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return picked, fmt.Errorf("apply failed: %w", err)
+	}
+	return picked, nil
+}
+
+// autoUpgradeSummary describes a round for the log and the notify command
+func autoUpgradeSummary(picked []OutdatedPkg, err error) string {
+	var b strings.Builder
+	if err != nil {
+		fmt.Fprintf(&b, "apkg auto-upgrade failed: %v\n", err)
+	} else {
+		fmt.Fprintf(&b, "apkg auto-upgrade upgraded %d packages\n", len(picked))
+	}
+	for _, o := range picked {
+		why := "allowlisted"
+		if o.Security {
+			why = strings.Join(o.Fixes, " ")
+		}
+		fmt.Fprintf(&b, "  %s %s -> %s (%s)\n", o.Name, o.Installed, o.Candidate, why)
+	}
+	return b.String()
+}
+
+// notifyAutoUpgrade runs the notify command with summary on stdin
+func notifyAutoUpgrade(command, summary string) error {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stdin = strings.NewReader(summary)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+// cmdAutoUpgrade implements `apkg auto-upgrade [-once]`: periodically apply the upgrades
+// that fix known CVEs or are on the allowlist, holding back every other one
+func cmdAutoUpgrade(configPath string, args []string) int {
+	fs := flag.NewFlagSet("auto-upgrade", flag.ExitOnError)
+	once := fs.Bool("once", false, "Run a single round and exit (for cron or systemd timers)")
+	fs.Parse(args)
+	if configPath == "-" {
+		eprintf("[FATAL] auto-upgrade re-reads the config every round, it can't come from stdin\n")
+		return 1
+	}
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		eprintf("[FATAL] Failed to read config: %v\n", err)
+		return 1
+	}
+	if len(cfg.Secdb) == 0 && len(cfg.AutoUpgrade.Allow) == 0 {
+		eprintf("[FATAL] auto-upgrade needs secdb urls or an auto_upgrade.allow list in the config\n")
+		return 1
+	}
+	for {
+		picked, err := autoUpgradeRound(configPath)
+		if err != nil {
+			eprintf("[ERROR] %v\n", err)
+		}
+		if len(picked) > 0 || err != nil {
+			summary := autoUpgradeSummary(picked, err)
+			printf("%s %s", time.Now().Format(time.RFC3339), summary)
+			if globalConfig != nil && globalConfig.AutoUpgrade.Notify != "" {
+				if err := notifyAutoUpgrade(globalConfig.AutoUpgrade.Notify, summary); err != nil {
+					eprintf("[WARN] Notify command failed: %v\n", err)
+				}
+			}
+		} else {
+			printf("%s No security or allowlisted upgrades\n", time.Now().Format(time.RFC3339))
+		}
+		if *once {
+			if err != nil {
+				return 4
+			}
+			return 0
+		}
+		interval := defaultAutoUpgradeInterval
+		if globalConfig != nil {
+			interval = globalConfig.AutoUpgrade.interval()
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,114 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// apkInstalledDB is where apk keeps its database of installed packages
+const apkInstalledDB = "lib/apk/db/installed"
+
+// basePkgs are the packages (name to version) the base layer already has, nil without a base
+var basePkgs map[string]string
+
+// parseAPKInstalledDB reads the package names and versions of an apk installed database
+func parseAPKInstalledDB(r io.Reader) (map[string]string, error) {
+	pkgs := make(map[string]string)
+	var name, version string
+	flush := func() {
+		if name != "" {
+			pkgs[name] = version
+		}
+		name, version = "", ""
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), maxIndexLine)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case line == "":
+			flush()
+		case strings.HasPrefix(line, "P:"):
+			name = line[2:]
+		case strings.HasPrefix(line, "V:"):
+			version = line[2:]
+		}
+	}
+	flush()
+	return pkgs, sc.Err()
+}
+
+// readBaseDB reads the apk database of a base image, given as a directory or a (compressed) tarball
+func readBaseDB(base string) (map[string]string, error) {
+	info, err := os.Stat(base)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		f, err := os.Open(filepath.Join(base, apkInstalledDB))
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return parseAPKInstalledDB(f)
+	}
+	f, err := os.Open(base)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rc, _, err := decompress(f)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s has no %s", base, apkInstalledDB)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimPrefix(filepath.Clean("/"+hdr.Name), "/") == apkInstalledDB {
+			return parseAPKInstalledDB(tr)
+		}
+	}
+}
+
+// loadBase reads the database of the configured base layer into basePkgs
+func loadBase(cfg *Config) error {
+	if cfg.Base == "" {
+		return nil
+	}
+	pkgs, err := readBaseDB(cfg.Base)
+	if err != nil {
+		return fmt.Errorf("failed to read the base layer: %w", err)
+	}
+	basePkgs = pkgs
+	printf("Base layer %s has %d packages\n", cfg.Base, len(pkgs))
+	return nil
+}
+
+// providedByBase reports whether the base layer has pkg at the version the repos offer,
+// such packages are left to the base and not installed on top of it
+func providedByBase(pkg string, pkgMap map[string]APKPackage) bool {
+	ver, ok := basePkgs[pkg]
+	if !ok {
+		return false
+	}
+	info, indexed := pkgMap[pkg]
+	return !indexed || info.Version == ver
+}
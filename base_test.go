@@ -0,0 +1,58 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testInstalledDB = "C:Q1abc=\nP:musl\nV:1.2.5-r0\nA:x86_64\nF:lib\nR:ld-musl-x86_64.so.1\n\nP:busybox\nV:1.36.1-r0\nF:bin\nR:busybox\n"
+
+func TestReadBaseDB(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "lib/apk/db"), 0755)
+	os.WriteFile(filepath.Join(dir, apkInstalledDB), []byte(testInstalledDB), 0644)
+
+	tarball := filepath.Join(t.TempDir(), "base.tar.gz")
+	f, _ := os.Create(tarball)
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	tw.WriteHeader(&tar.Header{Name: "./lib/apk/db/installed", Mode: 0644, Size: int64(len(testInstalledDB)), Typeflag: tar.TypeReg})
+	tw.Write([]byte(testInstalledDB))
+	tw.Close()
+	zw.Close()
+	f.Close()
+
+	for _, base := range []string{dir, tarball} {
+		pkgs, err := readBaseDB(base)
+		if err != nil || len(pkgs) != 2 || pkgs["musl"] != "1.2.5-r0" || pkgs["busybox"] != "1.36.1-r0" {
+			t.Errorf("readBaseDB(%s) = %v, %v", base, pkgs, err)
+		}
+	}
+}
+
+func TestResolveInstallSetSkipsBase(t *testing.T) {
+	oldBase := basePkgs
+	basePkgs = map[string]string{"musl": "1.2.5-r0", "busybox": "1.36.0-r0"}
+	defer func() { basePkgs = oldBase }()
+	pkgMap := map[string]APKPackage{
+		"musl":    {Name: "musl", Version: "1.2.5-r0"},
+		"busybox": {Name: "busybox", Version: "1.36.1-r0"},
+		"curl":    {Name: "curl", Version: "8.9.0-r0"},
+	}
+	got, err := resolveInstallSet(&Config{Packages: []string{"musl", "busybox", "curl"}}, pkgMap, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != "busybox" || got[1] != "curl" {
+		t.Errorf("expected only the upgraded busybox and curl on top of the base, got %v", got)
+	}
+}
@@ -0,0 +1,585 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"archive/tar"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Fixed names inside a bundle, the config and lockfile sit at its root so
+// lockfilePath finds the lockfile next to the config
+const (
+	bundleManifestName = "bundle.yaml"
+	bundleConfigName   = "apkg.yaml"
+	bundleLockName     = "apkg.lock"
+	bundleIndexName    = "APKINDEX.tar.gz"
+)
+
+// bundleDir is set by -bundle-dir to an extracted bundle: repos and direct packages
+// come from it and the network is never used
+var bundleDir string
+
+// bundle is the verified manifest of bundleDir
+var bundle *BundleManifest
+
+// BundleManifest describes the content of an offline bundle
+type BundleManifest struct {
+	// Repos maps every repo of the config to the directory holding its index and packages
+	Repos map[string]string `yaml:"repos"`
+	// Direct maps the source of every direct package entry to its copy
+	Direct map[string]string `yaml:"direct,omitempty"`
+	// Files holds the sha256 of every file of the bundle but the manifest
+	Files map[string]string `yaml:"files"`
+	// Base is the version of the lockfile a differential bundle was made against
+	Base string `yaml:"base,omitempty"`
+	// Unchanged lists the packages a differential bundle leaves out with their version,
+	// the target must already have them installed
+	Unchanged map[string]string `yaml:"unchanged,omitempty"`
+}
+
+// bundleDiff makes a differential bundle: only the packages that changed between the
+// Old lockfile and the one at NewPath are bundled
+type bundleDiff struct {
+	Old     *Lockfile
+	NewPath string
+}
+
+// bundleSource serves a repo from its directory in an extracted bundle
+type bundleSource string
+
+func (s bundleSource) FetchIndex(dest string) error {
+	_, err := copyFileSHA256(filepath.Join(string(s), bundleIndexName), dest, 0644)
+	return err
+}
+
+func (s bundleSource) Fetch(filename, dest string) (string, error) {
+	return copyFileSHA256(filepath.Join(string(s), path.Base(filename)), dest, 0644)
+}
+
+// bundleRepoSource returns the Source of repo inside the bundle being applied
+func bundleRepoSource(repo string) (Source, bool) {
+	if bundle == nil {
+		return nil, false
+	}
+	dir, ok := bundle.Repos[repo]
+	if !ok {
+		return nil, false
+	}
+	return bundleSource(filepath.Join(bundleDir, dir)), true
+}
+
+// bundleDirectSource returns the copy of a direct package source inside the bundle being applied
+func bundleDirectSource(src string) string {
+	if bundle == nil {
+		return src
+	}
+	if local, ok := bundle.Direct[src]; ok {
+		return filepath.Join(bundleDir, local)
+	}
+	return src
+}
+
+// loadBundle reads the manifest of an extracted bundle and checks every file against it,
+// nothing unlisted may be present
+func loadBundle(dir string) (*BundleManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, bundleManifestName))
+	if err != nil {
+		return nil, err
+	}
+	var m BundleManifest
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", bundleManifestName, err)
+	}
+	seen := map[string]bool{}
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name, _ := filepath.Rel(dir, p)
+		name = filepath.ToSlash(name)
+		if name == bundleManifestName {
+			return nil
+		}
+		want, ok := m.Files[name]
+		if !ok {
+			return fmt.Errorf("%s is not listed in the bundle manifest", name)
+		}
+		if got := fileSHA256(p); got != want {
+			return fmt.Errorf("checksum mismatch for %s: expected sha256 %s, got %s", name, want, got)
+		}
+		seen[name] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for name := range m.Files {
+		if !seen[name] {
+			return nil, fmt.Errorf("%s is missing from the bundle", name)
+		}
+	}
+	for _, name := range []string{bundleConfigName, bundleLockName} {
+		if !seen[name] {
+			return nil, fmt.Errorf("the bundle has no %s", name)
+		}
+	}
+	return &m, nil
+}
+
+// writeBundle archives the staged bundle in dir as a tar at dest, manifest first
+func writeBundle(dir, dest string) error {
+	var names []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		name, _ := filepath.Rel(dir, p)
+		names = append(names, filepath.ToSlash(name))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return names[i] == bundleManifestName || (names[j] != bundleManifestName && names[i] < names[j])
+	})
+	tmp := dest + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	tw := tar.NewWriter(f)
+	for _, name := range names {
+		if err := addBundleFile(tw, filepath.Join(dir, filepath.FromSlash(name)), name); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
+
+// addBundleFile writes the file at p to tw as name
+func addBundleFile(tw *tar.Writer, p, name string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: info.Size(), ModTime: info.ModTime()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// bundleOmits reports whether pkg is left out of the differential bundle being applied,
+// the installed copy is kept instead
+func bundleOmits(pkg string, pkgMap map[string]APKPackage, installedPkgs map[string]string) bool {
+	if bundle == nil {
+		return false
+	}
+	ver, ok := bundle.Unchanged[pkg]
+	return ok && pkgMap[pkg].Version == ver && installedPkgs[pkg] == ver
+}
+
+// checkBundleBase makes sure the packages a differential bundle leaves out are installed
+// at the version it was made against
+func checkBundleBase(toInstall []string, pkgMap map[string]APKPackage, installedPkgs map[string]string) error {
+	if bundle == nil || len(bundle.Unchanged) == 0 {
+		return nil
+	}
+	var missing []string
+	for _, pkg := range toInstall {
+		if ver, ok := bundle.Unchanged[pkg]; ok && pkgMap[pkg].Version == ver && installedPkgs[pkg] != ver {
+			missing = append(missing, fmt.Sprintf("%s-%s", pkg, ver))
+		}
+	}
+	if len(missing) > 0 {
+		base := "its base lockfile"
+		if bundle.Base != "" {
+			base = "lockfile version " + bundle.Base
+		}
+		return fmt.Errorf("the bundle only carries the changes since %s, these packages must be installed already: %s", base, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// extractBundle unpacks the bundle tar at src into dir, only plain files below dir are accepted
+func extractBundle(src, dir string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+		name := path.Clean(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || unsafeEntry(name) {
+			return fmt.Errorf("unexpected bundle entry %s", hdr.Name)
+		}
+		dest := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		out, err := os.OpenFile(dest, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, tr); err != nil {
+			out.Close()
+			return err
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+	}
+}
+
+// stageBundle resolves the config like `apkg lock` and stages its bundle in dir: the
+// config, a fresh lockfile, every repo index and every package to install. With diff the
+// config must resolve to its new lockfile, which is bundled instead, and packages
+// unchanged since its old one are left out.
+func stageBundle(configPath string, cfg *Config, dir, workDir string, diff *bundleDiff) (*BundleManifest, *Lockfile, error) {
+	// The target has the base layer, its packages are neither bundled nor locked
+	if err := loadBase(cfg); err != nil {
+		return nil, nil, err
+	}
+	pkgMap, sourceRepo := map[string]APKPackage{}, map[string]string{}
+	if len(cfg.Repos) > 0 {
+		var err error
+		if pkgMap, sourceRepo, err = fetchAndParseAllAPKIndexes(cfg.Repos); err != nil {
+			return nil, nil, fmt.Errorf("error fetching APKINDEX: %w", err)
+		}
+	}
+	m := &BundleManifest{Repos: map[string]string{}, Direct: map[string]string{}, Files: map[string]string{}, Unchanged: map[string]string{}}
+	// add stores a file of the bundle and records its checksum
+	add := func(name string, write func(dest string) error) error {
+		dest := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		if err := write(dest); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		m.Files[name] = fileSHA256(dest)
+		return nil
+	}
+	copyFrom := func(src string) func(string) error {
+		return func(dest string) error {
+			_, err := copyFileSHA256(src, dest, 0644)
+			return err
+		}
+	}
+
+	// Direct entries are bundled as their original sources, their checksums still apply
+	var direct []string
+	for _, entry := range cfg.Packages {
+		if isDirectEntry(entry) {
+			direct = append(direct, entry)
+		}
+	}
+	if _, err := resolveDirectPackages(cfg, pkgMap, sourceRepo, workDir); err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch package: %w", err)
+	}
+	toInstall, err := resolveInstallSet(cfg, pkgMap, sourceRepo)
+	if err != nil {
+		explainResolveError(err, cfg, pkgMap, sourceRepo)
+		return nil, nil, err
+	}
+	lf := newLockfile("", cfg, pkgMap, sourceRepo, toInstall)
+	old := map[string]string{}
+	if diff != nil {
+		if lf, err = readLockfile(diff.NewPath); err != nil {
+			return nil, nil, fmt.Errorf("failed to read lockfile: %w", err)
+		}
+		if err := checkLocked(lf, pkgMap, sourceRepo, toInstall, appliedOverrides(cfg, pkgMap, toInstall)); err != nil {
+			return nil, nil, fmt.Errorf("the config doesn't resolve to %s: %w", diff.NewPath, err)
+		}
+		for _, p := range diff.Old.Packages {
+			old[p.Name] = p.Version
+		}
+		m.Base = diff.Old.Version
+	}
+	for i, entry := range direct {
+		src, _ := splitDirectEntry(entry)
+		name := fmt.Sprintf("direct/%d/%s", i, path.Base(src))
+		err := add(name, func(dest string) error {
+			if isRemoteConfig(src) {
+				_, err := downloadFile(src, dest)
+				return err
+			}
+			_, err := copyFileSHA256(src, dest, 0644)
+			return err
+		})
+		if err == nil && isRawTarball(src) {
+			err = add(name+rawMetaSuffix, func(dest string) error {
+				data, err := readRawMeta(src)
+				if err != nil {
+					return err
+				}
+				return os.WriteFile(dest, data, 0644)
+			})
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		m.Direct[src] = name
+	}
+
+	repoDirs := map[string]string{}
+	for i, repo := range cfg.Repos {
+		repoDirs[repo] = fmt.Sprintf("repos/%d", i)
+		m.Repos[repo] = repoDirs[repo]
+		if err := add(repoDirs[repo]+"/"+bundleIndexName, copyFrom(indexCachePath(repo))); err != nil {
+			return nil, nil, err
+		}
+	}
+	sums := map[string]string{}
+	for _, pkg := range toInstall {
+		repo, ok := sourceRepo[pkg]
+		if !ok {
+			continue // direct packages are bundled above, missing ones fail the lockfile
+		}
+		info := pkgMap[pkg]
+		if old[pkg] == info.Version {
+			m.Unchanged[pkg] = info.Version
+			continue
+		}
+		printf("Bundling %s-%s\n", pkg, info.Version)
+		err := add(repoDirs[repo]+"/"+path.Base(info.Filename), func(dest string) (err error) {
+			sums[pkg], err = fetchPackage(repo, info, dest)
+			return err
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	// The manifest only proves the bundle is intact, the packages are checked against
+	// the checksums of the (signed) lockfile when it's applied
+	for i, p := range lf.Packages {
+		sum, ok := sums[p.Name]
+		if !ok && p.Repo == "" {
+			sum, ok = pkgMap[p.Name].SHA256, true // direct packages were fetched while resolving
+		}
+		if !ok {
+			continue // left out of a differential bundle
+		}
+		switch {
+		case diff == nil:
+			lf.Packages[i].SHA256 = sum
+		case p.SHA256 == "":
+			return nil, nil, fmt.Errorf("%s has no checksum for %s, run apkg lock to record it", diff.NewPath, p.Name)
+		case p.SHA256 != sum:
+			return nil, nil, fmt.Errorf("%s doesn't match %s: sha256 %s, locked %s", p.Name, diff.NewPath, sum, p.SHA256)
+		}
+	}
+
+	if err := add(bundleConfigName, func(dest string) error { return os.WriteFile(dest, configData, 0644) }); err != nil {
+		return nil, nil, err
+	}
+	if configKeyring != "" {
+		sig, err := readConfigSource(configPath + ".sig")
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read config signature %s.sig: %w", configPath, err)
+		}
+		if err := add(bundleConfigName+".sig", func(dest string) error { return os.WriteFile(dest, sig, 0644) }); err != nil {
+			return nil, nil, err
+		}
+	}
+	if diff == nil {
+		err = add(bundleLockName, func(dest string) error { return writeLockfile(dest, lf) })
+	} else {
+		// The lockfile is bundled as is so its signature still verifies
+		err = add(bundleLockName, copyFrom(diff.NewPath))
+		if _, statErr := os.Stat(diff.NewPath + ".sig"); err == nil && statErr == nil {
+			err = add(bundleLockName+".sig", copyFrom(diff.NewPath+".sig"))
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := yaml.Marshal(m)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, lf, os.WriteFile(filepath.Join(dir, bundleManifestName), data, 0644)
+}
+
+// cmdBundle implements `apkg bundle create [-o <file>] [-sign] [-key <id>]`, archiving the
+// config, a lockfile and everything it installs, `apkg bundle diff [-o <file>] <old.lock>
+// <new.lock>`, archiving only what changed between two lockfiles, and `apkg bundle apply
+// [-dry-run] <file>`, installing either without network access
+func cmdBundle(configPath string, args []string) int {
+	if len(args) > 0 && args[0] == "apply" {
+		return bundleApply(args[1:])
+	}
+	if len(args) == 0 || (args[0] != "create" && args[0] != "diff") {
+		eprintf("[FATAL] Usage: apkg bundle create [-o <file>] | apkg bundle diff [-o <file>] <old.lock> <new.lock> | apkg bundle apply <file>\n")
+		return 1
+	}
+	fs := flag.NewFlagSet("bundle "+args[0], flag.ExitOnError)
+	out := fs.String("o", "bundle.tar", "Where to write the bundle")
+	var sign *bool
+	var key *string
+	if args[0] == "create" {
+		sign = fs.Bool("sign", false, "Sign the bundled lockfile with gpg")
+		key = fs.String("key", "", "GPG key to sign with (default: gpg's default key)")
+	}
+	fs.Parse(args[1:])
+	var diff *bundleDiff
+	if args[0] == "diff" {
+		if fs.NArg() != 2 {
+			eprintf("[FATAL] Usage: apkg bundle diff [-o <file>] <old.lock> <new.lock>\n")
+			return 1
+		}
+		old, err := readLockfile(fs.Arg(0))
+		if err != nil {
+			eprintf("[FATAL] Failed to read lockfile: %v\n", err)
+			return 1
+		}
+		diff = &bundleDiff{Old: old, NewPath: fs.Arg(1)}
+	}
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		eprintf("[FATAL] Failed to read config: %v\n", err)
+		return 1
+	}
+	globalConfig = cfg
+	workDir, err := newWorkDir("run")
+	if err != nil {
+		eprintf("[FATAL] Failed to create temp dir: %v\n", err)
+		return 3
+	}
+	defer cleanupTempDirs(workDir)
+	dir := filepath.Join(workDir, "bundle")
+	m, lf, err := stageBundle(configPath, cfg, dir, workDir, diff)
+	if err != nil {
+		eprintf("[FATAL] %v\n", err)
+		return 2
+	}
+	if sign != nil && *sign {
+		lockPath := filepath.Join(dir, bundleLockName)
+		err := signLockfile(lockPath, *key)
+		if err == nil {
+			err = rehashBundleFile(dir, bundleLockName+".sig")
+		}
+		if err != nil {
+			eprintf("[FATAL] %v\n", err)
+			return 1
+		}
+	}
+	if err := writeBundle(dir, *out); err != nil {
+		eprintf("[FATAL] Failed to write %s: %v\n", *out, err)
+		return 1
+	}
+	if diff != nil {
+		printf("Bundled %d changed packages from %d repos in %s, %d unchanged ones are left out\n", len(lf.Packages)-len(m.Unchanged), len(cfg.Repos), *out, len(m.Unchanged))
+		return 0
+	}
+	printf("Bundled %d packages from %d repos in %s\n", len(lf.Packages), len(cfg.Repos), *out)
+	return 0
+}
+
+// rehashBundleFile adds a file written after staging to the manifest of the bundle in dir
+func rehashBundleFile(dir, name string) error {
+	manifest := filepath.Join(dir, bundleManifestName)
+	data, err := os.ReadFile(manifest)
+	if err != nil {
+		return err
+	}
+	var m BundleManifest
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	m.Files[name] = fileSHA256(filepath.Join(dir, filepath.FromSlash(name)))
+	if data, err = yaml.Marshal(&m); err != nil {
+		return err
+	}
+	return os.WriteFile(manifest, data, 0644)
+}
+
+// bundleApply extracts a bundle and runs apkg on it with -locked and -bundle-dir, which
+// verify every file and refuse the network
+func bundleApply(args []string) int {
+	fs := flag.NewFlagSet("bundle apply", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Show what the bundle would change without installing it")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		eprintf("[FATAL] Usage: apkg bundle apply [-dry-run] <file>\n")
+		return 1
+	}
+	workDir, err := newWorkDir("run")
+	if err != nil {
+		eprintf("[FATAL] Failed to create temp dir: %v\n", err)
+		return 3
+	}
+	defer cleanupTempDirs(workDir)
+	if err := extractBundle(fs.Arg(0), workDir); err != nil {
+		eprintf("[FATAL] Failed to extract %s: %v\n", fs.Arg(0), err)
+		return 1
+	}
+	self, err := os.Executable()
+	if err != nil {
+		eprintf("[FATAL] %v\n", err)
+		return 1
+	}
+	cmdArgs := []string{"-config", filepath.Join(workDir, bundleConfigName), "-state-dir", stateDir, "-locked", "-bundle-dir", workDir}
+	if configKeyring != "" {
+		cmdArgs = append(cmdArgs, "-config-keyring", configKeyring)
+	}
+	if lockKeyring != "" {
+		cmdArgs = append(cmdArgs, "-lock-keyring", lockKeyring)
+	}
+	if *dryRun {
+		cmdArgs = append(cmdArgs, "-dry-run")
+	}
+	cmd := exec.Command(self, cmdArgs...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		if exit, ok := err.(*exec.ExitError); ok {
+			return exit.ExitCode()
+		}
+		eprintf("[FATAL] %v\n", err)
+		return 4
+	}
+	return 0
+}
@@ -0,0 +1,136 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBundle(t *testing.T) {
+	oldState, oldCfg, oldData := stateDir, globalConfig, configData
+	stateDir = t.TempDir()
+	defer func() {
+		stateDir, globalConfig, configData = oldState, oldCfg, oldData
+		bundleDir, bundle = "", nil
+	}()
+
+	apk := tarGz(".PKGINFO", "pkgname = hello\npkgver = 1.0-r0\n")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/APKINDEX.tar.gz":
+			w.Write([]byte("P:hello\nV:1.0-r0\n\nP:unused\nV:2.0-r0\n\n"))
+		case "/hello-1.0-r0.apk":
+			w.Write(apk)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	configData = []byte("repos: [" + srv.URL + "]\npackages: [hello]\n")
+	cfg := &Config{Repos: []string{srv.URL}, Packages: []string{"hello"}}
+	globalConfig = cfg
+	work := t.TempDir()
+	_, lf, err := stageBundle("apkg.yaml", cfg, filepath.Join(work, "bundle"), work, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(apk)
+	if len(lf.Packages) != 1 || lf.Packages[0].Name != "hello" || lf.Packages[0].SHA256 != hex.EncodeToString(sum[:]) {
+		t.Fatalf("locked %+v", lf.Packages)
+	}
+
+	// A differential bundle has to match the checksums of its new lockfile
+	badLock := filepath.Join(work, "bad.lock")
+	writeLockfile(badLock, &Lockfile{Packages: []LockedPkg{{Name: "hello", Version: "1.0-r0", Repo: srv.URL, SHA256: "00"}}})
+	badDiff := &bundleDiff{Old: &Lockfile{}, NewPath: badLock}
+	if _, _, err := stageBundle("apkg.yaml", cfg, filepath.Join(work, "bad"), work, badDiff); err == nil || !strings.Contains(err.Error(), "doesn't match") {
+		t.Errorf("expected a checksum mismatch against the lockfile, got %v", err)
+	}
+
+	// A differential bundle against a lockfile with the same hello leaves it out
+	newLock := filepath.Join(work, "new.lock")
+	writeLockfile(newLock, lf)
+	cfg.Packages = []string{"hello"}
+	diff := &bundleDiff{Old: &Lockfile{Version: "1", Packages: []LockedPkg{{Name: "hello", Version: "1.0-r0"}}}, NewPath: newLock}
+	dm, _, err := stageBundle("apkg.yaml", cfg, filepath.Join(work, "diff"), work, diff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dm.Unchanged["hello"] != "1.0-r0" || dm.Base != "1" {
+		t.Errorf("diff manifest %+v", dm)
+	}
+	if _, err := os.Stat(filepath.Join(work, "diff", dm.Repos[srv.URL], "hello-1.0-r0.apk")); err == nil {
+		t.Error("an unchanged package was bundled")
+	}
+	bundle = dm
+	pkgMap := map[string]APKPackage{"hello": {Name: "hello", Version: "1.0-r0"}}
+	if err := checkBundleBase([]string{"hello"}, pkgMap, map[string]string{}); err == nil {
+		t.Error("expected a differential bundle to need hello installed")
+	}
+	if !bundleOmits("hello", pkgMap, map[string]string{"hello": "1.0-r0"}) {
+		t.Error("expected the installed hello to be kept")
+	}
+	bundle = nil
+
+	tarPath := filepath.Join(work, "bundle.tar")
+	if err := writeBundle(filepath.Join(work, "bundle"), tarPath); err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+
+	dir := t.TempDir()
+	if err := extractBundle(tarPath, dir); err != nil {
+		t.Fatal(err)
+	}
+	m, err := loadBundle(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, m.Repos[srv.URL], "unused-2.0-r0.apk")); err == nil {
+		t.Error("a package that isn't installed was bundled")
+	}
+
+	// The repo is down, everything comes from the bundle and the network is refused
+	bundleDir, bundle = dir, m
+	pkgs, _, err := fetchIndex(srv.URL)
+	if err != nil || pkgs["hello"].Version != "1.0-r0" {
+		t.Fatalf("index from the bundle: %v, %v", pkgs, err)
+	}
+	if _, err := fetchPackage(srv.URL, pkgs["hello"], filepath.Join(t.TempDir(), "hello.apk")); err != nil {
+		t.Errorf("package from the bundle: %v", err)
+	}
+	if _, err := httpGet(srv.URL + "/APKINDEX.tar.gz"); err == nil || !strings.Contains(err.Error(), "no network") {
+		t.Errorf("expected the network to be refused, got %v", err)
+	}
+
+	// The bundled packages need checksums in the lockfile
+	unsummed := filepath.Join(work, "unsummed.yaml")
+	writeLockfile(strings.TrimSuffix(unsummed, ".yaml")+".lock", &Lockfile{Packages: []LockedPkg{{Name: "hello", Version: "1.0-r0", Repo: srv.URL}}})
+	err = enforceLockfile(unsummed, pkgs, map[string]string{"hello": srv.URL}, []string{"hello"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "no checksums for hello") {
+		t.Errorf("expected a bundle lockfile without checksums to be refused, got %v", err)
+	}
+
+	// Any tampering fails verification
+	os.WriteFile(filepath.Join(dir, bundleConfigName), []byte("packages: [evil]\n"), 0644)
+	if _, err := loadBundle(dir); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected a checksum mismatch, got %v", err)
+	}
+	os.WriteFile(filepath.Join(dir, bundleConfigName), configData, 0644)
+	os.WriteFile(filepath.Join(dir, "extra"), nil, 0644)
+	if _, err := loadBundle(dir); err == nil || !strings.Contains(err.Error(), "not listed") {
+		t.Errorf("expected the unlisted file to be refused, got %v", err)
+	}
+}
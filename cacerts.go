@@ -0,0 +1,310 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/pem"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// caShareDir holds the certificates shipped by ca-certificates
+	caShareDir = "usr/share/ca-certificates"
+	// caLocalDir holds certificates added by hand
+	caLocalDir = "usr/local/share/ca-certificates"
+	// caConfFile selects which certificates of caShareDir are trusted
+	caConfFile = "etc/ca-certificates.conf"
+	// caCertsDir gets a link per trusted certificate and the bundle
+	caCertsDir = "etc/ssl/certs"
+	// caBundle is the concatenation of every trusted certificate
+	caBundle = "ca-certificates.crt"
+)
+
+// trustedCerts returns the certificates update-ca-certificates would trust, relative to root
+func trustedCerts(root string) ([]string, error) {
+	var certs []string
+	f, err := os.Open(filepath.Join(root, caConfFile))
+	switch {
+	case err == nil:
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			line := strings.TrimSpace(sc.Text())
+			// ! marks a deselected certificate
+			if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+				continue
+			}
+			certs = append(certs, filepath.Join(caShareDir, line))
+		}
+		f.Close()
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	case os.IsNotExist(err):
+		// Without a conf every shipped certificate is trusted
+		certs, err = findCerts(root, caShareDir)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+	local, err := findCerts(root, caLocalDir)
+	if err != nil {
+		return nil, err
+	}
+	return append(certs, local...), nil
+}
+
+// findCerts lists the .crt files below dir (relative to root)
+func findCerts(root, dir string) ([]string, error) {
+	var certs []string
+	err := filepath.Walk(filepath.Join(root, dir), func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return filepath.SkipDir
+		}
+		if err != nil || info.IsDir() || !strings.HasSuffix(p, ".crt") {
+			return err
+		}
+		rel, _ := filepath.Rel(root, p)
+		certs = append(certs, rel)
+		return nil
+	})
+	sort.Strings(certs)
+	return certs, err
+}
+
+// updateCACertificates is a built-in update-ca-certificates: it links every trusted
+// certificate into etc/ssl/certs as <name>.pem and writes the ca-certificates.crt bundle.
+// Every change goes through tx, so it is audited and rolled back with the packages.
+func updateCACertificates(tx *Transaction) (int, error) {
+	root := tx.installDir
+	certs, err := trustedCerts(root)
+	if err != nil {
+		return 0, err
+	}
+	certsDir := filepath.Join(root, caCertsDir)
+	if err := tx.mkdirAll(caCertsDir, dirMode()); err != nil {
+		return 0, err
+	}
+	var bundle bytes.Buffer
+	linked := make(map[string]string)
+	n := 0
+	for _, rel := range certs {
+		data, err := os.ReadFile(filepath.Join(root, rel))
+		if os.IsNotExist(err) {
+			debugf("install", "%s is selected but gone, not trusting it", rel)
+			continue
+		}
+		if err != nil {
+			eprintf("[WARN] Skipping certificate %s: %v\n", rel, err)
+			continue
+		}
+		if block, _ := pem.Decode(data); block == nil || block.Type != "CERTIFICATE" {
+			eprintf("[WARN] Skipping %s, it isn't a PEM certificate\n", rel)
+			continue
+		}
+		bundle.Write(bytes.TrimSpace(data))
+		bundle.WriteByte('\n')
+		// Relative links resolve inside root, also for the host's openssl rehash below
+		linkRel := filepath.Join(caCertsDir, strings.TrimSuffix(filepath.Base(rel), ".crt")+".pem")
+		want, err := filepath.Rel(caCertsDir, rel)
+		if err != nil {
+			return n, err
+		}
+		if target, err := os.Readlink(filepath.Join(root, linkRel)); err != nil || target != want {
+			if err := tx.prepareWrite(linkRel); err != nil {
+				return n, err
+			}
+			os.Remove(filepath.Join(root, linkRel))
+			if err := os.Symlink(want, filepath.Join(root, linkRel)); err != nil {
+				return n, err
+			}
+		}
+		linked[filepath.Base(linkRel)] = rel
+		n++
+	}
+	if err := pruneCertLinks(tx, linked); err != nil {
+		return n, err
+	}
+	bundleRel := filepath.Join(caCertsDir, caBundle)
+	if old, err := os.ReadFile(filepath.Join(root, bundleRel)); err != nil || !bytes.Equal(old, bundle.Bytes()) {
+		if err := tx.prepareWrite(bundleRel); err != nil {
+			return n, err
+		}
+		tmp := filepath.Join(certsDir, caBundle+".apkg-new")
+		if err := os.WriteFile(tmp, bundle.Bytes(), 0644); err != nil {
+			return n, err
+		}
+		if err := os.Rename(tmp, filepath.Join(root, bundleRel)); err != nil {
+			return n, err
+		}
+	}
+	// OpenSSL's CApath lookups need <subject hash>.0 links, the host's openssl can make them
+	if openssl, err := exec.LookPath("openssl"); err == nil {
+		before := hashLinks(certsDir)
+		if out, err := exec.Command(openssl, "rehash", certsDir).CombinedOutput(); err != nil {
+			eprintf("[WARN] openssl rehash failed: %v\n%s", err, out)
+		}
+		if err := journalHashLinks(tx, before); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// hashLinks maps the OpenSSL hash links in certsDir to their targets
+func hashLinks(certsDir string) map[string]string {
+	links := make(map[string]string)
+	entries, _ := os.ReadDir(certsDir)
+	for _, e := range entries {
+		if e.Type()&os.ModeSymlink == 0 || !certHashLink.MatchString(e.Name()) {
+			continue
+		}
+		if target, err := os.Readlink(filepath.Join(certsDir, e.Name())); err == nil {
+			links[e.Name()] = target
+		}
+	}
+	return links
+}
+
+// journalHashLinks journals the hash links openssl rehash changed, before maps the links
+// to the targets they had. openssl can't write through tx, so the journal entries and the
+// backups (made from before) follow the changes here.
+func journalHashLinks(tx *Transaction, before map[string]string) error {
+	after := hashLinks(filepath.Join(tx.installDir, caCertsDir))
+	for name, target := range before {
+		rel := filepath.Join(caCertsDir, name)
+		now, kept := after[name]
+		if tx.touched[rel] || (kept && now == target) {
+			continue
+		}
+		tx.touched[rel] = true
+		action := txRemove
+		if kept {
+			action = txReplace
+		}
+		if err := tx.record(action, rel); err != nil {
+			return err
+		}
+		backup := tx.backupPath(rel)
+		if err := os.MkdirAll(filepath.Dir(backup), 0755); err != nil {
+			return err
+		}
+		if err := os.Symlink(target, backup); err != nil {
+			return err
+		}
+	}
+	for name := range after {
+		rel := filepath.Join(caCertsDir, name)
+		if _, existed := before[name]; existed || tx.touched[rel] {
+			continue
+		}
+		tx.touched[rel] = true
+		if err := tx.record(txCreate, rel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// certHashLink matches the <subject hash>.<n> links of OpenSSL's CApath, r marks CRLs
+var certHashLink = regexp.MustCompile(`^[0-9a-f]{8}\.r?[0-9]+$`)
+
+// certLinkPath returns the path relative to root a link in caCertsDir points at, absolute
+// targets (of earlier versions or other tools) are taken as inside root as well
+func certLinkPath(target string) string {
+	if filepath.IsAbs(target) {
+		return strings.TrimPrefix(filepath.Clean(target), "/")
+	}
+	return filepath.Join(caCertsDir, target)
+}
+
+// isCertDirPath reports whether rel (relative to root) is in the certificate dirs
+func isCertDirPath(rel string) bool {
+	return strings.HasPrefix(rel, caShareDir+"/") || strings.HasPrefix(rel, caLocalDir+"/")
+}
+
+// pruneCertLinks removes the links into the certificate dirs of certificates no longer
+// trusted (linked maps the links just made to the certificates), and then the hash links
+// left dangling by that, by removed packages or pointing at an untrusted certificate
+func pruneCertLinks(tx *Transaction, linked map[string]string) error {
+	root := tx.installDir
+	certsDir := filepath.Join(root, caCertsDir)
+	trusted := make(map[string]bool, len(linked))
+	for _, rel := range linked {
+		trusted[rel] = true
+	}
+	entries, err := os.ReadDir(certsDir)
+	if err != nil {
+		return nil
+	}
+	var hashLinks []string
+	for _, e := range entries {
+		if e.Type()&os.ModeSymlink == 0 {
+			continue
+		}
+		name := e.Name()
+		if certHashLink.MatchString(name) {
+			hashLinks = append(hashLinks, name)
+			continue
+		}
+		target, err := os.Readlink(filepath.Join(certsDir, name))
+		if _, ok := linked[name]; err != nil || ok || !strings.HasSuffix(name, ".pem") {
+			continue
+		}
+		if isCertDirPath(certLinkPath(target)) {
+			debugf("install", "removing stale link %s -> %s", name, target)
+			if err := tx.removeFile(filepath.Join(caCertsDir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, name := range hashLinks {
+		target, err := os.Readlink(filepath.Join(certsDir, name))
+		if err != nil {
+			continue
+		}
+		rel := certLinkPath(target)
+		_, err = os.Lstat(filepath.Join(root, rel))
+		if os.IsNotExist(err) || (isCertDirPath(rel) && !trusted[rel]) {
+			debugf("install", "removing stale hash link %s -> %s", name, target)
+			if err := tx.removeFile(filepath.Join(caCertsDir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runCACertsHook regenerates etc/ssl/certs in tx when one of files, the files of the
+// packages tx installs, upgrades or removes, is a certificate and the trigger script of
+// ca-certificates won't run because scripts are disabled
+func runCACertsHook(cfg *Config, tx *Transaction, files []string) {
+	if cfg.RunScripts {
+		return
+	}
+	for _, rel := range files {
+		if !isCertDirPath(filepath.ToSlash(rel)) {
+			continue
+		}
+		tx.setPackage("")
+		n, err := updateCACertificates(tx)
+		if err != nil {
+			eprintf("[WARN] Failed to update CA certificates: %v\n", err)
+		} else {
+			printf("Updated %s with %d CA certificates\n", filepath.Join(caCertsDir, caBundle), n)
+		}
+		return
+	}
+}
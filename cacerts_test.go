@@ -0,0 +1,133 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// certsTx begins a transaction against root with the state in a temp dir
+func certsTx(t *testing.T, root string) *Transaction {
+	t.Helper()
+	tx, err := beginTransaction(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+func TestUpdateCACertificates(t *testing.T) {
+	oldState := stateDir
+	stateDir = t.TempDir()
+	defer func() { stateDir = oldState }()
+	root := t.TempDir()
+	write := func(rel string, data []byte) {
+		os.MkdirAll(filepath.Join(root, filepath.Dir(rel)), 0755)
+		os.WriteFile(filepath.Join(root, rel), data, 0644)
+	}
+	cert := func(b byte) []byte {
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte{b, b, b}})
+	}
+	write(caShareDir+"/mozilla/Root_A.crt", cert(1))
+	write(caShareDir+"/mozilla/Root_B.crt", cert(2))
+	write(caLocalDir+"/corp.crt", cert(3))
+	write(caConfFile, []byte("# comment\nmozilla/Root_A.crt\n!mozilla/Root_B.crt\n"))
+
+	tx := certsTx(t, root)
+	n, err := updateCACertificates(tx)
+	if err != nil || n != 2 {
+		t.Fatalf("expected 2 certificates, got %d, %v", n, err)
+	}
+	tx.commit()
+	bundle, _ := os.ReadFile(filepath.Join(root, caCertsDir, caBundle))
+	if strings.Count(string(bundle), "BEGIN CERTIFICATE") != 2 || strings.Contains(string(bundle), string(cert(2))) {
+		t.Errorf("unexpected bundle:\n%s", bundle)
+	}
+	// Links are relative so they resolve inside root
+	if target, _ := os.Readlink(filepath.Join(root, caCertsDir, "Root_A.pem")); target != "../../../"+caShareDir+"/mozilla/Root_A.crt" {
+		t.Errorf("unexpected link target %q", target)
+	}
+	if _, err := os.Stat(filepath.Join(root, caCertsDir, "corp.pem")); err != nil {
+		t.Errorf("corp.pem doesn't resolve inside the root: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(root, caCertsDir, "Root_B.pem")); err == nil {
+		t.Error("deselected certificate was linked")
+	}
+
+	// Without openssl, which would redo the hash links itself
+	t.Setenv("PATH", "")
+	// Deselecting a certificate later drops its link and the hash link pointing at it
+	certs := filepath.Join(root, caCertsDir)
+	os.Symlink("Root_A.pem", filepath.Join(certs, "0123abcd.0"))
+	os.Symlink("/"+caShareDir+"/mozilla/Root_A.crt", filepath.Join(certs, "0123abcd.1"))
+	os.Symlink("corp.pem", filepath.Join(certs, "89abcdef.0"))
+	os.Symlink("/etc/ssl/other.pem", filepath.Join(certs, "other.pem"))
+	write(caConfFile, []byte("!mozilla/Root_A.crt\n!mozilla/Root_B.crt\n"))
+	tx = certsTx(t, root)
+	if n, err := updateCACertificates(tx); err != nil || n != 1 {
+		t.Fatalf("expected 1 certificate, got %d, %v", n, err)
+	}
+	tx.commit()
+	for name, kept := range map[string]bool{"Root_A.pem": false, "0123abcd.0": false, "0123abcd.1": false, "89abcdef.0": true, "corp.pem": true, "other.pem": true} {
+		if _, err := os.Lstat(filepath.Join(certs, name)); (err == nil) != kept {
+			t.Errorf("%s: kept %v, want %v", name, err == nil, kept)
+		}
+	}
+}
+
+func TestCACertsHookOnRemoval(t *testing.T) {
+	oldState := stateDir
+	stateDir = t.TempDir()
+	defer func() { stateDir = oldState }()
+	t.Setenv("PATH", "")
+	root := t.TempDir()
+	corp := caLocalDir + "/corp.crt"
+	os.MkdirAll(filepath.Join(root, caLocalDir), 0755)
+	os.WriteFile(filepath.Join(root, corp), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte{3}}), 0644)
+	tx := certsTx(t, root)
+	runCACertsHook(&Config{}, tx, []string{corp})
+	tx.commit()
+	bundle := filepath.Join(root, caCertsDir, caBundle)
+	installed, _ := os.ReadFile(bundle)
+	if !strings.Contains(string(installed), "BEGIN CERTIFICATE") {
+		t.Fatalf("corp.crt isn't in the bundle:\n%s", installed)
+	}
+
+	// Removing the package that ships the certificate stops trusting it, in the
+	// removal's transaction
+	tx = certsTx(t, root)
+	if err := tx.removeFile(corp); err != nil {
+		t.Fatal(err)
+	}
+	runCACertsHook(&Config{}, tx, []string{corp})
+	if data, _ := os.ReadFile(bundle); strings.Contains(string(data), "BEGIN CERTIFICATE") {
+		t.Errorf("removed certificate is still in the bundle:\n%s", data)
+	}
+	if _, err := os.Lstat(filepath.Join(root, caCertsDir, "corp.pem")); err == nil {
+		t.Error("removed certificate is still linked")
+	}
+	journaled := map[string]bool{}
+	for _, e := range tx.entries {
+		journaled[e.rel] = true
+	}
+	if !journaled[filepath.Join(caCertsDir, caBundle)] || !journaled[filepath.Join(caCertsDir, "corp.pem")] {
+		t.Errorf("bundle and link changes weren't journaled: %+v", tx.entries)
+	}
+	if err := tx.rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(bundle); string(data) != string(installed) {
+		t.Errorf("rollback didn't restore the bundle:\n%s", data)
+	}
+	if _, err := os.Stat(filepath.Join(root, caCertsDir, "corp.pem")); err != nil {
+		t.Errorf("rollback didn't restore the link: %v", err)
+	}
+}
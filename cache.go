@@ -0,0 +1,149 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// fetchPackage fetches the .apk of info from repo to dest, through the shared
+// package cache when cache_dir is set, checks it against the trust level of repo
+// and returns its sha256. Verified alpine-keys packages add their keys to the trusted ones.
+func fetchPackage(repo string, info APKPackage, dest string) (string, error) {
+	var sum string
+	var err error
+	if globalConfig == nil || globalConfig.CacheDir == "" {
+		sum, err = fetchFromMirrorOrPeer(repo, info, dest)
+	} else {
+		sum, err = cachedFetch(globalConfig.CacheDir, repo, info, dest)
+	}
+	if err == nil {
+		err = checkTrust(repo, info.Filename, dest)
+	}
+	if err == nil && info.Name == keysPackage && trustLevel(repo) != trustOff {
+		if lerr := learnKeys(dest, info, repo); lerr != nil {
+			eprintf("[WARN] Not learning the keys of %s: %v\n", info.Filename, lerr)
+		}
+	}
+	return sum, err
+}
+
+// lockCacheEntry takes the exclusive lock of a cache entry, waiting for other
+// apkg processes working on the same entry
+func lockCacheEntry(path string) (func(), error) {
+	f, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// validCacheEntry checks a cached .apk against its recorded sha256 and the index size,
+// returning the sha256 of a valid entry
+func validCacheEntry(path string, size int64) (string, bool) {
+	info, err := os.Stat(path)
+	if err != nil || (size > 0 && info.Size() != size) {
+		return "", false
+	}
+	want, err := os.ReadFile(path + ".sha256")
+	if err != nil {
+		return "", false
+	}
+	sum := strings.TrimSpace(string(want))
+	return sum, sum == fileSHA256(path)
+}
+
+// cacheEntryPath returns where cache_dir keeps filename of repo
+func cacheEntryPath(cacheDir, repo, filename string) string {
+	sum := sha256.Sum256([]byte(strings.TrimRight(repo, "/")))
+	return filepath.Join(cacheDir, hex.EncodeToString(sum[:8]), filename)
+}
+
+// fetchFromMirrorOrPeer fetches info from a peer having it, from the source of repo otherwise,
+// in parallel ranges when it's large and the mirror publishes a Metalink for it
+func fetchFromMirrorOrPeer(repo string, info APKPackage, dest string) (string, error) {
+	if sum, ok := fetchFromPeers(repo, info, dest); ok {
+		countFileTraffic(repo, info.Name, fromPeer, dest)
+		return sum, nil
+	}
+	sum, ok := fetchSegmented(repo, info, dest)
+	if !ok {
+		var err error
+		if sum, err = measuredFetch(sourceFor(repo), info.Filename, dest); err != nil {
+			return "", err
+		}
+	}
+	countFileTraffic(repo, info.Name, fromMirror, dest)
+	return sum, nil
+}
+
+// cachedFetch serves info from the cache, downloading it first if it's missing or
+// corrupt. Entries are written to a temp file and renamed into place, their sha256 is
+// recorded last so an interrupted write never counts as a valid entry. The recorded
+// sha256 is the one computed while downloading, the file isn't read back.
+func cachedFetch(cacheDir, repo string, info APKPackage, dest string) (string, error) {
+	path := cacheEntryPath(cacheDir, repo, info.Filename)
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	unlock, err := lockCacheEntry(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to lock cache entry %s: %w", path, err)
+	}
+	defer unlock()
+
+	hash, valid := validCacheEntry(path, info.Size)
+	debugf("cache", "%s: %s (hit: %v)", info.Filename, path, valid)
+	if !valid {
+		os.Remove(path + ".sha256")
+		os.Remove(path)
+		tmp, err := os.CreateTemp(dir, ".fetch-*")
+		if err != nil {
+			return "", err
+		}
+		tmp.Close()
+		defer os.Remove(tmp.Name())
+		if hash, err = fetchFromMirrorOrPeer(repo, info, tmp.Name()); err != nil {
+			return "", err
+		}
+		if st, err := os.Stat(tmp.Name()); err != nil {
+			return "", err
+		} else if info.Size > 0 && st.Size() != info.Size {
+			return "", fmt.Errorf("%s is %d bytes, the index says %d", info.Filename, st.Size(), info.Size)
+		}
+		if err := os.Rename(tmp.Name(), path); err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(path+".sha256.tmp", []byte(hash+"\n"), 0644); err != nil {
+			return "", err
+		}
+		if err := os.Rename(path+".sha256.tmp", path+".sha256"); err != nil {
+			return "", err
+		}
+	} else {
+		printf("Using cached %s\n", info.Filename)
+		countFileTraffic(repo, info.Name, fromCache, path)
+	}
+	if err := os.Link(path, dest); err == nil {
+		return hash, nil
+	}
+	return hash, copyFile(path, dest, 0644)
+}
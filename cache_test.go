@@ -0,0 +1,60 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCachedFetch(t *testing.T) {
+	oldState := stateDir
+	stateDir = t.TempDir() // downloads are measured into traffic.yaml
+	defer func() { stateDir = oldState }()
+	hits := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Write([]byte("package"))
+	}))
+	defer srv.Close()
+	cacheDir, out := t.TempDir(), t.TempDir()
+	info := APKPackage{Name: "foo", Version: "1.0-r0", Filename: "foo-1.0-r0.apk", Size: 7}
+
+	for i, want := range []int{1, 1} {
+		dest := filepath.Join(out, "foo"+string(rune('a'+i))+".apk")
+		sum, err := cachedFetch(cacheDir, srv.URL, info, dest)
+		if err != nil {
+			t.Fatalf("fetch %d: %v", i, err)
+		}
+		if sum != fileSHA256(dest) {
+			t.Errorf("fetch %d: returned sha256 %s doesn't match the file", i, sum)
+		}
+		if hits != want {
+			t.Errorf("fetch %d: %d downloads, want %d", i, hits, want)
+		}
+	}
+
+	// A corrupted entry must be downloaded again instead of being served
+	matches, _ := filepath.Glob(filepath.Join(cacheDir, "*", info.Filename))
+	if len(matches) != 1 {
+		t.Fatalf("expected one cache entry, got %v", matches)
+	}
+	os.Remove(matches[0])
+	os.WriteFile(matches[0], []byte("garbage"), 0644)
+	if _, err := cachedFetch(cacheDir, srv.URL, info, filepath.Join(out, "fooc.apk")); err != nil {
+		t.Fatal(err)
+	}
+	if hits != 2 {
+		t.Errorf("corrupt entry was served from the cache")
+	}
+	if data, _ := os.ReadFile(filepath.Join(out, "fooc.apk")); string(data) != "package" {
+		t.Errorf("got %q", data)
+	}
+}
@@ -0,0 +1,56 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ChannelManifest maps every rollout channel to the lockfile version promoted to it
+type ChannelManifest struct {
+	Channels map[string]string `yaml:"channels"`
+}
+
+// promotedVersion fetches the channel manifest and returns the lockfile version promoted to channel
+func promotedVersion(manifestPath, channel string) (string, error) {
+	data, err := readConfigSource(manifestPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read channel manifest: %w", err)
+	}
+	var m ChannelManifest
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return "", fmt.Errorf("failed to parse channel manifest: %w", err)
+	}
+	ver, ok := m.Channels[channel]
+	if !ok || ver == "" {
+		return "", fmt.Errorf("channel %q is not in the manifest %s", channel, manifestPath)
+	}
+	return ver, nil
+}
+
+// channelAllows reports whether the lockfile of configPath is the version promoted to
+// the configured channel, applies are skipped until it is
+func channelAllows(cfg *Config, configPath string) (bool, error) {
+	if cfg.ChannelManifest == "" {
+		return false, fmt.Errorf("channel %q is set but channel_manifest isn't", cfg.Channel)
+	}
+	promoted, err := promotedVersion(cfg.ChannelManifest, cfg.Channel)
+	if err != nil {
+		return false, err
+	}
+	lf, err := readLockfile(lockfilePath(configPath))
+	if err != nil {
+		return false, fmt.Errorf("failed to read lockfile: %w", err)
+	}
+	if lf.Version != promoted {
+		printf("Lockfile version %q is not promoted to channel %s yet (promoted: %s), nothing to do.\n", lf.Version, cfg.Channel, promoted)
+		return false, nil
+	}
+	return true, nil
+}
@@ -0,0 +1,38 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestChannelAllows(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("channels:\n  canary: \"8\"\n  stable: \"7\"\n"))
+	}))
+	defer srv.Close()
+	configPath := filepath.Join(t.TempDir(), "apkg.yaml")
+	if err := writeLockfile(lockfilePath(configPath), &Lockfile{Version: "8"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for channel, want := range map[string]bool{"canary": true, "stable": false} {
+		ok, err := channelAllows(&Config{Channel: channel, ChannelManifest: srv.URL}, configPath)
+		if err != nil || ok != want {
+			t.Errorf("channel %s: got %v, %v, want %v", channel, ok, err, want)
+		}
+	}
+	if _, err := channelAllows(&Config{Channel: "beta", ChannelManifest: srv.URL}, configPath); err == nil {
+		t.Error("expected a channel missing from the manifest to fail")
+	}
+	if _, err := channelAllows(&Config{Channel: "canary"}, configPath); err == nil {
+		t.Error("expected a channel without a manifest to fail")
+	}
+}
@@ -0,0 +1,171 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// missingLib is a DT_NEEDED entry of an installed file that doesn't resolve in the root
+type missingLib struct {
+	Package string
+	File    string
+	Lib     string
+}
+
+// isELF reports whether the file at p starts with the ELF magic
+func isELF(p string) bool {
+	f, err := os.Open(p)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false
+	}
+	return bytes.Equal(magic, []byte(elf.ELFMAG))
+}
+
+// librarySearchPath returns the dirs the root's dynamic loader searches: the musl
+// path file when there is one, the defaults otherwise
+func librarySearchPath(root string) []string {
+	if file := muslPathFile(root); file != "" {
+		if data, err := os.ReadFile(file); err == nil {
+			return strings.FieldsFunc(string(data), func(r rune) bool { return r == ':' || r == '\n' })
+		}
+	}
+	return append([]string{"/lib64", "/usr/lib64"}, muslDefaultPath...)
+}
+
+// resolvesInRoot reports whether lib is found in one of dirs inside root
+func resolvesInRoot(root, lib string, dirs []string) bool {
+	for _, dir := range dirs {
+		p, err := resolveInRoot(root, path.Join(dir, lib))
+		if err != nil {
+			continue
+		}
+		if info, err := os.Stat(p); err == nil && !info.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// checkLibs resolves the DT_NEEDED entries of every ELF file pkgs installed against
+// the files of root, honouring RPATH/RUNPATH, and returns those that don't resolve
+func checkLibs(root string, pkgs []string) ([]missingLib, error) {
+	search := librarySearchPath(root)
+	var missing []missingLib
+	for _, pkg := range pkgs {
+		files, err := readInstalledFiles(pkg)
+		if err != nil {
+			return nil, fmt.Errorf("reading installed files of %s: %w", pkg, err)
+		}
+		for _, rel := range files {
+			full := filepath.Join(root, rel)
+			if info, err := os.Lstat(full); err != nil || !info.Mode().IsRegular() || !isELF(full) {
+				continue
+			}
+			ef, err := elf.Open(full)
+			if err != nil {
+				continue
+			}
+			needed, _ := ef.ImportedLibraries()
+			var dirs []string
+			for _, tag := range []elf.DynTag{elf.DT_RUNPATH, elf.DT_RPATH} {
+				paths, _ := ef.DynString(tag)
+				for _, p := range paths {
+					for _, d := range strings.Split(p, ":") {
+						dirs = append(dirs, strings.ReplaceAll(d, "$ORIGIN", "/"+path.Dir(rel)))
+					}
+				}
+			}
+			ef.Close()
+			dirs = append(dirs, search...)
+			for _, lib := range needed {
+				if !resolvesInRoot(root, lib, dirs) {
+					missing = append(missing, missingLib{Package: pkg, File: rel, Lib: lib})
+				}
+			}
+		}
+	}
+	return missing, nil
+}
+
+// cmdCheckLibs implements `apkg check-libs`: reports shared libraries installed
+// binaries need but the root doesn't have, exiting 1 when any is missing
+func cmdCheckLibs(configPath string, args []string) int {
+	fs := flag.NewFlagSet("check-libs", flag.ExitOnError)
+	suggest := fs.Bool("suggest", false, "Look up packages providing the missing libraries in the repo indexes")
+	fs.Parse(args)
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		eprintf("[FATAL] Failed to read config: %v\n", err)
+		return 2
+	}
+	globalConfig = cfg
+	installedPkgs, err := readInstalledPkgs(statePath("installed.yaml"))
+	if err != nil {
+		eprintf("[FATAL] Failed to read installed.yaml: %v\n", err)
+		return 2
+	}
+	pkgs := fs.Args()
+	if len(pkgs) == 0 {
+		for name := range installedPkgs {
+			pkgs = append(pkgs, name)
+		}
+	}
+	sort.Strings(pkgs)
+	missing, err := checkLibs(cfg.InstallDir, pkgs)
+	if err != nil {
+		eprintf("[FATAL] %v\n", err)
+		return 2
+	}
+	if len(missing) == 0 {
+		printf("Every shared library needed by the installed files resolves.\n")
+		return 0
+	}
+	var provides map[string][]string
+	if *suggest {
+		pkgMap, sourceRepo, ok := loadIndexForCommand(configPath)
+		if !ok {
+			return 2
+		}
+		provides = providesMap(pkgMap, sourceRepo)
+	}
+	libs := map[string]bool{}
+	for _, m := range missing {
+		printf("%s: /%s needs %s, which isn't installed\n", m.Package, m.File, m.Lib)
+		libs[m.Lib] = true
+	}
+	if provides != nil {
+		names := make([]string, 0, len(libs))
+		for lib := range libs {
+			names = append(names, lib)
+		}
+		sort.Strings(names)
+		for _, lib := range names {
+			if providers := provides["so:"+lib]; len(providers) > 0 {
+				printf("  %s is provided by %s\n", lib, strings.Join(providers, ", "))
+			} else {
+				printf("  %s isn't provided by any package in the repos\n", lib)
+			}
+		}
+	}
+	printf("%d missing libraries in %d files\n", len(libs), len(missing))
+	return 1
+}
@@ -0,0 +1,48 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"debug/elf"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckLibs(t *testing.T) {
+	// Any dynamically linked host binary will do
+	ef, err := elf.Open("/bin/true")
+	if err != nil {
+		t.Skip("no ELF /bin/true on this host")
+	}
+	needed, _ := ef.ImportedLibraries()
+	ef.Close()
+	if len(needed) == 0 {
+		t.Skip("/bin/true is statically linked")
+	}
+	oldState := stateDir
+	stateDir = t.TempDir()
+	defer func() { stateDir = oldState }()
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "bin"), 0755)
+	copyFile("/bin/true", filepath.Join(root, "bin/true"), 0755)
+	writeInstalledFiles("coreutils", []string{"bin/true"})
+
+	missing, err := checkLibs(root, []string{"coreutils"})
+	if err != nil || len(missing) != len(needed) {
+		t.Fatalf("expected %v to be missing, got %+v, %v", needed, missing, err)
+	}
+	// A library reachable through an absolute symlink inside the root resolves
+	os.MkdirAll(filepath.Join(root, "usr/lib"), 0755)
+	for _, lib := range needed {
+		os.WriteFile(filepath.Join(root, "usr/lib", lib+".real"), nil, 0755)
+		os.Symlink("/usr/lib/"+lib+".real", filepath.Join(root, "usr/lib", lib))
+	}
+	if missing, _ := checkLibs(root, []string{"coreutils"}); len(missing) != 0 {
+		t.Errorf("unexpected missing libraries %+v", missing)
+	}
+}
@@ -0,0 +1,158 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// runLockFile is held (flock) by every apkg process that modifies state
+const runLockFile = "apkg.run.lock"
+
+// staleTempMinAge is how old a leftover temp dir must be before it is removed automatically
+const staleTempMinAge = 10 * time.Minute
+
+// tempDirPatterns match the temporary directories apkg creates under tmp_dir
+var tempDirPatterns = []string{"apkg-run-*", "apkg-regen-*"}
+
+// legacyTempDirPatterns match the fixed-name temp dirs older versions created in the working directory
+var legacyTempDirPatterns = []string{"staged", "staging-2", "regen-staging-*"}
+
+// tmpBase returns the configured tmp_dir, defaulting to the working directory
+func tmpBase() string {
+	if globalConfig != nil && globalConfig.TmpDir != "" {
+		return globalConfig.TmpDir
+	}
+	return "."
+}
+
+// workDirOwnerFile in a temp dir holds the state dir of the run that created it, tmp_dir
+// may be shared by apkg processes of several state dirs
+const workDirOwnerFile = ".apkg-state"
+
+// newWorkDir creates a uniquely named temp dir for one run (kind is e.g. "run" or "regen")
+func newWorkDir(kind string) (string, error) {
+	base := tmpBase()
+	if err := os.MkdirAll(base, 0755); err != nil {
+		return "", err
+	}
+	dir, err := os.MkdirTemp(base, "apkg-"+kind+"-*")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, workDirOwnerFile), []byte(stateOwner()+"\n"), 0644); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// stateOwner identifies the state dir of this process in the temp dirs it creates
+func stateOwner() string {
+	if abs, err := filepath.Abs(stateDir); err == nil {
+		return abs
+	}
+	return stateDir
+}
+
+// ownsWorkDir reports whether dir was created by a run of this state dir
+func ownsWorkDir(dir string) bool {
+	owner, err := os.ReadFile(filepath.Join(dir, workDirOwnerFile))
+	return err == nil && strings.TrimSpace(string(owner)) == stateOwner()
+}
+
+// acquireRunLock takes the run lock, failing if another apkg process holds it.
+// The lock is released when the process exits.
+func acquireRunLock() (*os.File, error) {
+	f, err := os.OpenFile(statePath(runLockFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		pid, _ := os.ReadFile(statePath(runLockFile))
+		return nil, fmt.Errorf("another apkg process is running (pid %s)", strings.TrimSpace(string(pid)))
+	}
+	f.Truncate(0)
+	f.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+	return f, nil
+}
+
+// findTempDirs returns leftover temp dirs of this state dir older than minAge, the ones
+// of other state dirs sharing tmp_dir are left to their own runs
+func findTempDirs(minAge time.Duration) []string {
+	var patterns []string
+	for _, p := range tempDirPatterns {
+		patterns = append(patterns, filepath.Join(tmpBase(), p))
+	}
+	legacy := len(patterns)
+	patterns = append(patterns, legacyTempDirPatterns...)
+	var dirs []string
+	for i, pattern := range patterns {
+		matches, _ := filepath.Glob(pattern)
+		for _, m := range matches {
+			info, err := os.Stat(m)
+			if err != nil || !info.IsDir() {
+				continue
+			}
+			if time.Since(info.ModTime()) < minAge {
+				continue
+			}
+			if i < legacy && !ownsWorkDir(m) {
+				continue
+			}
+			dirs = append(dirs, m)
+		}
+	}
+	return dirs
+}
+
+// cleanStaleTempDirs removes temp dirs left behind by crashed runs, the caller must hold the run lock
+func cleanStaleTempDirs(minAge time.Duration) {
+	for _, dir := range findTempDirs(minAge) {
+		eprintf("[WARN] Removing leftover temp dir from an interrupted run: %s\n", dir)
+		if err := os.RemoveAll(dir); err != nil {
+			eprintf("[WARN] Failed to remove %s: %v\n", dir, err)
+		}
+	}
+}
+
+// cmdClean implements `apkg clean [-older-than <duration>]`
+func cmdClean(configPath string, args []string) int {
+	if cfg, err := readConfig(configPath); err == nil {
+		globalConfig = cfg
+	}
+	fs := flag.NewFlagSet("clean", flag.ExitOnError)
+	olderThan := fs.Duration("older-than", 0, "Only remove temp dirs older than this")
+	fs.Parse(args)
+	lock, err := acquireRunLock()
+	if err != nil {
+		eprintf("[ERROR] %v, not cleaning its temp dirs\n", err)
+		return 1
+	}
+	defer lock.Close()
+	dirs := findTempDirs(*olderThan)
+	if len(dirs) == 0 {
+		printf("Nothing to clean.\n")
+		return 0
+	}
+	for _, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			eprintf("[WARN] Failed to remove %s: %v\n", dir, err)
+			continue
+		}
+		printf("Removed %s\n", dir)
+	}
+	return 0
+}
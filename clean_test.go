@@ -0,0 +1,72 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCleanStaleTempDirs(t *testing.T) {
+	oldConfig, oldState := globalConfig, stateDir
+	defer func() { globalConfig, stateDir = oldConfig, oldState }()
+	tmp := t.TempDir()
+	globalConfig = &Config{TmpDir: tmp}
+
+	// Another state dir shares tmp_dir
+	stateDir = t.TempDir()
+	other, err := newWorkDir("run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateDir = t.TempDir()
+	stale, err := newWorkDir("run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh, err := newWorkDir("regen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stale, filepath.Join(tmp, "apkg-run-")) || !strings.HasPrefix(fresh, filepath.Join(tmp, "apkg-regen-")) {
+		t.Fatalf("temp dirs %s and %s not under tmp_dir", stale, fresh)
+	}
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(stale, old, old)
+	os.Chtimes(other, old, old)
+
+	cleanStaleTempDirs(staleTempMinAge)
+	if _, err := os.Stat(stale); err == nil {
+		t.Error("stale temp dir of this state dir was kept")
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Error("temp dir of a running apply was removed")
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Error("temp dir of another state dir was removed")
+	}
+}
+
+func TestRunLock(t *testing.T) {
+	oldState := stateDir
+	defer func() { stateDir = oldState }()
+	stateDir = t.TempDir()
+	lock, err := acquireRunLock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := acquireRunLock(); err == nil || !strings.Contains(err.Error(), "another apkg process") {
+		t.Errorf("second lock = %v", err)
+	}
+	lock.Close()
+	if code := cmdClean("/nonexistent", nil); code != 0 {
+		t.Errorf("clean = %d", code)
+	}
+}
@@ -0,0 +1,95 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+// codec decompresses streams starting with its magic bytes
+type codec struct {
+	name  string
+	magic []byte
+	open  func(io.Reader) (io.ReadCloser, error)
+}
+
+// codecs is the registry decompress picks from, see registerCodec
+var codecs []codec
+
+// registerCodec adds a decompressor for streams starting with magic
+func registerCodec(name string, magic []byte, open func(io.Reader) (io.ReadCloser, error)) {
+	codecs = append(codecs, codec{name: name, magic: magic, open: open})
+}
+
+func init() {
+	registerCodec("gzip", []byte{0x1f, 0x8b}, func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r) // multistream, .apk files are several concatenated gzip streams
+	})
+	registerCodec("bzip2", []byte("BZh"), func(r io.Reader) (io.ReadCloser, error) {
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	})
+	registerCodec("zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}, commandCodec("zstd", "-dc"))
+	registerCodec("xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, commandCodec("xz", "-dc"))
+}
+
+// commandCodec decompresses through an external tool reading stdin and writing stdout
+func commandCodec(name string, args ...string) func(io.Reader) (io.ReadCloser, error) {
+	return func(r io.Reader) (io.ReadCloser, error) {
+		if _, err := exec.LookPath(name); err != nil {
+			return nil, fmt.Errorf("%s compressed data needs the %s command: %w", name, name, err)
+		}
+		cmd := exec.Command(name, args...)
+		cmd.Stdin = r
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		return &commandReader{ReadCloser: out, cmd: cmd, stderr: &stderr}, nil
+	}
+}
+
+// commandReader is the output of a decompressor command, closing it waits for the command
+type commandReader struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+}
+
+func (c *commandReader) Close() error {
+	c.ReadCloser.Close()
+	if err := c.cmd.Wait(); err != nil {
+		return fmt.Errorf("%s: %v: %s", c.cmd.Path, err, bytes.TrimSpace(c.stderr.Bytes()))
+	}
+	return nil
+}
+
+// decompress sniffs the magic bytes of r and returns the decompressed stream and the
+// codec's name. Data matching no codec is returned unchanged with an empty name.
+func decompress(r io.Reader) (io.ReadCloser, string, error) {
+	br := bufio.NewReader(r)
+	for _, c := range codecs {
+		if head, _ := br.Peek(len(c.magic)); bytes.Equal(head, c.magic) {
+			rc, err := c.open(br)
+			if err != nil {
+				return nil, c.name, fmt.Errorf("failed to open %s stream: %w", c.name, err)
+			}
+			return rc, c.name, nil
+		}
+	}
+	return io.NopCloser(br), "", nil
+}
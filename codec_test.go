@@ -0,0 +1,66 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os/exec"
+	"testing"
+)
+
+func TestDecompress(t *testing.T) {
+	// Concatenated gzip streams, as in .apk files, read as one
+	var gz bytes.Buffer
+	for _, part := range []string{"hello ", "world"} {
+		w := gzip.NewWriter(&gz)
+		w.Write([]byte(part))
+		w.Close()
+	}
+	inputs := map[string][]byte{"gzip": gz.Bytes(), "": []byte("hello world")}
+	for _, tool := range []string{"xz", "zstd", "bzip2"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			continue
+		}
+		cmd := exec.Command(tool, "-c")
+		cmd.Stdin = bytes.NewReader([]byte("hello world"))
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%s: %v", tool, err)
+		}
+		inputs[tool] = out
+	}
+	for name, input := range inputs {
+		rc, codec, err := decompress(bytes.NewReader(input))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		data, err := io.ReadAll(rc)
+		if err == nil {
+			err = rc.Close()
+		}
+		if codec != name || string(data) != "hello world" || err != nil {
+			t.Errorf("%s: got codec %q, %q, %v", name, codec, data, err)
+		}
+	}
+}
+
+func TestCommandCodecFailure(t *testing.T) {
+	if _, err := exec.LookPath("xz"); err != nil {
+		t.Skip("xz not installed")
+	}
+	rc, _, err := decompress(bytes.NewReader([]byte{0xfd, '7', 'z', 'X', 'Z', 0x00, 'j', 'u', 'n', 'k'}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, rc)
+	if err := rc.Close(); err == nil {
+		t.Error("expected corrupt xz data to fail on close")
+	}
+}
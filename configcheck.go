@@ -0,0 +1,381 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configCheck validates the values of the config keys it names
+type configCheck struct {
+	keys  []string
+	check func(cfg *Config) error
+}
+
+// configChecks run on every config read, the first failing one rejects it
+var configChecks = []configCheck{
+	{[]string{"repos"}, validateRepoURLs},
+	{[]string{"packages"}, validatePins},
+	{[]string{"alpine_mirror"}, func(cfg *Config) error {
+		if u, err := url.Parse(cfg.AlpineMirror); cfg.AlpineMirror != "" && cfg.AlpineMirror != autoMirror && (err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https")) {
+			return fmt.Errorf("alpine_mirror %q is not an http(s) URL or auto", cfg.AlpineMirror)
+		}
+		return nil
+	}},
+	{[]string{"alpine_archive"}, func(cfg *Config) error {
+		if u, err := url.Parse(cfg.AlpineArchive); cfg.AlpineArchive != "" && cfg.AlpineArchive != "off" && (err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https")) {
+			return fmt.Errorf("alpine_archive %q is not an http(s) URL or off", cfg.AlpineArchive)
+		}
+		return nil
+	}},
+	{[]string{"network"}, func(cfg *Config) error { return cfg.Network.validate() }},
+	{[]string{"extraction"}, func(cfg *Config) error { return cfg.Extraction.validate() }},
+	{[]string{"scanners"}, validateScanners},
+	{[]string{"peers"}, func(cfg *Config) error { return cfg.Peers.validate() }},
+	{[]string{"strip"}, func(cfg *Config) error {
+		if cfg.Strip != "" && cfg.Strip != stripModeStrip && cfg.Strip != stripModeSplit {
+			return fmt.Errorf("unknown strip mode %q (known: strip, split)", cfg.Strip)
+		}
+		return nil
+	}},
+	{[]string{"library_cache"}, func(cfg *Config) error {
+		if cfg.LibraryCache != "" && cfg.LibraryCache != "auto" && cfg.LibraryCache != "off" {
+			return fmt.Errorf("unknown library_cache %q (known: auto, off)", cfg.LibraryCache)
+		}
+		return nil
+	}},
+	{[]string{"kernel_keep"}, func(cfg *Config) error {
+		if cfg.KernelKeep != nil && *cfg.KernelKeep < 0 {
+			return fmt.Errorf("kernel_keep must not be negative")
+		}
+		return nil
+	}},
+	{[]string{"trust"}, validateTrust},
+	{[]string{"routes"}, validateRoutes},
+	{[]string{"package_options"}, validatePackageOptions},
+	{[]string{"dependency_overrides"}, validateDependencyOverrides},
+	{[]string{"aliases"}, validateAliases},
+	{[]string{"optional_groups", "with_optional"}, validateOptionalGroups},
+	{[]string{"umask", "dir_mode"}, validateModes},
+	{[]string{"auto_upgrade.interval"}, func(cfg *Config) error {
+		if cfg.AutoUpgrade.Interval != "" {
+			if d, err := time.ParseDuration(cfg.AutoUpgrade.Interval); err != nil || d <= 0 {
+				return fmt.Errorf("auto_upgrade.interval %q is not a positive duration", cfg.AutoUpgrade.Interval)
+			}
+		}
+		return nil
+	}},
+	{[]string{"generations_keep"}, func(cfg *Config) error {
+		if cfg.GenerationsKeep < 0 {
+			return fmt.Errorf("generations_keep must not be negative")
+		}
+		return nil
+	}},
+	{[]string{"on_failure", "package_timeout"}, validateFailurePolicy},
+	{[]string{"install_mode"}, func(cfg *Config) error {
+		if cfg.InstallMode != "" && cfg.InstallMode != "staged" && cfg.InstallMode != installModeStreaming {
+			return fmt.Errorf("unknown install_mode %q (known: staged, streaming)", cfg.InstallMode)
+		}
+		return nil
+	}},
+}
+
+// validateConfig runs every config check and returns the first problem
+func validateConfig(cfg *Config) error {
+	for _, c := range configChecks {
+		if err := c.check(cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateRepoURLs checks that repos are http(s) URLs, optionally behind git+ or deb+,
+// once alpine: shorthands are expanded
+func validateRepoURLs(cfg *Config) error {
+	for _, repo := range cfg.Repos {
+		if strings.HasPrefix(repo, alpineRepoPrefix) {
+			return fmt.Errorf("repo %q is not alpine:<branch>/<repo> (e.g. alpine:v3.20/main or alpine:edge/community)", repo)
+		}
+		raw := strings.TrimPrefix(strings.TrimPrefix(repo, "git+"), "deb+")
+		u, err := url.Parse(raw)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && !(strings.HasPrefix(repo, "git+") && u.Scheme != "")) {
+			return fmt.Errorf("repo %q is not an http(s) URL (or a git+/deb+ one)", repo)
+		}
+	}
+	return nil
+}
+
+// decodeConfig decodes YAML strictly into cfg, keys Config doesn't know are errors
+func decodeConfig(data []byte, cfg *Config) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err := dec.Decode(cfg)
+	if err == nil {
+		splitPins(cfg)
+	}
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		return &configDecodeError{problems: explainDecodeErrors(typeErr.Errors)}
+	}
+	return err
+}
+
+// configDecodeError lists every problem found while decoding a config
+type configDecodeError struct {
+	problems []string
+}
+
+func (e *configDecodeError) Error() string {
+	return strings.Join(e.problems, "; ")
+}
+
+// unknownField matches the yaml.v3 error of a key the target type lacks
+var unknownField = regexp.MustCompile(`^line (\d+): field (\S+) not found in type main\.(\w+)$`)
+
+// explainDecodeErrors rewrites unknown key errors of the decoder to suggest the key
+// that was probably meant
+func explainDecodeErrors(errs []string) []string {
+	fields := configFields()
+	out := make([]string, len(errs))
+	for i, e := range errs {
+		m := unknownField.FindStringSubmatch(e)
+		if m == nil {
+			out[i] = e
+			continue
+		}
+		out[i] = fmt.Sprintf("line %s: unknown key %s", m[1], m[2])
+		if s := closestKey(m[2], fields[m[3]]); s != "" {
+			out[i] += fmt.Sprintf(" (did you mean %s?)", s)
+		}
+	}
+	return out
+}
+
+// configFields maps the struct types of the config to their YAML keys
+func configFields() map[string][]string {
+	fields := map[string][]string{}
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice || t.Kind() == reflect.Map {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct || fields[t.Name()] != nil {
+			return
+		}
+		fields[t.Name()] = []string{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+			if !f.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = strings.ToLower(f.Name)
+			}
+			fields[t.Name()] = append(fields[t.Name()], name)
+			walk(f.Type)
+		}
+	}
+	walk(reflect.TypeOf(Config{}))
+	return fields
+}
+
+// closestKey returns the key within edit distance 2 of name, empty if there is none
+func closestKey(name string, keys []string) string {
+	best, bestDist := "", 3
+	for _, k := range keys {
+		if d := editDistance(name, k); d < bestDist {
+			best, bestDist = k, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance of a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// configProblem is a problem `apkg config validate` reports, Line is 0 when unknown
+type configProblem struct {
+	Line    int
+	Message string
+	Warning bool
+}
+
+// keyLine returns the line of a dotted key (e.g. auto_upgrade.interval) in a YAML document, 0 if it's missing
+func keyLine(doc *yaml.Node, key string) int {
+	n := doc
+	if n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+		n = n.Content[0]
+	}
+	line := 0
+	for _, part := range strings.Split(key, ".") {
+		if n.Kind != yaml.MappingNode {
+			return line
+		}
+		found := false
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if n.Content[i].Value == part {
+				line, n, found = n.Content[i].Line, n.Content[i+1], true
+				break
+			}
+		}
+		if !found {
+			return line
+		}
+	}
+	return line
+}
+
+// lintConfig finds every problem of a config instead of stopping at the first one, lines
+// are only known for YAML configs
+func lintConfig(path string, data []byte) []configProblem {
+	data, format, err := configToYAML(path, data)
+	if err != nil {
+		return []configProblem{{Message: err.Error()}}
+	}
+	problems := lintYAML(data)
+	if format != formatYAML {
+		for i := range problems {
+			problems[i].Line = 0
+		}
+	}
+	return problems
+}
+
+// lintYAML lints a YAML config
+func lintYAML(data []byte) []configProblem {
+	var problems []configProblem
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return []configProblem{{Message: strings.TrimPrefix(err.Error(), "yaml: ")}}
+	}
+	var cfg Config
+	if err := decodeConfig(data, &cfg); err != nil {
+		var decErr *configDecodeError
+		if !errors.As(err, &decErr) {
+			return []configProblem{{Message: err.Error()}}
+		}
+		for _, p := range decErr.problems {
+			line := 0
+			if rest, ok := strings.CutPrefix(p, "line "); ok {
+				if n, msg, ok := strings.Cut(rest, ": "); ok {
+					line, _ = strconv.Atoi(n)
+					p = msg
+				}
+			}
+			problems = append(problems, configProblem{Line: line, Message: p})
+		}
+	}
+	expandAlpineRepos(&cfg)
+	for _, c := range configChecks {
+		err := c.check(&cfg)
+		if err == nil {
+			continue
+		}
+		line := 0
+		for _, k := range c.keys {
+			if l := keyLine(&doc, k); l != 0 && (line == 0 || strings.Contains(err.Error(), k)) {
+				line = l
+			}
+		}
+		problems = append(problems, configProblem{Line: line, Message: err.Error()})
+	}
+	if cfg.InstallDir != "" && !filepath.IsAbs(cfg.InstallDir) {
+		problems = append(problems, configProblem{Line: keyLine(&doc, "install_dir"), Warning: true,
+			Message: fmt.Sprintf("install_dir %q is relative, it depends on the directory apkg runs in", cfg.InstallDir)})
+	}
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Line < problems[j].Line })
+	return problems
+}
+
+// cmdConfigValidate implements `apkg config validate [file]`: every problem of the config
+// with its line, exit 1 when any of them is an error
+func cmdConfigValidate(configPath string, args []string) int {
+	if len(args) > 0 {
+		configPath = args[0]
+	}
+	var data []byte
+	var err error
+	if configPath == "-" {
+		data, err = readLimited(os.Stdin, maxConfigSize, "config")
+	} else {
+		data, err = readConfigSource(configPath)
+	}
+	if err != nil {
+		eprintf("[FATAL] Failed to read config: %v\n", err)
+		return 1
+	}
+	errs := 0
+	for _, p := range lintConfig(configPath, data) {
+		kind := "error"
+		if p.Warning {
+			kind = "warning"
+		} else {
+			errs++
+		}
+		if p.Line > 0 {
+			printf("%s:%d: %s: %s\n", configPath, p.Line, kind, p.Message)
+		} else {
+			printf("%s: %s: %s\n", configPath, kind, p.Message)
+		}
+	}
+	if errs > 0 {
+		return 1
+	}
+	printf("%s is valid.\n", configPath)
+	return 0
+}
+
+// cmdConfig implements `apkg config <subcommand>`
+func cmdConfig(configPath string, args []string) int {
+	if len(args) == 0 {
+		eprintf("Usage: %s [flags] config validate [file] | get <key> | set <key> <value> | unset <key> | add-repo <url> | remove-repo <url>\n", os.Args[0])
+		return 1
+	}
+	switch args[0] {
+	case "validate":
+		return cmdConfigValidate(configPath, args[1:])
+	case "get":
+		return cmdConfigGet(configPath, args[1:])
+	case "set", "unset", "add-repo", "remove-repo":
+		return cmdConfigEdit(configPath, args[0], args[1:])
+	}
+	eprintf("[FATAL] Unknown config subcommand %q (known: validate, get, set, unset, add-repo, remove-repo)\n", args[0])
+	return 1
+}
@@ -0,0 +1,54 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLintConfig(t *testing.T) {
+	data := []byte(`repos:
+  - htps://dl-cdn.alpinelinux.org/alpine/v3.22/main/x86_64
+packages:
+  - busybox
+instal_dir: /srv/root
+strip: maybe
+package_options:
+  busybox:
+    exlude: [usr/share/doc]
+auto_upgrade:
+  interval: soon
+`)
+	problems := lintConfig("apkg.yaml", data)
+	want := []struct {
+		line int
+		text string
+	}{
+		{1, "htps://"},
+		{5, "unknown key instal_dir (did you mean install_dir?)"},
+		{6, "unknown strip mode"},
+		{9, "unknown key exlude (did you mean exclude?)"},
+		{11, "auto_upgrade.interval"},
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("got %+v", problems)
+	}
+	for i, w := range want {
+		if problems[i].Line != w.line || !strings.Contains(problems[i].Message, w.text) || problems[i].Warning {
+			t.Errorf("problem %d: got %+v, want line %d with %q", i, problems[i], w.line, w.text)
+		}
+	}
+
+	var cfg Config
+	if err := decodeConfig([]byte("install_dir: root\ninstal: true\n"), &cfg); err == nil || !strings.Contains(err.Error(), "did you mean install") {
+		t.Errorf("strict decoding: %v", err)
+	}
+	if problems := lintConfig("apkg.yaml", []byte("install_dir: root\n")); len(problems) != 1 || !problems[0].Warning {
+		t.Errorf("relative install_dir: %+v", problems)
+	}
+}
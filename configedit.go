@@ -0,0 +1,289 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configDoc is a config edited as a YAML document, so comments and key order survive
+type configDoc struct {
+	path string
+	root yaml.Node
+}
+
+// loadConfigDoc reads the config at path for editing
+func loadConfigDoc(path string) (*configDoc, error) {
+	if err := checkConfigWritable(path); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	d := &configDoc{path: path}
+	if err := yaml.Unmarshal(data, &d.root); err != nil {
+		return nil, err
+	}
+	if d.root.Kind == 0 {
+		// An empty file, start a mapping
+		d.root = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	return d, nil
+}
+
+// lookup returns the value node of a dotted key, creating missing mappings on the way
+// when create is set, nil when the key doesn't exist
+func (d *configDoc) lookup(key string, create bool) (*yaml.Node, error) {
+	n := d.root.Content[0]
+	parts := strings.Split(key, ".")
+	for i, part := range parts {
+		if n.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("%s is not a mapping", strings.Join(parts[:i], "."))
+		}
+		var next *yaml.Node
+		for j := 0; j+1 < len(n.Content); j += 2 {
+			if n.Content[j].Value == part {
+				next = n.Content[j+1]
+				break
+			}
+		}
+		if next == nil {
+			if !create {
+				return nil, nil
+			}
+			next = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: part}, next)
+		}
+		n = next
+	}
+	return n, nil
+}
+
+// unset removes a dotted key, reporting whether it was there
+func (d *configDoc) unset(key string) (bool, error) {
+	parent := d.root.Content[0]
+	if i := strings.LastIndex(key, "."); i >= 0 {
+		var err error
+		if parent, err = d.lookup(key[:i], false); err != nil || parent == nil {
+			return false, err
+		}
+		key = key[i+1:]
+	}
+	if parent.Kind != yaml.MappingNode {
+		return false, nil
+	}
+	for j := 0; j+1 < len(parent.Content); j += 2 {
+		if parent.Content[j].Value == key {
+			parent.Content = append(parent.Content[:j], parent.Content[j+2:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// parseValue parses a value given on the command line as YAML, so true is a bool and
+// [a, b] a list
+func parseValue(value string) (*yaml.Node, error) {
+	var n yaml.Node
+	if err := yaml.Unmarshal([]byte(value), &n); err != nil {
+		return nil, fmt.Errorf("%q is not a valid value: %w", value, err)
+	}
+	if len(n.Content) == 0 {
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: ""}, nil
+	}
+	return n.Content[0], nil
+}
+
+// set replaces the value of a dotted key, keeping the comments attached to the old value
+func (d *configDoc) set(key, value string) error {
+	v, err := parseValue(value)
+	if err != nil {
+		return err
+	}
+	n, err := d.lookup(key, true)
+	if err != nil {
+		return err
+	}
+	v.HeadComment, v.LineComment, v.FootComment = n.HeadComment, n.LineComment, n.FootComment
+	*n = *v
+	return nil
+}
+
+// addToList appends value to the list at key unless it's already there, reporting whether it was added
+func (d *configDoc) addToList(key, value string) (bool, error) {
+	n, err := d.lookup(key, true)
+	if err != nil {
+		return false, err
+	}
+	if n.Kind == yaml.MappingNode && len(n.Content) == 0 {
+		// Just created by lookup
+		*n = yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	}
+	if n.Kind != yaml.SequenceNode {
+		return false, fmt.Errorf("%s is not a list", key)
+	}
+	for _, item := range n.Content {
+		if item.Value == value {
+			return false, nil
+		}
+	}
+	n.Content = append(n.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value})
+	return true, nil
+}
+
+// removeFromList drops value from the list at key, reporting whether it was there
+func (d *configDoc) removeFromList(key, value string) (bool, error) {
+	n, err := d.lookup(key, false)
+	if err != nil || n == nil {
+		return false, err
+	}
+	if n.Kind != yaml.SequenceNode {
+		return false, fmt.Errorf("%s is not a list", key)
+	}
+	for i, item := range n.Content {
+		if item.Value == value {
+			n.Content = append(n.Content[:i], n.Content[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// save validates the edited config like readConfig would and replaces the file with it.
+// The document is re-encoded: comments, key order, quoting and flow style are kept, blank
+// lines are dropped and indentation becomes two spaces. A symlinked config is written
+// through to its target.
+func (d *configDoc) save() error {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&d.root); err != nil {
+		return err
+	}
+	enc.Close()
+	var cfg Config
+	if err := decodeConfig(buf.Bytes(), &cfg); err != nil {
+		return err
+	}
+	expandAlpineRepos(&cfg)
+	if err := validateConfig(&cfg); err != nil {
+		return err
+	}
+	path := d.path
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	}
+	mode := os.FileMode(0644)
+	if st, err := os.Stat(path); err == nil {
+		mode = st.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".apkg-config-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// cmdConfigGet prints the value of a dotted key, scalars as they are and the rest as YAML
+func cmdConfigGet(configPath string, args []string) int {
+	if len(args) != 1 {
+		eprintf("Usage: %s [flags] config get <key>\n", os.Args[0])
+		return 1
+	}
+	data, err := readConfigSource(configPath)
+	if err != nil {
+		eprintf("[FATAL] Failed to read config: %v\n", err)
+		return 1
+	}
+	if data, _, err = configToYAML(configPath, data); err != nil {
+		eprintf("[FATAL] Failed to read config: %v\n", err)
+		return 1
+	}
+	d := &configDoc{path: configPath}
+	if err := yaml.Unmarshal(data, &d.root); err != nil || d.root.Kind == 0 {
+		eprintf("[FATAL] Failed to read config: %v\n", err)
+		return 1
+	}
+	n, err := d.lookup(args[0], false)
+	if err != nil || n == nil {
+		eprintf("[ERROR] %s is not set\n", args[0])
+		return 1
+	}
+	if n.Kind == yaml.ScalarNode {
+		fmt.Println(n.Value)
+		return 0
+	}
+	out, err := yaml.Marshal(n)
+	if err != nil {
+		eprintf("[ERROR] %v\n", err)
+		return 1
+	}
+	fmt.Print(string(out))
+	return 0
+}
+
+// cmdConfigEdit implements the config subcommands that modify it: set, unset,
+// add-repo and remove-repo
+func cmdConfigEdit(configPath, sub string, args []string) int {
+	want := 2
+	if sub != "set" {
+		want = 1
+	}
+	if len(args) != want {
+		eprintf("Usage: %s [flags] config set <key> <value> | unset <key> | add-repo <url> | remove-repo <url>\n", os.Args[0])
+		return 1
+	}
+	d, err := loadConfigDoc(configPath)
+	if err != nil {
+		eprintf("[FATAL] Failed to read config: %v\n", err)
+		return 1
+	}
+	changed := true
+	switch sub {
+	case "set":
+		err = d.set(args[0], args[1])
+	case "unset":
+		changed, err = d.unset(args[0])
+	case "add-repo":
+		changed, err = d.addToList("repos", args[0])
+	case "remove-repo":
+		changed, err = d.removeFromList("repos", args[0])
+	}
+	if err != nil {
+		eprintf("[FATAL] %v\n", err)
+		return 1
+	}
+	if !changed {
+		printf("Config unchanged.\n")
+		return 0
+	}
+	if err := d.save(); err != nil {
+		eprintf("[FATAL] The edited config is invalid, it wasn't written: %v\n", err)
+		return 1
+	}
+	printf("Config updated.\n")
+	return 0
+}
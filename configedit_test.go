@@ -0,0 +1,70 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigEdit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apkg.yaml")
+	os.WriteFile(path, []byte("# Mirrors\nrepos:\n  - https://a.example.com/main\npackages:\n  - busybox\nresolve_deps: false # for now\n"), 0640)
+	for _, args := range [][]string{
+		{"set", "resolve_deps", "true"},
+		{"set", "auto_upgrade.interval", "12h"},
+		{"add-repo", "https://b.example.com/community"},
+		{"remove-repo", "https://a.example.com/main"},
+	} {
+		if code := cmdConfig(path, args); code != 0 {
+			t.Fatalf("config %v exited %d", args, code)
+		}
+	}
+	data, _ := os.ReadFile(path)
+	out := string(data)
+	for _, want := range []string{"# Mirrors", "resolve_deps: true # for now", "interval: 12h", "  - https://b.example.com/community"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("%q missing from\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "a.example.com") {
+		t.Errorf("repo wasn't removed:\n%s", out)
+	}
+	if st, _ := os.Stat(path); st.Mode().Perm() != 0640 {
+		t.Errorf("mode changed to %v", st.Mode().Perm())
+	}
+	cfg, err := readConfig(path)
+	if err != nil || !cfg.ResolveDeps || cfg.AutoUpgrade.Interval != "12h" {
+		t.Fatalf("edited config reads as %+v, %v", cfg, err)
+	}
+
+	// Invalid results are never written
+	if code := cmdConfig(path, []string{"set", "strip", "sometimes"}); code == 0 {
+		t.Error("invalid value accepted")
+	}
+	if code := cmdConfig(path, []string{"set", "instal_dir", "/"}); code == 0 {
+		t.Error("unknown key accepted")
+	}
+	if after, _ := os.ReadFile(path); string(after) != out {
+		t.Errorf("rejected edits changed the file:\n%s", after)
+	}
+
+	// A symlinked config is edited in its target, the link stays
+	link := filepath.Join(t.TempDir(), "apkg.yaml")
+	os.Symlink(path, link)
+	if code := cmdConfig(link, []string{"set", "resolve_deps", "false"}); code != 0 {
+		t.Fatalf("config set through a symlink exited %d", code)
+	}
+	if st, err := os.Lstat(link); err != nil || st.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("the symlink was replaced: %v", err)
+	}
+	if data, _ := os.ReadFile(path); !strings.Contains(string(data), "resolve_deps: false") {
+		t.Errorf("the target wasn't edited:\n%s", data)
+	}
+}
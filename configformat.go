@@ -0,0 +1,549 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config formats, TOML and JSON configs are converted to YAML and then read like one
+const (
+	formatYAML = "yaml"
+	formatTOML = "toml"
+	formatJSON = "json"
+)
+
+// defaultConfigNames are tried in order when -config isn't given and apkg.yaml doesn't exist
+var defaultConfigNames = []string{"apkg.yaml", "apkg.toml", "apkg.json"}
+
+// defaultConfigPath returns the first of defaultConfigNames that exists, apkg.yaml if none does
+func defaultConfigPath() string {
+	for _, name := range defaultConfigNames {
+		if _, err := os.Stat(name); err == nil {
+			return name
+		}
+	}
+	return defaultConfigNames[0]
+}
+
+// tomlStart matches the first meaningful line of a TOML document: a table header or a
+// key = value pair
+var tomlStart = regexp.MustCompile(`^(\[\[?[^\]]+\]\]?|[A-Za-z0-9_."'-]+\s*=)`)
+
+// configFormat tells the format of a config from its extension, or its content when
+// the name doesn't say (stdin, URLs)
+func configFormat(path string, data []byte) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		return formatTOML
+	case ".json":
+		return formatJSON
+	case ".yaml", ".yml":
+		return formatYAML
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "{") {
+			return formatJSON
+		}
+		if tomlStart.MatchString(line) {
+			return formatTOML
+		}
+		break
+	}
+	return formatYAML
+}
+
+// configToYAML converts a config of any supported format to YAML
+func configToYAML(path string, data []byte) ([]byte, string, error) {
+	format := configFormat(path, data)
+	var doc any
+	switch format {
+	case formatJSON:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			return nil, format, fmt.Errorf("json: %w", err)
+		}
+		doc = jsonNumbers(doc)
+	case formatTOML:
+		var err error
+		if doc, err = parseTOML(string(data)); err != nil {
+			return nil, format, fmt.Errorf("toml: %w", err)
+		}
+	default:
+		return data, format, nil
+	}
+	out, err := yaml.Marshal(doc)
+	return out, format, err
+}
+
+// withoutLines drops the line numbers from a decode error of a converted config, they
+// are lines of the YAML it was converted to
+func withoutLines(err error) error {
+	var decErr *configDecodeError
+	if !errors.As(err, &decErr) {
+		return err
+	}
+	problems := make([]string, len(decErr.problems))
+	for i, p := range decErr.problems {
+		problems[i] = p
+		if rest, ok := strings.CutPrefix(p, "line "); ok {
+			if _, msg, ok := strings.Cut(rest, ": "); ok {
+				problems[i] = msg
+			}
+		}
+	}
+	return &configDecodeError{problems: problems}
+}
+
+// jsonNumbers turns the json.Numbers of a decoded document into ints or floats
+func jsonNumbers(v any) any {
+	switch t := v.(type) {
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		f, _ := t.Float64()
+		return f
+	case []any:
+		for i := range t {
+			t[i] = jsonNumbers(t[i])
+		}
+	case map[string]any:
+		for k := range t {
+			t[k] = jsonNumbers(t[k])
+		}
+	}
+	return v
+}
+
+// tomlParser parses the TOML configs need: tables, arrays of tables, dotted keys,
+// strings, integers, floats, booleans, arrays and inline tables. Dates are kept as strings.
+type tomlParser struct {
+	s    string
+	pos  int
+	line int
+	// defined holds the tables a [header] defined, inline the inline tables, both are
+	// closed to later headers. arrays holds the arrays of tables by parent and key.
+	defined, inline map[uintptr]bool
+	arrays          map[tomlSlot]bool
+}
+
+// tomlSlot is a key of a table
+type tomlSlot struct {
+	table uintptr
+	key   string
+}
+
+// tableID identifies a table of the document being parsed
+func tableID(t map[string]any) uintptr {
+	return reflect.ValueOf(t).Pointer()
+}
+
+// parseTOML parses a TOML document into maps and slices
+func parseTOML(s string) (map[string]any, error) {
+	p := &tomlParser{s: s, line: 1, defined: map[uintptr]bool{}, inline: map[uintptr]bool{}, arrays: map[tomlSlot]bool{}}
+	root := map[string]any{}
+	cur := root
+	for {
+		p.skipSpace(true)
+		if p.pos >= len(p.s) {
+			return root, nil
+		}
+		var err error
+		if p.s[p.pos] == '[' {
+			cur, err = p.header(root)
+		} else {
+			err = p.keyValue(cur)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", p.line, err)
+		}
+		if err := p.endOfLine(); err != nil {
+			return nil, fmt.Errorf("line %d: %w", p.line, err)
+		}
+	}
+}
+
+// skipSpace skips blanks and comments, and newlines too when newlines is set
+func (p *tomlParser) skipSpace(newlines bool) {
+	for p.pos < len(p.s) {
+		switch c := p.s[p.pos]; {
+		case c == ' ' || c == '\t' || c == '\r':
+			p.pos++
+		case c == '#':
+			for p.pos < len(p.s) && p.s[p.pos] != '\n' {
+				p.pos++
+			}
+		case c == '\n' && newlines:
+			p.pos++
+			p.line++
+		default:
+			return
+		}
+	}
+}
+
+// endOfLine expects nothing but blanks and a comment until the end of the line
+func (p *tomlParser) endOfLine() error {
+	p.skipSpace(false)
+	if p.pos < len(p.s) && p.s[p.pos] != '\n' {
+		return fmt.Errorf("unexpected %q after the value", p.rest())
+	}
+	return nil
+}
+
+// rest returns the remainder of the current line for error messages
+func (p *tomlParser) rest() string {
+	end := strings.IndexByte(p.s[p.pos:], '\n')
+	if end < 0 {
+		return p.s[p.pos:]
+	}
+	return p.s[p.pos : p.pos+end]
+}
+
+// header parses [table] or [[array of tables]] and returns the table that follows
+func (p *tomlParser) header(root map[string]any) (map[string]any, error) {
+	array := strings.HasPrefix(p.s[p.pos:], "[[")
+	if array {
+		p.pos += 2
+	} else {
+		p.pos++
+	}
+	keys, err := p.key()
+	if err != nil {
+		return nil, err
+	}
+	end := "]"
+	if array {
+		end = "]]"
+	}
+	if !strings.HasPrefix(p.s[p.pos:], end) {
+		return nil, fmt.Errorf("table header isn't closed with %s", end)
+	}
+	p.pos += len(end)
+	parent, err := p.table(root, keys[:len(keys)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := keys[len(keys)-1]
+	slot := tomlSlot{tableID(parent), last}
+	if !array {
+		if p.arrays[slot] {
+			return nil, fmt.Errorf("%s is an array of tables", strings.Join(keys, "."))
+		}
+		t, err := p.table(parent, []string{last})
+		if err != nil {
+			return nil, err
+		}
+		if p.defined[tableID(t)] {
+			return nil, fmt.Errorf("table %s is defined twice", strings.Join(keys, "."))
+		}
+		p.defined[tableID(t)] = true
+		return t, nil
+	}
+	list, _ := parent[last].([]any)
+	if _, exists := parent[last]; exists && !p.arrays[slot] {
+		return nil, fmt.Errorf("%s is not an array of tables", strings.Join(keys, "."))
+	}
+	t := map[string]any{}
+	parent[last] = append(list, t)
+	p.arrays[slot] = true
+	return t, nil
+}
+
+// table walks down keys from t, creating missing tables, the last element of an
+// array of tables stands for the array. Inline tables and arrays can't be extended.
+func (p *tomlParser) table(t map[string]any, keys []string) (map[string]any, error) {
+	for _, k := range keys {
+		switch v := t[k].(type) {
+		case nil:
+			next := map[string]any{}
+			t[k] = next
+			t = next
+		case map[string]any:
+			if p.inline[tableID(v)] {
+				return nil, fmt.Errorf("%s is an inline table and can't be extended", k)
+			}
+			t = v
+		case []any:
+			if !p.arrays[tomlSlot{tableID(t), k}] {
+				return nil, fmt.Errorf("%s is not a table", k)
+			}
+			t = v[len(v)-1].(map[string]any)
+		default:
+			return nil, fmt.Errorf("%s is not a table", k)
+		}
+	}
+	return t, nil
+}
+
+// key parses a possibly dotted key of bare and quoted parts
+func (p *tomlParser) key() ([]string, error) {
+	var keys []string
+	for {
+		p.skipSpace(false)
+		if p.pos >= len(p.s) {
+			return nil, fmt.Errorf("missing key")
+		}
+		var k string
+		if c := p.s[p.pos]; c == '"' || c == '\'' {
+			v, err := p.str()
+			if err != nil {
+				return nil, err
+			}
+			k = v
+		} else {
+			start := p.pos
+			for p.pos < len(p.s) && isBareKeyChar(p.s[p.pos]) {
+				p.pos++
+			}
+			if p.pos == start {
+				return nil, fmt.Errorf("invalid key at %q", p.rest())
+			}
+			k = p.s[start:p.pos]
+		}
+		keys = append(keys, k)
+		p.skipSpace(false)
+		if p.pos >= len(p.s) || p.s[p.pos] != '.' {
+			return keys, nil
+		}
+		p.pos++
+	}
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// keyValue parses key = value into t
+func (p *tomlParser) keyValue(t map[string]any) error {
+	keys, err := p.key()
+	if err != nil {
+		return err
+	}
+	if p.pos >= len(p.s) || p.s[p.pos] != '=' {
+		return fmt.Errorf("expected = after %s", strings.Join(keys, "."))
+	}
+	p.pos++
+	p.skipSpace(false)
+	v, err := p.value()
+	if err != nil {
+		return err
+	}
+	parent, err := p.table(t, keys[:len(keys)-1])
+	if err != nil {
+		return err
+	}
+	last := keys[len(keys)-1]
+	if _, exists := parent[last]; exists {
+		return fmt.Errorf("%s is defined twice", strings.Join(keys, "."))
+	}
+	parent[last] = v
+	return nil
+}
+
+// tomlNumber matches integers and floats, with _ separators and 0x/0o/0b prefixes
+var tomlNumber = regexp.MustCompile(`^[+-]?(0x[0-9A-Fa-f_]+|0o[0-7_]+|0b[01_]+|[0-9_]+(\.[0-9_]+)?([eE][+-]?[0-9_]+)?|inf|nan)`)
+
+// tomlDate matches dates and times, they are kept as strings
+var tomlDate = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}([Tt ]\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:\d{2})?)?|^\d{2}:\d{2}:\d{2}(\.\d+)?`)
+
+// value parses a value
+func (p *tomlParser) value() (any, error) {
+	if p.pos >= len(p.s) {
+		return nil, fmt.Errorf("missing value")
+	}
+	switch c := p.s[p.pos]; {
+	case c == '"' || c == '\'':
+		return p.str()
+	case c == '[':
+		return p.array()
+	case c == '{':
+		return p.inlineTable()
+	case strings.HasPrefix(p.s[p.pos:], "true"):
+		p.pos += 4
+		return true, nil
+	case strings.HasPrefix(p.s[p.pos:], "false"):
+		p.pos += 5
+		return false, nil
+	}
+	if m := tomlDate.FindString(p.s[p.pos:]); m != "" {
+		p.pos += len(m)
+		return m, nil
+	}
+	m := tomlNumber.FindString(p.s[p.pos:])
+	if m == "" {
+		return nil, fmt.Errorf("invalid value %q", p.rest())
+	}
+	p.pos += len(m)
+	num := strings.ReplaceAll(m, "_", "")
+	if i, err := strconv.ParseInt(num, 0, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(num, 64); err == nil {
+		return f, nil
+	}
+	return nil, fmt.Errorf("invalid number %q", m)
+}
+
+// array parses [a, b, ...], it may span lines and end with a comma
+func (p *tomlParser) array() ([]any, error) {
+	p.pos++
+	list := []any{}
+	for {
+		p.skipSpace(true)
+		if p.pos >= len(p.s) {
+			return nil, fmt.Errorf("array isn't closed")
+		}
+		if p.s[p.pos] == ']' {
+			p.pos++
+			return list, nil
+		}
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+		p.skipSpace(true)
+		if p.pos < len(p.s) && p.s[p.pos] == ',' {
+			p.pos++
+		} else if p.pos < len(p.s) && p.s[p.pos] != ']' {
+			return nil, fmt.Errorf("expected , or ] in array at %q", p.rest())
+		}
+	}
+}
+
+// inlineTable parses {k = v, ...} on a single line
+func (p *tomlParser) inlineTable() (map[string]any, error) {
+	p.pos++
+	t := map[string]any{}
+	for {
+		p.skipSpace(false)
+		if p.pos >= len(p.s) {
+			return nil, fmt.Errorf("inline table isn't closed")
+		}
+		if p.s[p.pos] == '}' {
+			p.pos++
+			p.inline[tableID(t)] = true
+			return t, nil
+		}
+		if err := p.keyValue(t); err != nil {
+			return nil, err
+		}
+		p.skipSpace(false)
+		if p.pos < len(p.s) && p.s[p.pos] == ',' {
+			p.pos++
+		} else if p.pos < len(p.s) && p.s[p.pos] != '}' {
+			return nil, fmt.Errorf("expected , or } in inline table at %q", p.rest())
+		}
+	}
+}
+
+// str parses basic ("...") and literal ('...') strings, single or multi-line
+func (p *tomlParser) str() (string, error) {
+	q := p.s[p.pos]
+	multi := strings.HasPrefix(p.s[p.pos:], strings.Repeat(string(q), 3))
+	delim := string(q)
+	if multi {
+		delim = strings.Repeat(string(q), 3)
+		p.pos += 3
+		// A newline right after the opening delimiter is trimmed
+		if strings.HasPrefix(p.s[p.pos:], "\r\n") {
+			p.pos += 2
+			p.line++
+		} else if strings.HasPrefix(p.s[p.pos:], "\n") {
+			p.pos++
+			p.line++
+		}
+	} else {
+		p.pos++
+	}
+	var b strings.Builder
+	for {
+		if p.pos >= len(p.s) || (!multi && p.s[p.pos] == '\n') {
+			return "", fmt.Errorf("string isn't closed")
+		}
+		if strings.HasPrefix(p.s[p.pos:], delim) {
+			p.pos += len(delim)
+			return b.String(), nil
+		}
+		c := p.s[p.pos]
+		if c == '\n' {
+			p.line++
+		}
+		if c != '\\' || q == '\'' {
+			b.WriteByte(c)
+			p.pos++
+			continue
+		}
+		p.pos++
+		if p.pos >= len(p.s) {
+			return "", fmt.Errorf("string isn't closed")
+		}
+		e := p.s[p.pos]
+		p.pos++
+		switch e {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case '"', '\\':
+			b.WriteByte(e)
+		case 'u', 'U':
+			n := 4
+			if e == 'U' {
+				n = 8
+			}
+			if p.pos+n > len(p.s) {
+				return "", fmt.Errorf("short \\%c escape", e)
+			}
+			r, err := strconv.ParseUint(p.s[p.pos:p.pos+n], 16, 32)
+			if err != nil || !utf8.ValidRune(rune(r)) {
+				return "", fmt.Errorf("invalid \\%c escape", e)
+			}
+			b.WriteRune(rune(r))
+			p.pos += n
+		case '\n', ' ', '\t', '\r':
+			if !multi {
+				return "", fmt.Errorf("invalid escape \\%c", e)
+			}
+			// A line ending backslash trims the whitespace up to the next text
+			p.pos--
+			for p.pos < len(p.s) && strings.ContainsRune(" \t\r\n", rune(p.s[p.pos])) {
+				if p.s[p.pos] == '\n' {
+					p.line++
+				}
+				p.pos++
+			}
+		default:
+			return "", fmt.Errorf("invalid escape \\%c", e)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConfigFormats(t *testing.T) {
+	dir := t.TempDir()
+	configs := map[string]string{
+		"apkg.yaml": `repos:
+  - https://example.com/main
+packages: [busybox, musl]
+install_dir: /srv/root
+kernel_keep: 2
+package_options:
+  busybox:
+    exclude: [usr/share/doc]
+auto_upgrade:
+  interval: 12h
+`,
+		"apkg.toml": `# same config
+repos = ["https://example.com/main"]
+packages = [
+  "busybox",
+  'musl',  # trailing comma
+]
+install_dir = "/srv/root"
+kernel_keep = 2
+auto_upgrade.interval = "12h"
+
+[package_options.busybox]
+exclude = ["usr/share/doc"]
+`,
+		"apkg.json": `{"repos": ["https:\/\/example.com\/main"], "packages": ["busybox", "musl"],
+ "install_dir": "/srv/root", "kernel_keep": 2,
+ "package_options": {"busybox": {"exclude": ["usr/share/doc"]}},
+ "auto_upgrade": {"interval": "12h"}}
+`,
+	}
+	var want *Config
+	for _, name := range []string{"apkg.yaml", "apkg.toml", "apkg.json"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(configs[name]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := readConfig(path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if want == nil {
+			want = cfg
+		} else if !reflect.DeepEqual(cfg, want) {
+			t.Errorf("%s: got %+v, want %+v", name, cfg, want)
+		}
+	}
+
+	// Content decides for names without a known extension
+	for data, format := range map[string]string{
+		"{\"packages\": []}":         formatJSON,
+		"# c\n[package_options.a]\n": formatTOML,
+		"install_dir = \"/x\"\n":     formatTOML,
+		"install_dir: /x\n":          formatYAML,
+	} {
+		if got := configFormat("-", []byte(data)); got != format {
+			t.Errorf("configFormat(%q) = %s, want %s", data, got, format)
+		}
+	}
+
+	// Strict keys hold for every format
+	if _, err := readConfigFromData(t, dir, "bad.toml", "instal_dir = \"/x\"\n"); err == nil || strings.Contains(err.Error(), "line") || !strings.Contains(err.Error(), "did you mean install_dir") {
+		t.Errorf("unknown TOML key: %v", err)
+	}
+	if problems := lintConfig("apkg.json", []byte(`{"strip": "maybe"}`)); len(problems) != 1 || problems[0].Line != 0 {
+		t.Errorf("lint JSON: %+v", problems)
+	}
+	if err := checkConfigWritable(filepath.Join(dir, "apkg.toml")); err == nil {
+		t.Errorf("TOML config is writable")
+	}
+}
+
+func readConfigFromData(t *testing.T, dir, name, data string) (*Config, error) {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return readConfig(path)
+}
+
+func TestParseTOML(t *testing.T) {
+	doc, err := parseTOML(`title = "a\tb \u00e9"
+lit = 'C:\path'
+multi = """
+one \
+  two"""
+n = 1_000
+hex = 0xff
+f = 1.5
+on = true
+date = 2025-01-02
+inline = { a = 1, "b.c" = [1, 2] }
+
+[[routes]]
+name = "x"
+[[routes]]
+name = "y"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"title": "a\tb é", "lit": `C:\path`, "multi": "one two", "n": int64(1000), "hex": int64(255),
+		"f": 1.5, "on": true, "date": "2025-01-02",
+		"inline": map[string]any{"a": int64(1), "b.c": []any{int64(1), int64(2)}},
+		"routes": []any{map[string]any{"name": "x"}, map[string]any{"name": "y"}},
+	}
+	if !reflect.DeepEqual(doc, want) {
+		t.Errorf("got %#v", doc)
+	}
+	for _, bad := range []string{
+		"a = 1\na = 2\n", "a = \"open\n", "a = [1 2]\n", "[t\n", "a = 1 b\n",
+		"x = []\n[x.y]\n",             // a static array isn't an array of tables
+		"x = []\n[[x]]\n",             // nor can it be extended into one
+		"x = [{a = 1}]\n[x.b]\n",      // even when it holds tables
+		"[a]\nb = 1\n[a]\nc = 2\n",    // a table defined twice
+		"[[a]]\n[a]\n",                // an array of tables reopened as a table
+		"a = {b = 1}\n[a.c]\n",        // an inline table extended by a header
+		"a = {b = 1}\na.c = 2\n",      // or a dotted key
+		"[a]\nb = {c = 1}\n[a.b.d]\n", // also when nested
+		"x = 1\n[x.y]\n",
+	} {
+		if _, err := parseTOML(bad); err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+	// Implicit tables may still be defined later, and every element of an array of tables gets its own subtables
+	for _, good := range []string{"[a.b]\n[a]\nc = 1\n", "[[a]]\n[a.b]\n[[a]]\n[a.b]\n"} {
+		if _, err := parseTOML(good); err != nil {
+			t.Errorf("%q: %v", good, err)
+		}
+	}
+}
+
+func FuzzParseTOML(f *testing.F) {
+	for _, seed := range []string{"a = 1\n", "x = []\n[x.y]\n", "[[a]]\n[a.b]\nc = {d = [1, {e = 'f'}]}\n", "s = \"\"\"\nx\"\"\"\n"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		parseTOML(s) // must not panic
+	})
+}
@@ -0,0 +1,78 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// configKeyring is the GPG keyring the config signature must verify against,
+// set with -config-keyring or APKG_CONFIG_KEYRING. Empty disables verification.
+var configKeyring string
+
+// isRemoteConfig reports whether the config path is an http(s) URL
+func isRemoteConfig(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// maxConfigSize bounds a config (or its signature) read from stdin or a URL
+const maxConfigSize = 4 << 20
+
+// readConfigSource reads a config from a local file or an http(s) URL
+func readConfigSource(path string) ([]byte, error) {
+	if !isRemoteConfig(path) {
+		return os.ReadFile(path)
+	}
+	var data []byte
+	err := withRetries("Fetching "+path, func() error {
+		resp, err := httpGet(path)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		data, err = readLimited(resp.Body, maxConfigSize, path)
+		return err
+	})
+	return data, err
+}
+
+// verifyConfigSignature checks the detached signature <path>.sig over data with gpgv
+func verifyConfigSignature(path string, data []byte) error {
+	if path == "-" {
+		return fmt.Errorf("a config read from stdin can't be verified, its signature has no location")
+	}
+	sig, err := readConfigSource(path + ".sig")
+	if err != nil {
+		return fmt.Errorf("failed to read config signature %s.sig: %w", path, err)
+	}
+	keyring, err := filepath.Abs(configKeyring)
+	if err != nil {
+		return err
+	}
+	tmpDir, err := os.MkdirTemp("", "apkg-configsig-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	dataPath := filepath.Join(tmpDir, "config")
+	sigPath := filepath.Join(tmpDir, "config.sig")
+	if err := os.WriteFile(dataPath, data, 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(sigPath, sig, 0600); err != nil {
+		return err
+	}
+	out, err := exec.Command("gpgv", "--keyring", keyring, sigPath, dataPath).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("config signature verification failed: %v\n%s", err, out)
+	}
+	return nil
+}
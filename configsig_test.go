@@ -0,0 +1,76 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// signWithTestKey signs path with a throwaway GPG key, writing path.sig, and returns a
+// keyring with its public key
+func signWithTestKey(t *testing.T, path string) string {
+	t.Helper()
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg not installed")
+	}
+	home := t.TempDir()
+	gpg := func(args ...string) {
+		cmd := exec.Command("gpg", append([]string{"--homedir", home, "--batch", "--pinentry-mode", "loopback", "--passphrase", ""}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("gpg %v: %v\n%s", args, err, out)
+		}
+	}
+	gpg("--quick-gen-key", "apkg test <test@example.com>", "ed25519", "sign", "never")
+	gpg("--output", path+".sig", "--detach-sign", path)
+	keyring := filepath.Join(t.TempDir(), "keyring.gpg")
+	gpg("--output", keyring, "--export", "test@example.com")
+	return keyring
+}
+
+func TestVerifyConfigSignature(t *testing.T) {
+	oldKeyring := configKeyring
+	defer func() { configKeyring = oldKeyring }()
+	path := filepath.Join(t.TempDir(), "apkg.yaml")
+	data := []byte("repos: [https://example.com/test]\npackages: [foo]\n")
+	os.WriteFile(path, data, 0644)
+	configKeyring = signWithTestKey(t, path)
+
+	if err := verifyConfigSignature(path, data); err != nil {
+		t.Errorf("valid signature rejected: %v", err)
+	}
+	if err := verifyConfigSignature(path, append(data, "  - evil\n"...)); err == nil {
+		t.Error("tampered config accepted")
+	}
+	if err := verifyConfigSignature("-", data); err == nil {
+		t.Error("config from stdin accepted")
+	}
+
+	// Remote configs fetch their signature next to them
+	sig, _ := os.ReadFile(path + ".sig")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/apkg.yaml":
+			w.Write(data)
+		case "/apkg.yaml.sig":
+			w.Write(sig)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	if _, err := readConfig(srv.URL + "/apkg.yaml"); err != nil {
+		t.Errorf("signed remote config: %v", err)
+	}
+	if err := verifyConfigSignature(srv.URL+"/other.yaml", data); err == nil {
+		t.Error("remote config without signature accepted")
+	}
+}
@@ -0,0 +1,77 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// installedControlDir (under the state dir) holds the control files (.PKGINFO, scripts) of every installed package
+const installedControlDir = "installed_control"
+
+// installedControlPath returns the directory holding the control files of pkg
+func installedControlPath(pkg string) string {
+	return filepath.Join(statePath(installedControlDir), pkg)
+}
+
+// saveControlFiles moves the staged control files of pkg into installed_control,
+// replacing the ones of a previously installed version
+func saveControlFiles(stagingDir, pkg string) error {
+	src := controlStagingPath(stagingDir, pkg)
+	if _, err := os.Stat(src); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := os.MkdirAll(statePath(installedControlDir), 0755); err != nil {
+		return err
+	}
+	dest := installedControlPath(pkg)
+	if err := os.RemoveAll(dest); err != nil {
+		return err
+	}
+	return os.Rename(src, dest)
+}
+
+// removeControlFiles forgets the control files of an uninstalled package
+func removeControlFiles(pkg string) error {
+	return os.RemoveAll(installedControlPath(pkg))
+}
+
+// readPkgInfo parses the stored .PKGINFO of an installed package, keys like
+// 'depend' may appear several times so every value is kept
+func readPkgInfo(pkg string) (map[string][]string, error) {
+	f, err := os.Open(filepath.Join(installedControlPath(pkg), ".PKGINFO"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parsePkgInfo(f)
+}
+
+// parsePkgInfo parses .PKGINFO "key = value" lines
+func parsePkgInfo(r io.Reader) (map[string][]string, error) {
+	info := make(map[string][]string)
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, " = ", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		info[kv[0]] = append(info[kv[0]], kv[1])
+	}
+	return info, sc.Err()
+}
@@ -0,0 +1,48 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestControlFiles(t *testing.T) {
+	oldState := stateDir
+	defer func() { stateDir = oldState }()
+	stateDir = t.TempDir()
+	stagingDir := t.TempDir()
+	staged := controlStagingPath(stagingDir, "foo")
+	os.MkdirAll(staged, 0755)
+	os.WriteFile(filepath.Join(staged, ".PKGINFO"), []byte("# generated\npkgname = foo\npkgver = 1.0-r0\ndepend = bar\ndepend = so:libc.musl-x86_64.so.1\n"), 0644)
+	os.WriteFile(filepath.Join(staged, ".post-install"), []byte("#!/bin/sh\n"), 0755)
+	if err := saveControlFiles(stagingDir, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	info, err := readPkgInfo("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info["pkgver"][0] != "1.0-r0" || strings.Join(info["depend"], " ") != "bar so:libc.musl-x86_64.so.1" {
+		t.Errorf("unexpected .PKGINFO: %v", info)
+	}
+	if _, err := os.Stat(filepath.Join(installedControlPath("foo"), ".post-install")); err != nil {
+		t.Errorf("script not kept: %v", err)
+	}
+	// A package without control files leaves nothing behind
+	if err := saveControlFiles(stagingDir, "bar"); err != nil {
+		t.Errorf("saveControlFiles without control files = %v", err)
+	}
+	if err := removeControlFiles("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readPkgInfo("foo"); err == nil {
+		t.Error("control files kept after removal")
+	}
+}
@@ -0,0 +1,400 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// debSourcesDir (under the state dir) keeps the last Packages file of every deb source,
+// packages are looked up in it when they're fetched
+const debSourcesDir = "deb_sources"
+
+// debIndexNames are the Packages files tried in order
+var debIndexNames = []string{"Packages.gz", "Packages.xz", "Packages"}
+
+// debSource is an experimental backend for Debian repositories, written as
+// deb+<mirror url>[#<suite>/<component>/<arch>]. Without the fragment the mirror is a
+// flat repository with Packages next to the .debs. Packages are converted to .apk form
+// when fetched, their maintainer scripts are dropped.
+type debSource struct {
+	base     string
+	indexDir string
+	dir      string
+	pkgs     map[string]debPackage
+}
+
+// debSources keeps the deb sources of this run so their Packages file is only parsed once
+var debSources = make(map[string]*debSource)
+
+// debPackage is what a deb source knows of a package from its Packages stanza
+type debPackage struct {
+	filename string
+	sha256   string
+	size     int64
+}
+
+// newDebSource parses a deb+ repos: entry
+func newDebSource(repo string) *debSource {
+	url := strings.TrimRight(strings.TrimPrefix(repo, "deb+"), "/")
+	s := &debSource{base: url, indexDir: url}
+	if i := strings.LastIndex(url, "#"); i >= 0 {
+		s.base = strings.TrimRight(url[:i], "/")
+		parts := strings.Split(url[i+1:], "/")
+		if len(parts) == 3 {
+			s.indexDir = fmt.Sprintf("%s/dists/%s/%s/binary-%s", s.base, parts[0], parts[1], parts[2])
+		} else {
+			s.indexDir = s.base + "/" + url[i+1:]
+		}
+	}
+	sum := sha256.Sum256([]byte(repo))
+	s.dir = filepath.Join(statePath(debSourcesDir), hex.EncodeToString(sum[:8]))
+	return s
+}
+
+// parseDebStanzas splits a Debian control file into its stanzas, continuation lines
+// are appended to their field
+func parseDebStanzas(r io.Reader) ([]map[string]string, error) {
+	var stanzas []map[string]string
+	cur := map[string]string{}
+	last := ""
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), maxIndexLine)
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.TrimSpace(line) == "":
+			if len(cur) > 0 {
+				stanzas = append(stanzas, cur)
+			}
+			cur, last = map[string]string{}, ""
+		case line[0] == ' ' || line[0] == '\t':
+			if last != "" {
+				cur[last] += "\n" + strings.TrimSpace(line)
+			}
+		default:
+			key, val, ok := strings.Cut(line, ":")
+			if ok {
+				last = key
+				cur[key] = strings.TrimSpace(val)
+			}
+		}
+	}
+	if len(cur) > 0 {
+		stanzas = append(stanzas, cur)
+	}
+	return stanzas, sc.Err()
+}
+
+// debRelations returns the package names of a Depends or Provides field, version
+// constraints and all but the first alternative are dropped
+func debRelations(field string) []string {
+	var names []string
+	for _, rel := range strings.Split(field, ",") {
+		rel, _, _ = strings.Cut(rel, "|")
+		rel, _, _ = strings.Cut(rel, "(")
+		rel, _, _ = strings.Cut(strings.TrimSpace(rel), ":") // arch qualifiers like python3:any
+		if rel = strings.TrimSpace(rel); rel != "" {
+			names = append(names, rel)
+		}
+	}
+	return names
+}
+
+// debToAPKIndex writes the stanzas of a Packages file as APKINDEX text. S: is left out
+// since the fetched .deb is checked against its own size and converted afterwards.
+func debToAPKIndex(w io.Writer, stanzas []map[string]string) {
+	for _, st := range stanzas {
+		if st["Package"] == "" || st["Version"] == "" {
+			continue
+		}
+		fmt.Fprintf(w, "P:%s\nV:%s\n", st["Package"], st["Version"])
+		if deps := debRelations(st["Pre-Depends"] + "," + st["Depends"]); len(deps) > 0 {
+			fmt.Fprintf(w, "D:%s\n", strings.Join(deps, " "))
+		}
+		if provides := debRelations(st["Provides"]); len(provides) > 0 {
+			fmt.Fprintf(w, "p:%s\n", strings.Join(provides, " "))
+		}
+		if st["Source"] != "" {
+			source, _, _ := strings.Cut(st["Source"], " ")
+			fmt.Fprintf(w, "o:%s\n", source)
+		}
+		if st["Maintainer"] != "" {
+			fmt.Fprintf(w, "m:%s\n", st["Maintainer"])
+		}
+		if kib, err := strconv.ParseInt(st["Installed-Size"], 10, 64); err == nil {
+			fmt.Fprintf(w, "I:%d\n", kib*1024)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+func (s *debSource) FetchIndex(dest string) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	download := filepath.Join(s.dir, "Packages.download")
+	defer os.Remove(download)
+	var err error
+	for _, name := range debIndexNames {
+		if _, err = downloadFile(s.indexDir+"/"+name, download); err == nil {
+			break
+		}
+		var perm *permanentError
+		if !errors.As(err, &perm) {
+			return err
+		}
+	}
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(download)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rc, _, err := decompress(f)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	var raw bytes.Buffer
+	stanzas, err := parseDebStanzas(io.TeeReader(rc, &raw))
+	if err != nil {
+		return err
+	}
+	var index bytes.Buffer
+	debToAPKIndex(&index, stanzas)
+	if err := os.WriteFile(dest, index.Bytes(), 0644); err != nil {
+		return err
+	}
+	s.pkgs = nil
+	return os.WriteFile(filepath.Join(s.dir, "Packages"), raw.Bytes(), 0644)
+}
+
+// lookup returns the Packages entry of the .apk name apkg uses for a package
+func (s *debSource) lookup(filename string) (debPackage, error) {
+	if s.pkgs == nil {
+		f, err := os.Open(filepath.Join(s.dir, "Packages"))
+		if err != nil {
+			return debPackage{}, fmt.Errorf("the index of %s hasn't been fetched: %w", s.base, err)
+		}
+		defer f.Close()
+		stanzas, err := parseDebStanzas(f)
+		if err != nil {
+			return debPackage{}, err
+		}
+		s.pkgs = make(map[string]debPackage)
+		for _, st := range stanzas {
+			size, _ := strconv.ParseInt(st["Size"], 10, 64)
+			s.pkgs[st["Package"]+"-"+st["Version"]+".apk"] = debPackage{filename: st["Filename"], sha256: st["SHA256"], size: size}
+		}
+	}
+	p, ok := s.pkgs[filename]
+	if !ok || p.filename == "" {
+		return debPackage{}, fmt.Errorf("%s is not in the index of %s", filename, s.base)
+	}
+	return p, nil
+}
+
+// Fetch downloads the .deb behind filename, checks it against the Packages entry and
+// stores it at dest converted to an .apk
+func (s *debSource) Fetch(filename, dest string) (string, error) {
+	p, err := s.lookup(filename)
+	if err != nil {
+		return "", err
+	}
+	deb := dest + ".deb"
+	defer os.Remove(deb)
+	sum, err := downloadFile(s.base+"/"+p.filename, deb)
+	if err != nil {
+		return "", err
+	}
+	if p.sha256 != "" && sum != p.sha256 {
+		return "", fmt.Errorf("%s has sha256 %s, the index says %s", p.filename, sum, p.sha256)
+	}
+	if st, err := os.Stat(deb); err == nil && p.size > 0 && st.Size() != p.size {
+		return "", fmt.Errorf("%s is %d bytes, the index says %d", p.filename, st.Size(), p.size)
+	}
+	if err := convertDeb(deb, dest); err != nil {
+		return "", fmt.Errorf("failed to convert %s: %w", p.filename, err)
+	}
+	return sum, nil
+}
+
+// arMembers calls fn with the name and content of every member of an ar archive
+func arMembers(r io.Reader, fn func(name string, data io.Reader) error) error {
+	br := bufio.NewReader(r)
+	magic := make([]byte, 8)
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != "!<arch>\n" {
+		return fmt.Errorf("not an ar archive")
+	}
+	hdr := make([]byte, 60)
+	for {
+		if _, err := io.ReadFull(br, hdr); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(strings.TrimSpace(string(hdr[:16])), "/")
+		size, err := strconv.ParseInt(strings.TrimSpace(string(hdr[48:58])), 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad ar member size of %s", name)
+		}
+		data := io.LimitReader(br, size)
+		if err := fn(name, data); err != nil {
+			return err
+		}
+		if _, err := io.Copy(io.Discard, data); err != nil {
+			return err
+		}
+		if size%2 == 1 {
+			br.ReadByte() // members are 2-byte aligned
+		}
+	}
+}
+
+// debPkgInfo renders the control stanza of a .deb as a .PKGINFO
+func debPkgInfo(control map[string]string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "pkgname = %s\npkgver = %s\n", control["Package"], control["Version"])
+	if desc, _, _ := strings.Cut(control["Description"], "\n"); desc != "" {
+		fmt.Fprintf(&b, "pkgdesc = %s\n", desc)
+	}
+	if control["Homepage"] != "" {
+		fmt.Fprintf(&b, "url = %s\n", control["Homepage"])
+	}
+	if kib, err := strconv.ParseInt(control["Installed-Size"], 10, 64); err == nil {
+		fmt.Fprintf(&b, "size = %d\n", kib*1024)
+	}
+	if control["Architecture"] != "" {
+		fmt.Fprintf(&b, "arch = %s\n", control["Architecture"])
+	}
+	if control["Maintainer"] != "" {
+		fmt.Fprintf(&b, "maintainer = %s\n", control["Maintainer"])
+	}
+	for _, dep := range debRelations(control["Pre-Depends"] + "," + control["Depends"]) {
+		fmt.Fprintf(&b, "depend = %s\n", dep)
+	}
+	return b.Bytes()
+}
+
+// convertDeb rewrites the .deb at src as a gzip tar at dest with a .PKGINFO made from
+// its control file followed by its data
+func convertDeb(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	zw := gzip.NewWriter(out)
+	tw := tar.NewWriter(zw)
+	var control map[string]string
+	sawData := false
+	err = arMembers(in, func(name string, data io.Reader) error {
+		switch {
+		case strings.HasPrefix(name, "control.tar"):
+			return eachTarEntry(data, func(hdr *tar.Header, r io.Reader) error {
+				if filepath.Clean(hdr.Name) != "control" {
+					return nil
+				}
+				stanzas, err := parseDebStanzas(r)
+				if err == nil && len(stanzas) > 0 {
+					control = stanzas[0]
+				}
+				return err
+			})
+		case strings.HasPrefix(name, "data.tar"):
+			if control == nil {
+				return fmt.Errorf("data comes before the control file")
+			}
+			info := debPkgInfo(control)
+			if err := tw.WriteHeader(&tar.Header{Name: ".PKGINFO", Mode: 0644, Size: int64(len(info)), Typeflag: tar.TypeReg}); err != nil {
+				return err
+			}
+			if _, err := tw.Write(info); err != nil {
+				return err
+			}
+			sawData = true
+			return copyTarEntries(tw, data)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !sawData {
+		return fmt.Errorf("no data.tar member")
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// copyTarEntries copies the entries of a (compressed) tar stream to tw with their names
+// made relative, the way .apk payloads are laid out
+func copyTarEntries(tw *tar.Writer, r io.Reader) error {
+	return eachTarEntry(r, func(hdr *tar.Header, r io.Reader) error {
+		name := strings.TrimPrefix(filepath.Clean("/"+hdr.Name), "/")
+		if name == "" {
+			return nil
+		}
+		hdr.Name = name
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Name += "/"
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = strings.TrimPrefix(filepath.Clean("/"+hdr.Linkname), "/")
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := io.Copy(tw, r)
+		return err
+	})
+}
+
+// eachTarEntry calls fn for every entry of a (compressed) tar stream
+func eachTarEntry(r io.Reader, fn func(hdr *tar.Header, r io.Reader) error) error {
+	rc, _, err := decompress(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return rc.Close()
+		}
+		if err != nil {
+			rc.Close()
+			return err
+		}
+		if err := fn(hdr, tr); err != nil {
+			rc.Close()
+			return err
+		}
+	}
+}
@@ -0,0 +1,106 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tarGz builds a gzip tar of name to content pairs
+func tarGz(files ...string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for i := 0; i+1 < len(files); i += 2 {
+		tw.WriteHeader(&tar.Header{Name: files[i], Mode: 0755, Size: int64(len(files[i+1])), Typeflag: tar.TypeReg})
+		tw.Write([]byte(files[i+1]))
+	}
+	tw.Close()
+	zw.Close()
+	return buf.Bytes()
+}
+
+// arArchive builds an ar archive of name to content pairs like dpkg-deb does
+func arArchive(members ...[]byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("!<arch>\n")
+	for i := 0; i+1 < len(members); i += 2 {
+		fmt.Fprintf(&buf, "%-16s%-12d%-6d%-6d%-8s%-10d`\n", string(members[i]), 0, 0, 0, "100644", len(members[i+1]))
+		buf.Write(members[i+1])
+		if len(members[i+1])%2 == 1 {
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestDebSource(t *testing.T) {
+	oldState := stateDir
+	stateDir = t.TempDir()
+	defer func() { stateDir = oldState }()
+
+	control := "Package: hello\nVersion: 2.10-3\nArchitecture: amd64\nInstalled-Size: 4\nDepends: libc6 (>= 2.34)\nDescription: example package\n more text\n"
+	deb := arArchive([]byte("debian-binary"), []byte("2.0\n"),
+		[]byte("control.tar.gz"), tarGz("./control", control),
+		[]byte("data.tar.gz"), tarGz("./usr/bin/hello", "#!/bin/sh\necho hello\n"))
+	sum := sha256.Sum256(deb)
+	packages := control + fmt.Sprintf("Filename: pool/main/h/hello/hello_2.10-3_amd64.deb\nSize: %d\nSHA256: %s\n\n", len(deb), hex.EncodeToString(sum[:]))
+	var packagesGz bytes.Buffer
+	zw := gzip.NewWriter(&packagesGz)
+	zw.Write([]byte(packages))
+	zw.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/debian/dists/bookworm/main/binary-amd64/Packages.gz":
+			w.Write(packagesGz.Bytes())
+		case "/debian/pool/main/h/hello/hello_2.10-3_amd64.deb":
+			w.Write(deb)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	src := sourceFor("deb+" + srv.URL + "/debian#bookworm/main/amd64")
+	index := filepath.Join(t.TempDir(), "APKINDEX")
+	if err := src.FetchIndex(index); err != nil {
+		t.Fatal(err)
+	}
+	pkgs, err := parseAPKIndexFile(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := pkgs["hello"]
+	if hello.Version != "2.10-3" || len(hello.Deps) != 1 || hello.Deps[0] != "libc6" || hello.InstalledSize != 4096 {
+		t.Fatalf("unexpected index entry %+v", hello)
+	}
+	apk := filepath.Join(t.TempDir(), hello.Filename)
+	if _, err := src.Fetch(hello.Filename, apk); err != nil {
+		t.Fatal(err)
+	}
+	dest, controlDir := t.TempDir(), t.TempDir()
+	if err := extractApk(apk, dest, controlDir, extractionLimits("", 0)); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dest, "usr/bin/hello")); err != nil || string(data) != "#!/bin/sh\necho hello\n" {
+		t.Errorf("usr/bin/hello = %q, %v", data, err)
+	}
+	if info, err := os.ReadFile(filepath.Join(controlDir, ".PKGINFO")); err != nil || !bytes.Contains(info, []byte("pkgname = hello\n")) {
+		t.Errorf(".PKGINFO = %q, %v", info, err)
+	}
+}
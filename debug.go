@@ -0,0 +1,79 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// debugEnv selects debug output like -debug, it also reaches re-executed workers
+const debugEnv = "APKG_DEBUG"
+
+// debugSubsystems are what -debug can select, "all" selects every one
+var debugSubsystems = []string{
+	"config",  // the config and settings in effect
+	"http",    // requests and their responses
+	"index",   // index fetches, parsing and the cached copies
+	"cache",   // hits and misses of the package cache
+	"resolve", // dependency resolution and the resolve cache
+	"extract", // every archive entry extracted
+	"install", // every file copied into install_dir
+	"tx",      // journal entries of transactions
+}
+
+// debugSpec is the -debug selection as given, debugSelected the subsystems it enables
+var (
+	debugSpec     string
+	debugSelected map[string]bool
+)
+
+// setDebug enables the comma separated subsystems of spec, unknown ones are an error
+func setDebug(spec string) error {
+	selected := map[string]bool{}
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		switch {
+		case s == "":
+		case s == "all":
+			for _, sub := range debugSubsystems {
+				selected[sub] = true
+			}
+		case !isDebugSubsystem(s):
+			return fmt.Errorf("unknown debug selector %q (known: all, %s)", s, strings.Join(debugSubsystems, ", "))
+		default:
+			selected[s] = true
+		}
+	}
+	debugSpec, debugSelected = spec, selected
+	return nil
+}
+
+// isDebugSubsystem reports whether s is one of debugSubsystems
+func isDebugSubsystem(s string) bool {
+	for _, sub := range debugSubsystems {
+		if sub == s {
+			return true
+		}
+	}
+	return false
+}
+
+// debugOn reports whether debug output of sub is enabled
+func debugOn(sub string) bool {
+	return debugSelected[sub]
+}
+
+// debugf prints a debug message of sub on stderr when it's selected. Debug output is for
+// developers and stays untranslated.
+func debugf(sub, format string, a ...any) {
+	if !debugSelected[sub] {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "[DEBUG "+sub+"] "+strings.TrimSuffix(format, "\n")+"\n", a...)
+}
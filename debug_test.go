@@ -0,0 +1,36 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import "testing"
+
+func TestSetDebug(t *testing.T) {
+	defer setDebug("")
+	if err := setDebug("http, resolve"); err != nil {
+		t.Fatal(err)
+	}
+	if !debugOn("http") || !debugOn("resolve") || debugOn("install") {
+		t.Errorf("selected %v, want http and resolve", debugSelected)
+	}
+	if err := setDebug("all"); err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range debugSubsystems {
+		if !debugOn(sub) {
+			t.Errorf("all doesn't select %s", sub)
+		}
+	}
+	if err := setDebug("http,htpp"); err == nil {
+		t.Error("expected an unknown selector to be refused")
+	}
+	if !debugOn("tx") {
+		t.Error("a refused selection replaced the previous one")
+	}
+	if err := setDebug(""); err != nil || len(debugSelected) != 0 {
+		t.Errorf("empty selection enabled %v (%v)", debugSelected, err)
+	}
+}
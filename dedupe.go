@@ -0,0 +1,222 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"gopkg.in/yaml.v3"
+)
+
+// hardlinksFile records which installed paths share an inode after deduplication
+const hardlinksFile = "hardlinks.yaml"
+
+// readHardlinks reads the dedupe groups, every group lists paths relative to install_dir
+func readHardlinks() ([][]string, error) {
+	f, err := os.Open(statePath(hardlinksFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var groups [][]string
+	dec := yaml.NewDecoder(f)
+	if err := dec.Decode(&groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// writeHardlinks writes the dedupe groups, dropping groups with a single path left
+func writeHardlinks(groups [][]string) error {
+	var kept [][]string
+	for _, g := range groups {
+		if len(g) > 1 {
+			kept = append(kept, g)
+		}
+	}
+	if len(kept) == 0 {
+		err := os.Remove(statePath(hardlinksFile))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	f, err := os.Create(statePath(hardlinksFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc := yaml.NewEncoder(f)
+	return enc.Encode(kept)
+}
+
+// forgetHardlinks drops uninstalled paths from the dedupe groups. Removing one
+// link of a group never affects the others so nothing else has to change.
+func forgetHardlinks(files []string) error {
+	groups, err := readHardlinks()
+	if err != nil || len(groups) == 0 {
+		return err
+	}
+	gone := make(map[string]bool, len(files))
+	for _, f := range files {
+		gone[filepath.ToSlash(f)] = true
+	}
+	for i, g := range groups {
+		var kept []string
+		for _, p := range g {
+			if !gone[p] {
+				kept = append(kept, p)
+			}
+		}
+		groups[i] = kept
+	}
+	return writeHardlinks(groups)
+}
+
+// dedupeInstallRoot replaces byte-identical installed files of all packages with
+// hardlinks to a single copy within tx and returns the bytes saved. Files are only
+// linked when their modes and owners match, since linked paths share one inode. The
+// dedupe groups are recorded when tx commits.
+func dedupeInstallRoot(tx *Transaction, installedPkgs map[string]string) (int64, error) {
+	installDir := tx.installDir
+	type candidate struct {
+		pkg  string
+		rel  string
+		size int64
+		mode os.FileMode
+		ino  uint64
+		uid  uint32
+		gid  uint32
+	}
+	bySize := map[int64][]candidate{}
+	for pkg := range installedPkgs {
+		files, err := readInstalledFiles(pkg)
+		if err != nil {
+			continue
+		}
+		for _, rel := range files {
+			info, err := os.Lstat(installPath(installDir, rel))
+			if err != nil || !info.Mode().IsRegular() || info.Size() == 0 {
+				continue
+			}
+			st, ok := info.Sys().(*syscall.Stat_t)
+			if !ok {
+				continue
+			}
+			bySize[info.Size()] = append(bySize[info.Size()], candidate{pkg, filepath.ToSlash(rel), info.Size(), info.Mode(), st.Ino, st.Uid, st.Gid})
+		}
+	}
+	groups, err := readHardlinks()
+	if err != nil {
+		return 0, err
+	}
+	var saved int64
+	for _, cands := range bySize {
+		if len(cands) < 2 {
+			continue
+		}
+		byHash := map[string][]candidate{}
+		for _, c := range cands {
+			h := fmt.Sprintf("%s %s %d:%d", fileSHA256(installPath(installDir, c.rel)), c.mode, c.uid, c.gid)
+			byHash[h] = append(byHash[h], c)
+		}
+		for _, same := range byHash {
+			if len(same) < 2 {
+				continue
+			}
+			sort.Slice(same, func(i, j int) bool { return same[i].rel < same[j].rel })
+			first := same[0]
+			group := []string{first.rel}
+			for _, c := range same[1:] {
+				group = append(group, c.rel)
+				if c.ino == first.ino {
+					continue // already linked
+				}
+				tx.setPackage(c.pkg)
+				if err := tx.prepareWrite(c.rel); err != nil {
+					return saved, err
+				}
+				if err := os.Link(installPath(installDir, first.rel), installPath(installDir, c.rel)); err != nil {
+					return saved, err
+				}
+				saved += c.size
+			}
+			groups = mergeHardlinkGroup(groups, group)
+		}
+	}
+	tx.deferCommit(func() {
+		if err := writeHardlinks(groups); err != nil {
+			eprintf("[WARN] Failed to update %s: %v\n", hardlinksFile, err)
+		}
+	})
+	return saved, nil
+}
+
+// mergeHardlinkGroup adds group to groups, merging it with any group sharing a path
+func mergeHardlinkGroup(groups [][]string, group []string) [][]string {
+	members := map[string]bool{}
+	for _, p := range group {
+		members[p] = true
+	}
+	var out [][]string
+	for _, g := range groups {
+		overlap := false
+		for _, p := range g {
+			if members[p] {
+				overlap = true
+				break
+			}
+		}
+		if !overlap {
+			out = append(out, g)
+			continue
+		}
+		for _, p := range g {
+			members[p] = true
+		}
+	}
+	merged := make([]string, 0, len(members))
+	for p := range members {
+		merged = append(merged, p)
+	}
+	sort.Strings(merged)
+	return append(out, merged)
+}
+
+// runDedupe deduplicates the install root in a transaction of its own when dedupe is
+// enabled and reports the savings, a failure rolls back every link it made
+func runDedupe(cfg *Config, installedPkgs map[string]string) {
+	if !cfg.Dedupe {
+		return
+	}
+	tx, err := beginTransaction(cfg.InstallDir)
+	if err != nil {
+		eprintf("[WARN] Deduplication failed: %v\n", err)
+		return
+	}
+	saved, err := dedupeInstallRoot(tx, installedPkgs)
+	if err != nil {
+		eprintf("[WARN] Deduplication failed: %v\n", err)
+		if err := tx.rollback(); err != nil {
+			eprintf("[ERROR] Rollback failed, run apkg again to retry: %v\n", err)
+		}
+		return
+	}
+	if err := tx.commit(); err != nil {
+		eprintf("[WARN] Failed to clean up transaction %s: %v\n", tx.ID, err)
+	}
+	if saved > 0 {
+		printf("Deduplicated identical files, saved %s\n", humanSize(saved))
+	}
+}
@@ -0,0 +1,102 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestDedupeInstallRoot(t *testing.T) {
+	oldState := stateDir
+	defer func() { stateDir = oldState }()
+	stateDir = t.TempDir()
+	root := t.TempDir()
+	write := func(rel, content string, mode os.FileMode) {
+		os.MkdirAll(filepath.Dir(filepath.Join(root, rel)), 0755)
+		os.WriteFile(filepath.Join(root, rel), []byte(content), mode)
+	}
+	write("usr/share/a/LICENSE", "same license text", 0644)
+	write("usr/share/b/LICENSE", "same license text", 0644)
+	write("usr/share/c/LICENSE", "same license text", 0600)
+	write("usr/share/d/LICENSE", "same license text", 0644)
+	write("usr/share/e/LICENSE", "other license text", 0644)
+	writeInstalledFiles("a", []string{"usr/share/a/LICENSE", "usr/share/e/LICENSE"})
+	writeInstalledFiles("b", []string{"usr/share/b/LICENSE", "usr/share/c/LICENSE"})
+	writeInstalledFiles("d", []string{"usr/share/d/LICENSE"})
+	owned := os.Geteuid() == 0
+	if owned {
+		// Same content and mode but another owner
+		os.Chown(filepath.Join(root, "usr/share/d/LICENSE"), 1000, 1000)
+	}
+
+	oldConfig := globalConfig
+	defer func() { globalConfig = oldConfig }()
+	auditLog := filepath.Join(t.TempDir(), "audit.jsonl")
+	globalConfig = &Config{AuditLog: auditLog}
+
+	// A rollback undoes every link
+	tx, err := beginTransaction(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dedupeInstallRoot(tx, map[string]string{"a": "1", "b": "1", "d": "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := os.Stat(filepath.Join(root, "usr/share/a/LICENSE")); a.Sys().(*syscall.Stat_t).Nlink != 1 {
+		t.Error("rollback left the files linked")
+	}
+
+	tx, _ = beginTransaction(root)
+	saved, err := dedupeInstallRoot(tx, map[string]string{"a": "1", "b": "1", "d": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.commit(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(auditLog); !strings.Contains(string(data), `"path":"usr/share/b/LICENSE","action":"replace"`) {
+		t.Errorf("linking wasn't audited:\n%s", data)
+	}
+	ino := func(rel string) uint64 {
+		info, err := os.Stat(filepath.Join(root, rel))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Sys().(*syscall.Stat_t).Ino
+	}
+	if ino("usr/share/a/LICENSE") != ino("usr/share/b/LICENSE") {
+		t.Error("identical files weren't linked")
+	}
+	if ino("usr/share/a/LICENSE") == ino("usr/share/c/LICENSE") {
+		t.Error("files with different modes were linked")
+	}
+	if owned && ino("usr/share/a/LICENSE") == ino("usr/share/d/LICENSE") {
+		t.Error("files with different owners were linked")
+	}
+	if want := int64(len("same license text")); owned && saved != want {
+		t.Errorf("saved %d, want %d", saved, want)
+	}
+	groups, err := readHardlinks()
+	if err != nil || len(groups) != 1 {
+		t.Fatalf("hardlink groups %v, %v", groups, err)
+	}
+
+	// Uninstalling one link leaves a single path, the group goes away
+	if err := forgetHardlinks([]string{"usr/share/b/LICENSE"}); err != nil {
+		t.Fatal(err)
+	}
+	if groups, _ := readHardlinks(); len(groups) != 0 {
+		t.Errorf("groups left %v", groups)
+	}
+}
@@ -0,0 +1,127 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"flag"
+	"io"
+	"os"
+	"regexp"
+	"runtime/debug"
+	"strings"
+)
+
+// apkgVersion is set at build time with -ldflags "-X main.apkgVersion=<v>", the module
+// version is used otherwise
+var apkgVersion string
+
+// describeCommitPattern finds the commit in a `git describe` style DESCRIPTION like v3.22.1-52-g0d7f3c9e6a
+var describeCommitPattern = regexp.MustCompile(`-g([0-9a-f]{7,40})$`)
+
+// indexDescription returns the DESCRIPTION an index tarball carries next to its APKINDEX,
+// the release and commit the repo was built from, empty for bare indexes
+func indexDescription(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	rc, _, err := decompress(f)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	inner := bufio.NewReader(rc)
+	if hdr, _ := inner.Peek(262); len(hdr) < 262 || string(hdr[257:262]) != "ustar" {
+		return "", nil
+	}
+	tr := tar.NewReader(inner)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if hdr.Typeflag == tar.TypeReg && hdr.Name == "DESCRIPTION" {
+			data, err := io.ReadAll(io.LimitReader(tr, 4096))
+			return strings.TrimSpace(string(data)), err
+		}
+	}
+}
+
+// descriptionCommit returns the upstream commit named by a DESCRIPTION, if any
+func descriptionCommit(desc string) string {
+	if m := describeCommitPattern.FindStringSubmatch(desc); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// versionString returns the version of this apkg binary
+func versionString() string {
+	if apkgVersion != "" {
+		return apkgVersion
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+// cmdVersion implements `apkg version [-repos]`: the apkg version and, with -repos, the
+// release, upstream commit and signer of every configured repo's index
+func cmdVersion(configPath string, args []string) int {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	repos := fs.Bool("repos", false, "Also show the description, commit and signer of every repo index")
+	fs.Parse(args)
+	printf("apkg %s\n", versionString())
+	if !*repos {
+		return 0
+	}
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		eprintf("[FATAL] Failed to read config: %v\n", err)
+		return 1
+	}
+	globalConfig = cfg
+	status := 0
+	for _, repo := range cfg.Repos {
+		printf("%s\n", repo)
+		_, fetchedAt, err := fetchIndex(repo)
+		if err != nil {
+			eprintf("[ERROR] Failed to fetch APKINDEX from %s: %v\n", repo, err)
+			status = 2
+			continue
+		}
+		path := indexCachePath(repo)
+		desc, err := indexDescription(path)
+		if err != nil {
+			eprintf("[WARN] Failed to read the DESCRIPTION of %s: %v\n", repo, err)
+		}
+		if desc == "" {
+			desc = "(none)"
+		}
+		printf("  description: %s\n", desc)
+		if commit := descriptionCommit(desc); commit != "" {
+			printf("  commit:      %s\n", commit)
+		}
+		switch key, err := verifyAPKSignature(path, true); {
+		case err == nil:
+			printf("  signed by:   %s (verified)\n", key)
+		case err == errUnsigned:
+			printf("  signed by:   nobody, the index is unsigned\n")
+		default:
+			printf("  signed by:   %s (%v)\n", key, err)
+		}
+		printf("  fetched:     %s\n", fetchedAt.Format("2006-01-02 15:04:05"))
+	}
+	return status
+}
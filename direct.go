@@ -0,0 +1,164 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// directChecksumSep separates a direct package entry from its expected sha256
+const directChecksumSep = "#sha256:"
+
+// isDirectEntry reports whether a packages: entry is an .apk URL or local path
+// rather than a package name
+func isDirectEntry(entry string) bool {
+	src, _ := splitDirectEntry(entry)
+	return strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") ||
+		strings.HasPrefix(src, "/") || strings.HasPrefix(src, "./") || strings.HasPrefix(src, "../") ||
+		strings.HasSuffix(src, ".apk") || isRawTarball(src)
+}
+
+// splitDirectEntry splits "<url or path>#sha256:<hex>" into its source and checksum
+func splitDirectEntry(entry string) (src, sum string) {
+	if i := strings.Index(entry, directChecksumSep); i >= 0 {
+		return entry[:i], strings.ToLower(entry[i+len(directChecksumSep):])
+	}
+	return entry, ""
+}
+
+// readApkPkgInfo reads the .PKGINFO of an .apk file without extracting it
+func readApkPkgInfo(apkPath string) (map[string][]string, error) {
+	f, err := os.Open(apkPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, _, err := decompress(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf(".PKGINFO not found in %s", apkPath)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == ".PKGINFO" {
+			return parsePkgInfo(tr)
+		}
+	}
+}
+
+// fetchDirectPackage downloads or copies a direct entry into stagedDir, verifies its
+// checksum and describes it from its .PKGINFO
+func fetchDirectPackage(entry, stagedDir string) (APKPackage, string, error) {
+	src, sum := splitDirectEntry(entry)
+	src = bundleDirectSource(src)
+	tmp, err := os.CreateTemp(stagedDir, "direct-*.apk")
+	if err != nil {
+		return APKPackage{}, "", err
+	}
+	tmp.Close()
+	var got string
+	if strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://") {
+		printf("Downloading %s\n", src)
+		got, err = downloadFile(src, tmp.Name())
+	} else {
+		got, err = copyFileSHA256(src, tmp.Name(), 0644)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return APKPackage{}, "", err
+	}
+	var meta []byte
+	if isRawTarball(src) {
+		if meta, err = readRawMeta(src); err == nil {
+			got, err = rawChecksum(tmp.Name(), meta)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			return APKPackage{}, "", err
+		}
+	}
+	if sum != "" {
+		if got != sum {
+			os.Remove(tmp.Name())
+			return APKPackage{}, "", fmt.Errorf("checksum mismatch for %s: expected sha256 %s, got %s", src, sum, got)
+		}
+	} else if strings.HasPrefix(src, "http://") {
+		eprintf("[WARN] %s has no %s suffix, its integrity isn't checked\n", src, directChecksumSep)
+	}
+	if isRawTarball(src) {
+		if err := convertRawDirect(src, tmp.Name(), meta); err != nil {
+			os.Remove(tmp.Name())
+			return APKPackage{}, "", err
+		}
+	}
+	pi, err := readApkPkgInfo(tmp.Name())
+	if err != nil {
+		os.Remove(tmp.Name())
+		return APKPackage{}, "", err
+	}
+	if len(pi["pkgname"]) == 0 || len(pi["pkgver"]) == 0 {
+		os.Remove(tmp.Name())
+		return APKPackage{}, "", fmt.Errorf("%s has no pkgname/pkgver in its .PKGINFO", src)
+	}
+	pkg := APKPackage{
+		Name:     pi["pkgname"][0],
+		Version:  pi["pkgver"][0],
+		Deps:     pi["depend"],
+		Provides: pi["provides"],
+		SHA256:   got,
+	}
+	pkg.Filename = pkg.Name + "-" + pkg.Version + ".apk"
+	if len(pi["origin"]) > 0 {
+		pkg.Origin = pi["origin"][0]
+	}
+	if len(pi["size"]) > 0 {
+		pkg.InstalledSize, _ = strconv.ParseInt(pi["size"][0], 10, 64)
+	}
+	if info, err := os.Stat(tmp.Name()); err == nil {
+		pkg.Size = info.Size()
+	}
+	staged := filepath.Join(stagedDir, pkg.Filename)
+	if err := os.Rename(tmp.Name(), staged); err != nil {
+		return APKPackage{}, "", err
+	}
+	return pkg, staged, nil
+}
+
+// resolveDirectPackages fetches every direct entry of cfg.Packages into stagedDir, adds
+// them to pkgMap (taking precedence over the repos) and replaces the entries with the
+// package names so they are planned, tracked and uninstalled like any other package.
+// It returns the staged .apk of every direct package.
+func resolveDirectPackages(cfg *Config, pkgMap map[string]APKPackage, sourceRepo map[string]string, stagedDir string) (map[string]string, error) {
+	staged := make(map[string]string)
+	for i, entry := range cfg.Packages {
+		if !isDirectEntry(entry) {
+			continue
+		}
+		pkg, path, err := fetchDirectPackage(entry, stagedDir)
+		if err != nil {
+			return nil, err
+		}
+		pkgMap[pkg.Name] = pkg
+		delete(sourceRepo, pkg.Name)
+		staged[pkg.Name] = path
+		cfg.Packages[i] = pkg.Name
+	}
+	return staged, nil
+}
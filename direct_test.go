@@ -0,0 +1,95 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirectEntries(t *testing.T) {
+	cases := []struct {
+		entry, src, sum string
+		direct          bool
+	}{
+		{"busybox", "busybox", "", false},
+		{"py3-pip", "py3-pip", "", false},
+		{"https://example.com/custom-1.0.apk#sha256:ABCD", "https://example.com/custom-1.0.apk", "abcd", true},
+		{"./dist/mytool-2.1.apk", "./dist/mytool-2.1.apk", "", true},
+		{"/srv/pkgs/tool.apk", "/srv/pkgs/tool.apk", "", true},
+		{"tool-1.0-r0.apk", "tool-1.0-r0.apk", "", true},
+		{"build/artifact.tar.zst", "build/artifact.tar.zst", "", true},
+	}
+	for _, c := range cases {
+		if got := isDirectEntry(c.entry); got != c.direct {
+			t.Errorf("isDirectEntry(%q) = %v, want %v", c.entry, got, c.direct)
+		}
+		src, sum := splitDirectEntry(c.entry)
+		if src != c.src || sum != c.sum {
+			t.Errorf("splitDirectEntry(%q) = %q, %q, want %q, %q", c.entry, src, sum, c.src, c.sum)
+		}
+	}
+}
+
+func TestRawTarball(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "artifact.tar.gz")
+	if err := os.WriteFile(src, tarGz("./usr/bin/tool", "#!/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := fetchDirectPackage(src, dir); err == nil {
+		t.Error("a raw tarball without a .meta file was accepted")
+	}
+	meta := "name: tool\nversion: 1.2-r0\ndepends:\n  - musl\n"
+	if err := os.WriteFile(src+rawMetaSuffix, []byte(meta), 0644); err != nil {
+		t.Fatal(err)
+	}
+	pkg, staged, err := fetchDirectPackage(src, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg.Name != "tool" || pkg.Version != "1.2-r0" || len(pkg.Deps) != 1 || pkg.Deps[0] != "musl" {
+		t.Errorf("raw tarball described as %+v", pkg)
+	}
+	if pkg.InstalledSize != int64(len("#!/bin/sh\n")) {
+		t.Errorf("installed size %d", pkg.InstalledSize)
+	}
+	var names []string
+	err = withFile(staged, func(r io.Reader) error {
+		return eachTarEntry(r, func(hdr *tar.Header, _ io.Reader) error {
+			names = append(names, hdr.Name)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 || names[0] != ".PKGINFO" || names[1] != "usr/bin/tool" {
+		t.Errorf("converted entries %v", names)
+	}
+
+	// The checksum covers the tarball followed by its .meta file
+	tarball, _ := os.ReadFile(src)
+	tarballSum := sha256.Sum256(tarball)
+	sum := sha256.Sum256(append(tarball, meta...))
+	if _, _, err := fetchDirectPackage(src+directChecksumSep+hex.EncodeToString(tarballSum[:]), dir); err == nil {
+		t.Error("a checksum of the tarball alone was accepted")
+	}
+	entry := src + directChecksumSep + hex.EncodeToString(sum[:])
+	if _, _, err := fetchDirectPackage(entry, dir); err != nil {
+		t.Errorf("checksum over the tarball and .meta refused: %v", err)
+	}
+	os.WriteFile(src+rawMetaSuffix, []byte("name: tool\nversion: 1.2-r0\ndepends:\n  - evil\n"), 0644)
+	if _, _, err := fetchDirectPackage(entry, dir); err == nil {
+		t.Error("a changed .meta file passed the checksum")
+	}
+}
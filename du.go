@@ -0,0 +1,110 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"syscall"
+)
+
+// pkgUsage is the on-disk size of one installed package
+type pkgUsage struct {
+	Name  string
+	Files int
+	Size  int64
+	// Shared is the size of files hardlinked to another package's copy, not counted in Size
+	Shared int64
+}
+
+// diskUsage sums the on-disk size of every file in the installed files index of
+// each package, inodes already counted for another package are reported as shared
+func diskUsage(installDir string, pkgs []string) []pkgUsage {
+	seen := make(map[uint64]bool)
+	var usage []pkgUsage
+	sort.Strings(pkgs)
+	for _, pkg := range pkgs {
+		u := pkgUsage{Name: pkg}
+		files, err := readInstalledFiles(pkg)
+		if err != nil {
+			eprintf("[WARN] %s: could not read installed files index: %v\n", pkg, err)
+		}
+		for _, rel := range files {
+			info, err := os.Lstat(installPath(installDir, rel))
+			if err != nil || info.IsDir() {
+				continue
+			}
+			u.Files++
+			if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+				if seen[st.Ino] {
+					u.Shared += info.Size()
+					continue
+				}
+				seen[st.Ino] = true
+			}
+			u.Size += info.Size()
+		}
+		usage = append(usage, u)
+	}
+	sort.SliceStable(usage, func(i, j int) bool { return usage[i].Size > usage[j].Size })
+	return usage
+}
+
+// cmdDu implements `apkg du [-index] [pkg...]`, installed packages sorted by size
+func cmdDu(configPath string, args []string) int {
+	fs := flag.NewFlagSet("du", flag.ExitOnError)
+	compare := fs.Bool("index", false, "Compare with the installed size (I:) from the repo index")
+	fs.Parse(args)
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		eprintf("[FATAL] Failed to read config: %v\n", err)
+		return 1
+	}
+	globalConfig = cfg
+	installedPkgs, err := readInstalledPkgs(statePath("installed.yaml"))
+	if err != nil {
+		eprintf("[FATAL] Failed to read installed.yaml: %v\n", err)
+		return 1
+	}
+	pkgs := fs.Args()
+	if len(pkgs) == 0 {
+		for name := range installedPkgs {
+			pkgs = append(pkgs, name)
+		}
+	}
+	for _, pkg := range pkgs {
+		if _, ok := installedPkgs[pkg]; !ok {
+			eprintf("[ERROR] %s is not installed\n", pkg)
+			return 1
+		}
+	}
+	var pkgMap map[string]APKPackage
+	if *compare {
+		var ok bool
+		if pkgMap, _, ok = loadIndexForCommand(configPath); !ok {
+			return 2
+		}
+	}
+	var total int64
+	for _, u := range diskUsage(cfg.InstallDir, pkgs) {
+		total += u.Size
+		line := fmt.Sprintf("%10s  %s (%d files)", humanSize(u.Size), u.Name, u.Files)
+		if u.Shared > 0 {
+			line += fmt.Sprintf(", %s shared", humanSize(u.Shared))
+		}
+		if *compare {
+			if p, ok := pkgMap[u.Name]; ok && p.InstalledSize > 0 {
+				line += fmt.Sprintf(", index: %s", humanSize(p.InstalledSize))
+			}
+		}
+		fmt.Println(line)
+	}
+	printf("%10s  total\n", humanSize(total))
+	return 0
+}
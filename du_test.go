@@ -0,0 +1,45 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskUsage(t *testing.T) {
+	oldState := stateDir
+	defer func() { stateDir = oldState }()
+	stateDir = t.TempDir()
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "usr/bin"), 0755)
+	os.WriteFile(filepath.Join(root, "usr/bin/big"), make([]byte, 4000), 0755)
+	os.WriteFile(filepath.Join(root, "usr/bin/small"), make([]byte, 100), 0755)
+	os.Link(filepath.Join(root, "usr/bin/small"), filepath.Join(root, "usr/bin/small-link"))
+	writeInstalledFiles("big", []string{"usr/bin", "usr/bin/big"})
+	writeInstalledFiles("small", []string{"usr/bin/small", "usr/bin/missing"})
+	writeInstalledFiles("linked", []string{"usr/bin/small-link"})
+
+	usage := diskUsage(root, []string{"small", "linked", "big"})
+	if len(usage) != 3 || usage[0].Name != "big" || usage[0].Size != 4000 || usage[0].Files != 1 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+	// The hardlinked copy is counted once, for the package first in name order
+	for _, u := range usage[1:] {
+		switch u.Name {
+		case "linked":
+			if u.Size != 100 || u.Shared != 0 {
+				t.Errorf("linked: %+v", u)
+			}
+		case "small":
+			if u.Size != 0 || u.Shared != 100 || u.Files != 1 {
+				t.Errorf("small: %+v", u)
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// eventFile (next to installed.yaml) describes the last change of the installed set, it's
+// replaced atomically so agents can watch it (inotify IN_MOVED_TO) instead of polling
+const eventFile = "installed_event.json"
+
+// dbusEventPath and dbusEventInterface identify the D-Bus signal sent with dbus_events
+const (
+	dbusEventPath      = "/io/github/lumiini/apkg"
+	dbusEventInterface = "io.github.lumiini.apkg"
+)
+
+// EventPackage is a package added, upgraded or removed by a change of the installed set
+type EventPackage struct {
+	Name       string `json:"name"`
+	OldVersion string `json:"old_version,omitempty"`
+	Version    string `json:"version,omitempty"`
+}
+
+// InstalledEvent is the content of eventFile, Serial grows by one with every change
+type InstalledEvent struct {
+	Serial    int            `json:"serial"`
+	Time      string         `json:"time"`
+	Installed []EventPackage `json:"installed,omitempty"`
+	Upgraded  []EventPackage `json:"upgraded,omitempty"`
+	Removed   []EventPackage `json:"removed,omitempty"`
+}
+
+// diffInstalled returns the event turning before into after, nil when they're the same
+func diffInstalled(before, after map[string]string) *InstalledEvent {
+	ev := &InstalledEvent{}
+	for name, ver := range after {
+		old, ok := before[name]
+		switch {
+		case !ok:
+			ev.Installed = append(ev.Installed, EventPackage{Name: name, Version: ver})
+		case old != ver:
+			ev.Upgraded = append(ev.Upgraded, EventPackage{Name: name, OldVersion: old, Version: ver})
+		}
+	}
+	for name, ver := range before {
+		if _, ok := after[name]; !ok {
+			ev.Removed = append(ev.Removed, EventPackage{Name: name, OldVersion: ver})
+		}
+	}
+	if len(ev.Installed)+len(ev.Upgraded)+len(ev.Removed) == 0 {
+		return nil
+	}
+	for _, list := range [][]EventPackage{ev.Installed, ev.Upgraded, ev.Removed} {
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	}
+	return ev
+}
+
+// emitInstalledEvent publishes the change from before to after of the installed set kept
+// in installedPath, as eventFile next to it and optionally as a D-Bus signal
+func emitInstalledEvent(installedPath string, before, after map[string]string) error {
+	ev := diffInstalled(before, after)
+	if ev == nil {
+		return nil
+	}
+	path := filepath.Join(filepath.Dir(installedPath), eventFile)
+	var last InstalledEvent
+	if data, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(data, &last)
+	}
+	ev.Serial = last.Serial + 1
+	ev.Time = time.Now().UTC().Format(time.RFC3339)
+	data, err := json.MarshalIndent(ev, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if globalConfig != nil && globalConfig.DBusEvents {
+		sendDBusEvent(data)
+	}
+	return nil
+}
+
+// sendDBusEvent broadcasts the event JSON as a Changed signal on the system bus with the host's dbus-send
+func sendDBusEvent(data []byte) {
+	compact, err := json.Marshal(json.RawMessage(data))
+	if err != nil {
+		compact = data
+	}
+	cmd := exec.Command("dbus-send", "--system", "--type=signal", dbusEventPath, dbusEventInterface+".Changed", "string:"+string(compact))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		eprintf("[WARN] Failed to send the D-Bus event: %v %s\n", err, out)
+	}
+}
@@ -0,0 +1,196 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// alpineRepoPattern matches the layout of the Alpine mirrors, <mirror>/<release>/<repo>/<arch>
+var alpineRepoPattern = regexp.MustCompile(`^(.*)/(v[0-9]+\.[0-9]+|edge|latest-stable)/(main|community|testing)/([^/]+)/?$`)
+
+// repoOffer is a package of some repo that could satisfy a dependency
+type repoOffer struct {
+	repo    string
+	pkg     APKPackage
+	enabled bool
+}
+
+// siblingRepos returns the Alpine repos next to the configured ones that aren't configured
+func siblingRepos(repos []string) []string {
+	configured := map[string]bool{}
+	for _, repo := range repos {
+		configured[strings.TrimSuffix(repo, "/")] = true
+	}
+	var siblings []string
+	for _, repo := range repos {
+		m := alpineRepoPattern.FindStringSubmatch(repo)
+		if m == nil {
+			continue
+		}
+		names := []string{"main", "community"}
+		if m[2] == "edge" {
+			names = append(names, "testing")
+		}
+		for _, name := range names {
+			sib := m[1] + "/" + m[2] + "/" + name + "/" + m[4]
+			if !configured[sib] {
+				configured[sib] = true
+				siblings = append(siblings, sib)
+			}
+		}
+	}
+	return siblings
+}
+
+// readRepoIndex returns the packages of repo, from the index cache when it's configured
+// and fetched to a temp file otherwise
+func readRepoIndex(repo string, configured bool) (map[string]APKPackage, error) {
+	if configured {
+		return parseAPKIndexFile(indexCachePath(repo))
+	}
+	tmp, err := newWorkDir("run")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	path := filepath.Join(tmp, "APKINDEX")
+	if err := sourceFor(repo).FetchIndex(path); err != nil {
+		return nil, err
+	}
+	return parseAPKIndexFile(path)
+}
+
+// findOffers looks up what every configured repo, and the Alpine repos next to them,
+// has for d
+func findOffers(cfg *Config, d depConstraint) []repoOffer {
+	var offers []repoOffer
+	look := func(repo string, enabled bool) {
+		pkgs, err := readRepoIndex(repo, enabled)
+		if err != nil {
+			return
+		}
+		names := make([]string, 0, len(pkgs))
+		for name := range pkgs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		r := &resolver{pkgMap: pkgs}
+		for _, name := range names {
+			if name == d.Name || r.satisfies(name, depConstraint{Name: d.Name}) {
+				offers = append(offers, repoOffer{repo: repo, pkg: pkgs[name], enabled: enabled})
+			}
+		}
+	}
+	for _, repo := range cfg.Repos {
+		look(repo, true)
+	}
+	for _, repo := range siblingRepos(cfg.Repos) {
+		look(repo, false)
+	}
+	return offers
+}
+
+// printOffers lists the offers and suggests the config changes that would make one of
+// them satisfy d
+func printOffers(cfg *Config, d depConstraint, offers []repoOffer, pkgMap map[string]APKPackage, sourceRepo map[string]string) []string {
+	var suggestions []string
+	if len(offers) == 0 {
+		eprintf("  No repo has %s\n", d.Name)
+		return suggestions
+	}
+	eprintf("  Available:\n")
+	for _, o := range offers {
+		note := ""
+		switch {
+		case !o.enabled:
+			note = " (repo not enabled)"
+		case sourceRepo[o.pkg.Name] != "" && sourceRepo[o.pkg.Name] != o.repo:
+			note = fmt.Sprintf(" (shadowed by %s)", sourceRepo[o.pkg.Name])
+		}
+		eprintf("    %s %s in %s%s\n", o.pkg.Name, o.pkg.Version, o.repo, note)
+		r := &resolver{pkgMap: map[string]APKPackage{o.pkg.Name: o.pkg}}
+		if !r.satisfies(o.pkg.Name, d) {
+			continue
+		}
+		switch {
+		case !o.enabled:
+			suggestions = append(suggestions, fmt.Sprintf("enable %s, it has %s %s", o.repo, o.pkg.Name, o.pkg.Version))
+		case sourceRepo[o.pkg.Name] != "" && sourceRepo[o.pkg.Name] != o.repo && pkgMap[o.pkg.Name].Version != o.pkg.Version:
+			suggestions = append(suggestions, fmt.Sprintf("move %s before %s in repos (the first repo having a package wins) to get %s %s",
+				o.repo, sourceRepo[o.pkg.Name], o.pkg.Name, o.pkg.Version))
+		}
+	}
+	return suggestions
+}
+
+// topLevel returns the configured package a chain of requiring packages starts from
+func topLevel(chain []string, pkg string) string {
+	if len(chain) == 0 {
+		return pkg
+	}
+	return chain[len(chain)-1]
+}
+
+// explainResolveError prints what clashed when err is a resolution failure, together with
+// the versions the repos have and config changes that could fix it
+func explainResolveError(err error, cfg *Config, pkgMap map[string]APKPackage, sourceRepo map[string]string) {
+	var re *resolveError
+	if !errors.As(err, &re) || re.Dep.Name == "" {
+		return
+	}
+	var suggestions []string
+	if re.ConflictBy != "" {
+		eprintf("  %s is %s\n", re.Dep, requiredBy(re.Chain))
+		eprintf("  %s, which conflicts with it, is %s\n", re.ConflictBy, requiredBy(re.ConflictChain))
+		var others []string
+		r := &resolver{pkgMap: pkgMap}
+		for _, name := range providesMap(pkgMap, sourceRepo)[re.Dep.Name] {
+			if name != re.Dep.Name && r.satisfies(name, re.Dep) {
+				others = append(others, name)
+			}
+		}
+		if len(others) > 0 {
+			suggestions = append(suggestions, fmt.Sprintf("add one of %s to packages to provide %s instead", strings.Join(others, ", "), re.Dep.Name))
+		}
+		a, b := topLevel(re.Chain, re.Dep.Name), topLevel(re.ConflictChain, re.ConflictBy)
+		if a != b {
+			suggestions = append(suggestions, fmt.Sprintf("drop %s or %s from packages, they can't be installed together", a, b))
+		}
+	} else {
+		eprintf("  %s is %s\n", re.Dep, requiredBy(re.Chain))
+		suggestions = printOffers(cfg, re.Dep, findOffers(cfg, re.Dep), pkgMap, sourceRepo)
+		if len(re.Chain) > 0 {
+			suggestions = append(suggestions, fmt.Sprintf("drop %s from packages", topLevel(re.Chain, re.Dep.Name)))
+		}
+	}
+	printSuggestions(suggestions)
+}
+
+// explainMissingPackage warns about a configured package no repo has, suggesting repos that do
+func explainMissingPackage(cfg *Config, pkg string, pkgMap map[string]APKPackage, sourceRepo map[string]string) {
+	eprintf("[WARN] %s is not in any configured repo, it's skipped\n", pkg)
+	d := parseDep(pkg)
+	printSuggestions(printOffers(cfg, d, findOffers(cfg, d), pkgMap, sourceRepo))
+}
+
+// printSuggestions prints the suggested config changes, if any
+func printSuggestions(suggestions []string) {
+	if len(suggestions) == 0 {
+		return
+	}
+	eprintf("  Suggestions:\n")
+	for _, s := range suggestions {
+		eprintf("    - %s\n", s)
+	}
+}
@@ -0,0 +1,166 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// maxBandwidthSamples is how many downloads the estimate is based on
+const maxBandwidthSamples = 20
+
+// bandwidthSample is a single measured package download
+type bandwidthSample struct {
+	Bytes   int64     `yaml:"bytes"`
+	Seconds float64   `yaml:"seconds"`
+	At      time.Time `yaml:"at"`
+}
+
+// readBandwidth returns the recorded downloads of trafficFile, oldest first
+func readBandwidth() []bandwidthSample {
+	return readTraffic().Bandwidth
+}
+
+// recordBandwidth adds a download of n bytes that took d to trafficFile, downloads from
+// a bundle aren't network transfers and are left out
+func recordBandwidth(n int64, d time.Duration) {
+	if bundleDir != "" || n <= 0 || d <= 0 {
+		return
+	}
+	trafficFileMu.Lock()
+	defer trafficFileMu.Unlock()
+	s := readTraffic()
+	s.Bandwidth = append(s.Bandwidth, bandwidthSample{Bytes: n, Seconds: d.Seconds(), At: time.Now().UTC()})
+	if len(s.Bandwidth) > maxBandwidthSamples {
+		s.Bandwidth = s.Bandwidth[len(s.Bandwidth)-maxBandwidthSamples:]
+	}
+	if err := writeTraffic(s); err != nil {
+		eprintf("[WARN] Failed to record download speed: %v\n", err)
+	}
+}
+
+// measuredFetch fetches filename from src to dest and records how fast it downloaded
+func measuredFetch(src Source, filename, dest string) (string, error) {
+	start := time.Now()
+	sum, err := src.Fetch(filename, dest)
+	if err == nil {
+		if st, serr := os.Stat(dest); serr == nil {
+			recordBandwidth(st.Size(), time.Since(start))
+		}
+	}
+	return sum, err
+}
+
+// measuredBandwidth returns the average bytes per second of the recorded downloads,
+// 0 when none were recorded yet
+func measuredBandwidth(samples []bandwidthSample) float64 {
+	var bytes int64
+	var seconds float64
+	for _, s := range samples {
+		bytes += s.Bytes
+		seconds += s.Seconds
+	}
+	if seconds <= 0 {
+		return 0
+	}
+	return float64(bytes) / seconds
+}
+
+// estimateDuration formats how long n bytes take at rate bytes per second
+func estimateDuration(n int64, rate float64) string {
+	if rate <= 0 {
+		return "unknown"
+	}
+	d := time.Duration(float64(n) / rate * float64(time.Second))
+	if d < time.Second {
+		return "<1s"
+	}
+	return d.Round(time.Second).String()
+}
+
+// signedSize formats a disk delta with its sign
+func signedSize(n int64) string {
+	if n < 0 {
+		return "-" + humanSize(-n)
+	}
+	return "+" + humanSize(n)
+}
+
+// cachedInDir reports whether cache_dir holds a valid copy of pkg from repo
+func cachedInDir(cfg *Config, repo string, info APKPackage) bool {
+	if cfg.CacheDir == "" || repo == "" {
+		return false
+	}
+	_, ok := validCacheEntry(cacheEntryPath(cfg.CacheDir, repo, info.Filename), info.Size)
+	return ok
+}
+
+// explainPlan prints the plan with the download time, cache use and disk delta of every
+// change and in total
+func explainPlan(cfg *Config, plan *Plan, pkgMap map[string]APKPackage, sourceRepo map[string]string) {
+	if plan.Empty() {
+		printf("System is already up to date with the configuration.\n")
+		return
+	}
+	samples := readBandwidth()
+	rate := measuredBandwidth(samples)
+	if rate > 0 {
+		printf("Download speed: %s/s, measured over the last %d downloads\n", humanSize(int64(rate)), len(samples))
+	} else {
+		printf("Download speed: unknown, no downloads were measured yet\n")
+	}
+	var network, cached int64
+	annotate := func(it PlanItem) string {
+		if cachedInDir(cfg, sourceRepo[it.Name], pkgMap[it.Name]) {
+			cached += it.DownloadSize
+			return fmt.Sprintf(T("from cache, %s"), humanSize(it.DownloadSize))
+		}
+		network += it.DownloadSize
+		return fmt.Sprintf(T("download %s ~%s"), humanSize(it.DownloadSize), estimateDuration(it.DownloadSize, rate))
+	}
+	for _, it := range plan.Installs {
+		printf("  - Install %s (%s): %s, %s on disk%s\n", it.Name, it.NewVersion, annotate(it), signedSize(it.InstalledSize), it.groupNote())
+	}
+	for _, it := range plan.Upgrades {
+		delta := it.InstalledSize - storedInstalledSize(it.Name)
+		printf("  - Upgrade %s from %s to %s: %s, %s on disk%s\n", it.Name, it.OldVersion, it.NewVersion, annotate(it), signedSize(delta), it.groupNote())
+	}
+	for _, it := range plan.Removals {
+		printf("  - Uninstall %s (%s): %s on disk\n", it.Name, it.OldVersion, signedSize(-it.InstalledSize))
+	}
+	printf("%d to install, %d to upgrade, %d to uninstall\n", len(plan.Installs), len(plan.Upgrades), len(plan.Removals))
+	printf("Download: %s from the network (~%s), %s from cache_dir\n", humanSize(network), estimateDuration(network, rate), humanSize(cached))
+	printf("Disk delta: %s\n", signedSize(plan.DiskDelta()))
+}
+
+// cmdExplainPlan implements `apkg explain-plan`: the plan annotated with estimates to
+// schedule large applies
+func cmdExplainPlan(configPath string, args []string) int {
+	fs := flag.NewFlagSet("explain-plan", flag.ExitOnError)
+	full := fs.Bool("full", false, "Plan every package as if nothing was installed")
+	fs.Parse(args)
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		eprintf("[FATAL] Failed to read config: %v\n", err)
+		return 1
+	}
+	globalConfig = cfg
+	if err := loadBase(cfg); err != nil {
+		eprintf("[FATAL] %v\n", err)
+		return 1
+	}
+	plan, pkgMap, sourceRepo, _, err := configPlan(cfg, *full)
+	if err != nil {
+		eprintf("[FATAL] %v\n", err)
+		return 2
+	}
+	explainPlan(cfg, plan, pkgMap, sourceRepo)
+	return 0
+}
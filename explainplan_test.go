@@ -0,0 +1,39 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordBandwidth(t *testing.T) {
+	oldState := stateDir
+	stateDir = t.TempDir()
+	defer func() { stateDir = oldState }()
+	if rate := measuredBandwidth(readBandwidth()); rate != 0 {
+		t.Fatalf("rate without samples: %v", rate)
+	}
+	for i := 0; i < maxBandwidthSamples+5; i++ {
+		recordBandwidth(1<<20, time.Second)
+	}
+	recordBandwidth(3<<20, time.Second)
+	samples := readBandwidth()
+	if len(samples) != maxBandwidthSamples {
+		t.Fatalf("kept %d samples", len(samples))
+	}
+	rate := measuredBandwidth(samples)
+	if want := float64(22<<20) / 20; rate != want {
+		t.Errorf("rate %v, want %v", rate, want)
+	}
+	if got := estimateDuration(10<<20, 1<<20); got != "10s" {
+		t.Errorf("estimate %q", got)
+	}
+	if got := estimateDuration(1, 0); got != "unknown" {
+		t.Errorf("estimate without samples %q", got)
+	}
+}
@@ -0,0 +1,204 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"archive/tar"
+	"flag"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// tarMerger writes the payload of several packages into one tar stream. The first
+// package shipping a path wins, later copies are dropped since a stream can't be rewritten.
+type tarMerger struct {
+	tw      *tar.Writer
+	written map[string]string
+	filter  *extractFilter
+}
+
+// newTarMerger starts a merged tar stream on w
+func newTarMerger(w io.Writer) *tarMerger {
+	return &tarMerger{tw: tar.NewWriter(w), written: make(map[string]string), filter: defaultExtractFilter()}
+}
+
+// addApk copies the payload entries of apkPath that pkg's filters keep into the stream,
+// parent directories of kept entries are emitted on the way
+func (m *tarMerger) addApk(pkg, apkPath string) error {
+	f, err := os.Open(apkPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rc, _, err := decompress(f)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	opts := packageOptions(pkg)
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(hdr.Name, "./"), "/")
+		if name == "" || m.filter.classify(hdr.Name) != entryPayload {
+			continue
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			if opts.hasPathFilters() {
+				continue // only directories kept files end up in
+			}
+		} else if !opts.wantsPath(name) {
+			continue
+		}
+		if owner, ok := m.written[name]; ok {
+			if hdr.Typeflag != tar.TypeDir {
+				eprintf("[WARN] %s ships %s which %s already provides, keeping the first\n", pkg, name, owner)
+			}
+			continue
+		}
+		if err := m.addParents(path.Dir(name)); err != nil {
+			return err
+		}
+		hdr.Name = name
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Name += "/"
+		}
+		if err := m.tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := io.Copy(m.tw, tr); err != nil {
+				return err
+			}
+		}
+		m.written[name] = pkg
+	}
+}
+
+// addParents emits directory entries for dir and its parents that aren't in the stream yet
+func (m *tarMerger) addParents(dir string) error {
+	if dir == "." || dir == "/" || dir == "" {
+		return nil
+	}
+	if _, ok := m.written[dir]; ok {
+		return nil
+	}
+	if err := m.addParents(path.Dir(dir)); err != nil {
+		return err
+	}
+	m.written[dir] = ""
+	return m.tw.WriteHeader(&tar.Header{Name: dir + "/", Typeflag: tar.TypeDir, Mode: 0755})
+}
+
+// Close finishes the tar stream
+func (m *tarMerger) Close() error {
+	return m.tw.Close()
+}
+
+// cmdExtract implements `apkg extract -to-tar <file|-> [pkg...]`: the filtered content of
+// the configured package set (or the given packages) as one tar stream, without staging it on disk
+func cmdExtract(configPath string, args []string) int {
+	fs := flag.NewFlagSet("extract", flag.ExitOnError)
+	toTar := fs.String("to-tar", "", "Write the merged content as a tar stream to this file, - for stdout")
+	fs.Parse(args)
+	if *toTar == "" {
+		eprintf("Usage: %s [flags] extract -to-tar <file|-> [pkg...]\n", os.Args[0])
+		return 1
+	}
+	var out io.Writer
+	if *toTar == "-" {
+		if jsonOut != nil {
+			eprintf("[FATAL] -json and extract -to-tar - both need stdout\n")
+			return 1
+		}
+		// stdout carries the stream, everything else goes to stderr
+		out = os.Stdout
+		os.Stdout = os.Stderr
+	} else {
+		f, err := os.Create(*toTar)
+		if err != nil {
+			eprintf("[FATAL] %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		eprintf("[FATAL] Failed to read config: %v\n", err)
+		return 1
+	}
+	globalConfig = cfg
+	if err := validateExcludeProfiles(cfg); err != nil {
+		eprintf("[FATAL] %v\n", err)
+		return 1
+	}
+	pkgMap, sourceRepo := map[string]APKPackage{}, map[string]string{}
+	if len(cfg.Repos) > 0 {
+		if pkgMap, sourceRepo, err = fetchAndParseAllAPKIndexes(cfg.Repos); err != nil {
+			eprintf("[FATAL] Error fetching APKINDEX: %v\n", err)
+			return 2
+		}
+	}
+	workDir, err := newWorkDir("run")
+	if err != nil {
+		eprintf("[FATAL] Failed to create temp dir: %v\n", err)
+		return 3
+	}
+	defer cleanupTempDirs(workDir)
+	directPkgs, err := resolveDirectPackages(cfg, pkgMap, sourceRepo, workDir)
+	if err != nil {
+		eprintf("[FATAL] Failed to fetch package: %v\n", err)
+		return 2
+	}
+	pkgs := fs.Args()
+	if len(pkgs) == 0 {
+		if pkgs, err = resolveInstallSet(cfg, pkgMap, sourceRepo); err != nil {
+			eprintf("[FATAL] %v\n", err)
+			explainResolveError(err, cfg, pkgMap, sourceRepo)
+			return 1
+		}
+	}
+
+	m := newTarMerger(out)
+	for _, pkg := range pkgs {
+		info, ok := pkgMap[pkg]
+		if !ok {
+			eprintf("[ERROR] %s not found in any repo\n", pkg)
+			return 2
+		}
+		apkPath, direct := directPkgs[pkg]
+		if !direct {
+			apkPath = filepath.Join(workDir, info.Filename)
+			if _, err := fetchPackage(sourceRepo[pkg], info, apkPath); err != nil {
+				eprintf("[ERROR] Failed to download %s: %v\n", pkg, err)
+				return 2
+			}
+		}
+		if err := m.addApk(pkg, apkPath); err != nil {
+			eprintf("[ERROR] Failed to export %s: %v\n", pkg, err)
+			return 4
+		}
+		os.Remove(apkPath)
+		eprintf("Exported %s (%s)\n", pkg, info.Version)
+	}
+	if err := m.Close(); err != nil {
+		eprintf("[ERROR] %v\n", err)
+		return 4
+	}
+	return 0
+}
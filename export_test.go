@@ -0,0 +1,89 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestApk writes a gzipped tarball with the given files, directories end in /
+func writeTestApk(t *testing.T, path string, files map[string]string) {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, name := range []string{".PKGINFO", "usr/", "usr/bin/", "usr/bin/sh", "usr/share/doc/README"} {
+		content, ok := files[name]
+		if !ok {
+			continue
+		}
+		hdr := &tar.Header{Name: name, Mode: 0755, Typeflag: tar.TypeDir}
+		if name[len(name)-1] != '/' {
+			hdr = &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		}
+		tw.WriteHeader(hdr)
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gz.Close()
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTarMerger(t *testing.T) {
+	oldCfg := globalConfig
+	globalConfig = &Config{Exclude: []string{"usr/share/doc"}}
+	defer func() { globalConfig = oldCfg }()
+
+	dir := t.TempDir()
+	writeTestApk(t, filepath.Join(dir, "a.apk"), map[string]string{".PKGINFO": "pkgname = a\n", "usr/": "", "usr/bin/": "", "usr/bin/sh": "from a", "usr/share/doc/README": "doc"})
+	writeTestApk(t, filepath.Join(dir, "b.apk"), map[string]string{".PKGINFO": "pkgname = b\n", "usr/": "", "usr/bin/": "", "usr/bin/sh": "from b"})
+
+	var out bytes.Buffer
+	m := newTarMerger(&out)
+	for _, pkg := range []string{"a", "b"} {
+		if err := m.addApk(pkg, filepath.Join(dir, pkg+".apk")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.Close()
+
+	var names []string
+	tr := tar.NewReader(&out)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		if hdr.Name == "usr/bin/sh" {
+			if data, _ := io.ReadAll(tr); string(data) != "from a" {
+				t.Errorf("usr/bin/sh = %q, want the first package's copy", data)
+			}
+		}
+	}
+	want := []string{"usr/", "usr/bin/", "usr/bin/sh"}
+	if len(names) != len(want) {
+		t.Fatalf("entries = %v, want %v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Errorf("entries = %v, want %v", names, want)
+			break
+		}
+	}
+}
@@ -0,0 +1,195 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// entryKind tells extractApk what to do with an archive entry
+type entryKind int
+
+const (
+	entryPayload entryKind = iota // regular package content, extracted to the destination
+	entryControl                  // package metadata and maintainer scripts, kept aside
+	entrySkip                     // never extracted
+)
+
+// controlFiles are the metadata files apk places at the root of a package
+var controlFiles = []string{
+	".PKGINFO",
+	".pre-install", ".post-install",
+	".pre-upgrade", ".post-upgrade",
+	".pre-deinstall", ".post-deinstall",
+	".trigger",
+}
+
+// extractFilter decides which archive entries are payload, control files or skipped
+type extractFilter struct {
+	skip []string // glob patterns matched against the entry name
+}
+
+// newExtractFilter returns a filter skipping the given extra patterns on top of the defaults
+func newExtractFilter(skip []string) *extractFilter {
+	return &extractFilter{skip: skip}
+}
+
+// defaultExtractFilter returns the filter configured in apkg.yaml
+func defaultExtractFilter() *extractFilter {
+	if globalConfig == nil {
+		return newExtractFilter(nil)
+	}
+	return newExtractFilter(globalConfig.ExtractSkip)
+}
+
+// classify returns how the archive entry called name should be handled
+func (f *extractFilter) classify(name string) entryKind {
+	name = strings.TrimPrefix(name, "./")
+	// Signatures only ever live at the archive root, e.g. .SIGN.RSA.alpine-devel@lists.alpinelinux.org-6165ee59.rsa.pub
+	if strings.HasPrefix(name, ".SIGN.") {
+		return entrySkip
+	}
+	for _, c := range controlFiles {
+		if name == c {
+			return entryControl
+		}
+	}
+	for _, pattern := range f.skip {
+		if matchPathOrParent(pattern, name) {
+			return entrySkip
+		}
+	}
+	return entryPayload
+}
+
+// unsafeEntry reports whether an archive entry name is absolute or leaves the directory
+// it is extracted to
+func unsafeEntry(name string) bool {
+	name = path.Clean(name)
+	return path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../")
+}
+
+// matchPathOrParent reports whether pattern matches name or one of its parent
+// directories, so 'usr/share/doc' also covers everything below it
+func matchPathOrParent(pattern, name string) bool {
+	pattern = strings.TrimSuffix(pattern, "/")
+	name = strings.TrimSuffix(name, "/")
+	for {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+		i := strings.LastIndex(name, "/")
+		if i < 0 {
+			return false
+		}
+		name = name[:i]
+	}
+}
+
+// controlStagingPath returns where control files of pkg are kept while staged
+func controlStagingPath(stagingDir, pkg string) string {
+	return filepath.Join(stagingDir, ".control", pkg)
+}
+
+// extractApk extracts a .apk (tar.gz) file to the given directory, control files
+// go to controlDir instead (or are dropped when controlDir is empty). The extraction
+// stays within limits, with isolate it runs in a worker process.
+func extractApk(apkPath, destDir, controlDir string, limits extractLimits) error {
+	if limits.Isolate {
+		return extractIsolated(apkPath, destDir, controlDir, limits)
+	}
+	return extractApkLocal(apkPath, destDir, controlDir, limits)
+}
+
+// extractApkLocal extracts apkPath in this process within limits
+func extractApkLocal(apkPath, destDir, controlDir string, limits extractLimits) error {
+	f, err := os.Open(apkPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, _, err := decompress(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	filter := defaultExtractFilter()
+	budget := extractBudget{limits: limits}
+	var modes dirModes
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := checkPackageDeadline(); err != nil {
+			return err
+		}
+		name := hdr.Name
+		if unsafeEntry(name) {
+			return fmt.Errorf("refusing archive entry %s outside the package", name)
+		}
+		dir := destDir
+		kind := filter.classify(name)
+		switch kind {
+		case entrySkip:
+			continue
+		case entryControl:
+			if controlDir == "" {
+				continue
+			}
+			dir = controlDir
+		}
+		if err := budget.add(hdr, kind); err != nil {
+			return err
+		}
+		target := filepath.Join(dir, name)
+		debugf("extract", "%s: %s (%d bytes)", name, target, hdr.Size)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, dirMode()); err != nil {
+				return err
+			}
+			if err := chownEntry(target, hdr.Uid, hdr.Gid); err != nil {
+				return err
+			}
+			modes.add(target, hdr.FileInfo().Mode())
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), dirMode()); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return err
+			}
+			out.Close()
+			if err := chownEntry(target, hdr.Uid, hdr.Gid); err != nil {
+				return err
+			}
+			// The staged copy keeps the packaged mode exactly, the install copies it from there
+			if err := os.Chmod(target, archiveMode(hdr.FileInfo().Mode())); err != nil {
+				return err
+			}
+		}
+	}
+	return modes.apply()
+}
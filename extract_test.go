@@ -0,0 +1,130 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExtractFilterClassify(t *testing.T) {
+	f := newExtractFilter([]string{"usr/share/doc", "usr/share/locale/*"})
+	cases := map[string]entryKind{
+		".PKGINFO":      entryControl,
+		".post-install": entryControl,
+		".trigger":      entryControl,
+		".SIGN.RSA.alpine-devel@lists.alpinelinux.org-6165ee59.rsa.pub":    entrySkip,
+		"etc/apk/keys/alpine-devel@lists.alpinelinux.org-6165ee59.rsa.pub": entryPayload,
+		"usr/bin/htop":                            entryPayload,
+		"usr/share/doc":                           entrySkip,
+		"usr/share/doc/htop/README":               entrySkip,
+		"usr/share/locale/de/LC_MESSAGES/htop.mo": entrySkip,
+		"usr/share/locale":                        entryPayload,
+		"usr/share/post-install":                  entryPayload,
+	}
+	for name, want := range cases {
+		if got := f.classify(name); got != want {
+			t.Errorf("classify(%q) = %d, want %d", name, got, want)
+		}
+	}
+}
+
+func TestPackageOptionsWantsPath(t *testing.T) {
+	opts := PackageOptions{Include: []string{"usr/share/zoneinfo/Europe"}, Exclude: []string{"usr/share/zoneinfo/Europe/Berlin"}}
+	if !opts.wantsPath("usr/share/zoneinfo/Europe/Paris") {
+		t.Errorf("included path rejected")
+	}
+	if opts.wantsPath("usr/share/zoneinfo/Europe/Berlin") {
+		t.Errorf("excluded path accepted")
+	}
+	if opts.wantsPath("usr/share/zoneinfo/Asia/Tokyo") {
+		t.Errorf("path outside include accepted")
+	}
+}
+
+func TestPackageOptionsRelocate(t *testing.T) {
+	for prefix, want := range map[string]string{"": "usr/bin/gcc", "opt/toolchain": "opt/toolchain/usr/bin/gcc", "/opt/toolchain/": "opt/toolchain/usr/bin/gcc"} {
+		if got := (PackageOptions{Prefix: prefix}).relocate("usr/bin/gcc"); got != want {
+			t.Errorf("prefix %q: relocate = %q, want %q", prefix, got, want)
+		}
+	}
+	for _, prefix := range []string{"/", "..", "opt/../../etc"} {
+		cfg := &Config{PackageOptions: map[string]PackageOptions{"gcc": {Prefix: prefix}}}
+		if err := validatePackageOptions(cfg); err == nil {
+			t.Errorf("prefix %q should be refused", prefix)
+		}
+	}
+}
+
+func TestExtractApkModes(t *testing.T) {
+	oldCfg := globalConfig
+	globalConfig = &Config{DirMode: "0750"}
+	defer func() { globalConfig = oldCfg }()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for _, hdr := range []*tar.Header{
+		{Name: "tmp/", Mode: 01777, Typeflag: tar.TypeDir},
+		{Name: "usr/bin/hello", Mode: 0755, Typeflag: tar.TypeReg},
+		{Name: "bin/su", Mode: 04755, Typeflag: tar.TypeReg},
+		{Name: "usr/bin/wall", Mode: 02755, Typeflag: tar.TypeReg},
+		{Name: "etc/shadow", Mode: 0640, Typeflag: tar.TypeReg},
+		{Name: "proc/", Mode: 0555, Typeflag: tar.TypeDir},
+	} {
+		tw.WriteHeader(hdr)
+	}
+	tw.Close()
+	zw.Close()
+	dir := t.TempDir()
+	apk := filepath.Join(dir, "pkg.apk")
+	os.WriteFile(apk, buf.Bytes(), 0644)
+	dest := filepath.Join(dir, "staging")
+	if err := extractApk(apk, dest, "", extractionLimits("", 0)); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]os.FileMode{
+		"tmp":           os.ModeDir | os.ModeSticky | 0777,
+		"usr/bin/hello": 0755,
+		"bin/su":        os.ModeSetuid | 0755,
+		"usr/bin/wall":  os.ModeSetgid | 0755,
+		"etc/shadow":    0640,
+		"proc":          os.ModeDir | 0555,
+		"usr":           os.ModeDir | 0750, // no entry, dir_mode applies
+	} {
+		info, err := os.Stat(filepath.Join(dest, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != want {
+			t.Errorf("%s has mode %v, want %v", name, info.Mode(), want)
+		}
+	}
+	if err := validateModes(&Config{Umask: "0999"}); err == nil {
+		t.Error("expected a bad umask to be refused")
+	}
+}
+
+func TestExtractApkRefusesEscapes(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"../escape", "/etc/escape", ".."} {
+		apk := filepath.Join(dir, "pkg.apk")
+		os.WriteFile(apk, tarGz(name, "x"), 0644)
+		err := extractApk(apk, filepath.Join(dir, "staging"), "", extractionLimits("", 0))
+		if err == nil || !strings.Contains(err.Error(), "outside the package") {
+			t.Errorf("%s: expected the entry to be refused, got %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escape")); err == nil {
+		t.Error("../escape was extracted")
+	}
+}
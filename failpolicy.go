@@ -0,0 +1,191 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// on_failure policies
+const (
+	failFast          = "fail-fast"
+	failContinue      = "continue-and-report"
+	failRetryPrefix   = "retry-"
+	maxFailureRetries = 10
+)
+
+// failurePolicy is the parsed on_failure: how often a failed package step is retried,
+// and whether the run goes on without the package once it still fails
+type failurePolicy struct {
+	retries int
+	cont    bool
+}
+
+// parseFailurePolicy parses on_failure, empty is fail-fast
+func parseFailurePolicy(s string) (failurePolicy, error) {
+	switch s {
+	case "", failFast:
+		return failurePolicy{}, nil
+	case failContinue:
+		return failurePolicy{cont: true}, nil
+	}
+	if n, ok := strings.CutPrefix(s, failRetryPrefix); ok {
+		if retries, err := strconv.Atoi(n); err == nil && retries > 0 && retries <= maxFailureRetries {
+			return failurePolicy{retries: retries}, nil
+		}
+	}
+	return failurePolicy{}, fmt.Errorf("unknown on_failure %q (known: fail-fast, continue-and-report, retry-N with N from 1 to %d)", s, maxFailureRetries)
+}
+
+// validateFailurePolicy checks on_failure and package_timeout
+func validateFailurePolicy(cfg *Config) error {
+	if _, err := parseFailurePolicy(cfg.OnFailure); err != nil {
+		return err
+	}
+	if cfg.PackageTimeout != "" {
+		if d, err := time.ParseDuration(cfg.PackageTimeout); err != nil || d <= 0 {
+			return fmt.Errorf("package_timeout %q is not a positive duration", cfg.PackageTimeout)
+		}
+	}
+	return nil
+}
+
+// activeFailurePolicy returns the policy of the config being applied
+func activeFailurePolicy() (failurePolicy, time.Duration) {
+	if globalConfig == nil {
+		return failurePolicy{}, 0
+	}
+	p, _ := parseFailurePolicy(globalConfig.OnFailure)
+	d, _ := time.ParseDuration(globalConfig.PackageTimeout)
+	return p, d
+}
+
+// errPackageTimeout is returned once a package step ran past package_timeout
+var errPackageTimeout = errors.New("package_timeout exceeded")
+
+// packageDeadline is when the running package step times out, zero without a timeout
+var packageDeadline time.Time
+
+// checkPackageDeadline fails once the running package step is past its deadline. It's
+// checked between archive entries and download reads, so a step never stops halfway
+// through a write. The error is permanent, network retries don't extend the step.
+func checkPackageDeadline() error {
+	if !packageDeadline.IsZero() && time.Now().After(packageDeadline) {
+		return &permanentError{errPackageTimeout}
+	}
+	return nil
+}
+
+// deadlineReader fails reads once the running package step is past its deadline
+type deadlineReader struct {
+	io.Reader
+}
+
+func (r deadlineReader) Read(p []byte) (int, error) {
+	if err := checkPackageDeadline(); err != nil {
+		return 0, err
+	}
+	return r.Reader.Read(p)
+}
+
+// PackageFailure is a package the run went on without under continue-and-report
+type PackageFailure struct {
+	Name  string `json:"name"`
+	Step  string `json:"step"`
+	Error string `json:"error"`
+}
+
+// failedPackages are the packages skipped by this run
+var failedPackages []PackageFailure
+
+// packageFailed reports whether pkg was skipped by this run
+func packageFailed(pkg string) bool {
+	for _, f := range failedPackages {
+		if f.Name == pkg {
+			return true
+		}
+	}
+	return false
+}
+
+// runPackageStep runs one step (download, install) of pkg under on_failure and
+// package_timeout. Changes an attempt made in tx are rolled back before the next one.
+// It returns false when the package failed and the run goes on without it, and an
+// error when the run has to stop.
+func runPackageStep(pkg, step string, tx *Transaction, fn func() error) (bool, error) {
+	policy, timeout := activeFailurePolicy()
+	var err error
+	for attempt := 0; attempt <= policy.retries; attempt++ {
+		if attempt > 0 {
+			eprintf("[WARN] %s of %s failed, retrying (%d/%d): %v\n", step, pkg, attempt, policy.retries, err)
+		}
+		var sp txSavepoint
+		if tx != nil {
+			sp = tx.savepoint()
+		}
+		if timeout > 0 {
+			packageDeadline = time.Now().Add(timeout)
+		}
+		err = fn()
+		packageDeadline = time.Time{}
+		if err == nil {
+			return true, nil
+		}
+		if tx != nil {
+			if rerr := tx.rollbackTo(sp); rerr != nil {
+				return false, fmt.Errorf("%s of %s failed (%v) and rolling it back failed: %w", step, pkg, err, rerr)
+			}
+		}
+	}
+	if !policy.cont {
+		return false, err
+	}
+	eprintf("[ERROR] %s of %s failed, continuing without it: %v\n", step, pkg, err)
+	failedPackages = append(failedPackages, PackageFailure{Name: pkg, Step: step, Error: err.Error()})
+	return false, nil
+}
+
+// withoutFailed drops the skipped packages from pkgs
+func withoutFailed(pkgs []string) []string {
+	var kept []string
+	for _, pkg := range pkgs {
+		if !packageFailed(pkg) {
+			kept = append(kept, pkg)
+		}
+	}
+	return kept
+}
+
+// dropFailedPackages takes the skipped packages out of the plan and keeps their installed
+// version (if any) in updatedPkgs
+func dropFailedPackages(plan *Plan, updatedPkgs, installedPkgs map[string]string) {
+	if len(failedPackages) == 0 {
+		return
+	}
+	keep := func(items []PlanItem) []PlanItem {
+		var kept []PlanItem
+		for _, it := range items {
+			if !packageFailed(it.Name) {
+				kept = append(kept, it)
+			}
+		}
+		return kept
+	}
+	plan.Installs, plan.Upgrades = keep(plan.Installs), keep(plan.Upgrades)
+	for _, f := range failedPackages {
+		if old, ok := installedPkgs[f.Name]; ok {
+			updatedPkgs[f.Name] = old
+		} else {
+			delete(updatedPkgs, f.Name)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunPackageStep(t *testing.T) {
+	oldConfig, oldState := globalConfig, stateDir
+	defer func() { globalConfig, stateDir, failedPackages = oldConfig, oldState, nil }()
+	stateDir = t.TempDir()
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "kept"), []byte("original"), 0644)
+
+	for _, bad := range []string{"retry-0", "retry-x", "skip"} {
+		if err := validateFailurePolicy(&Config{OnFailure: bad}); err == nil {
+			t.Errorf("on_failure %q accepted", bad)
+		}
+	}
+	if err := validateFailurePolicy(&Config{OnFailure: "retry-3", PackageTimeout: "5m"}); err != nil {
+		t.Error(err)
+	}
+
+	tx, err := beginTransaction(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An attempt that wrote files and failed is rolled back before the retry
+	write := func(rel, data string) error {
+		if err := tx.prepareWrite(rel); err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(root, rel), []byte(data), 0644)
+	}
+	globalConfig = &Config{OnFailure: "retry-2"}
+	attempts := 0
+	ok, err := runPackageStep("foo", "install", tx, func() error {
+		attempts++
+		if err := write("kept", "attempt"); err != nil {
+			return err
+		}
+		if attempts == 1 {
+			if err := write("partial", "half"); err != nil {
+				return err
+			}
+			return errors.New("disk hiccup")
+		}
+		return nil
+	})
+	if !ok || err != nil || attempts != 2 {
+		t.Fatalf("retry: %v %v after %d attempts", ok, err, attempts)
+	}
+	if _, err := os.Stat(filepath.Join(root, "partial")); !os.IsNotExist(err) {
+		t.Error("the failed attempt's file was kept")
+	}
+
+	// continue-and-report undoes only the failing package, a file foo wrote gets foo's
+	// content back
+	globalConfig = &Config{OnFailure: failContinue}
+	ok, err = runPackageStep("bar", "install", tx, func() error {
+		write("bar-file", "bar")
+		write("kept", "bar")
+		return errors.New("broken archive")
+	})
+	if ok || err != nil || !packageFailed("bar") || packageFailed("foo") {
+		t.Fatalf("continue: %v %v %+v", ok, err, failedPackages)
+	}
+	if _, err := os.Stat(filepath.Join(root, "bar-file")); !os.IsNotExist(err) {
+		t.Error("the failed package's file was kept")
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "kept")); string(data) != "attempt" {
+		t.Errorf("the failed package's content of a shared file was kept: %q", data)
+	}
+	if err := tx.rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "kept")); string(data) != "original" {
+		t.Errorf("rollback after a savepoint restored %q", data)
+	}
+
+	// fail-fast stops, a timeout is a failure
+	globalConfig = &Config{PackageTimeout: "10ms"}
+	_, err = runPackageStep("slow", "download", nil, func() error {
+		for {
+			if err := checkPackageDeadline(); err != nil {
+				return err
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+	if !errors.Is(err, errPackageTimeout) {
+		t.Errorf("timeout: %v", err)
+	}
+	if !packageDeadline.IsZero() {
+		t.Error("deadline left set")
+	}
+}
@@ -0,0 +1,196 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PackageOptions are per-package settings from the package_options config map
+type PackageOptions struct {
+	// Include, when set, only installs paths matching one of these globs (or below them)
+	Include []string `yaml:"include,omitempty"`
+	// Exclude never installs paths matching one of these globs (or below them)
+	Exclude []string `yaml:"exclude,omitempty"`
+	// NoStrip keeps the package's ELF files as shipped when strip is enabled
+	NoStrip bool `yaml:"no_strip,omitempty"`
+	// Prefix installs the package below this directory of install_dir (e.g. opt/toolchain)
+	Prefix string `yaml:"prefix,omitempty"`
+	// AllowSuid lets the package install setuid/setgid files and file capabilities without -allow-suid
+	AllowSuid bool `yaml:"allow_suid,omitempty"`
+}
+
+// excludeProfiles are the built-in path exclusion sets usable in exclude_profiles
+var excludeProfiles = map[string][]string{
+	"no-docs": {
+		"usr/share/doc", "usr/share/man", "usr/share/info",
+		"usr/share/gtk-doc", "usr/share/devhelp",
+	},
+	"no-locales": {
+		"usr/share/locale", "usr/lib/locale",
+	},
+	"minimal": {
+		"usr/share/doc", "usr/share/man", "usr/share/info",
+		"usr/share/gtk-doc", "usr/share/devhelp",
+		"usr/share/locale", "usr/lib/locale",
+		"usr/share/bash-completion", "usr/share/zsh", "usr/share/fish",
+	},
+}
+
+// validateExcludeProfiles checks that every configured exclude profile exists
+func validateExcludeProfiles(cfg *Config) error {
+	for _, name := range cfg.ExcludeProfiles {
+		if _, ok := excludeProfiles[name]; !ok {
+			return fmt.Errorf("unknown exclude profile %q (known: minimal, no-docs, no-locales)", name)
+		}
+	}
+	return nil
+}
+
+// validatePackageOptions checks that every prefix is a directory inside install_dir
+func validatePackageOptions(cfg *Config) error {
+	for pkg, opts := range cfg.PackageOptions {
+		if opts.Prefix == "" {
+			continue
+		}
+		if p := opts.prefixDir(); p == "." || p == ".." || strings.HasPrefix(p, "../") {
+			return fmt.Errorf("prefix %q of %s must be a directory inside install_dir", opts.Prefix, pkg)
+		}
+	}
+	return nil
+}
+
+// packageOptions returns the configured options of pkg, with the global
+// exclude globs and profiles added to its excludes
+func packageOptions(pkg string) PackageOptions {
+	if globalConfig == nil {
+		return PackageOptions{}
+	}
+	opts := globalConfig.optionsOf(pkg)
+	var exclude []string
+	exclude = append(exclude, opts.Exclude...)
+	exclude = append(exclude, globalConfig.Exclude...)
+	for _, name := range globalConfig.ExcludeProfiles {
+		exclude = append(exclude, excludeProfiles[name]...)
+	}
+	opts.Exclude = exclude
+	return opts
+}
+
+// hasPathFilters reports whether only part of the package gets installed
+func (o PackageOptions) hasPathFilters() bool {
+	return len(o.Include) > 0 || len(o.Exclude) > 0
+}
+
+// wantsPath reports whether rel passes the include/exclude filters
+func (o PackageOptions) wantsPath(rel string) bool {
+	rel = filepath.ToSlash(rel)
+	if len(o.Include) > 0 {
+		included := false
+		for _, pattern := range o.Include {
+			if matchPathOrParent(pattern, rel) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+	for _, pattern := range o.Exclude {
+		if matchPathOrParent(pattern, rel) {
+			return false
+		}
+	}
+	return true
+}
+
+// relocate returns where rel of the package is installed, below its prefix if it has one
+func (o PackageOptions) relocate(rel string) string {
+	if o.Prefix == "" {
+		return rel
+	}
+	return filepath.Join(o.prefixDir(), rel)
+}
+
+// prefixDir returns the prefix relative to install_dir, a leading / is allowed
+func (o PackageOptions) prefixDir() string {
+	if p := strings.TrimLeft(filepath.Clean(o.Prefix), "/"); p != "" {
+		return p
+	}
+	return "."
+}
+
+// filteredFiles walks the extracted package in dir like an install does: it returns the
+// (relocated) paths opts installs and the package paths its filters leave out
+func filteredFiles(opts PackageOptions, dir string) (files, omitted []string) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return nil
+		}
+		switch {
+		case info.IsDir() && opts.hasPathFilters():
+			// Only the directories of the files installed are created
+		case !info.IsDir() && !opts.wantsPath(rel):
+			omitted = append(omitted, rel)
+		default:
+			files = append(files, opts.relocate(rel))
+		}
+		return nil
+	})
+	return files, omitted
+}
+
+// omittedFilesPath returns where the files a filter left out of pkg are recorded
+func omittedFilesPath(pkg string) string {
+	return filepath.Join(installedControlPath(pkg), "omitted.yaml")
+}
+
+// writeOmittedFiles records the files filters left out of pkg, so verify knows they are missing on purpose
+func writeOmittedFiles(pkg string, files []string) error {
+	os.Remove(omittedFilesPath(pkg))
+	if len(files) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(installedControlPath(pkg), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(omittedFilesPath(pkg))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	enc := yaml.NewEncoder(f)
+	return enc.Encode(files)
+}
+
+// readOmittedFiles reads the files filters left out of pkg
+func readOmittedFiles(pkg string) ([]string, error) {
+	f, err := os.Open(omittedFilesPath(pkg))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var files []string
+	dec := yaml.NewDecoder(f)
+	if err := dec.Decode(&files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
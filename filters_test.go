@@ -0,0 +1,66 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGlobalExclusions(t *testing.T) {
+	oldConfig := globalConfig
+	defer func() { globalConfig = oldConfig }()
+	globalConfig = &Config{
+		Exclude:         []string{"etc/motd"},
+		ExcludeProfiles: []string{"no-docs"},
+		PackageOptions:  map[string]PackageOptions{"tzdata": {Exclude: []string{"usr/share/zoneinfo/right"}}},
+	}
+	for _, tc := range []struct {
+		pkg, path string
+		want      bool
+	}{
+		{"busybox", "bin/busybox", true},
+		{"busybox", "etc/motd", false},
+		{"busybox", "usr/share/man/man1/busybox.1.gz", false},
+		{"busybox", "usr/share/locale/de/LC_MESSAGES/busybox.mo", true},
+		{"tzdata", "usr/share/zoneinfo/right/UTC", false},
+		{"tzdata", "usr/share/doc/tzdata/README", false},
+		{"tzdata", "usr/share/zoneinfo/UTC", true},
+	} {
+		if got := packageOptions(tc.pkg).wantsPath(tc.path); got != tc.want {
+			t.Errorf("%s: wantsPath(%s) = %v, want %v", tc.pkg, tc.path, got, tc.want)
+		}
+	}
+	if !packageOptions("busybox").hasPathFilters() {
+		t.Error("global exclusions don't count as path filters")
+	}
+
+	globalConfig.ExcludeProfiles = []string{"minimal"}
+	if packageOptions("bash").wantsPath("usr/share/bash-completion/completions/git") {
+		t.Error("minimal profile kept shell completions")
+	}
+	if err := validateExcludeProfiles(&Config{ExcludeProfiles: []string{"tiny"}}); err == nil {
+		t.Error("unknown profile accepted")
+	}
+}
+
+func TestFilteredFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, rel := range []string{"usr/bin/tool", "usr/share/doc/tool/README"} {
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(rel)), 0755)
+		os.WriteFile(filepath.Join(dir, rel), nil, 0644)
+	}
+	files, omitted := filteredFiles(PackageOptions{Exclude: []string{"usr/share/doc"}}, dir)
+	if strings.Join(files, " ") != "usr/bin/tool" || strings.Join(omitted, " ") != "usr/share/doc/tool/README" {
+		t.Errorf("files %v, omitted %v", files, omitted)
+	}
+	if files, _ := filteredFiles(PackageOptions{}, dir); len(files) != 7 {
+		t.Errorf("unfiltered files %v", files)
+	}
+}
@@ -0,0 +1,121 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"flag"
+	"sort"
+	"strings"
+)
+
+// cmdFreeze implements `apkg freeze [-lock-only] [-version <v>] [-sign] [-key <id>]`: the installed
+// packages, dependencies included, become the config's package list and their exact
+// versions, repos and checksums are written to the lockfile like apkg lock does
+func cmdFreeze(configPath string, args []string) int {
+	fs := flag.NewFlagSet("freeze", flag.ExitOnError)
+	lockOnly := fs.Bool("lock-only", false, "Only write the lockfile, leave the config's package list alone")
+	sign := fs.Bool("sign", false, "Sign the lockfile with gpg (writes <lockfile>.sig)")
+	key := fs.String("key", "", "GPG key to sign with (default: gpg's default key)")
+	version := fs.String("version", "", "Version of the locked package set, promoted to channels in the channel manifest")
+	fs.Parse(args)
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		eprintf("[FATAL] Failed to read config: %v\n", err)
+		return 1
+	}
+	globalConfig = cfg
+	installedPkgs, err := readInstalledPkgs(statePath("installed.yaml"))
+	if err != nil {
+		eprintf("[FATAL] Failed to read installed.yaml: %v\n", err)
+		return 1
+	}
+	if len(installedPkgs) == 0 {
+		eprintf("[ERROR] Nothing is installed, refusing to write an empty package list\n")
+		return 1
+	}
+	// The base layer's packages aren't installed, so they aren't locked either
+	if err := loadBase(cfg); err != nil {
+		eprintf("[FATAL] %v\n", err)
+		return 1
+	}
+	pkgMap, sourceRepo := map[string]APKPackage{}, map[string]string{}
+	if len(cfg.Repos) > 0 {
+		if pkgMap, sourceRepo, err = fetchAndParseAllAPKIndexes(cfg.Repos); err != nil {
+			eprintf("[FATAL] Error fetching APKINDEX: %v\n", err)
+			return 2
+		}
+	}
+	workDir, err := newWorkDir("run")
+	if err != nil {
+		eprintf("[FATAL] Failed to create temp dir: %v\n", err)
+		return 3
+	}
+	defer cleanupTempDirs(workDir)
+	entries := append([]string(nil), cfg.Packages...)
+	directPkgs, err := resolveDirectPackages(cfg, pkgMap, sourceRepo, workDir)
+	if err != nil {
+		eprintf("[FATAL] Failed to fetch package: %v\n", err)
+		return 2
+	}
+	// Only the installed versions are locked, a package the repos moved on from can't be
+	// installed again from the lockfile
+	names := make([]string, 0, len(installedPkgs))
+	var stale []string
+	for name, ver := range installedPkgs {
+		names = append(names, name)
+		if info, ok := pkgMap[name]; !ok || info.Version != ver {
+			stale = append(stale, name+"-"+ver)
+		}
+	}
+	sort.Strings(names)
+	if len(stale) > 0 {
+		sort.Strings(stale)
+		eprintf("[ERROR] Not available from the repos any more, run apkg to upgrade first: %s\n", strings.Join(stale, ", "))
+		return 1
+	}
+	lf := newLockfile(*version, cfg, pkgMap, sourceRepo, names)
+	printf("Fetching %d packages to record their checksums\n", len(lf.Packages))
+	if err := lockChecksums(lf, pkgMap, sourceRepo, workDir); err != nil {
+		eprintf("[FATAL] %v\n", err)
+		return 2
+	}
+
+	if !*lockOnly {
+		// Direct .apk entries are kept, the packages they install aren't listed by name again
+		packages := []string{}
+		for _, entry := range entries {
+			if isDirectEntry(entry) {
+				packages = append(packages, entry)
+			}
+		}
+		for _, name := range names {
+			if _, direct := directPkgs[name]; !direct {
+				packages = append(packages, name)
+			}
+		}
+		cfg.Packages = packages
+		if err := writeConfig(configPath, cfg); err != nil {
+			eprintf("[FATAL] Failed to write config: %v\n", err)
+			return 1
+		}
+		printf("Wrote %d packages to %s\n", len(packages), configPath)
+	}
+	path := lockfilePath(configPath)
+	if err := writeLockfile(path, lf); err != nil {
+		eprintf("[FATAL] Failed to write %s: %v\n", path, err)
+		return 1
+	}
+	printf("Locked %d packages in %s\n", len(lf.Packages), path)
+	if *sign {
+		if err := signLockfile(path, *key); err != nil {
+			eprintf("[FATAL] %v\n", err)
+			return 1
+		}
+		printf("Signed %s.sig\n", path)
+	}
+	return 0
+}
@@ -0,0 +1,81 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFreeze(t *testing.T) {
+	oldState, oldConfig := stateDir, globalConfig
+	defer func() { stateDir, globalConfig = oldState, oldConfig }()
+	stateDir = t.TempDir()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".apk") {
+			w.Write(tarGz(".PKGINFO", "pkgname = x\n"))
+			return
+		}
+		w.Write([]byte("P:curl\nV:8.9.0-r0\n\nP:musl\nV:1.2.5-r0\n\n"))
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	local := filepath.Join(dir, "local-1.0-r0.apk")
+	writeTestApk(t, local, map[string]string{".PKGINFO": "pkgname = local\npkgver = 1.0-r0\n"})
+	configPath := filepath.Join(dir, "apkg.yaml")
+	os.WriteFile(configPath, []byte("repos: ["+srv.URL+"]\npackages: [curl, "+local+"]\ntmp_dir: "+t.TempDir()+"\n"), 0644)
+
+	if code := cmdFreeze(configPath, nil); code != 1 {
+		t.Errorf("freezing nothing installed exited %d", code)
+	}
+	writeInstalledPkgs(statePath("installed.yaml"), map[string]string{"curl": "8.8.0-r0", "musl": "1.2.5-r0", "local": "1.0-r0"})
+	if code := cmdFreeze(configPath, []string{"-lock-only"}); code != 1 {
+		t.Errorf("freezing a version the repos no longer have exited %d", code)
+	}
+	writeInstalledPkgs(statePath("installed.yaml"), map[string]string{"curl": "8.9.0-r0", "musl": "1.2.5-r0", "local": "1.0-r0"})
+
+	if code := cmdFreeze(configPath, []string{"-lock-only", "-version", "7"}); code != 0 {
+		t.Fatalf("freeze -lock-only exited %d", code)
+	}
+	if data, _ := os.ReadFile(configPath); strings.Contains(string(data), "musl") {
+		t.Error("-lock-only changed the config")
+	}
+	lf, err := readLockfile(lockfilePath(configPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked := map[string]LockedPkg{}
+	for _, p := range lf.Packages {
+		locked[p.Name] = p
+	}
+	if lf.Version != "7" || len(locked) != 3 || locked["curl"].Version != "8.9.0-r0" || locked["musl"].Version != "1.2.5-r0" || locked["local"].Version != "1.0-r0" {
+		t.Errorf("unexpected lockfile %+v", lf)
+	}
+	if locked["curl"].Repo != srv.URL || locked["local"].Repo != "" {
+		t.Errorf("expected the repos of the packages to be locked, got %+v", lf.Packages)
+	}
+	for _, p := range lf.Packages {
+		if p.SHA256 == "" {
+			t.Errorf("%s was locked without checksum", p.Name)
+		}
+	}
+
+	if code := cmdFreeze(configPath, nil); code != 0 {
+		t.Fatalf("freeze exited %d", code)
+	}
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(cfg.Packages, " "); got != local+" curl musl" {
+		t.Errorf("frozen packages %q", got)
+	}
+}
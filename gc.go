@@ -0,0 +1,134 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// inodeKey identifies a file across the generations sharing it through hardlinks
+type inodeKey struct {
+	dev, ino uint64
+}
+
+// treeInodes adds the inode of every regular file under dir to seen, returning the size
+// of the files that weren't in it yet
+func treeInodes(dir string, seen map[inodeKey]bool) int64 {
+	var size int64
+	filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			size += info.Size()
+			return nil
+		}
+		key := inodeKey{uint64(st.Dev), uint64(st.Ino)}
+		if !seen[key] {
+			seen[key] = true
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// collectGenerations picks the generations gc removes: unfinished ones and finished ones
+// older than the keep most recent, the active generation is always kept (keep 0 keeps all
+// finished ones)
+func collectGenerations(gens []int, active, keep int) []int {
+	var complete []int
+	for _, n := range gens {
+		if generationComplete(n) {
+			complete = append(complete, n)
+		}
+	}
+	retained := map[int]bool{active: true}
+	for i := len(complete) - 1; i >= 0; i-- {
+		if keep == 0 || len(complete)-i <= keep {
+			retained[complete[i]] = true
+		}
+	}
+	var drop []int
+	for _, n := range gens {
+		if !retained[n] {
+			drop = append(drop, n)
+		}
+	}
+	return drop
+}
+
+// cmdGC implements `apkg gc [-keep <n>] [-n]`
+func cmdGC(configPath string, args []string) int {
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		eprintf("[FATAL] Failed to read config: %v\n", err)
+		return 1
+	}
+	globalConfig = cfg
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	keep := fs.Int("keep", cfg.GenerationsKeep, "Keep the n most recent generations besides the active one (0 keeps all finished ones)")
+	dryRun := fs.Bool("n", false, "Only report what would be removed")
+	fs.Parse(args)
+	if *keep < 0 {
+		eprintf("[ERROR] -keep can't be negative\n")
+		return 1
+	}
+	gens, err := allGenerations()
+	if err != nil {
+		eprintf("[ERROR] Failed to list generations: %v\n", err)
+		return 1
+	}
+	lock, err := acquireRunLock()
+	if err != nil {
+		eprintf("[ERROR] %v\n", err)
+		return 1
+	}
+	defer lock.Close()
+	drop := collectGenerations(gens, activeGeneration(cfg.InstallDir), *keep)
+	if len(drop) == 0 {
+		printf("Nothing to collect.\n")
+		return 0
+	}
+	// Only data no retained generation links to is reclaimed
+	dropped := make(map[int]bool)
+	for _, n := range drop {
+		dropped[n] = true
+	}
+	seen := make(map[inodeKey]bool)
+	for _, n := range gens {
+		if !dropped[n] {
+			treeInodes(generationPath(n), seen)
+		}
+	}
+	var reclaimed int64
+	status := 0
+	for _, n := range drop {
+		size := treeInodes(generationPath(n), seen)
+		reclaimed += size
+		if *dryRun {
+			printf("Would remove generation %d (%s)\n", n, humanSize(size))
+			continue
+		}
+		if err := os.RemoveAll(generationPath(n)); err != nil {
+			eprintf("[WARN] Failed to remove generation %d: %v\n", n, err)
+			status = 1
+			continue
+		}
+		printf("Removed generation %d (%s)\n", n, humanSize(size))
+	}
+	if *dryRun {
+		printf("%s would be reclaimed\n", humanSize(reclaimed))
+	} else {
+		printf("Reclaimed %s\n", humanSize(reclaimed))
+	}
+	return status
+}
@@ -0,0 +1,318 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// generationsDir (under the state dir) holds one directory per generation with the
+// install root it built ("root") and the package state it was made with ("state")
+const generationsDir = "generations"
+
+// generationState are the state files describing what is installed, they are kept
+// with every generation and restored when switching to it
+var generationState = []string{"installed.yaml", "installed_files", installedControlDir, alternativesFile, hardlinksFile, strippedFile, ldPathStateFile, previousKernelsFile}
+
+// generationPath returns the directory of generation n
+func generationPath(n int) string {
+	return filepath.Join(statePath(generationsDir), strconv.Itoa(n))
+}
+
+// generationRoot returns the absolute path of the install root of generation n, which
+// install_dir links to while it's active
+func generationRoot(n int) (string, error) {
+	return filepath.Abs(filepath.Join(generationPath(n), "root"))
+}
+
+// generationComplete reports whether generation n was finished, an interrupted apply
+// leaves its generation without state
+func generationComplete(n int) bool {
+	_, err := os.Stat(filepath.Join(generationPath(n), "state"))
+	return err == nil
+}
+
+// allGenerations returns the numbers of all generation directories, oldest first
+func allGenerations() ([]int, error) {
+	entries, err := os.ReadDir(statePath(generationsDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var gens []int
+	for _, e := range entries {
+		if n, err := strconv.Atoi(e.Name()); err == nil && e.IsDir() {
+			gens = append(gens, n)
+		}
+	}
+	sort.Ints(gens)
+	return gens, nil
+}
+
+// activeGeneration returns the generation install_dir links to, 0 when it isn't one
+func activeGeneration(installDir string) int {
+	target, err := os.Readlink(filepath.Clean(installDir))
+	if err != nil || filepath.Base(target) != "root" {
+		return 0
+	}
+	n, err := strconv.Atoi(filepath.Base(filepath.Dir(target)))
+	if err != nil {
+		return 0
+	}
+	if root, err := generationRoot(n); err != nil || root != target {
+		return 0
+	}
+	return n
+}
+
+// copyTree copies the tree at src to dst, regular files are hardlinked when link is set
+func copyTree(src, dst string, link bool) error {
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			dest, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(dest, target)
+		case info.Mode().IsRegular():
+			if link && os.Link(p, target) == nil {
+				return nil
+			}
+			return copyFile(p, target, info.Mode())
+		}
+		return nil // devices and fifos aren't shipped by packages
+	})
+}
+
+// saveGenerationState copies the current package state into generation n
+func saveGenerationState(n int) error {
+	dir := filepath.Join(generationPath(n), "state")
+	tmp := dir + ".tmp"
+	os.RemoveAll(tmp)
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return err
+	}
+	for _, name := range generationState {
+		if _, err := os.Lstat(statePath(name)); os.IsNotExist(err) {
+			continue
+		}
+		if err := copyTree(statePath(name), filepath.Join(tmp, name), false); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp, dir)
+}
+
+// restoreGenerationState replaces the current package state by the one of generation n
+func restoreGenerationState(n int) error {
+	dir := filepath.Join(generationPath(n), "state")
+	for _, name := range generationState {
+		if err := os.RemoveAll(statePath(name)); err != nil {
+			return err
+		}
+		if _, err := os.Lstat(filepath.Join(dir, name)); os.IsNotExist(err) {
+			continue
+		}
+		if err := copyTree(filepath.Join(dir, name), statePath(name), false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pointInstallDir atomically points the install_dir symlink at generation n
+func pointInstallDir(installDir string, n int) error {
+	root, err := generationRoot(n)
+	if err != nil {
+		return err
+	}
+	installDir = filepath.Clean(installDir)
+	tmp := installDir + ".apkg-new"
+	os.Remove(tmp)
+	if err := os.Symlink(root, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, installDir)
+}
+
+// beginGeneration starts a new generation as a hardlinked copy of the active one and
+// returns its number and root, the apply then works on that root. An install_dir that
+// is a plain directory becomes the first generation.
+func beginGeneration(installDir string) (int, string, error) {
+	active := activeGeneration(installDir)
+	if active == 0 {
+		info, err := os.Lstat(installDir)
+		switch {
+		case err == nil && info.Mode()&os.ModeSymlink != 0:
+			return 0, "", fmt.Errorf("install_dir %s is a symlink that isn't managed by apkg", installDir)
+		case err == nil:
+			gens, err := allGenerations()
+			if err != nil {
+				return 0, "", err
+			}
+			active = 1
+			if len(gens) > 0 {
+				active = gens[len(gens)-1] + 1
+			}
+			if err := os.MkdirAll(generationPath(active), 0755); err != nil {
+				return 0, "", err
+			}
+			root, _ := generationRoot(active)
+			if err := os.Rename(installDir, root); err != nil {
+				return 0, "", fmt.Errorf("failed to move install_dir into generation %d (it has to be on the same filesystem as the state dir): %w", active, err)
+			}
+			if err := saveGenerationState(active); err != nil {
+				return 0, "", err
+			}
+			if err := pointInstallDir(installDir, active); err != nil {
+				return 0, "", err
+			}
+			printf("Moved %s into generation %d\n", installDir, active)
+		case !os.IsNotExist(err):
+			return 0, "", err
+		}
+	}
+	gens, err := allGenerations()
+	if err != nil {
+		return 0, "", err
+	}
+	next := 1
+	if len(gens) > 0 {
+		next = gens[len(gens)-1] + 1
+	}
+	root, err := generationRoot(next)
+	if err != nil {
+		return 0, "", err
+	}
+	if active != 0 {
+		from, _ := generationRoot(active)
+		err = copyTree(from, root, true)
+	} else {
+		err = os.MkdirAll(root, dirMode())
+	}
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to create generation %d: %w", next, err)
+	}
+	return next, root, nil
+}
+
+// finishGeneration records the package state of generation n and makes it the active one
+func finishGeneration(installDir string, n int) error {
+	if err := saveGenerationState(n); err != nil {
+		return err
+	}
+	if err := pointInstallDir(installDir, n); err != nil {
+		return err
+	}
+	printf("Switched %s to generation %d\n", installDir, n)
+	return nil
+}
+
+// abortGeneration puts the package state of the active generation back after the apply
+// building generation n failed and removes what was built of n, install_dir still links
+// to the active one. Without an active generation there was no install root, so there
+// is no state either.
+func abortGeneration(active, n int) {
+	if err := restoreGenerationState(active); err != nil {
+		eprintf("[ERROR] Failed to restore the state of generation %d: %v\n", active, err)
+		return
+	}
+	if err := os.RemoveAll(generationPath(n)); err != nil {
+		eprintf("[WARN] Failed to remove the unfinished generation %d: %v\n", n, err)
+	}
+	eprintf("Generation %d was not finished, kept the state of generation %d.\n", n, active)
+}
+
+// cmdGenerations implements `apkg generations list|switch <n>`
+func cmdGenerations(configPath string, args []string) int {
+	fs := flag.NewFlagSet("generations", flag.ExitOnError)
+	fs.Parse(args)
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		eprintf("[FATAL] Failed to read config: %v\n", err)
+		return 1
+	}
+	if !cfg.Generations {
+		eprintf("[ERROR] generations is not enabled in the config\n")
+		return 1
+	}
+	gens, err := allGenerations()
+	if err != nil {
+		eprintf("[ERROR] Failed to list generations: %v\n", err)
+		return 1
+	}
+	active := activeGeneration(cfg.InstallDir)
+	switch fs.Arg(0) {
+	case "", "list":
+		for _, n := range gens {
+			if !generationComplete(n) {
+				continue
+			}
+			mark := " "
+			if n == active {
+				mark = "*"
+			}
+			info, _ := os.Stat(filepath.Join(generationPath(n), "state"))
+			pkgs, _ := readInstalledPkgs(filepath.Join(generationPath(n), "state", "installed.yaml"))
+			printf("%s %4d  %s  %d packages\n", mark, n, info.ModTime().Format("2006-01-02 15:04:05"), len(pkgs))
+		}
+		return 0
+	case "switch":
+		n, err := strconv.Atoi(fs.Arg(1))
+		if err != nil || fs.NArg() != 2 {
+			eprintf("Usage: apkg generations switch <n>\n")
+			return 1
+		}
+		if !generationComplete(n) {
+			eprintf("[ERROR] There is no generation %d\n", n)
+			return 1
+		}
+		if n == active {
+			printf("Generation %d is already active.\n", n)
+			return 0
+		}
+		if _, err := acquireRunLock(); err != nil {
+			eprintf("[FATAL] %v\n", err)
+			return 1
+		}
+		before, _ := readInstalledPkgs(statePath("installed.yaml"))
+		if err := restoreGenerationState(n); err != nil {
+			eprintf("[ERROR] Failed to restore the state of generation %d: %v\n", n, err)
+			return 4
+		}
+		after, _ := readInstalledPkgs(statePath("installed.yaml"))
+		if err := emitInstalledEvent(statePath("installed.yaml"), before, after); err != nil {
+			eprintf("[WARN] Failed to write %s: %v\n", eventFile, err)
+		}
+		if err := pointInstallDir(cfg.InstallDir, n); err != nil {
+			eprintf("[ERROR] Failed to switch to generation %d: %v\n", n, err)
+			return 4
+		}
+		printf("Switched %s to generation %d\n", cfg.InstallDir, n)
+		return 0
+	}
+	eprintf("[ERROR] Unknown generations command %q (known: list, switch)\n", fs.Arg(0))
+	return 1
+}
@@ -0,0 +1,116 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGenerations(t *testing.T) {
+	oldState := stateDir
+	stateDir = t.TempDir()
+	defer func() { stateDir = oldState }()
+	installDir := filepath.Join(stateDir, "root")
+	os.MkdirAll(filepath.Join(installDir, "etc"), 0755)
+	os.WriteFile(filepath.Join(installDir, "etc", "motd"), []byte("v1\n"), 0644)
+	writeInstalledPkgs(statePath("installed.yaml"), map[string]string{"motd": "1-r0"})
+
+	// A plain install_dir becomes generation 1, the apply builds generation 2
+	n, root, err := beginGeneration(installDir)
+	if err != nil || n != 2 {
+		t.Fatalf("beginGeneration = %d, %v", n, err)
+	}
+	if activeGeneration(installDir) != 1 {
+		t.Fatalf("expected install_dir to link to generation 1")
+	}
+	// Files are replaced by rename like transactions do, the old generation keeps its copy
+	os.Remove(filepath.Join(root, "etc", "motd"))
+	os.WriteFile(filepath.Join(root, "etc", "motd"), []byte("v2\n"), 0644)
+	writeInstalledPkgs(statePath("installed.yaml"), map[string]string{"motd": "2-r0"})
+	if err := finishGeneration(installDir, n); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(installDir, "etc", "motd")); string(data) != "v2\n" {
+		t.Errorf("generation 2 has motd %q", data)
+	}
+
+	if err := restoreGenerationState(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := pointInstallDir(installDir, 1); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(installDir, "etc", "motd")); string(data) != "v1\n" {
+		t.Errorf("generation 1 has motd %q", data)
+	}
+	if pkgs, _ := readInstalledPkgs(statePath("installed.yaml")); pkgs["motd"] != "1-r0" {
+		t.Errorf("expected the state of generation 1 back, got %v", pkgs)
+	}
+}
+
+func TestCollectGenerations(t *testing.T) {
+	oldState := stateDir
+	stateDir = t.TempDir()
+	defer func() { stateDir = oldState }()
+	for _, n := range []int{1, 2, 3, 4, 6} {
+		os.MkdirAll(filepath.Join(generationPath(n), "root"), 0755)
+		if n != 4 {
+			os.MkdirAll(filepath.Join(generationPath(n), "state"), 0755)
+		}
+	}
+	// 4 never finished, 2 is active after a switch back
+	drop := collectGenerations([]int{1, 2, 3, 4, 6}, 2, 1)
+	if len(drop) != 3 || drop[0] != 1 || drop[1] != 3 || drop[2] != 4 {
+		t.Errorf("collectGenerations = %v, want [1 3 4]", drop)
+	}
+	if drop := collectGenerations([]int{1, 2, 3, 4, 6}, 2, 0); len(drop) != 1 || drop[0] != 4 {
+		t.Errorf("keep 0 should only collect unfinished generations, got %v", drop)
+	}
+}
+
+func TestAbortGenerationAfterFailedUninstall(t *testing.T) {
+	oldState := stateDir
+	stateDir = t.TempDir()
+	defer func() { stateDir = oldState }()
+	installDir := filepath.Join(stateDir, "root")
+	os.MkdirAll(filepath.Join(installDir, "etc"), 0755)
+	os.WriteFile(filepath.Join(installDir, "etc", "motd"), []byte("v1\n"), 0644)
+	installed := map[string]string{"motd": "1-r0", "gone": "1-r0"}
+	writeInstalledPkgs(statePath("installed.yaml"), installed)
+	writeInstalledFiles("motd", []string{"etc/motd"})
+	before, _ := os.ReadFile(statePath("installed.yaml"))
+
+	n, root, err := beginGeneration(installDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The install succeeded and recorded its state, then removing gone fails because
+	// it has no file index
+	updated := map[string]string{"motd": "2-r0", "gone": "1-r0"}
+	writeInstalledPkgs(statePath("installed.yaml"), updated)
+	writeInstalledFiles("motd", []string{"etc/motd", "etc/issue"})
+	cfg := &Config{InstallDir: root}
+	if err := uninstallRemoved(cfg, []string{"gone"}, installed, updated, nil, statePath("installed.yaml")); err == nil {
+		t.Fatal("expected the uninstall to fail")
+	}
+	abortGeneration(activeGeneration(installDir), n)
+
+	if after, _ := os.ReadFile(statePath("installed.yaml")); string(after) != string(before) {
+		t.Errorf("installed.yaml changed:\n%s\nwant:\n%s", after, before)
+	}
+	if files, _ := readInstalledFiles("motd"); len(files) != 1 {
+		t.Errorf("expected the file index of the active generation back, got %v", files)
+	}
+	if activeGeneration(installDir) != 1 {
+		t.Errorf("expected install_dir to still link to generation 1")
+	}
+	if _, err := os.Stat(generationPath(n)); !os.IsNotExist(err) {
+		t.Errorf("the unfinished generation %d was left behind", n)
+	}
+}
@@ -0,0 +1,142 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"embed"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// localeFS holds the catalogs shipped with apkg, locales/<lang>.yaml maps English
+// messages to their translation
+//
+//go:embed locales/*.yaml
+var localeFS embed.FS
+
+// localeDirEnv points at a directory of <lang>.yaml catalogs, distributions ship their
+// translations there, in addition to or instead of the built-in ones
+const localeDirEnv = "APKG_LOCALE_DIR"
+
+// defaultLocaleDir is where catalogs are looked up when APKG_LOCALE_DIR isn't set
+const defaultLocaleDir = "/usr/share/apkg/locales"
+
+// catalog maps English messages to the ones of the selected language, nil for English
+var catalog map[string]string
+
+// messageTag matches the [WARN]/[ERROR]/... prefix of a message, it stays untranslated
+// so logs can still be filtered by it
+var messageTag = regexp.MustCompile(`^\[[A-Z-]+\] `)
+
+// localeLanguage returns the language of a locale name like de_DE.UTF-8, empty for
+// the C and POSIX locales
+func localeLanguage(locale string) string {
+	locale = strings.SplitN(strings.SplitN(locale, ".", 2)[0], "@", 2)[0]
+	lang := strings.ToLower(strings.SplitN(strings.SplitN(locale, "_", 2)[0], "-", 2)[0])
+	if lang == "c" || lang == "posix" {
+		return ""
+	}
+	return lang
+}
+
+// selectedLanguage returns the language from -lang, or from LC_ALL, LC_MESSAGES and
+// LANG in the order gettext consults them
+func selectedLanguage(flagLang string) string {
+	if flagLang != "" {
+		return localeLanguage(flagLang)
+	}
+	for _, env := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if v := os.Getenv(env); v != "" {
+			return localeLanguage(v)
+		}
+	}
+	return ""
+}
+
+// loadCatalog reads the catalog of lang, entries of the locale dir override the built-in ones
+func loadCatalog(lang string) (map[string]string, error) {
+	cat := map[string]string{}
+	found := false
+	if data, err := localeFS.ReadFile("locales/" + lang + ".yaml"); err == nil {
+		if err := yaml.Unmarshal(data, &cat); err != nil {
+			return nil, fmt.Errorf("built-in %s catalog: %w", lang, err)
+		}
+		found = true
+	}
+	dir := os.Getenv(localeDirEnv)
+	if dir == "" {
+		dir = defaultLocaleDir
+	}
+	path := filepath.Join(dir, lang+".yaml")
+	if data, err := os.ReadFile(path); err == nil {
+		extra := map[string]string{}
+		if err := yaml.Unmarshal(data, &extra); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		for k, v := range extra {
+			cat[k] = v
+		}
+		found = true
+	}
+	if !found {
+		return nil, fmt.Errorf("no %s catalog, messages stay in English", lang)
+	}
+	return cat, nil
+}
+
+// setLanguage switches the messages to lang, English needs no catalog
+func setLanguage(lang string) error {
+	catalog = nil
+	if lang == "" || lang == "en" {
+		return nil
+	}
+	cat, err := loadCatalog(lang)
+	if err != nil {
+		return err
+	}
+	catalog = cat
+	return nil
+}
+
+// T translates a message, its tag and trailing newline are kept as they are and
+// messages missing from the catalog stay in English
+func T(msg string) string {
+	if catalog == nil {
+		return msg
+	}
+	tag := messageTag.FindString(msg)
+	body := strings.TrimSuffix(msg[len(tag):], "\n")
+	tr, ok := catalog[body]
+	if !ok || tr == "" {
+		return msg
+	}
+	return tag + tr + msg[len(tag)+len(body):]
+}
+
+// printf prints a translated message on stdout
+func printf(format string, a ...any) {
+	if catalog == nil {
+		fmt.Printf(format, a...)
+		return
+	}
+	fmt.Printf(T(format), a...)
+}
+
+// eprintf prints a translated message on stderr, warnings are collected for the summary
+func eprintf(format string, a ...any) {
+	recordWarning(format, a...)
+	if catalog == nil {
+		fmt.Fprintf(os.Stderr, format, a...)
+		return
+	}
+	fmt.Fprintf(os.Stderr, T(format), a...)
+}
@@ -0,0 +1,84 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// formatVerb matches the verbs of a format string, %% included so escapes stay escapes
+var formatVerb = regexp.MustCompile(`%[-+# 0-9.*]*[a-zA-Z%]`)
+
+func TestCatalogVerbs(t *testing.T) {
+	files, _ := fs.Glob(localeFS, "locales/*.yaml")
+	if len(files) == 0 {
+		t.Fatal("no built-in catalogs")
+	}
+	// Every message has to still be printed somewhere, a reworded one leaves a dead key behind
+	sources, _ := filepath.Glob("*.go")
+	var src strings.Builder
+	for _, name := range sources {
+		if !strings.HasSuffix(name, "_test.go") {
+			data, _ := os.ReadFile(name)
+			src.Write(data)
+		}
+	}
+	for _, f := range files {
+		lang := strings.TrimSuffix(filepath.Base(f), ".yaml")
+		cat, err := loadCatalog(lang)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for en, tr := range cat {
+			if quoted := strconv.Quote(en); !strings.Contains(src.String(), quoted[1:len(quoted)-1]) {
+				t.Errorf("%s: %q doesn't occur in the source anymore", lang, en)
+			}
+			if a, b := formatVerb.FindAllString(en, -1), formatVerb.FindAllString(tr, -1); !reflect.DeepEqual(a, b) {
+				t.Errorf("%s: %q uses %v, its translation %v", lang, en, a, b)
+			}
+		}
+	}
+}
+
+func TestTranslate(t *testing.T) {
+	defer setLanguage("")
+	if got := localeLanguage("de_DE.UTF-8@euro"); got != "de" {
+		t.Errorf("language of de_DE.UTF-8@euro: %q", got)
+	}
+	if got := localeLanguage("C.UTF-8"); got != "" {
+		t.Errorf("language of C.UTF-8: %q", got)
+	}
+	if err := setLanguage("de"); err != nil {
+		t.Fatal(err)
+	}
+	if got := T("[FATAL] Install failed: %v\n"); got != "[FATAL] Installation fehlgeschlagen: %v\n" {
+		t.Errorf("got %q", got)
+	}
+	if got := T("[WARN] not in the catalog\n"); got != "[WARN] not in the catalog\n" {
+		t.Errorf("untranslated message changed: %q", got)
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "de.yaml"), []byte(`"Converged.": "Alles gut."`), 0644)
+	t.Setenv(localeDirEnv, dir)
+	if err := setLanguage("de"); err != nil {
+		t.Fatal(err)
+	}
+	if T("Converged.\n") != "Alles gut.\n" || T("Install") != "Installieren" {
+		t.Error("the locale dir doesn't extend the built-in catalog")
+	}
+	if err := setLanguage("xx"); err == nil || catalog != nil {
+		t.Error("unknown language accepted")
+	}
+}
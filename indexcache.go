@@ -0,0 +1,93 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// indexCacheDir (under the state dir) keeps the last successfully fetched index of
+// every repo, its modification time is when it was fetched
+const indexCacheDir = "index_cache"
+
+// requireFresh is set by -require-fresh, indexes older than it are refused (0 disables)
+var requireFresh time.Duration
+
+// indexCachePath returns where the cached index of repo is kept
+func indexCachePath(repo string) string {
+	sum := sha256.Sum256([]byte(repo))
+	return filepath.Join(statePath(indexCacheDir), hex.EncodeToString(sum[:8])+".APKINDEX")
+}
+
+// indexDigests memoizes the sha256 of the cached index of every repo fetched this run
+var indexDigests = map[string]string{}
+
+// indexDigest returns the sha256 of the cached index of repo, hashing it only once per run
+func indexDigest(repo string) (string, error) {
+	if sum, ok := indexDigests[repo]; ok {
+		return sum, nil
+	}
+	sum := fileSHA256(indexCachePath(repo))
+	if sum == "" {
+		return "", fmt.Errorf("no cached index of %s", repo)
+	}
+	indexDigests[repo] = sum
+	return sum, nil
+}
+
+// fetchIndex fetches and parses the index of repo, caching it on success. When the
+// repo can't be reached the cached copy is used instead, together with when it was fetched.
+func fetchIndex(repo string) (map[string]APKPackage, time.Time, error) {
+	path := indexCachePath(repo)
+	tmp, err := prefetchIndex(repo)
+	delete(prefetchedIndexes, repo)
+	if err == nil {
+		// An index failing its repo's trust level is never replaced by the cached copy
+		if err := checkTrust(repo, "index", tmp); err != nil {
+			os.Remove(tmp)
+			return nil, time.Time{}, err
+		}
+		var pkgs map[string]APKPackage
+		if pkgs, err = parseAPKIndexFile(tmp); err == nil {
+			indexDigests[repo] = fileSHA256(tmp)
+			if err := os.Rename(tmp, path); err != nil {
+				eprintf("[WARN] Failed to cache index of %s: %v\n", repo, err)
+			}
+			debugf("index", "%s: %d packages, cached as %s", repo, len(pkgs), path)
+			return pkgs, time.Now(), nil
+		}
+	}
+	os.Remove(tmp)
+	debugf("index", "%s: fetch failed (%v), trying the cached copy %s", repo, err, path)
+	info, statErr := os.Stat(path)
+	if statErr != nil {
+		return nil, time.Time{}, err
+	}
+	pkgs, parseErr := parseAPKIndexFile(path)
+	if parseErr != nil {
+		return nil, time.Time{}, err
+	}
+	indexDigests[repo] = fileSHA256(path)
+	eprintf("[WARN] Failed to fetch APKINDEX from %s (%v), using the copy fetched %s ago\n", repo, err, time.Since(info.ModTime()).Round(time.Minute))
+	return pkgs, info.ModTime(), nil
+}
+
+// checkIndexFresh fails when the index of repo is older than -require-fresh allows
+func checkIndexFresh(repo string, fetchedAt time.Time) error {
+	if requireFresh <= 0 {
+		return nil
+	}
+	if age := time.Since(fetchedAt); age > requireFresh {
+		return fmt.Errorf("index of %s was fetched %s ago, older than -require-fresh %s", repo, age.Round(time.Minute), requireFresh)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFetchIndexFallsBackToCache(t *testing.T) {
+	oldState, oldFresh := stateDir, requireFresh
+	stateDir = t.TempDir()
+	defer func() { stateDir, requireFresh = oldState, oldFresh }()
+
+	up := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("P:busybox\nV:1.36.1-r0\n\n"))
+	}))
+	defer srv.Close()
+
+	if _, _, err := fetchIndex(srv.URL); err != nil {
+		t.Fatalf("first fetch: %v", err)
+	}
+	up = false
+	old := time.Now().Add(-48 * time.Hour)
+	os.Chtimes(indexCachePath(srv.URL), old, old)
+	pkgs, fetchedAt, err := fetchIndex(srv.URL)
+	if err != nil || pkgs["busybox"].Version != "1.36.1-r0" {
+		t.Fatalf("expected the cached index, got %v, %v", pkgs, err)
+	}
+	if err := checkIndexFresh(srv.URL, fetchedAt); err != nil {
+		t.Errorf("freshness is only enforced with -require-fresh: %v", err)
+	}
+	requireFresh = 24 * time.Hour
+	if err := checkIndexFresh(srv.URL, fetchedAt); err == nil {
+		t.Error("expected a 48h old index to fail -require-fresh 24h")
+	}
+}
+
+func TestProvidesMapCache(t *testing.T) {
+	oldState, oldMemo, oldDigests := stateDir, providesMemo, indexDigests
+	stateDir = t.TempDir()
+	defer func() { stateDir, providesMemo, indexDigests = oldState, oldMemo, oldDigests }()
+
+	repo := "https://example.com/main"
+	os.MkdirAll(statePath(indexCacheDir), 0755)
+	os.WriteFile(indexCachePath(repo), []byte("P:openssl\nV:3.3.0-r0\np:so:libssl.so.3=3\n\n"), 0644)
+	pkgMap := map[string]APKPackage{"openssl": {Name: "openssl", Version: "3.3.0-r0", Provides: []string{"so:libssl.so.3=3"}}}
+	sourceRepo := map[string]string{"openssl": repo}
+
+	providesMemo, indexDigests = map[string]map[string][]string{}, map[string]string{}
+	if got := providesMap(pkgMap, sourceRepo)["so:libssl.so.3"]; len(got) != 1 || got[0] != "openssl" {
+		t.Fatalf("providers of so:libssl.so.3 = %v", got)
+	}
+	// A later run with the same snapshot reads the cached map, not pkgMap
+	providesMemo, indexDigests = map[string]map[string][]string{}, map[string]string{}
+	if got := providesMap(map[string]APKPackage{"openssl": {Name: "openssl"}}, sourceRepo)["so:libssl.so.3"]; len(got) != 1 {
+		t.Errorf("cached map wasn't used, providers = %v", got)
+	}
+	// A changed index invalidates it
+	providesMemo, indexDigests = map[string]map[string][]string{}, map[string]string{}
+	os.WriteFile(indexCachePath(repo), []byte("P:openssl\nV:3.3.1-r0\n\n"), 0644)
+	if got := providesMap(map[string]APKPackage{"openssl": {Name: "openssl"}}, sourceRepo)["so:libssl.so.3"]; len(got) != 0 {
+		t.Errorf("stale map was used, providers = %v", got)
+	}
+}
@@ -0,0 +1,103 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// indexFilter keeps only the index entries a run can need: the wanted names and
+// whatever provides one of them. It grows with the dependencies of what it kept.
+type indexFilter struct {
+	want map[string]struct{}
+}
+
+// activeIndexFilter is consulted by parseAPKIndex, nil keeps every entry
+var activeIndexFilter *indexFilter
+
+// enableIndexFilter turns filtered parsing on for the configured packages and the
+// installed ones when index_filter or the low-memory profile asks for it
+func enableIndexFilter(cfg *Config) {
+	if !cfg.IndexFilter && !lowMemory {
+		return
+	}
+	f := &indexFilter{want: map[string]struct{}{}}
+	for _, pkg := range cfg.Packages {
+		// The dependencies of a direct .apk are only known once it is fetched, after the indexes
+		if isDirectEntry(pkg) {
+			eprintf("[WARN] %s is a direct package, parsing the full indexes\n", pkg)
+			return
+		}
+		f.want[pkg] = struct{}{}
+	}
+	installed, _ := readInstalledPkgs(statePath("installed.yaml"))
+	for pkg := range installed {
+		f.want[pkg] = struct{}{}
+	}
+	activeIndexFilter = f
+}
+
+// depName strips the version constraint and conflict marker of a dependency or provides token
+func depName(dep string) string {
+	dep = strings.TrimPrefix(dep, "!")
+	if i := strings.IndexAny(dep, "<>=~"); i >= 0 {
+		dep = dep[:i]
+	}
+	return dep
+}
+
+// keeps reports whether pkg is wanted by name or by one of its provides
+func (f *indexFilter) keeps(pkg *APKPackage) bool {
+	if _, ok := f.want[pkg.Name]; ok {
+		return true
+	}
+	for _, p := range pkg.Provides {
+		if _, ok := f.want[depName(p)]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// grow adds the dependencies of pkgs to the wanted set and reports whether any was new
+func (f *indexFilter) grow(pkgs map[string]APKPackage) bool {
+	grew := false
+	for _, pkg := range pkgs {
+		for _, dep := range pkg.Deps {
+			if strings.HasPrefix(dep, "!") {
+				continue
+			}
+			name := depName(dep)
+			if _, ok := f.want[name]; !ok && name != "" {
+				f.want[name] = struct{}{}
+				grew = true
+			}
+		}
+	}
+	return grew
+}
+
+// completeFilteredIndexes re-parses the cached indexes of repos until the kept entries
+// include their whole dependency closure. The maps are rebuilt on every pass so the
+// first repo listing a package still wins.
+func completeFilteredIndexes(repos []string, pkgMap map[string]APKPackage, sourceRepo map[string]string) error {
+	for activeIndexFilter.grow(pkgMap) {
+		for name := range pkgMap {
+			delete(pkgMap, name)
+			delete(sourceRepo, name)
+		}
+		for _, repo := range repos {
+			m, err := parseAPKIndexFile(indexCachePath(repo))
+			if err != nil {
+				return fmt.Errorf("re-reading cached index of %s: %w", repo, err)
+			}
+			mergeIndex(pkgMap, sourceRepo, repo, m)
+		}
+	}
+	return nil
+}
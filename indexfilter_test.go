@@ -0,0 +1,42 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFilteredIndexClosure(t *testing.T) {
+	oldState, oldFilter := stateDir, activeIndexFilter
+	stateDir = t.TempDir()
+	defer func() { stateDir, activeIndexFilter = oldState, oldFilter }()
+
+	serve := func(index string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(index))
+		}))
+	}
+	// curl pulls libcurl from the second repo, which needs libssl3 back from the first
+	mainRepo := serve("P:curl\nV:8.0-r0\nD:libcurl>=8.0 so:libc.musl-x86_64.so.1\n\nP:libssl3\nV:3.3-r0\np:so:libssl.so.3=3\n\nP:vim\nV:9.0-r0\n\n")
+	defer mainRepo.Close()
+	community := serve("P:libcurl\nV:8.0-r0\nD:so:libssl.so.3\n\nP:curl\nV:7.0-r0\n\nP:htop\nV:3.3-r0\n\n")
+	defer community.Close()
+
+	enableIndexFilter(&Config{Packages: []string{"curl"}, IndexFilter: true})
+	pkgMap, sourceRepo, err := fetchAndParseAllAPKIndexes([]string{mainRepo.URL, community.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkgMap) != 3 || pkgMap["libssl3"].Name == "" || pkgMap["libcurl"].Name == "" {
+		t.Errorf("unexpected filtered packages: %v", pkgMap)
+	}
+	if pkgMap["curl"].Version != "8.0-r0" || sourceRepo["curl"] != mainRepo.URL {
+		t.Errorf("the first repo should still win: %v from %s", pkgMap["curl"], sourceRepo["curl"])
+	}
+}
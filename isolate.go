@@ -0,0 +1,297 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Defaults of the extraction: config section
+const (
+	defaultExtractMaxSize  = 4 << 30
+	defaultExtractMaxFiles = 250000
+	defaultExtractMemory   = 512 << 20
+	defaultExtractTimeout  = 10 * time.Minute
+)
+
+// ExtractionConfig bounds what unpacking a single package may cost
+type ExtractionConfig struct {
+	// Isolate unpacks every package in a worker process limited to memory and timeout,
+	// so a decompression bomb can't exhaust the host
+	Isolate bool `yaml:"isolate,omitempty"`
+	// MaxSize is the most a package may decompress to, e.g. 512M (default 4G)
+	MaxSize string `yaml:"max_size,omitempty"`
+	// MaxFileSize is the most a single file of a package may have (default: max_size)
+	MaxFileSize string `yaml:"max_file_size,omitempty"`
+	// MaxFiles is the most entries a package may have (default 250000)
+	MaxFiles int `yaml:"max_files,omitempty"`
+	// Memory is the memory limit of the worker process (default 512M)
+	Memory string `yaml:"memory,omitempty"`
+	// Timeout is how long the worker may take for a package (default 10m)
+	Timeout string `yaml:"timeout,omitempty"`
+	// Repos override these settings for the packages of a repo, isolate can only be enabled
+	Repos map[string]ExtractionConfig `yaml:"repos,omitempty"`
+}
+
+// parseSize parses a byte count with an optional K, M, G or T (binary) suffix
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	num := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	if i := strings.IndexAny(num, "KMGT"); i >= 0 && i == len(num)-1 {
+		mult = 1 << (10 * (strings.IndexByte("KMGT", num[i]) + 1))
+		num = num[:i]
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%q is not a positive size (e.g. 512M or 4G)", s)
+	}
+	return n * mult, nil
+}
+
+// validate checks the sizes and the timeout of the extraction section and its repo overrides
+func (e ExtractionConfig) validate() error {
+	for key, val := range map[string]string{"max_size": e.MaxSize, "max_file_size": e.MaxFileSize, "memory": e.Memory} {
+		if val == "" {
+			continue
+		}
+		if _, err := parseSize(val); err != nil {
+			return fmt.Errorf("extraction %s: %w", key, err)
+		}
+	}
+	if e.MaxFiles < 0 {
+		return fmt.Errorf("extraction max_files must not be negative")
+	}
+	if e.Timeout != "" {
+		if d, err := time.ParseDuration(e.Timeout); err != nil || d <= 0 {
+			return fmt.Errorf("extraction timeout %q is not a positive duration", e.Timeout)
+		}
+	}
+	for repo, o := range e.Repos {
+		if len(o.Repos) > 0 {
+			return fmt.Errorf("extraction repos: %s can't have repos of its own", repo)
+		}
+		if err := o.validate(); err != nil {
+			return fmt.Errorf("extraction repos: %s: %w", repo, err)
+		}
+	}
+	return nil
+}
+
+// extractLimits are the effective limits of one package extraction
+type extractLimits struct {
+	Isolate     bool
+	MaxSize     int64
+	MaxFileSize int64
+	MaxFiles    int
+	Memory      int64
+	Timeout     time.Duration
+	// InstalledSize is the installed size (I:) the index declares, 0 if unknown
+	InstalledSize int64
+}
+
+// apply sets the limits e configures in l
+func (e ExtractionConfig) apply(l *extractLimits) {
+	l.Isolate = l.Isolate || e.Isolate
+	if n, err := parseSize(e.MaxSize); err == nil {
+		l.MaxSize = n
+	}
+	if n, err := parseSize(e.MaxFileSize); err == nil {
+		l.MaxFileSize = n
+	}
+	if e.MaxFiles > 0 {
+		l.MaxFiles = e.MaxFiles
+	}
+	if n, err := parseSize(e.Memory); err == nil {
+		l.Memory = n
+	}
+	if d, err := time.ParseDuration(e.Timeout); err == nil && d > 0 {
+		l.Timeout = d
+	}
+}
+
+// extractionLimits returns the limits of a package from repo (empty for direct packages)
+// declaring installedSize: the defaults, the extraction section and its repo override
+func extractionLimits(repo string, installedSize int64) extractLimits {
+	l := extractLimits{MaxSize: defaultExtractMaxSize, MaxFiles: defaultExtractMaxFiles, Memory: defaultExtractMemory, Timeout: defaultExtractTimeout, InstalledSize: installedSize}
+	if globalConfig == nil {
+		return l
+	}
+	ext := globalConfig.Extraction
+	ext.apply(&l)
+	if o, ok := ext.Repos[repo]; ok {
+		o.apply(&l)
+	}
+	return l
+}
+
+// errExtractLimit is returned when a package exceeds the extraction limits, retrying can't help
+var errExtractLimit = errors.New("package exceeds the extraction limits")
+
+// extractBudget counts the entries of an extraction against its limits
+type extractBudget struct {
+	limits  extractLimits
+	size    int64
+	payload int64
+	files   int
+}
+
+// add counts the archive entry hdr of the given kind. The tar reader never returns more
+// than the size in the header, so oversized packages are refused before anything of the
+// entry is written. The installed size (I:) only covers the payload.
+func (b *extractBudget) add(hdr *tar.Header, kind entryKind) error {
+	b.files++
+	if b.files > b.limits.MaxFiles {
+		return &permanentError{fmt.Errorf("%w: more than %d entries (extraction max_files)", errExtractLimit, b.limits.MaxFiles)}
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+	if b.limits.MaxFileSize > 0 && hdr.Size > b.limits.MaxFileSize {
+		return &permanentError{fmt.Errorf("%w: %s has %s (extraction max_file_size is %s)", errExtractLimit, hdr.Name, humanSize(hdr.Size), humanSize(b.limits.MaxFileSize))}
+	}
+	b.size += hdr.Size
+	if b.size > b.limits.MaxSize {
+		return &permanentError{fmt.Errorf("%w: decompresses to more than %s (extraction max_size)", errExtractLimit, humanSize(b.limits.MaxSize))}
+	}
+	if kind == entryPayload {
+		b.payload += hdr.Size
+	}
+	if b.limits.InstalledSize > 0 && b.payload > b.limits.InstalledSize {
+		return &permanentError{fmt.Errorf("%w: its files are larger than the %s its index entry declares (I:)", errExtractLimit, humanSize(b.limits.InstalledSize))}
+	}
+	return nil
+}
+
+// extractWorkerEnv makes an apkg process an extraction worker reading its job from stdin
+const extractWorkerEnv = "APKG_EXTRACT_WORKER"
+
+// extractJob is what an extraction worker is asked to do
+type extractJob struct {
+	Apk      string        `json:"apk"`
+	Dest     string        `json:"dest"`
+	Control  string        `json:"control"`
+	Skip     []string      `json:"skip"`
+	DirMode  string        `json:"dir_mode"`
+	Limits   extractLimits `json:"limits"`
+	Deadline time.Time     `json:"deadline"`
+}
+
+// extractIsolated runs the extraction of apkPath in a worker process. The worker limits
+// its own memory, file size and CPU time, the run kills it once it takes too long.
+func extractIsolated(apkPath, destDir, controlDir string, limits extractLimits) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	job := extractJob{Apk: apkPath, Dest: destDir, Control: controlDir, Skip: defaultExtractFilter().skip, Limits: limits, Deadline: packageDeadline}
+	if globalConfig != nil {
+		job.DirMode = globalConfig.DirMode
+	}
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), limits.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, self)
+	cmd.Env = append(os.Environ(), extractWorkerEnv+"=1", debugEnv+"="+debugSpec)
+	cmd.Stdin = bytes.NewReader(data)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return &permanentError{fmt.Errorf("%w: extraction took longer than %s (extraction timeout)", errExtractLimit, limits.Timeout)}
+	}
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return &permanentError{errors.New(msg)}
+	}
+	if exit, ok := err.(*exec.ExitError); ok {
+		if ws, ok := exit.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return &permanentError{fmt.Errorf("%w: extraction worker killed by %v", errExtractLimit, ws.Signal())}
+		}
+	}
+	return fmt.Errorf("extraction worker failed: %w", err)
+}
+
+// runExtractWorker is the extraction worker: it applies the limits of its job to itself,
+// extracts and reports a failure on stderr
+func runExtractWorker() int {
+	var job extractJob
+	if err := json.NewDecoder(os.Stdin).Decode(&job); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid extraction job: %v\n", err)
+		return 1
+	}
+	globalConfig = &Config{ExtractSkip: job.Skip, DirMode: job.DirMode}
+	setDebug(os.Getenv(debugEnv))
+	packageDeadline = job.Deadline
+	if err := limitWorker(job.Limits); err != nil {
+		fmt.Fprintf(os.Stderr, "limiting the extraction worker: %v\n", err)
+		return 1
+	}
+	if err := extractApkLocal(job.Apk, job.Dest, job.Control, job.Limits); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// limitWorker caps the address space of the process to what it uses now plus the memory
+// limit, no single file can outgrow max_file_size (or max_size) and the CPU time is
+// bounded by the timeout
+func limitWorker(l extractLimits) error {
+	debug.SetMemoryLimit(l.Memory)
+	fileSize := l.MaxSize
+	if l.MaxFileSize > 0 {
+		fileSize = l.MaxFileSize
+	}
+	rlimits := map[int]uint64{
+		syscall.RLIMIT_FSIZE: uint64(fileSize),
+		syscall.RLIMIT_CPU:   uint64(l.Timeout/time.Second) + 1,
+	}
+	if vm := processVMSize(); vm > 0 {
+		rlimits[syscall.RLIMIT_AS] = uint64(vm + l.Memory)
+	}
+	for res, max := range rlimits {
+		if err := syscall.Setrlimit(res, &syscall.Rlimit{Cur: max, Max: max}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// processVMSize returns the virtual memory size of the process from /proc, 0 if unknown
+func processVMSize() int64 {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if v, ok := strings.CutPrefix(sc.Text(), "VmSize:"); ok {
+			kb, _ := strconv.ParseInt(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(v), "kB")), 10, 64)
+			return kb << 10
+		}
+	}
+	return 0
+}
@@ -0,0 +1,147 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestMain lets the test binary serve as extraction worker, like apkg itself
+func TestMain(m *testing.M) {
+	if os.Getenv(extractWorkerEnv) != "" {
+		os.Exit(runExtractWorker())
+	}
+	os.Exit(m.Run())
+}
+
+// writeBombApk writes a package with one file of size zero bytes and count empty files
+func writeBombApk(t *testing.T, path string, size int64, count int) {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "zeros", Mode: 0644, Size: size, Typeflag: tar.TypeReg})
+	zeros := make([]byte, 1<<16)
+	for left := size; left > 0; left -= int64(len(zeros)) {
+		tw.Write(zeros[:min(left, int64(len(zeros)))])
+	}
+	for i := 0; i < count; i++ {
+		tw.WriteHeader(&tar.Header{Name: filepath.Join("files", string(rune('a'+i%26))+string(rune('a'+i/26))), Mode: 0644, Typeflag: tar.TypeReg})
+	}
+	tw.Close()
+	gz.Close()
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for in, want := range map[string]int64{"100": 100, "4K": 4 << 10, "512M": 512 << 20, "2g": 2 << 30, "1TB": 1 << 40} {
+		if got, err := parseSize(in); err != nil || got != want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "0", "-1M", "12X", "M"} {
+		if _, err := parseSize(in); err == nil {
+			t.Errorf("parseSize(%q) should fail", in)
+		}
+	}
+	if err := (ExtractionConfig{Timeout: "soon"}).validate(); err == nil {
+		t.Error("expected a bad extraction timeout to be refused")
+	}
+}
+
+func TestExtractLimits(t *testing.T) {
+	oldCfg := globalConfig
+	defer func() { globalConfig = oldCfg }()
+	globalConfig = nil
+	dir := t.TempDir()
+	apk := filepath.Join(dir, "bomb.apk")
+	writeBombApk(t, apk, 4<<20, 10)
+	limits := extractionLimits("", 0)
+
+	small := limits
+	small.MaxSize = 1 << 20
+	if err := extractApkLocal(apk, filepath.Join(dir, "a"), "", small); !errors.Is(err, errExtractLimit) {
+		t.Errorf("max_size not enforced: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a", "zeros")); !os.IsNotExist(err) {
+		t.Errorf("oversized file was written")
+	}
+	few := limits
+	few.MaxFiles = 5
+	if err := extractApkLocal(apk, filepath.Join(dir, "b"), "", few); !errors.Is(err, errExtractLimit) {
+		t.Errorf("max_files not enforced: %v", err)
+	}
+	perFile := limits
+	perFile.MaxFileSize = 1 << 20
+	if err := extractApkLocal(apk, filepath.Join(dir, "c"), "", perFile); !errors.Is(err, errExtractLimit) {
+		t.Errorf("max_file_size not enforced: %v", err)
+	}
+	if err := extractApkLocal(apk, filepath.Join(dir, "d"), "", extractionLimits("", 1<<20)); !errors.Is(err, errExtractLimit) {
+		t.Errorf("installed size (I:) not enforced: %v", err)
+	}
+	if err := extractApkLocal(apk, filepath.Join(dir, "e"), "", extractionLimits("", 5<<20)); err != nil {
+		t.Errorf("extraction within the limits failed: %v", err)
+	}
+}
+
+func TestExtractionLimitsRepoOverride(t *testing.T) {
+	oldCfg := globalConfig
+	defer func() { globalConfig = oldCfg }()
+	globalConfig = &Config{Extraction: ExtractionConfig{MaxSize: "1G", MaxFiles: 100, Repos: map[string]ExtractionConfig{
+		"https://big.example.com/repo": {MaxSize: "16G", Isolate: true},
+	}}}
+	l := extractionLimits("https://dl-cdn.alpinelinux.org/alpine/v3.20/main", 0)
+	if l.MaxSize != 1<<30 || l.MaxFiles != 100 || l.Isolate {
+		t.Errorf("limits = %+v, want max_size 1G and max_files 100", l)
+	}
+	l = extractionLimits("https://big.example.com/repo", 0)
+	if l.MaxSize != 16<<30 || l.MaxFiles != 100 || !l.Isolate {
+		t.Errorf("override limits = %+v, want max_size 16G, max_files 100 and isolate", l)
+	}
+	bad := ExtractionConfig{Repos: map[string]ExtractionConfig{"r": {Repos: map[string]ExtractionConfig{"s": {}}}}}
+	if err := bad.validate(); err == nil {
+		t.Error("expected nested repo overrides to be refused")
+	}
+}
+
+func TestExtractIsolated(t *testing.T) {
+	oldCfg := globalConfig
+	defer func() { globalConfig = oldCfg }()
+	dir := t.TempDir()
+	apk := filepath.Join(dir, "pkg.apk")
+	writeBombApk(t, apk, 4<<20, 3)
+
+	globalConfig = &Config{Extraction: ExtractionConfig{Isolate: true}}
+	if err := extractApk(apk, filepath.Join(dir, "ok"), "", extractionLimits("", 0)); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "ok", "zeros")); err != nil || info.Size() != 4<<20 {
+		t.Errorf("worker didn't extract the package: %v", err)
+	}
+
+	globalConfig = &Config{Extraction: ExtractionConfig{Isolate: true, MaxSize: "1M"}}
+	err := extractApk(apk, filepath.Join(dir, "bomb"), "", extractionLimits("", 0))
+	var perm *permanentError
+	if err == nil || !errors.As(err, &perm) {
+		t.Errorf("worker didn't refuse the package: %v", err)
+	}
+
+	limits := extractionLimits("", 0)
+	limits.Timeout = time.Nanosecond
+	if err := extractIsolated(apk, filepath.Join(dir, "slow"), "", limits); !errors.Is(err, errExtractLimit) {
+		t.Errorf("worker timeout not enforced: %v", err)
+	}
+}
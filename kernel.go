@@ -0,0 +1,340 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+
+	"gopkg.in/yaml.v3"
+)
+
+// modulesDir is where kernel packages (linux-*, *-modules) install their modules
+const modulesDir = "lib/modules"
+
+// kernelVersions returns the kernel versions a package ships modules for
+func kernelVersions(files []string) []string {
+	seen := map[string]bool{}
+	var kvers []string
+	for _, rel := range files {
+		rest, ok := strings.CutPrefix(rel, modulesDir+"/")
+		if !ok {
+			continue
+		}
+		kver, _, ok := strings.Cut(rest, "/")
+		if ok && !seen[kver] {
+			seen[kver] = true
+			kvers = append(kvers, kver)
+		}
+	}
+	return kvers
+}
+
+// isModuleFile reports whether name is a (possibly compressed) kernel module
+func isModuleFile(name string) bool {
+	for _, ext := range []string{".ko", ".ko.gz", ".ko.xz", ".ko.zst"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// moduleName returns the name a module is known by in depends=, from its file name
+func moduleName(path string) string {
+	base := filepath.Base(path)
+	base = base[:strings.Index(base, ".ko")]
+	return strings.ReplaceAll(base, "-", "_")
+}
+
+// moduleDepends reads the depends= entry of a module's .modinfo section
+func moduleDepends(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if !strings.HasSuffix(path, ".ko") {
+		rc, _, err := decompress(f)
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		r = rc
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	ef, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	sec := ef.Section(".modinfo")
+	if sec == nil {
+		return nil, nil
+	}
+	info, err := sec.Data()
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range bytes.Split(info, []byte{0}) {
+		if v, ok := bytes.CutPrefix(field, []byte("depends=")); ok && len(v) > 0 {
+			return strings.Split(strings.ReplaceAll(string(v), "-", "_"), ","), nil
+		}
+	}
+	return nil, nil
+}
+
+// writeModulesDep is the built-in depmod used when the host has none: it writes
+// modules.dep for kver, listing every module's dependencies transitively
+func writeModulesDep(root, kver string) error {
+	base := filepath.Join(root, modulesDir, kver)
+	paths := map[string]string{} // module name -> path relative to base
+	deps := map[string][]string{}
+	err := filepath.Walk(base, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !isModuleFile(p) {
+			return err
+		}
+		rel, _ := filepath.Rel(base, p)
+		name := moduleName(p)
+		paths[name] = filepath.ToSlash(rel)
+		d, err := moduleDepends(p)
+		if err != nil {
+			eprintf("[WARN] Failed to read module info of %s: %v\n", rel, err)
+		}
+		deps[name] = d
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(paths))
+	for name := range paths {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return paths[names[i]] < paths[names[j]] })
+	var buf bytes.Buffer
+	for _, name := range names {
+		// modprobe loads the list back to front, so dependencies of dependencies come last
+		var order []string
+		seen := map[string]bool{name: true}
+		var walk func(string)
+		walk = func(n string) {
+			for _, d := range deps[n] {
+				if seen[d] || paths[d] == "" {
+					continue
+				}
+				seen[d] = true
+				order = append(order, paths[d])
+				walk(d)
+			}
+		}
+		walk(name)
+		fmt.Fprintf(&buf, "%s:", paths[name])
+		for _, p := range order {
+			fmt.Fprintf(&buf, " %s", p)
+		}
+		buf.WriteByte('\n')
+	}
+	tmp := filepath.Join(base, "modules.dep.apkg-new")
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(base, "modules.dep"))
+}
+
+// runDepmod regenerates the module dependency files of kver inside root
+func runDepmod(root, kver string) error {
+	if depmod, err := exec.LookPath("depmod"); err == nil {
+		if out, err := exec.Command(depmod, "-b", root, kver).CombinedOutput(); err != nil {
+			return fmt.Errorf("depmod %s: %v\n%s", kver, err, out)
+		}
+		return nil
+	}
+	return writeModulesDep(root, kver)
+}
+
+// runningKernel returns the release of the running kernel
+func runningKernel() string {
+	var u syscall.Utsname
+	if err := syscall.Uname(&u); err != nil {
+		return ""
+	}
+	var b []byte
+	for _, c := range u.Release {
+		if c == 0 {
+			break
+		}
+		b = append(b, byte(c))
+	}
+	return string(b)
+}
+
+// previousKernelsFile (under the state dir) lists the module trees of kernel packages
+// apkg installed that an upgrade or removal left behind, oldest first. Only these are
+// pruned, trees of the base layer or installed by hand are never touched.
+const previousKernelsFile = "previous_kernels.yaml"
+
+// readPreviousKernels returns the kernel versions of previousKernelsFile
+func readPreviousKernels() ([]string, error) {
+	data, err := os.ReadFile(statePath(previousKernelsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var kvers []string
+	if err := yaml.Unmarshal(data, &kvers); err != nil {
+		return nil, err
+	}
+	return kvers, nil
+}
+
+// writePreviousKernels writes previousKernelsFile, removing it when kvers is empty
+func writePreviousKernels(kvers []string) error {
+	if len(kvers) == 0 {
+		err := os.Remove(statePath(previousKernelsFile))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	data, err := yaml.Marshal(kvers)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(statePath(previousKernelsFile), data, 0644)
+}
+
+// removeTree removes the tree rel of install_dir within tx, directories are removed once
+// empty and recreated by a rollback restoring their files
+func removeTree(tx *Transaction, rel string) error {
+	var files, dirs []string
+	err := filepath.Walk(installPath(tx.installDir, rel), func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		r, err := filepath.Rel(tx.installDir, p)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			dirs = append(dirs, r)
+		} else {
+			files = append(files, r)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := tx.removeFile(f); err != nil {
+			return err
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Remove(installPath(tx.installDir, dirs[i]))
+	}
+	return nil
+}
+
+// pruneKernels records the module trees of kernel packages tx upgrades (changedPkgs) or
+// removes (removedPkgs) as previous kernels and, with kernel_keep, removes all but the
+// keep most recent previous kernels and the running kernel's within tx. remaining are the
+// packages installed once tx commits.
+func pruneKernels(cfg *Config, tx *Transaction, changedPkgs, removedPkgs []string, remaining map[string]string) error {
+	previous, err := readPreviousKernels()
+	if err != nil {
+		return err
+	}
+	for _, pkg := range append(append([]string(nil), changedPkgs...), removedPkgs...) {
+		old, _ := readInstalledFiles(pkg)
+		kept := map[string]bool{}
+		for _, kver := range kernelVersions(tx.packageFiles(pkg)) {
+			kept[kver] = true
+		}
+		for _, kver := range kernelVersions(old) {
+			if !kept[kver] {
+				previous = append(slices.DeleteFunc(previous, func(k string) bool { return k == kver }), kver)
+			}
+		}
+	}
+	// A previous kernel installed again is owned by its package
+	owned := map[string]bool{}
+	for pkg := range remaining {
+		files := tx.packageFiles(pkg)
+		if len(files) == 0 {
+			files, _ = readInstalledFiles(pkg)
+		}
+		for _, kver := range kernelVersions(files) {
+			owned[kver] = true
+		}
+	}
+	var left []string
+	for _, kver := range previous {
+		if _, err := os.Stat(installPath(tx.installDir, filepath.Join(modulesDir, kver))); err == nil && !owned[kver] {
+			left = append(left, kver)
+		}
+	}
+	if cfg.KernelKeep != nil && len(left) > *cfg.KernelKeep {
+		root, _ := filepath.Abs(tx.installDir)
+		prune := left[:len(left)-*cfg.KernelKeep]
+		left = left[len(left)-*cfg.KernelKeep:]
+		tx.setPackage("")
+		for _, kver := range prune {
+			if root == "/" && kver == runningKernel() {
+				left = append([]string{kver}, left...)
+				continue
+			}
+			printf("Removing modules of previous kernel %s\n", kver)
+			if err := removeTree(tx, filepath.Join(modulesDir, kver)); err != nil {
+				return err
+			}
+		}
+	}
+	tx.deferCommit(func() {
+		if err := writePreviousKernels(left); err != nil {
+			eprintf("[WARN] Failed to update %s: %v\n", previousKernelsFile, err)
+		}
+	})
+	return nil
+}
+
+// runKernelHooks regenerates module dependencies of the kernels changedPkgs ship
+// modules for
+func runKernelHooks(cfg *Config, changedPkgs []string) {
+	kvers := map[string]bool{}
+	for _, pkg := range changedPkgs {
+		files, _ := readInstalledFiles(pkg)
+		for _, kver := range kernelVersions(files) {
+			kvers[kver] = true
+		}
+	}
+	for kver := range kvers {
+		if _, err := os.Stat(filepath.Join(cfg.InstallDir, modulesDir, kver)); err != nil {
+			continue
+		}
+		if err := runDepmod(cfg.InstallDir, kver); err != nil {
+			eprintf("[WARN] Failed to generate module dependencies for %s: %v\n", kver, err)
+		} else {
+			printf("Generated module dependencies for kernel %s\n", kver)
+		}
+	}
+}
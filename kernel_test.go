@@ -0,0 +1,76 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPruneKernels(t *testing.T) {
+	oldState := stateDir
+	stateDir = t.TempDir()
+	defer func() { stateDir = oldState }()
+	root := t.TempDir()
+
+	// 6.6.0-custom was built by hand, 6.6.1 was left behind by an earlier upgrade and
+	// 6.6.2 is installed
+	for _, kver := range []string{"6.6.0-custom", "6.6.1-0-lts", "6.6.2-0-lts"} {
+		dir := filepath.Join(root, modulesDir, kver, "kernel")
+		os.MkdirAll(dir, 0755)
+		os.WriteFile(filepath.Join(dir, "loop.ko.gz"), nil, 0644)
+		os.WriteFile(filepath.Join(root, modulesDir, kver, "modules.dep"), nil, 0644)
+	}
+	files := []string{"boot/vmlinuz-lts", "lib/modules/6.6.2-0-lts/kernel/loop.ko.gz"}
+	if kvers := kernelVersions(files); len(kvers) != 1 || kvers[0] != "6.6.2-0-lts" {
+		t.Fatalf("unexpected kernel versions %v", kvers)
+	}
+	writeInstalledFiles("linux-lts", files)
+	writePreviousKernels([]string{"6.6.1-0-lts"})
+
+	// Upgrading to 6.6.3 leaves 6.6.2 behind, keeping one previous kernel prunes 6.6.1
+	tx, err := beginTransaction(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.setPackage("linux-lts")
+	tx.mkdirAll("lib/modules/6.6.3-0-lts/kernel", 0755)
+	tx.prepareWrite("lib/modules/6.6.3-0-lts/kernel/loop.ko.gz")
+	os.WriteFile(filepath.Join(root, "lib/modules/6.6.3-0-lts/kernel/loop.ko.gz"), nil, 0644)
+	keep := 1
+	if err := pruneKernels(&Config{KernelKeep: &keep}, tx, []string{"linux-lts"}, nil, map[string]string{"linux-lts": "6.6.3-r0"}); err != nil {
+		t.Fatal(err)
+	}
+	for kver, want := range map[string]bool{"6.6.0-custom": true, "6.6.1-0-lts": false, "6.6.2-0-lts": true, "6.6.3-0-lts": true} {
+		if _, err := os.Stat(filepath.Join(root, modulesDir, kver)); (err == nil) != want {
+			t.Errorf("%s kept: %v, want %v", kver, err == nil, want)
+		}
+	}
+	removed := 0
+	for _, e := range tx.entries {
+		if e.action == txRemove {
+			removed++
+		}
+	}
+	if removed != 2 {
+		t.Errorf("expected the 2 files of 6.6.1 to be removed in the transaction, got %+v", tx.entries)
+	}
+	if err := tx.rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, modulesDir, "6.6.1-0-lts", "kernel", "loop.ko.gz")); err != nil {
+		t.Errorf("rollback didn't restore 6.6.1: %v", err)
+	}
+
+	tx, _ = beginTransaction(root)
+	pruneKernels(&Config{}, tx, nil, []string{"linux-lts"}, map[string]string{})
+	tx.commit()
+	if kvers, _ := readPreviousKernels(); len(kvers) != 2 || kvers[1] != "6.6.2-0-lts" {
+		t.Errorf("removing the kernel should record 6.6.2 as previous kernel, got %v", kvers)
+	}
+}
@@ -0,0 +1,148 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// keysPackage ships the signing keys of the Alpine repos, new keys arrive with its upgrades
+const keysPackage = "alpine-keys"
+
+// trustedKeysDir (under the state dir) holds the keys learned from verified keysPackage
+// downloads, trusted besides keys_dir. Every key has a <key>.repo next to it naming the
+// repo it was learned from.
+const trustedKeysDir = "trusted_keys"
+
+// packageKeysDir is where keysPackage ships its keys, files elsewhere are never learned
+const packageKeysDir = "usr/share/apk/keys/"
+
+// maxKeySize bounds a key file read from a package
+const maxKeySize = 64 << 10
+
+// findPublicKey reads the key called name from keys_dir, or from the keys learned
+// from keysPackage when keys_dir doesn't have it
+func findPublicKey(name string) (*rsa.PublicKey, error) {
+	pub, err := readPublicKey(filepath.Join(keysDir(), name))
+	if os.IsNotExist(err) {
+		if learned, lerr := readPublicKey(filepath.Join(statePath(trustedKeysDir), name)); lerr == nil {
+			return learned, nil
+		}
+	}
+	return pub, err
+}
+
+// isAlpineRepo reports whether repo is one of the Alpine repos, an alpine: shorthand or
+// a repo on the Alpine mirror or archive
+func isAlpineRepo(repo string) bool {
+	if globalConfig == nil {
+		return false
+	}
+	for i, spec := range globalConfig.repoSpecs {
+		if strings.HasPrefix(spec, alpineRepoPrefix) && i < len(globalConfig.Repos) && globalConfig.Repos[i] == repo {
+			return true
+		}
+	}
+	bases := []string{defaultAlpineMirror, defaultAlpineArchive}
+	if m := strings.TrimSuffix(globalConfig.AlpineMirror, "/"); m != "" && m != autoMirror {
+		bases = append(bases, m)
+	}
+	if a := strings.TrimSuffix(globalConfig.AlpineArchive, "/"); a != "" && a != "off" {
+		bases = append(bases, a)
+	}
+	for _, base := range bases {
+		if strings.HasPrefix(repo, base+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// learnKeys adds the keys shipped by the keysPackage at apkPath, downloaded from repo, to
+// the trusted keys. Only Alpine repos teach keys, a third-party repo trusted for its own
+// packages can't make keys trusted for Alpine's. The package itself has to carry a valid
+// signature by a key trusted already, so a key only becomes trusted through a transition
+// signed by its predecessor, whatever the trust level. The signature covers the data
+// member through the datahash, the index checksum of info is checked too when the index
+// has one. Keys are never dropped, packages signed by a retired key stay verifiable.
+func learnKeys(apkPath string, info APKPackage, repo string) error {
+	if !isAlpineRepo(repo) {
+		return fmt.Errorf("%s is not an Alpine repo", repo)
+	}
+	if _, err := verifyAPKSignature(apkPath, false); err != nil {
+		return err
+	}
+	if info.Checksum != "" {
+		if err := verifyPackageChecksum(apkPath, info); err != nil {
+			return err
+		}
+	}
+	f, err := os.Open(apkPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rc, _, err := decompress(f)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	dir := statePath(trustedKeysDir)
+	learned := 0
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Base(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || !strings.HasSuffix(name, ".pub") || !strings.HasPrefix(path.Clean(hdr.Name), packageKeysDir) {
+			continue
+		}
+		data, err := readLimited(tr, maxKeySize, name)
+		if err != nil {
+			return err
+		}
+		if _, err := parsePublicKey(data, name); err != nil {
+			eprintf("[WARN] %s ships %s which is not a usable key: %v\n", keysPackage, hdr.Name, err)
+			continue
+		}
+		target := filepath.Join(dir, name)
+		if old, err := os.ReadFile(target); err == nil && bytes.Equal(old, data) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(keysDir(), name)); err == nil {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(target+".repo", []byte(repo+"\n"), 0644); err != nil {
+			return err
+		}
+		if err := os.WriteFile(target, data, 0644); err != nil {
+			return err
+		}
+		printf("Trusting signing key %s from %s of %s\n", name, keysPackage, repo)
+		learned++
+	}
+	if learned > 0 {
+		printf("Learned %d signing keys from %s\n", learned, keysPackage)
+	}
+	return nil
+}
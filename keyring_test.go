@@ -0,0 +1,116 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLearnKeys(t *testing.T) {
+	oldConfig, oldState := globalConfig, stateDir
+	defer func() { globalConfig, stateDir = oldConfig, oldState }()
+	keys := t.TempDir()
+	globalConfig = &Config{KeysDir: keys}
+	stateDir = t.TempDir()
+	const alpineMain = defaultAlpineMirror + "/v3.22/main"
+
+	newKey := func() (*rsa.PrivateKey, []byte) {
+		priv, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, _ := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+		return priv, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	}
+	signed := func(priv *rsa.PrivateKey, keyName string, payload []byte) []byte {
+		digest := sha256.Sum256(payload)
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, digest[:])
+		return append(gzipTar(".SIGN.RSA256."+keyName, sig, true), payload...)
+	}
+	// signedPkg is a package with a signed control member whose datahash covers data
+	signedPkg := func(priv *rsa.PrivateKey, keyName string, data []byte) []byte {
+		datahash := sha256.Sum256(data)
+		control := gzipTar(".PKGINFO", []byte("pkgname = alpine-keys\ndatahash = "+hex.EncodeToString(datahash[:])+"\n"), true)
+		return append(signed(priv, keyName, control), data...)
+	}
+	old, oldPub := newKey()
+	rotated, rotatedPub := newKey()
+	os.WriteFile(filepath.Join(keys, "old.rsa.pub"), oldPub, 0644)
+	dir := t.TempDir()
+
+	// The rotated key is only known once a package signed by the old one brought it
+	index := filepath.Join(dir, "APKINDEX.tar.gz")
+	os.WriteFile(index, signed(rotated, "rotated.rsa.pub", gzipTar("APKINDEX", []byte("P:musl\nV:1.2.5-r0\n\n"), false)), 0644)
+	if _, err := verifyAPKSignature(index, true); err == nil {
+		t.Fatal("index signed by an unknown key verified")
+	}
+	forged := filepath.Join(dir, "forged.apk")
+	os.WriteFile(forged, signedPkg(rotated, "rotated.rsa.pub", gzipTar("usr/share/apk/keys/rotated.rsa.pub", rotatedPub, false)), 0644)
+	if err := learnKeys(forged, APKPackage{}, alpineMain); err == nil {
+		t.Fatal("learned the keys of a package signed by an unknown key")
+	}
+	pkg := filepath.Join(dir, "alpine-keys.apk")
+	os.WriteFile(pkg, signedPkg(old, "old.rsa.pub", gzipTar("usr/share/apk/keys/rotated.rsa.pub", rotatedPub, false)), 0644)
+	genuine, _ := os.ReadFile(pkg)
+	if err := learnKeys(pkg, APKPackage{Checksum: "Q1AAAAAAAAAAAAAAAAAAAAAAAAAAA="}, alpineMain); err == nil {
+		t.Fatal("learned the keys of a package that doesn't match its index checksum")
+	}
+
+	// A member appended to a genuine package isn't covered by its datahash
+	_, evilPub := newKey()
+	tampered := filepath.Join(dir, "tampered.apk")
+	os.WriteFile(tampered, append(append([]byte{}, genuine...), gzipTar("usr/share/apk/keys/x86_64/evil.rsa.pub", evilPub, false)...), 0644)
+	if err := learnKeys(tampered, APKPackage{}, alpineMain); err == nil {
+		t.Fatal("learned the keys of a package with an appended data member")
+	}
+	if _, err := os.Stat(filepath.Join(statePath(trustedKeysDir), "evil.rsa.pub")); err == nil {
+		t.Fatal("the appended key was trusted")
+	}
+
+	// Only keys under usr/share/apk/keys are learned
+	elsewhere := filepath.Join(dir, "elsewhere.apk")
+	os.WriteFile(elsewhere, signedPkg(old, "old.rsa.pub", gzipTar("etc/evil.rsa.pub", evilPub, false)), 0644)
+	if err := learnKeys(elsewhere, APKPackage{}, alpineMain); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(statePath(trustedKeysDir), "evil.rsa.pub")); err == nil {
+		t.Fatal("a key outside usr/share/apk/keys was trusted")
+	}
+
+	// A third-party repo can't teach keys, even with a package signed by a trusted key
+	if err := learnKeys(pkg, APKPackage{}, "https://packages.example.com/alpine"); err == nil {
+		t.Fatal("learned the keys of an alpine-keys package from a third-party repo")
+	}
+	if _, err := os.Stat(filepath.Join(statePath(trustedKeysDir), "rotated.rsa.pub")); err == nil {
+		t.Fatal("a third-party repo's key was trusted")
+	}
+
+	if err := learnKeys(pkg, APKPackage{}, alpineMain); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(statePath(trustedKeysDir), "rotated.rsa.pub.repo")); string(data) != alpineMain+"\n" {
+		t.Errorf("recorded source %q", data)
+	}
+	if key, err := verifyAPKSignature(index, true); err != nil || key != "rotated.rsa.pub" {
+		t.Errorf("index signed by the rotated key: %q, %v", key, err)
+	}
+
+	// alpine: shorthands are Alpine repos whatever mirror they expand to
+	globalConfig = &Config{Repos: []string{"https://mirror.example.org/alpine/v3.22/main"}, repoSpecs: []string{"alpine:v3.22/main"}}
+	if !isAlpineRepo("https://mirror.example.org/alpine/v3.22/main") || isAlpineRepo("https://mirror.example.org/other") {
+		t.Error("alpine: shorthand not recognized")
+	}
+}
@@ -0,0 +1,253 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// lastChangesFile (under the state dir) lists every journaled change of the last run that
+// committed a transaction, after a "since" line with the time its first transaction began
+const lastChangesFile = "last_changes"
+
+// runStarted is when the first transaction of this process began
+var runStarted time.Time
+
+// changesRecorded is set once this process wrote lastChangesFile, later transactions append to it
+var changesRecorded bool
+
+// recordChanges adds the changes of a committing transaction to lastChangesFile
+func recordChanges(tx *Transaction) error {
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if !changesRecorded {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	}
+	f, err := os.OpenFile(statePath(lastChangesFile), flags, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	if !changesRecorded {
+		fmt.Fprintf(w, "since\t%s\n", runStarted.UTC().Format(time.RFC3339Nano))
+	}
+	for _, e := range tx.entries {
+		if e.action == txSave {
+			continue // the file keeps the action of its first entry
+		}
+		fmt.Fprintf(w, "%s\t%s\n", e.action, filepath.ToSlash(e.rel))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	changesRecorded = true
+	return f.Close()
+}
+
+// readLastChanges returns the final action of every path changed by the last run, in
+// the order they were first changed, and when that run began
+func readLastChanges() ([]string, map[string]string, time.Time, error) {
+	f, err := os.Open(statePath(lastChangesFile))
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	defer f.Close()
+	var order []string
+	actions := make(map[string]string)
+	var since time.Time
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		action, rel, ok := strings.Cut(sc.Text(), "\t")
+		if !ok {
+			continue
+		}
+		if action == "since" {
+			since, _ = time.Parse(time.RFC3339Nano, rel)
+			continue
+		}
+		if _, seen := actions[rel]; !seen {
+			order = append(order, rel)
+		}
+		actions[rel] = action
+	}
+	return order, actions, since, sc.Err()
+}
+
+// layerWriter writes changed paths of install_dir as an OCI layer
+type layerWriter struct {
+	*tarMerger
+	installDir string
+}
+
+// addPath writes rel as it is now in install_dir
+func (l *layerWriter) addPath(rel string) error {
+	if _, ok := l.written[rel]; ok {
+		return nil
+	}
+	full := installPath(l.installDir, filepath.FromSlash(rel))
+	info, err := os.Lstat(full)
+	if err != nil {
+		return err
+	}
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(full); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = rel
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	hdr.Uname, hdr.Gname = "", ""
+	if err := l.addParents(path.Dir(rel)); err != nil {
+		return err
+	}
+	if err := l.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	l.written[rel] = ""
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(full)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(l.tw, f)
+	return err
+}
+
+// addWhiteout marks rel as deleted, the way OCI layers remove files of lower layers
+func (l *layerWriter) addWhiteout(rel string) error {
+	dir, name := path.Split(rel)
+	if err := l.addParents(path.Clean(dir)); err != nil {
+		return err
+	}
+	return l.tw.WriteHeader(&tar.Header{Name: dir + ".wh." + name, Typeflag: tar.TypeReg, Mode: 0644})
+}
+
+// modifiedSince returns the paths of install_dir changed after since that aren't in known,
+// such as the outputs of post-install hooks which aren't journaled
+func modifiedSince(installDir string, since time.Time, known map[string]string) []string {
+	root, err := filepath.EvalSymlinks(installDir)
+	if err != nil {
+		return nil
+	}
+	// Allow for filesystems with coarse timestamps
+	since = since.Add(-time.Second)
+	var found []string
+	filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || info.ModTime().Before(since) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return nil
+		}
+		if _, ok := known[filepath.ToSlash(rel)]; !ok {
+			found = append(found, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	sort.Strings(found)
+	return found
+}
+
+// cmdExportLayer implements `apkg export-layer -o <file|-> [-gzip]`: the files the last
+// apply added, replaced or removed (as whiteouts) as one tar stream
+func cmdExportLayer(configPath string, args []string) int {
+	fs := flag.NewFlagSet("export-layer", flag.ExitOnError)
+	output := fs.String("o", "", "Write the layer to this file, - for stdout")
+	compress := fs.Bool("gzip", false, "Compress the layer with gzip")
+	fs.Parse(args)
+	if *output == "" {
+		eprintf("Usage: %s [flags] export-layer -o <file|-> [-gzip]\n", os.Args[0])
+		return 1
+	}
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		eprintf("[FATAL] Failed to read config: %v\n", err)
+		return 1
+	}
+	globalConfig = cfg
+	order, actions, since, err := readLastChanges()
+	if err != nil {
+		eprintf("[ERROR] No changes recorded, run an apply first: %v\n", err)
+		return 1
+	}
+	var out io.Writer
+	if *output == "-" {
+		out = os.Stdout
+	} else {
+		f, err := os.Create(*output)
+		if err != nil {
+			eprintf("[FATAL] %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+	if *compress {
+		zw := gzip.NewWriter(out)
+		defer zw.Close()
+		out = zw
+	}
+	l := &layerWriter{tarMerger: newTarMerger(out), installDir: cfg.InstallDir}
+	added, removed := 0, 0
+	for _, rel := range order {
+		var err error
+		switch actions[rel] {
+		case txCreate, txReplace, txMkdir:
+			if err = l.addPath(rel); os.IsNotExist(err) {
+				err = nil // removed again later in the run
+			} else if err == nil {
+				added++
+			}
+		case txRemove:
+			if _, statErr := os.Lstat(installPath(cfg.InstallDir, filepath.FromSlash(rel))); os.IsNotExist(statErr) {
+				err = l.addWhiteout(rel)
+				removed++
+			}
+		}
+		if err != nil {
+			eprintf("[ERROR] Failed to export %s: %v\n", rel, err)
+			return 4
+		}
+	}
+	if !since.IsZero() {
+		for _, rel := range modifiedSince(cfg.InstallDir, since, actions) {
+			if err := l.addPath(rel); err != nil {
+				eprintf("[ERROR] Failed to export %s: %v\n", rel, err)
+				return 4
+			}
+			added++
+		}
+	}
+	if err := l.Close(); err != nil {
+		eprintf("[ERROR] %v\n", err)
+		return 4
+	}
+	eprintf("Exported %d changed and %d removed paths\n", added, removed)
+	return 0
+}
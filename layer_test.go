@@ -0,0 +1,76 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportLayer(t *testing.T) {
+	oldState, oldConfig, oldRecorded := stateDir, globalConfig, changesRecorded
+	stateDir = t.TempDir()
+	defer func() { stateDir, globalConfig, changesRecorded = oldState, oldConfig, oldRecorded }()
+	changesRecorded = false
+
+	root := filepath.Join(t.TempDir(), "root")
+	os.MkdirAll(filepath.Join(root, "etc"), 0755)
+	old := time.Now().Add(-time.Hour)
+	for _, name := range []string{"etc/keep.conf", "etc/gone.conf"} {
+		os.WriteFile(filepath.Join(root, name), []byte("old"), 0644)
+		os.Chtimes(filepath.Join(root, name), old, old)
+	}
+
+	tx, err := beginTransaction(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.mkdirAll("usr/bin", 0755)
+	tx.prepareWrite("usr/bin/tool")
+	os.WriteFile(filepath.Join(root, "usr/bin/tool"), []byte("#!/bin/sh\n"), 0755)
+	tx.removeFile("etc/gone.conf")
+	if err := tx.commit(); err != nil {
+		t.Fatal(err)
+	}
+	// Written by a post-install hook, outside the transaction
+	os.WriteFile(filepath.Join(root, "etc/hook.out"), []byte("generated"), 0644)
+
+	config := filepath.Join(t.TempDir(), "apkg.yaml")
+	os.WriteFile(config, []byte("install_dir: "+root+"\n"), 0644)
+	layer := filepath.Join(t.TempDir(), "layer.tar")
+	if code := cmdExportLayer(config, []string{"-o", layer}); code != 0 {
+		t.Fatalf("export-layer exited %d", code)
+	}
+	f, err := os.Open(layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var names []string
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	sort.Strings(names)
+	want := "etc/ etc/.wh.gone.conf etc/hook.out usr/ usr/bin/ usr/bin/tool"
+	if got := strings.Join(names, " "); got != want {
+		t.Errorf("layer has %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,154 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// muslDefaultPath is the library search path musl uses when it has no path file,
+// a path file replaces it so it is always written first
+var muslDefaultPath = []string{"/lib", "/usr/local/lib", "/usr/lib"}
+
+// ldPathStateFile (under the state dir) holds the musl path file apkg wrote last, a path
+// file with other content was edited by hand and is left alone
+const ldPathStateFile = "ld_path"
+
+// isSharedLib reports whether rel looks like a shared library found through the search path
+func isSharedLib(rel string) bool {
+	base := path.Base(rel)
+	return strings.HasPrefix(base, "lib") && (strings.HasSuffix(base, ".so") || strings.Contains(base, ".so."))
+}
+
+// libraryDirs returns the directories outside musl's default path that installed
+// packages put shared libraries in
+func libraryDirs(installedPkgs map[string]string) []string {
+	defaults := map[string]bool{}
+	for _, d := range muslDefaultPath {
+		defaults[d] = true
+	}
+	seen := map[string]bool{}
+	var dirs []string
+	for pkg := range installedPkgs {
+		files, _ := readInstalledFiles(pkg)
+		for _, rel := range files {
+			if !isSharedLib(rel) {
+				continue
+			}
+			dir := "/" + path.Dir(rel)
+			if !defaults[dir] && !seen[dir] {
+				seen[dir] = true
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// muslPathFile returns the path file of the root's musl loader, empty when it has none
+func muslPathFile(root string) string {
+	loaders, _ := filepath.Glob(filepath.Join(root, "lib", "ld-musl-*.so.1"))
+	if len(loaders) == 0 {
+		return ""
+	}
+	arch := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(loaders[0]), "ld-musl-"), ".so.1")
+	return filepath.Join(root, "etc", "ld-musl-"+arch+".path")
+}
+
+// writeMuslPath writes the musl path file of root so libraries outside the default
+// path resolve, it returns the path file written or empty when none was needed
+func writeMuslPath(root string, installedPkgs map[string]string) (string, error) {
+	file := muslPathFile(root)
+	if file == "" {
+		return "", nil
+	}
+	extra := libraryDirs(installedPkgs)
+	current, err := os.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	written, _ := os.ReadFile(statePath(ldPathStateFile))
+	if err == nil && string(current) != string(written) {
+		eprintf("[WARN] %s was edited by hand, not updating it\n", file)
+		return "", nil
+	}
+	if len(extra) == 0 {
+		// The defaults suffice, drop the file if apkg wrote it
+		if err == nil {
+			os.Remove(file)
+			os.Remove(statePath(ldPathStateFile))
+		}
+		return "", nil
+	}
+	content := strings.Join(append(append([]string{}, muslDefaultPath...), extra...), "\n") + "\n"
+	if content == string(current) {
+		return "", nil
+	}
+	if err := os.MkdirAll(filepath.Dir(file), dirMode()); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(file+".apkg-new", []byte(content), 0644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(file+".apkg-new", file); err != nil {
+		return "", err
+	}
+	return file, os.WriteFile(statePath(ldPathStateFile), []byte(content), 0644)
+}
+
+// updateLibraryCache makes the libraries of root resolvable: a musl path file for
+// musl roots, ld.so.cache through the host's ldconfig for glibc roots
+func updateLibraryCache(root string, installedPkgs map[string]string) (string, error) {
+	if muslPathFile(root) != "" {
+		return writeMuslPath(root, installedPkgs)
+	}
+	glibc, _ := filepath.Glob(filepath.Join(root, "lib*", "ld-linux*.so*"))
+	if len(glibc) == 0 {
+		return "", nil
+	}
+	ldconfig, err := exec.LookPath("ldconfig")
+	if err != nil {
+		return "", fmt.Errorf("%s is a glibc root but the host has no ldconfig", root)
+	}
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	if out, err := exec.Command(ldconfig, "-r", abs).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("ldconfig: %v\n%s", err, out)
+	}
+	return filepath.Join(root, "etc", "ld.so.cache"), nil
+}
+
+// runLibraryCacheHook updates the library cache when changed packages ship shared libraries
+func runLibraryCacheHook(cfg *Config, changedPkgs []string, installedPkgs map[string]string) {
+	if cfg.LibraryCache == "off" {
+		return
+	}
+	for _, pkg := range changedPkgs {
+		files, _ := readInstalledFiles(pkg)
+		for _, rel := range files {
+			if !isSharedLib(rel) {
+				continue
+			}
+			file, err := updateLibraryCache(cfg.InstallDir, installedPkgs)
+			if err != nil {
+				eprintf("[WARN] Failed to update the library cache: %v\n", err)
+			} else if file != "" {
+				printf("Updated library search path in %s\n", file)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,47 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteMuslPath(t *testing.T) {
+	oldState := stateDir
+	stateDir = t.TempDir()
+	defer func() { stateDir = oldState }()
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "lib"), 0755)
+	os.WriteFile(filepath.Join(root, "lib/ld-musl-aarch64.so.1"), nil, 0755)
+	writeInstalledFiles("musl", []string{"lib/ld-musl-aarch64.so.1", "lib/libc.musl-aarch64.so.1"})
+	writeInstalledFiles("pulseaudio", []string{"usr/lib/pulseaudio/libpulsecommon-17.0.so", "usr/lib/pulseaudio/modules/module-null.so"})
+	installed := map[string]string{"musl": "1.2.5-r0", "pulseaudio": "17.0-r0"}
+
+	file, err := writeMuslPath(root, installed)
+	if err != nil || file != filepath.Join(root, "etc/ld-musl-aarch64.path") {
+		t.Fatalf("unexpected path file %q, %v", file, err)
+	}
+	data, _ := os.ReadFile(file)
+	if want := "/lib\n/usr/local/lib\n/usr/lib\n/usr/lib/pulseaudio\n"; string(data) != want {
+		t.Errorf("path file %q, want %q", data, want)
+	}
+	// Once the extra dir is gone the file apkg wrote is removed again
+	delete(installed, "pulseaudio")
+	writeMuslPath(root, installed)
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("path file should be gone: %v", err)
+	}
+	// A path file edited by hand is left alone
+	os.WriteFile(file, []byte("/opt/lib\n"), 0644)
+	installed["pulseaudio"] = "17.0-r0"
+	writeMuslPath(root, installed)
+	if data, _ := os.ReadFile(file); string(data) != "/opt/lib\n" {
+		t.Errorf("hand edited path file was replaced: %q", data)
+	}
+}
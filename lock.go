@@ -0,0 +1,372 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// lockKeyring is the GPG keyring apkg.lock.sig must verify against with -locked,
+// set with -lock-keyring or APKG_LOCK_KEYRING
+var lockKeyring string
+
+// LockedPkg is an approved package version in apkg.lock
+type LockedPkg struct {
+	Name    string `yaml:"name"`
+	Version string `yaml:"version"`
+	Repo    string `yaml:"repo,omitempty"`
+	// SHA256 is the checksum of the package file, -locked installs nothing else
+	SHA256 string `yaml:"sha256,omitempty"`
+}
+
+// lockedSums are the package checksums of the lockfile enforced by -locked
+var lockedSums map[string]string
+
+// Lockfile is the exact package set a config resolved to when it was locked
+type Lockfile struct {
+	// Version names the package set for rollout channels, e.g. a release number
+	Version  string      `yaml:"version,omitempty"`
+	Packages []LockedPkg `yaml:"packages"`
+	// Overrides are the dependency overrides the package set was resolved with
+	Overrides []string `yaml:"overrides,omitempty"`
+}
+
+// lockfilePath returns the lockfile belonging to a config: apkg.yaml locks to
+// apkg.lock next to it, configs from stdin or a URL use apkg.lock in the working directory
+func lockfilePath(configPath string) string {
+	if configPath == "-" || isRemoteConfig(configPath) {
+		return "apkg.lock"
+	}
+	return strings.TrimSuffix(configPath, filepath.Ext(configPath)) + ".lock"
+}
+
+// readLockfile reads a lockfile
+func readLockfile(path string) (*Lockfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseLockfile(data)
+}
+
+// parseLockfile parses the content of a lockfile
+func parseLockfile(data []byte) (*Lockfile, error) {
+	var lf Lockfile
+	if err := yaml.Unmarshal(data, &lf); err != nil {
+		return nil, err
+	}
+	return &lf, nil
+}
+
+// writeLockfile writes a lockfile with its packages sorted by name
+func writeLockfile(path string, lf *Lockfile) error {
+	sort.Slice(lf.Packages, func(i, j int) bool { return lf.Packages[i].Name < lf.Packages[j].Name })
+	data, err := yaml.Marshal(lf)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// signLockfile writes the detached signature <path>.sig with gpg, key picks the signing key
+func signLockfile(path, key string) error {
+	args := []string{"--batch", "--yes", "--detach-sign", "--output", path + ".sig"}
+	if key != "" {
+		args = append(args, "--local-user", key)
+	}
+	out, err := exec.Command("gpg", append(args, path)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("signing %s failed: %v\n%s", path, err, out)
+	}
+	return nil
+}
+
+// verifyLockfile checks <path>.sig against lockKeyring with gpgv, over data read from path
+// before so the content verified is the content used
+func verifyLockfile(path string, data []byte) error {
+	keyring, err := filepath.Abs(lockKeyring)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command("gpgv", "--keyring", keyring, path+".sig", "-")
+	cmd.Stdin = bytes.NewReader(data)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("lockfile signature verification failed: %v\n%s", err, out)
+	}
+	return nil
+}
+
+// checkLocked makes sure the resolved package set is exactly the locked one, from the
+// locked repos and resolved with the same dependency overrides
+func checkLocked(lf *Lockfile, pkgMap map[string]APKPackage, sourceRepo map[string]string, toInstall []string, overrides []string) error {
+	locked := make(map[string]string, len(lf.Packages))
+	lockedRepo := make(map[string]string, len(lf.Packages))
+	for _, p := range lf.Packages {
+		locked[p.Name] = p.Version
+		lockedRepo[p.Name] = p.Repo
+	}
+	var problems []string
+	for _, pkg := range toInstall {
+		info, ok := pkgMap[pkg]
+		if !ok {
+			continue
+		}
+		ver, ok := locked[pkg]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("%s (%s) is not in the lockfile", pkg, info.Version))
+		case ver != info.Version:
+			problems = append(problems, fmt.Sprintf("%s is locked to %s but resolves to %s", pkg, ver, info.Version))
+		case lockedRepo[pkg] != "" && !sameRepo(lockedRepo[pkg], sourceRepo[pkg]):
+			problems = append(problems, fmt.Sprintf("%s is locked to %s but comes from %s", pkg, lockedRepo[pkg], sourceRepo[pkg]))
+		}
+		delete(locked, pkg)
+	}
+	for pkg, ver := range locked {
+		problems = append(problems, fmt.Sprintf("%s (%s) is locked but no longer part of the config", pkg, ver))
+	}
+	lockedOverrides := map[string]bool{}
+	for _, o := range lf.Overrides {
+		lockedOverrides[o] = true
+	}
+	for _, o := range overrides {
+		if !lockedOverrides[o] {
+			problems = append(problems, fmt.Sprintf("override %q is not in the lockfile", o))
+		}
+		delete(lockedOverrides, o)
+	}
+	for o := range lockedOverrides {
+		problems = append(problems, fmt.Sprintf("locked override %q no longer applies", o))
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("package set differs from the lockfile:\n  %s", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// enforceLockfile verifies the lockfile of configPath (and its signature when a lock
+// keyring is set) and checks the resolved package set against it. The checksums it
+// records are kept in lockedSums, every package downloaded has to match them.
+func enforceLockfile(configPath string, pkgMap map[string]APKPackage, sourceRepo map[string]string, toInstall []string, overrides []string) error {
+	path := lockfilePath(configPath)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read lockfile: %w", err)
+	}
+	if lockKeyring != "" {
+		if err := verifyLockfile(path, data); err != nil {
+			return err
+		}
+	} else {
+		eprintf("[WARN] No -lock-keyring set, the signature of %s isn't checked\n", path)
+	}
+	lf, err := parseLockfile(data)
+	if err != nil {
+		return fmt.Errorf("failed to read lockfile: %w", err)
+	}
+	if err := checkLocked(lf, pkgMap, sourceRepo, toInstall, overrides); err != nil {
+		return err
+	}
+	lockedSums = map[string]string{}
+	var unsummed []string
+	for _, p := range lf.Packages {
+		if p.SHA256 == "" {
+			unsummed = append(unsummed, p.Name)
+			continue
+		}
+		lockedSums[p.Name] = p.SHA256
+	}
+	if len(unsummed) > 0 && bundle != nil {
+		// bundle.yaml isn't signed, the lockfile is all that vouches for the bundled packages
+		var missing []string
+		for _, name := range unsummed {
+			if _, ok := bundle.Unchanged[name]; !ok {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("%s has no checksums for %s, the bundled packages can't be verified", path, strings.Join(missing, ", "))
+		}
+	} else if len(unsummed) > 0 {
+		eprintf("[WARN] %s has no checksums for %s, only their versions are locked (run apkg lock to record them)\n", path, strings.Join(unsummed, ", "))
+	}
+	return nil
+}
+
+// checkLockedSum fails when pkg has a locked checksum other than sum
+func checkLockedSum(pkg, sum string) error {
+	if want, ok := lockedSums[pkg]; ok && want != sum {
+		return fmt.Errorf("%s doesn't match the lockfile: sha256 %s, locked %s", pkg, sum, want)
+	}
+	return nil
+}
+
+// lockChecksums records the checksum of every locked package, fetching the ones of the
+// repos into dir (through cache_dir when it is set)
+func lockChecksums(lf *Lockfile, pkgMap map[string]APKPackage, sourceRepo map[string]string, dir string) error {
+	for i, p := range lf.Packages {
+		info := pkgMap[p.Name]
+		if p.Repo == "" {
+			lf.Packages[i].SHA256 = info.SHA256 // direct packages were fetched while resolving
+			continue
+		}
+		dest := filepath.Join(dir, filepath.Base(info.Filename))
+		sum, err := fetchPackage(sourceRepo[p.Name], info, dest)
+		os.Remove(dest)
+		if err != nil {
+			return fmt.Errorf("failed to download %s: %w", p.Name, err)
+		}
+		lf.Packages[i].SHA256 = sum
+	}
+	return nil
+}
+
+// newLockfile records the resolved package set toInstall
+func newLockfile(version string, cfg *Config, pkgMap map[string]APKPackage, sourceRepo map[string]string, toInstall []string) *Lockfile {
+	lf := &Lockfile{Version: version, Overrides: appliedOverrides(cfg, pkgMap, toInstall)}
+	for _, pkg := range toInstall {
+		info, ok := pkgMap[pkg]
+		if !ok {
+			eprintf("[WARN] %s not found in any repo, not locked\n", pkg)
+			continue
+		}
+		lf.Packages = append(lf.Packages, LockedPkg{Name: pkg, Version: info.Version, Repo: sourceRepo[pkg]})
+	}
+	return lf
+}
+
+// writeAppliedLock writes the lockfile at path from the resolution of an apply, so it
+// describes exactly what was installed: the packages of toInstall installed at their
+// resolved version, with the checksums the apply downloaded them with (digests). The
+// packages it didn't download are taken from the previous lockfile when that locked the
+// same version and repo, or fetched as resolved.
+func writeAppliedLock(path string, cfg *Config, pkgMap map[string]APKPackage, sourceRepo map[string]string, toInstall []string, digests map[string]string) error {
+	installed, err := readInstalledPkgs(statePath("installed.yaml"))
+	if err != nil {
+		return err
+	}
+	var pkgs []string
+	for _, pkg := range toInstall {
+		if info, ok := pkgMap[pkg]; ok && installed[pkg] == info.Version {
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	lf := newLockfile("", cfg, pkgMap, sourceRepo, pkgs)
+	previous := map[string]LockedPkg{}
+	if old, err := readLockfile(path); err == nil {
+		lf.Version = old.Version
+		for _, p := range old.Packages {
+			previous[p.Name] = p
+		}
+	}
+	missing := &Lockfile{}
+	for i, p := range lf.Packages {
+		if sum, ok := digests[p.Name]; ok && sum != "" {
+			lf.Packages[i].SHA256 = sum
+		} else if old, ok := previous[p.Name]; ok && old.Version == p.Version && old.Repo == p.Repo && old.SHA256 != "" {
+			lf.Packages[i].SHA256 = old.SHA256
+		} else {
+			missing.Packages = append(missing.Packages, p)
+		}
+	}
+	if len(missing.Packages) > 0 {
+		workDir, err := newWorkDir("run")
+		if err != nil {
+			return err
+		}
+		defer cleanupTempDirs(workDir)
+		printf("Fetching %d packages to record their checksums\n", len(missing.Packages))
+		if err := lockChecksums(missing, pkgMap, sourceRepo, workDir); err != nil {
+			return err
+		}
+		sums := map[string]string{}
+		for _, p := range missing.Packages {
+			sums[p.Name] = p.SHA256
+		}
+		for i, p := range lf.Packages {
+			if sum, ok := sums[p.Name]; ok {
+				lf.Packages[i].SHA256 = sum
+			}
+		}
+	}
+	return writeLockfile(path, lf)
+}
+
+// cmdLock implements `apkg lock [-version <v>] [-sign] [-key <id>]`: resolve the config
+// and record the exact package versions in apkg.lock
+func cmdLock(configPath string, args []string) int {
+	fs := flag.NewFlagSet("lock", flag.ExitOnError)
+	sign := fs.Bool("sign", false, "Sign the lockfile with gpg (writes <lockfile>.sig)")
+	key := fs.String("key", "", "GPG key to sign with (default: gpg's default key)")
+	version := fs.String("version", "", "Version of the locked package set, promoted to channels in the channel manifest")
+	fs.Parse(args)
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		eprintf("[FATAL] Failed to read config: %v\n", err)
+		return 1
+	}
+	globalConfig = cfg
+	// The base layer's packages aren't installed, so they aren't locked either
+	if err := loadBase(cfg); err != nil {
+		eprintf("[FATAL] %v\n", err)
+		return 1
+	}
+	pkgMap, sourceRepo := map[string]APKPackage{}, map[string]string{}
+	if len(cfg.Repos) > 0 {
+		if pkgMap, sourceRepo, err = fetchAndParseAllAPKIndexes(cfg.Repos); err != nil {
+			eprintf("[FATAL] Error fetching APKINDEX: %v\n", err)
+			return 2
+		}
+	}
+	workDir, err := newWorkDir("run")
+	if err != nil {
+		eprintf("[FATAL] Failed to create temp dir: %v\n", err)
+		return 3
+	}
+	defer cleanupTempDirs(workDir)
+	if _, err := resolveDirectPackages(cfg, pkgMap, sourceRepo, workDir); err != nil {
+		eprintf("[FATAL] Failed to fetch package: %v\n", err)
+		return 2
+	}
+	toInstall, err := resolveInstallSet(cfg, pkgMap, sourceRepo)
+	if err != nil {
+		eprintf("[FATAL] %v\n", err)
+		explainResolveError(err, cfg, pkgMap, sourceRepo)
+		return 1
+	}
+	lf := newLockfile(*version, cfg, pkgMap, sourceRepo, toInstall)
+	printf("Fetching %d packages to record their checksums\n", len(lf.Packages))
+	if err := lockChecksums(lf, pkgMap, sourceRepo, workDir); err != nil {
+		eprintf("[FATAL] %v\n", err)
+		return 2
+	}
+	path := lockfilePath(configPath)
+	if err := writeLockfile(path, lf); err != nil {
+		eprintf("[FATAL] Failed to write %s: %v\n", path, err)
+		return 1
+	}
+	printf("Locked %d packages in %s\n", len(lf.Packages), path)
+	if *sign {
+		if err := signLockfile(path, *key); err != nil {
+			eprintf("[FATAL] %v\n", err)
+			return 1
+		}
+		printf("Signed %s.sig\n", path)
+	}
+	return 0
+}
@@ -0,0 +1,167 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckLocked(t *testing.T) {
+	lf := &Lockfile{Packages: []LockedPkg{{Name: "busybox", Version: "1.36.1-r0"}, {Name: "musl", Version: "1.2.5-r0"}}}
+	pkgMap := map[string]APKPackage{
+		"busybox": {Name: "busybox", Version: "1.36.1-r0"},
+		"musl":    {Name: "musl", Version: "1.2.5-r1"},
+		"curl":    {Name: "curl", Version: "8.9.0-r0"},
+	}
+	if err := checkLocked(lf, pkgMap, nil, []string{"busybox"}, nil); err == nil {
+		t.Error("expected a locked package missing from the config to fail")
+	}
+	if err := checkLocked(lf, pkgMap, nil, []string{"busybox", "musl"}, nil); err == nil {
+		t.Error("expected a version differing from the lockfile to fail")
+	}
+	if err := checkLocked(lf, pkgMap, nil, []string{"busybox", "curl"}, nil); err == nil {
+		t.Error("expected an unlocked package to fail")
+	}
+	pkgMap["musl"] = APKPackage{Name: "musl", Version: "1.2.5-r0"}
+	if err := checkLocked(lf, pkgMap, nil, []string{"busybox", "musl"}, nil); err != nil {
+		t.Errorf("exact package set rejected: %v", err)
+	}
+	if err := checkLocked(lf, pkgMap, nil, []string{"busybox", "musl"}, []string{"busybox: ignoring dependency musl"}); err == nil {
+		t.Error("expected an override missing from the lockfile to fail")
+	}
+}
+
+func TestEnforceLockfile(t *testing.T) {
+	oldState, oldConfig, oldKeyring, oldSums := stateDir, globalConfig, lockKeyring, lockedSums
+	defer func() { stateDir, globalConfig, lockKeyring, lockedSums = oldState, oldConfig, oldKeyring, oldSums }()
+	stateDir = t.TempDir()
+	apk := tarGz(".PKGINFO", "pkgname = hello\npkgver = 1.0-r0\n")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(apk)
+	}))
+	defer srv.Close()
+	globalConfig = &Config{}
+	pkgMap := map[string]APKPackage{"hello": {Name: "hello", Version: "1.0-r0", Filename: "hello-1.0-r0.apk"}}
+	sourceRepo := map[string]string{"hello": srv.URL}
+	lf := newLockfile("", globalConfig, pkgMap, sourceRepo, []string{"hello"})
+	if err := lockChecksums(lf, pkgMap, sourceRepo, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(apk)
+	if lf.Packages[0].SHA256 != hex.EncodeToString(digest[:]) || lf.Packages[0].Repo != srv.URL {
+		t.Fatalf("locked %+v", lf.Packages[0])
+	}
+	configPath := filepath.Join(t.TempDir(), "apkg.yaml")
+	lockPath := lockfilePath(configPath)
+	if err := writeLockfile(lockPath, lf); err != nil {
+		t.Fatal(err)
+	}
+	lockKeyring = signWithTestKey(t, lockPath)
+
+	if err := enforceLockfile(configPath, pkgMap, sourceRepo, []string{"hello"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkLockedSum("hello", lf.Packages[0].SHA256); err != nil {
+		t.Errorf("locked content rejected: %v", err)
+	}
+	if err := checkLockedSum("hello", hex.EncodeToString(make([]byte, 32))); err == nil {
+		t.Error("other content accepted")
+	}
+	// The same version from another repo isn't the locked package
+	if err := enforceLockfile(configPath, pkgMap, map[string]string{"hello": "https://elsewhere"}, []string{"hello"}, nil); err == nil || !strings.Contains(err.Error(), "comes from") {
+		t.Errorf("package from another repo = %v", err)
+	}
+	// Any change to the signed lockfile fails verification
+	data, _ := os.ReadFile(lockPath)
+	os.WriteFile(lockPath, bytes.Replace(data, []byte("sha256: "), []byte("sha256: 0"), 1), 0644)
+	if err := enforceLockfile(configPath, pkgMap, sourceRepo, []string{"hello"}, nil); err == nil {
+		t.Error("tampered lockfile accepted")
+	}
+}
+
+func TestLockSkipsBase(t *testing.T) {
+	oldState, oldConfig, oldBase := stateDir, globalConfig, basePkgs
+	defer func() { stateDir, globalConfig, basePkgs = oldState, oldConfig, oldBase }()
+	stateDir = t.TempDir()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".apk") {
+			w.Write(tarGz(".PKGINFO", "pkgname = x\n"))
+			return
+		}
+		w.Write([]byte("P:musl\nV:1.2.5-r0\n\nP:curl\nV:8.9.0-r0\n\n"))
+	}))
+	defer srv.Close()
+	base := t.TempDir()
+	os.MkdirAll(filepath.Join(base, "lib/apk/db"), 0755)
+	os.WriteFile(filepath.Join(base, apkInstalledDB), []byte("P:musl\nV:1.2.5-r0\n\n"), 0644)
+	configPath := filepath.Join(t.TempDir(), "apkg.yaml")
+	os.WriteFile(configPath, []byte("repos: ["+srv.URL+"]\npackages: [musl, curl]\nbase: "+base+"\ntmp_dir: "+t.TempDir()+"\n"), 0644)
+
+	if code := cmdLock(configPath, nil); code != 0 {
+		t.Fatalf("lock exited %d", code)
+	}
+	lf, err := readLockfile(lockfilePath(configPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lf.Packages) != 1 || lf.Packages[0].Name != "curl" {
+		t.Errorf("expected only curl on top of the base, locked %+v", lf.Packages)
+	}
+}
+
+func TestWriteAppliedLock(t *testing.T) {
+	oldState, oldConfig := stateDir, globalConfig
+	defer func() { stateDir, globalConfig = oldState, oldConfig }()
+	stateDir = t.TempDir()
+	fetched := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched++
+		w.Write([]byte("zlib"))
+	}))
+	defer srv.Close()
+	cfg := &Config{Repos: []string{srv.URL}, TmpDir: t.TempDir()}
+	globalConfig = cfg
+	pkgMap := map[string]APKPackage{
+		"curl": {Name: "curl", Version: "8.9.1-r0", Filename: "curl-8.9.1-r0.apk"},
+		"musl": {Name: "musl", Version: "1.2.5-r0", Filename: "musl-1.2.5-r0.apk"},
+		"zlib": {Name: "zlib", Version: "1.3.1-r0", Filename: "zlib-1.3.1-r0.apk"},
+		"nano": {Name: "nano", Version: "8.1-r0", Filename: "nano-8.1-r0.apk"},
+	}
+	sourceRepo := map[string]string{"curl": srv.URL, "musl": srv.URL, "zlib": srv.URL, "nano": srv.URL}
+	// nano failed to install and isn't locked
+	writeInstalledPkgs(statePath("installed.yaml"), map[string]string{"curl": "8.9.1-r0", "musl": "1.2.5-r0", "zlib": "1.3.1-r0"})
+	path := filepath.Join(t.TempDir(), "apkg.lock")
+	writeLockfile(path, &Lockfile{Version: "3", Packages: []LockedPkg{{Name: "musl", Version: "1.2.5-r0", Repo: srv.URL, SHA256: "musl-sum"}}})
+
+	// curl was downloaded by the apply, musl is unchanged since the last lock, zlib is fetched
+	if err := writeAppliedLock(path, cfg, pkgMap, sourceRepo, []string{"curl", "musl", "nano", "zlib"}, map[string]string{"curl": "curl-sum"}); err != nil {
+		t.Fatal(err)
+	}
+	lf, err := readLockfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sums := map[string]string{}
+	for _, p := range lf.Packages {
+		sums[p.Name] = p.SHA256
+	}
+	zlibSum := sha256.Sum256([]byte("zlib"))
+	if lf.Version != "3" || len(sums) != 3 || sums["curl"] != "curl-sum" || sums["musl"] != "musl-sum" || sums["zlib"] != hex.EncodeToString(zlibSum[:]) {
+		t.Errorf("unexpected lockfile %+v", lf)
+	}
+	if fetched != 1 {
+		t.Errorf("expected only zlib to be fetched, got %d fetches", fetched)
+	}
+}
@@ -0,0 +1,55 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// lowMemory is set with -low-memory or low_memory: true, it trades speed for a
+// small and predictable peak RSS on routers and SBCs
+var lowMemory bool
+
+// lowMemoryGCPercent makes the GC run far more often than the default of 100
+const lowMemoryGCPercent = 20
+
+// applyLowMemory switches the process to the low-memory profile when enabled
+func applyLowMemory(cfg *Config) {
+	if cfg.LowMemory {
+		lowMemory = true
+	}
+	if !lowMemory {
+		return
+	}
+	runtime.GOMAXPROCS(1)
+	debug.SetGCPercent(lowMemoryGCPercent)
+	// Streaming skips the checks only possible on a whole package, so it stays opt-in
+	// even though staging keeps every package in tmp, which often is a tmpfs on these devices
+	if cfg.InstallMode != installModeStreaming {
+		eprintf("[WARN] Low-memory profile: packages are staged in tmp_dir (%s), set install_mode: streaming if that is in RAM\n", tmpBase())
+	}
+}
+
+// prunePkgMap drops every index entry apply no longer needs once the plan is
+// computed, keeping the install set and what is installed
+func prunePkgMap(pkgMap map[string]APKPackage, sourceRepo map[string]string, toInstall []string, installedPkgs map[string]string) {
+	keep := make(map[string]struct{}, len(toInstall)+len(installedPkgs))
+	for _, pkg := range toInstall {
+		keep[pkg] = struct{}{}
+	}
+	for pkg := range installedPkgs {
+		keep[pkg] = struct{}{}
+	}
+	for name := range pkgMap {
+		if _, ok := keep[name]; !ok {
+			delete(pkgMap, name)
+			delete(sourceRepo, name)
+		}
+	}
+	debug.FreeOSMemory()
+}
@@ -8,16 +8,20 @@ package main
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -30,60 +34,287 @@ type Config struct {
 	InstallDir  string   `yaml:"install_dir"`
 	RunScripts  bool     `yaml:"run_scripts"`
 	ResolveDeps bool     `yaml:"resolve_deps"`
+	// Alternatives maps a path shared by several packages to the preferred provider
+	Alternatives map[string]string `yaml:"alternatives,omitempty"`
+	// AuditLog is an append-only JSONL file every file change is logged to (empty disables it)
+	AuditLog string `yaml:"audit_log,omitempty"`
+	// TmpDir is where per-run temp dirs are created (default: working directory)
+	TmpDir string `yaml:"tmp_dir,omitempty"`
+	// PackageOptions holds per-package settings such as include/exclude path filters
+	PackageOptions map[string]PackageOptions `yaml:"package_options,omitempty"`
+	// Exclude lists globs of paths never installed from any package
+	Exclude []string `yaml:"exclude,omitempty"`
+	// ExcludeProfiles enables built-in exclusion sets: minimal, no-docs, no-locales
+	ExcludeProfiles []string `yaml:"exclude_profiles,omitempty"`
+	// Dedupe hardlinks byte-identical files of different packages after install
+	Dedupe bool `yaml:"dedupe,omitempty"`
+	// Network is the retry/timeout policy of index fetches and package downloads
+	Network NetworkConfig `yaml:"network,omitempty"`
+	// Provenance is where an in-toto/SLSA provenance statement of the built root is written after apply
+	Provenance string `yaml:"provenance,omitempty"`
+	// Channel is the rollout channel (e.g. canary, stable) this machine follows, applies only
+	// happen once the lockfile's version is promoted to it in ChannelManifest
+	Channel         string `yaml:"channel,omitempty"`
+	ChannelManifest string `yaml:"channel_manifest,omitempty"`
+	// CacheDir keeps downloaded packages, it can be shared by apkg processes running in parallel
+	CacheDir string `yaml:"cache_dir,omitempty"`
+	// InstallMode "streaming" installs packages straight from the download instead of staging them first
+	InstallMode string `yaml:"install_mode,omitempty"`
+	// ExtractSkip lists extra glob patterns of archive entries that are never extracted
+	ExtractSkip []string `yaml:"extract_skip,omitempty"`
+	// IndexFilter only keeps the index entries of the configured packages and their
+	// dependencies in memory, the low-memory profile enables it too
+	IndexFilter bool `yaml:"index_filter,omitempty"`
+	// Strip "strip" strips installed ELF files, "split" keeps their debug info in usr/lib/debug first
+	Strip string `yaml:"strip,omitempty"`
+	// LibraryCache "off" stops apkg from maintaining the musl path file or ld.so.cache of install_dir
+	LibraryCache string `yaml:"library_cache,omitempty"`
+	// KernelKeep is how many module trees of previous kernels (left behind by upgrades and
+	// removals of kernel packages) are kept in lib/modules, unset keeps all of them
+	KernelKeep *int `yaml:"kernel_keep,omitempty"`
+	// Arches are the architectures `apkg build-matrix` builds, $arch in repos is replaced by each
+	Arches []string `yaml:"arches,omitempty"`
+	// QemuBinfmt lets apkg register the host's qemu-user with binfmt_misc so maintainer
+	// scripts of a foreign-architecture root run under emulation
+	QemuBinfmt bool `yaml:"qemu_binfmt,omitempty"`
+	// ResolveCache skips parsing and resolution when nothing changed since the last run that
+	// found the system converged
+	ResolveCache bool `yaml:"resolve_cache,omitempty"`
+	// LowMemory enables the low-memory profile, like -low-memory
+	LowMemory bool `yaml:"low_memory,omitempty"`
+	// Generations builds every apply into a new generation under the state dir and makes
+	// install_dir a symlink to the active one
+	Generations bool `yaml:"generations,omitempty"`
+	// GenerationsKeep is how many finished generations `apkg gc` keeps besides the active one, 0 keeps all
+	GenerationsKeep int `yaml:"generations_keep,omitempty"`
+	// Routes send the paths below a directory of install_dir (e.g. etc) to another
+	// destination directory, so one apply can populate several volumes
+	Routes map[string]string `yaml:"routes,omitempty"`
+	// Base is the lower layer (a directory or tarball of an image with an apk database) apkg
+	// installs on top of, packages it already has are not installed again
+	Base string `yaml:"base,omitempty"`
+	// DBusEvents also broadcasts changes of the installed set as a D-Bus signal on the system bus
+	DBusEvents bool `yaml:"dbus_events,omitempty"`
+	// Trust maps repos (or "default") to off, warn or enforce: whether unsigned or badly
+	// signed indexes and packages are allowed, reported or refused (default: off)
+	Trust map[string]string `yaml:"trust,omitempty"`
+	// KeysDir holds the public keys signatures are checked against (default: /etc/apk/keys)
+	KeysDir string `yaml:"keys_dir,omitempty"`
+	// DependencyOverrides drops or substitutes dependencies of a package when resolve_deps
+	// pulls them in
+	DependencyOverrides map[string]DependencyOverride `yaml:"dependency_overrides,omitempty"`
+	// Aliases map old package names to the ones upstream renamed them to, on top of the built-in renames
+	Aliases map[string]string `yaml:"aliases,omitempty"`
+	// OptionalGroups are tiers of packages installed only when enabled in with_optional or with -with
+	OptionalGroups map[string]OptionalGroup `yaml:"optional_groups,omitempty"`
+	// WithOptional lists the optional groups to install
+	WithOptional []string `yaml:"with_optional,omitempty"`
+
+	// Secdb lists Alpine secdb JSON files (URLs or paths) `apkg outdated` checks upgrades against
+	Secdb []string `yaml:"secdb,omitempty"`
+	// AutoUpgrade is the policy of `apkg auto-upgrade`
+	AutoUpgrade AutoUpgradeConfig `yaml:"auto_upgrade,omitempty"`
+	// Umask (octal, e.g. 027) applies to everything an apply creates without a packaged mode
+	Umask string `yaml:"umask,omitempty"`
+	// DirMode (octal, default 0755) is the mode of directories no package describes
+	DirMode string `yaml:"dir_mode,omitempty"`
+	// Userns makes applies of unprivileged users run in a user namespace mapping them to root
+	// and their /etc/subuid and /etc/subgid ranges to the other ids, so ownership is kept
+	Userns bool `yaml:"userns,omitempty"`
+	// Sandbox restricts the filesystem and network access of applies with Landlock to the
+	// configured repos, cache, state, temp and install dirs
+	Sandbox bool `yaml:"sandbox,omitempty"`
+	// Extraction limits the size and entries of every package, optionally unpacking it in a
+	// resource-limited worker process
+	Extraction ExtractionConfig `yaml:"extraction,omitempty"`
+	// Scanners are commands (e.g. clamscan) the staged packages have to pass before install
+	Scanners []Scanner `yaml:"scanners,omitempty"`
+	// Peers are other apkg hosts whose package caches are tried before the mirrors
+	Peers PeersConfig `yaml:"peers,omitempty"`
+
+	// AlpineMirror is the mirror base alpine:<branch>/<repo> repos expand to (default: dl-cdn.alpinelinux.org),
+	// auto uses the one `apkg mirrors update` picked
+	AlpineMirror string `yaml:"alpine_mirror,omitempty"`
+	// AlpineArchive is where alpine: repos are fetched from once the mirror lacks their
+	// (end-of-life) branch (default: archive.alpinelinux.org), off disables the fallback
+	AlpineArchive string `yaml:"alpine_archive,omitempty"`
+	// Arch is the arch alpine: repos expand to (default: the host's)
+	Arch string `yaml:"arch,omitempty"`
+
+	// OnFailure is what a failing package does to the run: fail-fast (default) stops and rolls
+	// back, continue-and-report installs the rest and reports it, retry-N retries it N times first
+	OnFailure string `yaml:"on_failure,omitempty"`
+	// PackageTimeout bounds the download and extraction, and the install, of every package (e.g. 5m)
+	PackageTimeout string `yaml:"package_timeout,omitempty"`
+
+	// repoSpecs are the repos as written when alpine: shorthands were expanded
+	repoSpecs []string
+	// pins are the repos packages: entries written as foo@<repo> are restricted to
+	pins map[string]string
+	// optionalOf maps the packages added by optional groups to their group
+	optionalOf map[string]string
+	// renamed maps the configured packages upstream renamed to their new names
+	renamed map[string]string
 }
 
-// readConfig reads and parses apkg.yaml
+// stdinConfig caches the config read with -config - since stdin can only be read once
+var stdinConfig []byte
+
+// configData is the raw content of the last config read, attested in provenance
+var configData []byte
+
+// readConfig reads and parses apkg.yaml (or its TOML or JSON equivalent), a path of
+// "-" reads it from stdin and an http(s) URL fetches it
 func readConfig(path string) (*Config, error) {
-	f, err := os.Open(path)
+	var data []byte
+	if path == "-" {
+		if stdinConfig == nil {
+			var err error
+			if stdinConfig, err = readLimited(os.Stdin, maxConfigSize, "config"); err != nil {
+				return nil, err
+			}
+		}
+		data = stdinConfig
+	} else {
+		var err error
+		if data, err = readConfigSource(path); err != nil {
+			return nil, err
+		}
+	}
+	// Never apply a config that doesn't carry a valid signature once a keyring is configured
+	if configKeyring != "" {
+		if err := verifyConfigSignature(path, data); err != nil {
+			return nil, err
+		}
+	}
+
+	configData = data
+	data, format, err := configToYAML(path, data)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
-
 	var cfg Config
-	dec := yaml.NewDecoder(f)
-	if err := dec.Decode(&cfg); err != nil {
+	if err := decodeConfig(data, &cfg); err != nil {
+		if format != formatYAML {
+			err = withoutLines(err)
+		}
+		return nil, err
+	}
+	expandAlpineRepos(&cfg)
+	if err := validateConfig(&cfg); err != nil {
 		return nil, err
 	}
 	return &cfg, nil
 }
 
+// checkConfigWritable refuses to modify configs apkg can't or mustn't write back
+func checkConfigWritable(path string) error {
+	if path == "-" || isRemoteConfig(path) {
+		return fmt.Errorf("config was read from stdin or a URL and can't be modified")
+	}
+	if configKeyring != "" {
+		return fmt.Errorf("config is signature protected, edit and re-sign it by hand")
+	}
+	if data, err := os.ReadFile(path); err == nil && configFormat(path, data) != formatYAML {
+		return fmt.Errorf("only YAML configs can be modified, edit %s by hand", path)
+	}
+	return nil
+}
+
+// writeConfig writes cfg back to apkg.yaml
+func writeConfig(path string, cfg *Config) error {
+	if err := checkConfigWritable(path); err != nil {
+		return err
+	}
+	if cfg.repoSpecs != nil {
+		// Write the alpine: shorthands back instead of the URLs they expanded to
+		c := *cfg
+		c.Repos = cfg.repoSpecs
+		cfg = &c
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return yamlEncode(f, cfg)
+}
+
+// yamlEncode writes cfg as YAML to w
+func yamlEncode(w io.Writer, cfg *Config) error {
+	if len(cfg.pins) > 0 {
+		c := *cfg
+		c.Packages = withPins(cfg.Packages, cfg.pins)
+		cfg = &c
+	}
+	enc := yaml.NewEncoder(w)
+	return enc.Encode(cfg)
+}
+
 // fetchAPKIndex downloads and parses the APKINDEX.tar.gz from a given Alpine repo URL
 type APKPackage struct {
 	Name     string
 	Version  string
 	Filename string
 	Deps     []string
+	Provides []string
+	// Origin is the source package this one was built from (subpackages share it)
+	Origin     string
+	Maintainer string
+	// BuildTime is the unix timestamp the package was built at
+	BuildTime int64
+	// SHA256 of the .apk, only known up front for direct entries
+	SHA256 string
+	// Checksum is the Q1 checksum (sha1 of the control member) the index lists
+	Checksum string
+	// Size is the size of the .apk, InstalledSize the size of its contents
+	Size          int64
+	InstalledSize int64
+	// ProviderPriority ranks the providers of a virtual name, higher is preferred
+	ProviderPriority int64
 }
 
-// fetchAndParseAPKIndex downloads and parses the APKINDEX.tar.gz from a given Alpine repo URL
-// fetchAndParseAPKIndex fetches APKINDEX from the exact repo URL provided
-func fetchAndParseAPKIndex(repoURL string) (map[string]APKPackage, error) {
-	repoURL = strings.TrimRight(repoURL, "/")
-	indexURL := repoURL + "/APKINDEX.tar.gz"
-	resp, err := http.Get(indexURL)
+// apkIndexNames are the index files tried in order, minimal repos may only publish
+// a bare or gzip-only APKINDEX
+var apkIndexNames = []string{"APKINDEX.tar.gz", "APKINDEX.gz", "APKINDEX"}
+
+// parseAPKIndexFile parses an index stored at path in any form parseAPKIndexPayload accepts
+func parseAPKIndexFile(path string) (map[string]APKPackage, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		return nil, fmt.Errorf("failed to download APKINDEX: %w", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
+	defer f.Close()
+	return parseAPKIndexPayload(f)
+}
 
-	if resp.StatusCode != 200 {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("failed to fetch APKINDEX: status %d, content-type %s, body: %s", resp.StatusCode, resp.Header.Get("Content-Type"), string(body))
+// parseAPKIndexPayload parses an index served as a compressed tarball, compressed or plain text,
+// telling them apart by their content rather than their name or content-type
+func parseAPKIndexPayload(r io.Reader) (map[string]APKPackage, error) {
+	rc, _, err := decompress(r)
+	if err != nil {
+		return nil, err
 	}
-
-	ct := resp.Header.Get("Content-Type")
-	if !(strings.Contains(ct, "gzip") || strings.Contains(ct, "octet-stream")) {
-		return nil, fmt.Errorf("unexpected content-type for APKINDEX: %s", ct)
+	defer rc.Close()
+	inner := bufio.NewReader(rc)
+	if hdr, _ := inner.Peek(262); len(hdr) == 262 && string(hdr[257:262]) == "ustar" {
+		return parseAPKIndexTar(inner)
 	}
+	return parseAPKIndexText(inner)
+}
 
-	gzr, err := gzip.NewReader(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+// parseAPKIndexText parses a bare APKINDEX after checking it looks like one, so an
+// HTML error page served with status 200 isn't taken for an empty index
+func parseAPKIndexText(br *bufio.Reader) (map[string]APKPackage, error) {
+	if head, _ := br.Peek(2); len(head) < 2 || head[1] != ':' {
+		return nil, &permanentError{fmt.Errorf("payload is neither an APKINDEX nor a (compressed) tarball of one")}
 	}
-	defer gzr.Close()
+	return parseAPKIndex(br)
+}
 
-	tarReader := tar.NewReader(gzr)
+// parseAPKIndexTar reads the APKINDEX out of an (already decompressed) index tarball
+func parseAPKIndexTar(r io.Reader) (map[string]APKPackage, error) {
+	tarReader := tar.NewReader(r)
 	for {
 		hdr, err := tarReader.Next()
 		if err == io.EOF {
@@ -99,45 +330,79 @@ func fetchAndParseAPKIndex(repoURL string) (map[string]APKPackage, error) {
 	return nil, fmt.Errorf("APKINDEX not found in archive")
 }
 
+// maxIndexLine bounds a single APKINDEX line, longer lines fail the parse
+const maxIndexLine = 1 << 20
+
 // parseAPKIndex parses the APKINDEX file and returns a map of package name to APKPackage
 func parseAPKIndex(r io.Reader) (map[string]APKPackage, error) {
-	// Read the entire APKINDEX into memory
-	data, err := io.ReadAll(r)
-	if err != nil {
-		return nil, err
-	}
-	content := string(data)
-
-	entries := strings.Split(content, "\n\n")
+	// Scan line by line so only the entry being parsed is held in memory, a
+	// full APKINDEX is several MiB and would otherwise be kept twice
 	pkgs := make(map[string]APKPackage)
-	for _, entry := range entries {
-		var name, version, depsLine string
-		for _, line := range strings.Split(entry, "\n") {
-			if len(line) < 2 || line[1] != ':' {
-				continue
-			}
-			val := line[2:]
-			switch line[0] {
-			case 'P':
-				name = val
-			case 'V':
-				version = val
-			case 'D':
-				depsLine = val
-			}
-		}
-		if name != "" && version != "" {
-			filename := name + "-" + version + ".apk"
-			var deps []string
-			if depsLine != "" {
-				for _, dep := range strings.Fields(depsLine) {
-					// Remove version constraints (e.g., 'libc.musl-x86_64.so.1 so:libc.musl-x86_64.so.1')
-					deps = append(deps, strings.Split(dep, ">=")[0])
-				}
+	var name, version, depsLine, providesLine, origin, maintainer, checksum string
+	var buildTime, size, installedSize, providerPriority int64
+	flush := func() {
+		if name != "" && version != "" && (activeIndexFilter == nil || activeIndexFilter.keeps(&APKPackage{Name: name, Provides: strings.Fields(providesLine)})) {
+			deps := strings.Fields(depsLine)
+			pkgs[name] = APKPackage{
+				Name:          name,
+				Version:       version,
+				Filename:      name + "-" + version + ".apk",
+				Deps:          deps,
+				Provides:      strings.Fields(providesLine),
+				Origin:        origin,
+				Maintainer:    maintainer,
+				BuildTime:     buildTime,
+				Checksum:      checksum,
+				Size:          size,
+				InstalledSize: installedSize,
+
+				ProviderPriority: providerPriority,
 			}
-			pkgs[name] = APKPackage{Name: name, Version: version, Filename: filename, Deps: deps}
 		}
+		name, version, depsLine, providesLine, origin, maintainer, checksum = "", "", "", "", "", "", ""
+		buildTime, size, installedSize, providerPriority = 0, 0, 0, 0
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), maxIndexLine)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			flush()
+			continue
+		}
+		if len(line) < 2 || line[1] != ':' {
+			continue
+		}
+		val := line[2:]
+		switch line[0] {
+		case 'P':
+			name = val
+		case 'V':
+			version = val
+		case 'D':
+			depsLine = val
+		case 'p':
+			providesLine = val
+		case 'o':
+			origin = val
+		case 'm':
+			maintainer = val
+		case 'C':
+			checksum = val
+		case 't':
+			buildTime, _ = strconv.ParseInt(val, 10, 64)
+		case 'S':
+			size, _ = strconv.ParseInt(val, 10, 64)
+		case 'I':
+			installedSize, _ = strconv.ParseInt(val, 10, 64)
+		case 'k':
+			providerPriority, _ = strconv.ParseInt(val, 10, 64)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
 	}
+	flush()
 	return pkgs, nil
 }
 
@@ -170,8 +435,10 @@ func readInstalledPkgs(path string) (map[string]string, error) {
 	return pkgs, nil
 }
 
-// writeInstalledPkgs writes the installed packages file (installed.yaml)
+// writeInstalledPkgs writes the installed packages file (installed.yaml) and publishes
+// the change of the installed set
 func writeInstalledPkgs(path string, pkgs map[string]string) error {
+	before, _ := readInstalledPkgs(path)
 	list := make([]InstalledPkg, 0, len(pkgs))
 	for name, ver := range pkgs {
 		list = append(list, InstalledPkg{Name: name, Version: ver})
@@ -182,194 +449,506 @@ func writeInstalledPkgs(path string, pkgs map[string]string) error {
 	}
 	defer f.Close()
 	enc := yaml.NewEncoder(f)
-	return enc.Encode(list)
+	if err := enc.Encode(list); err != nil {
+		return err
+	}
+	if err := emitInstalledEvent(path, before, pkgs); err != nil {
+		eprintf("[WARN] Failed to write %s: %v\n", eventFile, err)
+	}
+	return nil
 }
 
 // globalConfig is used for script handling
 var globalConfig *Config
 
 func main() {
+	if os.Getenv(extractWorkerEnv) != "" {
+		os.Exit(runExtractWorker())
+	}
+	if root := os.Getenv(rootExecEnv); root != "" {
+		os.Exit(execInRoot(root, os.Args[1:]))
+	}
 	var err error
 	// CLI flags
-	configPath := flag.String("config", "apkg.yaml", "Path to config file")
+	configPath := flag.String("config", "apkg.yaml", "Path to config file, - reads it from stdin")
+	keyringFlag := flag.String("config-keyring", "", "GPG keyring the config's detached signature (<config>.sig) must verify against (default: $APKG_CONFIG_KEYRING)")
+	stateDirFlag := flag.String("state-dir", "", "Directory holding installed.yaml and the other state (default: $APKG_STATE_DIR or the working directory)")
 	dryRun := flag.Bool("dry-run", false, "Show what would be done, but don't modify anything")
-	verbose := flag.Bool("v", false, "Enable verbose output")
+	verbose := flag.Bool("v", false, "Enable every debug selector, same as -debug all")
+	debug := flag.String("debug", "", "Comma-separated subsystems to print debug output of, e.g. http,resolve or all (default: $APKG_DEBUG)")
+	jsonOutput := flag.Bool("json", false, "Print a machine-readable summary on stdout, human output goes to stderr")
+	ipv4Only := flag.Bool("4", false, "Only connect to mirrors over IPv4")
+	ipv6Only := flag.Bool("6", false, "Only connect to mirrors over IPv6")
+	flag.DurationVar(&requireFresh, "require-fresh", 0, "Fail instead of falling back to cached indexes older than this (e.g. 24h)")
+	locked := flag.Bool("locked", false, "Refuse to install anything but the exact package set in the lockfile")
+	writeLock := flag.Bool("write-lock", false, "Write the lockfile from the package set the apply installed")
+	lockKeyringFlag := flag.String("lock-keyring", "", "GPG keyring the lockfile's signature (<lockfile>.sig) must verify against with -locked (default: $APKG_LOCK_KEYRING)")
+	flag.BoolVar(&lowMemory, "low-memory", false, "Keep peak memory low (single thread, aggressive GC) for small devices")
+	changedExitCode := flag.Int("changed-exit-code", 0, "Exit with this code when the run changed the system (0 disables)")
+	flag.BoolVar(&failOnWarn, "fail-on-warn", false, "Exit with 6 when the run printed any warning")
+	with := flag.String("with", "", "Comma-separated optional groups to install on top of with_optional")
+	flag.BoolVar(&allowSuid, "allow-suid", false, "Install new setuid/setgid files and file capabilities without review")
+	bundleDirFlag := flag.String("bundle-dir", "", "Install from an extracted offline bundle without network access (used by bundle apply)")
+	lang := flag.String("lang", "", "Language of the messages, e.g. de (default: from LC_ALL, LC_MESSAGES or LANG)")
+	flag.BoolVar(&longOutput, "long", false, "List one package per line with versions and sizes, whatever the terminal width")
+	only := flag.String("only-upgrade", "", "Comma-separated packages whose upgrades are applied, upgrades of other installed packages are held back and nothing is installed or removed")
 	flag.Parse()
+	configGiven := false
+	flag.Visit(func(f *flag.Flag) { configGiven = configGiven || f.Name == "config" })
+	if !configGiven {
+		*configPath = defaultConfigPath()
+	}
+	if err := setLanguage(selectedLanguage(*lang)); err != nil && *lang != "" {
+		eprintf("[WARN] %v\n", err)
+	}
+	if *debug == "" {
+		*debug = os.Getenv(debugEnv)
+	}
+	if *verbose && *debug == "" {
+		*debug = "all"
+	}
+	if err := setDebug(*debug); err != nil {
+		eprintf("[FATAL] %v\n", err)
+		os.Exit(1)
+	}
+	if err := waitUserNamespace(); err != nil {
+		eprintf("[FATAL] %v\n", err)
+		os.Exit(1)
+	}
+	if *with != "" {
+		withGroups = strings.Split(*with, ",")
+	}
+	if *only != "" {
+		onlyUpgrade = map[string]bool{}
+		for _, pkg := range strings.Split(*only, ",") {
+			onlyUpgrade[pkg] = true
+		}
+	}
+	if *jsonOutput {
+		enableJSONOutput()
+	}
+	switch {
+	case *ipv4Only && *ipv6Only:
+		eprintf("[FATAL] -4 and -6 are mutually exclusive\n")
+		os.Exit(1)
+	case *ipv4Only:
+		ipFamilyOverride = "ipv4"
+	case *ipv6Only:
+		ipFamilyOverride = "ipv6"
+	}
+	configKeyring = *keyringFlag
+	if configKeyring == "" {
+		configKeyring = os.Getenv("APKG_CONFIG_KEYRING")
+	}
+	lockKeyring = *lockKeyringFlag
+	if lockKeyring == "" {
+		lockKeyring = os.Getenv("APKG_LOCK_KEYRING")
+	}
+	if *stateDirFlag != "" {
+		stateDir = *stateDirFlag
+	} else if env := os.Getenv("APKG_STATE_DIR"); env != "" {
+		stateDir = env
+	}
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		eprintf("[FATAL] Failed to create state dir: %v\n", err)
+		os.Exit(1)
+	}
+	if *bundleDirFlag != "" {
+		m, err := loadBundle(*bundleDirFlag)
+		if err != nil {
+			eprintf("[FATAL] Bundle verification failed: %v\n", err)
+			os.Exit(1)
+		}
+		bundleDir, bundle = *bundleDirFlag, m
+	}
 
 	args := flag.Args()
+	if len(args) > 0 {
+		switch args[0] {
+		case "alternatives":
+			os.Exit(cmdAlternatives(*configPath, args[1:]))
+		case "provides":
+			os.Exit(cmdProvides(*configPath, args[1:]))
+		case "info":
+			os.Exit(cmdInfo(*configPath, args[1:]))
+		case "search":
+			os.Exit(cmdSearch(*configPath, args[1:]))
+		case "list":
+			os.Exit(cmdList(*configPath, args[1:]))
+		case "status":
+			os.Exit(cmdStatus(*configPath))
+		case "verify":
+			os.Exit(cmdVerify(*configPath, args[1:]))
+		case "extract":
+			os.Exit(cmdExtract(*configPath, args[1:]))
+		case "freeze":
+			os.Exit(cmdFreeze(*configPath, args[1:]))
+		case "lock":
+			os.Exit(cmdLock(*configPath, args[1:]))
+		case "du":
+			os.Exit(cmdDu(*configPath, args[1:]))
+		case "shell":
+			os.Exit(cmdShell(*configPath, args[1:]))
+		case "run":
+			os.Exit(cmdRun(*configPath, args[1:]))
+		case "export-layer":
+			os.Exit(cmdExportLayer(*configPath, args[1:]))
+		case "gc":
+			os.Exit(cmdGC(*configPath, args[1:]))
+		case "generations":
+			os.Exit(cmdGenerations(*configPath, args[1:]))
+		case "auto-upgrade":
+			os.Exit(cmdAutoUpgrade(*configPath, args[1:]))
+		case "outdated":
+			os.Exit(cmdOutdated(*configPath, args[1:]))
+		case "bundle":
+			os.Exit(cmdBundle(*configPath, args[1:]))
+		case "config":
+			os.Exit(cmdConfig(*configPath, args[1:]))
+		case "mirrors":
+			os.Exit(cmdMirrors(*configPath, args[1:]))
+		case "proxy":
+			os.Exit(cmdProxy(*configPath, args[1:]))
+		case "peers":
+			os.Exit(cmdPeers(*configPath, args[1:]))
+		case "explain-plan":
+			os.Exit(cmdExplainPlan(*configPath, args[1:]))
+		case "plan":
+			os.Exit(cmdPlan(*configPath, args[1:]))
+		case "version":
+			os.Exit(cmdVersion(*configPath, args[1:]))
+		case "repo-diff":
+			os.Exit(cmdRepoDiff(*configPath, args[1:]))
+		case "repo-stats":
+			os.Exit(cmdRepoStats(*configPath, args[1:]))
+		case "stats":
+			os.Exit(cmdStats(*configPath, args[1:]))
+		case "check-libs":
+			os.Exit(cmdCheckLibs(*configPath, args[1:]))
+		case "services":
+			os.Exit(cmdServices(*configPath, args[1:]))
+		case "build-matrix":
+			os.Exit(cmdBuildMatrix(*configPath, args[1:]))
+		case "audit":
+			os.Exit(cmdAudit(*configPath, args[1:]))
+		case "clean":
+			os.Exit(cmdClean(*configPath, args[1:]))
+		case "resume":
+			// An apply that keeps what interrupted transactions completed
+			resumeRun = true
+		}
+	}
 	if len(args) > 0 && (args[0] == "add" || args[0] == "remove" || args[0] == "reinstall" || args[0] == "regen-indexes" || args[0] == "list-installed" || args[0] == "help" || args[0] == "--help" || args[0] == "-h") {
+		// --with-subpackages applies add/remove to every package sharing the origin
+		withSubpackages := false
+		if len(args) > 1 && args[1] == "--with-subpackages" {
+			withSubpackages = true
+			args = append([]string{args[0]}, args[2:]...)
+		}
 		if args[0] == "help" || args[0] == "--help" || args[0] == "-h" {
-			fmt.Println(`apkg - worse Alpine package manager
+			fmt.Print(`apkg - worse Alpine package manager
 
 Usage:
   apkg [flags]                # Install/upgrade/uninstall to match config
-  apkg add <pkg>              # Add a package to the config and install it
+  apkg add <pkg>[@<repo>]     # Add a package to the config and install it, pinned to <repo>
+  apkg add --with-subpackages <pkg>     # Add a package and every subpackage of its origin
   apkg remove|del <pkg>       # Remove a package from the config and uninstall it
+  apkg remove --with-subpackages <pkg>  # Remove a whole origin family
   apkg reinstall <pkg>        # Force reinstall a package
   apkg regen-indexes          # Regenerate installed file indexes
   apkg list-installed         # List installed packages and versions
+  apkg alternatives [list]    # List paths shared by several packages
+  apkg alternatives set <path> <pkg>  # Point a shared path at another provider
+  apkg provides <token>       # Find packages providing e.g. cmd:pip3 or so:libssl.so.3
+  apkg provides -r <pkg>      # List everything a package provides
+  apkg info <pkg>             # Show package details from the repo index
+  apkg search [-maintainer <m>] <term>  # Search available packages by name
+  apkg list [-origin <o>]     # List available packages grouped by origin
+  apkg clean [-older-than <d>]  # Remove temp dirs left behind by interrupted runs
+  apkg resume                 # Apply, keeping the packages an interrupted run completed
+  apkg verify [pkg...]        # Check that every installed file is still present
+  apkg lock [-version <v>] [-sign] [-key <id>]  # Record the resolved package versions in apkg.lock
+  apkg freeze [-lock-only] [-version <v>] [-sign]  # Turn the installed packages into the config's list and apkg.lock
+  apkg extract -to-tar <file|-> [pkg...]  # Export the merged, filtered package set as one tar stream
+  apkg du [-index] [pkg...]   # Show disk usage per installed package, largest first
+  apkg audit [-tx <id>] [-package <p>] [-path <glob>]  # Query the audit log
+  apkg shell [-shell <path>]  # Open a shell inside install_dir (chroot, proot or a user namespace)
+  apkg run [-e K=V] <cmd> [args...]  # Run a command inside install_dir and exit with its exit code
+  apkg build-matrix [-arch <a,b>] [-jobs <n>] [-export <dir>]  # Build every configured arch into its own root
+  apkg services [list|enable|disable] [-runlevel <r>] [name]  # Manage OpenRC/systemd services in install_dir
+  apkg check-libs [-suggest] [pkg...]  # Report shared libraries installed binaries need but the root lacks
+  apkg export-layer -o <file|-> [-gzip]  # Write the files changed by the last apply as a tar layer
+  apkg gc [-keep <n>] [-n]    # Remove unfinished and old generations, reporting reclaimed space
+  apkg generations [list|switch <n>]  # List generations or atomically switch install_dir to another one
+  apkg auto-upgrade [-once]   # Periodically apply security fixes and allowlisted upgrades only
+  apkg outdated [-security]   # List installed packages with upgrades available, flagging security fixes
+  apkg bundle create [-o <file>]  # Archive the config, a lockfile and every package it installs
+  apkg bundle diff <old.lock> <new.lock>  # Bundle only the packages that changed between two lockfiles
+  apkg bundle apply <file>    # Install a bundle offline, verifying every file against it
+  apkg config validate [file] # Report every problem of the config with its line
+  apkg config get|set|unset <key> [value]  # Read or change a (dotted) config key, keeping comments
+  apkg config add-repo|remove-repo <url>  # Add or remove a repo
+  apkg mirrors update [-prefer de,at]  # Probe the official Alpine mirrors and write the fastest to alpine_mirror
+  apkg proxy [-listen :8080] [-max-size <s>]  # Serve a caching proxy of the Alpine mirror to the LAN, purge empties its cache
+  apkg peers serve [-listen :8771]  # Share cache_dir with the apkg hosts of the LAN, list shows the peers found
+  apkg plan [-emit dockerfile|sh] [-full]  # Show the plan or render it as apk add lines / a curl+tar script
+  apkg explain-plan [-full]   # Show the plan with estimated download time, cache use and disk delta
+  apkg version [-repos]       # Show the apkg version and the release, commit and signer of every repo
+  apkg repo-diff [-summary] <old> <new>  # Compare two index snapshots (files or repos)
+  apkg repo-stats [index|repo...]  # Package counts and sizes of indexes (default: configured repos)
+  apkg stats network [-top 10] [-reset]  # Bytes fetched from the repos, peers and the cache over all runs
+  apkg status                 # Exit 0 if the system matches the config, 1 on drift, 2 on error
 
 Flags:
-  -config <file>   Path to config file (default: apkg.yaml)
-  -dry-run         Show what would be done, but don't modify anything
-  -v               Enable verbose output
+  -config <file>   Path or http(s) URL of the config file (default: apkg.yaml, apkg.toml or apkg.json), - reads it from stdin
+  -config-keyring <file>  Require a valid <config>.sig made by a key in this GPG keyring
+  -state-dir <dir> Where installed.yaml and the other state live (default: $APKG_STATE_DIR or .)
+  -dry-run         Show what would be done, but don't modify anything (exits 5 if changes are pending)
+  -v               Enable all debug output, same as -debug all
+  -debug <list>    Debug output of these subsystems only: config, http, index, cache, resolve, extract, install, tx or all
+  -json            Print a machine-readable summary on stdout, human output goes to stderr
+  -changed-exit-code <n>  Exit with n when the run changed the system
+  -fail-on-warn    Exit 6 when the run printed any warning (strict CI)
+  -4, -6           Only connect to mirrors over IPv4 or IPv6
+  -require-fresh <d>  Fail instead of using cached indexes older than d (e.g. 24h)
+  -low-memory      Keep peak memory low on small devices (single thread, aggressive GC)
+  -locked          Only install the exact package set recorded in apkg.lock
+  -lock-keyring <file>  Require a valid apkg.lock.sig made by a key in this GPG keyring
+  -write-lock      Write apkg.lock from the package set the apply resolved and installed, with their checksums
+  -with <groups>   Comma-separated optional groups to install on top of with_optional
+  -only-upgrade <pkgs>  Hold back upgrades of installed packages not in this comma-separated list, install or remove nothing
+  -allow-suid      Install new setuid/setgid files and file capabilities without review
+  -bundle-dir <dir>  Install from an extracted bundle without network access
+  -lang <lang>     Language of the messages (default: from LC_ALL, LC_MESSAGES or LANG)
+  -long            List one package per line with versions and sizes instead of terminal-wide columns
   -h, --help       Show this help message
 `)
 			os.Exit(0)
 		}
 		if args[0] == "list-installed" {
-			installedPkgs, _ := readInstalledPkgs("installed.yaml")
+			installedPkgs, _ := readInstalledPkgs(statePath("installed.yaml"))
 			if len(installedPkgs) == 0 {
-				fmt.Println("No packages installed.")
+				printf("No packages installed.\n")
 			} else {
-				fmt.Println("Installed packages:")
+				printf("Installed packages:\n")
+				width := terminalWidth()
+				var items []string
 				for name, ver := range installedPkgs {
-					fmt.Printf("  %s %s\n", name, ver)
+					if width > 0 {
+						items = append(items, name+"-"+ver)
+					} else {
+						items = append(items, name+" "+ver)
+					}
 				}
+				sort.Strings(items)
+				printColumns(os.Stdout, items, width)
 			}
 			os.Exit(0)
 		}
 		var cfg *Config
 		cfg, err = readConfig(*configPath)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "[FATAL] Failed to read config: %v\n", err)
+			eprintf("[FATAL] Failed to read config: %v\n", err)
 			os.Exit(1)
 		}
+		globalConfig = cfg
 		if *dryRun {
-			fmt.Println("[DRY-RUN] Subcommand execution skipped.")
+			printf("[DRY-RUN] Subcommand execution skipped.\n")
 			switch args[0] {
 			case "add":
 				if len(args) < 2 {
-					fmt.Fprintf(os.Stderr, "Usage: %s [flags] add <package>\n", os.Args[0])
+					eprintf("Usage: %s [flags] add <package>\n", os.Args[0])
 					os.Exit(1)
 				}
-				fmt.Printf("[DRY-RUN] Would add package '%s' to config '%s'.\n", args[1], *configPath)
+				if withSubpackages {
+					printf("[DRY-RUN] Would add package '%s' and its subpackages to config '%s'.\n", args[1], *configPath)
+				} else {
+					printf("[DRY-RUN] Would add package '%s' to config '%s'.\n", args[1], *configPath)
+				}
 			case "remove":
 				if len(args) < 2 {
-					fmt.Fprintf(os.Stderr, "Usage: %s [flags] remove <package>\n", os.Args[0])
+					eprintf("Usage: %s [flags] remove <package>\n", os.Args[0])
 					os.Exit(1)
 				}
-				fmt.Printf("[DRY-RUN] Would remove package '%s' from config '%s'.\n", args[1], *configPath)
+				if withSubpackages {
+					printf("[DRY-RUN] Would remove package '%s' and its subpackages from config '%s'.\n", args[1], *configPath)
+				} else {
+					printf("[DRY-RUN] Would remove package '%s' from config '%s'.\n", args[1], *configPath)
+				}
 			case "reinstall":
 				if len(args) < 2 {
-					fmt.Fprintf(os.Stderr, "Usage: %s [flags] reinstall <package>\n", os.Args[0])
+					eprintf("Usage: %s [flags] reinstall <package>\n", os.Args[0])
 					os.Exit(1)
 				}
-				fmt.Printf("[DRY-RUN] Would reinstall package '%s'.\n", args[1])
+				printf("[DRY-RUN] Would reinstall package '%s'.\n", args[1])
 			case "regen-indexes":
-				fmt.Println("[DRY-RUN] Would regenerate all file indexes.")
+				printf("[DRY-RUN] Would regenerate all file indexes.\n")
 			}
-			fmt.Println("[DRY-RUN] No changes made.")
+			printf("[DRY-RUN] No changes made.\n")
 			os.Exit(0)
 		}
 		if args[0] == "regen-indexes" {
-			installedPkgs, _ := readInstalledPkgs("installed.yaml")
+			if _, err := acquireRunLock(); err != nil {
+				eprintf("[FATAL] %v\n", err)
+				os.Exit(1)
+			}
+			installedPkgs, _ := readInstalledPkgs(statePath("installed.yaml"))
 			cfgPkgs := make(map[string]bool)
 			for _, p := range cfg.Packages {
 				cfgPkgs[p] = true
 			}
 			updatedPkgs := make(map[string]string)
+			workDir, err := newWorkDir("regen")
+			if err != nil {
+				eprintf("[FATAL] Failed to create temp dir: %v\n", err)
+				os.Exit(3)
+			}
 			for pkg, ver := range installedPkgs {
 				if !cfgPkgs[pkg] {
-					fmt.Printf("Removing %s from installed.yaml (not in config)\n", pkg)
+					printf("Removing %s from installed.yaml (not in config)\n", pkg)
 					continue
 				}
-				fmt.Printf("Regenerating file index for %s (%s)...\n", pkg, ver)
-				apkFile := "staged/" + pkg + "-" + ver + ".apk"
+				printf("Regenerating file index for %s (%s)...\n", pkg, ver)
+				apkFile := filepath.Join(workDir, pkg+"-"+ver+".apk")
 				// Find repo for this package
-				_, sourceRepo, err := fetchAndParseAllAPKIndexes(cfg.Repos)
+				pkgMap, sourceRepo, err := fetchAndParseAllAPKIndexes(cfg.Repos)
 				if err != nil {
-					fmt.Fprintf(os.Stderr, "[WARN] Could not fetch APKINDEX for regen: %v\n", err)
+					eprintf("[WARN] Could not fetch APKINDEX for regen: %v\n", err)
 					continue
 				}
 				repo, ok := sourceRepo[pkg]
 				if !ok {
-					fmt.Fprintf(os.Stderr, "[WARN] Could not find repo for %s\n", pkg)
+					eprintf("[WARN] Could not find repo for %s\n", pkg)
 					continue
 				}
-				apkURL := strings.TrimRight(repo, "/") + "/" + pkg + "-" + ver + ".apk"
-				fmt.Printf("[DEBUG] Downloading from: %s\n", apkURL)
-				err = downloadFile(apkURL, apkFile)
+				debugf("http", "Downloading %s from: %s", pkg+"-"+ver+".apk", repo)
+				_, err = sourceFor(repo).Fetch(pkg+"-"+ver+".apk", apkFile)
 				if err != nil {
-					fmt.Fprintf(os.Stderr, "[WARN] Failed to download %s: %v\n", pkg, err)
+					eprintf("[WARN] Failed to download %s: %v\n", pkg, err)
 					continue
 				}
-				tmpDir := "regen-staging-" + pkg
-				os.RemoveAll(tmpDir)
-				if err = extractApk(apkFile, tmpDir); err != nil {
-					fmt.Fprintf(os.Stderr, "[WARN] Failed to extract %s: %v\n", pkg, err)
+				tmpDir := filepath.Join(workDir, pkg)
+				// omitted.yaml isn't part of the package: it is kept if the extraction fails and
+				// rewritten from the filters otherwise
+				oldOmitted, _ := readOmittedFiles(pkg)
+				os.RemoveAll(installedControlPath(pkg))
+				var installedSize int64
+				if info := pkgMap[pkg]; info.Version == ver {
+					installedSize = info.InstalledSize
+				}
+				if err = extractApk(apkFile, tmpDir, installedControlPath(pkg), extractionLimits(repo, installedSize)); err != nil {
+					eprintf("[WARN] Failed to extract %s: %v\n", pkg, err)
+					writeOmittedFiles(pkg, oldOmitted)
 					os.Remove(apkFile)
 					continue
 				}
-				var files []string
-				_ = filepath.Walk(tmpDir, func(path string, info os.FileInfo, err error) error {
-					if err != nil {
-						return nil
-					}
-					rel, err := filepath.Rel(tmpDir, path)
-					if err != nil || rel == "." {
-						return nil
-					}
-					files = append(files, rel)
-					return nil
-				})
+				files, omitted := filteredFiles(packageOptions(pkg), tmpDir)
 				if err = writeInstalledFiles(pkg, files); err != nil {
-					fmt.Fprintf(os.Stderr, "[WARN] Failed to write index for %s: %v\n", pkg, err)
+					eprintf("[WARN] Failed to write index for %s: %v\n", pkg, err)
+				}
+				if err = writeOmittedFiles(pkg, omitted); err != nil {
+					eprintf("[WARN] Failed to record omitted files for %s: %v\n", pkg, err)
 				}
 				os.RemoveAll(tmpDir)
 				os.Remove(apkFile)
-				fmt.Printf("Regenerated index for %s (%d files)\n", pkg, len(files))
+				printf("Regenerated index for %s (%d files)\n", pkg, len(files))
 				updatedPkgs[pkg] = ver
 			}
-			if err = writeInstalledPkgs("installed.yaml", updatedPkgs); err != nil {
-				fmt.Fprintf(os.Stderr, "[WARN] Failed to update installed.yaml: %v\n", err)
+			cleanupTempDirs(workDir)
+			if err = writeInstalledPkgs(statePath("installed.yaml"), updatedPkgs); err != nil {
+				eprintf("[WARN] Failed to update installed.yaml: %v\n", err)
 			}
 			os.Exit(0)
 		}
 		if len(args) < 2 {
-			fmt.Fprintf(os.Stderr, "Usage: %s [flags] add|remove|reinstall <package>\n", os.Args[0])
+			eprintf("Usage: %s [flags] add|remove|reinstall <package>\n", os.Args[0])
 			os.Exit(1)
 		}
 		var err error
 		cfg, err = readConfig(*configPath)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "[FATAL] Failed to read config: %v\n", err)
+			eprintf("[FATAL] Failed to read config: %v\n", err)
 			os.Exit(1)
 		}
-		pkg := args[1]
+		// foo@<repo> pins the package to that repo
+		pkg, pin := splitPin(args[1])
 		changed := false
+		if pin != "" && args[0] == "add" && cfg.pins[pkg] != pin {
+			if cfg.pins == nil {
+				cfg.pins = map[string]string{}
+			}
+			cfg.pins[pkg] = pin
+			if err := validatePins(cfg); err != nil {
+				eprintf("[FATAL] %v\n", err)
+				os.Exit(1)
+			}
+			changed = true
+			printf("Pinned %s to %s.\n", pkg, pin)
+		}
+		// Packages upstream renamed are added under their new name
+		if _, ok := cfg.alias(pkg); ok && args[0] == "add" {
+			if pkgMap, _, err := fetchAndParseAllAPKIndexes(cfg.Repos); err == nil {
+				if to := resolveAlias(cfg, pkg, pkgMap); to != pkg {
+					printf("%s was renamed to %s.\n", pkg, to)
+					pkg = to
+				}
+			}
+		}
+		pkgs := []string{pkg}
+		if withSubpackages && (args[0] == "add" || args[0] == "remove") {
+			pkgs, err = originFamily(cfg.Repos, pkg)
+			if err != nil {
+				eprintf("[FATAL] %v\n", err)
+				os.Exit(1)
+			}
+		}
 		if args[0] == "add" {
-			for _, p := range cfg.Packages {
-				if p == pkg {
-					fmt.Printf("%s is already in the package list.\n", pkg)
-					os.Exit(0)
+			for _, pkg := range pkgs {
+				already := false
+				for _, p := range cfg.Packages {
+					if p == pkg {
+						already = true
+						break
+					}
+				}
+				if already {
+					printf("%s is already in the package list.\n", pkg)
+					continue
 				}
+				cfg.Packages = append(cfg.Packages, pkg)
+				changed = true
+				printf("Added %s to package list.\n", pkg)
 			}
-			cfg.Packages = append(cfg.Packages, pkg)
-			changed = true
-			fmt.Printf("Added %s to package list.\n", pkg)
 		} else if args[0] == "remove" {
+			drop := map[string]bool{}
+			for _, pkg := range pkgs {
+				drop[pkg] = true
+			}
 			newPkgs := []string{}
-			found := false
+			found := map[string]bool{}
 			for _, p := range cfg.Packages {
-				if p == pkg {
-					found = true
+				if drop[p] {
+					found[p] = true
 					continue
 				}
 				newPkgs = append(newPkgs, p)
 			}
-			if found {
+			for _, pkg := range pkgs {
+				if found[pkg] {
+					printf("Removed %s from package list.\n", pkg)
+				} else if !withSubpackages {
+					printf("%s was not in the package list.\n", pkg)
+				}
+			}
+			if len(found) > 0 {
 				cfg.Packages = newPkgs
 				changed = true
-				fmt.Printf("Removed %s from package list.\n", pkg)
-			} else {
-				fmt.Printf("%s was not in the package list.\n", pkg)
 			}
 		} else if args[0] == "reinstall" {
 			// Remove from installed.yaml and installed_files, but keep in config
-			fmt.Printf("Reinstalling %s...\n", pkg)
+			printf("Reinstalling %s...\n", pkg)
 			// Remove installed files if present
-			installedPkgs, _ := readInstalledPkgs("installed.yaml")
+			installedPkgs, _ := readInstalledPkgs(statePath("installed.yaml"))
 			if ver, ok := installedPkgs[pkg]; ok {
 				// Find repo for this package
 				_, sourceRepo, err := fetchAndParseAllAPKIndexes(cfg.Repos)
@@ -377,10 +956,30 @@ Flags:
 				if err == nil {
 					repo = sourceRepo[pkg]
 				}
-				if err := uninstallPackage(pkg, ver, repo, cfg.InstallDir); err != nil {
-					fmt.Fprintf(os.Stderr, "[WARN] Failed to uninstall %s: %v\n", pkg, err)
+				// The lock is released by the re-exec below, which takes it again
+				if _, err := acquireRunLock(); err != nil {
+					eprintf("[FATAL] %v\n", err)
+					os.Exit(1)
+				}
+				if err := recoverTransactions(); err != nil {
+					eprintf("[FATAL] Failed to recover interrupted transactions: %v\n", err)
+					os.Exit(4)
+				}
+				tx, err := beginTransaction(cfg.InstallDir)
+				if err != nil {
+					eprintf("[FATAL] Failed to start transaction: %v\n", err)
+					os.Exit(4)
+				}
+				if err := uninstallPackage(pkg, ver, repo, cfg.InstallDir, tx); err != nil {
+					eprintf("[WARN] Failed to uninstall %s: %v\n", pkg, err)
+					if err := tx.rollback(); err != nil {
+						eprintf("[ERROR] Rollback failed: %v\n", err)
+					}
 				} else {
-					fmt.Printf("Uninstalled %s (%s)\n", pkg, ver)
+					if err := tx.commit(); err != nil {
+						eprintf("[WARN] Failed to clean up transaction %s: %v\n", tx.ID, err)
+					}
+					printf("Uninstalled %s (%s)\n", pkg, ver)
 				}
 			}
 			// Ensure it's in the config
@@ -394,23 +993,16 @@ Flags:
 			if !found {
 				cfg.Packages = append(cfg.Packages, pkg)
 				changed = true
-				fmt.Printf("Added %s to package list.\n", pkg)
+				printf("Added %s to package list.\n", pkg)
 			}
 			changed = true // always reinstall
 		}
 		if changed {
-			f, err := os.Create(*configPath)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "[FATAL] Failed to write config: %v\n", err)
-				os.Exit(1)
-			}
-			defer f.Close()
-			enc := yaml.NewEncoder(f)
-			if err := enc.Encode(cfg); err != nil {
-				fmt.Fprintf(os.Stderr, "[FATAL] Failed to encode config: %v\n", err)
+			if err := writeConfig(*configPath, cfg); err != nil {
+				eprintf("[FATAL] Failed to write config: %v\n", err)
 				os.Exit(1)
 			}
-			fmt.Println("Config updated. Applying changes...")
+			printf("Config updated. Applying changes...\n")
 			// Re-run main logic to apply install/uninstall, but drop subcommand args
 			newArgs := []string{os.Args[0]}
 			for _, a := range os.Args[1:] {
@@ -421,33 +1013,127 @@ Flags:
 			}
 			err = syscall.Exec(os.Args[0], newArgs, os.Environ())
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "[FATAL] Failed to re-exec: %v\n", err)
+				eprintf("[FATAL] Failed to re-exec: %v\n", err)
 				os.Exit(1)
 			}
 		}
 		os.Exit(0)
 	}
 
+	startedOn := time.Now()
 	cfg, err := readConfig(*configPath)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "[FATAL] Failed to read config: %v\n", err)
+		eprintf("[FATAL] Failed to read config: %v\n", err)
 		os.Exit(1)
 	}
 	globalConfig = cfg
-	if *verbose {
-		fmt.Println("Using repos:", cfg.Repos)
-		fmt.Println("Packages to install:", cfg.Packages)
+	applyUmask(cfg)
+	applyLowMemory(cfg)
+	enableIndexFilter(cfg)
+	if err := loadBase(cfg); err != nil {
+		eprintf("[FATAL] %v\n", err)
+		os.Exit(1)
+	}
+	if err := validateExcludeProfiles(cfg); err != nil {
+		eprintf("[FATAL] %v\n", err)
+		os.Exit(1)
+	}
+	if cfg.Userns {
+		if err := enterUserNamespace(); err != nil {
+			eprintf("[FATAL] Failed to enter a user namespace: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	// A sandbox that was asked for and can't be set up fails the run rather than running unrestricted
+	if cfg.Sandbox {
+		if err := sandboxApply(cfg, *configPath); err != nil {
+			eprintf("[FATAL] Failed to sandbox the apply: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if cfg.Channel != "" {
+		ok, err := channelAllows(cfg, *configPath)
+		if err != nil {
+			eprintf("[FATAL] %v\n", err)
+			os.Exit(1)
+		}
+		if !ok {
+			finishRun(newRunResult(&Plan{}, *dryRun, false))
+			return
+		}
+		*locked = true // a channel promotes an exact package set
+	}
+	if !*dryRun {
+		if _, err := acquireRunLock(); err != nil {
+			eprintf("[FATAL] %v\n", err)
+			os.Exit(1)
+		}
+		cleanStaleTempDirs(staleTempMinAge)
+		recoverFn := recoverTransactions
+		if resumeRun {
+			recoverFn = func() error { return resumeTransactions(cfg.InstallDir, statePath("installed.yaml")) }
+		}
+		if err := recoverFn(); err != nil {
+			eprintf("[FATAL] Failed to recover interrupted transactions: %v\n", err)
+			os.Exit(4)
+		}
+	}
+	debugf("config", "Using repos: %v", cfg.Repos)
+	debugf("config", "Packages to install: %v", cfg.Packages)
+
+	// A run with the same config, indexes and installed packages as the last one that
+	// found nothing to change can skip parsing and resolution altogether
+	var resolveKey string
+	if cfg.ResolveCache && len(resumedPkgs) == 0 && !*writeLock {
+		key, err := resolveCacheKey(*configPath, cfg, *locked)
+		if err != nil {
+			debugf("resolve", "Not using the resolve cache: %v", err)
+		} else if key == readResolveCache() {
+			printf("Config, indexes and installed packages are unchanged since the last converged run.\n")
+			(&Plan{}).print()
+			finishRun(newRunResult(&Plan{}, *dryRun, false))
+			return
+		}
+		resolveKey = key
 	}
 
 	// 1. Fetch and parse APKINDEX from all repos
-	fmt.Println("Fetching APKINDEX from all repos...")
-	pkgMap, sourceRepo, err := fetchAndParseAllAPKIndexes(cfg.Repos)
+	printf("Fetching APKINDEX from all repos...\n")
+	printTrust(cfg.Repos)
+	pkgMap, sourceRepo := map[string]APKPackage{}, map[string]string{}
+	if len(cfg.Repos) > 0 {
+		pkgMap, sourceRepo, err = fetchAndParseAllAPKIndexes(cfg.Repos)
+		if err != nil {
+			eprintf("[FATAL] Error fetching APKINDEX: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	// Every run stages into its own unique temp dir so concurrent builds don't collide
+	workDir, err := newWorkDir("run")
+	if err != nil {
+		eprintf("[FATAL] Failed to create temp dir: %v\n", err)
+		os.Exit(3)
+	}
+	stagedDir := filepath.Join(workDir, "staged")
+	stagingDir := filepath.Join(workDir, "staging")
+	if err := os.MkdirAll(stagedDir, 0755); err != nil {
+		eprintf("[FATAL] Failed to create staged dir: %v\n", err)
+		os.Exit(3)
+	}
+	if err := os.MkdirAll(stagingDir, 0755); err != nil {
+		eprintf("[FATAL] Failed to create staging dir: %v\n", err)
+		os.Exit(3)
+	}
+	// .apk URLs and paths in the packages list bypass the repos, they are fetched up front to learn their name and version
+	directPkgs, err := resolveDirectPackages(cfg, pkgMap, sourceRepo, stagedDir)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "[FATAL] Error fetching APKINDEX: %v\n", err)
+		eprintf("[FATAL] Failed to fetch package: %v\n", err)
+		cleanupTempDirs(workDir)
 		os.Exit(2)
 	}
 
-	installedPkgsPath := "installed.yaml"
+	installedPkgsPath := statePath("installed.yaml")
 	installedPkgs, _ := readInstalledPkgs(installedPkgsPath)
 	updatedPkgs := make(map[string]string)
 	for k, v := range installedPkgs {
@@ -455,306 +1141,475 @@ Flags:
 	}
 
 	// Dependency resolution
-	installSet := map[string]struct{}{}
-	var resolveDeps bool = cfg.ResolveDeps
-	var addWithDeps func(string)
-	addWithDeps = func(pkg string) {
-		if _, ok := installSet[pkg]; ok {
-			return
-		}
-		installSet[pkg] = struct{}{}
-		if resolveDeps {
-			info, ok := pkgMap[pkg]
-			if ok {
-				for _, dep := range info.Deps {
-					if dep != "" && dep != pkg {
-						addWithDeps(dep)
-					}
-				}
-			}
+	toInstall, err := resolveInstallSet(cfg, pkgMap, sourceRepo)
+	if err != nil {
+		eprintf("[FATAL] %v\n", err)
+		explainResolveError(err, cfg, pkgMap, sourceRepo)
+		cleanupTempDirs(workDir)
+		os.Exit(1)
+	}
+	toInstall = holdUpgrades(toInstall, pkgMap, installedPkgs)
+	plan := computePlan(cfg, pkgMap, installedPkgs, toInstall)
+	if lowMemory {
+		prunePkgMap(pkgMap, sourceRepo, toInstall, installedPkgs)
+	}
+	if *locked {
+		if err := enforceLockfile(*configPath, pkgMap, sourceRepo, toInstall, plan.Overrides); err != nil {
+			eprintf("[FATAL] %v\n", err)
+			cleanupTempDirs(workDir)
+			os.Exit(1)
 		}
 	}
-	for _, pkg := range cfg.Packages {
-		addWithDeps(pkg)
+	if err := checkBundleBase(toInstall, pkgMap, installedPkgs); err != nil {
+		eprintf("[FATAL] %v\n", err)
+		cleanupTempDirs(workDir)
+		os.Exit(1)
 	}
-	toInstall := []string{}
-	for pkg := range installSet {
-		toInstall = append(toInstall, pkg)
+	if plan.Empty() && resolveKey != "" {
+		if err := writeResolveCache(resolveKey); err != nil {
+			eprintf("[WARN] Failed to update %s: %v\n", resolveCacheFile, err)
+		}
 	}
 	for _, pkg := range toInstall {
 		info, ok := pkgMap[pkg]
 		if !ok {
+			explainMissingPackage(cfg, pkg, pkgMap, sourceRepo)
 			continue
 		}
 		curVer, already := installedPkgs[pkg]
 		if already {
 			if curVer == info.Version {
-				fmt.Printf("%s (%s) is already installed. Skipping.\n", pkg, curVer)
+				printf("%s (%s) is already installed. Skipping.\n", pkg, curVer)
 				continue
 			} else {
-				fmt.Printf("%s: upgrading from %s to %s\n", pkg, curVer, info.Version)
+				printf("%s: upgrading from %s to %s\n", pkg, curVer, info.Version)
 			}
 		} else {
-			fmt.Printf("%s (%s) will be installed.\n", pkg, info.Version)
+			printf("%s (%s) will be installed.\n", pkg, info.Version)
 		}
 		updatedPkgs[pkg] = info.Version
 	}
 
 	// Only download and extract packages that need install/upgrade
 	if *dryRun {
-		fmt.Println("[DRY-RUN] The following changes would be made:")
-		// Packages to install/upgrade
-		installationsFound := false
-		for _, pkg := range toInstall {
-			info, ok := pkgMap[pkg]
-			if !ok {
-				continue
-			}
-			curVer, already := installedPkgs[pkg]
-			if already {
-				if curVer != info.Version {
-					fmt.Printf("  - Upgrade %s from %s to %s\n", pkg, curVer, info.Version)
-					installationsFound = true
-				}
-			} else {
-				fmt.Printf("  - Install %s (%s)\n", pkg, info.Version)
-				installationsFound = true
-			}
+		printf("[DRY-RUN] The following changes would be made:\n")
+		plan.print()
+		printf("[DRY-RUN] No changes made.\n")
+		cleanupTempDirs(workDir)
+		finishRun(newRunResult(plan, true, false))
+		if !plan.Empty() {
+			os.Exit(exitChangesPending)
 		}
-
-		// Packages to uninstall
-		uninstallsFound := false
-		configPkgs := map[string]struct{}{}
-		for _, p := range cfg.Packages {
-			configPkgs[p] = struct{}{}
-		}
-		for pkg, ver := range installedPkgs {
-			if _, found := configPkgs[pkg]; !found {
-				fmt.Printf("  - Uninstall %s (%s)\n", pkg, ver)
-				uninstallsFound = true
-			}
-		}
-
-		if !installationsFound && !uninstallsFound {
-			fmt.Println("System is already up to date with the configuration.")
-		}
-		fmt.Println("[DRY-RUN] No changes made.")
 		return
 	}
-	if err := os.MkdirAll("staged", 0755); err != nil {
-		fmt.Fprintf(os.Stderr, "[FATAL] Failed to create staged dir: %v\n", err)
-		os.Exit(3)
-	}
-	if err := os.MkdirAll("staging-2", 0755); err != nil {
-		fmt.Fprintf(os.Stderr, "[FATAL] Failed to create staging-2 dir: %v\n", err)
-		os.Exit(3)
-	}
+	// In streaming mode packages go from the download straight into the install root
+	var stagedPkgs, streamedPkgs []string
 	for _, pkg := range toInstall {
+		if bundleOmits(pkg, pkgMap, installedPkgs) {
+			continue // a differential bundle leaves the installed copy in place
+		}
+		if _, ok := pkgMap[pkg]; ok && directPkgs[pkg] == "" && canStream(cfg, sourceRepo[pkg]) {
+			streamedPkgs = append(streamedPkgs, pkg)
+		} else {
+			stagedPkgs = append(stagedPkgs, pkg)
+		}
+	}
+	gateSuid(plan)
+	var privileged []PrivilegedFile
+	pkgDigests := make(map[string]string)
+	for _, pkg := range stagedPkgs {
 		info, ok := pkgMap[pkg]
 		if !ok {
 			continue
 		}
-		repo, ok := sourceRepo[pkg]
-		if !ok {
-			fmt.Fprintf(os.Stderr, "[ERROR] No repo found for %s\n", pkg)
-			continue
+		ok, err := runPackageStep(pkg, "download", nil, func() error {
+			stagedPath, direct := directPkgs[pkg]
+			pkgDigests[pkg] = info.SHA256
+			if !direct {
+				repo, ok := sourceRepo[pkg]
+				if !ok {
+					return fmt.Errorf(T("no repo found for %s"), pkg)
+				}
+				stagedPath = filepath.Join(stagedDir, info.Filename)
+				printf("Downloading %s (%s) from %s\n", info.Name, info.Version, repo)
+				sum, err := fetchPackage(repo, info, stagedPath)
+				if err != nil {
+					return fmt.Errorf("failed to download %s: %w", info.Name, err)
+				}
+				pkgDigests[pkg] = sum
+			}
+			if err := checkLockedSum(pkg, pkgDigests[pkg]); err != nil {
+				return err
+			}
+			printf("Staged: %s\n", stagedPath)
+			var files []PrivilegedFile
+			if cur, ok := installedPkgs[pkg]; !ok || cur != info.Version {
+				var err error
+				if files, err = scanPrivileged(pkg, stagedPath); err != nil {
+					return fmt.Errorf(T("failed to audit %s: %w"), info.Name, err)
+				}
+			}
+
+			// Extract .apk (tar.gz) into the staging dir
+			pkgStagingPath := filepath.Join(stagingDir, pkg)
+			os.RemoveAll(pkgStagingPath)
+			if err := extractApk(stagedPath, pkgStagingPath, controlStagingPath(stagingDir, pkg), extractionLimits(sourceRepo[pkg], info.InstalledSize)); err != nil {
+				return fmt.Errorf("failed to extract %s: %w", info.Name, err)
+			}
+			if err := scanPackage(stagingDir, pkg); err != nil {
+				return err
+			}
+			privileged = append(privileged, files...)
+			printf("Extracted %s to %s\n", info.Filename, pkgStagingPath)
+			return nil
+		})
+		if err != nil {
+			eprintf("[FATAL] %v\n", err)
+			cleanupTempDirs(workDir)
+			os.Exit(4)
 		}
-		apkURL := strings.TrimRight(repo, "/") + "/" + info.Filename
-		stagedPath := "staged/" + info.Filename
-		fmt.Printf("Downloading %s (%s) from %s\n", info.Name, info.Version, apkURL)
-		if err := downloadFile(apkURL, stagedPath); err != nil {
-			fmt.Fprintf(os.Stderr, "[ERROR] Failed to download %s: %v\n", info.Name, err)
-			continue
+		if !ok {
+			delete(pkgDigests, pkg)
 		}
-		fmt.Printf("Staged: %s\n", stagedPath)
+	}
+	stagedPkgs = withoutFailed(stagedPkgs)
+	dropFailedPackages(plan, updatedPkgs, installedPkgs)
+	if err := scanStaged(stagingDir, stagedPkgs); err != nil {
+		eprintf("[FATAL] %v\n", err)
+		cleanupTempDirs(workDir)
+		os.Exit(4)
+	}
+	if err := reportPrivileged(privileged); err != nil {
+		eprintf("[FATAL] %v\n", err)
+		cleanupTempDirs(workDir)
+		os.Exit(1)
+	}
 
-		// Extract .apk (tar.gz) into staging-2
-		if err := extractApk(stagedPath, "staging-2/"+pkg); err != nil {
-			fmt.Fprintf(os.Stderr, "[ERROR] Failed to extract %s: %v\n", info.Name, err)
-			continue
+	// With generations the apply builds a new root next to the active one and install_dir
+	// is only switched over once everything succeeded
+	linkDir, generation, activeGen := cfg.InstallDir, 0, 0
+	if cfg.Generations && cfg.Install && !plan.Empty() {
+		var root string
+		generation, root, err = beginGeneration(linkDir)
+		if err != nil {
+			eprintf("[FATAL] %v\n", err)
+			cleanupTempDirs(workDir)
+			os.Exit(4)
 		}
-		fmt.Printf("Extracted %s to staging-2/%s\n", info.Filename, pkg)
+		activeGen = activeGeneration(linkDir)
+		cfg.InstallDir = root
 	}
-
+	var services []Service
 	if cfg.Install {
-		if err := installPackages(toInstall, "staging-2", cfg.InstallDir); err != nil {
-			fmt.Fprintf(os.Stderr, "[FATAL] Install failed: %v\n", err)
+		tx, err := beginTransaction(cfg.InstallDir)
+		if err != nil {
+			eprintf("[FATAL] Failed to start transaction: %v\n", err)
+			cleanupTempDirs(workDir)
+			if generation != 0 {
+				abortGeneration(activeGen, generation)
+			}
+			os.Exit(4)
+		}
+		err = installPackages(stagedPkgs, stagingDir, cfg.InstallDir, tx)
+		var streamedDigests map[string]string
+		if err == nil {
+			streamedDigests, err = installStreamedPackages(streamedPkgs, pkgMap, sourceRepo, stagingDir, cfg.InstallDir, tx)
+		}
+		if err != nil {
+			eprintf("[FATAL] Install failed: %v\n", err)
+			if err := tx.rollback(); err != nil {
+				eprintf("[ERROR] Rollback failed, run apkg again to retry: %v\n", err)
+			} else {
+				eprintf("Rolled back all changes.\n")
+			}
+			cleanupTempDirs(workDir)
+			if generation != 0 {
+				abortGeneration(activeGen, generation)
+			}
 			os.Exit(4)
 		} else {
-			fmt.Printf("All packages installed to %s\n", cfg.InstallDir)
+			dropFailedPackages(plan, updatedPkgs, installedPkgs)
+			var changedPkgs []string
+			for _, list := range [][]PlanItem{plan.Installs, plan.Upgrades} {
+				for _, it := range list {
+					changedPkgs = append(changedPkgs, it.Name)
+				}
+			}
+			// Packages a resumed transaction kept haven't had their hooks yet
+			for _, pkg := range resumedPkgs {
+				if _, ok := updatedPkgs[pkg]; ok && !slices.Contains(changedPkgs, pkg) {
+					changedPkgs = append(changedPkgs, pkg)
+				}
+			}
+			// Stripping changes file contents, so it has to happen before deduplication
+			runStrip(cfg, tx, changedPkgs)
+			// The files of upgraded packages before and after, either may have certificates
+			var changedFiles []string
+			for _, pkg := range changedPkgs {
+				old, _ := readInstalledFiles(pkg)
+				changedFiles = append(append(changedFiles, old...), tx.packageFiles(pkg)...)
+			}
+			runCACertsHook(cfg, tx, changedFiles)
+			if err := pruneKernels(cfg, tx, changedPkgs, nil, updatedPkgs); err != nil {
+				eprintf("[WARN] Failed to prune previous kernels: %v\n", err)
+			}
+			if err := tx.commit(); err != nil {
+				eprintf("[WARN] Failed to clean up transaction %s: %v\n", tx.ID, err)
+			}
+			printf("All packages installed to %s\n", cfg.InstallDir)
 			if err := writeInstalledPkgs(installedPkgsPath, updatedPkgs); err != nil {
-				fmt.Fprintf(os.Stderr, "[WARN] Failed to update installed.yaml: %v\n", err)
+				eprintf("[WARN] Failed to update installed.yaml: %v\n", err)
+			}
+			runDedupe(cfg, updatedPkgs)
+			runKernelHooks(cfg, changedPkgs)
+			runLibraryCacheHook(cfg, changedPkgs, updatedPkgs)
+			services = findServices(cfg.InstallDir, changedPkgs)
+			printServiceSummary(services)
+			for pkg, sum := range streamedDigests {
+				pkgDigests[pkg] = sum
 			}
-			cleanupTempDirs()
+			cleanupTempDirs(workDir)
 		}
 	} else {
-		fmt.Println("Install step skipped (install: false in config)")
+		printf("Install step skipped (install: false in config), packages are staged in %s\n", stagingDir)
 	}
 
-	// Uninstall packages that are no longer in the config
-	toUninstall := []string{}
-	for pkg := range installedPkgs {
-		found := false
-		for _, want := range cfg.Packages {
-			if pkg == want {
-				found = true
-				break
+	// Uninstall packages that are no longer in the config or needed by it
+	toUninstall := removedPackages(cfg, installedPkgs, toInstall)
+	if len(toUninstall) > 0 {
+		if err := uninstallRemoved(cfg, toUninstall, installedPkgs, updatedPkgs, sourceRepo, installedPkgsPath); err != nil {
+			if generation != 0 {
+				abortGeneration(activeGen, generation)
 			}
+			os.Exit(4)
 		}
-		if !found {
-			toUninstall = append(toUninstall, pkg)
+	}
+	if generation != 0 {
+		if err := finishGeneration(linkDir, generation); err != nil {
+			eprintf("[FATAL] Failed to switch to generation %d: %v\n", generation, err)
+			abortGeneration(activeGen, generation)
+			os.Exit(4)
 		}
 	}
-	for _, pkg := range toUninstall {
-		ver := installedPkgs[pkg]
-		repo := ""
-		if sourceRepo != nil {
-			repo = sourceRepo[pkg]
+	if *writeLock {
+		path := lockfilePath(*configPath)
+		if err := writeAppliedLock(path, cfg, pkgMap, sourceRepo, toInstall, pkgDigests); err != nil {
+			eprintf("[FATAL] Failed to write %s: %v\n", path, err)
+			os.Exit(1)
 		}
-		if err := uninstallPackage(pkg, ver, repo, cfg.InstallDir); err != nil {
-			fmt.Fprintf(os.Stderr, "[ERROR] Failed to uninstall %s: %v\n", pkg, err)
+		printf("Locked the installed packages in %s\n", path)
+	}
+	if cfg.Provenance != "" && cfg.Install {
+		if err := writeProvenance(cfg, *configPath, pkgMap, sourceRepo, pkgDigests, startedOn); err != nil {
+			eprintf("[WARN] Failed to write provenance: %v\n", err)
 		} else {
-			fmt.Printf("Uninstalled %s (%s)\n", pkg, ver)
-			delete(updatedPkgs, pkg)
-			if err := writeInstalledPkgs(installedPkgsPath, updatedPkgs); err != nil {
-				fmt.Fprintf(os.Stderr, "[WARN] Failed to update installed.yaml after uninstall: %v\n", err)
-			}
+			printf("Provenance written to %s\n", cfg.Provenance)
 		}
 	}
-}
-
-// extractApk extracts a .apk (tar.gz) file to the given directory
-func extractApk(apkPath, destDir string) error {
-	f, err := os.Open(apkPath)
+	finalPkgs, err := readInstalledPkgs(installedPkgsPath)
 	if err != nil {
-		return err
+		finalPkgs = installedPkgs
 	}
-	defer f.Close()
+	result := outcomeResult(plan, installedPkgs, finalPkgs)
+	result.Services = services
+	finishRun(result)
+	if result.Changed && *changedExitCode != 0 {
+		os.Exit(*changedExitCode)
+	}
+}
 
-	gz, err := gzip.NewReader(f)
+// uninstallRemoved uninstalls packages that are no longer in the config in one transaction,
+// installed.yaml is only rewritten once it commits. All removals are rolled back when one
+// fails, the error has been reported by then.
+func uninstallRemoved(cfg *Config, toUninstall []string, installedPkgs, updatedPkgs, sourceRepo map[string]string, installedPkgsPath string) error {
+	tx, err := beginTransaction(cfg.InstallDir)
 	if err != nil {
+		eprintf("[FATAL] Failed to start transaction: %v\n", err)
 		return err
 	}
-	defer gz.Close()
-
-	tr := tar.NewReader(gz)
-	skipNames := []string{
-		".PKGINFO", ".post-install", ".post-upgrade", ".pre-deinstall", ".trigger",
-	}
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return err
-		}
-		name := hdr.Name
-		// Skip unwanted files
-		skip := false
-		for _, s := range skipNames {
-			if name == s || strings.HasPrefix(name, s+"/") {
-				skip = true
-				break
-			}
-		}
-		if strings.HasPrefix(name, ".SIGN.RSA-") {
-			skip = true
-		}
-		if strings.HasSuffix(name, ".pub") {
-			skip = true
-		}
-		if skip {
-			continue
+	for _, pkg := range toUninstall {
+		ver := installedPkgs[pkg]
+		repo := ""
+		if sourceRepo != nil {
+			repo = sourceRepo[pkg]
 		}
-		target := filepath.Join(destDir, name)
-		switch hdr.Typeflag {
-		case tar.TypeDir:
-			if err := os.MkdirAll(target, 0755); err != nil {
-				return err
-			}
-		case tar.TypeReg:
-			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
-				return err
-			}
-			out, err := os.Create(target)
-			if err != nil {
-				return err
-			}
-			if _, err := io.Copy(out, tr); err != nil {
-				out.Close()
-				return err
+		if err := uninstallPackage(pkg, ver, repo, cfg.InstallDir, tx); err != nil {
+			eprintf("[ERROR] Failed to uninstall %s: %v\n", pkg, err)
+			if err := tx.rollback(); err != nil {
+				eprintf("[ERROR] Rollback failed, run apkg again to retry: %v\n", err)
+			} else {
+				eprintf("Rolled back all removals.\n")
 			}
-			out.Close()
+			return err
 		}
+		delete(updatedPkgs, pkg)
+	}
+	var removedFiles []string
+	for _, pkg := range toUninstall {
+		files, _ := readInstalledFiles(pkg)
+		removedFiles = append(removedFiles, files...)
+	}
+	runCACertsHook(cfg, tx, removedFiles)
+	if err := pruneKernels(cfg, tx, nil, toUninstall, updatedPkgs); err != nil {
+		eprintf("[WARN] Failed to prune previous kernels: %v\n", err)
+	}
+	if err := tx.commit(); err != nil {
+		eprintf("[WARN] Failed to clean up transaction %s: %v\n", tx.ID, err)
+	}
+	for _, pkg := range toUninstall {
+		printf("Uninstalled %s (%s)\n", pkg, installedPkgs[pkg])
+	}
+	if err := writeInstalledPkgs(installedPkgsPath, updatedPkgs); err != nil {
+		eprintf("[WARN] Failed to update installed.yaml after uninstall: %v\n", err)
 	}
 	return nil
 }
 
 // installPackages copies files from stagingDir/pkg to installDir for each package, preserving structure and permissions.
-func installPackages(pkgs []string, stagingDir, installDir string) error {
+// Every change is journaled in tx, the installed files index is only written once tx commits.
+func installPackages(pkgs []string, stagingDir, installDir string, tx *Transaction) error {
+	var omittedCount, omittedBytes int64
 	for _, pkg := range pkgs {
-		pkgStagingPath := filepath.Join(stagingDir, pkg)
-		var installedFiles []string
-		err := filepath.Walk(pkgStagingPath, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			relPath, err := filepath.Rel(pkgStagingPath, path)
-			if err != nil || relPath == "." {
+		_, err := runPackageStep(pkg, "install", tx, func() error {
+			count, size, err := installPackage(pkg, stagingDir, installDir, tx)
+			omittedCount += count
+			omittedBytes += size
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to install package %s: %w", pkg, err)
+		}
+	}
+	if omittedCount > 0 {
+		printf("Path exclusions saved %s (%d files)\n", humanSize(omittedBytes), omittedCount)
+	}
+	return nil
+}
+
+// installPackage copies the staged files of pkg to installDir within tx, returning the
+// number and size of the files path filters left out
+func installPackage(pkg, stagingDir, installDir string, tx *Transaction) (int64, int64, error) {
+	var omittedCount, omittedBytes int64
+	pkgStagingPath := filepath.Join(stagingDir, pkg)
+	tx.setPackage(pkg)
+	opts := packageOptions(pkg)
+	var installedFiles []string
+	var omittedFiles []string
+	var altPaths []string
+	var modes dirModes
+	err := filepath.Walk(pkgStagingPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := checkPackageDeadline(); err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(pkgStagingPath, path)
+		if err != nil || relPath == "." {
+			return nil
+		}
+		if info.IsDir() {
+			if opts.hasPathFilters() {
+				// Only create the directories filtered files end up in
 				return nil
 			}
-			targetPath := filepath.Join(installDir, relPath)
-			if info.IsDir() {
-				return os.MkdirAll(targetPath, info.Mode())
-			}
-			srcFile, err := os.Open(path)
-			if err != nil {
+			target := installPath(installDir, opts.relocate(relPath))
+			if err := tx.mkdirAll(opts.relocate(relPath), dirMode()); err != nil {
 				return err
 			}
-			defer srcFile.Close()
-			dstFile, err := os.OpenFile(targetPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode())
-			if err != nil {
+			modes.add(target, info.Mode())
+			return chownLike(target, info)
+		}
+		if !opts.wantsPath(relPath) {
+			omittedFiles = append(omittedFiles, relPath)
+			omittedCount++
+			omittedBytes += info.Size()
+			return nil
+		}
+		// Filters match the paths of the package, everything else works on the installed ones
+		relPath = opts.relocate(relPath)
+		targetPath := installPath(installDir, relPath)
+		if opts.hasPathFilters() {
+			if err := tx.mkdirAll(filepath.Dir(relPath), dirMode()); err != nil {
 				return err
 			}
-			defer dstFile.Close()
-			_, err = io.Copy(dstFile, srcFile)
-			if err == nil {
-				installedFiles = append(installedFiles, relPath)
-			}
+		}
+		if isAlternativePath(relPath) {
+			// Divert the file so other providers can coexist, the shared path becomes a symlink
+			altPaths = append(altPaths, relPath)
+			relPath = alternativeTarget(relPath, pkg)
+			targetPath = installPath(installDir, relPath)
+		} else if !tx.claimFile(relPath, stagingDir) {
+			return nil
+		}
+		if err := tx.prepareWrite(relPath); err != nil {
 			return err
-		})
+		}
+		debugf("install", "%s: %s (%d bytes)", pkg, targetPath, info.Size())
+		srcFile, err := os.Open(path)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "[ERROR] Failed to copy files for package %s: %v\n", pkg, err)
-			return fmt.Errorf("failed to install package %s: %w", pkg, err)
+			return err
+		}
+		defer srcFile.Close()
+		dstFile, err := os.OpenFile(targetPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode())
+		if err != nil {
+			return err
+		}
+		defer dstFile.Close()
+		_, err = io.Copy(dstFile, srcFile)
+		if err == nil {
+			err = chownLike(targetPath, info)
 		}
-		if err := writeInstalledFiles(pkg, installedFiles); err != nil {
-			fmt.Fprintf(os.Stderr, "[WARN] Failed to record installed files for %s: %v\n", pkg, err)
+		if err == nil {
+			err = os.Chmod(targetPath, archiveMode(info.Mode()))
 		}
-		fmt.Printf("Installed package: %s to %s\n", pkg, installDir)
+		if err == nil {
+			installedFiles = append(installedFiles, relPath)
+		}
+		return err
+	})
+	if err == nil {
+		err = modes.apply()
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf(T("failed to copy files: %w"), err)
+	}
+	finishPackage(pkg, stagingDir, installDir, tx, installedFiles, omittedFiles, altPaths)
+	return omittedCount, omittedBytes, nil
+}
 
-		// Script handling: look for known scripts and run or log
-		scriptNames := []string{".post-install", ".pre-deinstall", ".post-upgrade"}
-		for _, script := range scriptNames {
-			scriptPath := filepath.Join(pkgStagingPath, script)
-			if _, err := os.Stat(scriptPath); err == nil {
-				if globalConfig != nil && globalConfig.RunScripts {
-					fmt.Printf("Would run script: %s\n", scriptPath)
-					// Here you would actually run the script if not in test-root
-				} else {
-					fmt.Fprintf(os.Stderr, "[WARN] Script present but not run (run_scripts: false): %s\n", scriptPath)
-				}
-			} else if !os.IsNotExist(err) {
-				fmt.Fprintf(os.Stderr, "[WARN] Error checking script %s: %v\n", scriptPath, err)
+// finishPackage registers the state updates of an installed package to happen when tx
+// commits and reports its install scripts
+func finishPackage(pkg, stagingDir, installDir string, tx *Transaction, installedFiles, omittedFiles, altPaths []string) {
+	cp := txCheckpoint{Package: pkg, Action: "install", Version: stagedVersion(stagingDir, pkg), Files: installedFiles, Omitted: omittedFiles, Alternatives: altPaths}
+	if err := tx.checkpoint(cp, stagingDir); err != nil {
+		eprintf("[WARN] Failed to checkpoint %s, resuming will redo it: %v\n", pkg, err)
+	}
+	tx.deferCommit(func() {
+		recordPackage(installDir, stagingDir, pkg, installedFiles, omittedFiles, altPaths)
+	})
+	printf("Installed package: %s to %s\n", pkg, installDir)
+
+	// Script handling: look for known scripts and run or log
+	scriptNames := []string{".post-install", ".pre-deinstall", ".post-upgrade"}
+	for _, script := range scriptNames {
+		scriptPath := filepath.Join(controlStagingPath(stagingDir, pkg), script)
+		if _, err := os.Stat(scriptPath); err == nil {
+			if globalConfig != nil && globalConfig.RunScripts {
+				printf("Would run script: %s\n", scriptPath)
+				// Here you would actually run the script if not in test-root
+			} else {
+				eprintf("[WARN] Script present but not run (run_scripts: false): %s\n", scriptPath)
 			}
+		} else if !os.IsNotExist(err) {
+			eprintf("[WARN] Error checking script %s: %v\n", scriptPath, err)
 		}
 	}
-	return nil
 }
 
 // writeInstalledFiles records the list of files installed for a package
 func writeInstalledFiles(pkgName string, files []string) error {
-	dir := "installed_files"
+	dir := statePath("installed_files")
 	os.MkdirAll(dir, 0755)
 	f, err := os.Create(filepath.Join(dir, pkgName+".yaml"))
 	if err != nil {
@@ -767,7 +1622,7 @@ func writeInstalledFiles(pkgName string, files []string) error {
 
 // readInstalledFiles reads the list of files installed for a package
 func readInstalledFiles(pkgName string) ([]string, error) {
-	f, err := os.Open(filepath.Join("installed_files", pkgName+".yaml"))
+	f, err := os.Open(filepath.Join(statePath("installed_files"), pkgName+".yaml"))
 	if err != nil {
 		return nil, err
 	}
@@ -780,66 +1635,107 @@ func readInstalledFiles(pkgName string) ([]string, error) {
 	return files, nil
 }
 
-// downloadFile downloads a file from url and saves it to dest
-func downloadFile(url, dest string) error {
-	resp, err := http.Get(url)
-	if err != nil {
+// downloadFile downloads a file from url and saves it to dest, retrying per the network
+// policy. The sha256 of the file is computed on the way and returned.
+func downloadFile(url, dest string) (string, error) {
+	var sum string
+	err := withRetries("Downloading "+url, func() error {
+		resp, err := httpGet(url)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		f, err := os.Create(dest)
+		if err != nil {
+			return &permanentError{err}
+		}
+		defer f.Close()
+
+		sum, err = copySHA256(f, deadlineReader{resp.Body})
 		return err
+	})
+	return sum, err
+}
+
+// copySHA256 copies src to dst and returns the sha256 of the data, so a download is
+// verified without reading it back from disk
+func copySHA256(dst io.Writer, src io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(dst, io.TeeReader(src, h)); err != nil {
+		return "", err
 	}
-	defer resp.Body.Close()
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
 
-	f, err := os.Create(dest)
+// copyFileSHA256 copies src to dest like copyFile and returns the sha256 of the data
+func copyFileSHA256(src, dest string, mode os.FileMode) (string, error) {
+	in, err := os.Open(src)
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer f.Close()
-
-	_, err = io.Copy(f, resp.Body)
-	return err
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return "", err
+	}
+	sum, err := copySHA256(out, in)
+	if err != nil {
+		out.Close()
+		return "", err
+	}
+	return sum, out.Close()
 }
 
-// cleanupTempDirs removes temporary directories after install
-func cleanupTempDirs() {
-	os.RemoveAll("staged")
-	os.RemoveAll("staging-2")
+// cleanupTempDirs removes the temporary directory of a run after install
+func cleanupTempDirs(workDir string) {
+	os.RemoveAll(workDir)
 }
 
-// uninstallPackage removes files belonging to a package from installDir using the installed_files index
-func uninstallPackage(pkgName, version, repo, installDir string) error {
-	fmt.Printf("Uninstalling %s (%s)...\n", pkgName, version)
+// uninstallPackage removes files belonging to a package from installDir using the installed_files index.
+// Removals are journaled in tx, the index and control files are only dropped once tx commits.
+func uninstallPackage(pkgName, version, repo, installDir string, tx *Transaction) error {
+	printf("Uninstalling %s (%s)...\n", pkgName, version)
 	files, err := readInstalledFiles(pkgName)
 	if err != nil {
 		return fmt.Errorf("could not read installed files index: %w", err)
 	}
-	// Remove files
+	if err := runControlScript(installDir, pkgName, ".pre-deinstall", version); err != nil {
+		eprintf("[WARN] %v\n", err)
+	}
+	tx.removedPkgs[pkgName] = true
+	tx.setPackage(pkgName)
+	// Get all files from other installed packages that stay installed
+	otherFiles := map[string]struct{}{}
+	installedPkgs, _ := readInstalledPkgs(statePath("installed.yaml"))
+	for otherPkg := range installedPkgs {
+		if tx.removedPkgs[otherPkg] {
+			continue
+		}
+		ofs, _ := readInstalledFiles(otherPkg)
+		for _, f := range ofs {
+			otherFiles[installPath(installDir, f)] = struct{}{}
+		}
+	}
+	// Remove files, except the ones a package that stays installed ships too
 	for _, rel := range files {
-		target := filepath.Join(installDir, rel)
-		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
-			fmt.Fprintf(os.Stderr, "[WARN] Failed to remove %s: %v\n", target, err)
+		if _, shared := otherFiles[installPath(installDir, rel)]; shared {
+			continue
+		}
+		if err := tx.removeFile(rel); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", installPath(installDir, rel), err)
 		}
 	}
 	// Collect all parent directories
 	dirs := map[string]struct{}{}
 	for _, rel := range files {
-		dir := filepath.Dir(filepath.Join(installDir, rel))
+		dir := filepath.Dir(installPath(installDir, rel))
 		// Only consider directories that are not the root install directory itself
 		// and not the current directory ('.') which can happen with relative paths.
-		if dir != installDir && dir != "." {
+		if dir != installDir && dir != "." && !isRouteRoot(dir) {
 			dirs[dir] = struct{}{}
 		}
 	}
-	// Get all files from other installed packages
-	otherFiles := map[string]struct{}{}
-	installedPkgs, _ := readInstalledPkgs("installed.yaml")
-	for otherPkg := range installedPkgs {
-		if otherPkg == pkgName {
-			continue
-		}
-		ofs, _ := readInstalledFiles(otherPkg)
-		for _, f := range ofs {
-			otherFiles[filepath.Join(installDir, f)] = struct{}{}
-		}
-	}
 	// Remove directories if empty and not used by other packages
 	// Sort dirs by descending length (deepest first)
 	dirList := []string{}
@@ -856,33 +1752,104 @@ func uninstallPackage(pkgName, version, repo, installDir string) error {
 			}
 		}
 		if !used {
-			// Only remove if empty
+			// Only remove if empty, a rollback recreates it when restoring files
 			_ = os.Remove(dir)
 		}
 	}
-	os.Remove(filepath.Join("installed_files", pkgName+".yaml"))
+	if err := tx.checkpoint(txCheckpoint{Package: pkgName, Action: "remove", Version: version, Files: files}, ""); err != nil {
+		eprintf("[WARN] Failed to checkpoint %s, resuming will redo it: %v\n", pkgName, err)
+	}
+	tx.deferCommit(func() {
+		forgetPackage(installDir, pkgName, version, files)
+	})
 	return nil
 }
 
-// fetchAndParseAllAPKIndexes fetches and merges APKINDEX from all repos
+// recordPackage makes the state updates of an installed package: its file index,
+// alternatives, control files from stagingDir and omitted files
+func recordPackage(installDir, stagingDir, pkg string, installedFiles, omittedFiles, altPaths []string) {
+	if err := writeInstalledFiles(pkg, installedFiles); err != nil {
+		eprintf("[WARN] Failed to record installed files for %s: %v\n", pkg, err)
+	}
+	if err := registerAlternatives(installDir, pkg, altPaths); err != nil {
+		eprintf("[WARN] Failed to register alternatives for %s: %v\n", pkg, err)
+	}
+	// Keep .PKGINFO and scripts around for removal, verification and offline info
+	if err := saveControlFiles(stagingDir, pkg); err != nil {
+		eprintf("[WARN] Failed to store control files for %s: %v\n", pkg, err)
+	}
+	if err := writeOmittedFiles(pkg, omittedFiles); err != nil {
+		eprintf("[WARN] Failed to record omitted files for %s: %v\n", pkg, err)
+	}
+}
+
+// forgetPackage makes the state updates of an uninstalled package and runs its
+// post-deinstall script
+func forgetPackage(installDir, pkgName, version string, files []string) {
+	if err := unregisterAlternatives(installDir, pkgName); err != nil {
+		eprintf("[WARN] Failed to update alternatives for %s: %v\n", pkgName, err)
+	}
+	if err := runControlScript(installDir, pkgName, ".post-deinstall", version); err != nil {
+		eprintf("[WARN] %v\n", err)
+	}
+	if err := forgetHardlinks(files); err != nil {
+		eprintf("[WARN] Failed to update %s: %v\n", hardlinksFile, err)
+	}
+	if err := forgetStripped(files); err != nil {
+		eprintf("[WARN] Failed to update %s: %v\n", strippedFile, err)
+	}
+	os.Remove(filepath.Join(statePath("installed_files"), pkgName+".yaml"))
+	if err := removeControlFiles(pkgName); err != nil {
+		eprintf("[WARN] Failed to remove control files of %s: %v\n", pkgName, err)
+	}
+}
+
+// mergeIndex adds the packages of repo's index that no earlier repo provided
+func mergeIndex(pkgMap map[string]APKPackage, sourceRepo map[string]string, repo string, m map[string]APKPackage) {
+	for name, pkg := range m {
+		if pinnedElsewhere(name, repo) {
+			continue
+		}
+		if _, exists := pkgMap[name]; !exists {
+			pkgMap[name] = pkg
+			sourceRepo[name] = repo
+		}
+	}
+}
+
+// failedRepos are the repos whose index the last fetchAndParseAllAPKIndexes couldn't fetch
+var failedRepos []string
+
+// fetchAndParseAllAPKIndexes fetches and merges APKINDEX from all repos, a repo that
+// fails to fetch is warned about and left out
 func fetchAndParseAllAPKIndexes(repos []string) (map[string]APKPackage, map[string]string, error) {
 	pkgMap := make(map[string]APKPackage)
 	sourceRepo := make(map[string]string) // package name -> repo URL
+	var indexed []string
+	failedRepos = nil
 	for _, repo := range repos {
-		m, err := fetchAndParseAPKIndex(repo)
+		m, fetchedAt, err := fetchIndex(repo)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "[WARN] Failed to fetch APKINDEX from %s: %v\n", repo, err)
+			eprintf("[WARN] Failed to fetch APKINDEX from %s: %v\n", repo, err)
+			failedRepos = append(failedRepos, repo)
 			continue
 		}
-		for name, pkg := range m {
-			if _, exists := pkgMap[name]; !exists {
-				pkgMap[name] = pkg
-				sourceRepo[name] = repo
-			}
+		if err := checkIndexFresh(repo, fetchedAt); err != nil {
+			return nil, nil, err
+		}
+		indexed = append(indexed, repo)
+		mergeIndex(pkgMap, sourceRepo, repo, m)
+	}
+	if activeIndexFilter != nil {
+		if err := completeFilteredIndexes(indexed, pkgMap, sourceRepo); err != nil {
+			return nil, nil, err
 		}
 	}
 	if len(pkgMap) == 0 {
 		return nil, nil, fmt.Errorf("no packages found in any repo")
 	}
+	if err := checkPins(repos, pkgMap, sourceRepo); err != nil {
+		return nil, nil, err
+	}
 	return pkgMap, sourceRepo, nil
 }
@@ -7,7 +7,15 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
 	"testing"
 )
 
@@ -17,24 +25,24 @@ func TestReadConfig(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer os.Remove(f.Name())
-	f.WriteString("repo: test\npackages:\n  - foo\ninstall: true\ninstall_dir: root\nrun_scripts: false\n")
+	f.WriteString("repos:\n  - https://example.com/test\npackages:\n  - foo\ninstall: true\ninstall_dir: root\nrun_scripts: false\n")
 	f.Close()
 	cfg, err := readConfig(f.Name())
 	if err != nil {
 		t.Fatalf("readConfig failed: %v", err)
 	}
-	if cfg.Repo != "test" || len(cfg.Packages) != 1 || cfg.Packages[0] != "foo" || !cfg.Install || cfg.InstallDir != "root" || cfg.RunScripts != false {
+	if len(cfg.Repos) != 1 || cfg.Repos[0] != "https://example.com/test" || len(cfg.Packages) != 1 || cfg.Packages[0] != "foo" || !cfg.Install || cfg.InstallDir != "root" || cfg.RunScripts != false {
 		t.Errorf("unexpected config: %+v", cfg)
 	}
 }
 
 func TestInstalledPkgsReadWrite(t *testing.T) {
-	path := "installed-test.yaml"
+	// Writes installed_event.json next to it
+	path := filepath.Join(t.TempDir(), "installed-test.yaml")
 	pkgs := map[string]string{"foo": "1.0", "bar": "2.0"}
 	if err := writeInstalledPkgs(path, pkgs); err != nil {
 		t.Fatalf("writeInstalledPkgs failed: %v", err)
 	}
-	defer os.Remove(path)
 	read, err := readInstalledPkgs(path)
 	if err != nil {
 		t.Fatalf("readInstalledPkgs failed: %v", err)
@@ -43,3 +51,213 @@ func TestInstalledPkgsReadWrite(t *testing.T) {
 		t.Errorf("unexpected read: %+v", read)
 	}
 }
+
+func TestParseAPKIndexProvides(t *testing.T) {
+	index := "P:py3-pip\nV:23.1-r0\np:cmd:pip3=23.1-r0 cmd:pip=23.1-r0\n\nP:libssl3\nV:3.3.0-r0\np:so:libssl.so.3=3\n"
+	pkgs, err := parseAPKIndex(strings.NewReader(index))
+	if err != nil {
+		t.Fatalf("parseAPKIndex failed: %v", err)
+	}
+	provides := buildProvidesMap(pkgs)
+	if m := lookupProvides(provides, "cmd:pip3"); len(m["cmd:pip3"]) != 1 || m["cmd:pip3"][0] != "py3-pip" {
+		t.Errorf("unexpected cmd:pip3 lookup: %+v", m)
+	}
+	if m := lookupProvides(provides, "libssl.so.3"); len(m["so:libssl.so.3"]) != 1 {
+		t.Errorf("bare token did not match prefixed provide: %+v", m)
+	}
+}
+
+func TestParseAPKIndexPayload(t *testing.T) {
+	index := "P:busybox\nV:1.36.1-r0\n\n"
+	gzipped := func(b []byte) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(b)
+		gz.Close()
+		return buf.Bytes()
+	}
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	tw.WriteHeader(&tar.Header{Name: "DESCRIPTION", Mode: 0644, Size: 4, Typeflag: tar.TypeReg})
+	tw.Write([]byte("main"))
+	tw.WriteHeader(&tar.Header{Name: "APKINDEX", Mode: 0644, Size: int64(len(index)), Typeflag: tar.TypeReg})
+	tw.Write([]byte(index))
+	tw.Close()
+
+	for name, payload := range map[string][]byte{
+		"plain":  []byte(index),
+		"gzip":   gzipped([]byte(index)),
+		"tar.gz": gzipped(tarBuf.Bytes()),
+	} {
+		pkgs, err := parseAPKIndexPayload(bytes.NewReader(payload))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if pkgs["busybox"].Version != "1.36.1-r0" {
+			t.Errorf("%s: unexpected packages %+v", name, pkgs)
+		}
+	}
+	if _, err := parseAPKIndexPayload(strings.NewReader("<html>Not found</html>")); err == nil {
+		t.Error("expected an HTML page to be rejected")
+	}
+}
+
+func TestComputePlan(t *testing.T) {
+	cfg := &Config{Packages: []string{"foo", "bar"}}
+	pkgMap := map[string]APKPackage{
+		"foo": {Name: "foo", Version: "1.1", Size: 100, InstalledSize: 400},
+		"bar": {Name: "bar", Version: "2.0", Size: 50, InstalledSize: 200},
+	}
+	installed := map[string]string{"foo": "1.0", "old": "0.1"}
+	toInstall, err := resolveInstallSet(cfg, pkgMap, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := computePlan(cfg, pkgMap, installed, toInstall)
+	if len(plan.Installs) != 1 || plan.Installs[0].Name != "bar" {
+		t.Errorf("unexpected installs: %+v", plan.Installs)
+	}
+	if len(plan.Upgrades) != 1 || plan.Upgrades[0].OldVersion != "1.0" || plan.Upgrades[0].NewVersion != "1.1" {
+		t.Errorf("unexpected upgrades: %+v", plan.Upgrades)
+	}
+	if len(plan.Removals) != 1 || plan.Removals[0].Name != "old" {
+		t.Errorf("unexpected removals: %+v", plan.Removals)
+	}
+	if plan.DownloadSize() != 150 {
+		t.Errorf("unexpected download size: %d", plan.DownloadSize())
+	}
+}
+
+func TestParseAPKIndexLineLimit(t *testing.T) {
+	index := "P:foo\nV:1.0-r0\nD:" + strings.Repeat("x", maxIndexLine) + "\n\nP:bar\nV:2.0-r0\n"
+	if _, err := parseAPKIndex(strings.NewReader(index)); err == nil {
+		t.Error("expected an overlong line to fail the parse")
+	}
+	pkgs, err := parseAPKIndex(strings.NewReader("P:foo\nV:1.0-r0\n\n\n\nP:bar\nV:2.0-r0"))
+	if err != nil {
+		t.Fatalf("parseAPKIndex failed: %v", err)
+	}
+	if len(pkgs) != 2 || pkgs["bar"].Version != "2.0-r0" {
+		t.Errorf("unexpected packages: %+v", pkgs)
+	}
+}
+
+func TestApplyLowMemoryKeepsInstallMode(t *testing.T) {
+	oldLow, oldProcs := lowMemory, runtime.GOMAXPROCS(0)
+	defer func() { lowMemory = oldLow; runtime.GOMAXPROCS(oldProcs); debug.SetGCPercent(100) }()
+	cfg := &Config{LowMemory: true}
+	applyLowMemory(cfg)
+	if !lowMemory || cfg.InstallMode != "" {
+		t.Errorf("low memory %v, install mode %q", lowMemory, cfg.InstallMode)
+	}
+}
+
+func TestPrunePkgMap(t *testing.T) {
+	pkgMap := map[string]APKPackage{"foo": {Name: "foo"}, "bar": {Name: "bar"}, "old": {Name: "old"}, "unused": {Name: "unused"}}
+	sourceRepo := map[string]string{"foo": "r", "bar": "r", "old": "r", "unused": "r"}
+	prunePkgMap(pkgMap, sourceRepo, []string{"bar", "foo"}, map[string]string{"old": "1.0"})
+	if len(pkgMap) != 3 || len(sourceRepo) != 3 {
+		t.Fatalf("unexpected pruned maps: %v %v", pkgMap, sourceRepo)
+	}
+	if _, ok := pkgMap["unused"]; ok {
+		t.Error("unused entry was kept")
+	}
+}
+
+func TestInstalledEvent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "installed.yaml")
+	writeInstalledPkgs(path, map[string]string{"busybox": "1.36.0-r0", "curl": "8.9.0-r0"})
+	writeInstalledPkgs(path, map[string]string{"busybox": "1.36.1-r0", "musl": "1.2.5-r0"})
+	writeInstalledPkgs(path, map[string]string{"busybox": "1.36.1-r0", "musl": "1.2.5-r0"})
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(path), eventFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ev InstalledEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		t.Fatal(err)
+	}
+	// The unchanged third write doesn't count
+	if ev.Serial != 2 || len(ev.Installed) != 1 || ev.Installed[0].Name != "musl" ||
+		len(ev.Upgraded) != 1 || ev.Upgraded[0].OldVersion != "1.36.0-r0" || len(ev.Removed) != 1 || ev.Removed[0].Name != "curl" {
+		t.Errorf("unexpected event %+v", ev)
+	}
+}
+
+func TestOptionalGroups(t *testing.T) {
+	oldWith := withGroups
+	withGroups = []string{"openrc"}
+	defer func() { withGroups = oldWith }()
+	cfg := &Config{Packages: []string{"nginx", "curl"}, OptionalGroups: map[string]OptionalGroup{
+		"docs":   {Subpackages: []string{"-doc"}},
+		"openrc": {Subpackages: []string{"-openrc"}, Packages: []string{"openrc", "missing"}},
+	}}
+	if err := validateOptionalGroups(cfg); err != nil {
+		t.Fatal(err)
+	}
+	pkgMap := map[string]APKPackage{
+		"nginx":        {Name: "nginx", Version: "1.26.2-r0"},
+		"nginx-doc":    {Name: "nginx-doc", Version: "1.26.2-r0"},
+		"nginx-openrc": {Name: "nginx-openrc", Version: "1.26.2-r0"},
+		"curl":         {Name: "curl", Version: "8.9.0-r0"},
+		"curl-doc":     {Name: "curl-doc", Version: "8.9.0-r0"},
+		"openrc":       {Name: "openrc", Version: "0.55-r0"},
+	}
+	toInstall, err := resolveInstallSet(cfg, pkgMap, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(toInstall, " ") != "curl nginx nginx-openrc openrc" {
+		t.Errorf("install set %v", toInstall)
+	}
+	plan := computePlan(cfg, pkgMap, map[string]string{}, toInstall)
+	for _, it := range plan.Installs {
+		if (it.Group == "openrc") != (it.Name == "nginx-openrc" || it.Name == "openrc") {
+			t.Errorf("%s is in group %q", it.Name, it.Group)
+		}
+	}
+	want := "docs: not enabled (-with docs), 2 packages available|openrc: enabled, 2 packages nginx-openrc openrc"
+	if strings.Join(plan.Optional, "|") != want {
+		t.Errorf("optional summary %q", plan.Optional)
+	}
+	withGroups = []string{"nope"}
+	if err := validateOptionalGroups(cfg); err == nil {
+		t.Error("an undefined group was accepted")
+	}
+}
+
+func TestReadConfigStdin(t *testing.T) {
+	oldStdin, oldCached := os.Stdin, stdinConfig
+	defer func() { os.Stdin, stdinConfig = oldStdin, oldCached }()
+	stdinConfig = nil
+	f, err := os.CreateTemp(t.TempDir(), "stdin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("repos:\n  - https://example.com/test\npackages:\n  - foo\ninstall_dir: root\n")
+	f.Seek(0, 0)
+	os.Stdin = f
+	// stdin is only read once, later reads of the config get the same content
+	for i := 0; i < 2; i++ {
+		cfg, err := readConfig("-")
+		if err != nil {
+			t.Fatalf("read %d: %v", i, err)
+		}
+		if len(cfg.Packages) != 1 || cfg.Packages[0] != "foo" {
+			t.Errorf("read %d: unexpected config %+v", i, cfg)
+		}
+	}
+	if err := checkConfigWritable("-"); err == nil {
+		t.Error("expected a config from stdin not to be writable")
+	}
+}
+
+func TestStatePath(t *testing.T) {
+	oldState := stateDir
+	defer func() { stateDir = oldState }()
+	stateDir = "/var/lib/apkg/web"
+	if got := statePath("installed.yaml"); got != "/var/lib/apkg/web/installed.yaml" {
+		t.Errorf("statePath = %s", got)
+	}
+}
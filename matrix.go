@@ -0,0 +1,237 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// matrixDir (under the state dir) holds the config and state of every arch built by build-matrix
+const matrixDir = "matrix"
+
+// archPlaceholder is replaced by the arch in repos, install_dir and provenance
+const archPlaceholder = "$arch"
+
+// archConfig derives the config building arch from cfg: $arch is substituted in the repos,
+// and install_dir and provenance get a per-arch location when they don't use it
+func archConfig(cfg *Config, arch string) Config {
+	c := *cfg
+	c.Arches = nil
+	// A channel gates the lockfile of the main config, not the per-arch ones
+	c.Channel, c.ChannelManifest = "", ""
+	c.Repos = make([]string, len(cfg.Repos))
+	for i, repo := range cfg.Repos {
+		c.Repos[i] = strings.ReplaceAll(repo, archPlaceholder, arch)
+	}
+	c.Packages = append([]string(nil), cfg.Packages...)
+	if strings.Contains(c.InstallDir, archPlaceholder) {
+		c.InstallDir = strings.ReplaceAll(c.InstallDir, archPlaceholder, arch)
+	} else {
+		c.InstallDir = filepath.Join(c.InstallDir, arch)
+	}
+	if c.Provenance != "" {
+		if strings.Contains(c.Provenance, archPlaceholder) {
+			c.Provenance = strings.ReplaceAll(c.Provenance, archPlaceholder, arch)
+		} else {
+			ext := filepath.Ext(c.Provenance)
+			c.Provenance = strings.TrimSuffix(c.Provenance, ext) + "-" + arch + ext
+		}
+	}
+	return c
+}
+
+// prepareArchState writes the derived config of arch into its own state dir, which
+// shares the index cache with the main state dir. It returns the config path and state dir.
+func prepareArchState(cfg *Config, arch string) (string, string, error) {
+	dir := statePath(filepath.Join(matrixDir, arch))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", "", err
+	}
+	shared, err := filepath.Abs(statePath(indexCacheDir))
+	if err != nil {
+		return "", "", err
+	}
+	if err := os.MkdirAll(shared, 0755); err != nil {
+		return "", "", err
+	}
+	link := filepath.Join(dir, indexCacheDir)
+	if _, err := os.Lstat(link); os.IsNotExist(err) {
+		if err := os.Symlink(shared, link); err != nil {
+			return "", "", err
+		}
+	}
+	c := archConfig(cfg, arch)
+	path := filepath.Join(dir, "apkg.yaml")
+	f, err := os.Create(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	if err := yamlEncode(f, &c); err != nil {
+		return "", "", err
+	}
+	return path, dir, nil
+}
+
+// prefixLines copies r to w line by line, prefixing every line
+func prefixLines(w io.Writer, mu *sync.Mutex, prefix string, r io.Reader) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1<<20)
+	for sc.Scan() {
+		mu.Lock()
+		fmt.Fprintf(w, "%s%s\n", prefix, sc.Text())
+		mu.Unlock()
+	}
+}
+
+// matrixFlags are the flags of the build-matrix invocation the apply of every arch gets too
+var matrixFlags = []string{"locked", "with", "only-upgrade", "allow-suid", "require-fresh", "4", "6"}
+
+// forwardedFlags returns the matrixFlags build-matrix was run with as arguments
+func forwardedFlags() []string {
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		if slices.Contains(matrixFlags, f.Name) {
+			args = append(args, "-"+f.Name+"="+f.Value.String())
+		}
+	})
+	return args
+}
+
+// runArchStep runs apkg with args against the config and state of one arch, prefixing its output
+func runArchStep(arch, configPath, dir string, mu *sync.Mutex, args ...string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(self, append([]string{"-config", configPath, "-state-dir", dir}, args...)...)
+	// The derived configs aren't signed, the main config was verified already
+	cmd.Env = append(os.Environ(), "APKG_CONFIG_KEYRING=")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	prefix := "[" + arch + "] "
+	go func() { defer wg.Done(); prefixLines(os.Stdout, mu, prefix, stdout) }()
+	go func() { defer wg.Done(); prefixLines(os.Stderr, mu, prefix, stderr) }()
+	wg.Wait()
+	return cmd.Wait()
+}
+
+// cmdBuildMatrix implements `apkg build-matrix`: every arch of the config is built into
+// its own root concurrently, each with its own lockfile and optionally a tar export
+func cmdBuildMatrix(configPath string, args []string) int {
+	fs := flag.NewFlagSet("build-matrix", flag.ExitOnError)
+	only := fs.String("arch", "", "Comma separated subset of the configured arches to build")
+	jobs := fs.Int("jobs", 0, "How many arches to build at once (default: all)")
+	export := fs.String("export", "", "Also export every root as <dir>/<arch>.tar")
+	fs.Parse(args)
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		eprintf("[FATAL] Failed to read config: %v\n", err)
+		return 1
+	}
+	globalConfig = cfg
+	arches := cfg.Arches
+	if *only != "" {
+		arches = strings.Split(*only, ",")
+		for _, arch := range arches {
+			found := false
+			for _, a := range cfg.Arches {
+				found = found || a == arch
+			}
+			if !found {
+				eprintf("[FATAL] %s isn't one of the configured arches %v\n", arch, cfg.Arches)
+				return 1
+			}
+		}
+	}
+	if len(arches) == 0 {
+		eprintf("[FATAL] No arches configured, list them under arches: in the config\n")
+		return 1
+	}
+	if *export != "" {
+		if err := os.MkdirAll(*export, 0755); err != nil {
+			eprintf("[FATAL] %v\n", err)
+			return 1
+		}
+	}
+	if *jobs <= 0 || *jobs > len(arches) {
+		*jobs = len(arches)
+	}
+
+	var mu sync.Mutex
+	failed := map[string]error{}
+	sem := make(chan struct{}, *jobs)
+	var wg sync.WaitGroup
+	for _, arch := range arches {
+		wg.Add(1)
+		go func(arch string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			err := buildArch(cfg, arch, *export, &mu)
+			if err != nil {
+				mu.Lock()
+				failed[arch] = err
+				mu.Unlock()
+			}
+		}(arch)
+	}
+	wg.Wait()
+
+	sort.Strings(arches)
+	for _, arch := range arches {
+		dir := statePath(filepath.Join(matrixDir, arch))
+		if err, ok := failed[arch]; ok {
+			printf("  %-10s FAILED: %v\n", arch, err)
+		} else {
+			printf("  %-10s ok, root %s, lockfile %s\n", arch, archConfig(cfg, arch).InstallDir, filepath.Join(dir, "apkg.lock"))
+		}
+	}
+	if len(failed) > 0 {
+		return 4
+	}
+	return 0
+}
+
+// buildArch applies and optionally exports one arch of the matrix. The apply writes the
+// lockfile from its own resolution, so it locks exactly the root that was built.
+func buildArch(cfg *Config, arch, export string, mu *sync.Mutex) error {
+	configPath, dir, err := prepareArchState(cfg, arch)
+	if err != nil {
+		return err
+	}
+	if err := runArchStep(arch, configPath, dir, mu, append(forwardedFlags(), "-write-lock")...); err != nil {
+		return fmt.Errorf("apply: %w", err)
+	}
+	if export != "" {
+		if err := runArchStep(arch, configPath, dir, mu, "extract", "-to-tar", filepath.Join(export, arch+".tar")); err != nil {
+			return fmt.Errorf("export: %w", err)
+		}
+	}
+	return nil
+}
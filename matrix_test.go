@@ -0,0 +1,56 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestArchConfig(t *testing.T) {
+	cfg := &Config{
+		Repos:      []string{"https://dl-cdn.alpinelinux.org/alpine/v3.20/main/$arch", "/srv/local"},
+		Packages:   []string{"busybox"},
+		InstallDir: "rootfs",
+		Provenance: "out/provenance.json",
+		Arches:     []string{"x86_64", "aarch64"},
+	}
+	c := archConfig(cfg, "aarch64")
+	if c.Repos[0] != "https://dl-cdn.alpinelinux.org/alpine/v3.20/main/aarch64" || c.Repos[1] != "/srv/local" {
+		t.Errorf("unexpected repos: %v", c.Repos)
+	}
+	if c.InstallDir != filepath.Join("rootfs", "aarch64") || c.Provenance != "out/provenance-aarch64.json" || c.Arches != nil {
+		t.Errorf("unexpected derived config: %+v", c)
+	}
+	cfg.InstallDir = "roots/$arch/fs"
+	if c := archConfig(cfg, "x86_64"); c.InstallDir != "roots/x86_64/fs" {
+		t.Errorf("unexpected install_dir: %s", c.InstallDir)
+	}
+	if cfg.Repos[0] == c.Repos[0] {
+		t.Error("the main config was modified")
+	}
+}
+
+func TestPrepareArchStateSharesIndexCache(t *testing.T) {
+	oldState := stateDir
+	stateDir = t.TempDir()
+	defer func() { stateDir = oldState }()
+
+	path, dir, err := prepareArchState(&Config{InstallDir: "rootfs"}, "riscv64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := readConfig(path)
+	if err != nil || cfg.InstallDir != filepath.Join("rootfs", "riscv64") {
+		t.Fatalf("unexpected derived config %+v, %v", cfg, err)
+	}
+	os.WriteFile(filepath.Join(dir, indexCacheDir, "x.APKINDEX"), []byte("P:x\n"), 0644)
+	if _, err := os.Stat(filepath.Join(stateDir, indexCacheDir, "x.APKINDEX")); err != nil {
+		t.Errorf("index cache isn't shared: %v", err)
+	}
+}
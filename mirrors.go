@@ -0,0 +1,227 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mirrorsListURL is the official list of Alpine mirrors, one base URL per line
+var mirrorsListURL = defaultAlpineMirror + "/MIRRORS.txt"
+
+// mirrorFile (under the state dir) holds the mirror `apkg mirrors update` picked, used by
+// alpine_mirror: auto
+const mirrorFile = "mirror"
+
+// autoMirror is the alpine_mirror value that uses the mirror picked by `apkg mirrors update`
+const autoMirror = "auto"
+
+// mirrorProbes is how many mirrors are probed at once
+const mirrorProbes = 8
+
+// mirrorThroughputCandidates is how many of the fastest responding mirrors get their
+// throughput measured
+const mirrorThroughputCandidates = 3
+
+// pickedMirror returns the mirror recorded by `apkg mirrors update`, the default one
+// when none was
+func pickedMirror() string {
+	data, err := os.ReadFile(statePath(mirrorFile))
+	if m := strings.TrimSpace(string(data)); err == nil && m != "" {
+		return m
+	}
+	return defaultAlpineMirror
+}
+
+// mirrorProbe is the measurement of one mirror
+type mirrorProbe struct {
+	url        string
+	latency    time.Duration
+	throughput float64
+	err        error
+}
+
+// fetchMirrorList returns the mirror base URLs of the official list
+func fetchMirrorList() ([]string, error) {
+	var data []byte
+	err := withRetries("mirror list", func() error {
+		resp, err := httpGet(mirrorsListURL)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		data, err = readLimited(resp.Body, 1<<20, "mirror list")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var mirrors []string
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if u, err := url.Parse(line); err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+			mirrors = append(mirrors, strings.TrimSuffix(line, "/"))
+		}
+	}
+	if len(mirrors) == 0 {
+		return nil, fmt.Errorf("%s lists no mirrors", mirrorsListURL)
+	}
+	return mirrors, nil
+}
+
+// preferMirrors keeps the mirrors whose host ends in one of the country domains of
+// prefer (e.g. de, fr), all of them when none does
+func preferMirrors(mirrors, prefer []string) []string {
+	var kept []string
+	for _, m := range mirrors {
+		u, _ := url.Parse(m)
+		for _, c := range prefer {
+			if c = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(c), ".")); c != "" && strings.HasSuffix(u.Hostname(), "."+c) {
+				kept = append(kept, m)
+				break
+			}
+		}
+	}
+	if len(kept) == 0 {
+		return mirrors
+	}
+	return kept
+}
+
+// timedGet fetches url to the end and returns its size and how long it took
+func timedGet(url string) (int64, time.Duration, error) {
+	start := time.Now()
+	resp, err := httpGet(url)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	n, err := io.Copy(io.Discard, resp.Body)
+	return n, time.Since(start), err
+}
+
+// probeMirrors measures the latency of every mirror (a fetch of its last-updated file),
+// then the throughput of the fastest ones with an index of latest-stable. The result is
+// sorted best first, mirrors that failed last.
+func probeMirrors(mirrors []string, arch string) []mirrorProbe {
+	probes := make([]mirrorProbe, len(mirrors))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, mirrorProbes)
+	for i, m := range mirrors {
+		wg.Add(1)
+		go func(i int, m string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			_, d, err := timedGet(m + "/last-updated")
+			probes[i] = mirrorProbe{url: m, latency: d, err: err}
+		}(i, m)
+	}
+	wg.Wait()
+	sort.SliceStable(probes, func(i, j int) bool {
+		if (probes[i].err == nil) != (probes[j].err == nil) {
+			return probes[i].err == nil
+		}
+		return probes[i].latency < probes[j].latency
+	})
+	for i := 0; i < len(probes) && i < mirrorThroughputCandidates && probes[i].err == nil; i++ {
+		n, d, err := timedGet(probes[i].url + "/latest-stable/main/" + arch + "/APKINDEX.tar.gz")
+		if err != nil {
+			probes[i].err = err
+			continue
+		}
+		probes[i].throughput = float64(n) / d.Seconds()
+	}
+	sort.SliceStable(probes, func(i, j int) bool {
+		if (probes[i].err == nil) != (probes[j].err == nil) {
+			return probes[i].err == nil
+		}
+		return probes[i].throughput > probes[j].throughput
+	})
+	return probes
+}
+
+// cmdMirrors implements `apkg mirrors update`: pick the fastest official mirror and write
+// it to alpine_mirror, or record it for alpine_mirror: auto
+func cmdMirrors(configPath string, args []string) int {
+	if len(args) == 0 || args[0] != "update" {
+		eprintf("Usage: %s [flags] mirrors update [-prefer de,at] [-dry-run]\n", os.Args[0])
+		return 1
+	}
+	fs := flag.NewFlagSet("mirrors update", flag.ExitOnError)
+	prefer := fs.String("prefer", "", "Comma-separated country domains (e.g. de,at) whose mirrors are preferred")
+	dryRun := fs.Bool("dry-run", false, "Only show the measurements, don't change anything")
+	fs.Parse(args[1:])
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		eprintf("[FATAL] Failed to read config: %v\n", err)
+		return 1
+	}
+	globalConfig = cfg
+	mirrors, err := fetchMirrorList()
+	if err != nil {
+		eprintf("[FATAL] Failed to fetch the mirror list: %v\n", err)
+		return 2
+	}
+	if *prefer != "" {
+		mirrors = preferMirrors(mirrors, strings.Split(*prefer, ","))
+	}
+	printf("Probing %d mirrors...\n", len(mirrors))
+	probes := probeMirrors(mirrors, repoArch(cfg))
+	failed := 0
+	for _, p := range probes {
+		switch {
+		case p.err != nil:
+			failed++
+		case p.throughput > 0:
+			printf("  %s: %s latency, %s/s\n", p.url, p.latency.Round(time.Millisecond), humanSize(int64(p.throughput)))
+		}
+	}
+	if failed > 0 {
+		printf("%d mirrors couldn't be reached\n", failed)
+	}
+	if len(probes) == 0 || probes[0].err != nil {
+		eprintf("[FATAL] No mirror could be reached\n")
+		return 2
+	}
+	best := probes[0].url
+	printf("Fastest mirror: %s\n", best)
+	if *dryRun {
+		return 0
+	}
+	if cfg.AlpineMirror != autoMirror && checkConfigWritable(configPath) == nil {
+		d, err := loadConfigDoc(configPath)
+		if err == nil {
+			if err = d.set("alpine_mirror", best); err == nil {
+				err = d.save()
+			}
+		}
+		if err != nil {
+			eprintf("[FATAL] Failed to write config: %v\n", err)
+			return 1
+		}
+		printf("Wrote alpine_mirror to %s\n", configPath)
+		return 0
+	}
+	if err := os.WriteFile(statePath(mirrorFile), []byte(best+"\n"), 0644); err != nil {
+		eprintf("[FATAL] Failed to record the mirror: %v\n", err)
+		return 1
+	}
+	printf("Recorded the mirror for alpine_mirror: auto\n")
+	return 0
+}
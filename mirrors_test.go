@@ -0,0 +1,72 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirrorsUpdate(t *testing.T) {
+	mirror := func(delay time.Duration) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(delay)
+			w.Write([]byte(strings.Repeat("x", 1024)))
+		}))
+	}
+	slow, fast := mirror(50*time.Millisecond), mirror(0)
+	defer slow.Close()
+	defer fast.Close()
+	list := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(slow.URL + "/\n" + fast.URL + "\nhttp://127.0.0.1:1\nnot a mirror\n"))
+	}))
+	defer list.Close()
+	oldList, oldState := mirrorsListURL, stateDir
+	defer func() { mirrorsListURL, stateDir = oldList, oldState }()
+	mirrorsListURL = list.URL
+	stateDir = t.TempDir()
+
+	mirrors, err := fetchMirrorList()
+	if err != nil || len(mirrors) != 3 || mirrors[0] != slow.URL {
+		t.Fatalf("mirror list: %v %v", mirrors, err)
+	}
+	probes := probeMirrors(mirrors, "x86_64")
+	if probes[0].url != fast.URL || probes[2].err == nil {
+		t.Errorf("probes: %+v", probes)
+	}
+
+	config := filepath.Join(t.TempDir(), "apkg.yaml")
+	os.WriteFile(config, []byte("# repos\nrepos: [alpine:v3.20/main]\n"), 0644)
+	if code := cmdMirrors(config, []string{"update"}); code != 0 {
+		t.Fatalf("exit %d", code)
+	}
+	cfg, err := readConfig(config)
+	if err != nil || cfg.AlpineMirror != fast.URL || cfg.Repos[0] != fast.URL+"/v3.20/main/"+repoArch(cfg) {
+		t.Errorf("config: %+v %v", cfg, err)
+	}
+
+	// alpine_mirror: auto records the mirror in the state dir
+	os.WriteFile(config, []byte("repos: [alpine:v3.20/main]\nalpine_mirror: auto\n"), 0644)
+	if code := cmdMirrors(config, []string{"update"}); code != 0 {
+		t.Fatalf("exit %d", code)
+	}
+	if cfg, err := readConfig(config); err != nil || cfg.Repos[0] != fast.URL+"/v3.20/main/"+repoArch(cfg) {
+		t.Errorf("auto mirror: %+v %v", cfg, err)
+	}
+
+	if got := preferMirrors([]string{"https://a.example.de/alpine", "https://b.example.com/alpine"}, []string{".DE"}); len(got) != 1 {
+		t.Errorf("prefer: %v", got)
+	}
+	if got := preferMirrors([]string{"https://b.example.com/alpine"}, []string{"fr"}); len(got) != 1 {
+		t.Errorf("prefer without match: %v", got)
+	}
+}
@@ -0,0 +1,90 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// defaultDirMode is the mode of directories no package describes, e.g. the parents of a
+// relocated package
+const defaultDirMode os.FileMode = 0755
+
+// parseMode parses an octal mode such as 0750
+func parseMode(s string) (os.FileMode, error) {
+	v, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || v > 07777 {
+		return 0, fmt.Errorf("%q is not an octal mode", s)
+	}
+	return os.FileMode(v), nil
+}
+
+// validateModes checks the configured umask and dir_mode
+func validateModes(cfg *Config) error {
+	if cfg.Umask != "" {
+		if m, err := parseMode(cfg.Umask); err != nil || m > 0777 {
+			return fmt.Errorf("umask: %q is not an octal umask", cfg.Umask)
+		}
+	}
+	if cfg.DirMode != "" {
+		if m, err := parseMode(cfg.DirMode); err != nil || m > 0777 {
+			return fmt.Errorf("dir_mode: %q is not an octal permission mode", cfg.DirMode)
+		}
+	}
+	return nil
+}
+
+// dirMode returns the configured dir_mode, 0755 by default
+func dirMode() os.FileMode {
+	if globalConfig != nil && globalConfig.DirMode != "" {
+		if m, err := parseMode(globalConfig.DirMode); err == nil {
+			return m
+		}
+	}
+	return defaultDirMode
+}
+
+// applyUmask sets the configured umask for everything the apply creates without a mode
+// from a package: state, staging and directories no package describes
+func applyUmask(cfg *Config) {
+	if m, err := parseMode(cfg.Umask); err == nil && cfg.Umask != "" {
+		syscall.Umask(int(m))
+	}
+}
+
+// archiveMode returns the exact mode of a packaged file or directory: its permissions
+// and the setuid, setgid and sticky bits. Callers chmod after chown, which clears setuid.
+func archiveMode(mode os.FileMode) os.FileMode {
+	return mode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+}
+
+// pendingMode is the mode of a packaged directory waiting to be applied
+type pendingMode struct {
+	path string
+	mode os.FileMode
+}
+
+// dirModes collects the modes of packaged directories, they are only applied once their
+// content is written so read-only directories can still be filled
+type dirModes []pendingMode
+
+func (d *dirModes) add(path string, mode os.FileMode) {
+	*d = append(*d, pendingMode{path, archiveMode(mode)})
+}
+
+// apply sets every collected mode, deepest directories first
+func (d dirModes) apply() error {
+	for i := len(d) - 1; i >= 0; i-- {
+		if err := os.Chmod(d[i].path, d[i].mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
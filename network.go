@@ -0,0 +1,300 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Defaults of the network: config section
+const (
+	defaultNetTimeout      = 30 * time.Second
+	defaultNetRetries      = 3
+	defaultNetRetryBackoff = 2 * time.Second
+)
+
+// NetworkConfig is the retry/timeout policy shared by every index fetch and package download
+type NetworkConfig struct {
+	// Timeout is how long a connection may go without sending any data (default 30s)
+	Timeout string `yaml:"timeout,omitempty"`
+	// Retries is how often a failed fetch is retried (default 3, 0 disables retries)
+	Retries *int `yaml:"retries,omitempty"`
+	// RetryBackoff is the wait before the first retry, doubled for every further one (default 2s)
+	RetryBackoff string `yaml:"retry_backoff,omitempty"`
+	// IPFamily forces connections over "ipv4" or "ipv6", empty uses both
+	IPFamily string `yaml:"ip_family,omitempty"`
+	// Hosts pins host names to IP addresses, bypassing DNS for them
+	Hosts map[string]string `yaml:"hosts,omitempty"`
+	// Proxy routes every fetch through a socks5:// or http(s):// proxy, empty uses $HTTPS_PROXY and friends
+	Proxy string `yaml:"proxy,omitempty"`
+	// SegmentedSize is the package size (e.g. 64M) from which a package whose mirror publishes
+	// a Metalink is downloaded in parallel ranges from its mirrors, empty never does
+	SegmentedSize string `yaml:"segmented_size,omitempty"`
+	// Connections is how many ranges of a segmented download are fetched at once (default 4)
+	Connections int `yaml:"connections,omitempty"`
+}
+
+// ipFamilyOverride is set by the -4/-6 flags and takes precedence over ip_family
+var ipFamilyOverride string
+
+// httpClient is the client every fetch goes through, dialing with netDial
+var httpClient = newHTTPClient()
+
+// newHTTPClient builds the shared client on top of the default transport settings
+func newHTTPClient() *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = netDial
+	t.Proxy = netProxy
+	return &http.Client{Transport: t}
+}
+
+// netDial dials addr honouring the IP family preference and the pinned hosts.
+// TLS still verifies against the original host name.
+func netDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	n := networkConfig()
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		if ip, ok := n.Hosts[host]; ok {
+			addr = net.JoinHostPort(ip, port)
+		}
+	}
+	switch n.ipFamily() {
+	case "ipv4":
+		network = "tcp4"
+	case "ipv6":
+		network = "tcp6"
+	}
+	d := &net.Dialer{Timeout: n.timeout(), KeepAlive: 30 * time.Second}
+	return d.DialContext(ctx, network, addr)
+}
+
+// netProxy returns the proxy for req, the configured one or the one from the environment.
+// With a SOCKS5 proxy host names are resolved by the proxy, so pinned hosts only apply to the proxy itself.
+func netProxy(req *http.Request) (*url.URL, error) {
+	if p := networkConfig().Proxy; p != "" {
+		return url.Parse(p)
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// ipFamily returns the IP family connections are restricted to, if any
+func (n NetworkConfig) ipFamily() string {
+	if ipFamilyOverride != "" {
+		return ipFamilyOverride
+	}
+	return n.IPFamily
+}
+
+// validate checks the durations of the network section
+func (n NetworkConfig) validate() error {
+	for key, val := range map[string]string{"timeout": n.Timeout, "retry_backoff": n.RetryBackoff} {
+		if val == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(val); err != nil || d <= 0 {
+			return fmt.Errorf("invalid network %s %q", key, val)
+		}
+	}
+	if n.IPFamily != "" && n.IPFamily != "ipv4" && n.IPFamily != "ipv6" {
+		return fmt.Errorf("invalid network ip_family %q, must be ipv4 or ipv6", n.IPFamily)
+	}
+	for host, ip := range n.Hosts {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("network hosts: %s is pinned to %q which is not an IP address", host, ip)
+		}
+	}
+	if n.Proxy != "" {
+		u, err := url.Parse(n.Proxy)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("invalid network proxy %q", n.Proxy)
+		}
+		if u.Scheme != "socks5" && u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("unsupported network proxy scheme %q, use socks5, http or https", u.Scheme)
+		}
+	}
+	if n.SegmentedSize != "" {
+		if _, err := parseSize(n.SegmentedSize); err != nil {
+			return fmt.Errorf("invalid network segmented_size: %w", err)
+		}
+	}
+	if n.Connections < 0 {
+		return fmt.Errorf("network connections can't be negative")
+	}
+	if n.Retries != nil && *n.Retries < 0 {
+		return fmt.Errorf("network retries can't be negative")
+	}
+	return nil
+}
+
+// networkConfig returns the network section of the active config
+func networkConfig() NetworkConfig {
+	if globalConfig == nil {
+		return NetworkConfig{}
+	}
+	return globalConfig.Network
+}
+
+// timeout returns the configured idle timeout
+func (n NetworkConfig) timeout() time.Duration {
+	if d, err := time.ParseDuration(n.Timeout); err == nil && d > 0 {
+		return d
+	}
+	return defaultNetTimeout
+}
+
+// retries returns the configured number of retries
+func (n NetworkConfig) retries() int {
+	if n.Retries != nil {
+		return *n.Retries
+	}
+	return defaultNetRetries
+}
+
+// retryBackoff returns the configured wait before the first retry
+func (n NetworkConfig) retryBackoff() time.Duration {
+	if d, err := time.ParseDuration(n.RetryBackoff); err == nil && d > 0 {
+		return d
+	}
+	return defaultNetRetryBackoff
+}
+
+// permanentError marks a failure that retrying can't fix, like a 404
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// httpStatusError is a response with an unexpected status code
+type httpStatusError struct {
+	code int
+	err  error
+}
+
+func (e *httpStatusError) Error() string { return e.err.Error() }
+func (e *httpStatusError) Unwrap() error { return e.err }
+
+// isNotFound reports whether err is a 404 response
+func isNotFound(err error) bool {
+	var status *httpStatusError
+	return errors.As(err, &status) && status.code == http.StatusNotFound
+}
+
+// withRetries runs fn until it succeeds, fails permanently or runs out of retries
+func withRetries(what string, fn func() error) error {
+	n := networkConfig()
+	wait := n.retryBackoff()
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		var perm *permanentError
+		if err == nil || errors.As(err, &perm) || attempt > n.retries() {
+			return err
+		}
+		eprintf("[WARN] %s failed (%v), retrying in %s (%d/%d)\n", what, err, wait, attempt, n.retries())
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// idleTimeoutBody aborts the request once no data arrived for the timeout
+type idleTimeoutBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	cancel  context.CancelFunc
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timer.Reset(b.timeout)
+	}
+	if err != nil && err != io.EOF && b.ctx.Err() != nil {
+		err = fmt.Errorf("no data received for %s: %w", b.timeout, err)
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// httpGet makes a single GET request under the network timeout policy. Any status
+// other than 200 is an error, client errors (4xx) are marked permanent.
+func httpGet(url string) (*http.Response, error) {
+	return httpGetRange(url, "")
+}
+
+// httpGetRange is httpGet for the byte range spec (e.g. "bytes=0-1023") of url, anything
+// but a 206 answering it is an error. An empty spec gets the whole file.
+func httpGetRange(url, spec string) (*http.Response, error) {
+	if bundleDir != "" {
+		return nil, &permanentError{fmt.Errorf("%s: no network access while applying a bundle", url)}
+	}
+	timeout := networkConfig().timeout()
+	ctx, cancel := context.WithCancel(context.Background())
+	timer := time.AfterFunc(timeout, cancel)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		timer.Stop()
+		cancel()
+		return nil, &permanentError{err}
+	}
+	want := http.StatusOK
+	if spec != "" {
+		req.Header.Set("Range", spec)
+		want = http.StatusPartialContent
+	}
+	debugf("http", "GET %s %s", url, spec)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		debugf("http", "GET %s failed: %v", url, err)
+		timer.Stop()
+		cancel()
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("no response from %s within %s", url, timeout)
+		}
+		return nil, err
+	}
+	debugf("http", "GET %s: %s, %d bytes, %s", url, resp.Status, resp.ContentLength, resp.Proto)
+	resp.Body = &idleTimeoutBody{ReadCloser: resp.Body, ctx: ctx, cancel: cancel, timer: timer, timeout: timeout}
+	if resp.StatusCode != want {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		resp.Body.Close()
+		err := &httpStatusError{code: resp.StatusCode, err: fmt.Errorf("fetching %s: status %d, content-type %s, body: %s", url, resp.StatusCode, resp.Header.Get("Content-Type"), string(body))}
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			return nil, &permanentError{err}
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// maxErrorBody is how much of an error response ends up in the error message
+const maxErrorBody = 512
+
+// readLimited reads r fully, failing instead of buffering more than limit bytes
+func readLimited(r io.Reader, limit int64, what string) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%s is larger than %s", what, humanSize(limit))
+	}
+	return data, nil
+}
@@ -0,0 +1,131 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	oldConfig := globalConfig
+	defer func() { globalConfig = oldConfig }()
+	retries := 2
+	globalConfig = &Config{Network: NetworkConfig{Retries: &retries, RetryBackoff: "1ms", Timeout: "200ms"}}
+
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/flaky":
+			if hits.Add(1) < 3 {
+				http.Error(w, "busy", http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("ok"))
+		case "/stall":
+			w.Write([]byte("a"))
+			w.(http.Flusher).Flush()
+			time.Sleep(500 * time.Millisecond)
+		default:
+			hits.Add(1)
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	get := func(path string) error {
+		return withRetries("Fetching "+path, func() error {
+			resp, err := httpGet(srv.URL + path)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			_, err = io.ReadAll(resp.Body)
+			return err
+		})
+	}
+
+	// Server errors are retried until they succeed
+	if err := get("/flaky"); err != nil || hits.Load() != 3 {
+		t.Errorf("flaky fetch = %v after %d attempts", err, hits.Load())
+	}
+	// Client errors are permanent
+	hits.Store(0)
+	var perm *permanentError
+	if err := get("/missing"); !errors.As(err, &perm) || hits.Load() != 1 {
+		t.Errorf("404 = %v after %d attempts", err, hits.Load())
+	}
+	// A body that stops sending data is aborted after the idle timeout
+	if err := get("/stall"); err == nil {
+		t.Error("stalled fetch succeeded")
+	}
+
+	if err := (NetworkConfig{Timeout: "soon"}).validate(); err == nil {
+		t.Error("invalid timeout accepted")
+	}
+}
+
+func TestPinnedHosts(t *testing.T) {
+	oldConfig := globalConfig
+	defer func() { globalConfig = oldConfig }()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Host))
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	globalConfig = &Config{Network: NetworkConfig{Hosts: map[string]string{"mirror.apkg.invalid": "127.0.0.1"}, IPFamily: "ipv4"}}
+
+	// The pinned name never goes through DNS, the request still carries it
+	resp, err := httpGet("http://mirror.apkg.invalid:" + port + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "mirror.apkg.invalid:"+port {
+		t.Errorf("Host header %q", body)
+	}
+
+	if err := (NetworkConfig{Hosts: map[string]string{"a": "not-an-ip"}}).validate(); err == nil {
+		t.Error("pin to a non-IP accepted")
+	}
+	if err := (NetworkConfig{IPFamily: "ipv5"}).validate(); err == nil {
+		t.Error("unknown IP family accepted")
+	}
+	ipFamilyOverride = "ipv6"
+	defer func() { ipFamilyOverride = "" }()
+	if f := globalConfig.Network.ipFamily(); f != "ipv6" {
+		t.Errorf("-6 didn't override ip_family, got %s", f)
+	}
+}
+
+func TestNetworkProxy(t *testing.T) {
+	oldConfig := globalConfig
+	defer func() { globalConfig = oldConfig }()
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("proxied " + r.URL.String()))
+	}))
+	defer proxy.Close()
+	globalConfig = &Config{Network: NetworkConfig{Proxy: proxy.URL}}
+	resp, err := httpGet("http://mirror.apkg.invalid/v3.22/main/x86_64/APKINDEX.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if body, _ := io.ReadAll(resp.Body); string(body) != "proxied http://mirror.apkg.invalid/v3.22/main/x86_64/APKINDEX.tar.gz" {
+		t.Errorf("proxy got %q", body)
+	}
+	for proxy, ok := range map[string]bool{"socks5://127.0.0.1:1080": true, "https://proxy:3128": true, "ftp://proxy": false, "proxy:3128": false} {
+		if err := (NetworkConfig{Proxy: proxy}).validate(); (err == nil) != ok {
+			t.Errorf("validate(%s) = %v", proxy, err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// withGroups are the optional groups enabled with -with, on top of with_optional
+var withGroups []string
+
+// OptionalGroup is a tier of packages only installed when it's enabled
+type OptionalGroup struct {
+	// Packages are installed as they are
+	Packages []string `yaml:"packages,omitempty"`
+	// Subpackages are suffixes like -doc or -openrc, the matching subpackage of every
+	// configured package is installed when the repos have it
+	Subpackages []string `yaml:"subpackages,omitempty"`
+}
+
+// validateOptionalGroups checks that every enabled group is defined
+func validateOptionalGroups(cfg *Config) error {
+	for _, name := range append(append([]string{}, cfg.WithOptional...), withGroups...) {
+		if _, ok := cfg.OptionalGroups[name]; !ok {
+			return fmt.Errorf("optional group %q is enabled but not defined in optional_groups", name)
+		}
+	}
+	return nil
+}
+
+// optionalEnabled reports whether the optional group name is enabled
+func optionalEnabled(cfg *Config, name string) bool {
+	for _, g := range append(append([]string{}, cfg.WithOptional...), withGroups...) {
+		if g == name {
+			return true
+		}
+	}
+	return false
+}
+
+// optionalMembers returns the packages of group g the repos have
+func optionalMembers(cfg *Config, g OptionalGroup, pkgMap map[string]APKPackage) []string {
+	var members []string
+	for _, pkg := range g.Packages {
+		if _, ok := pkgMap[pkg]; ok {
+			members = append(members, pkg)
+		}
+	}
+	for _, pkg := range cfg.Packages {
+		if _, optional := cfg.optionalOf[pkg]; optional {
+			continue
+		}
+		for _, suffix := range g.Subpackages {
+			if _, ok := pkgMap[pkg+suffix]; ok {
+				members = append(members, pkg+suffix)
+			}
+		}
+	}
+	return members
+}
+
+// addOptionalPackages adds the packages of the enabled optional groups to the
+// configured ones, remembering which group brought each of them in
+func addOptionalPackages(cfg *Config, pkgMap map[string]APKPackage) {
+	if cfg.optionalOf != nil {
+		return
+	}
+	cfg.optionalOf = map[string]string{}
+	configured := map[string]bool{}
+	for _, pkg := range cfg.Packages {
+		configured[pkg] = true
+	}
+	names := make([]string, 0, len(cfg.OptionalGroups))
+	for name := range cfg.OptionalGroups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var added []string
+	for _, name := range names {
+		if !optionalEnabled(cfg, name) {
+			continue
+		}
+		for _, pkg := range optionalMembers(cfg, cfg.OptionalGroups[name], pkgMap) {
+			if !configured[pkg] {
+				configured[pkg] = true
+				cfg.optionalOf[pkg] = name
+				added = append(added, pkg)
+			}
+		}
+	}
+	cfg.Packages = append(cfg.Packages, added...)
+}
+
+// optionalSummary describes every optional group for the plan: what an enabled one
+// adds and what a disabled one would
+func optionalSummary(cfg *Config, pkgMap map[string]APKPackage) []string {
+	names := make([]string, 0, len(cfg.OptionalGroups))
+	for name := range cfg.OptionalGroups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var lines []string
+	for _, name := range names {
+		if optionalEnabled(cfg, name) {
+			var pkgs []string
+			for pkg, g := range cfg.optionalOf {
+				if g == name {
+					pkgs = append(pkgs, pkg)
+				}
+			}
+			sort.Strings(pkgs)
+			lines = append(lines, fmt.Sprintf("%s: enabled, %d packages %s", name, len(pkgs), strings.Join(pkgs, " ")))
+			continue
+		}
+		pkgs := optionalMembers(cfg, cfg.OptionalGroups[name], pkgMap)
+		lines = append(lines, fmt.Sprintf("%s: not enabled (-with %s), %d packages available", name, name, len(pkgs)))
+	}
+	return lines
+}
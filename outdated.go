@@ -0,0 +1,178 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// maxSecdbSize bounds a secdb file, the biggest Alpine one is a few MiB
+const maxSecdbSize = 64 << 20
+
+// secdbFile is the layout of an Alpine secdb JSON file (https://secdb.alpinelinux.org)
+type secdbFile struct {
+	Packages []struct {
+		Pkg struct {
+			Name     string              `json:"name"`
+			Secfixes map[string][]string `json:"secfixes"`
+		} `json:"pkg"`
+	} `json:"packages"`
+}
+
+// secdbFixes maps an origin package to the versions that fixed vulnerabilities and
+// the CVEs each of them fixed
+type secdbFixes map[string]map[string][]string
+
+// loadSecdb reads and merges the secdb files at urls (or local paths)
+func loadSecdb(urls []string) (secdbFixes, error) {
+	fixes := secdbFixes{}
+	for _, url := range urls {
+		var data []byte
+		var err error
+		if isRemoteConfig(url) {
+			err = withRetries("Fetching "+url, func() error {
+				resp, err := httpGet(url)
+				if err != nil {
+					return err
+				}
+				defer resp.Body.Close()
+				data, err = readLimited(resp.Body, maxSecdbSize, url)
+				return err
+			})
+		} else {
+			data, err = os.ReadFile(url)
+		}
+		if err != nil {
+			return nil, err
+		}
+		var f secdbFile
+		if err := json.Unmarshal(data, &f); err != nil {
+			return nil, fmt.Errorf("%s: %w", url, err)
+		}
+		for _, p := range f.Packages {
+			if fixes[p.Pkg.Name] == nil {
+				fixes[p.Pkg.Name] = map[string][]string{}
+			}
+			for ver, cves := range p.Pkg.Secfixes {
+				fixes[p.Pkg.Name][ver] = append(fixes[p.Pkg.Name][ver], cves...)
+			}
+		}
+	}
+	return fixes, nil
+}
+
+// fixedBetween returns the CVEs of origin fixed by a version newer than from and no
+// newer than to, i.e. what upgrading from from to to fixes
+func (s secdbFixes) fixedBetween(origin, from, to string) []string {
+	var cves []string
+	for ver, fixed := range s[origin] {
+		if ver == "0" {
+			continue // "0" lists what never affected Alpine
+		}
+		if compareAPKVersions(ver, from) > 0 && compareAPKVersions(ver, to) <= 0 {
+			cves = append(cves, fixed...)
+		}
+	}
+	sort.Strings(cves)
+	return cves
+}
+
+// OutdatedPkg is an installed package with a newer version in the repos
+type OutdatedPkg struct {
+	Name      string   `json:"name"`
+	Installed string   `json:"installed"`
+	Candidate string   `json:"candidate"`
+	Repo      string   `json:"repo"`
+	Security  bool     `json:"security"`
+	Fixes     []string `json:"fixes,omitempty"`
+}
+
+// findOutdated lists the installed packages the repos have newer versions of
+func findOutdated(installedPkgs map[string]string, pkgMap map[string]APKPackage, sourceRepo map[string]string, secdb secdbFixes) []OutdatedPkg {
+	outdated := []OutdatedPkg{}
+	for name, ver := range installedPkgs {
+		pkg, ok := pkgMap[name]
+		if !ok || compareAPKVersions(pkg.Version, ver) <= 0 {
+			continue
+		}
+		o := OutdatedPkg{Name: name, Installed: ver, Candidate: pkg.Version, Repo: sourceRepo[name]}
+		if secdb != nil {
+			o.Fixes = secdb.fixedBetween(pkgOrigin(pkg), ver, pkg.Version)
+			o.Security = len(o.Fixes) > 0
+		}
+		outdated = append(outdated, o)
+	}
+	sort.Slice(outdated, func(i, j int) bool { return outdated[i].Name < outdated[j].Name })
+	return outdated
+}
+
+// cmdOutdated implements `apkg outdated [-security]`: the installed packages the repos
+// have upgrades for, without changing anything
+func cmdOutdated(configPath string, args []string) int {
+	fs := flag.NewFlagSet("outdated", flag.ExitOnError)
+	security := fs.Bool("security", false, "Only list upgrades that fix a vulnerability listed in the secdb")
+	fs.Parse(args)
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		eprintf("[FATAL] Failed to read config: %v\n", err)
+		return 1
+	}
+	globalConfig = cfg
+	if *security && len(cfg.Secdb) == 0 {
+		eprintf("[FATAL] -security needs secdb urls in the config\n")
+		return 1
+	}
+	installedPkgs, err := readInstalledPkgs(statePath("installed.yaml"))
+	if err != nil {
+		eprintf("[FATAL] Failed to read installed.yaml: %v\n", err)
+		return 1
+	}
+	pkgMap, sourceRepo, err := fetchAndParseAllAPKIndexes(cfg.Repos)
+	if err != nil {
+		eprintf("[FATAL] Error fetching APKINDEX: %v\n", err)
+		return 2
+	}
+	var secdb secdbFixes
+	if len(cfg.Secdb) > 0 {
+		if secdb, err = loadSecdb(cfg.Secdb); err != nil {
+			eprintf("[ERROR] Failed to load the secdb: %v\n", err)
+			return 2
+		}
+	}
+	outdated := findOutdated(installedPkgs, pkgMap, sourceRepo, secdb)
+	if *security {
+		kept := []OutdatedPkg{}
+		for _, o := range outdated {
+			if o.Security {
+				kept = append(kept, o)
+			}
+		}
+		outdated = kept
+	}
+	if jsonOut != nil {
+		enc := json.NewEncoder(jsonOut)
+		enc.SetIndent("", "  ")
+		enc.Encode(outdated)
+		return 0
+	}
+	if len(outdated) == 0 {
+		printf("Every installed package is up to date.\n")
+		return 0
+	}
+	for _, o := range outdated {
+		mark := ""
+		if o.Security {
+			mark = fmt.Sprintf("  [security: %d fixes]", len(o.Fixes))
+		}
+		printf("%-30s %-18s -> %-18s %s%s\n", o.Name, o.Installed, o.Candidate, o.Repo, mark)
+	}
+	return 0
+}
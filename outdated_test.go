@@ -0,0 +1,75 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFindOutdated(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"packages": [{"pkg": {"name": "openssl", "secfixes": {
+			"0": ["CVE-2000-0001"],
+			"3.3.1-r0": ["CVE-2024-0001"],
+			"3.3.2-r0": ["CVE-2024-0002", "CVE-2024-0003"],
+			"3.3.3-r0": ["CVE-2025-0001"]}}}]}`))
+	}))
+	defer srv.Close()
+	secdb, err := loadSecdb([]string{srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	installed := map[string]string{"libssl3": "3.3.1-r0", "busybox": "1.37.0-r19", "curl": "8.9.0-r0", "gone": "1.0-r0"}
+	pkgMap := map[string]APKPackage{
+		"libssl3": {Name: "libssl3", Version: "3.3.2-r0", Origin: "openssl"},
+		"busybox": {Name: "busybox", Version: "1.37.0-r19"},
+		"curl":    {Name: "curl", Version: "8.10.0-r0"},
+	}
+	got := findOutdated(installed, pkgMap, map[string]string{"curl": "main", "libssl3": "main"}, secdb)
+	if len(got) != 2 || got[0].Name != "curl" || got[1].Name != "libssl3" {
+		t.Fatalf("outdated %+v", got)
+	}
+	if got[0].Security || got[0].Candidate != "8.10.0-r0" || got[0].Repo != "main" {
+		t.Errorf("curl listed as %+v", got[0])
+	}
+	if !got[1].Security || strings.Join(got[1].Fixes, " ") != "CVE-2024-0002 CVE-2024-0003" {
+		t.Errorf("libssl3 listed as %+v", got[1])
+	}
+}
+
+func TestAutoUpgradePolicy(t *testing.T) {
+	cfg := &Config{AutoUpgrade: AutoUpgradeConfig{Allow: []string{"tzdata", "ca-certificates*"}}}
+	outdated := []OutdatedPkg{
+		{Name: "busybox", Installed: "1.37.0-r18", Candidate: "1.37.0-r19"},
+		{Name: "ca-certificates-bundle", Installed: "20241121-r1", Candidate: "20250619-r0"},
+		{Name: "libssl3", Installed: "3.3.1-r0", Candidate: "3.3.2-r0", Security: true, Fixes: []string{"CVE-2024-0002"}},
+	}
+	picked := autoUpgradeCandidates(cfg, outdated)
+	if len(picked) != 2 || picked[0].Name != "ca-certificates-bundle" || picked[1].Name != "libssl3" {
+		t.Errorf("picked %+v", picked)
+	}
+
+	oldOnly := onlyUpgrade
+	onlyUpgrade = map[string]bool{"libssl3": true}
+	defer func() { onlyUpgrade = oldOnly }()
+	pkgMap := map[string]APKPackage{
+		"busybox": {Name: "busybox", Version: "1.37.0-r19"},
+		"libssl3": {Name: "libssl3", Version: "3.3.2-r0"},
+		"curl":    {Name: "curl", Version: "8.9.0-r0"},
+	}
+	installed := map[string]string{"busybox": "1.37.0-r18", "libssl3": "3.3.1-r0"}
+	got := holdUpgrades([]string{"busybox", "curl", "libssl3"}, pkgMap, installed)
+	if strings.Join(got, " ") != "libssl3" {
+		t.Errorf("expected the busybox upgrade held back and curl not installed, got %v", got)
+	}
+	if removed := removedPackages(&Config{}, installed, got); len(removed) != 0 {
+		t.Errorf("an -only-upgrade round removed %v", removed)
+	}
+}
@@ -0,0 +1,577 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultPeerPort is where `apkg peers serve` listens unless told otherwise
+const defaultPeerPort = 8771
+
+// defaultPeerTimeout is how long discovery waits for answers
+const defaultPeerTimeout = time.Second
+
+// peerService is the mDNS service apkg hosts serving their cache announce
+const peerService = "_apkg._tcp.local"
+
+// mdnsAddr is the mDNS group discovery asks
+var mdnsAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// PeersConfig lets apkg fetch packages from the package caches of other hosts before the mirrors
+type PeersConfig struct {
+	// Discover finds the hosts running `apkg peers serve` on the LAN with mDNS
+	Discover bool `yaml:"discover,omitempty"`
+	// Static are peers used without discovery, e.g. http://10.0.0.5:8771
+	Static []string `yaml:"static,omitempty"`
+	// Timeout is how long discovery waits for answers (default 1s)
+	Timeout string `yaml:"timeout,omitempty"`
+}
+
+// validate checks the static peer URLs and the discovery timeout
+func (p PeersConfig) validate() error {
+	for _, peer := range p.Static {
+		if u, err := url.Parse(peer); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("peer %q is not an http(s) URL", peer)
+		}
+	}
+	if p.Timeout != "" {
+		if d, err := time.ParseDuration(p.Timeout); err != nil || d <= 0 {
+			return fmt.Errorf("peers timeout %q is not a positive duration", p.Timeout)
+		}
+	}
+	return nil
+}
+
+// timeout returns the configured discovery timeout
+func (p PeersConfig) timeout() time.Duration {
+	if d, err := time.ParseDuration(p.Timeout); err == nil && d > 0 {
+		return d
+	}
+	return defaultPeerTimeout
+}
+
+// runPeers are the peers of this run, discovered on first use
+var runPeers struct {
+	once  sync.Once
+	peers []string
+}
+
+// activePeers returns the static and discovered peers of the config being applied
+func activePeers() []string {
+	if globalConfig == nil {
+		return nil
+	}
+	cfg := globalConfig.Peers
+	runPeers.once.Do(func() {
+		runPeers.peers = append([]string(nil), cfg.Static...)
+		if !cfg.Discover {
+			return
+		}
+		found, err := discoverPeers(mdnsAddr, cfg.timeout())
+		if err != nil {
+			eprintf("[WARN] Peer discovery failed: %v\n", err)
+		}
+		runPeers.peers = append(runPeers.peers, found...)
+		debugf("http", "Peers: %v", runPeers.peers)
+	})
+	return runPeers.peers
+}
+
+// peerClient fetches from peers directly, they're on the LAN and never behind the configured proxy
+var peerClient = &http.Client{Transport: &http.Transport{Proxy: nil}, Timeout: 5 * time.Minute}
+
+// fetchFromPeers fetches info of repo from the first peer that has it into dest. Only a
+// package matching the checksum of its index entry is taken, it returns false when no
+// peer had one (or the index has no checksum to verify against).
+func fetchFromPeers(repo string, info APKPackage, dest string) (string, bool) {
+	if info.Checksum == "" {
+		return "", false
+	}
+	rel := filepath.ToSlash(cacheEntryPath("", repo, info.Filename))
+	for _, peer := range activePeers() {
+		sum, err := fetchFromPeer(strings.TrimSuffix(peer, "/")+"/"+rel, info, dest)
+		if err == nil {
+			printf("Fetched %s from peer %s\n", info.Filename, peer)
+			return sum, true
+		}
+		os.Remove(dest)
+		debugf("http", "Peer %s: %s: %v", peer, info.Filename, err)
+	}
+	return "", false
+}
+
+// fetchFromPeer downloads u to dest and verifies it against info
+func fetchFromPeer(u string, info APKPackage, dest string) (string, error) {
+	resp, err := peerClient.Get(u)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %d", resp.StatusCode)
+	}
+	f, err := os.Create(dest)
+	if err != nil {
+		return "", err
+	}
+	sum, err := copySHA256(f, io.LimitReader(resp.Body, max(info.Size, 0)+1))
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+	if err := verifyPackageChecksum(dest, info); err != nil {
+		return "", err
+	}
+	return sum, nil
+}
+
+// errChecksum is returned for packages not matching their index entry
+var errChecksum = errors.New("package doesn't match its index entry")
+
+// verifyPackageChecksum checks a package against its index entry: the size, the sha1 of its
+// control member against the Q1 checksum (C:) and the sha256 of the data that follows it
+// against the datahash of its .PKGINFO. Together they cover everything but the signature.
+func verifyPackageChecksum(path string, info APKPackage) error {
+	wantSHA1, err := indexSHA1(info)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size > 0 && st.Size() != info.Size {
+		return fmt.Errorf("%w: %d bytes, the index says %d", errChecksum, st.Size(), info.Size)
+	}
+	bounds, err := gzipMembers(f)
+	if err != nil {
+		return err
+	}
+	// A signature member comes first in signed packages, the control member follows
+	control := 0
+	if name, _ := firstTarEntry(io.NewSectionReader(f, 0, bounds[1])); strings.HasPrefix(name, ".SIGN.") {
+		control = 1
+	}
+	if len(bounds) < control+3 {
+		return fmt.Errorf("%w: no data member", errChecksum)
+	}
+	start, end := bounds[control], bounds[control+1]
+	h := sha1.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, start, end-start)); err != nil {
+		return err
+	}
+	if !bytes.Equal(h.Sum(nil), wantSHA1) {
+		return fmt.Errorf("%w: control checksum differs", errChecksum)
+	}
+	if err := checkDataHash(f, start, end, st.Size()); err != nil {
+		return fmt.Errorf("%w: %v", errChecksum, err)
+	}
+	return nil
+}
+
+// indexSHA1 decodes the Q1 checksum (C:) of an index entry, the sha1 of its control member
+func indexSHA1(info APKPackage) ([]byte, error) {
+	want, ok := strings.CutPrefix(info.Checksum, "Q1")
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported checksum %q", errChecksum, info.Checksum)
+	}
+	sum, err := base64.StdEncoding.DecodeString(want)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad checksum %q", errChecksum, info.Checksum)
+	}
+	return sum, nil
+}
+
+// checkDataHash checks the data of an apk, what follows its control member from start
+// to end up to size, against the datahash of the control member's .PKGINFO
+func checkDataHash(f io.ReaderAt, start, end, size int64) error {
+	pkgInfo, err := readControlPkgInfo(io.NewSectionReader(f, start, end-start))
+	if err != nil {
+		return err
+	}
+	datahash := ""
+	if v := pkgInfo["datahash"]; len(v) > 0 {
+		datahash = v[0]
+	}
+	d := sha256.New()
+	if _, err := io.Copy(d, io.NewSectionReader(f, end, size-end)); err != nil {
+		return err
+	}
+	if datahash == "" || hex.EncodeToString(d.Sum(nil)) != datahash {
+		return errors.New("data hash differs")
+	}
+	return nil
+}
+
+// gzipMembers returns the offsets the gzip members of r start at, followed by the end of the last
+func gzipMembers(r io.Reader) ([]int64, error) {
+	or := &offsetReader{r: bufio.NewReader(r)}
+	zr, err := gzip.NewReader(or)
+	if err != nil {
+		return nil, err
+	}
+	bounds := []int64{0}
+	for {
+		zr.Multistream(false)
+		if _, err := io.Copy(io.Discard, zr); err != nil {
+			return nil, err
+		}
+		bounds = append(bounds, or.n)
+		if err := zr.Reset(or); err == io.EOF {
+			return bounds, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// firstTarEntry returns the name of the first entry of a gzipped tar member
+func firstTarEntry(r io.Reader) (string, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return "", err
+	}
+	hdr, err := tar.NewReader(zr).Next()
+	if err != nil {
+		return "", err
+	}
+	return hdr.Name, nil
+}
+
+// readControlPkgInfo parses the .PKGINFO of a gzipped control member
+func readControlPkgInfo(r io.Reader) (map[string][]string, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, errors.New("no .PKGINFO")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimPrefix(hdr.Name, "./") == ".PKGINFO" {
+			return parsePkgInfo(tr)
+		}
+	}
+}
+
+// peerHandler serves the valid entries of cacheDir to peers
+func peerHandler(cacheDir string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rel := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+		dir, file := path.Split(rel)
+		if strings.Count(rel, "/") != 1 || !strings.HasSuffix(file, ".apk") {
+			http.NotFound(w, r)
+			return
+		}
+		p := filepath.Join(cacheDir, filepath.FromSlash(dir), file)
+		if _, err := os.Stat(p); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		f, err := openCacheEntry(p)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		st, err := f.Stat()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.ServeContent(w, r, file, st.ModTime(), f)
+	})
+}
+
+// openCacheEntry opens the cache entry at p when it's complete and valid, never one being
+// written. Entries are replaced by renames, the open file stays what was verified.
+func openCacheEntry(p string) (*os.File, error) {
+	unlock, err := lockCacheEntry(p)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if _, ok := validCacheEntry(p, 0); !ok {
+		return nil, os.ErrNotExist
+	}
+	return os.Open(p)
+}
+
+// dnsName encodes name as DNS labels
+func dnsName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// readDNSName decodes the (possibly compressed) name at off of msg, returning the offset after it
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; jumps < 16; {
+		if off >= len(msg) {
+			return "", 0, errors.New("truncated name")
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, "."), end, nil
+		case n&0xC0 == 0xC0:
+			if off+1 >= len(msg) {
+				return "", 0, errors.New("truncated pointer")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+			jumps++
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errors.New("truncated label")
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+	return "", 0, errors.New("name compression loop")
+}
+
+// DNS record types and classes mDNS discovery uses
+const (
+	dnsTypePTR = 12
+	dnsTypeSRV = 33
+	dnsTypeANY = 255
+	dnsClassIN = 1
+	// dnsUnicast asks for a unicast answer in a question, marks a unique record in an answer
+	dnsUnicast = 0x8000
+)
+
+// dnsRecord appends a resource record to msg
+func dnsRecord(msg []byte, name string, typ, class uint16, rdata []byte) []byte {
+	msg = append(msg, dnsName(name)...)
+	msg = binary.BigEndian.AppendUint16(msg, typ)
+	msg = binary.BigEndian.AppendUint16(msg, class)
+	msg = binary.BigEndian.AppendUint32(msg, 120)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(rdata)))
+	return append(msg, rdata...)
+}
+
+// peerQuery is the mDNS question for apkg peers
+func peerQuery() []byte {
+	msg := []byte{0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	msg = append(msg, dnsName(peerService)...)
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypePTR)
+	return binary.BigEndian.AppendUint16(msg, dnsClassIN|dnsUnicast)
+}
+
+// peerAnswer is the answer of a peer called instance on port to the query with id
+func peerAnswer(id uint16, instance string, port int) []byte {
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = append(msg, 0x84, 0, 0, 0, 0, 2, 0, 0, 0, 0) // response, authoritative, 2 answers
+	full := instance + "." + peerService
+	msg = dnsRecord(msg, peerService, dnsTypePTR, dnsClassIN, dnsName(full))
+	srv := binary.BigEndian.AppendUint16([]byte{0, 0, 0, 0}, uint16(port))
+	srv = append(srv, dnsName(instance+".local")...)
+	return dnsRecord(msg, full, dnsTypeSRV, dnsClassIN|dnsUnicast, srv)
+}
+
+// asksForPeers reports whether msg is a query with a question for peerService
+func asksForPeers(msg []byte) (uint16, bool) {
+	if len(msg) < 12 || msg[2]&0x80 != 0 {
+		return 0, false
+	}
+	off := 12
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[4:])); i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil || next+4 > len(msg) {
+			return 0, false
+		}
+		typ := binary.BigEndian.Uint16(msg[next:])
+		if strings.EqualFold(name, peerService) && (typ == dnsTypePTR || typ == dnsTypeANY) {
+			return binary.BigEndian.Uint16(msg), true
+		}
+		off = next + 4
+	}
+	return 0, false
+}
+
+// peerPort returns the port of the SRV record for a peer in the answer msg, 0 if there is none
+func peerPort(msg []byte) int {
+	if len(msg) < 12 || msg[2]&0x80 == 0 {
+		return 0
+	}
+	off := 12
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[4:])); i++ {
+		_, next, err := readDNSName(msg, off)
+		if err != nil {
+			return 0
+		}
+		off = next + 4
+	}
+	records := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+	for i := 0; i < records; i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil || next+10 > len(msg) {
+			return 0
+		}
+		typ := binary.BigEndian.Uint16(msg[next:])
+		rdlen := int(binary.BigEndian.Uint16(msg[next+8:]))
+		rdata := next + 10
+		if rdata+rdlen > len(msg) {
+			return 0
+		}
+		if typ == dnsTypeSRV && rdlen >= 6 && strings.HasSuffix(strings.ToLower(name), "."+peerService) {
+			return int(binary.BigEndian.Uint16(msg[rdata+4:]))
+		}
+		off = rdata + rdlen
+	}
+	return 0
+}
+
+// discoverPeers asks addr for apkg peers and collects the answers until timeout
+func discoverPeers(addr *net.UDPAddr, timeout time.Duration) ([]string, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := conn.WriteToUDP(peerQuery(), addr); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	seen := map[string]bool{}
+	var peers []string
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return peers, nil // the deadline ends discovery
+		}
+		if port := peerPort(buf[:n]); port != 0 {
+			peer := "http://" + net.JoinHostPort(from.IP.String(), strconv.Itoa(port))
+			if !seen[peer] {
+				seen[peer] = true
+				peers = append(peers, peer)
+			}
+		}
+	}
+}
+
+// answerPeerQueries answers every query for apkg peers read from conn with instance and
+// port, directly to the host asking
+func answerPeerQueries(conn net.PacketConn, instance string, port int) error {
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if id, ok := asksForPeers(buf[:n]); ok {
+			conn.WriteTo(peerAnswer(id, instance, port), from)
+		}
+	}
+}
+
+// cmdPeers implements `apkg peers serve` sharing cache_dir with the other apkg hosts of the
+// LAN, and `apkg peers list` showing the peers this host finds
+func cmdPeers(configPath string, args []string) int {
+	if len(args) == 0 || (args[0] != "serve" && args[0] != "list") {
+		eprintf("Usage: %s [flags] peers serve [-listen :8771] [-no-announce] | peers list\n", os.Args[0])
+		return 1
+	}
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		eprintf("[FATAL] Failed to read config: %v\n", err)
+		return 1
+	}
+	globalConfig = cfg
+	if args[0] == "list" {
+		peers := append([]string(nil), cfg.Peers.Static...)
+		found, err := discoverPeers(mdnsAddr, cfg.Peers.timeout())
+		if err != nil {
+			eprintf("[ERROR] Peer discovery failed: %v\n", err)
+		}
+		for _, p := range append(peers, found...) {
+			printf("%s\n", p)
+		}
+		return 0
+	}
+	fs := flag.NewFlagSet("peers serve", flag.ExitOnError)
+	listen := fs.String("listen", fmt.Sprintf(":%d", defaultPeerPort), "Address to serve the package cache on")
+	noAnnounce := fs.Bool("no-announce", false, "Don't answer mDNS discovery, only peers listed statically find this host")
+	fs.Parse(args[1:])
+	if cfg.CacheDir == "" {
+		eprintf("[FATAL] peers serve shares cache_dir, the config has none\n")
+		return 1
+	}
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		eprintf("[FATAL] %v\n", err)
+		return 1
+	}
+	if !*noAnnounce {
+		conn, err := net.ListenMulticastUDP("udp4", nil, mdnsAddr)
+		if err != nil {
+			eprintf("[FATAL] Failed to join the mDNS group: %v\n", err)
+			return 1
+		}
+		host, _ := os.Hostname()
+		go answerPeerQueries(conn, strings.SplitN(host, ".", 2)[0], ln.Addr().(*net.TCPAddr).Port)
+	}
+	printf("Sharing %s with peers on %s\n", cfg.CacheDir, ln.Addr())
+	srv := &http.Server{
+		Handler:           peerHandler(cfg.CacheDir),
+		ReadHeaderTimeout: proxyReadTimeout,
+		ReadTimeout:       proxyReadTimeout,
+		WriteTimeout:      proxyWriteTimeout,
+		IdleTimeout:       proxyIdleTimeout,
+	}
+	if err := srv.Serve(ln); err != nil {
+		eprintf("[FATAL] %v\n", err)
+		return 2
+	}
+	return 0
+}
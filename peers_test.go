@@ -0,0 +1,147 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// peerTestApk builds a signed package of foo and parses its index entry
+func peerTestApk(t *testing.T) ([]byte, APKPackage) {
+	t.Helper()
+	data := tarGz("usr/bin/foo", "#!/bin/sh\n")
+	datahash := sha256.Sum256(data)
+	control := gzipTar(".PKGINFO", []byte("pkgname = foo\npkgver = 1.0-r0\ndatahash = "+hex.EncodeToString(datahash[:])+"\n"), true)
+	q1 := sha1.Sum(control)
+	apk := append(append(gzipTar(".SIGN.RSA256.test-1.rsa.pub", []byte("sig"), true), control...), data...)
+	index := "P:foo\nV:1.0-r0\nC:Q1" + base64.StdEncoding.EncodeToString(q1[:]) + "\nS:" + strconv.Itoa(len(apk)) + "\n\n"
+	pkgs, err := parseAPKIndex(strings.NewReader(index))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return apk, pkgs["foo"]
+}
+
+func TestVerifyPackageChecksum(t *testing.T) {
+	apk, info := peerTestApk(t)
+	if !strings.HasPrefix(info.Checksum, "Q1") {
+		t.Fatalf("C: not parsed: %+v", info)
+	}
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.apk")
+	os.WriteFile(good, apk, 0644)
+	if err := verifyPackageChecksum(good, info); err != nil {
+		t.Fatalf("verifyPackageChecksum = %v", err)
+	}
+	// The data swapped for other data of the same size, and a package not from this index
+	tampered := append([]byte(nil), apk...)
+	data := tarGz("usr/bin/foo", "#!/bin/su\n")
+	copy(tampered[len(apk)-len(data):], data)
+	os.WriteFile(filepath.Join(dir, "tampered.apk"), tampered, 0644)
+	other := info
+	other.Checksum = "Q1" + base64.StdEncoding.EncodeToString(make([]byte, 20))
+	unsupported := info
+	unsupported.Checksum = "Q2abc"
+	for name, c := range map[string]struct {
+		path string
+		info APKPackage
+	}{
+		"tampered data": {"tampered.apk", info},
+		"other package": {"good.apk", other},
+		"unsupported":   {"good.apk", unsupported},
+	} {
+		if err := verifyPackageChecksum(filepath.Join(dir, c.path), c.info); !errors.Is(err, errChecksum) {
+			t.Errorf("%s: expected errChecksum, got %v", name, err)
+		}
+	}
+}
+
+func TestFetchFromPeers(t *testing.T) {
+	oldConfig := globalConfig
+	defer func() {
+		globalConfig = oldConfig
+		runPeers.once, runPeers.peers = sync.Once{}, nil
+	}()
+	apk, info := peerTestApk(t)
+	const repo = "https://mirror.example/v3.22/main"
+	cacheDir := t.TempDir()
+	entry := cacheEntryPath(cacheDir, repo, info.Filename)
+	os.MkdirAll(filepath.Dir(entry), 0755)
+	os.WriteFile(entry, apk, 0644)
+	sum := sha256.Sum256(apk)
+	os.WriteFile(entry+".sha256", []byte(hex.EncodeToString(sum[:])+"\n"), 0644)
+	peer := httptest.NewServer(peerHandler(cacheDir))
+	defer peer.Close()
+	empty := httptest.NewServer(peerHandler(t.TempDir()))
+	defer empty.Close()
+
+	globalConfig = &Config{Peers: PeersConfig{Static: []string{empty.URL, peer.URL}}}
+	runPeers.once, runPeers.peers = sync.Once{}, nil
+	dest := filepath.Join(t.TempDir(), "foo.apk")
+	got, ok := fetchFromPeers(repo, info, dest)
+	if !ok || got != hex.EncodeToString(sum[:]) {
+		t.Fatalf("fetchFromPeers = %q, %v", got, ok)
+	}
+	// A package the peer has under another version than the index lists is not taken
+	changed := info
+	changed.Checksum = "Q1" + base64.StdEncoding.EncodeToString(make([]byte, 20))
+	if _, ok := fetchFromPeers(repo, changed, dest); ok {
+		t.Error("package not matching the index was taken")
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Error("rejected package was left behind")
+	}
+	// Without a checksum nothing is fetched from peers
+	info.Checksum = ""
+	if _, ok := fetchFromPeers(repo, info, dest); ok {
+		t.Error("package without checksum was fetched from a peer")
+	}
+	// Only complete cache entries are served
+	os.Remove(entry + ".sha256")
+	info = changed
+	if _, err := fetchFromPeer(peer.URL+"/"+filepath.ToSlash(cacheEntryPath("", repo, info.Filename)), info, dest); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("entry without checksum served: %v", err)
+	}
+	if _, err := fetchFromPeer(peer.URL+"/../etc/passwd", info, dest); err == nil {
+		t.Error("path outside the cache served")
+	}
+}
+
+func TestDiscoverPeers(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer conn.Close()
+	go answerPeerQueries(conn, "builder-7", 8771)
+	peers, err := discoverPeers(conn.LocalAddr().(*net.UDPAddr), 300*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0] != "http://127.0.0.1:8771" {
+		t.Errorf("discoverPeers = %v", peers)
+	}
+	if _, ok := asksForPeers(peerAnswer(0, "builder-7", 8771)); ok {
+		t.Error("an answer was taken for a query")
+	}
+	if port := peerPort(peerQuery()); port != 0 {
+		t.Errorf("a query was taken for an answer with port %d", port)
+	}
+}
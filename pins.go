@@ -0,0 +1,141 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// pinSep separates a packages: entry from the repo it's pinned to, as in foo@<repo>
+const pinSep = "@"
+
+// splitPin splits a packages: entry into the package and the repo it's pinned to, empty
+// for unpinned entries. Direct entries can't be pinned, their source is given already.
+func splitPin(entry string) (name, repo string) {
+	if isDirectEntry(entry) {
+		return entry, ""
+	}
+	name, repo, ok := strings.Cut(entry, pinSep)
+	if !ok {
+		return entry, ""
+	}
+	return name, repo
+}
+
+// splitPins moves the repo pins of the packages: entries to cfg.pins, leaving the names
+func splitPins(cfg *Config) {
+	for i, entry := range cfg.Packages {
+		name, repo := splitPin(entry)
+		if repo == "" {
+			continue
+		}
+		if cfg.pins == nil {
+			cfg.pins = map[string]string{}
+		}
+		cfg.pins[name] = repo
+		cfg.Packages[i] = name
+	}
+}
+
+// withPins returns the packages: entries with their repo pins written back
+func withPins(packages []string, pins map[string]string) []string {
+	out := make([]string, len(packages))
+	for i, name := range packages {
+		out[i] = name
+		if repo, ok := pins[name]; ok {
+			out[i] = name + pinSep + repo
+		}
+	}
+	return out
+}
+
+// sameRepo reports whether two repos: entries are the same repo
+func sameRepo(a, b string) bool {
+	return strings.TrimRight(a, "/") == strings.TrimRight(b, "/")
+}
+
+// pinnedRepo returns the repo (as fetched, alpine: repos expanded) pkg is pinned to,
+// empty when it isn't pinned. The pin of a package carries over to what its aliases lead
+// to: the indexes are merged before it is known whether it was renamed.
+func (cfg *Config) pinnedRepo(pkg string) string {
+	pin, ok := cfg.pins[pkg]
+	if !ok {
+		names := make([]string, 0, len(cfg.pins))
+		for name := range cfg.pins {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if cfg.renamesLeadTo(name, pkg) {
+				pin, ok = cfg.pins[name], true
+				break
+			}
+		}
+	}
+	if !ok {
+		return ""
+	}
+	specs := cfg.Repos
+	if cfg.repoSpecs != nil {
+		specs = cfg.repoSpecs
+	}
+	for i, spec := range specs {
+		if sameRepo(spec, pin) || sameRepo(cfg.Repos[i], pin) {
+			return cfg.Repos[i]
+		}
+	}
+	return pin
+}
+
+// validatePins checks that every package is pinned to one of the configured repos
+func validatePins(cfg *Config) error {
+	names := make([]string, 0, len(cfg.pins))
+	for name := range cfg.pins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if repo := cfg.pinnedRepo(name); !slices.ContainsFunc(cfg.Repos, func(r string) bool { return sameRepo(r, repo) }) {
+			return fmt.Errorf("package %s is pinned to %s, which is not one of the repos", name, cfg.pins[name])
+		}
+	}
+	return nil
+}
+
+// pinnedElsewhere reports whether pkg is pinned to another repo than repo, so its entry
+// in the index of repo must never be used
+func pinnedElsewhere(pkg, repo string) bool {
+	if globalConfig == nil {
+		return false
+	}
+	pinned := globalConfig.pinnedRepo(pkg)
+	return pinned != "" && !sameRepo(pinned, repo)
+}
+
+// checkPins fails when a pinned package of one of repos (or what it was renamed to) didn't
+// come from its repo, because the repo couldn't be fetched or doesn't have it
+func checkPins(repos []string, pkgMap map[string]APKPackage, sourceRepo map[string]string) error {
+	if globalConfig == nil {
+		return nil
+	}
+	names := make([]string, 0, len(globalConfig.pins))
+	for name := range globalConfig.pins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		repo := globalConfig.pinnedRepo(name)
+		pkg := resolveAlias(globalConfig, name, pkgMap)
+		if slices.Contains(repos, repo) && !sameRepo(sourceRepo[pkg], repo) {
+			return fmt.Errorf("%s is pinned to %s, which doesn't have it (or couldn't be fetched)", name, repo)
+		}
+	}
+	return nil
+}
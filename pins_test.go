@@ -0,0 +1,78 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPackagePins(t *testing.T) {
+	oldConfig, oldState := globalConfig, stateDir
+	stateDir = t.TempDir()
+	defer func() { globalConfig, stateDir = oldConfig, oldState }()
+	serve := func(index string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(index))
+		}))
+	}
+	// Upstream comes first and carries a newer foo than the internal fork
+	upstream := serve("P:foo\nV:9.9-r0\n\nP:bar\nV:1.0-r0\n\n")
+	defer upstream.Close()
+	internal := serve("P:foo\nV:1.0-r5\n\n")
+	defer internal.Close()
+	empty := serve("P:baz\nV:1.0-r0\n\n")
+	defer empty.Close()
+
+	path := filepath.Join(t.TempDir(), "apkg.yaml")
+	os.WriteFile(path, []byte("repos:\n  - "+upstream.URL+"\n  - "+internal.URL+"/\npackages:\n  - foo@"+internal.URL+"\n  - bar\ninstall_dir: /tmp/x\n"), 0644)
+	cfg, err := readConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(cfg.Packages, " ") != "foo bar" || cfg.pinnedRepo("foo") != internal.URL+"/" || cfg.pinnedRepo("bar") != "" {
+		t.Fatalf("packages %v, pins %v", cfg.Packages, cfg.pins)
+	}
+	globalConfig = cfg
+	pkgMap, sourceRepo, err := fetchAndParseAllAPKIndexes(cfg.Repos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkgMap["foo"].Version != "1.0-r5" || !sameRepo(sourceRepo["foo"], internal.URL) || sourceRepo["bar"] != upstream.URL {
+		t.Errorf("foo %s from %s, bar from %s", pkgMap["foo"].Version, sourceRepo["foo"], sourceRepo["bar"])
+	}
+
+	// The pin survives writing the config back
+	if err := writeConfig(path, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); !strings.Contains(string(data), "foo@"+internal.URL) {
+		t.Errorf("pin lost writing the config:\n%s", data)
+	}
+
+	// A pinned repo without the package fails instead of falling back to another repo
+	globalConfig = &Config{Repos: []string{upstream.URL, empty.URL}, pins: map[string]string{"foo": empty.URL}}
+	if _, _, err := fetchAndParseAllAPKIndexes(globalConfig.Repos); err == nil || !strings.Contains(err.Error(), "pinned") {
+		t.Errorf("expected a pin error, got %v", err)
+	}
+
+	// Pins have to name a configured repo, alpine: shorthands as written
+	if err := validatePins(&Config{Repos: []string{upstream.URL}, pins: map[string]string{"foo": "https://elsewhere"}}); err == nil {
+		t.Error("pin to an unknown repo accepted")
+	}
+	alpine := &Config{Repos: []string{"https://mirror/v3.22/main/x86_64"}, repoSpecs: []string{"alpine:v3.22/main"}, pins: map[string]string{"foo": "alpine:v3.22/main"}}
+	if err := validatePins(alpine); err != nil || alpine.pinnedRepo("foo") != "https://mirror/v3.22/main/x86_64" {
+		t.Errorf("alpine: pin = %q, %v", alpine.pinnedRepo("foo"), err)
+	}
+	if name, repo := splitPin("https://example.com/foo@2.apk"); repo != "" || name != "https://example.com/foo@2.apk" {
+		t.Errorf("direct entry split into %q @ %q", name, repo)
+	}
+}
@@ -0,0 +1,334 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// exitChangesPending is returned by -dry-run when applying the config would change the system
+const exitChangesPending = 5
+
+// PlanItem is a single package change of a Plan
+type PlanItem struct {
+	Name       string
+	OldVersion string
+	NewVersion string
+	// DownloadSize and InstalledSize come from the S: and I: index fields, InstalledSize
+	// of a removal comes from the stored .PKGINFO when the package is gone from the repos
+	DownloadSize  int64
+	InstalledSize int64
+	// Group is the optional group that brought the package in, empty for configured ones
+	Group string
+}
+
+// Plan describes what applying the config would change
+type Plan struct {
+	Installs []PlanItem
+	Upgrades []PlanItem
+	Removals []PlanItem
+	// Overrides describes the dependency overrides the resolution applied
+	Overrides []string
+	// Optional describes the optional groups, enabled or not
+	Optional []string
+	// Missing are the packages to install that no index has, they are left out of the plan
+	Missing []string
+}
+
+// resolveInstallSet returns the configured packages and those of the enabled optional groups, plus
+// their dependencies when resolve_deps is enabled, without those the base layer already has.
+// sourceRepo is the repo of every package of pkgMap, see providesMap.
+func resolveInstallSet(cfg *Config, pkgMap map[string]APKPackage, sourceRepo map[string]string) ([]string, error) {
+	addOptionalPackages(cfg, pkgMap)
+	packages := resolveAliases(cfg, pkgMap)
+	installSet := map[string]struct{}{}
+	for _, pkg := range packages {
+		installSet[pkg] = struct{}{}
+	}
+	if cfg.ResolveDeps {
+		deps, err := resolveDependencies(packages, pkgMap, sourceRepo, cfg.DependencyOverrides)
+		if err != nil {
+			return nil, err
+		}
+		for _, pkg := range deps {
+			installSet[pkg] = struct{}{}
+		}
+	}
+	toInstall := []string{}
+	for pkg := range installSet {
+		if providedByBase(pkg, pkgMap) {
+			continue
+		}
+		toInstall = append(toInstall, pkg)
+	}
+	sort.Strings(toInstall)
+	return toInstall, nil
+}
+
+// computePlan compares the packages to install with the installed ones
+func computePlan(cfg *Config, pkgMap map[string]APKPackage, installedPkgs map[string]string, toInstall []string) *Plan {
+	plan := &Plan{Overrides: appliedOverrides(cfg, pkgMap, toInstall), Optional: optionalSummary(cfg, pkgMap)}
+	for _, pkg := range toInstall {
+		info, ok := pkgMap[pkg]
+		if !ok {
+			plan.Missing = append(plan.Missing, pkg)
+			continue
+		}
+		item := PlanItem{Name: pkg, NewVersion: info.Version, DownloadSize: info.Size, InstalledSize: info.InstalledSize, Group: cfg.optionalOf[pkg]}
+		curVer, already := installedPkgs[pkg]
+		if !already {
+			plan.Installs = append(plan.Installs, item)
+		} else if curVer != info.Version {
+			item.OldVersion = curVer
+			plan.Upgrades = append(plan.Upgrades, item)
+		}
+	}
+	for _, pkg := range removedPackages(cfg, installedPkgs, toInstall) {
+		ver := installedPkgs[pkg]
+		item := PlanItem{Name: pkg, OldVersion: ver}
+		if size := storedInstalledSize(pkg); size > 0 {
+			item.InstalledSize = size
+		} else if info, ok := pkgMap[pkg]; ok && info.Version == ver {
+			item.InstalledSize = info.InstalledSize
+		}
+		plan.Removals = append(plan.Removals, item)
+	}
+	return plan
+}
+
+// removedPackages returns the installed packages that are neither configured nor in the
+// resolved install set, dependencies pulled in by resolve_deps stay installed. An -only-upgrade
+// round removes nothing.
+func removedPackages(cfg *Config, installedPkgs map[string]string, toInstall []string) []string {
+	if onlyUpgrade != nil {
+		return nil
+	}
+	keep := map[string]bool{}
+	for _, pkg := range cfg.Packages {
+		if _, renamed := cfg.renamed[pkg]; !renamed {
+			keep[pkg] = true
+		}
+	}
+	for _, pkg := range toInstall {
+		keep[pkg] = true
+	}
+	var removed []string
+	for pkg := range installedPkgs {
+		if !keep[pkg] {
+			removed = append(removed, pkg)
+		}
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+// storedInstalledSize returns the installed size in the stored .PKGINFO of pkg, 0 if unknown
+func storedInstalledSize(pkg string) int64 {
+	pi, err := readPkgInfo(pkg)
+	if err != nil || len(pi["size"]) == 0 {
+		return 0
+	}
+	size, _ := strconv.ParseInt(pi["size"][0], 10, 64)
+	return size
+}
+
+// groupNote marks items of an optional group in the plan output
+func (it PlanItem) groupNote() string {
+	if it.Group == "" {
+		return ""
+	}
+	return " (optional: " + it.Group + ")"
+}
+
+// Empty reports whether the plan changes nothing
+func (p *Plan) Empty() bool {
+	return len(p.Installs) == 0 && len(p.Upgrades) == 0 && len(p.Removals) == 0
+}
+
+// DownloadSize is the total size of the packages that would be downloaded
+func (p *Plan) DownloadSize() int64 {
+	var total int64
+	for _, list := range [][]PlanItem{p.Installs, p.Upgrades} {
+		for _, it := range list {
+			total += it.DownloadSize
+		}
+	}
+	return total
+}
+
+// DiskDelta estimates how much the install root grows (negative when it shrinks)
+func (p *Plan) DiskDelta() int64 {
+	var delta int64
+	for _, it := range p.Installs {
+		delta += it.InstalledSize
+	}
+	for _, it := range p.Upgrades {
+		delta += it.InstalledSize - storedInstalledSize(it.Name)
+	}
+	for _, it := range p.Removals {
+		delta -= it.InstalledSize
+	}
+	return delta
+}
+
+// print writes the plan in a human readable form
+func (p *Plan) print() {
+	if len(p.Optional) > 0 {
+		printf("Optional groups:\n")
+		for _, o := range p.Optional {
+			printf("  - %s\n", o)
+		}
+	}
+	if len(p.Overrides) > 0 {
+		printf("Dependency overrides:\n")
+		for _, o := range p.Overrides {
+			printf("  - %s\n", o)
+		}
+	}
+	if p.Empty() {
+		printf("System is already up to date with the configuration.\n")
+		return
+	}
+	if width := terminalWidth(); width > 0 {
+		p.printColumns(width)
+	} else {
+		for _, it := range p.Installs {
+			printf("  - Install %s (%s) [%s]%s\n", it.Name, it.NewVersion, humanSize(it.InstalledSize), it.groupNote())
+		}
+		for _, it := range p.Upgrades {
+			printf("  - Upgrade %s from %s to %s [%s]%s\n", it.Name, it.OldVersion, it.NewVersion, humanSize(it.InstalledSize), it.groupNote())
+		}
+		for _, it := range p.Removals {
+			printf("  - Uninstall %s (%s)\n", it.Name, it.OldVersion)
+		}
+	}
+	printf("%d to install, %d to upgrade, %d to uninstall\n", len(p.Installs), len(p.Upgrades), len(p.Removals))
+	printf("Download size: %s\n", humanSize(p.DownloadSize()))
+	delta := p.DiskDelta()
+	if delta < 0 {
+		printf("Disk space freed: %s\n", humanSize(-delta))
+	} else {
+		printf("Additional disk space: %s\n", humanSize(delta))
+	}
+}
+
+// printColumns lists the packages of every kind of change in columns fitting width,
+// like apt does, versions and sizes are left to -long
+func (p *Plan) printColumns(width int) {
+	for _, kind := range []struct {
+		title string
+		items []PlanItem
+	}{{"Install", p.Installs}, {"Upgrade", p.Upgrades}, {"Uninstall", p.Removals}} {
+		if len(kind.items) == 0 {
+			continue
+		}
+		names := make([]string, len(kind.items))
+		for i, it := range kind.items {
+			names[i] = it.Name
+		}
+		printf("%s (%d):\n", T(kind.title), len(names))
+		printColumns(os.Stdout, names, width)
+	}
+}
+
+// humanSize formats a byte count like 1.5 MiB
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// configPlan fetches what planning the config needs and computes its plan, the
+// returned map points every direct package at its config entry. full plans every
+// package as an install, as if nothing was installed yet.
+func configPlan(cfg *Config, full bool) (*Plan, map[string]APKPackage, map[string]string, map[string]string, error) {
+	pkgMap, sourceRepo := map[string]APKPackage{}, map[string]string{}
+	var err error
+	if len(cfg.Repos) > 0 {
+		pkgMap, sourceRepo, err = fetchAndParseAllAPKIndexes(cfg.Repos)
+		if err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("fetching APKINDEX: %w", err)
+		}
+	}
+	// Direct .apk entries have to be fetched to learn which version they are
+	workDir, err := newWorkDir("run")
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("creating temp dir: %w", err)
+	}
+	defer cleanupTempDirs(workDir)
+	entries := append([]string(nil), cfg.Packages...)
+	if _, err := resolveDirectPackages(cfg, pkgMap, sourceRepo, workDir); err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("fetching package: %w", err)
+	}
+	direct := map[string]string{}
+	for i, entry := range entries {
+		if isDirectEntry(entry) {
+			direct[cfg.Packages[i]] = entry
+		}
+	}
+	installedPkgs := map[string]string{}
+	if !full {
+		if installedPkgs, err = readInstalledPkgs(statePath("installed.yaml")); err != nil {
+			return nil, nil, nil, nil, fmt.Errorf("reading installed.yaml: %w", err)
+		}
+	}
+	toInstall, err := resolveInstallSet(cfg, pkgMap, sourceRepo)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	plan := computePlan(cfg, pkgMap, installedPkgs, toInstall)
+	return plan, pkgMap, sourceRepo, direct, nil
+}
+
+// cmdStatus implements `apkg status`: exit 0 when the system matches the config,
+// 1 when it drifted and 2 on errors. Only the indexes and direct .apk entries are fetched.
+// A repo that failed to fetch or a package no repo has is an error, the state can't be
+// told from the indexes then.
+func cmdStatus(configPath string) int {
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		eprintf("[ERROR] Failed to read config: %v\n", err)
+		return 2
+	}
+	globalConfig = cfg
+	enableIndexFilter(cfg)
+	if err := loadBase(cfg); err != nil {
+		eprintf("[ERROR] %v\n", err)
+		return 2
+	}
+	plan, _, _, _, err := configPlan(cfg, false)
+	if err != nil {
+		eprintf("[ERROR] %v\n", err)
+		return 2
+	}
+	if len(failedRepos) > 0 {
+		eprintf("[ERROR] Failed to fetch APKINDEX from %s\n", strings.Join(failedRepos, ", "))
+		return 2
+	}
+	if len(plan.Missing) > 0 {
+		eprintf("[ERROR] Not found in any repo: %s\n", strings.Join(plan.Missing, ", "))
+		return 2
+	}
+	if plan.Empty() {
+		printf("Converged.\n")
+		return 0
+	}
+	printf("Drift detected:\n")
+	plan.print()
+	return 1
+}
@@ -0,0 +1,68 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCmdStatus(t *testing.T) {
+	oldConfig, oldState := globalConfig, stateDir
+	defer func() { globalConfig, stateDir = oldConfig, oldState }()
+	stateDir = t.TempDir()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("P:foo\nV:1.1-r0\n\n"))
+	}))
+	defer srv.Close()
+	configPath := filepath.Join(t.TempDir(), "apkg.yaml")
+	os.WriteFile(configPath, []byte("repos: ["+srv.URL+"]\npackages: [foo]\ninstall_dir: "+t.TempDir()+"\n"), 0644)
+
+	for _, tc := range []struct {
+		installed map[string]string
+		want      int
+	}{
+		{map[string]string{"foo": "1.1-r0"}, 0},
+		{map[string]string{"foo": "1.0-r0"}, 1},
+		{map[string]string{}, 1},
+		{map[string]string{"foo": "1.1-r0", "bar": "1.0-r0"}, 1},
+	} {
+		if err := writeInstalledPkgs(statePath("installed.yaml"), tc.installed); err != nil {
+			t.Fatal(err)
+		}
+		if code := cmdStatus(configPath); code != tc.want {
+			t.Errorf("status with %v installed = %d, want %d", tc.installed, code, tc.want)
+		}
+	}
+	writeInstalledPkgs(statePath("installed.yaml"), map[string]string{"foo": "1.1-r0"})
+	// A package no index has, or a repo that can't be fetched, can't be reported as converged
+	os.WriteFile(configPath, []byte("repos: ["+srv.URL+"]\npackages: [foo, gone]\ninstall_dir: "+t.TempDir()+"\n"), 0644)
+	if code := cmdStatus(configPath); code != 2 {
+		t.Errorf("status with a package missing from the indexes = %d, want 2", code)
+	}
+	down := httptest.NewServer(http.NotFoundHandler())
+	defer down.Close()
+	os.WriteFile(configPath, []byte("repos: ["+srv.URL+", "+down.URL+"]\npackages: [foo]\ninstall_dir: "+t.TempDir()+"\n"), 0644)
+	if code := cmdStatus(configPath); code != 2 {
+		t.Errorf("status with a repo failing to fetch = %d, want 2", code)
+	}
+	if code := cmdStatus(filepath.Join(t.TempDir(), "missing.yaml")); code != 2 {
+		t.Errorf("status without a config = %d, want 2", code)
+	}
+}
+
+func TestRemovedPackagesKeepsDependencies(t *testing.T) {
+	cfg := &Config{Packages: []string{"curl"}}
+	installed := map[string]string{"curl": "8.9.1-r0", "libcurl": "8.9.1-r0", "nano": "8.1-r0"}
+	got := removedPackages(cfg, installed, []string{"curl", "libcurl"})
+	if len(got) != 1 || got[0] != "nano" {
+		t.Errorf("removed %v, want only nano", got)
+	}
+}
@@ -0,0 +1,162 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// shQuote quotes s for a POSIX shell
+func shQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// isHTTPRepo reports whether repo can be used by apk or curl as is
+func isHTTPRepo(repo string) bool {
+	return strings.HasPrefix(repo, "http://") || strings.HasPrefix(repo, "https://")
+}
+
+// planEmitter renders a plan in another tool's terms
+type planEmitter struct {
+	w          io.Writer
+	cfg        *Config
+	plan       *Plan
+	pkgMap     map[string]APKPackage
+	sourceRepo map[string]string
+	direct     map[string]string
+}
+
+// changes returns the installs and upgrades of the plan
+func (e *planEmitter) changes() []PlanItem {
+	return append(append([]PlanItem{}, e.plan.Installs...), e.plan.Upgrades...)
+}
+
+// dockerfile renders the plan as RUN apk lines with pinned versions
+func (e *planEmitter) dockerfile() {
+	fmt.Fprintln(e.w, "# Generated by apkg plan -emit dockerfile")
+	var pinned, direct []string
+	for _, it := range e.changes() {
+		if entry, ok := e.direct[it.Name]; ok {
+			src, _ := splitDirectEntry(entry)
+			direct = append(direct, src)
+			continue
+		}
+		if repo := e.sourceRepo[it.Name]; !isHTTPRepo(repo) {
+			fmt.Fprintf(e.w, "# %s comes from %s, which apk can't use\n", it.Name, repo)
+			continue
+		}
+		pinned = append(pinned, it.Name+"="+it.NewVersion)
+	}
+	if len(pinned) > 0 {
+		fmt.Fprint(e.w, "RUN apk add --no-cache")
+		for _, repo := range e.cfg.Repos {
+			if isHTTPRepo(repo) {
+				fmt.Fprintf(e.w, " \\\n    --repository %s", repo)
+			}
+		}
+		for _, p := range pinned {
+			fmt.Fprintf(e.w, " \\\n    %s", p)
+		}
+		fmt.Fprintln(e.w)
+	}
+	if len(direct) > 0 {
+		fmt.Fprintf(e.w, "RUN apk add --no-cache --allow-untrusted %s\n", strings.Join(direct, " "))
+	}
+	if len(e.plan.Removals) > 0 {
+		var names []string
+		for _, it := range e.plan.Removals {
+			names = append(names, it.Name)
+		}
+		fmt.Fprintf(e.w, "RUN apk del --no-cache %s\n", strings.Join(names, " "))
+	}
+}
+
+// shell renders the plan as a POSIX script extracting packages with curl and tar
+func (e *planEmitter) shell() {
+	fmt.Fprintln(e.w, "#!/bin/sh")
+	fmt.Fprintln(e.w, "# Generated by apkg plan -emit sh, maintainer scripts are not run")
+	fmt.Fprintln(e.w, "set -eu")
+	fmt.Fprintf(e.w, "ROOT=\"${ROOT:-%s}\"\n", strings.ReplaceAll(e.cfg.InstallDir, `"`, `\"`))
+	fmt.Fprintln(e.w, `mkdir -p "$ROOT"`)
+	fmt.Fprintln(e.w, `unpack() { tar -xzf - -C "$ROOT" --exclude=.PKGINFO --exclude='.SIGN.*' --exclude='.pre-*' --exclude='.post-*' --exclude=.trigger; }`)
+	for _, it := range e.changes() {
+		fmt.Fprintf(e.w, "# %s %s\n", it.Name, it.NewVersion)
+		if entry, ok := e.direct[it.Name]; ok {
+			src, _ := splitDirectEntry(entry)
+			if isHTTPRepo(src) {
+				fmt.Fprintf(e.w, "curl -fsSL %s | unpack\n", shQuote(src))
+			} else {
+				fmt.Fprintf(e.w, "unpack < %s\n", shQuote(src))
+			}
+			continue
+		}
+		repo := e.sourceRepo[it.Name]
+		if !isHTTPRepo(repo) {
+			fmt.Fprintf(e.w, "# comes from %s, which isn't reachable over HTTP\n", repo)
+			continue
+		}
+		fmt.Fprintf(e.w, "curl -fsSL %s | unpack\n", shQuote(strings.TrimRight(repo, "/")+"/"+e.pkgMap[it.Name].Filename))
+	}
+	for _, it := range e.plan.Removals {
+		fmt.Fprintf(e.w, "# remove %s %s\n", it.Name, it.OldVersion)
+		files, err := readInstalledFiles(it.Name)
+		if err != nil {
+			fmt.Fprintln(e.w, "# its installed files aren't known")
+			continue
+		}
+		for _, rel := range files {
+			fmt.Fprintf(e.w, "rm -f \"$ROOT\"/%s\n", shQuote(rel))
+		}
+	}
+}
+
+// cmdPlan implements `apkg plan [-emit dockerfile|sh] [-full]`
+func cmdPlan(configPath string, args []string) int {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	emit := fs.String("emit", "", "Render the plan as a Dockerfile fragment (dockerfile) or a shell script (sh)")
+	full := fs.Bool("full", false, "Plan every package as if nothing was installed, to reproduce the whole environment")
+	fs.Parse(args)
+	if *emit != "" && *emit != "dockerfile" && *emit != "sh" {
+		eprintf("[FATAL] Unknown -emit %q (known: dockerfile, sh)\n", *emit)
+		return 1
+	}
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		eprintf("[FATAL] Failed to read config: %v\n", err)
+		return 1
+	}
+	globalConfig = cfg
+	// Keep the emitted text alone on stdout
+	out := os.Stdout
+	if *emit != "" {
+		os.Stdout = os.Stderr
+		defer func() { os.Stdout = out }()
+	}
+	if err := loadBase(cfg); err != nil {
+		eprintf("[FATAL] %v\n", err)
+		return 1
+	}
+	plan, pkgMap, sourceRepo, direct, err := configPlan(cfg, *full)
+	if err != nil {
+		eprintf("[FATAL] %v\n", err)
+		return 2
+	}
+	e := &planEmitter{w: out, cfg: cfg, plan: plan, pkgMap: pkgMap, sourceRepo: sourceRepo, direct: direct}
+	switch *emit {
+	case "dockerfile":
+		e.dockerfile()
+	case "sh":
+		e.shell()
+	default:
+		plan.print()
+	}
+	return 0
+}
@@ -0,0 +1,49 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPlanEmitter(t *testing.T) {
+	oldState := stateDir
+	stateDir = t.TempDir()
+	defer func() { stateDir = oldState }()
+
+	repo := "https://dl-cdn.alpinelinux.org/alpine/v3.20/main"
+	e := &planEmitter{
+		cfg: &Config{Repos: []string{repo}, InstallDir: "/opt/root"},
+		plan: &Plan{
+			Installs: []PlanItem{{Name: "busybox", NewVersion: "1.36.1-r0"}, {Name: "tool", NewVersion: "1.0-r0"}},
+			Removals: []PlanItem{{Name: "old", OldVersion: "2.0-r0"}},
+		},
+		pkgMap:     map[string]APKPackage{"busybox": {Name: "busybox", Version: "1.36.1-r0", Filename: "busybox-1.36.1-r0.apk"}},
+		sourceRepo: map[string]string{"busybox": repo},
+		direct:     map[string]string{"tool": "https://example.com/tool-1.0-r0.apk"},
+	}
+
+	var b strings.Builder
+	e.w = &b
+	e.dockerfile()
+	out := b.String()
+	for _, want := range []string{"--repository " + repo, "busybox=1.36.1-r0", "--allow-untrusted https://example.com/tool-1.0-r0.apk", "RUN apk del --no-cache old"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("dockerfile output lacks %q:\n%s", want, out)
+		}
+	}
+
+	b.Reset()
+	e.shell()
+	out = b.String()
+	for _, want := range []string{`ROOT="${ROOT:-/opt/root}"`, "curl -fsSL '" + repo + "/busybox-1.36.1-r0.apk' | unpack", "curl -fsSL 'https://example.com/tool-1.0-r0.apk' | unpack", "installed files aren't known"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("sh output lacks %q:\n%s", want, out)
+		}
+	}
+}
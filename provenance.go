@@ -0,0 +1,139 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// provenanceBuildType identifies how apkg builds a root in provenance statements
+const provenanceBuildType = "https://github.com/lumiini/apkg/apply/v1"
+
+// ResourceDescriptor is an in-toto resource: an artifact with its digests
+type ResourceDescriptor struct {
+	Name   string            `json:"name,omitempty"`
+	URI    string            `json:"uri,omitempty"`
+	Digest map[string]string `json:"digest"`
+}
+
+// ProvenanceStatement is an in-toto v1 statement carrying a SLSA v1 provenance predicate
+type ProvenanceStatement struct {
+	Type          string               `json:"_type"`
+	Subject       []ResourceDescriptor `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     struct {
+		BuildDefinition struct {
+			BuildType            string               `json:"buildType"`
+			ExternalParameters   map[string]any       `json:"externalParameters"`
+			ResolvedDependencies []ResourceDescriptor `json:"resolvedDependencies"`
+		} `json:"buildDefinition"`
+		RunDetails struct {
+			Builder struct {
+				ID string `json:"id"`
+			} `json:"builder"`
+			Metadata struct {
+				StartedOn  string `json:"startedOn"`
+				FinishedOn string `json:"finishedOn"`
+			} `json:"metadata"`
+		} `json:"runDetails"`
+	} `json:"predicate"`
+}
+
+// sha256Digest returns an in-toto digest of data
+func sha256Digest(data []byte) map[string]string {
+	sum := sha256.Sum256(data)
+	return map[string]string{"sha256": hex.EncodeToString(sum[:])}
+}
+
+// rootDigest hashes an install root deterministically: every path in lexical order
+// with its type, permissions and content hash or symlink target
+func rootDigest(root string) (string, error) {
+	h := sha256.New()
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s\tl\t%s\n", filepath.ToSlash(rel), target)
+		case d.IsDir():
+			fmt.Fprintf(h, "%s\td\t%o\n", filepath.ToSlash(rel), info.Mode().Perm())
+		case info.Mode().IsRegular():
+			fmt.Fprintf(h, "%s\tf\t%o\t%s\n", filepath.ToSlash(rel), info.Mode().Perm(), fileSHA256(path))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeProvenance writes a provenance statement of the root built from the config,
+// its lockfile, the repo index snapshots and the installed packages
+func writeProvenance(cfg *Config, configPath string, pkgMap map[string]APKPackage, sourceRepo, pkgDigests map[string]string, startedOn time.Time) error {
+	root, err := rootDigest(cfg.InstallDir)
+	if err != nil {
+		return fmt.Errorf("failed to hash %s: %w", cfg.InstallDir, err)
+	}
+	var st ProvenanceStatement
+	st.Type = "https://in-toto.io/Statement/v1"
+	st.PredicateType = "https://slsa.dev/provenance/v1"
+	st.Subject = []ResourceDescriptor{{Name: cfg.InstallDir, Digest: map[string]string{"sha256": root}}}
+	bd := &st.Predicate.BuildDefinition
+	bd.BuildType = provenanceBuildType
+	bd.ExternalParameters = map[string]any{"config": configPath, "packages": cfg.Packages, "repos": cfg.Repos}
+	bd.ResolvedDependencies = append(bd.ResolvedDependencies, ResourceDescriptor{Name: "config", URI: configPath, Digest: sha256Digest(configData)})
+	if lock, err := os.ReadFile(lockfilePath(configPath)); err == nil {
+		bd.ResolvedDependencies = append(bd.ResolvedDependencies, ResourceDescriptor{Name: "lockfile", URI: lockfilePath(configPath), Digest: sha256Digest(lock)})
+	}
+	for _, repo := range cfg.Repos {
+		if sum, err := indexDigest(repo); err == nil {
+			bd.ResolvedDependencies = append(bd.ResolvedDependencies, ResourceDescriptor{Name: "index", URI: repo, Digest: map[string]string{"sha256": sum}})
+		}
+	}
+	names := make([]string, 0, len(pkgDigests))
+	for name := range pkgDigests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		info := pkgMap[name]
+		uri := info.Filename
+		if repo, ok := sourceRepo[name]; ok {
+			uri = strings.TrimRight(repo, "/") + "/" + info.Filename
+		}
+		bd.ResolvedDependencies = append(bd.ResolvedDependencies, ResourceDescriptor{Name: name + "-" + info.Version, URI: uri, Digest: map[string]string{"sha256": pkgDigests[name]}})
+	}
+	rd := &st.Predicate.RunDetails
+	rd.Builder.ID = "apkg"
+	rd.Metadata.StartedOn = startedOn.UTC().Format(time.RFC3339)
+	rd.Metadata.FinishedOn = time.Now().UTC().Format(time.RFC3339)
+	data, err := json.MarshalIndent(&st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(cfg.Provenance, append(data, '\n'), 0644)
+}
@@ -0,0 +1,61 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteProvenance(t *testing.T) {
+	oldState, oldData := stateDir, configData
+	defer func() { stateDir, configData = oldState, oldData }()
+	stateDir = t.TempDir()
+	configData = []byte("packages: [hello]\n")
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "usr/bin"), 0755)
+	os.WriteFile(filepath.Join(root, "usr/bin/hello"), []byte("hello"), 0755)
+	os.Symlink("hello", filepath.Join(root, "usr/bin/hi"))
+	before, err := rootDigest(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &Config{InstallDir: root, Packages: []string{"hello"}, Repos: []string{"https://example.com/main"}, Provenance: filepath.Join(t.TempDir(), "provenance.json")}
+	pkgMap := map[string]APKPackage{"hello": {Name: "hello", Version: "1.0-r0", Filename: "hello-1.0-r0.apk"}}
+	err = writeProvenance(cfg, "apkg.yaml", pkgMap, map[string]string{"hello": "https://example.com/main/"}, map[string]string{"hello": "abc123"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st ProvenanceStatement
+	data, _ := os.ReadFile(cfg.Provenance)
+	if err := json.Unmarshal(data, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.PredicateType != "https://slsa.dev/provenance/v1" || len(st.Subject) != 1 || st.Subject[0].Digest["sha256"] != before {
+		t.Errorf("unexpected statement %+v", st)
+	}
+	deps := map[string]ResourceDescriptor{}
+	for _, d := range st.Predicate.BuildDefinition.ResolvedDependencies {
+		deps[d.Name] = d
+	}
+	if d := deps["hello-1.0-r0"]; d.URI != "https://example.com/main/hello-1.0-r0.apk" || d.Digest["sha256"] != "abc123" {
+		t.Errorf("package dependency %+v", d)
+	}
+	if d := deps["config"]; d.Digest["sha256"] != sha256Digest(configData)["sha256"] {
+		t.Errorf("config dependency %+v", d)
+	}
+
+	// The root digest covers content, modes and links
+	os.Chmod(filepath.Join(root, "usr/bin/hello"), 0700)
+	if after, _ := rootDigest(root); after == before {
+		t.Error("mode change not reflected in the root digest")
+	}
+}
@@ -0,0 +1,208 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// providesCacheDir (under the state dir) keeps the provides map built from each set of
+// repos, together with the hash of the index snapshot it was built from
+const providesCacheDir = "provides_cache"
+
+// providesCache is a cached provides map and the snapshot key it's valid for
+type providesCache struct {
+	Key      string              `json:"key"`
+	Provides map[string][]string `json:"provides"`
+}
+
+// providesMemo keeps the provides maps built this run by snapshot key, so resolving
+// several targets against the same indexes builds each one once
+var providesMemo = map[string]map[string][]string{}
+
+// providesName strips the version from a provides entry (e.g. 'so:libssl.so.3=3' -> 'so:libssl.so.3')
+func providesName(p string) string {
+	return strings.SplitN(p, "=", 2)[0]
+}
+
+// buildProvidesMap maps every provided token (and the package names themselves) to the packages providing it
+func buildProvidesMap(pkgMap map[string]APKPackage) map[string][]string {
+	provides := make(map[string][]string)
+	for name, pkg := range pkgMap {
+		provides[name] = append(provides[name], name)
+		for _, p := range pkg.Provides {
+			tok := providesName(p)
+			provides[tok] = append(provides[tok], name)
+		}
+	}
+	for tok := range provides {
+		sort.Strings(provides[tok])
+	}
+	return provides
+}
+
+// providesSnapshotKey hashes the index digests of the repos pkgMap was read from and
+// the packages that came from no repo, i.e. everything the provides map is built from
+func providesSnapshotKey(pkgMap map[string]APKPackage, sourceRepo map[string]string) (string, error) {
+	used := map[string]bool{}
+	var loose []string
+	for name, pkg := range pkgMap {
+		if repo, ok := sourceRepo[name]; ok {
+			used[repo] = true
+		} else {
+			loose = append(loose, name+"="+pkg.Version+" "+strings.Join(pkg.Provides, " "))
+		}
+	}
+	repos := make([]string, 0, len(used))
+	for repo := range used {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	sort.Strings(loose)
+	h := sha256.New()
+	for _, repo := range repos {
+		sum, err := indexDigest(repo)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "repo %s %s\n", repo, sum)
+	}
+	for _, l := range loose {
+		fmt.Fprintf(h, "\npkg %s", l)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// providesCachePath returns where the provides map built from repos is cached
+func providesCachePath(sourceRepo map[string]string) string {
+	h := sha256.New()
+	seen := map[string]bool{}
+	var repos []string
+	for _, repo := range sourceRepo {
+		if !seen[repo] {
+			seen[repo] = true
+			repos = append(repos, repo)
+		}
+	}
+	sort.Strings(repos)
+	for _, repo := range repos {
+		fmt.Fprintf(h, "%s\n", repo)
+	}
+	return filepath.Join(statePath(providesCacheDir), hex.EncodeToString(h.Sum(nil)[:8])+".json")
+}
+
+// providesMap returns the provides map of pkgMap, reusing the one built from the same
+// index snapshot by this or an earlier run. Filtered indexes are partial and never cached,
+// neither are package sets read from no repo.
+func providesMap(pkgMap map[string]APKPackage, sourceRepo map[string]string) map[string][]string {
+	if activeIndexFilter != nil || len(sourceRepo) == 0 {
+		return buildProvidesMap(pkgMap)
+	}
+	key, err := providesSnapshotKey(pkgMap, sourceRepo)
+	if err != nil {
+		return buildProvidesMap(pkgMap)
+	}
+	if provides, ok := providesMemo[key]; ok {
+		return provides
+	}
+	path := providesCachePath(sourceRepo)
+	var cached providesCache
+	if data, err := os.ReadFile(path); err == nil && json.Unmarshal(data, &cached) == nil && cached.Key == key {
+		providesMemo[key] = cached.Provides
+		return cached.Provides
+	}
+	provides := buildProvidesMap(pkgMap)
+	providesMemo[key] = provides
+	data, err := json.Marshal(providesCache{Key: key, Provides: provides})
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+	}
+	if err == nil {
+		err = os.WriteFile(path+".tmp", data, 0644)
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		eprintf("[WARN] Failed to cache the provides map: %v\n", err)
+	}
+	return provides
+}
+
+// lookupProvides finds the packages providing token, a bare name like 'pip3'
+// also matches prefixed tokens such as 'cmd:pip3'
+func lookupProvides(provides map[string][]string, token string) map[string][]string {
+	matches := make(map[string][]string)
+	token = providesName(token)
+	if pkgs, ok := provides[token]; ok {
+		matches[token] = pkgs
+	}
+	if !strings.Contains(token, ":") {
+		for tok, pkgs := range provides {
+			if i := strings.Index(tok, ":"); i >= 0 && tok[i+1:] == token {
+				matches[tok] = pkgs
+			}
+		}
+	}
+	return matches
+}
+
+// cmdProvides implements `apkg provides [-r] <token>`
+func cmdProvides(configPath string, args []string) int {
+	reverse := false
+	if len(args) > 0 && (args[0] == "-r" || args[0] == "--reverse") {
+		reverse = true
+		args = args[1:]
+	}
+	if len(args) < 1 {
+		eprintf("Usage: %s [flags] provides [-r] <token|package>\n", os.Args[0])
+		return 1
+	}
+	pkgMap, sourceRepo, ok := loadIndexForCommand(configPath)
+	if !ok {
+		return 2
+	}
+	if reverse {
+		pkg, ok := pkgMap[args[0]]
+		if !ok {
+			eprintf("[ERROR] %s not found in any repo\n", args[0])
+			return 1
+		}
+		printf("%s (%s) from %s provides:\n", pkg.Name, pkg.Version, sourceRepo[pkg.Name])
+		if len(pkg.Provides) == 0 {
+			printf("  (nothing besides itself)\n")
+		}
+		for _, p := range pkg.Provides {
+			printf("  %s\n", p)
+		}
+		return 0
+	}
+	matches := lookupProvides(providesMap(pkgMap, sourceRepo), args[0])
+	if len(matches) == 0 {
+		eprintf("Nothing provides %s\n", args[0])
+		return 1
+	}
+	toks := make([]string, 0, len(matches))
+	for tok := range matches {
+		toks = append(toks, tok)
+	}
+	sort.Strings(toks)
+	for _, tok := range toks {
+		printf("%s is provided by:\n", tok)
+		for _, name := range matches[tok] {
+			printf("  %s (%s)\n", name, pkgMap[name].Version)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,391 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// proxyCacheDir (under the state dir) is where `apkg proxy` caches by default
+const proxyCacheDir = "proxy_cache"
+
+// proxyStatsPath is where the proxy serves its statistics as JSON
+const proxyStatsPath = "/_apkg/stats"
+
+// ProxyStats are the counters of a running proxy
+type ProxyStats struct {
+	Requests     int64 `json:"requests"`
+	Hits         int64 `json:"hits"`
+	Misses       int64 `json:"misses"`
+	Stale        int64 `json:"stale"`
+	Errors       int64 `json:"errors"`
+	BytesServed  int64 `json:"bytes_served"`
+	BytesFetched int64 `json:"bytes_fetched"`
+	CachedFiles  int64 `json:"cached_files"`
+	CacheSize    int64 `json:"cache_size"`
+}
+
+// Timeouts of the connections of the proxy and of peers serve: clients only send a request,
+// the response covers the upstream fetch and sending the largest packages to slow clients
+const (
+	proxyReadTimeout  = 30 * time.Second
+	proxyWriteTimeout = 30 * time.Minute
+	proxyIdleTimeout  = 2 * time.Minute
+)
+
+// cachingProxy serves the files of an upstream mirror from dir, fetching them on the first
+// request. Packages never change once published and are kept until evicted, everything
+// else (indexes) is fetched again once it's older than indexTTL.
+type cachingProxy struct {
+	upstream string
+	dir      string
+	indexTTL time.Duration
+	maxSize  int64
+
+	mu       sync.Mutex
+	stats    ProxyStats
+	fetching map[string]*pathLock
+}
+
+// pathLock is the lock of a file being served, refs counts the requests holding or
+// waiting for it so it's dropped with the last one
+type pathLock struct {
+	sync.Mutex
+	refs int
+}
+
+// newCachingProxy returns a proxy for upstream caching in dir, counting what dir holds already
+func newCachingProxy(upstream, dir string, indexTTL time.Duration, maxSize int64) (*cachingProxy, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	p := &cachingProxy{upstream: strings.TrimSuffix(upstream, "/"), dir: dir, indexTTL: indexTTL, maxSize: maxSize, fetching: map[string]*pathLock{}}
+	for _, f := range p.cachedFiles() {
+		p.stats.CachedFiles++
+		p.stats.CacheSize += f.size
+	}
+	return p, nil
+}
+
+// proxyFile is a cached file and when it was last served
+type proxyFile struct {
+	path     string
+	size     int64
+	lastUsed time.Time
+}
+
+// cachedFiles lists the files in the cache, temp files of running fetches excluded
+func (p *cachingProxy) cachedFiles() []proxyFile {
+	var files []proxyFile
+	filepath.Walk(p.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".fetch-") {
+			return nil
+		}
+		f := proxyFile{path: path, size: info.Size(), lastUsed: info.ModTime()}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			f.lastUsed = time.Unix(st.Atim.Unix())
+		}
+		files = append(files, f)
+		return nil
+	})
+	return files
+}
+
+// count adds to the stats under the lock
+func (p *cachingProxy) count(fn func(s *ProxyStats)) {
+	p.mu.Lock()
+	fn(&p.stats)
+	p.mu.Unlock()
+}
+
+// lockPath serializes fetches of the same file, concurrent clients wait for the first one.
+// It returns once the lock is held, with the function releasing it.
+func (p *cachingProxy) lockPath(rel string) func() {
+	p.mu.Lock()
+	l, ok := p.fetching[rel]
+	if !ok {
+		l = &pathLock{}
+		p.fetching[rel] = l
+	}
+	l.refs++
+	p.mu.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		p.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(p.fetching, rel)
+		}
+		p.mu.Unlock()
+	}
+}
+
+// tryLockPath takes the lock of rel only when no request holds or waits for it, with the
+// function releasing it
+func (p *cachingProxy) tryLockPath(rel string) (func(), bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, busy := p.fetching[rel]; busy {
+		return nil, false
+	}
+	l := &pathLock{refs: 1}
+	l.Lock()
+	p.fetching[rel] = l
+	return func() {
+		l.Unlock()
+		p.mu.Lock()
+		delete(p.fetching, rel)
+		p.mu.Unlock()
+	}, true
+}
+
+// immutable reports whether the file at rel never changes once published
+func immutable(rel string) bool {
+	return strings.HasSuffix(rel, ".apk")
+}
+
+func (p *cachingProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == proxyStatsPath {
+		p.mu.Lock()
+		stats := p.stats
+		p.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Clean drops every .. so the file stays below the cache dir
+	rel := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	if rel == "" || strings.HasSuffix(r.URL.Path, "/") || strings.HasPrefix(rel, "_apkg") {
+		http.NotFound(w, r)
+		return
+	}
+	p.count(func(s *ProxyStats) { s.Requests++ })
+	local := filepath.Join(p.dir, filepath.FromSlash(rel))
+	unlock := p.lockPath(rel)
+	info, statErr := os.Stat(local)
+	// Clients can ask for a fresh index with Cache-Control: no-cache, like from any HTTP cache
+	revalidate := strings.Contains(r.Header.Get("Cache-Control"), "no-cache")
+	fresh := statErr == nil && (immutable(rel) || (time.Since(info.ModTime()) < p.indexTTL && !revalidate))
+	switch {
+	case fresh:
+		p.count(func(s *ProxyStats) { s.Hits++ })
+	default:
+		err := p.fetch(rel, local)
+		switch {
+		case err == nil:
+			p.count(func(s *ProxyStats) { s.Misses++ })
+		case statErr == nil:
+			// The upstream is unreachable, a stale index beats none
+			p.count(func(s *ProxyStats) { s.Stale++ })
+			w.Header().Set("Warning", `110 apkg "Response is Stale"`)
+			eprintf("[WARN] Serving stale %s: %v\n", rel, err)
+		default:
+			unlock()
+			p.count(func(s *ProxyStats) { s.Errors++ })
+			var perm *permanentError
+			if errors.As(err, &perm) {
+				http.NotFound(w, r)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	f, err := os.Open(local)
+	if err == nil {
+		// The access time is what eviction goes by, the modification time is when it was fetched
+		if info, err = f.Stat(); err == nil {
+			os.Chtimes(local, time.Now(), info.ModTime())
+		}
+	}
+	unlock()
+	if err != nil {
+		p.count(func(s *ProxyStats) { s.Errors++ })
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	if r.Method == http.MethodGet {
+		p.count(func(s *ProxyStats) { s.BytesServed += info.Size() })
+	}
+	http.ServeContent(w, r, path.Base(rel), info.ModTime(), f)
+}
+
+// fetch downloads rel from the upstream into local and evicts what no longer fits
+func (p *cachingProxy) fetch(rel, local string) error {
+	resp, err := httpGet(p.upstream + "/" + rel)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(local), ".fetch-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	n, err := io.Copy(tmp, resp.Body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	var old int64 = -1
+	if info, err := os.Stat(local); err == nil {
+		old = info.Size()
+	}
+	if err := os.Rename(tmp.Name(), local); err != nil {
+		return err
+	}
+	p.count(func(s *ProxyStats) {
+		s.BytesFetched += n
+		s.CacheSize += n
+		if old >= 0 {
+			s.CacheSize -= old
+		} else {
+			s.CachedFiles++
+		}
+	})
+	p.evict(local)
+	return nil
+}
+
+// evict removes the least recently served files until the cache fits max size again,
+// keep (the file just fetched) stays and so do files a request is serving or fetching.
+// Their locks aren't waited for, two fetches evicting would wait for each other.
+func (p *cachingProxy) evict(keep string) {
+	p.mu.Lock()
+	over := p.maxSize > 0 && p.stats.CacheSize > p.maxSize
+	p.mu.Unlock()
+	if !over {
+		return
+	}
+	files := p.cachedFiles()
+	sort.Slice(files, func(i, j int) bool { return files[i].lastUsed.Before(files[j].lastUsed) })
+	for _, f := range files {
+		p.mu.Lock()
+		done := p.stats.CacheSize <= p.maxSize
+		p.mu.Unlock()
+		if done {
+			return
+		}
+		if f.path == keep {
+			continue
+		}
+		rel, err := filepath.Rel(p.dir, f.path)
+		if err != nil {
+			continue
+		}
+		unlock, ok := p.tryLockPath(filepath.ToSlash(rel))
+		if !ok {
+			continue
+		}
+		err = os.Remove(f.path)
+		unlock()
+		if err != nil {
+			continue
+		}
+		p.count(func(s *ProxyStats) {
+			s.CacheSize -= f.size
+			s.CachedFiles--
+		})
+	}
+}
+
+// cmdProxy implements `apkg proxy`: a caching proxy of an Alpine mirror for the apkg and apk
+// clients of a LAN, and `apkg proxy purge` emptying its cache
+func cmdProxy(configPath string, args []string) int {
+	if cfg, err := readConfig(configPath); err == nil {
+		globalConfig = cfg
+	}
+	if len(args) > 0 && args[0] == "purge" {
+		return cmdProxyPurge(args[1:])
+	}
+	fs := flag.NewFlagSet("proxy", flag.ExitOnError)
+	listen := fs.String("listen", ":8080", "Address to serve on")
+	cacheDir := fs.String("cache-dir", statePath(proxyCacheDir), "Directory to cache in")
+	upstream := fs.String("upstream", "", "Mirror to fetch from (default: alpine_mirror of the config or dl-cdn.alpinelinux.org)")
+	indexTTL := fs.Duration("index-ttl", 5*time.Minute, "How long indexes are served from the cache before they are fetched again")
+	maxSize := fs.String("max-size", "", "Evict the least recently served files beyond this size (e.g. 20G, default: unlimited)")
+	fs.Parse(args)
+	if *upstream == "" {
+		*upstream = defaultAlpineMirror
+		if globalConfig != nil {
+			*upstream = alpineMirror(globalConfig)
+		}
+	}
+	var limit int64
+	if *maxSize != "" {
+		var err error
+		if limit, err = parseSize(*maxSize); err != nil {
+			eprintf("[FATAL] -max-size: %v\n", err)
+			return 1
+		}
+	}
+	p, err := newCachingProxy(*upstream, *cacheDir, *indexTTL, limit)
+	if err != nil {
+		eprintf("[FATAL] %v\n", err)
+		return 3
+	}
+	printf("Proxying %s on %s, caching in %s (%d files, %s)\n", p.upstream, *listen, p.dir, p.stats.CachedFiles, humanSize(p.stats.CacheSize))
+	printf("Point clients at http://<this host>%s/<branch>/<repo>, statistics are at %s\n", *listen, proxyStatsPath)
+	srv := &http.Server{
+		Addr:              *listen,
+		Handler:           p,
+		ReadHeaderTimeout: proxyReadTimeout,
+		ReadTimeout:       proxyReadTimeout,
+		WriteTimeout:      proxyWriteTimeout,
+		IdleTimeout:       proxyIdleTimeout,
+	}
+	if err := srv.ListenAndServe(); err != nil {
+		eprintf("[FATAL] %v\n", err)
+		return 2
+	}
+	return 0
+}
+
+// cmdProxyPurge empties the proxy cache, or only drops its indexes
+func cmdProxyPurge(args []string) int {
+	fs := flag.NewFlagSet("proxy purge", flag.ExitOnError)
+	cacheDir := fs.String("cache-dir", statePath(proxyCacheDir), "Directory the proxy caches in")
+	indexes := fs.Bool("indexes", false, "Only drop the indexes, packages stay cached")
+	fs.Parse(args)
+	p := &cachingProxy{dir: *cacheDir}
+	removed, size := 0, int64(0)
+	for _, f := range p.cachedFiles() {
+		if *indexes && immutable(f.path) {
+			continue
+		}
+		if err := os.Remove(f.path); err != nil {
+			eprintf("[WARN] Failed to remove %s: %v\n", f.path, err)
+			continue
+		}
+		removed++
+		size += f.size
+	}
+	printf("Removed %d cached files (%s)\n", removed, humanSize(size))
+	return 0
+}
@@ -0,0 +1,178 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCachingProxy(t *testing.T) {
+	var fetches atomic.Int64
+	var down atomic.Bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		fetches.Add(1)
+		switch r.URL.Path {
+		case "/v3.20/main/x86_64/APKINDEX.tar.gz":
+			io.WriteString(w, "index")
+		case "/v3.20/main/x86_64/foo-1.0-r0.apk":
+			io.WriteString(w, strings.Repeat("f", 1000))
+		case "/v3.20/main/x86_64/bar-1.0-r0.apk":
+			io.WriteString(w, strings.Repeat("b", 1000))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+	dir := t.TempDir()
+	p, err := newCachingProxy(upstream.URL, dir, time.Hour, 1500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+	get := func(path string, header ...string) (int, string) {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if len(header) == 2 {
+			req.Header.Set(header[0], header[1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	for i := 0; i < 2; i++ {
+		if code, body := get("/v3.20/main/x86_64/foo-1.0-r0.apk"); code != 200 || len(body) != 1000 {
+			t.Fatalf("package: %d %q", code, body)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("package fetched %d times, want once", n)
+	}
+	get("/v3.20/main/x86_64/APKINDEX.tar.gz")
+	get("/v3.20/main/x86_64/APKINDEX.tar.gz")
+	if n := fetches.Load(); n != 2 {
+		t.Errorf("fresh index fetched again (%d fetches)", n)
+	}
+	get("/v3.20/main/x86_64/APKINDEX.tar.gz", "Cache-Control", "no-cache")
+	if n := fetches.Load(); n != 3 {
+		t.Errorf("no-cache didn't revalidate the index (%d fetches)", n)
+	}
+	down.Store(true)
+	if code, body := get("/v3.20/main/x86_64/APKINDEX.tar.gz", "Cache-Control", "no-cache"); code != 200 || body != "index" {
+		t.Errorf("stale index not served while upstream is down: %d %q", code, body)
+	}
+	down.Store(false)
+	if code, _ := get("/v3.20/main/x86_64/missing-1.0-r0.apk"); code != 404 {
+		t.Errorf("missing package: status %d, want 404", code)
+	}
+	// .. is cleaned away, this asks the mirror for etc/passwd
+	if code, _ := get("/../../etc/passwd"); code == 200 {
+		t.Error("path outside the mirror served")
+	}
+
+	// bar doesn't fit next to foo and the index, foo was served least recently
+	get("/v3.20/main/x86_64/APKINDEX.tar.gz", "Cache-Control", "no-cache")
+	get("/v3.20/main/x86_64/bar-1.0-r0.apk")
+	if _, err := os.Stat(filepath.Join(dir, "v3.20/main/x86_64/foo-1.0-r0.apk")); !os.IsNotExist(err) {
+		t.Error("least recently served package not evicted")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "v3.20/main/x86_64/bar-1.0-r0.apk")); err != nil {
+		t.Errorf("fetched package evicted: %v", err)
+	}
+
+	p.mu.Lock()
+	if len(p.fetching) != 0 {
+		t.Errorf("locks of served files kept: %v", p.fetching)
+	}
+	p.mu.Unlock()
+
+	_, body := get(proxyStatsPath)
+	var stats ProxyStats
+	if err := json.Unmarshal([]byte(body), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Hits != 2 || stats.Stale != 1 || stats.Errors != 2 || stats.CachedFiles != 2 || stats.CacheSize != 1005 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	if code := cmdProxyPurge([]string{"-cache-dir", dir, "-indexes"}); code != 0 {
+		t.Fatalf("purge exited %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "v3.20/main/x86_64/APKINDEX.tar.gz")); !os.IsNotExist(err) {
+		t.Error("index not purged")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "v3.20/main/x86_64/bar-1.0-r0.apk")); err != nil {
+		t.Errorf("package purged with -indexes: %v", err)
+	}
+}
+
+func TestCachingProxyEvictWhileServing(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Repeat(r.URL.Path[1:2], 1000))
+	}))
+	defer upstream.Close()
+	dir := t.TempDir()
+	p, err := newCachingProxy(upstream.URL, dir, time.Hour, 2500)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A file a request holds the lock of isn't evicted
+	os.WriteFile(filepath.Join(dir, "held.apk"), []byte(strings.Repeat("h", 2000)), 0644)
+	os.WriteFile(filepath.Join(dir, "idle.apk"), []byte(strings.Repeat("i", 2000)), 0644)
+	p.stats.CacheSize = 4000
+	unlock := p.lockPath("held.apk")
+	p.evict("")
+	unlock()
+	if _, err := os.Stat(filepath.Join(dir, "held.apk")); err != nil {
+		t.Errorf("a file being served was evicted: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "idle.apk")); err == nil {
+		t.Error("the idle file wasn't evicted")
+	}
+
+	// Requests evicting each other's files all get their file
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		name := string(rune('a'+i%8)) + ".apk"
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.Get(srv.URL + "/" + name)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK || string(body) != strings.Repeat(name[:1], 1000) {
+				t.Errorf("%s: %d %q", name, resp.StatusCode, body)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,181 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"debug/elf"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// binfmtDir is where the kernel exposes binfmt_misc registrations
+var binfmtDir = "/proc/sys/fs/binfmt_misc"
+
+// qemuNames maps ELF machines to the suffix of their qemu-user emulator
+var qemuNames = map[elf.Machine]string{
+	elf.EM_X86_64:  "x86_64",
+	elf.EM_386:     "i386",
+	elf.EM_AARCH64: "aarch64",
+	elf.EM_ARM:     "arm",
+	elf.EM_RISCV:   "riscv64",
+	elf.EM_PPC64:   "ppc64le",
+	elf.EM_S390:    "s390x",
+}
+
+// hostMachines maps GOARCH to the ELF machines the host runs natively
+var hostMachines = map[string][]elf.Machine{
+	"amd64":   {elf.EM_X86_64, elf.EM_386},
+	"386":     {elf.EM_386},
+	"arm64":   {elf.EM_AARCH64},
+	"arm":     {elf.EM_ARM},
+	"riscv64": {elf.EM_RISCV},
+	"ppc64le": {elf.EM_PPC64},
+	"s390x":   {elf.EM_S390},
+}
+
+// emulationChecked caches the result of ensureEmulation for the root of this run
+var emulationChecked = map[string]error{}
+
+// resolveInRoot follows the symlinks of p (absolute within root) without leaving root
+func resolveInRoot(root, p string) (string, error) {
+	for i := 0; i < 16; i++ {
+		full := filepath.Join(root, p)
+		target, err := os.Readlink(full)
+		if err != nil {
+			if _, statErr := os.Lstat(full); statErr != nil {
+				return "", statErr
+			}
+			return full, nil
+		}
+		if filepath.IsAbs(target) {
+			p = target
+		} else {
+			p = filepath.Join(filepath.Dir(p), target)
+		}
+	}
+	return "", fmt.Errorf("too many levels of symlinks resolving %s in %s", p, root)
+}
+
+// rootELFHeader returns the machine and the raw header of the root's /bin/sh
+func rootELFHeader(root string) (elf.Machine, []byte, error) {
+	sh, err := resolveInRoot(root, "/bin/sh")
+	if err != nil {
+		return 0, nil, err
+	}
+	f, err := os.Open(sh)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+	hdr := make([]byte, 20)
+	if _, err := io.ReadFull(f, hdr); err != nil {
+		return 0, nil, fmt.Errorf("reading the ELF header of %s: %w", sh, err)
+	}
+	ef, err := elf.NewFile(f)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: %w", sh, err)
+	}
+	return ef.Machine, hdr, nil
+}
+
+// binfmtMagic builds the binfmt_misc magic and mask matching executables like the one
+// hdr (the first 20 bytes of an ELF file) belongs to: same class, byte order and
+// machine, any OS ABI, static or position independent
+func binfmtMagic(hdr []byte) (magic, mask string) {
+	m := make([]byte, 20)
+	k := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	copy(m, hdr[:7])
+	// e_type ET_EXEC (2), masked to also match ET_DYN (3)
+	if hdr[elf.EI_DATA] == byte(elf.ELFDATA2MSB) {
+		m[16], m[17] = 0x00, 0x02
+		k[17] = 0xfe
+	} else {
+		m[16], m[17] = 0x02, 0x00
+		k[16] = 0xfe
+	}
+	m[18], m[19] = hdr[18], hdr[19]
+	esc := func(b []byte) string {
+		var sb strings.Builder
+		for _, c := range b {
+			fmt.Fprintf(&sb, "\\x%02x", c)
+		}
+		return sb.String()
+	}
+	return esc(m), esc(k)
+}
+
+// ensureEmulation makes sure binaries of root can run on this host: it does nothing for
+// native roots, checks a qemu-user binfmt_misc registration for foreign ones and, with
+// qemu_binfmt enabled, registers the host's static qemu for them
+func ensureEmulation(root string) error {
+	if err, ok := emulationChecked[root]; ok {
+		return err
+	}
+	err := checkEmulation(root)
+	emulationChecked[root] = err
+	return err
+}
+
+func checkEmulation(root string) error {
+	machine, hdr, err := rootELFHeader(root)
+	if err != nil {
+		// Without a readable /bin/sh the scripts fail on their own, with a clearer error
+		return nil
+	}
+	for _, m := range hostMachines[runtime.GOARCH] {
+		if m == machine {
+			return nil
+		}
+	}
+	name, ok := qemuNames[machine]
+	if !ok {
+		return fmt.Errorf("%s is a %s root and qemu-user has no emulator apkg knows for it", root, machine)
+	}
+	entry := filepath.Join(binfmtDir, "qemu-"+name)
+	if data, err := os.ReadFile(entry); err == nil {
+		var flags, interp string
+		for _, line := range strings.Split(string(data), "\n") {
+			if v, ok := strings.CutPrefix(line, "flags: "); ok {
+				flags = v
+			} else if v, ok := strings.CutPrefix(line, "interpreter "); ok {
+				interp = v
+			}
+		}
+		if !strings.HasPrefix(string(data), "enabled") {
+			return fmt.Errorf("binfmt_misc entry %s is disabled", entry)
+		}
+		// Without the F flag the kernel looks the interpreter up inside the chroot
+		if !strings.Contains(flags, "F") {
+			if _, err := os.Stat(filepath.Join(root, interp)); err != nil {
+				return fmt.Errorf("binfmt_misc entry %s lacks the F flag and %s isn't in %s", entry, interp, root)
+			}
+		}
+		return nil
+	}
+	if globalConfig == nil || !globalConfig.QemuBinfmt {
+		return fmt.Errorf("%s is a %s root, register qemu-%s with binfmt_misc (or enable qemu_binfmt) to run its scripts", root, name, name)
+	}
+	interp, err := exec.LookPath("qemu-" + name + "-static")
+	if err != nil {
+		if interp, err = exec.LookPath("qemu-" + name); err != nil {
+			return fmt.Errorf("qemu_binfmt is enabled but neither qemu-%s-static nor qemu-%s is installed", name, name)
+		}
+	}
+	magic, mask := binfmtMagic(hdr)
+	// F opens the interpreter now so it works inside the chroot, P keeps argv[0] and C the credentials of setuid binaries
+	reg := fmt.Sprintf(":qemu-%s:M::%s:%s:%s:FPC", name, magic, mask, interp)
+	if err := os.WriteFile(filepath.Join(binfmtDir, "register"), []byte(reg), 0); err != nil {
+		return fmt.Errorf("registering qemu-%s with binfmt_misc (needs root and binfmt_misc mounted): %w", name, err)
+	}
+	printf("Registered %s for %s binaries with binfmt_misc\n", interp, name)
+	return nil
+}
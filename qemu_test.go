@@ -0,0 +1,22 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import "testing"
+
+func TestBinfmtMagic(t *testing.T) {
+	// ELF64 little endian ET_DYN aarch64, as found in Alpine's busybox
+	hdr := []byte{0x7f, 'E', 'L', 'F', 2, 1, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 3, 0, 0xb7, 0}
+	magic, mask := binfmtMagic(hdr)
+	// The registration qemu-binfmt-conf.sh uses for aarch64
+	if want := `\x7f\x45\x4c\x46\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00\xb7\x00`; magic != want {
+		t.Errorf("magic %s, want %s", magic, want)
+	}
+	if want := `\xff\xff\xff\xff\xff\xff\xff\x00\xff\xff\xff\xff\xff\xff\xff\xff\xfe\xff\xff\xff`; mask != want {
+		t.Errorf("mask %s, want %s", mask, want)
+	}
+}
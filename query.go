@@ -0,0 +1,232 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// loadIndexForCommand reads the config and fetches the merged index for read-only commands
+func loadIndexForCommand(configPath string) (map[string]APKPackage, map[string]string, bool) {
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		eprintf("[FATAL] Failed to read config: %v\n", err)
+		return nil, nil, false
+	}
+	pkgMap, sourceRepo, err := fetchAndParseAllAPKIndexes(cfg.Repos)
+	if err != nil {
+		eprintf("[FATAL] Error fetching APKINDEX: %v\n", err)
+		return nil, nil, false
+	}
+	return pkgMap, sourceRepo, true
+}
+
+// pkgOrigin returns the origin of a package, falling back to its own name
+func pkgOrigin(pkg APKPackage) string {
+	if pkg.Origin == "" {
+		return pkg.Name
+	}
+	return pkg.Origin
+}
+
+// groupByOrigin groups package names by their origin, both sorted
+func groupByOrigin(pkgMap map[string]APKPackage, names []string) (origins []string, groups map[string][]string) {
+	groups = make(map[string][]string)
+	for _, name := range names {
+		o := pkgOrigin(pkgMap[name])
+		if _, ok := groups[o]; !ok {
+			origins = append(origins, o)
+		}
+		groups[o] = append(groups[o], name)
+	}
+	sort.Strings(origins)
+	for _, o := range origins {
+		sort.Strings(groups[o])
+	}
+	return origins, groups
+}
+
+// printGrouped prints packages with subpackages indented under their origin
+func printGrouped(pkgMap map[string]APKPackage, names []string) {
+	origins, groups := groupByOrigin(pkgMap, names)
+	width := terminalWidth()
+	for _, o := range origins {
+		printf("%s:\n", o)
+		items := make([]string, len(groups[o]))
+		for i, name := range groups[o] {
+			if width > 0 {
+				items[i] = name + "-" + pkgMap[name].Version
+			} else {
+				items[i] = name + " " + pkgMap[name].Version
+			}
+		}
+		printColumns(os.Stdout, items, width)
+	}
+}
+
+// cmdInfo implements `apkg info <pkg>`, installed packages are also shown
+// from their stored .PKGINFO when the repos can't be reached
+func cmdInfo(configPath string, args []string) int {
+	if len(args) < 1 {
+		eprintf("Usage: %s [flags] info <package>\n", os.Args[0])
+		return 1
+	}
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		eprintf("[FATAL] Failed to read config: %v\n", err)
+		return 1
+	}
+	installedPkgs, _ := readInstalledPkgs(statePath("installed.yaml"))
+	pkgInfo, _ := readPkgInfo(args[0])
+	pkgMap, sourceRepo, err := fetchAndParseAllAPKIndexes(cfg.Repos)
+	if err != nil {
+		if pkgInfo == nil {
+			eprintf("[FATAL] Error fetching APKINDEX: %v\n", err)
+			return 2
+		}
+		eprintf("[WARN] Error fetching APKINDEX, showing installed metadata only: %v\n", err)
+	}
+	pkg, found := pkgMap[args[0]]
+	if !found {
+		if pkgInfo == nil {
+			eprintf("[ERROR] %s not found in any repo\n", args[0])
+			return 1
+		}
+		printPkgInfo(pkgInfo)
+		return 0
+	}
+	printf("Name:       %s\n", pkg.Name)
+	printf("Version:    %s\n", pkg.Version)
+	if ver, ok := installedPkgs[pkg.Name]; ok {
+		printf("Installed:  %s\n", ver)
+	}
+	printf("Origin:     %s\n", pkgOrigin(pkg))
+	printf("Maintainer: %s\n", pkg.Maintainer)
+	if pkg.BuildTime > 0 {
+		printf("Built:      %s\n", time.Unix(pkg.BuildTime, 0).UTC().Format(time.RFC3339))
+	}
+	printf("Repo:       %s\n", sourceRepo[pkg.Name])
+	if len(pkg.Deps) > 0 {
+		printf("Depends:    %s\n", strings.Join(pkg.Deps, " "))
+	}
+	var siblings []string
+	for name, other := range pkgMap {
+		if name != pkg.Name && pkgOrigin(other) == pkgOrigin(pkg) {
+			siblings = append(siblings, name)
+		}
+	}
+	if len(siblings) > 0 {
+		sort.Strings(siblings)
+		printf("Subpackages of %s: %s\n", pkgOrigin(pkg), strings.Join(siblings, " "))
+	}
+	return 0
+}
+
+// printPkgInfo prints the stored .PKGINFO of an installed package
+func printPkgInfo(info map[string][]string) {
+	first := func(key string) string {
+		if v := info[key]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	printf("Name:       %s\n", first("pkgname"))
+	printf("Installed:  %s\n", first("pkgver"))
+	printf("Origin:     %s\n", first("origin"))
+	printf("Maintainer: %s\n", first("maintainer"))
+	if t, err := strconv.ParseInt(first("builddate"), 10, 64); err == nil {
+		printf("Built:      %s\n", time.Unix(t, 0).UTC().Format(time.RFC3339))
+	}
+	if deps := info["depend"]; len(deps) > 0 {
+		printf("Depends:    %s\n", strings.Join(deps, " "))
+	}
+}
+
+// cmdSearch implements `apkg search [-maintainer <m>] <term>`
+func cmdSearch(configPath string, args []string) int {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	maintainer := fs.String("maintainer", "", "Only show packages whose maintainer contains this string")
+	fs.Parse(args)
+	if fs.NArg() < 1 && *maintainer == "" {
+		eprintf("Usage: %s [flags] search [-maintainer <m>] <term>\n", os.Args[0])
+		return 1
+	}
+	term := strings.ToLower(fs.Arg(0))
+	pkgMap, _, ok := loadIndexForCommand(configPath)
+	if !ok {
+		return 2
+	}
+	var names []string
+	for name, pkg := range pkgMap {
+		if term != "" && !strings.Contains(strings.ToLower(name), term) {
+			continue
+		}
+		if *maintainer != "" && !strings.Contains(strings.ToLower(pkg.Maintainer), strings.ToLower(*maintainer)) {
+			continue
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		printf("No packages found.\n")
+		return 1
+	}
+	printGrouped(pkgMap, names)
+	return 0
+}
+
+// cmdList implements `apkg list [-origin <o>]`
+func cmdList(configPath string, args []string) int {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	origin := fs.String("origin", "", "Only show packages built from this origin")
+	fs.Parse(args)
+	pkgMap, _, ok := loadIndexForCommand(configPath)
+	if !ok {
+		return 2
+	}
+	var names []string
+	for name, pkg := range pkgMap {
+		if *origin != "" && pkgOrigin(pkg) != *origin {
+			continue
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		printf("No packages found.\n")
+		return 1
+	}
+	printGrouped(pkgMap, names)
+	return 0
+}
+
+// originFamily returns every package built from the same origin as pkg, e.g. nginx, nginx-doc and nginx-openrc
+func originFamily(repos []string, pkg string) ([]string, error) {
+	pkgMap, _, err := fetchAndParseAllAPKIndexes(repos)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching APKINDEX: %w", err)
+	}
+	origin := pkg
+	if info, ok := pkgMap[pkg]; ok {
+		origin = pkgOrigin(info)
+	}
+	var family []string
+	for name, info := range pkgMap {
+		if pkgOrigin(info) == origin {
+			family = append(family, name)
+		}
+	}
+	if len(family) == 0 {
+		return nil, fmt.Errorf("no packages found for origin %s", origin)
+	}
+	sort.Strings(family)
+	return family, nil
+}
@@ -0,0 +1,57 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseAPKIndexMetadata(t *testing.T) {
+	index := "P:nginx\nV:1.26.1-r0\no:nginx\nm:Jane Doe <jane@example.com>\nt:1717000000\n\n" +
+		"P:nginx-doc\nV:1.26.1-r0\no:nginx\n\nP:busybox\nV:1.36.1-r0\n"
+	pkgMap, err := parseAPKIndex(strings.NewReader(index))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nginx := pkgMap["nginx"]
+	if nginx.Origin != "nginx" || nginx.Maintainer != "Jane Doe <jane@example.com>" || nginx.BuildTime != 1717000000 {
+		t.Errorf("unexpected metadata: %+v", nginx)
+	}
+	if o := pkgOrigin(pkgMap["busybox"]); o != "busybox" {
+		t.Errorf("package without origin has origin %q", o)
+	}
+	origins, groups := groupByOrigin(pkgMap, []string{"nginx-doc", "busybox", "nginx"})
+	if strings.Join(origins, " ") != "busybox nginx" || strings.Join(groups["nginx"], " ") != "nginx nginx-doc" {
+		t.Errorf("unexpected grouping: %v %v", origins, groups)
+	}
+}
+
+func TestOriginFamily(t *testing.T) {
+	oldConfig, oldState := globalConfig, stateDir
+	defer func() { globalConfig, stateDir = oldConfig, oldState }()
+	stateDir = t.TempDir()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("P:nginx\nV:1.26.1-r0\no:nginx\n\nP:nginx-openrc\nV:1.26.1-r0\no:nginx\n\nP:nginx-doc\nV:1.26.1-r0\no:nginx\n\nP:busybox\nV:1.36.1-r0\n\n"))
+	}))
+	defer srv.Close()
+	globalConfig = &Config{Repos: []string{srv.URL}}
+	for _, pkg := range []string{"nginx", "nginx-doc"} {
+		family, err := originFamily(globalConfig.Repos, pkg)
+		if err != nil || strings.Join(family, " ") != "nginx nginx-doc nginx-openrc" {
+			t.Errorf("originFamily(%s) = %v, %v", pkg, family, err)
+		}
+	}
+	if family, err := originFamily(globalConfig.Repos, "busybox"); err != nil || len(family) != 1 {
+		t.Errorf("package without subpackages: %v, %v", family, err)
+	}
+	if _, err := originFamily(globalConfig.Repos, "nothing"); err == nil {
+		t.Error("expected an unknown origin to fail")
+	}
+}
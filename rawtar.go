@@ -0,0 +1,150 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// rawMetaSuffix is appended to a raw tarball's location to find its sidecar metadata
+const rawMetaSuffix = ".meta"
+
+// rawTarballSuffixes mark packages: entries that are plain tarballs rather than .apk files
+var rawTarballSuffixes = []string{".tar.gz", ".tgz", ".tar.zst", ".tar.xz", ".tar.bz2", ".tar"}
+
+// rawMeta is the sidecar metadata of a raw tarball, <tarball>.meta
+type rawMeta struct {
+	Name        string   `yaml:"name"`
+	Version     string   `yaml:"version"`
+	Description string   `yaml:"description,omitempty"`
+	Depends     []string `yaml:"depends,omitempty"`
+}
+
+// isRawTarball reports whether the source of a direct entry is a raw tarball
+func isRawTarball(src string) bool {
+	for _, suffix := range rawTarballSuffixes {
+		if strings.HasSuffix(src, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// readRawMeta fetches the sidecar metadata of the raw tarball at src
+func readRawMeta(src string) ([]byte, error) {
+	data, err := readConfigSource(src + rawMetaSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the metadata of %s: %w", src, err)
+	}
+	return data, nil
+}
+
+// parseRawMeta parses the sidecar metadata of the raw tarball at src
+func parseRawMeta(src string, data []byte) (rawMeta, error) {
+	var meta rawMeta
+	if err := yaml.Unmarshal(data, &meta); err != nil {
+		return rawMeta{}, fmt.Errorf("%s%s: %w", src, rawMetaSuffix, err)
+	}
+	if meta.Name == "" || meta.Version == "" {
+		return rawMeta{}, fmt.Errorf("%s%s must set name and version", src, rawMetaSuffix)
+	}
+	return meta, nil
+}
+
+// rawChecksum returns the sha256 of the raw tarball at path followed by its metadata,
+// what the checksum of a raw tarball entry covers so the metadata can't be swapped
+func rawChecksum(path string, meta []byte) (string, error) {
+	h := sha256.New()
+	if err := withFile(path, func(r io.Reader) error {
+		_, err := io.Copy(h, r)
+		return err
+	}); err != nil {
+		return "", err
+	}
+	h.Write(meta)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// convertRawTarball writes the tarball at src as an .apk at dest, with a .PKGINFO made from meta
+func convertRawTarball(src, dest string, meta rawMeta) error {
+	var size int64
+	err := withFile(src, func(r io.Reader) error {
+		return eachTarEntry(r, func(hdr *tar.Header, _ io.Reader) error {
+			size += hdr.Size
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	var info bytes.Buffer
+	fmt.Fprintf(&info, "pkgname = %s\npkgver = %s\nsize = %d\n", meta.Name, meta.Version, size)
+	if meta.Description != "" {
+		fmt.Fprintf(&info, "pkgdesc = %s\n", meta.Description)
+	}
+	for _, dep := range meta.Depends {
+		fmt.Fprintf(&info, "depend = %s\n", dep)
+	}
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	zw := gzip.NewWriter(out)
+	tw := tar.NewWriter(zw)
+	if err := tw.WriteHeader(&tar.Header{Name: ".PKGINFO", Mode: 0644, Size: int64(info.Len()), Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(info.Bytes()); err != nil {
+		return err
+	}
+	if err := withFile(src, func(r io.Reader) error { return copyTarEntries(tw, r) }); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// withFile calls fn with the open file at path
+func withFile(path string, fn func(io.Reader) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return fn(f)
+}
+
+// convertRawDirect replaces the raw tarball fetched from src to path by its .apk form,
+// described by the metadata read with readRawMeta
+func convertRawDirect(src, path string, data []byte) error {
+	meta, err := parseRawMeta(src, data)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".raw"
+	if err := os.Rename(path, tmp); err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if err := convertRawTarball(tmp, path, meta); err != nil {
+		return fmt.Errorf("failed to convert %s: %w", src, err)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Who keeps a file shipped by an installed package and a new one, the rules of apk
+const (
+	replacesYes      = iota // the new package overwrites the file and takes it over
+	replacesNo              // the installed package keeps its file
+	replacesConflict        // nothing says who owns the file
+)
+
+// replacesInfo is the part of a .PKGINFO deciding file takeovers
+type replacesInfo struct {
+	Version  string
+	Origin   string
+	Replaces []string
+	Priority int
+}
+
+// pkgReplaces picks the takeover rules out of a parsed .PKGINFO
+func pkgReplaces(info map[string][]string) replacesInfo {
+	first := func(key string) string {
+		if v := info[key]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	r := replacesInfo{Version: first("pkgver"), Origin: first("origin"), Replaces: info["replaces"]}
+	r.Priority, _ = strconv.Atoi(first("replaces_priority"))
+	return r
+}
+
+// replacesPackage reports whether a replaces list names pkg at version
+func replacesPackage(replaces []string, pkg, version string) bool {
+	for _, tok := range replaces {
+		if d := parseDep(tok); d.Name == pkg && (version == "" || d.allows(version)) {
+			return true
+		}
+	}
+	return false
+}
+
+// replacesFile decides who keeps a file shipped by the installed package owner and the new
+// package pkg: upgrades and subpackages of the same origin overwrite, otherwise the side
+// whose replaces names the other wins, by replaces_priority when both do
+func replacesFile(owner string, o replacesInfo, pkg string, n replacesInfo) int {
+	if owner == pkg || (o.Origin != "" && o.Origin == n.Origin) {
+		return replacesYes
+	}
+	ownerPrio, newPrio := -1, -1
+	if replacesPackage(o.Replaces, pkg, n.Version) {
+		ownerPrio = o.Priority
+	}
+	if replacesPackage(n.Replaces, owner, o.Version) {
+		newPrio = n.Priority
+	}
+	if ownerPrio > newPrio {
+		return replacesNo
+	}
+	if newPrio >= 0 {
+		return replacesYes
+	}
+	return replacesConflict
+}
+
+// loadOwners maps every file of the installed packages to its package
+func (tx *Transaction) loadOwners() {
+	tx.owners = map[string]string{}
+	installed, _ := readInstalledPkgs(statePath("installed.yaml"))
+	for pkg := range installed {
+		files, _ := readInstalledFiles(pkg)
+		for _, rel := range files {
+			tx.owners[rel] = pkg
+		}
+	}
+}
+
+// replacesOf returns the takeover rules of pkg: the staged .PKGINFO of a package this
+// transaction installs, the stored one of an installed package
+func (tx *Transaction) replacesOf(pkg, stagingDir string) replacesInfo {
+	if r, ok := tx.replaces[pkg]; ok {
+		return r
+	}
+	info, err := readPkgInfo(pkg)
+	if stagingDir != "" {
+		if f, ferr := os.Open(filepath.Join(controlStagingPath(stagingDir, pkg), ".PKGINFO")); ferr == nil {
+			info, err = parsePkgInfo(f)
+			f.Close()
+		}
+	}
+	if err != nil {
+		eprintf("[WARN] No .PKGINFO of %s, it replaces nothing: %v\n", pkg, err)
+	}
+	r := pkgReplaces(info)
+	tx.replaces[pkg] = r
+	return r
+}
+
+// claimFile decides whether the package being installed writes rel when another package
+// owns it. A takeover moves rel out of the installed files of the old owner once tx
+// commits, so removing that package later leaves the file alone.
+func (tx *Transaction) claimFile(rel, stagingDir string) bool {
+	if tx.owners == nil {
+		tx.loadOwners()
+	}
+	owner := tx.owners[rel]
+	if owner == "" || owner == tx.pkg || tx.removedPkgs[owner] {
+		tx.owners[rel] = tx.pkg
+		return true
+	}
+	pkg := tx.pkg
+	switch replacesFile(owner, tx.replacesOf(owner, ""), pkg, tx.replacesOf(pkg, stagingDir)) {
+	case replacesNo:
+		printf("Keeping %s of %s, it replaces %s\n", rel, owner, pkg)
+		return false
+	case replacesConflict:
+		eprintf("[WARN] %s and %s both ship %s and neither replaces the other, overwriting\n", pkg, owner, rel)
+		tx.owners[rel] = pkg
+		return true
+	}
+	printf("%s takes over %s from %s\n", pkg, rel, owner)
+	tx.owners[rel] = pkg
+	tx.deferCommit(func() {
+		if err := disownFile(owner, rel); err != nil {
+			eprintf("[WARN] Failed to hand %s over from %s: %v\n", rel, owner, err)
+		}
+	})
+	return true
+}
+
+// disownFile drops rel from the installed files of pkg
+func disownFile(pkg, rel string) error {
+	files, err := readInstalledFiles(pkg)
+	if err != nil {
+		return err
+	}
+	kept := files[:0]
+	for _, f := range files {
+		if f != rel {
+			kept = append(kept, f)
+		}
+	}
+	return writeInstalledFiles(pkg, kept)
+}
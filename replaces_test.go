@@ -0,0 +1,63 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplacesFile(t *testing.T) {
+	plain := replacesInfo{Version: "1.0-r0"}
+	cases := []struct {
+		o, n replacesInfo
+		want int
+	}{
+		{plain, plain, replacesConflict},
+		{plain, replacesInfo{Replaces: []string{"old"}}, replacesYes},
+		{plain, replacesInfo{Replaces: []string{"old<1.0"}}, replacesConflict},
+		{replacesInfo{Replaces: []string{"new"}}, plain, replacesNo},
+		{replacesInfo{Replaces: []string{"new"}, Priority: 10}, replacesInfo{Replaces: []string{"old"}, Priority: 20}, replacesYes},
+		{replacesInfo{Replaces: []string{"new"}, Priority: 20}, replacesInfo{Replaces: []string{"old"}, Priority: 10}, replacesNo},
+		{replacesInfo{Origin: "src"}, replacesInfo{Origin: "src"}, replacesYes},
+	}
+	for i, c := range cases {
+		if got := replacesFile("old", c.o, "new", c.n); got != c.want {
+			t.Errorf("case %d: got %d, want %d", i, got, c.want)
+		}
+	}
+}
+
+func TestClaimFileTakeover(t *testing.T) {
+	oldState := stateDir
+	stateDir = t.TempDir()
+	defer func() { stateDir = oldState }()
+	writeInstalledPkgs(statePath("installed.yaml"), map[string]string{"old": "1.0-r0"})
+	writeInstalledFiles("old", []string{"usr/bin/tool", "usr/bin/other"})
+	staging := t.TempDir()
+	os.MkdirAll(controlStagingPath(staging, "new"), 0755)
+	os.WriteFile(filepath.Join(controlStagingPath(staging, "new"), ".PKGINFO"), []byte("pkgname = new\npkgver = 2.0-r0\nreplaces = old\n"), 0644)
+
+	tx, err := beginTransaction(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.setPackage("new")
+	if !tx.claimFile("usr/bin/tool", staging) || !tx.claimFile("usr/bin/new", staging) {
+		t.Fatal("new should take over usr/bin/tool")
+	}
+	if files, _ := readInstalledFiles("old"); len(files) != 2 {
+		t.Fatalf("ownership changed before the commit: %v", files)
+	}
+	if err := tx.commit(); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := readInstalledFiles("old"); len(files) != 1 || files[0] != "usr/bin/other" {
+		t.Errorf("old still owns %v", files)
+	}
+}
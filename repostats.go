@@ -0,0 +1,155 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"flag"
+	"os"
+	"sort"
+	"time"
+)
+
+// loadSnapshot parses an index snapshot: a local index file in any form
+// parseAPKIndexFile accepts, or a repo whose current index is fetched
+func loadSnapshot(snapshot string) (map[string]APKPackage, error) {
+	if info, err := os.Stat(snapshot); err == nil && !info.IsDir() {
+		return parseAPKIndexFile(snapshot)
+	}
+	tmp, err := os.CreateTemp("", "apkg-snapshot-*")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err := sourceFor(snapshot).FetchIndex(tmp.Name()); err != nil {
+		return nil, err
+	}
+	return parseAPKIndexFile(tmp.Name())
+}
+
+// IndexDiff lists what changed between two index snapshots
+type IndexDiff struct {
+	Added      []PlanItem
+	Removed    []PlanItem
+	Upgraded   []PlanItem
+	Downgraded []PlanItem
+}
+
+// diffIndexes compares two snapshots, rebuilt packages with the same version don't count
+func diffIndexes(old, new map[string]APKPackage) *IndexDiff {
+	d := &IndexDiff{}
+	for name, pkg := range new {
+		item := PlanItem{Name: name, NewVersion: pkg.Version, DownloadSize: pkg.Size, InstalledSize: pkg.InstalledSize}
+		prev, ok := old[name]
+		if !ok {
+			d.Added = append(d.Added, item)
+			continue
+		}
+		item.OldVersion = prev.Version
+		switch compareAPKVersions(prev.Version, pkg.Version) {
+		case -1:
+			d.Upgraded = append(d.Upgraded, item)
+		case 1:
+			d.Downgraded = append(d.Downgraded, item)
+		}
+	}
+	for name, pkg := range old {
+		if _, ok := new[name]; !ok {
+			d.Removed = append(d.Removed, PlanItem{Name: name, OldVersion: pkg.Version, DownloadSize: pkg.Size})
+		}
+	}
+	for _, list := range [][]PlanItem{d.Added, d.Removed, d.Upgraded, d.Downgraded} {
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	}
+	return d
+}
+
+// cmdRepoDiff implements `apkg repo-diff <old> <new>`
+func cmdRepoDiff(configPath string, args []string) int {
+	fs := flag.NewFlagSet("repo-diff", flag.ExitOnError)
+	summary := fs.Bool("summary", false, "Only print the counts")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		eprintf("Usage: %s [flags] repo-diff [-summary] <old index|repo> <new index|repo>\n", os.Args[0])
+		return 1
+	}
+	var snapshots [2]map[string]APKPackage
+	for i, s := range fs.Args() {
+		pkgs, err := loadSnapshot(s)
+		if err != nil {
+			eprintf("[FATAL] Failed to load %s: %v\n", s, err)
+			return 2
+		}
+		snapshots[i] = pkgs
+	}
+	d := diffIndexes(snapshots[0], snapshots[1])
+	if !*summary {
+		for _, it := range d.Added {
+			printf("+ %s %s\n", it.Name, it.NewVersion)
+		}
+		for _, it := range d.Removed {
+			printf("- %s %s\n", it.Name, it.OldVersion)
+		}
+		for _, it := range d.Upgraded {
+			printf("↑ %s %s -> %s\n", it.Name, it.OldVersion, it.NewVersion)
+		}
+		for _, it := range d.Downgraded {
+			printf("↓ %s %s -> %s\n", it.Name, it.OldVersion, it.NewVersion)
+		}
+	}
+	// What a mirror has to fetch to resync: every added or changed .apk
+	var download int64
+	for _, list := range [][]PlanItem{d.Added, d.Upgraded, d.Downgraded} {
+		for _, it := range list {
+			download += it.DownloadSize
+		}
+	}
+	printf("%d added, %d removed, %d upgraded, %d downgraded, %s to download to resync\n",
+		len(d.Added), len(d.Removed), len(d.Upgraded), len(d.Downgraded), humanSize(download))
+	return 0
+}
+
+// cmdRepoStats implements `apkg repo-stats [index|repo...]`, defaulting to the configured repos
+func cmdRepoStats(configPath string, args []string) int {
+	fs := flag.NewFlagSet("repo-stats", flag.ExitOnError)
+	fs.Parse(args)
+	snapshots := fs.Args()
+	if len(snapshots) == 0 {
+		cfg, err := readConfig(configPath)
+		if err != nil {
+			eprintf("[FATAL] Failed to read config: %v\n", err)
+			return 1
+		}
+		globalConfig = cfg
+		snapshots = cfg.Repos
+	}
+	for _, s := range snapshots {
+		pkgs, err := loadSnapshot(s)
+		if err != nil {
+			eprintf("[ERROR] Failed to load %s: %v\n", s, err)
+			return 2
+		}
+		origins := map[string]bool{}
+		var size, installed, newest int64
+		for _, pkg := range pkgs {
+			origins[pkgOrigin(pkg)] = true
+			size += pkg.Size
+			installed += pkg.InstalledSize
+			if pkg.BuildTime > newest {
+				newest = pkg.BuildTime
+			}
+		}
+		printf("%s\n", s)
+		printf("  Packages:       %d (%d origins)\n", len(pkgs), len(origins))
+		printf("  Download size:  %s\n", humanSize(size))
+		printf("  Installed size: %s\n", humanSize(installed))
+		if newest > 0 {
+			printf("  Newest build:   %s\n", time.Unix(newest, 0).UTC().Format(time.RFC3339))
+		}
+	}
+	return 0
+}
@@ -0,0 +1,136 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// resolveCacheFile (under the state dir) holds the key of the last run that found
+// nothing to change
+const resolveCacheFile = "resolve_cache"
+
+// prefetchedIndex is where an index was fetched to, or the error if that failed
+type prefetchedIndex struct {
+	path string
+	err  error
+}
+
+// prefetchedIndexes records the repos whose index was already fetched next to its
+// cached copy this run, so fetchIndex doesn't fetch twice
+var prefetchedIndexes = map[string]prefetchedIndex{}
+
+// prefetchIndex fetches the index of repo next to its cached copy without parsing it.
+// Every fetch gets a temp file of its own, the build-matrix runs share the index cache.
+func prefetchIndex(repo string) (string, error) {
+	if p, ok := prefetchedIndexes[repo]; ok {
+		return p.path, p.err
+	}
+	path := indexCachePath(repo)
+	tmp := ""
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		var f *os.File
+		if f, err = os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp"); err == nil {
+			tmp = f.Name()
+			f.Close()
+			err = sourceFor(repo).FetchIndex(tmp)
+		}
+	}
+	if err == nil {
+		countFileTraffic(repo, "", fromIndex, tmp)
+	}
+	prefetchedIndexes[repo] = prefetchedIndex{path: tmp, err: err}
+	return tmp, err
+}
+
+// resolveCacheKey hashes everything the plan depends on: the config, the -with and
+// -only-upgrade flags, the fetched indexes, the packages of the base layer, installed.yaml
+// and, with -locked, the lockfile
+func resolveCacheKey(configPath string, cfg *Config, locked bool) (string, error) {
+	h := sha256.New()
+	h.Write(configData)
+	fmt.Fprintf(h, "\nwith %s\n", strings.Join(withGroups, ","))
+	if onlyUpgrade != nil {
+		var only []string
+		for pkg := range onlyUpgrade {
+			only = append(only, pkg)
+		}
+		sort.Strings(only)
+		fmt.Fprintf(h, "only-upgrade %s\n", strings.Join(only, ","))
+	}
+	for _, entry := range cfg.Packages {
+		if isDirectEntry(entry) && !strings.Contains(entry, directChecksumSep) {
+			return "", fmt.Errorf("%s has no %s suffix, its content may change", entry, directChecksumSep)
+		}
+	}
+	for _, repo := range cfg.Repos {
+		path, err := prefetchIndex(repo)
+		if err != nil {
+			return "", err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "\nrepo %s\n", repo)
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	if cfg.Base != "" {
+		base, err := readBaseDB(cfg.Base)
+		if err != nil {
+			return "", err
+		}
+		var names []string
+		for name := range base {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(h, "\nbase\n")
+		for _, name := range names {
+			fmt.Fprintf(h, "%s %s\n", name, base[name])
+		}
+	}
+	files := []string{statePath("installed.yaml")}
+	if locked {
+		files = append(files, lockfilePath(configPath))
+	}
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		fmt.Fprintf(h, "\nfile %s\n", filepath.Base(path))
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readResolveCache returns the key of the last converged run, empty if there is none
+func readResolveCache() string {
+	data, err := os.ReadFile(statePath(resolveCacheFile))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// writeResolveCache records key as the key of a run that found nothing to change
+func writeResolveCache(key string) error {
+	return os.WriteFile(statePath(resolveCacheFile), []byte(key+"\n"), 0644)
+}
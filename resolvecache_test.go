@@ -0,0 +1,105 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveCacheKey(t *testing.T) {
+	oldState, oldData := stateDir, configData
+	stateDir = t.TempDir()
+	configData = []byte("packages: [busybox]\n")
+	defer func() { stateDir, configData = oldState, oldData }()
+
+	fetches := 0
+	index := "P:busybox\nV:1.36.1-r0\n\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		w.Write([]byte(index))
+	}))
+	defer srv.Close()
+	cfg := &Config{Repos: []string{srv.URL}, Packages: []string{"busybox"}}
+
+	key, err := resolveCacheKey("apkg.yaml", cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := fetchIndex(srv.URL); err != nil || fetches != 1 {
+		t.Fatalf("fetchIndex should reuse the prefetched index: %v, %d fetches", err, fetches)
+	}
+	if again, _ := resolveCacheKey("apkg.yaml", cfg, false); again != key {
+		t.Error("key changed although nothing did")
+	}
+	delete(prefetchedIndexes, srv.URL)
+	writeInstalledPkgs(statePath("installed.yaml"), map[string]string{"busybox": "1.36.1-r0"})
+	if changed, _ := resolveCacheKey("apkg.yaml", cfg, false); changed == key {
+		t.Error("key didn't change with installed.yaml")
+	}
+	delete(prefetchedIndexes, srv.URL)
+	index = "P:busybox\nV:1.36.1-r1\n\n"
+	if changed, _ := resolveCacheKey("apkg.yaml", cfg, false); changed == key {
+		t.Error("key didn't change with the index")
+	}
+	key, _ = resolveCacheKey("apkg.yaml", cfg, false)
+	withGroups = []string{"debug"}
+	changed, _ := resolveCacheKey("apkg.yaml", cfg, false)
+	withGroups = nil
+	if changed == key {
+		t.Error("key didn't change with -with")
+	}
+	onlyUpgrade = map[string]bool{"busybox": true}
+	changed, _ = resolveCacheKey("apkg.yaml", cfg, false)
+	onlyUpgrade = nil
+	if changed == key {
+		t.Error("key didn't change with -only-upgrade")
+	}
+	base := t.TempDir()
+	os.MkdirAll(filepath.Join(base, "lib/apk/db"), 0755)
+	os.WriteFile(filepath.Join(base, apkInstalledDB), []byte(testInstalledDB), 0644)
+	cfg.Base = base
+	key, _ = resolveCacheKey("apkg.yaml", cfg, false)
+	os.WriteFile(filepath.Join(base, apkInstalledDB), []byte("P:musl\nV:1.2.5-r1\n"), 0644)
+	if changed, _ := resolveCacheKey("apkg.yaml", cfg, false); changed == key {
+		t.Error("key didn't change with the base layer")
+	}
+	cfg.Base = ""
+	cfg.Packages = append(cfg.Packages, "https://example.org/foo.apk")
+	if _, err := resolveCacheKey("apkg.yaml", cfg, false); err == nil {
+		t.Error("expected a direct entry without checksum to disable the cache")
+	}
+}
+
+func TestPrefetchIndexOwnTempFile(t *testing.T) {
+	oldState := stateDir
+	stateDir = t.TempDir()
+	defer func() { stateDir = oldState }()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("P:busybox\nV:1.36.1-r0\n\n"))
+	}))
+	defer srv.Close()
+
+	// Two runs sharing the index cache, as build-matrix's do, each fetch to a file of their own
+	first, err := prefetchIndex(srv.URL)
+	delete(prefetchedIndexes, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := fetchIndex(srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(first); err != nil {
+		t.Errorf("the other run's fetch was clobbered: %v", err)
+	}
+	if pkgs, err := parseAPKIndexFile(indexCachePath(srv.URL)); err != nil || pkgs["busybox"].Version != "1.36.1-r0" {
+		t.Errorf("cached index %v, %v", pkgs, err)
+	}
+}
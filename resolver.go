@@ -0,0 +1,357 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxResolveSteps bounds the backtracking search, a config that needs more is reported
+// instead of keeping apkg busy for hours
+const maxResolveSteps = 200000
+
+// depConstraint is a parsed dependency token like 'so:libc.musl-x86_64.so.1', 'foo>=1.2' or '!bar'
+type depConstraint struct {
+	Name     string
+	Op       string // "", "=", "<", "<=", ">", ">=" or "~"
+	Version  string
+	Conflict bool
+}
+
+// parseDep parses a dependency token of an index D: line or .PKGINFO depend
+func parseDep(tok string) depConstraint {
+	var d depConstraint
+	if strings.HasPrefix(tok, "!") {
+		d.Conflict = true
+		tok = tok[1:]
+	}
+	i := strings.IndexAny(tok, "<>=~")
+	if i < 0 {
+		d.Name = tok
+		return d
+	}
+	d.Name = tok[:i]
+	j := i
+	for j < len(tok) && strings.ContainsRune("<>=~", rune(tok[j])) {
+		j++
+	}
+	d.Op, d.Version = tok[i:j], tok[j:]
+	return d
+}
+
+// String formats d the way it's written in an index
+func (d depConstraint) String() string {
+	s := d.Name + d.Op + d.Version
+	if d.Conflict {
+		s = "!" + s
+	}
+	return s
+}
+
+// fuzzyVersionMatch reports whether version is want or a version below it, e.g. 1.2 matches
+// 1.2, 1.2.3 and 1.2-r1 but not 1.20
+func fuzzyVersionMatch(version, want string) bool {
+	if !strings.HasPrefix(version, want) {
+		return false
+	}
+	rest := version[len(want):]
+	return rest == "" || strings.ContainsRune(".-_", rune(rest[0]))
+}
+
+// allows reports whether version meets the version constraint of d
+func (d depConstraint) allows(version string) bool {
+	if d.Op == "" {
+		return true
+	}
+	if strings.Contains(d.Op, "~") {
+		return fuzzyVersionMatch(version, d.Version)
+	}
+	c := compareAPKVersions(version, d.Version)
+	switch d.Op {
+	case "=", "==":
+		return c == 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return true
+}
+
+// pendingDep is a dependency still to be satisfied and the chain of packages that want it
+type pendingDep struct {
+	dep   depConstraint
+	chain []string
+}
+
+// resolveConflict is a '!' dependency of a selected package
+type resolveConflict struct {
+	dep depConstraint
+	by  string
+}
+
+// DependencyOverride deviates from the dependencies a package declares
+type DependencyOverride struct {
+	// Ignore lists dependencies that aren't installed for the package
+	Ignore []string `yaml:"ignore,omitempty"`
+	// Replace maps a dependency to the package installed in its place
+	Replace map[string]string `yaml:"replace,omitempty"`
+}
+
+// validateDependencyOverrides checks that overrides have something to apply to
+func validateDependencyOverrides(cfg *Config) error {
+	if len(cfg.DependencyOverrides) > 0 && !cfg.ResolveDeps {
+		return fmt.Errorf("dependency_overrides needs resolve_deps")
+	}
+	for pkg, o := range cfg.DependencyOverrides {
+		for _, dep := range o.Ignore {
+			if dep == "" {
+				return fmt.Errorf("dependency_overrides of %s ignores an empty dependency", pkg)
+			}
+		}
+		for dep, sub := range o.Replace {
+			if dep == "" || sub == "" {
+				return fmt.Errorf("dependency_overrides of %s has an empty replacement", pkg)
+			}
+		}
+	}
+	return nil
+}
+
+// overrideDep applies the overrides of pkg to one of its dependency tokens, returning
+// the token to resolve instead ("" when it's ignored) and a description of the change
+func overrideDep(overrides map[string]DependencyOverride, pkg, tok string) (string, string) {
+	o, ok := overrides[pkg]
+	if !ok {
+		return tok, ""
+	}
+	d := parseDep(tok)
+	for _, ignored := range o.Ignore {
+		if d.Name == ignored {
+			return "", fmt.Sprintf("%s: ignoring dependency %s", pkg, tok)
+		}
+	}
+	if sub, ok := o.Replace[d.Name]; ok {
+		if d.Conflict {
+			sub = "!" + sub
+		}
+		return sub, fmt.Sprintf("%s: dependency %s replaced by %s", pkg, tok, sub)
+	}
+	return tok, ""
+}
+
+// appliedOverrides describes the dependency overrides that change the deps of the
+// packages to install
+func appliedOverrides(cfg *Config, pkgMap map[string]APKPackage, toInstall []string) []string {
+	var applied []string
+	for _, pkg := range toInstall {
+		for _, tok := range pkgMap[pkg].Deps {
+			if _, change := overrideDep(cfg.DependencyOverrides, pkg, tok); change != "" {
+				applied = append(applied, change)
+			}
+		}
+	}
+	return applied
+}
+
+// resolveError is the dead end a resolution failed on: the dependency nothing could
+// satisfy and, when a conflict ruled out its candidates, the package declaring it
+type resolveError struct {
+	Dep           depConstraint
+	Chain         []string
+	ConflictBy    string
+	ConflictChain []string
+	msg           string
+}
+
+// Error implements error
+func (e *resolveError) Error() string {
+	return "can't resolve dependencies: " + e.msg
+}
+
+// resolver picks a set of packages satisfying every dependency and conflict, trying the
+// other providers of a dependency when a choice leads to a dead end
+type resolver struct {
+	pkgMap    map[string]APKPackage
+	provides  map[string][]string
+	overrides map[string]DependencyOverride
+	selected  map[string][]string // package -> chain that pulled it in
+	conflicts []resolveConflict
+	steps     int
+	// failure is the dead end reached with the most packages selected, it's the
+	// closest the search got to a solution
+	failure      *resolveError
+	failureDepth int
+}
+
+// requiredBy formats a chain of requiring packages for an explanation
+func requiredBy(chain []string) string {
+	if len(chain) == 0 {
+		return "required by the config"
+	}
+	return "required by " + strings.Join(chain, " <- ")
+}
+
+// fail records why the search is stuck, keeping the deepest dead end
+func (r *resolver) fail(e *resolveError, format string, args ...interface{}) {
+	if r.failure == nil || len(r.selected) >= r.failureDepth {
+		e.msg = fmt.Sprintf(format, args...)
+		r.failure = e
+		r.failureDepth = len(r.selected)
+	}
+}
+
+// satisfies reports whether package name meets d by its name or one of its provides
+func (r *resolver) satisfies(name string, d depConstraint) bool {
+	pkg := r.pkgMap[name]
+	if pkg.Name == d.Name && d.allows(pkg.Version) {
+		return true
+	}
+	for _, p := range pkg.Provides {
+		pname, pver, versioned := strings.Cut(p, "=")
+		if pname != d.Name {
+			continue
+		}
+		if d.Op == "" || (versioned && d.allows(pver)) {
+			return true
+		}
+	}
+	return false
+}
+
+// candidates returns the packages that could satisfy d, the package named like it first
+// and the other providers by descending provider_priority
+func (r *resolver) candidates(d depConstraint) []string {
+	var cands []string
+	named := false
+	for _, name := range r.provides[d.Name] {
+		if !r.satisfies(name, d) {
+			continue
+		}
+		if name == d.Name {
+			named = true
+		} else {
+			cands = append(cands, name)
+		}
+	}
+	sort.SliceStable(cands, func(i, j int) bool {
+		return r.pkgMap[cands[i]].ProviderPriority > r.pkgMap[cands[j]].ProviderPriority
+	})
+	if named {
+		cands = append([]string{d.Name}, cands...)
+	}
+	return cands
+}
+
+// blocker returns the conflict of a selected package that rules name out, if any
+func (r *resolver) blocker(name string) *resolveConflict {
+	for i, c := range r.conflicts {
+		if c.by != name && r.satisfies(name, c.dep) {
+			return &r.conflicts[i]
+		}
+	}
+	return nil
+}
+
+// solve satisfies the queued dependencies depth-first, undoing a choice when it fails
+func (r *resolver) solve(queue []pendingDep) bool {
+	r.steps++
+	if r.steps > maxResolveSteps {
+		r.failure = &resolveError{msg: fmt.Sprintf("gave up after %d steps, the dependencies are too entangled", maxResolveSteps)}
+		return false
+	}
+	if len(queue) == 0 {
+		return true
+	}
+	next, rest := queue[0], queue[1:]
+	d := next.dep
+	if d.Conflict {
+		by := "the config"
+		if len(next.chain) > 0 {
+			by = next.chain[0]
+		}
+		for name, chain := range r.selected {
+			if name != by && r.satisfies(name, d) {
+				r.fail(&resolveError{Dep: parseDep(name), Chain: chain, ConflictBy: by, ConflictChain: next.chain[min(1, len(next.chain)):]},
+					"%s conflicts with %s (%s), which is %s", by, d.Name, d, requiredBy(chain))
+				return false
+			}
+		}
+		r.conflicts = append(r.conflicts, resolveConflict{d, by})
+		if r.solve(rest) {
+			return true
+		}
+		r.conflicts = r.conflicts[:len(r.conflicts)-1]
+		return false
+	}
+	for name := range r.selected {
+		if r.satisfies(name, d) {
+			return r.solve(rest)
+		}
+	}
+	cands := r.candidates(d)
+	if len(cands) == 0 {
+		if pkg, ok := r.pkgMap[d.Name]; ok {
+			r.fail(&resolveError{Dep: d, Chain: next.chain}, "%s is %s, but the repos only have %s %s", d, requiredBy(next.chain), d.Name, pkg.Version)
+		} else {
+			r.fail(&resolveError{Dep: d, Chain: next.chain}, "nothing provides %s, %s", d, requiredBy(next.chain))
+		}
+		return false
+	}
+	for _, name := range cands {
+		if c := r.blocker(name); c != nil {
+			r.fail(&resolveError{Dep: d, Chain: next.chain, ConflictBy: c.by, ConflictChain: r.selected[c.by]},
+				"%s (for %s, %s) conflicts with %s, which is %s", name, d, requiredBy(next.chain), c.by, requiredBy(r.selected[c.by]))
+			continue
+		}
+		debugf("resolve", "%s: trying %s, %s", d, name, requiredBy(next.chain))
+		chain := append([]string{name}, next.chain...)
+		r.selected[name] = next.chain
+		var deps []pendingDep
+		for _, tok := range r.pkgMap[name].Deps {
+			tok, _ = overrideDep(r.overrides, name, tok)
+			if tok != "" && tok != name {
+				deps = append(deps, pendingDep{parseDep(tok), chain})
+			}
+		}
+		if r.solve(append(deps, rest...)) {
+			return true
+		}
+		delete(r.selected, name)
+	}
+	return false
+}
+
+// resolveDependencies returns the packages needed to install pkgs with all their
+// dependencies after overrides, or why no consistent set exists. Configured names no
+// repo has are left for the install to report.
+func resolveDependencies(pkgs []string, pkgMap map[string]APKPackage, sourceRepo map[string]string, overrides map[string]DependencyOverride) ([]string, error) {
+	r := &resolver{pkgMap: pkgMap, provides: providesMap(pkgMap, sourceRepo), overrides: overrides, selected: map[string][]string{}}
+	var queue []pendingDep
+	for _, pkg := range pkgs {
+		d := parseDep(pkg)
+		if len(r.provides[d.Name]) == 0 {
+			continue
+		}
+		queue = append(queue, pendingDep{dep: d})
+	}
+	if !r.solve(queue) {
+		return nil, r.failure
+	}
+	resolved := make([]string, 0, len(r.selected))
+	for name := range r.selected {
+		resolved = append(resolved, name)
+	}
+	sort.Strings(resolved)
+	return resolved, nil
+}
@@ -0,0 +1,156 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseDep(t *testing.T) {
+	cases := map[string]depConstraint{
+		"musl":                     {Name: "musl"},
+		"so:libc.musl-x86_64.so.1": {Name: "so:libc.musl-x86_64.so.1"},
+		"busybox>=1.36":            {Name: "busybox", Op: ">=", Version: "1.36"},
+		"openssl~3.3":              {Name: "openssl", Op: "~", Version: "3.3"},
+		"!ssl_client":              {Name: "ssl_client", Conflict: true},
+	}
+	for tok, want := range cases {
+		if got := parseDep(tok); got != want {
+			t.Errorf("parseDep(%q) = %+v, want %+v", tok, got, want)
+		}
+		if got := parseDep(tok).String(); got != tok {
+			t.Errorf("parseDep(%q).String() = %q", tok, got)
+		}
+	}
+}
+
+func TestResolveBacktracks(t *testing.T) {
+	// The first provider of cmd:sh conflicts with a package needed later, the
+	// resolver has to go back and pick the other one
+	pkgMap := map[string]APKPackage{
+		"app":          {Name: "app", Version: "1.0-r0", Deps: []string{"cmd:sh", "tool>=2"}},
+		"busybox":      {Name: "busybox", Version: "1.36.1-r0", Provides: []string{"cmd:sh"}},
+		"dash":         {Name: "dash", Version: "0.5.12-r0", Provides: []string{"cmd:sh"}},
+		"tool":         {Name: "tool", Version: "2.1-r0", Deps: []string{"!busybox", "so:libz.so.1"}},
+		"zlib":         {Name: "zlib", Version: "1.3.1-r0", Provides: []string{"so:libz.so.1=1.3.1"}},
+		"zlib-unused":  {Name: "zlib-unused", Version: "1.0-r0"},
+		"busybox-misc": {Name: "busybox-misc", Version: "1.36.1-r0", Deps: []string{"busybox"}},
+	}
+	got, err := resolveDependencies([]string{"app"}, pkgMap, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, " ") != "app dash tool zlib" {
+		t.Errorf("resolved %v", got)
+	}
+
+	_, err = resolveDependencies([]string{"app", "busybox-misc"}, pkgMap, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "conflicts with") {
+		t.Errorf("expected a conflict, got %v", err)
+	}
+
+	pkgMap["tool"] = APKPackage{Name: "tool", Version: "1.9-r0"}
+	_, err = resolveDependencies([]string{"app"}, pkgMap, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "tool>=2 is required by app, but the repos only have tool 1.9-r0") {
+		t.Errorf("expected an explanation of the too old tool, got %v", err)
+	}
+}
+
+func TestResolveProviderPriority(t *testing.T) {
+	pkgMap := map[string]APKPackage{
+		"app":     {Name: "app", Version: "1.0-r0", Deps: []string{"cmd:sh", "lib~1.2"}},
+		"busybox": {Name: "busybox", Version: "1.36.1-r0", Provides: []string{"cmd:sh"}, ProviderPriority: 100},
+		"dash":    {Name: "dash", Version: "0.5.12-r0", Provides: []string{"cmd:sh"}, ProviderPriority: 10},
+		"lib":     {Name: "lib", Version: "1.2.4-r1"},
+	}
+	got, err := resolveDependencies([]string{"app"}, pkgMap, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, " ") != "app busybox lib" {
+		t.Errorf("resolved %v, want the provider with the higher priority", got)
+	}
+
+	pkgMap["lib"] = APKPackage{Name: "lib", Version: "1.20-r0"}
+	if _, err := resolveDependencies([]string{"app"}, pkgMap, nil, nil); err == nil {
+		t.Error("lib~1.2 shouldn't match 1.20")
+	}
+}
+
+func TestFuzzyVersionMatch(t *testing.T) {
+	cases := map[string]bool{"1.2": true, "1.2.3": true, "1.2-r1": true, "1.2_rc1": true, "1.20": false, "1.1": false}
+	for version, want := range cases {
+		if got := fuzzyVersionMatch(version, "1.2"); got != want {
+			t.Errorf("fuzzyVersionMatch(%q, 1.2) = %v", version, got)
+		}
+	}
+}
+
+func TestResolveErrorDetails(t *testing.T) {
+	pkgMap := map[string]APKPackage{
+		"app":  {Name: "app", Version: "1.0-r0", Deps: []string{"lib"}},
+		"lib":  {Name: "lib", Version: "2.0-r0"},
+		"tool": {Name: "tool", Version: "1.0-r0", Deps: []string{"!lib"}},
+	}
+	_, err := resolveDependencies([]string{"app", "tool"}, pkgMap, nil, nil)
+	re, ok := err.(*resolveError)
+	if !ok {
+		t.Fatalf("expected a resolveError, got %v", err)
+	}
+	if re.Dep.Name != "lib" || strings.Join(re.Chain, " ") != "app" || re.ConflictBy != "tool" || len(re.ConflictChain) != 0 {
+		t.Errorf("unexpected failure details %+v", re)
+	}
+}
+
+func TestSiblingRepos(t *testing.T) {
+	got := siblingRepos([]string{
+		"https://dl-cdn.alpinelinux.org/alpine/v3.22/main/x86_64",
+		"https://dl-cdn.alpinelinux.org/alpine/edge/testing/x86_64/",
+		"https://example.com/repo",
+	})
+	want := []string{
+		"https://dl-cdn.alpinelinux.org/alpine/v3.22/community/x86_64",
+		"https://dl-cdn.alpinelinux.org/alpine/edge/main/x86_64",
+		"https://dl-cdn.alpinelinux.org/alpine/edge/community/x86_64",
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("siblingRepos = %v, want %v", got, want)
+	}
+}
+
+func TestDependencyOverrides(t *testing.T) {
+	pkgMap := map[string]APKPackage{
+		"nginx":        {Name: "nginx", Version: "1.26.2-r0", Deps: []string{"nginx-openrc", "pcre>=8"}},
+		"nginx-openrc": {Name: "nginx-openrc", Version: "1.26.2-r0", Deps: []string{"openrc"}},
+		"openrc":       {Name: "openrc", Version: "0.55-r0"},
+		"pcre":         {Name: "pcre", Version: "8.45-r3"},
+		"pcre2":        {Name: "pcre2", Version: "10.43-r0"},
+	}
+	cfg := &Config{Packages: []string{"nginx"}, ResolveDeps: true, DependencyOverrides: map[string]DependencyOverride{
+		"nginx": {Ignore: []string{"nginx-openrc"}, Replace: map[string]string{"pcre": "pcre2"}},
+	}}
+	if err := validateDependencyOverrides(cfg); err != nil {
+		t.Fatal(err)
+	}
+	got, err := resolveInstallSet(cfg, pkgMap, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, " ") != "nginx pcre2" {
+		t.Errorf("resolved %v", got)
+	}
+	applied := appliedOverrides(cfg, pkgMap, got)
+	want := "nginx: ignoring dependency nginx-openrc|nginx: dependency pcre>=8 replaced by pcre2"
+	if strings.Join(applied, "|") != want {
+		t.Errorf("applied overrides %q", applied)
+	}
+	cfg.ResolveDeps = false
+	if err := validateDependencyOverrides(cfg); err == nil {
+		t.Error("overrides without resolve_deps were accepted")
+	}
+}
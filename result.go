@@ -0,0 +1,127 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+)
+
+// resultSchemaVersion is bumped whenever a field of RunResult changes meaning or is removed
+const resultSchemaVersion = 1
+
+// RunResult is the machine-readable summary printed with -json, see README.md for the schema
+type RunResult struct {
+	SchemaVersion int         `json:"schema_version"`
+	Changed       bool        `json:"changed"`
+	DryRun        bool        `json:"dry_run"`
+	Installed     []ResultPkg `json:"installed"`
+	Upgraded      []ResultPkg `json:"upgraded"`
+	Removed       []ResultPkg `json:"removed"`
+	// Services are the init scripts and units shipped by the installed and upgraded packages
+	Services []Service `json:"services,omitempty"`
+	// Warnings are the warnings printed during the run
+	Warnings []ResultWarning `json:"warnings"`
+	// Failed are the packages on_failure: continue-and-report went on without
+	Failed []PackageFailure `json:"failed,omitempty"`
+	// Transfer are the bytes this run fetched, by where they came from
+	Transfer *TrafficCounters `json:"transfer,omitempty"`
+}
+
+// ResultPkg is a single package change in a RunResult
+type ResultPkg struct {
+	Name       string `json:"name"`
+	Version    string `json:"version,omitempty"`
+	OldVersion string `json:"old_version,omitempty"`
+	// Group is the optional group the package belongs to
+	Group string `json:"group,omitempty"`
+}
+
+// jsonOut is where the -json summary goes, human readable output is moved to stderr
+var jsonOut *os.File
+
+// enableJSONOutput keeps stdout for the JSON summary and sends everything else to stderr
+func enableJSONOutput() {
+	jsonOut = os.Stdout
+	os.Stdout = os.Stderr
+}
+
+// newRunResult builds the summary of a plan that wasn't applied (dry runs, nothing to do),
+// installed is false when install: false would only stage the installs and upgrades
+func newRunResult(plan *Plan, dryRun, installed bool) *RunResult {
+	r := &RunResult{
+		SchemaVersion: resultSchemaVersion,
+		DryRun:        dryRun,
+		Installed:     []ResultPkg{},
+		Upgraded:      []ResultPkg{},
+		Removed:       []ResultPkg{},
+		Warnings:      []ResultWarning{},
+	}
+	if installed || dryRun {
+		for _, it := range plan.Installs {
+			r.Installed = append(r.Installed, ResultPkg{Name: it.Name, Version: it.NewVersion, Group: it.Group})
+		}
+		for _, it := range plan.Upgrades {
+			r.Upgraded = append(r.Upgraded, ResultPkg{Name: it.Name, Version: it.NewVersion, OldVersion: it.OldVersion, Group: it.Group})
+		}
+	}
+	for _, it := range plan.Removals {
+		r.Removed = append(r.Removed, ResultPkg{Name: it.Name, OldVersion: it.OldVersion})
+	}
+	r.Changed = len(r.Installed)+len(r.Upgraded)+len(r.Removed) > 0
+	return r
+}
+
+// outcomeResult builds the summary of an apply from what it changed: before and after
+// are the installed packages at its start and end, so failed and skipped packages aren't
+// reported as installed. The plan only contributes the groups.
+func outcomeResult(plan *Plan, before, after map[string]string) *RunResult {
+	r := newRunResult(&Plan{}, false, false)
+	groups := map[string]string{}
+	for _, list := range [][]PlanItem{plan.Installs, plan.Upgrades} {
+		for _, it := range list {
+			groups[it.Name] = it.Group
+		}
+	}
+	for _, name := range sortedNames(after) {
+		old, ok := before[name]
+		switch {
+		case !ok:
+			r.Installed = append(r.Installed, ResultPkg{Name: name, Version: after[name], Group: groups[name]})
+		case old != after[name]:
+			r.Upgraded = append(r.Upgraded, ResultPkg{Name: name, Version: after[name], OldVersion: old, Group: groups[name]})
+		}
+	}
+	for _, name := range sortedNames(before) {
+		if _, ok := after[name]; !ok {
+			r.Removed = append(r.Removed, ResultPkg{Name: name, OldVersion: before[name]})
+		}
+	}
+	r.Changed = len(r.Installed)+len(r.Upgraded)+len(r.Removed) > 0
+	return r
+}
+
+// sortedNames returns the package names of a name -> version map in order
+func sortedNames(pkgs map[string]string) []string {
+	names := make([]string, 0, len(pkgs))
+	for name := range pkgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// emitResult prints the summary when -json is enabled
+func emitResult(r *RunResult) {
+	if jsonOut == nil {
+		return
+	}
+	enc := json.NewEncoder(jsonOut)
+	enc.SetIndent("", "  ")
+	enc.Encode(r)
+}
@@ -0,0 +1,34 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import "testing"
+
+func TestOutcomeResult(t *testing.T) {
+	plan := &Plan{
+		Installs: []PlanItem{{Name: "htop", NewVersion: "3.4.1-r0", Group: "debug"}, {Name: "broken", NewVersion: "1.0-r0"}},
+		Upgrades: []PlanItem{{Name: "busybox", OldVersion: "1.37.0-r18", NewVersion: "1.37.0-r19"}},
+		Removals: []PlanItem{{Name: "nano", OldVersion: "8.4-r0"}},
+	}
+	before := map[string]string{"busybox": "1.37.0-r18", "nano": "8.4-r0", "musl": "1.2.5-r0"}
+	// broken failed to download and nano's removal never happened
+	after := map[string]string{"busybox": "1.37.0-r19", "nano": "8.4-r0", "musl": "1.2.5-r0", "htop": "3.4.1-r0"}
+	r := outcomeResult(plan, before, after)
+	if len(r.Installed) != 1 || r.Installed[0] != (ResultPkg{Name: "htop", Version: "3.4.1-r0", Group: "debug"}) {
+		t.Errorf("installed %+v", r.Installed)
+	}
+	if len(r.Upgraded) != 1 || r.Upgraded[0].OldVersion != "1.37.0-r18" || r.Upgraded[0].Version != "1.37.0-r19" {
+		t.Errorf("upgraded %+v", r.Upgraded)
+	}
+	if len(r.Removed) != 0 || !r.Changed {
+		t.Errorf("removed %+v, changed %v", r.Removed, r.Changed)
+	}
+	// Nothing applied (install: false) is no change
+	if r := outcomeResult(plan, before, before); r.Changed || len(r.Installed) != 0 || r.Removed == nil {
+		t.Errorf("unchanged run: %+v", r)
+	}
+}
@@ -0,0 +1,206 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// txDone is the journal line marking that every change of a package was made, the
+// checkpoint of the package is complete then
+const txDone = "done"
+
+// checkpointsDir (in a transaction dir) holds what resume needs of every completed package
+const checkpointsDir = "checkpoints"
+
+// resumeRun is set by `apkg resume`: interrupted transactions keep their completed packages
+var resumeRun bool
+
+// txCheckpoint is a package a transaction finished installing or uninstalling, with
+// the state updates its commit would have made
+type txCheckpoint struct {
+	Package      string   `yaml:"package"`
+	Action       string   `yaml:"action"` // install or remove
+	Version      string   `yaml:"version"`
+	Files        []string `yaml:"files,omitempty"`
+	Omitted      []string `yaml:"omitted,omitempty"`
+	Alternatives []string `yaml:"alternatives,omitempty"`
+}
+
+// checkpoint records that cp.Package is complete, its control files are kept from
+// stagingDir so resume can store them
+func (tx *Transaction) checkpoint(cp txCheckpoint, stagingDir string) error {
+	dir := filepath.Join(tx.Dir, checkpointsDir)
+	if stagingDir != "" {
+		if src := controlStagingPath(stagingDir, cp.Package); dirExists(src) {
+			dest := controlStagingPath(dir, cp.Package)
+			os.RemoveAll(dest)
+			if err := copyTree(src, dest, false); err != nil {
+				return err
+			}
+		}
+	}
+	data, err := yaml.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, cp.Package+".yaml"), data, 0644); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(tx.journal, "%s\t%s\n", txDone, cp.Package); err != nil {
+		return err
+	}
+	return tx.journal.Sync()
+}
+
+// dirExists reports whether path is a directory
+func dirExists(path string) bool {
+	st, err := os.Stat(path)
+	return err == nil && st.IsDir()
+}
+
+// stagedVersion returns the version in the staged .PKGINFO of pkg
+func stagedVersion(stagingDir, pkg string) string {
+	f, err := os.Open(filepath.Join(controlStagingPath(stagingDir, pkg), ".PKGINFO"))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	info, _ := parsePkgInfo(f)
+	if v := info["pkgver"]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// readJournal returns the lines of the journal in txDir, done markers included
+func readJournal(txDir string) ([]txEntry, error) {
+	f, err := os.Open(filepath.Join(txDir, "journal"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+	var entries []txEntry
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		parts := strings.SplitN(sc.Text(), "\t", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		e := txEntry{action: parts[0], rel: parts[1]}
+		if e.action == txSave {
+			e.saved, e.rel, _ = strings.Cut(e.rel, "\t")
+		}
+		entries = append(entries, e)
+	}
+	return entries, sc.Err()
+}
+
+// resumedPkgs are the packages resumed transactions kept installed, the apply that
+// follows counts them as changed so their hooks run
+var resumedPkgs []string
+
+// resumeTransaction keeps the completed packages of the interrupted transaction in txDir:
+// the changes after the last completed package are undone, the state updates of the
+// completed ones are made, their changes are audited and installed.yaml is updated.
+// It returns how many were kept.
+func resumeTransaction(txDir, installDir, installedPkgsPath string) (int, error) {
+	entries, err := readJournal(txDir)
+	if err != nil {
+		return 0, err
+	}
+	var done []string
+	var kept []txEntry
+	tail := entries
+	for i, e := range entries {
+		if e.action == txDone {
+			// The changes since the previous marker were made for this package
+			for _, k := range tail[:len(tail)-len(entries[i:])] {
+				k.pkg = e.rel
+				kept = append(kept, k)
+			}
+			done = append(done, e.rel)
+			tail = entries[i+1:]
+		}
+	}
+	if err := undoEntries(installDir, txDir, tail); err != nil {
+		return 0, err
+	}
+	installed, err := readInstalledPkgs(installedPkgsPath)
+	if err != nil {
+		return 0, err
+	}
+	dir := filepath.Join(txDir, checkpointsDir)
+	for _, pkg := range done {
+		data, err := os.ReadFile(filepath.Join(dir, pkg+".yaml"))
+		if err != nil {
+			return 0, err
+		}
+		var cp txCheckpoint
+		if err := yaml.Unmarshal(data, &cp); err != nil {
+			return 0, fmt.Errorf("checkpoint of %s: %w", pkg, err)
+		}
+		if cp.Action == "remove" {
+			forgetPackage(installDir, cp.Package, cp.Version, cp.Files)
+			delete(installed, cp.Package)
+			continue
+		}
+		recordPackage(installDir, dir, cp.Package, cp.Files, cp.Omitted, cp.Alternatives)
+		installed[cp.Package] = cp.Version
+		resumedPkgs = append(resumedPkgs, cp.Package)
+	}
+	if err := writeInstalledPkgs(installedPkgsPath, installed); err != nil {
+		return 0, err
+	}
+	// The backups are still there for the before hashes
+	if err := writeAuditLog(&Transaction{ID: filepath.Base(txDir), Dir: txDir, installDir: installDir, entries: kept}); err != nil {
+		eprintf("[WARN] Failed to write audit log: %v\n", err)
+	}
+	return len(done), os.RemoveAll(txDir)
+}
+
+// resumeTransactions resumes every interrupted transaction against installDir, others are
+// rolled back like recoverTransactions does
+func resumeTransactions(installDir, installedPkgsPath string) error {
+	dirs, err := os.ReadDir(statePath(transactionsDir))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	resumed := 0
+	for _, d := range dirs {
+		txDir := filepath.Join(statePath(transactionsDir), d.Name())
+		txInstallDir, err := os.ReadFile(filepath.Join(txDir, "install_dir"))
+		if err != nil {
+			return fmt.Errorf("transaction %s is unreadable: %w", d.Name(), err)
+		}
+		if string(txInstallDir) != installDir {
+			continue // recoverTransactions rolls it back
+		}
+		kept, err := resumeTransaction(txDir, installDir, installedPkgsPath)
+		if err != nil {
+			return fmt.Errorf("resuming transaction %s: %w", d.Name(), err)
+		}
+		printf("Resumed transaction %s: kept %d completed packages, undid the one in progress\n", d.Name(), kept)
+		resumed++
+	}
+	if resumed == 0 {
+		printf("No interrupted transaction to resume\n")
+	}
+	return recoverTransactions()
+}
@@ -0,0 +1,119 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResumeKeepsCompletedPackages(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	oldConfig := globalConfig
+	globalConfig = &Config{AuditLog: filepath.Join(dir, "audit.jsonl")}
+	defer func() { globalConfig, resumedPkgs = oldConfig, nil }()
+
+	root := filepath.Join(dir, "root")
+	staging := filepath.Join(dir, "staging")
+	os.MkdirAll(root, 0755)
+	os.MkdirAll(controlStagingPath(staging, "foo"), 0755)
+	os.WriteFile(filepath.Join(controlStagingPath(staging, "foo"), ".PKGINFO"), []byte("pkgname = foo\npkgver = 1.2-r0\n"), 0644)
+	installedPath := filepath.Join(dir, "installed.yaml")
+	writeInstalledPkgs(installedPath, map[string]string{"old": "1.0-r0"})
+	os.WriteFile(filepath.Join(root, "old"), []byte("old"), 0644)
+
+	tx, err := beginTransaction(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// foo is installed completely
+	tx.setPackage("foo")
+	tx.prepareWrite("foo")
+	os.WriteFile(filepath.Join(root, "foo"), []byte("foo"), 0644)
+	if err := tx.checkpoint(txCheckpoint{Package: "foo", Action: "install", Version: stagedVersion(staging, "foo"), Files: []string{"foo"}}, staging); err != nil {
+		t.Fatal(err)
+	}
+	// old is removed completely
+	tx.setPackage("old")
+	tx.removeFile("old")
+	if err := tx.checkpoint(txCheckpoint{Package: "old", Action: "remove", Version: "1.0-r0", Files: []string{"old"}}, ""); err != nil {
+		t.Fatal(err)
+	}
+	// bar is interrupted midway
+	tx.setPackage("bar")
+	tx.prepareWrite("bar")
+	os.WriteFile(filepath.Join(root, "bar"), []byte("bar"), 0644)
+	tx.journal.Close()
+
+	if err := resumeTransactions(root, installedPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "foo")); err != nil {
+		t.Errorf("completed install undone: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "old")); !os.IsNotExist(err) {
+		t.Errorf("completed removal undone")
+	}
+	if _, err := os.Stat(filepath.Join(root, "bar")); !os.IsNotExist(err) {
+		t.Errorf("package in progress not undone")
+	}
+	installed, _ := readInstalledPkgs(installedPath)
+	if len(installed) != 1 || installed["foo"] != "1.2-r0" {
+		t.Errorf("installed = %v, want only foo 1.2-r0", installed)
+	}
+	if files, err := readInstalledFiles("foo"); err != nil || len(files) != 1 {
+		t.Errorf("installed files of foo = %v, %v", files, err)
+	}
+	if _, err := os.Stat(filepath.Join(installedControlPath("foo"), ".PKGINFO")); err != nil {
+		t.Errorf("control files of foo not stored: %v", err)
+	}
+	if _, err := os.Stat(tx.Dir); !os.IsNotExist(err) {
+		t.Errorf("transaction dir left behind")
+	}
+	// The next apply runs the hooks of foo, the audit log has the kept changes
+	if len(resumedPkgs) != 1 || resumedPkgs[0] != "foo" {
+		t.Errorf("resumed packages = %v, want foo", resumedPkgs)
+	}
+	audit, _ := os.ReadFile(globalConfig.AuditLog)
+	if !strings.Contains(string(audit), `"package":"foo"`) || !strings.Contains(string(audit), `"package":"old"`) || strings.Contains(string(audit), `"bar"`) {
+		t.Errorf("audit log:\n%s", audit)
+	}
+}
+
+func TestResumeRollsBackOtherInstallDirs(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	root := filepath.Join(dir, "gen")
+	os.MkdirAll(root, 0755)
+	tx, err := beginTransaction(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.prepareWrite("foo")
+	os.WriteFile(filepath.Join(root, "foo"), []byte("foo"), 0644)
+	tx.checkpoint(txCheckpoint{Package: "foo", Action: "install"}, "")
+	tx.journal.Close()
+
+	if err := resumeTransactions(filepath.Join(dir, "root"), filepath.Join(dir, "installed.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "foo")); !os.IsNotExist(err) {
+		t.Errorf("transaction of another install_dir not rolled back")
+	}
+}
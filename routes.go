@@ -0,0 +1,68 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// validateRoutes checks that every route sends a path inside install_dir somewhere
+func validateRoutes(cfg *Config) error {
+	for from, to := range cfg.Routes {
+		if p := routePath(from); p == "." || p == ".." || strings.HasPrefix(p, "../") {
+			return fmt.Errorf("route %q must be a path inside install_dir", from)
+		}
+		if to == "" {
+			return fmt.Errorf("route %q has no destination", from)
+		}
+	}
+	return nil
+}
+
+// routePath returns a route's path relative to install_dir, a leading / is allowed
+func routePath(from string) string {
+	if p := strings.TrimLeft(filepath.ToSlash(filepath.Clean(from)), "/"); p != "" {
+		return p
+	}
+	return "."
+}
+
+// installPath returns where rel (relative to install_dir) is on disk: below the
+// destination of the longest route covering it, or in installDir
+func installPath(installDir, rel string) string {
+	if globalConfig == nil || len(globalConfig.Routes) == 0 {
+		return filepath.Join(installDir, rel)
+	}
+	slashed := filepath.ToSlash(filepath.Clean(rel))
+	best, dest := "", ""
+	for from, to := range globalConfig.Routes {
+		p := routePath(from)
+		if (slashed == p || strings.HasPrefix(slashed, p+"/")) && len(p) > len(best) {
+			best, dest = p, to
+		}
+	}
+	if best == "" {
+		return filepath.Join(installDir, rel)
+	}
+	return filepath.Join(dest, filepath.FromSlash(strings.TrimPrefix(slashed, best)))
+}
+
+// isRouteRoot reports whether dir is the destination of a route, which is never
+// removed when it becomes empty
+func isRouteRoot(dir string) bool {
+	if globalConfig == nil {
+		return false
+	}
+	for _, to := range globalConfig.Routes {
+		if filepath.Clean(to) == filepath.Clean(dir) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,34 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestInstallPath(t *testing.T) {
+	oldConfig := globalConfig
+	globalConfig = &Config{Routes: map[string]string{"etc": "/vol/config", "usr/share/doc": "/vol/docs", "usr/share/doc/keep": "/vol/keep"}}
+	defer func() { globalConfig = oldConfig }()
+	cases := map[string]string{
+		"etc":                     "/vol/config",
+		"etc/motd":                "/vol/config/motd",
+		"etcetera/x":              "/root/etcetera/x",
+		"usr/share/doc/a/README":  "/vol/docs/a/README",
+		"usr/share/doc/keep/NEWS": "/vol/keep/NEWS",
+		"usr/bin/busybox":         "/root/usr/bin/busybox",
+	}
+	for rel, want := range cases {
+		if got := installPath("/root", filepath.FromSlash(rel)); got != filepath.FromSlash(want) {
+			t.Errorf("installPath(%q) = %q, want %q", rel, got, want)
+		}
+	}
+	if err := validateRoutes(&Config{Routes: map[string]string{"/": "/vol"}}); err == nil {
+		t.Error("a route of the whole install_dir should be refused")
+	}
+}
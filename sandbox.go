@@ -0,0 +1,300 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Landlock system calls, numbered the same on every architecture
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+)
+
+// Landlock constants from linux/landlock.h
+const (
+	landlockCreateRulesetVersion = 1 << 0
+	landlockRulePathBeneath      = 1
+	landlockRuleNetPort          = 2
+
+	landlockAccessFSExecute     = 1 << 0
+	landlockAccessFSWriteFile   = 1 << 1
+	landlockAccessFSReadFile    = 1 << 2
+	landlockAccessFSReadDir     = 1 << 3
+	landlockAccessFSRefer       = 1 << 13 // ABI 2
+	landlockAccessFSTruncate    = 1 << 14 // ABI 3
+	landlockAccessFSIoctlDev    = 1 << 15 // ABI 5
+	landlockAccessNetBindTCP    = 1 << 0  // ABI 4
+	landlockAccessNetConnectTCP = 1 << 1  // ABI 4
+
+	prSetNoNewPrivs = 38
+	oPath           = 0x200000 // O_PATH, missing from package syscall
+)
+
+// Sets of filesystem rights: what read-only paths allow, every right of ABI 1 (EXECUTE up to
+// MAKE_SYM) and the rights that apply to files rather than directories
+const (
+	landlockFSRead  = landlockAccessFSExecute | landlockAccessFSReadFile | landlockAccessFSReadDir
+	landlockFSABI1  = 1<<13 - 1
+	landlockFSFiles = landlockAccessFSExecute | landlockAccessFSWriteFile | landlockAccessFSReadFile | landlockAccessFSTruncate | landlockAccessFSIoctlDev
+)
+
+// sandboxSystemDirs are readable so apkg can run helpers (gpg, git, strip) and resolve hosts
+var sandboxSystemDirs = []string{"/bin", "/sbin", "/usr", "/lib", "/lib64", "/etc", "/proc"}
+
+// sandboxRules are the paths and ports the sandbox leaves accessible
+type sandboxRules struct {
+	Read  []string
+	Write []string
+	Ports []uint64
+}
+
+// urlPort returns the TCP port an http(s) URL connects to, 0 for anything else
+func urlPort(raw string) uint64 {
+	raw = strings.TrimPrefix(strings.TrimPrefix(raw, "git+"), "deb+")
+	u, err := url.Parse(raw)
+	if err != nil {
+		return 0
+	}
+	if p := u.Port(); p != "" {
+		n, _ := strconv.ParseUint(p, 10, 16)
+		return n
+	}
+	switch u.Scheme {
+	case "http":
+		return 80
+	case "https":
+		return 443
+	}
+	return 0
+}
+
+// sandboxPaths collects what an apply with cfg needs: the system, the config's directory
+// and the keyrings verifying it to read, the state, temp, cache and install dirs to
+// write, the repo ports
+func sandboxPaths(cfg *Config, configPath string) sandboxRules {
+	r := sandboxRules{Read: append([]string(nil), sandboxSystemDirs...)}
+	r.Read = append(r.Read, keysDir())
+	if configPath != "-" && !isRemoteConfig(configPath) {
+		r.Read = append(r.Read, filepath.Dir(configPath))
+	}
+	// The sandboxed process verifies the config and lockfile signatures again
+	for _, keyring := range []string{configKeyring, lockKeyring} {
+		if keyring == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(keyring); err == nil {
+			r.Read = append(r.Read, abs)
+		}
+	}
+	for _, p := range []string{cfg.Base, cfg.ChannelManifest} {
+		if p != "" && !isRemoteConfig(p) {
+			r.Read = append(r.Read, filepath.Dir(p))
+		}
+	}
+	for _, entry := range cfg.Packages {
+		if src, _ := splitDirectEntry(entry); isDirectEntry(entry) && !isRemoteConfig(src) {
+			r.Read = append(r.Read, filepath.Dir(src))
+		}
+	}
+	if bundleDir != "" {
+		r.Read = append(r.Read, bundleDir)
+	}
+	r.Write = []string{stateDir, tmpBase(), os.TempDir(), "/dev", cfg.InstallDir}
+	if cfg.Generations {
+		// install_dir is replaced by a link to the active generation
+		r.Write = append(r.Write, filepath.Dir(filepath.Clean(cfg.InstallDir)))
+	}
+	for _, p := range []string{cfg.CacheDir, cfg.AuditLog, cfg.Provenance} {
+		if p != "" {
+			r.Write = append(r.Write, filepath.Dir(p))
+		}
+	}
+	if cfg.CacheDir != "" {
+		r.Write = append(r.Write, cfg.CacheDir)
+	}
+	if cfg.QemuBinfmt {
+		r.Write = append(r.Write, "/proc/sys/fs/binfmt_misc")
+	}
+	for _, dest := range cfg.Routes {
+		r.Write = append(r.Write, dest)
+	}
+	seen := map[uint64]bool{}
+	for _, u := range append(append([]string(nil), cfg.Repos...), cfg.ChannelManifest, cfg.AlpineArchive) {
+		if p := urlPort(u); p != 0 && !seen[p] {
+			seen[p] = true
+			r.Ports = append(r.Ports, p)
+		}
+	}
+	// Proxies and DNS over TCP have to stay reachable too
+	for _, env := range []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy"} {
+		if p := urlPort(os.Getenv(env)); p != 0 && !seen[p] {
+			seen[p] = true
+			r.Ports = append(r.Ports, p)
+		}
+	}
+	// Peers, discovered ones are expected on the default port
+	for _, u := range cfg.Peers.Static {
+		if p := urlPort(u); p != 0 && !seen[p] {
+			seen[p] = true
+			r.Ports = append(r.Ports, p)
+		}
+	}
+	if cfg.Peers.Discover && !seen[defaultPeerPort] {
+		seen[defaultPeerPort] = true
+		r.Ports = append(r.Ports, defaultPeerPort)
+	}
+	if !seen[53] {
+		r.Ports = append(r.Ports, 53)
+	}
+	return r
+}
+
+// landlockABI returns the Landlock ABI version of the kernel, 0 without Landlock
+func landlockABI() int {
+	v, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		return 0
+	}
+	return int(v)
+}
+
+// landlockAddPath allows access below path, only the file rights apply to a non-directory
+func landlockAddPath(ruleset int, path string, access uint64) error {
+	fd, err := syscall.Open(path, oPath|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	defer syscall.Close(fd)
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err == nil && st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		access &= landlockFSFiles
+	}
+	// struct landlock_path_beneath_attr is packed: u64 allowed_access, s32 parent_fd
+	var attr [12]byte
+	binary.NativeEndian.PutUint64(attr[:8], access)
+	binary.NativeEndian.PutUint32(attr[8:], uint32(int32(fd)))
+	if _, _, errno := syscall.Syscall6(sysLandlockAddRule, uintptr(ruleset), landlockRulePathBeneath, uintptr(unsafe.Pointer(&attr[0])), 0, 0, 0); errno != 0 {
+		return fmt.Errorf("%s: %w", path, errno)
+	}
+	return nil
+}
+
+// enableSandbox restricts the calling thread and everything it executes to rules with
+// Landlock: the filesystem outside of them becomes inaccessible and, on kernels with
+// Landlock ABI 4, TCP connections are limited to their ports and nothing can listen
+func enableSandbox(r sandboxRules) error {
+	abi := landlockABI()
+	if abi == 0 {
+		return fmt.Errorf("the kernel doesn't support Landlock")
+	}
+	var fsAccess uint64 = landlockFSABI1
+	if abi >= 2 {
+		fsAccess |= landlockAccessFSRefer
+	}
+	if abi >= 3 {
+		fsAccess |= landlockAccessFSTruncate
+	}
+	if abi >= 5 {
+		fsAccess |= landlockAccessFSIoctlDev
+	}
+	// struct landlock_ruleset_attr: u64 handled_access_fs, u64 handled_access_net (ABI 4)
+	attr := [2]uint64{fsAccess, 0}
+	size := uintptr(8)
+	if abi >= 4 {
+		attr[1] = landlockAccessNetBindTCP | landlockAccessNetConnectTCP
+		size = 16
+	}
+	fd, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr[0])), size, 0)
+	if errno != 0 {
+		return fmt.Errorf("creating the Landlock ruleset failed: %w", errno)
+	}
+	ruleset := int(fd)
+	defer syscall.Close(ruleset)
+	for _, p := range r.Read {
+		if err := landlockAddPath(ruleset, p, landlockFSRead); err != nil {
+			return err
+		}
+	}
+	for _, p := range r.Write {
+		if err := landlockAddPath(ruleset, p, fsAccess); err != nil {
+			return err
+		}
+	}
+	if abi >= 4 {
+		for _, port := range r.Ports {
+			// struct landlock_net_port_attr: u64 allowed_access, u64 port
+			rule := [2]uint64{landlockAccessNetConnectTCP, port}
+			if _, _, errno := syscall.Syscall6(sysLandlockAddRule, uintptr(ruleset), landlockRuleNetPort, uintptr(unsafe.Pointer(&rule[0])), 0, 0, 0); errno != 0 {
+				return fmt.Errorf("port %d: %w", port, errno)
+			}
+		}
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("setting no_new_privs failed: %w", errno)
+	}
+	if _, _, errno := syscall.RawSyscall(sysLandlockRestrictSelf, uintptr(ruleset), 0, 0); errno != 0 {
+		return fmt.Errorf("enforcing the Landlock ruleset failed: %w", errno)
+	}
+	return nil
+}
+
+// sandboxedEnv marks an apkg process that already runs inside its sandbox
+const sandboxedEnv = "APKG_SANDBOXED"
+
+// sandboxApply puts an apply into its sandbox. Landlock only restricts the thread it is
+// enabled on, so apkg restricts one thread and re-executes itself from it, the new image
+// (and every thread it starts) inherits the restriction. The install and cache dirs are
+// created first since nothing outside the allowed paths can be created afterwards.
+func sandboxApply(cfg *Config, configPath string) error {
+	if os.Getenv(sandboxedEnv) != "" {
+		return nil
+	}
+	if configPath == "-" {
+		return fmt.Errorf("a config from stdin can't be read again by the sandboxed process")
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if cfg.Install && !cfg.Generations {
+		if err := os.MkdirAll(cfg.InstallDir, 0755); err != nil {
+			return err
+		}
+	}
+	if cfg.CacheDir != "" {
+		if err := os.MkdirAll(cfg.CacheDir, 0755); err != nil {
+			return err
+		}
+	}
+	rules := sandboxPaths(cfg, configPath)
+	rules.Read = append(rules.Read, filepath.Dir(self))
+	runtime.LockOSThread()
+	if err := enableSandbox(rules); err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	err = syscall.Exec(self, os.Args, append(os.Environ(), sandboxedEnv+"=1"))
+	// This thread is restricted now while the others aren't, there's no going back
+	eprintf("[FATAL] Failed to re-exec into the sandbox: %v\n", err)
+	os.Exit(1)
+	return nil
+}
@@ -0,0 +1,48 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSandboxPaths(t *testing.T) {
+	oldState, oldCfg, oldKeyrings := stateDir, globalConfig, [2]string{configKeyring, lockKeyring}
+	defer func() {
+		stateDir, globalConfig = oldState, oldCfg
+		configKeyring, lockKeyring = oldKeyrings[0], oldKeyrings[1]
+	}()
+	stateDir = "/var/lib/apkg"
+	globalConfig = &Config{}
+	configKeyring, lockKeyring = "/srv/keys/config.kbx", "/opt/release/lock.gpg"
+	t.Setenv("HTTPS_PROXY", "http://proxy.example.com:3128")
+
+	cfg := &Config{
+		Repos:       []string{"https://dl-cdn.alpinelinux.org/alpine/v3.22/main", "http://mirror.example.com:8080/alpine", "git+https://git.example.com/pkgs.git"},
+		Packages:    []string{"busybox", "/srv/dist/hello-1.0-r0.apk"},
+		InstallDir:  "/mnt/root",
+		CacheDir:    "/var/cache/apkg",
+		Generations: true,
+	}
+	r := sandboxPaths(cfg, "/etc/apkg/apkg.yaml")
+	read, write := strings.Join(r.Read, " "), strings.Join(r.Write, " ")
+	for _, want := range []string{"/usr", "/etc/apkg", "/srv/dist", defaultKeysDir, "/srv/keys/config.kbx", "/opt/release/lock.gpg"} {
+		if !strings.Contains(read, want) {
+			t.Errorf("%s isn't readable: %v", want, r.Read)
+		}
+	}
+	for _, want := range []string{"/var/lib/apkg", "/mnt/root", "/mnt", "/var/cache/apkg"} {
+		if !strings.Contains(write, want) {
+			t.Errorf("%s isn't writable: %v", want, r.Write)
+		}
+	}
+	if got := fmt.Sprint(r.Ports); got != "[443 8080 3128 53]" {
+		t.Errorf("ports %s", got)
+	}
+}
@@ -0,0 +1,115 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Scanner is an external command gating the staged contents of packages before they are
+// installed, e.g. clamscan. A nonzero exit fails the run.
+type Scanner struct {
+	// Name identifies the scanner in messages (default: its command)
+	Name string `yaml:"name,omitempty"`
+	// Command is run with /bin/sh -c, the directory to scan is $1 and $APKG_SCAN_DIR, the
+	// packages in it are listed in $APKG_PACKAGES
+	Command string `yaml:"command"`
+	// PerPackage runs the command for every package on its own, as part of its download
+	// step so on_failure and package_timeout apply, instead of once over all of them
+	PerPackage bool `yaml:"per_package,omitempty"`
+}
+
+// label returns how the scanner is called in messages
+func (s Scanner) label() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.Command
+}
+
+// validateScanners checks that every scanner has a command
+func validateScanners(cfg *Config) error {
+	for i, s := range cfg.Scanners {
+		if strings.TrimSpace(s.Command) == "" {
+			return fmt.Errorf("scanner %d (%s) has no command", i+1, s.Name)
+		}
+	}
+	return nil
+}
+
+// configuredScanners returns the scanners of the config being applied running per package
+// or over the whole staging dir
+func configuredScanners(perPackage bool) []Scanner {
+	if globalConfig == nil {
+		return nil
+	}
+	var out []Scanner
+	for _, s := range globalConfig.Scanners {
+		if s.PerPackage == perPackage {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// runScanner runs s over dir holding pkgs, its output goes to stderr so -json stays
+// machine-readable. Within a package step it's killed at the package deadline.
+func runScanner(s Scanner, dir string, pkgs []string) error {
+	ctx := context.Background()
+	if !packageDeadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, packageDeadline)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", s.Command, "sh", dir)
+	cmd.Env = append(os.Environ(), "APKG_SCAN_DIR="+dir, "APKG_PACKAGES="+strings.Join(pkgs, " "))
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	// Scanners may start helpers of their own, the deadline kills the whole process group
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) }
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return checkPackageDeadline()
+	}
+	if exit, ok := err.(*exec.ExitError); ok {
+		return &permanentError{fmt.Errorf("scanner %s rejected %s (exit status %d)", s.label(), strings.Join(pkgs, ", "), exit.ExitCode())}
+	}
+	if err != nil {
+		return fmt.Errorf("scanner %s failed: %w", s.label(), err)
+	}
+	return nil
+}
+
+// scanPackage runs the per-package scanners over the staged files of pkg
+func scanPackage(stagingDir, pkg string) error {
+	for _, s := range configuredScanners(true) {
+		if err := runScanner(s, filepath.Join(stagingDir, pkg), []string{pkg}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanStaged runs the other scanners once over the whole staging dir holding pkgs
+func scanStaged(stagingDir string, pkgs []string) error {
+	if len(pkgs) == 0 {
+		return nil
+	}
+	for _, s := range configuredScanners(false) {
+		printf("Scanning %d staged packages with %s\n", len(pkgs), s.label())
+		if err := runScanner(s, stagingDir, pkgs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
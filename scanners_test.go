@@ -0,0 +1,65 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScanners(t *testing.T) {
+	oldCfg := globalConfig
+	defer func() { globalConfig = oldCfg }()
+	staging := t.TempDir()
+	for pkg, content := range map[string]string{"clean": "hello", "infected": "EICAR"} {
+		os.MkdirAll(filepath.Join(staging, pkg, "usr/bin"), 0755)
+		os.WriteFile(filepath.Join(staging, pkg, "usr/bin", pkg), []byte(content), 0755)
+	}
+	log := filepath.Join(t.TempDir(), "log")
+	// Rejects anything containing EICAR and logs what it was run over
+	detect := `echo "$1 $APKG_PACKAGES" >> ` + log + `; ! grep -rq EICAR "$APKG_SCAN_DIR"`
+
+	globalConfig = &Config{Scanners: []Scanner{{Name: "eicar", Command: detect, PerPackage: true}}}
+	if err := scanPackage(staging, "clean"); err != nil {
+		t.Errorf("clean package rejected: %v", err)
+	}
+	err := scanPackage(staging, "infected")
+	var perm *permanentError
+	if !errors.As(err, &perm) || !strings.Contains(err.Error(), "eicar rejected infected") {
+		t.Errorf("infected package not rejected: %v", err)
+	}
+	if err := scanStaged(staging, []string{"clean", "infected"}); err != nil {
+		t.Errorf("per-package scanner ran over the staging dir: %v", err)
+	}
+
+	globalConfig = &Config{Scanners: []Scanner{{Command: detect}}}
+	if err := scanPackage(staging, "infected"); err != nil {
+		t.Errorf("staging dir scanner ran per package: %v", err)
+	}
+	if err := scanStaged(staging, []string{"clean", "infected"}); err == nil {
+		t.Error("infected staging dir not rejected")
+	}
+	data, _ := os.ReadFile(log)
+	want := filepath.Join(staging, "clean") + " clean\n" + filepath.Join(staging, "infected") + " infected\n" + staging + " clean infected\n"
+	if string(data) != want {
+		t.Errorf("scanners ran over\n%s\nwant\n%s", data, want)
+	}
+
+	packageDeadline = time.Now().Add(50 * time.Millisecond)
+	defer func() { packageDeadline = time.Time{} }()
+	if err := runScanner(Scanner{Command: "sleep 5"}, staging, nil); !errors.Is(err, errPackageTimeout) {
+		t.Errorf("scanner not stopped at the package deadline: %v", err)
+	}
+
+	if err := validateScanners(&Config{Scanners: []Scanner{{Name: "empty"}}}); err == nil {
+		t.Error("expected a scanner without command to be refused")
+	}
+}
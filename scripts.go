@@ -0,0 +1,82 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+// runControlScript runs a stored maintainer script of pkg (e.g. .pre-deinstall) inside
+// installDir, chrooting into it unless installDir is the real root. It does nothing
+// when the package has no such script or run_scripts is disabled.
+func runControlScript(installDir, pkg, script string, args ...string) error {
+	scriptPath := filepath.Join(installedControlPath(pkg), script)
+	if _, err := os.Stat(scriptPath); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if globalConfig == nil || !globalConfig.RunScripts {
+		eprintf("[WARN] Script present but not run (run_scripts: false): %s\n", scriptPath)
+		return nil
+	}
+	root, err := filepath.Abs(installDir)
+	if err != nil {
+		return err
+	}
+	// Copy the script into the root so it is reachable after chroot
+	tmpDir := filepath.Join(root, "tmp")
+	if err := os.MkdirAll(tmpDir, 01777); err != nil {
+		return err
+	}
+	inRoot := filepath.Join(tmpDir, ".apkg-"+pkg+script)
+	if err := copyFile(scriptPath, inRoot, 0755); err != nil {
+		return err
+	}
+	defer os.Remove(inRoot)
+
+	printf("Running %s script for %s\n", script, pkg)
+	cmd := exec.Command("/bin/sh", append([]string{"/tmp/.apkg-" + pkg + script}, args...)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = []string{"PATH=/usr/sbin:/usr/bin:/sbin:/bin", "HOME=/root"}
+	if root != "/" {
+		if err := ensureEmulation(root); err != nil {
+			return fmt.Errorf("%s script of %s can't run: %w", script, pkg, err)
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{Chroot: root}
+		cmd.Dir = "/"
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s script of %s failed: %w", script, pkg, err)
+	}
+	return nil
+}
+
+// copyFile copies src to dest with the given mode
+func copyFile(src, dest string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
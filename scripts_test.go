@@ -0,0 +1,35 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunControlScriptSkipped(t *testing.T) {
+	oldConfig, oldState := globalConfig, stateDir
+	defer func() { globalConfig, stateDir = oldConfig, oldState }()
+	stateDir = t.TempDir()
+	globalConfig = &Config{RunScripts: false}
+	root := t.TempDir()
+	// No script: nothing to do
+	if err := runControlScript(root, "foo", ".pre-deinstall"); err != nil {
+		t.Errorf("missing script = %v", err)
+	}
+	// A script with run_scripts disabled is reported but not run
+	dir := installedControlPath("foo")
+	os.MkdirAll(dir, 0755)
+	os.WriteFile(filepath.Join(dir, ".pre-deinstall"), []byte("#!/bin/sh\ntouch /ran\n"), 0755)
+	if err := runControlScript(root, "foo", ".pre-deinstall"); err != nil {
+		t.Errorf("disabled script = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "tmp")); err == nil {
+		t.Error("disabled script was copied into the root")
+	}
+}
@@ -0,0 +1,268 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults of segmented downloads
+const (
+	defaultConnections = 4
+	// minSegment is the smallest range fetched on its own
+	minSegment = 1 << 20
+	// maxMetalink bounds the size of a Metalink document
+	maxMetalink = 1 << 20
+)
+
+// metalinkSuffix is appended to the URL of a package for its Metalink (RFC 5854), as
+// mirror redirectors like MirrorBrain and mirrorbits publish them
+const metalinkSuffix = ".meta4"
+
+// metalink is the part of a Metalink document segmented downloads use
+type metalink struct {
+	Files []metalinkFile `xml:"file"`
+}
+
+type metalinkFile struct {
+	Name   string `xml:"name,attr"`
+	Size   int64  `xml:"size"`
+	Hashes []struct {
+		Type  string `xml:"type,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"hash"`
+	URLs []struct {
+		Priority int    `xml:"priority,attr"`
+		URL      string `xml:",chardata"`
+	} `xml:"url"`
+}
+
+// sha256 returns the sha-256 hash the Metalink lists for the file, empty without one
+func (f metalinkFile) sha256() string {
+	for _, h := range f.Hashes {
+		if strings.EqualFold(h.Type, "sha-256") {
+			return strings.ToLower(strings.TrimSpace(h.Value))
+		}
+	}
+	return ""
+}
+
+// mirrors returns the URLs of the file, the most preferred (lowest priority) first
+func (f metalinkFile) mirrors() []string {
+	urls := f.URLs
+	sort.SliceStable(urls, func(i, j int) bool {
+		pi, pj := urls[i].Priority, urls[j].Priority
+		if pi == 0 {
+			pi = 999999
+		}
+		if pj == 0 {
+			pj = 999999
+		}
+		return pi < pj
+	})
+	var out []string
+	for _, u := range urls {
+		if u := strings.TrimSpace(u.URL); strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://") {
+			out = append(out, u)
+		}
+	}
+	return out
+}
+
+// segmentedSize returns the size from which downloads are segmented, 0 when they never are
+func (n NetworkConfig) segmentedSize() int64 {
+	size, _ := parseSize(n.SegmentedSize)
+	return size
+}
+
+// connections returns how many ranges are fetched at once
+func (n NetworkConfig) connections() int {
+	if n.Connections > 0 {
+		return n.Connections
+	}
+	return defaultConnections
+}
+
+// fetchMetalink fetches and parses the Metalink at url, returning its entry for filename
+func fetchMetalink(url, filename string) (metalinkFile, error) {
+	resp, err := httpGet(url)
+	if err != nil {
+		return metalinkFile{}, err
+	}
+	defer resp.Body.Close()
+	data, err := readLimited(resp.Body, maxMetalink, url)
+	if err != nil {
+		return metalinkFile{}, err
+	}
+	var m metalink
+	if err := xml.Unmarshal(data, &m); err != nil {
+		return metalinkFile{}, fmt.Errorf("%s: %w", url, err)
+	}
+	for _, f := range m.Files {
+		if f.Name == filename || len(m.Files) == 1 {
+			return f, nil
+		}
+	}
+	return metalinkFile{}, fmt.Errorf("%s doesn't list %s", url, filename)
+}
+
+// fetchSegmented downloads a large package of an HTTP repo in parallel ranges from the
+// mirrors of its Metalink. It returns false whenever the package is small, its mirror
+// publishes no usable Metalink or the download fails, a plain download follows then.
+func fetchSegmented(repo string, info APKPackage, dest string) (string, bool) {
+	n := networkConfig()
+	threshold := n.segmentedSize()
+	if threshold <= 0 || info.Size < threshold {
+		return "", false
+	}
+	src, ok := sourceFor(repo).(httpSource)
+	if !ok {
+		return "", false
+	}
+	url := string(src) + "/" + info.Filename
+	meta, err := fetchMetalink(url+metalinkSuffix, info.Filename)
+	if err != nil {
+		debugf("http", "No Metalink for %s: %v", info.Filename, err)
+		return "", false
+	}
+	sum := meta.sha256()
+	if sum == "" || meta.Size != info.Size {
+		eprintf("[WARN] Ignoring the Metalink of %s: it lists no sha-256 or another size than the index\n", info.Filename)
+		return "", false
+	}
+	mirrors := meta.mirrors()
+	if !slices.Contains(mirrors, url) {
+		mirrors = append(mirrors, url)
+	}
+	start := time.Now()
+	if err := segmentedDownload(mirrors, info.Size, sum, dest, n.connections()); err != nil {
+		eprintf("[WARN] Segmented download of %s failed (%v), downloading it in one piece\n", info.Filename, err)
+		return "", false
+	}
+	recordBandwidth(info.Size, time.Since(start))
+	printf("Fetched %s in ranges from %d mirrors\n", info.Filename, len(mirrors))
+	return sum, true
+}
+
+// segment is a byte range of a segmented download
+type segment struct {
+	start, end int64 // inclusive, like the Range header
+}
+
+// segmentedDownload fetches size bytes to dest in ranges, conns at a time spread over
+// mirrors, and checks the result against sum. A range failing on one mirror is fetched
+// from the next, a mirror failing a range isn't asked again.
+func segmentedDownload(mirrors []string, size int64, sum, dest string, conns int) error {
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	segSize := max(size/int64(conns*4), minSegment)
+	segments := make(chan segment)
+	go func() {
+		for start := int64(0); start < size; start += segSize {
+			segments <- segment{start, min(start+segSize, size) - 1}
+		}
+		close(segments)
+	}()
+	var (
+		mu       sync.Mutex
+		bad      = map[string]bool{}
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+	for w := 0; w < conns; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for seg := range segments {
+				if failed() {
+					continue
+				}
+				if err := fetchSegment(f, seg, mirrors, w, bad, &mu); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	got, err := copySHA256(io.Discard, f)
+	if err != nil {
+		return err
+	}
+	if got != sum {
+		return fmt.Errorf("sha256 %s, the Metalink lists %s", got, sum)
+	}
+	return nil
+}
+
+// fetchSegment fetches seg into f from the first working mirror, worker w starting at
+// its own mirror so the connections spread over them
+func fetchSegment(f *os.File, seg segment, mirrors []string, w int, bad map[string]bool, mu *sync.Mutex) error {
+	var lastErr error
+	for i := range mirrors {
+		m := mirrors[(w+i)%len(mirrors)]
+		mu.Lock()
+		skip := bad[m]
+		mu.Unlock()
+		if skip {
+			continue
+		}
+		err := withRetries("Downloading "+m, func() error {
+			resp, err := httpGetRange(m, fmt.Sprintf("bytes=%d-%d", seg.start, seg.end))
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			want := seg.end - seg.start + 1
+			n, err := io.Copy(io.NewOffsetWriter(f, seg.start), io.LimitReader(deadlineReader{resp.Body}, want))
+			if err == nil && n != want {
+				err = fmt.Errorf("range %d-%d ended after %d bytes", seg.start, seg.end, n)
+			}
+			return err
+		})
+		if err == nil {
+			return nil
+		}
+		debugf("http", "Range %d-%d from %s: %v", seg.start, seg.end, m, err)
+		mu.Lock()
+		bad[m] = true
+		mu.Unlock()
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no mirror left for range %d-%d", seg.start, seg.end)
+	}
+	return lastErr
+}
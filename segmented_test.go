@@ -0,0 +1,98 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFetchSegmented(t *testing.T) {
+	oldConfig, oldState := globalConfig, stateDir
+	defer func() { globalConfig, stateDir = oldConfig, oldState }()
+	stateDir = t.TempDir()
+	payload := make([]byte, 3*minSegment+123)
+	rand.Read(payload)
+	digest := sha256.Sum256(payload)
+	sum := hex.EncodeToString(digest[:])
+	const name = "big-1.0-r0.apk"
+
+	var ranges atomic.Int32
+	var metaHash atomic.Value
+	metaHash.Store(sum)
+	serve := func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "" {
+			ranges.Add(1)
+		}
+		http.ServeContent(w, r, name, time.Time{}, bytes.NewReader(payload))
+	}
+	mirror := httptest.NewServer(http.HandlerFunc(serve))
+	defer mirror.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+	var metaRequests atomic.Int32
+	repo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/main/"+name+metalinkSuffix {
+			metaRequests.Add(1)
+			fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="%s">
+    <size>%d</size>
+    <hash type="sha-256">%s</hash>
+    <url priority="2">%s/%s</url>
+    <url priority="1">%s/%s</url>
+  </file>
+</metalink>`, name, len(payload), metaHash.Load(), mirror.URL, name, broken.URL, name)
+			return
+		}
+		serve(w, r)
+	}))
+	defer repo.Close()
+
+	retries := 0
+	globalConfig = &Config{Network: NetworkConfig{SegmentedSize: "1M", Connections: 3, Retries: &retries}}
+	info := APKPackage{Name: "big", Filename: name, Size: int64(len(payload))}
+	dest := filepath.Join(t.TempDir(), name)
+	got, ok := fetchSegmented(repo.URL+"/main", info, dest)
+	if !ok || got != sum {
+		t.Fatalf("fetchSegmented = %q, %v", got, ok)
+	}
+	if data, _ := os.ReadFile(dest); !bytes.Equal(data, payload) {
+		t.Error("segmented download differs from the package")
+	}
+	if ranges.Load() < 4 {
+		t.Errorf("expected the 4 ranges to be fetched in parts, got %d range requests", ranges.Load())
+	}
+
+	// A Metalink disagreeing with the download falls back to a plain download
+	metaHash.Store(hex.EncodeToString(make([]byte, 32)))
+	if _, ok := fetchSegmented(repo.URL+"/main", info, dest); ok {
+		t.Error("download not matching the Metalink was taken")
+	}
+	if got, err := fetchFromMirrorOrPeer(repo.URL+"/main", info, dest); err != nil || got != sum {
+		t.Errorf("fallback = %q, %v", got, err)
+	}
+
+	// Small packages never ask for a Metalink
+	before := metaRequests.Load()
+	info.Size = 1000
+	if _, ok := fetchSegmented(repo.URL+"/main", info, dest); ok || metaRequests.Load() != before {
+		t.Error("Metalink fetched for a small package")
+	}
+}
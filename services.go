@@ -0,0 +1,267 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Service is an init script or unit shipped by an installed package
+type Service struct {
+	Name    string `json:"name"`
+	Package string `json:"package"`
+	// Init is "openrc" or "systemd"
+	Init string `json:"init"`
+	Path string `json:"path"`
+	// EnabledIn lists the runlevels (openrc) or targets (systemd) the service is enabled in
+	EnabledIn []string `json:"enabled_in"`
+}
+
+// systemdUnitDirs are where packages ship systemd units, relative to the root
+var systemdUnitDirs = []string{"usr/lib/systemd/system", "lib/systemd/system"}
+
+// serviceKinds are the systemd unit types listed as services
+var serviceKinds = []string{".service", ".socket", ".timer", ".path"}
+
+// classifyService returns the init system and name of a service file at rel, if it is one
+func classifyService(rel string) (init, name string, ok bool) {
+	dir, base := path.Split(rel)
+	dir = strings.TrimSuffix(dir, "/")
+	if dir == "etc/init.d" {
+		return "openrc", base, true
+	}
+	for _, d := range systemdUnitDirs {
+		if dir != d || strings.Contains(base, "@.") {
+			continue
+		}
+		for _, kind := range serviceKinds {
+			if strings.HasSuffix(base, kind) {
+				return "systemd", base, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// findServices lists the services shipped by pkgs, with where they are enabled
+func findServices(installDir string, pkgs []string) []Service {
+	var services []Service
+	for _, pkg := range pkgs {
+		files, err := readInstalledFiles(pkg)
+		if err != nil {
+			continue
+		}
+		for _, rel := range files {
+			init, name, ok := classifyService(rel)
+			if !ok {
+				continue
+			}
+			svc := Service{Name: name, Package: pkg, Init: init, Path: "/" + rel}
+			svc.EnabledIn = serviceLinks(installDir, &svc)
+			services = append(services, svc)
+		}
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].Name < services[j].Name })
+	return services
+}
+
+// serviceLinkGlob returns the glob matching the enablement symlinks of svc
+func serviceLinkGlob(installDir string, svc *Service) string {
+	if svc.Init == "openrc" {
+		return filepath.Join(installDir, "etc/runlevels", "*", svc.Name)
+	}
+	return filepath.Join(installDir, "etc/systemd/system", "*", svc.Name)
+}
+
+// serviceLinks returns the runlevels or targets svc is enabled in
+func serviceLinks(installDir string, svc *Service) []string {
+	matches, _ := filepath.Glob(serviceLinkGlob(installDir, svc))
+	enabled := []string{}
+	for _, m := range matches {
+		enabled = append(enabled, filepath.Base(filepath.Dir(m)))
+	}
+	return enabled
+}
+
+// unitInstallTargets returns the WantedBy= and RequiredBy= targets of a systemd unit
+// as the .wants/.requires directories enabling it links into
+func unitInstallTargets(unitPath string) ([]string, error) {
+	f, err := os.Open(unitPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var dirs []string
+	section := ""
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if strings.HasPrefix(line, "[") {
+			section = line
+			continue
+		}
+		if section != "[Install]" {
+			continue
+		}
+		key, val, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		suffix := map[string]string{"WantedBy": ".wants", "RequiredBy": ".requires"}[strings.TrimSpace(key)]
+		if suffix == "" {
+			continue
+		}
+		for _, target := range strings.Fields(val) {
+			dirs = append(dirs, target+suffix)
+		}
+	}
+	return dirs, sc.Err()
+}
+
+// enableService links svc into runlevel (openrc) or the targets of its [Install] section (systemd)
+func enableService(installDir string, svc *Service, runlevel string) error {
+	var dirs []string
+	if svc.Init == "openrc" {
+		dirs = []string{filepath.Join("etc/runlevels", runlevel)}
+	} else {
+		targets, err := unitInstallTargets(filepath.Join(installDir, svc.Path))
+		if err != nil {
+			return err
+		}
+		if len(targets) == 0 {
+			return fmt.Errorf("%s has no WantedBy= or RequiredBy= in its [Install] section", svc.Name)
+		}
+		for _, t := range targets {
+			dirs = append(dirs, filepath.Join("etc/systemd/system", t))
+		}
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(filepath.Join(installDir, dir), dirMode()); err != nil {
+			return err
+		}
+		link := filepath.Join(installDir, dir, svc.Name)
+		os.Remove(link)
+		if err := os.Symlink(svc.Path, link); err != nil {
+			return err
+		}
+		printf("Enabled %s in %s\n", svc.Name, filepath.Base(dir))
+	}
+	return nil
+}
+
+// disableService removes every enablement symlink of svc
+func disableService(installDir string, svc *Service) error {
+	matches, _ := filepath.Glob(serviceLinkGlob(installDir, svc))
+	for _, m := range matches {
+		if info, err := os.Lstat(m); err != nil || info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if err := os.Remove(m); err != nil {
+			return err
+		}
+		printf("Disabled %s in %s\n", svc.Name, filepath.Base(filepath.Dir(m)))
+	}
+	return nil
+}
+
+// printServiceSummary lists services of freshly installed packages after an apply
+func printServiceSummary(services []Service) {
+	if len(services) == 0 {
+		return
+	}
+	printf("Services shipped by the installed packages:\n")
+	for _, svc := range services {
+		state := "disabled"
+		if len(svc.EnabledIn) > 0 {
+			state = "enabled in " + strings.Join(svc.EnabledIn, ", ")
+		}
+		printf("  %-24s %-8s %s (%s)\n", svc.Name, svc.Init, svc.Package, state)
+	}
+	printf("Enable them with: apkg services enable <name>\n")
+}
+
+// cmdServices implements `apkg services [list|enable|disable]`
+func cmdServices(configPath string, args []string) int {
+	action := "list"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		action, args = args[0], args[1:]
+	}
+	fs := flag.NewFlagSet("services", flag.ExitOnError)
+	runlevel := fs.String("runlevel", "default", "OpenRC runlevel to enable the service in")
+	fs.Parse(args)
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		eprintf("[FATAL] Failed to read config: %v\n", err)
+		return 1
+	}
+	globalConfig = cfg
+	installedPkgs, err := readInstalledPkgs(statePath("installed.yaml"))
+	if err != nil {
+		eprintf("[FATAL] Failed to read installed.yaml: %v\n", err)
+		return 1
+	}
+	var pkgs []string
+	for name := range installedPkgs {
+		pkgs = append(pkgs, name)
+	}
+	services := findServices(cfg.InstallDir, pkgs)
+
+	switch action {
+	case "list":
+		if jsonOut != nil {
+			if services == nil {
+				services = []Service{}
+			}
+			enc := json.NewEncoder(jsonOut)
+			enc.SetIndent("", "  ")
+			enc.Encode(services)
+			return 0
+		}
+		if len(services) == 0 {
+			printf("No installed package ships an init script or systemd unit.\n")
+		}
+		printServiceSummary(services)
+		return 0
+	case "enable", "disable":
+		if fs.NArg() != 1 {
+			eprintf("Usage: %s [flags] services %s <name>\n", os.Args[0], action)
+			return 1
+		}
+		found := false
+		for i := range services {
+			svc := &services[i]
+			if svc.Name != fs.Arg(0) && strings.TrimSuffix(svc.Name, ".service") != fs.Arg(0) {
+				continue
+			}
+			found = true
+			if action == "enable" {
+				err = enableService(cfg.InstallDir, svc, *runlevel)
+			} else {
+				err = disableService(cfg.InstallDir, svc)
+			}
+			if err != nil {
+				eprintf("[ERROR] %v\n", err)
+				return 1
+			}
+		}
+		if !found {
+			eprintf("[ERROR] No installed package ships a service called %s\n", fs.Arg(0))
+			return 1
+		}
+		return 0
+	}
+	eprintf("Unknown services action %q (known: list, enable, disable)\n", action)
+	return 1
+}
@@ -0,0 +1,55 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestServicesEnableDisable(t *testing.T) {
+	oldState := stateDir
+	stateDir = t.TempDir()
+	defer func() { stateDir = oldState }()
+	root := t.TempDir()
+
+	files := []string{"etc/init.d/sshd", "usr/lib/systemd/system/sshd.service", "usr/lib/systemd/system/sshd@.service", "usr/bin/sshd"}
+	for _, f := range files {
+		os.MkdirAll(filepath.Join(root, filepath.Dir(f)), 0755)
+		os.WriteFile(filepath.Join(root, f), []byte("[Unit]\n[Install]\nWantedBy=multi-user.target\n"), 0644)
+	}
+	writeInstalledFiles("openssh-server", files)
+
+	services := findServices(root, []string{"openssh-server"})
+	if len(services) != 2 {
+		t.Fatalf("expected the init script and the unit, got %+v", services)
+	}
+	for i := range services {
+		if err := enableService(root, &services[i], "default"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if target, _ := os.Readlink(filepath.Join(root, "etc/runlevels/default/sshd")); target != "/etc/init.d/sshd" {
+		t.Errorf("unexpected runlevel link target %q", target)
+	}
+	if _, err := os.Lstat(filepath.Join(root, "etc/systemd/system/multi-user.target.wants/sshd.service")); err != nil {
+		t.Errorf("unit wasn't enabled: %v", err)
+	}
+	services = findServices(root, []string{"openssh-server"})
+	for i := range services {
+		if len(services[i].EnabledIn) != 1 {
+			t.Errorf("%s should be enabled once: %v", services[i].Name, services[i].EnabledIn)
+		}
+		disableService(root, &services[i])
+	}
+	for _, svc := range findServices(root, []string{"openssh-server"}) {
+		if len(svc.EnabledIn) != 0 {
+			t.Errorf("%s is still enabled in %v", svc.Name, svc.EnabledIn)
+		}
+	}
+}
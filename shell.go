@@ -0,0 +1,275 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// rootEnv is the environment commands run with inside the install root
+func rootEnv() []string {
+	env := []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin", "HOME=/root", "USER=root", "LANG=C.UTF-8"}
+	if term := os.Getenv("TERM"); term != "" {
+		env = append(env, "TERM="+term)
+	}
+	return env
+}
+
+// rootCommand returns a command running argv inside root: chrooted when running as
+// root, under proot when it is installed and in a user namespace otherwise
+func rootCommand(root string, argv []string) (*exec.Cmd, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(root); err != nil {
+		return nil, err
+	}
+	var cmd *exec.Cmd
+	userns := false
+	switch {
+	case root == "/":
+		cmd = exec.Command(argv[0], argv[1:]...)
+	case os.Geteuid() == 0:
+		cmd = exec.Command(argv[0], argv[1:]...)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Chroot: root}
+	default:
+		if proot, err := exec.LookPath("proot"); err == nil {
+			cmd = exec.Command(proot, append([]string{"-0", "-r", root, "-b", "/dev", "-b", "/proc", "-b", "/sys", "-w", "/"}, argv...)...)
+			break
+		}
+		// Map the calling user to root in a new user and mount namespace, where apkg
+		// mounts the root's file systems and chroots before executing argv
+		self, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		cmd = exec.Command(self, argv...)
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS,
+			UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}},
+			GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}},
+		}
+		userns = true
+	}
+	cmd.Dir = "/"
+	cmd.Env = rootEnv()
+	if userns {
+		cmd.Env = append(cmd.Env, rootExecEnv+"="+root)
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd, nil
+}
+
+// rootPath are the directories commands are looked up in inside the install root
+var rootPath = []string{"/usr/local/sbin", "/usr/local/bin", "/usr/sbin", "/usr/bin", "/sbin", "/bin"}
+
+// rootLookPath finds a command given without a directory in the PATH of root and
+// returns its path inside root, since the host's PATH means nothing there
+func rootLookPath(root, name string) (string, error) {
+	if strings.Contains(name, "/") {
+		return name, nil
+	}
+	for _, dir := range rootPath {
+		p := filepath.Join(dir, name)
+		if info, err := os.Stat(filepath.Join(root, p)); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("%s not found in the PATH of %s", name, root)
+}
+
+// mountRootFS mounts /proc and bind mounts /dev into root unless they already are,
+// it only does so as root (proot binds them itself, execInRoot in a user namespace).
+// The returned func unmounts them.
+func mountRootFS(root string) (func(), error) {
+	var mounted []string
+	cleanup := func() {
+		for i := len(mounted) - 1; i >= 0; i-- {
+			if err := syscall.Unmount(mounted[i], syscall.MNT_DETACH); err != nil {
+				eprintf("[WARN] Failed to unmount %s: %v\n", mounted[i], err)
+			}
+		}
+	}
+	if root == "/" || os.Geteuid() != 0 {
+		return cleanup, nil
+	}
+	proc := filepath.Join(root, "proc")
+	if _, err := os.Stat(filepath.Join(proc, "self")); os.IsNotExist(err) {
+		if err := os.MkdirAll(proc, 0555); err != nil {
+			return cleanup, err
+		}
+		if err := syscall.Mount("proc", proc, "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+			return cleanup, fmt.Errorf("mounting %s: %w", proc, err)
+		}
+		mounted = append(mounted, proc)
+	}
+	dev := filepath.Join(root, "dev")
+	if _, err := os.Stat(filepath.Join(dev, "null")); os.IsNotExist(err) {
+		if err := os.MkdirAll(dev, 0755); err != nil {
+			cleanup()
+			return func() {}, err
+		}
+		if err := syscall.Mount("/dev", dev, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			cleanup()
+			return func() {}, fmt.Errorf("bind mounting %s: %w", dev, err)
+		}
+		mounted = append(mounted, dev)
+	}
+	return cleanup, nil
+}
+
+// rootExecEnv makes an apkg process started by rootCommand in a user namespace execute
+// its arguments inside the install root it names, see execInRoot
+const rootExecEnv = "APKG_ROOT_EXEC"
+
+// rootMounts are the file systems of the host bound into the root in a user namespace,
+// with a file telling whether the root has them already
+var rootMounts = [][2]string{{"proc", "self"}, {"dev", "null"}, {"sys", "kernel"}}
+
+// execInRoot runs in the user and mount namespace rootCommand created: it binds /proc,
+// /dev and /sys into root unless they are there already, which only this namespace
+// sees, chroots into root and replaces itself by argv. Mounting fresh file systems
+// isn't allowed without a pid namespace of its own, the host's are bound recursively.
+func execInRoot(root string, argv []string) int {
+	os.Unsetenv(rootExecEnv)
+	// Nothing mounted here may propagate back to the host
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		eprintf("[FATAL] Failed to make the mounts private: %v\n", err)
+		return 1
+	}
+	for _, m := range rootMounts {
+		target := filepath.Join(root, m[0])
+		if _, err := os.Stat(filepath.Join(target, m[1])); err == nil {
+			continue
+		}
+		if err := os.MkdirAll(target, 0755); err != nil {
+			eprintf("[WARN] /%s isn't available in %s: %v\n", m[0], root, err)
+			continue
+		}
+		if err := syscall.Mount("/"+m[0], target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			eprintf("[WARN] /%s isn't available in %s: %v\n", m[0], root, err)
+		}
+	}
+	if err := syscall.Chroot(root); err != nil {
+		eprintf("[FATAL] chroot %s: %v\n", root, err)
+		return 1
+	}
+	if err := os.Chdir("/"); err != nil {
+		eprintf("[FATAL] %v\n", err)
+		return 1
+	}
+	err := syscall.Exec(argv[0], argv, os.Environ())
+	eprintf("[FATAL] Failed to start %s: %v\n", argv[0], err)
+	return 127
+}
+
+// exitCode returns the exit status to propagate for the error of a finished command
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return exitErr.ExitCode()
+	}
+	return 1
+}
+
+// runInRoot runs argv inside installDir with /proc and /dev available and returns its exit code
+func runInRoot(installDir string, argv, env []string) int {
+	root, err := filepath.Abs(installDir)
+	if err != nil {
+		eprintf("[FATAL] %v\n", err)
+		return 1
+	}
+	if argv[0], err = rootLookPath(root, argv[0]); err != nil {
+		eprintf("[FATAL] %v\n", err)
+		return 127
+	}
+	cmd, err := rootCommand(root, argv)
+	if err != nil {
+		eprintf("[FATAL] %v\n", err)
+		return 1
+	}
+	cmd.Env = append(cmd.Env, env...)
+	unmount, err := mountRootFS(root)
+	if err != nil {
+		eprintf("[FATAL] %v\n", err)
+		return 1
+	}
+	defer unmount()
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			eprintf("[FATAL] Failed to start %s: %v\n", argv[0], err)
+			return 127
+		}
+		return exitCode(err)
+	}
+	return 0
+}
+
+// cmdShell implements `apkg shell`: an interactive shell inside install_dir
+func cmdShell(configPath string, args []string) int {
+	fs := flag.NewFlagSet("shell", flag.ExitOnError)
+	shell := fs.String("shell", "/bin/sh", "Shell to run, as a path inside the install root")
+	fs.Parse(args)
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		eprintf("[FATAL] Failed to read config: %v\n", err)
+		return 1
+	}
+	globalConfig = cfg
+	if _, err := os.Stat(filepath.Join(cfg.InstallDir, *shell)); err != nil {
+		eprintf("[FATAL] %s not found in %s, install a shell (e.g. busybox) first\n", *shell, cfg.InstallDir)
+		return 1
+	}
+	eprintf("Entering %s, exit the shell to leave\n", cfg.InstallDir)
+	return runInRoot(cfg.InstallDir, []string{*shell, "-l"}, []string{"SHELL=" + *shell, `PS1=(apkg) \w \$ `})
+}
+
+// cmdRun implements `apkg run <cmd> [args...]`: runs one command inside install_dir
+// and exits with its exit code
+func cmdRun(configPath string, args []string) int {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	var env envFlags
+	fs.Var(&env, "e", "Set KEY=VALUE in the command's environment (repeatable)")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		eprintf("Usage: apkg run [-e KEY=VALUE]... [--] <cmd> [args...]\n")
+		return 1
+	}
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		eprintf("[FATAL] Failed to read config: %v\n", err)
+		return 1
+	}
+	globalConfig = cfg
+	return runInRoot(cfg.InstallDir, fs.Args(), env)
+}
+
+// envFlags collects repeated -e KEY=VALUE flags
+type envFlags []string
+
+func (e *envFlags) String() string { return strings.Join(*e, " ") }
+
+func (e *envFlags) Set(v string) error {
+	if !strings.Contains(v, "=") {
+		return fmt.Errorf("expected KEY=VALUE, got %q", v)
+	}
+	*e = append(*e, v)
+	return nil
+}
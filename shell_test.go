@@ -0,0 +1,82 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestRootCommand(t *testing.T) {
+	cmd, err := rootCommand("/", []string{"/bin/true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd.SysProcAttr != nil || cmd.Dir != "/" || !strings.HasPrefix(strings.Join(cmd.Env, "\n"), "PATH=") {
+		t.Errorf("unexpected command for /: %+v", cmd)
+	}
+	if _, err := rootCommand(filepath.Join(t.TempDir(), "missing"), []string{"/bin/true"}); err == nil {
+		t.Error("expected a missing root to fail")
+	}
+	if os.Geteuid() != 0 {
+		if _, err := exec.LookPath("proot"); err == nil {
+			return
+		}
+		// apkg re-executes itself in the namespaces to mount /proc, /dev and /sys first
+		root := t.TempDir()
+		cmd, err = rootCommand(root, []string{"/bin/sh"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cmd.SysProcAttr.Chroot != "" || cmd.SysProcAttr.Cloneflags&syscall.CLONE_NEWNS == 0 || strings.Join(cmd.Args[1:], " ") != "/bin/sh" {
+			t.Errorf("unexpected user namespace command: %+v %+v", cmd.Args, cmd.SysProcAttr)
+		}
+		if !slices.Contains(cmd.Env, rootExecEnv+"="+root) {
+			t.Errorf("%s not set: %v", rootExecEnv, cmd.Env)
+		}
+		return
+	}
+	root := t.TempDir()
+	cmd, err = rootCommand(root, []string{"/bin/sh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd.SysProcAttr == nil || cmd.SysProcAttr.Chroot != root {
+		t.Errorf("expected a chroot into %s, got %+v", root, cmd.SysProcAttr)
+	}
+}
+
+func TestRootLookPath(t *testing.T) {
+	root := t.TempDir()
+	os.MkdirAll(filepath.Join(root, "usr/bin"), 0755)
+	os.MkdirAll(filepath.Join(root, "bin"), 0755)
+	os.WriteFile(filepath.Join(root, "usr/bin/tool"), []byte("#!/bin/sh\n"), 0755)
+	os.WriteFile(filepath.Join(root, "bin/tool"), []byte("#!/bin/sh\n"), 0755)
+	os.WriteFile(filepath.Join(root, "bin/data"), []byte("x"), 0644)
+
+	if p, err := rootLookPath(root, "tool"); err != nil || p != "/usr/bin/tool" {
+		t.Errorf("expected /usr/bin/tool, got %q, %v", p, err)
+	}
+	if _, err := rootLookPath(root, "data"); err == nil {
+		t.Error("a non-executable file was found")
+	}
+	if p, _ := rootLookPath(root, "/opt/x"); p != "/opt/x" {
+		t.Errorf("paths should be kept as they are, got %q", p)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	err := exec.Command("/bin/sh", "-c", "exit 3").Run()
+	if code := exitCode(err); code != 3 {
+		t.Errorf("expected exit code 3, got %d", code)
+	}
+}
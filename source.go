@@ -0,0 +1,178 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Source is where a repos: entry gets its index and packages from
+type Source interface {
+	// FetchIndex stores the source's raw index at dest, in any form parseAPKIndexPayload accepts
+	FetchIndex(dest string) error
+	// Fetch stores the .apk called filename at dest and returns its sha256
+	Fetch(filename, dest string) (string, error)
+}
+
+// sourceFor returns the Source of a repos: entry, git+<url> entries are git
+// repositories, deb+<url> entries Debian repositories, everything else is an HTTP mirror,
+// alpine: repos falling back to the archive.
+// While a bundle is applied its repos are served from the bundle.
+func sourceFor(repo string) Source {
+	if s, ok := bundleRepoSource(repo); ok {
+		return s
+	}
+	if strings.HasPrefix(repo, "git+") {
+		return newGitSource(repo)
+	}
+	if strings.HasPrefix(repo, "deb+") {
+		if s, ok := debSources[repo]; ok {
+			return s
+		}
+		debSources[repo] = newDebSource(repo)
+		return debSources[repo]
+	}
+	if archive, ok := alpineArchives[repo]; ok {
+		return archiveSourceFor(repo, archive)
+	}
+	return httpSource(strings.TrimRight(repo, "/"))
+}
+
+// httpSource is a plain HTTP(S) Alpine mirror
+type httpSource string
+
+// FetchIndex tries every name in apkIndexNames, a missing index (4xx) moves on to the
+// next name while other failures mean the mirror is unreachable
+func (s httpSource) FetchIndex(dest string) error {
+	var firstErr error
+	for _, name := range apkIndexNames {
+		_, err := downloadFile(string(s)+"/"+name, dest)
+		if err == nil {
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		var perm *permanentError
+		if !errors.As(err, &perm) {
+			break
+		}
+	}
+	return firstErr
+}
+
+func (s httpSource) Fetch(filename, dest string) (string, error) {
+	return downloadFile(string(s)+"/"+filename, dest)
+}
+
+// gitSourcesDir (under the state dir) holds the clones of git sources
+const gitSourcesDir = "git_sources"
+
+// gitSource is a git repository publishing an APKINDEX and its .apk files,
+// written as git+<clone url>[#<branch or tag>[:<subdir>]]
+type gitSource struct {
+	url    string
+	ref    string
+	subdir string
+	dir    string
+}
+
+// syncedGitSources remembers which clones are already up to date in this run
+var syncedGitSources = make(map[string]bool)
+
+// newGitSource parses a git+ repos: entry
+func newGitSource(repo string) *gitSource {
+	s := &gitSource{url: strings.TrimPrefix(repo, "git+")}
+	if i := strings.LastIndex(s.url, "#"); i >= 0 {
+		s.url, s.ref = s.url[:i], s.url[i+1:]
+		if j := strings.Index(s.ref, ":"); j >= 0 {
+			s.ref, s.subdir = s.ref[:j], s.ref[j+1:]
+		}
+	}
+	sum := sha256.Sum256([]byte(s.url + "#" + s.ref))
+	s.dir = filepath.Join(statePath(gitSourcesDir), hex.EncodeToString(sum[:8]))
+	return s
+}
+
+// git runs a git command, including its output in the error
+func git(args ...string) error {
+	out, err := exec.Command("git", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// sync clones the repository, or updates the existing clone to the latest
+// commit of the ref, once per run. LFS objects are pulled when the repo uses LFS.
+func (s *gitSource) sync() error {
+	if syncedGitSources[s.dir] {
+		return nil
+	}
+	if strings.HasPrefix(s.ref, "-") {
+		return fmt.Errorf("invalid git ref %q in %s", s.ref, s.url)
+	}
+	err := withRetries("Syncing "+s.url, func() error {
+		if _, err := os.Stat(filepath.Join(s.dir, ".git")); err != nil {
+			os.RemoveAll(s.dir)
+			if err := os.MkdirAll(filepath.Dir(s.dir), 0755); err != nil {
+				return &permanentError{err}
+			}
+			args := []string{"clone", "--quiet", "--depth", "1"}
+			if s.ref != "" {
+				args = append(args, "--branch", s.ref)
+			}
+			return git(append(args, "--", s.url, s.dir)...)
+		}
+		ref := s.ref
+		if ref == "" {
+			ref = "HEAD"
+		}
+		if err := git("-C", s.dir, "fetch", "--quiet", "--depth", "1", "--", "origin", ref); err != nil {
+			return err
+		}
+		return git("-C", s.dir, "checkout", "--quiet", "--force", "FETCH_HEAD")
+	})
+	if err != nil {
+		return err
+	}
+	if attrs, err := os.ReadFile(filepath.Join(s.dir, ".gitattributes")); err == nil && strings.Contains(string(attrs), "filter=lfs") {
+		if err := withRetries("Pulling LFS objects of "+s.url, func() error { return git("-C", s.dir, "lfs", "pull") }); err != nil {
+			return err
+		}
+	}
+	syncedGitSources[s.dir] = true
+	return nil
+}
+
+func (s *gitSource) FetchIndex(dest string) error {
+	if err := s.sync(); err != nil {
+		return err
+	}
+	for _, name := range apkIndexNames {
+		src := filepath.Join(s.dir, s.subdir, name)
+		if _, err := os.Stat(src); err == nil {
+			return copyFile(src, dest, 0644)
+		}
+	}
+	return fmt.Errorf("no APKINDEX found in %s", s.url)
+}
+
+func (s *gitSource) Fetch(filename, dest string) (string, error) {
+	if err := s.sync(); err != nil {
+		return "", err
+	}
+	return copyFileSHA256(filepath.Join(s.dir, s.subdir, path.Base(filename)), dest, 0644)
+}
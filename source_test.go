@@ -0,0 +1,82 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestGitSource(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	oldState := stateDir
+	stateDir = t.TempDir()
+	defer func() { stateDir = oldState }()
+
+	repo := t.TempDir()
+	index := "P:hello\nV:1.0-r0\n\n"
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "APKINDEX", Mode: 0644, Size: int64(len(index)), Typeflag: tar.TypeReg})
+	tw.Write([]byte(index))
+	tw.Close()
+	gz.Close()
+	os.MkdirAll(filepath.Join(repo, "x86_64"), 0755)
+	os.WriteFile(filepath.Join(repo, "x86_64", "APKINDEX.tar.gz"), buf.Bytes(), 0644)
+	os.WriteFile(filepath.Join(repo, "x86_64", "hello-1.0-r0.apk"), []byte("apk"), 0644)
+	for _, args := range [][]string{
+		{"init", "--quiet", "--initial-branch=main"},
+		{"add", "."},
+		{"-c", "user.name=t", "-c", "user.email=t@t", "commit", "--quiet", "-m", "init"},
+		{"tag", "v1"},
+	} {
+		if err := git(append([]string{"-C", repo}, args...)...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	src := sourceFor("git+file://" + repo + "#v1:x86_64")
+	indexPath := filepath.Join(t.TempDir(), "APKINDEX")
+	if err := src.FetchIndex(indexPath); err != nil {
+		t.Fatalf("FetchIndex: %v", err)
+	}
+	pkgs, err := parseAPKIndexFile(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkgs["hello"].Version != "1.0-r0" {
+		t.Errorf("hello version = %q, want 1.0-r0", pkgs["hello"].Version)
+	}
+	dest := filepath.Join(t.TempDir(), "hello.apk")
+	if _, err := src.Fetch("hello-1.0-r0.apk", dest); err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if data, _ := os.ReadFile(dest); string(data) != "apk" {
+		t.Errorf("fetched %q, want apk", data)
+	}
+	os.WriteFile(filepath.Join(src.(*gitSource).dir, "outside.apk"), []byte("outside"), 0644)
+	if _, err := src.Fetch("../outside.apk", dest); err == nil {
+		t.Errorf("Fetch read a file outside the repo subdir")
+	}
+
+	marker := filepath.Join(t.TempDir(), "marker")
+	evil := sourceFor("git+file://" + repo + "#--upload-pack=touch " + marker)
+	if err := evil.FetchIndex(filepath.Join(t.TempDir(), "APKINDEX")); err == nil {
+		t.Errorf("FetchIndex accepted a ref starting with -")
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Errorf("ref was passed to git as an option")
+	}
+}
@@ -0,0 +1,18 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import "path/filepath"
+
+// stateDir is where installed.yaml, installed_files and the rest of apkg's state
+// live, set with -state-dir or APKG_STATE_DIR (default: working directory)
+var stateDir = "."
+
+// statePath returns the path of a state file or directory
+func statePath(name string) string {
+	return filepath.Join(stateDir, name)
+}
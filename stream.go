@@ -0,0 +1,421 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// installModeStreaming installs packages straight from the download, see install_mode
+const installModeStreaming = "streaming"
+
+// streamSource is a Source that can hand out a package as a stream
+type streamSource interface {
+	Open(filename string) (io.ReadCloser, error)
+}
+
+func (s httpSource) Open(filename string) (io.ReadCloser, error) {
+	resp, err := httpGet(string(s) + "/" + filename)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// canStream reports whether pkg from repo can be installed in streaming mode, repos
+// with a trust level are always staged and so is everything scanners have to check
+func canStream(cfg *Config, repo string) bool {
+	// Signatures and locked checksums can only be checked once the whole package is there
+	if cfg.InstallMode != installModeStreaming || !cfg.Install || repo == "" || trustLevel(repo) != trustOff || len(cfg.Scanners) > 0 || lockedSums != nil {
+		return false
+	}
+	_, ok := sourceFor(repo).(streamSource)
+	return ok
+}
+
+// apkHasher hashes a package while it is read: all of it, and the gzip members it is
+// made of for verifyStreamedChecksum. Which member holds the control files is only known
+// once the first entry was read, so the first two are hashed both ways.
+type apkHasher struct {
+	r       *bufio.Reader
+	n       int64
+	member  int
+	all     hash.Hash
+	control [2]hash.Hash // sha1 of the first and of the second member
+	data    [2]hash.Hash // sha256 of what follows the first and the second member
+	one     [1]byte
+}
+
+func newAPKHasher(r io.Reader) *apkHasher {
+	return &apkHasher{
+		r:       bufio.NewReader(r),
+		all:     sha256.New(),
+		control: [2]hash.Hash{sha1.New(), sha1.New()},
+		data:    [2]hash.Hash{sha256.New(), sha256.New()},
+	}
+}
+
+func (h *apkHasher) hash(p []byte) {
+	h.n += int64(len(p))
+	h.all.Write(p)
+	if h.member < len(h.control) {
+		h.control[h.member].Write(p)
+	}
+	for i, d := range h.data {
+		if h.member > i {
+			d.Write(p)
+		}
+	}
+}
+
+func (h *apkHasher) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hash(p[:n])
+	return n, err
+}
+
+// ReadByte makes apkHasher a flate.Reader, gzip then reads no further than the member it
+// decompresses and every byte is hashed as part of the member it belongs to
+func (h *apkHasher) ReadByte() (byte, error) {
+	b, err := h.r.ReadByte()
+	if err == nil {
+		h.one[0] = b
+		h.hash(h.one[:])
+	}
+	return b, err
+}
+
+// gzipStream reads the gzip members of src one after the other, counting them on src
+type gzipStream struct {
+	zr  *gzip.Reader
+	src *apkHasher
+}
+
+func (g *gzipStream) Read(p []byte) (int, error) {
+	for {
+		n, err := g.zr.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		g.src.member++
+		if err := g.zr.Reset(g.src); err != nil {
+			return n, err // io.EOF after the last member
+		}
+		g.zr.Multistream(false)
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// verifyStreamedChecksum checks a streamed package against its index entry like
+// verifyPackageChecksum does for a downloaded one, from the member hashes of h and the
+// .PKGINFO the control member left in controlDir
+func verifyStreamedChecksum(h *apkHasher, signed bool, controlDir string, info APKPackage) error {
+	wantSHA1, err := indexSHA1(info)
+	if err != nil {
+		return err
+	}
+	control := 0
+	if signed {
+		control = 1
+	}
+	if h.member < control+2 {
+		return fmt.Errorf("%w: no data member", errChecksum)
+	}
+	if !bytes.Equal(h.control[control].Sum(nil), wantSHA1) {
+		return fmt.Errorf("%w: control checksum differs", errChecksum)
+	}
+	f, err := os.Open(filepath.Join(controlDir, ".PKGINFO"))
+	if err != nil {
+		return fmt.Errorf("%w: no .PKGINFO", errChecksum)
+	}
+	defer f.Close()
+	pkgInfo, err := parsePkgInfo(f)
+	if err != nil {
+		return err
+	}
+	if v := pkgInfo["datahash"]; len(v) == 0 || hex.EncodeToString(h.data[control].Sum(nil)) != v[0] {
+		return fmt.Errorf("%w: data hash differs", errChecksum)
+	}
+	return nil
+}
+
+// streamedPkg is what installStreamed learned about a package while streaming it
+type streamedPkg struct {
+	sha256       string
+	omittedCount int64
+	omittedBytes int64
+}
+
+// streamedFile is a file, link or directory installStreamed read. Files are written to
+// tmp beside their target and links are made there, both are renamed into place once
+// the package is verified.
+type streamedFile struct {
+	tmp, rel string
+	hdr      *tar.Header
+	// link is the path hard links point to, relative to the root like rel
+	link string
+}
+
+// installStreamed installs pkg while it downloads: the archive is read once and every
+// file is written to a temporary file beside its target as it arrives, so there is no
+// spooled download and no staged copy. The download is hashed on the way, once it ended
+// it is checked against the index size and checksum and only then are the files renamed
+// into place, journaled in tx. A mismatch fails the install with the temporary files
+// removed, the directories made for them are rolled back with tx.
+func installStreamed(pkg string, info APKPackage, repo, stagingDir, installDir string, tx *Transaction) (res *streamedPkg, err error) {
+	body, err := sourceFor(repo).(streamSource).Open(info.Filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", pkg, err)
+	}
+	defer body.Close()
+	sum := newAPKHasher(deadlineReader{body})
+	var rc io.Reader
+	if magic, _ := sum.r.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(sum)
+		if err != nil {
+			return nil, err
+		}
+		zr.Multistream(false)
+		rc = &gzipStream{zr: zr, src: sum}
+	} else {
+		dc, _, err := decompress(sum)
+		if err != nil {
+			return nil, err
+		}
+		defer dc.Close()
+		rc = dc
+	}
+
+	printf("Streaming %s (%s) from %s\n", pkg, info.Version, repo)
+	tx.setPackage(pkg)
+	opts := packageOptions(pkg)
+	filter := defaultExtractFilter()
+	budget := extractBudget{limits: extractionLimits(repo, info.InstalledSize)}
+	controlDir := controlStagingPath(stagingDir, pkg)
+	res = &streamedPkg{}
+	var installedFiles, omittedFiles, altPaths []string
+	var modes dirModes
+	var dirs, pending []streamedFile
+	pendingIdx := make(map[string]int)
+	defer func() {
+		if err != nil {
+			for _, f := range pending {
+				os.Remove(f.tmp)
+			}
+		}
+	}()
+	signed := false
+	tr := tar.NewReader(rc)
+	for first := true; ; first = false {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if unsafeEntry(hdr.Name) {
+			return nil, fmt.Errorf("refusing archive entry %s outside the package", hdr.Name)
+		}
+		if first {
+			signed = strings.HasPrefix(hdr.Name, ".SIGN.")
+		}
+		rel := filepath.Clean(hdr.Name)
+		kind := filter.classify(hdr.Name)
+		if kind == entrySkip {
+			continue
+		}
+		if err := budget.add(hdr, kind); err != nil {
+			return nil, err
+		}
+		if kind == entryControl {
+			if hdr.Typeflag == tar.TypeReg {
+				if err := writeStreamedFile(tr, filepath.Join(controlDir, rel), 0644); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if !opts.hasPathFilters() {
+				dirs = append(dirs, streamedFile{rel: opts.relocate(rel), hdr: hdr})
+			}
+		case tar.TypeReg, tar.TypeSymlink, tar.TypeLink:
+			if !opts.wantsPath(rel) {
+				omittedFiles = append(omittedFiles, rel)
+				res.omittedCount++
+				res.omittedBytes += hdr.Size
+				continue
+			}
+			rel = opts.relocate(rel)
+			if err := checkPrivileged(pkg, rel, hdr); err != nil {
+				return nil, err
+			}
+			link := ""
+			if hdr.Typeflag == tar.TypeLink {
+				if unsafeEntry(hdr.Linkname) {
+					return nil, fmt.Errorf("refusing hard link %s to %s outside the package", hdr.Name, hdr.Linkname)
+				}
+				link = opts.relocate(filepath.Clean(hdr.Linkname))
+				if isAlternativePath(link) {
+					link = alternativeTarget(link, pkg)
+				}
+				if i, ok := pendingIdx[link]; !ok || pending[i].hdr.Typeflag != tar.TypeReg {
+					eprintf("[WARN] %s: skipping hard link %s, %s isn't installed with it\n", pkg, rel, hdr.Linkname)
+					continue
+				}
+			}
+			if isAlternativePath(rel) {
+				altPaths = append(altPaths, rel)
+				rel = alternativeTarget(rel, pkg)
+			} else if !tx.claimFile(rel, stagingDir) {
+				continue
+			}
+			debugf("install", "%s: %s (%d bytes, streamed)", pkg, installPath(installDir, rel), hdr.Size)
+			i, ok := pendingIdx[rel]
+			if !ok {
+				i = len(pending)
+				pendingIdx[rel] = i
+				pending = append(pending, streamedFile{tmp: installPath(installDir, rel) + ".apkg-new", rel: rel})
+			}
+			pending[i].hdr, pending[i].link = hdr, link
+			if hdr.Typeflag != tar.TypeReg {
+				continue
+			}
+			if err := tx.mkdirAll(filepath.Dir(rel), dirMode()); err != nil {
+				return nil, err
+			}
+			if err := writeStreamedFile(tr, pending[i].tmp, 0600); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// Read to the end so the whole download is hashed and the gzip checksums are verified
+	if _, err := io.Copy(io.Discard, rc); err != nil {
+		return nil, err
+	}
+	if info.Size > 0 && sum.n != info.Size {
+		return nil, fmt.Errorf("%s is %d bytes, the index says %d", info.Filename, sum.n, info.Size)
+	}
+	if info.Checksum != "" {
+		if err := verifyStreamedChecksum(sum, signed, controlDir, info); err != nil {
+			return nil, fmt.Errorf("%s: %w", info.Filename, err)
+		}
+	}
+	res.sha256 = hex.EncodeToString(sum.all.Sum(nil))
+	countTraffic(repo, pkg, fromMirror, sum.n)
+	printf("Verified %s (%d bytes, sha256 %s)\n", info.Filename, sum.n, res.sha256)
+
+	for _, d := range dirs {
+		target := installPath(installDir, d.rel)
+		if err := tx.mkdirAll(d.rel, dirMode()); err != nil {
+			return nil, err
+		}
+		if err := chownEntry(target, d.hdr.Uid, d.hdr.Gid); err != nil {
+			return nil, err
+		}
+		modes.add(target, d.hdr.FileInfo().Mode())
+	}
+	for _, f := range pending {
+		target := installPath(installDir, f.rel)
+		if err := tx.mkdirAll(filepath.Dir(f.rel), dirMode()); err != nil {
+			return nil, err
+		}
+		switch f.hdr.Typeflag {
+		case tar.TypeSymlink:
+			os.Remove(f.tmp)
+			if err := os.Symlink(f.hdr.Linkname, f.tmp); err != nil {
+				return nil, err
+			}
+		case tar.TypeLink:
+			os.Remove(f.tmp)
+			if err := os.Link(installPath(installDir, f.link), f.tmp); err != nil {
+				return nil, err
+			}
+		}
+		if err := tx.prepareWrite(f.rel); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(f.tmp, target); err != nil {
+			return nil, err
+		}
+		installedFiles = append(installedFiles, f.rel)
+		if f.hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := chownEntry(target, f.hdr.Uid, f.hdr.Gid); err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(target, archiveMode(f.hdr.FileInfo().Mode())); err != nil {
+			return nil, err
+		}
+	}
+	if err := modes.apply(); err != nil {
+		return nil, err
+	}
+	finishPackage(pkg, stagingDir, installDir, tx, installedFiles, omittedFiles, altPaths)
+	return res, nil
+}
+
+// writeStreamedFile writes r to path with mode, creating its parent directories
+func writeStreamedFile(r io.Reader, path string, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// installStreamedPackages streams every package of pkgs into installDir within tx and
+// returns the sha256 of each download
+func installStreamedPackages(pkgs []string, pkgMap map[string]APKPackage, sourceRepo map[string]string, stagingDir, installDir string, tx *Transaction) (map[string]string, error) {
+	digests := make(map[string]string)
+	var omittedCount, omittedBytes int64
+	for _, pkg := range pkgs {
+		var res *streamedPkg
+		ok, err := runPackageStep(pkg, "install", tx, func() error {
+			var err error
+			res, err = installStreamed(pkg, pkgMap[pkg], sourceRepo[pkg], stagingDir, installDir, tx)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to install package %s: %w", pkg, err)
+		}
+		if !ok {
+			continue
+		}
+		digests[pkg] = res.sha256
+		omittedCount += res.omittedCount
+		omittedBytes += res.omittedBytes
+	}
+	if omittedCount > 0 {
+		printf("Path exclusions saved %s (%d files)\n", humanSize(omittedBytes), omittedCount)
+	}
+	return digests, nil
+}
@@ -0,0 +1,188 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInstallStreamed(t *testing.T) {
+	oldState, oldCfg := stateDir, globalConfig
+	stateDir = t.TempDir()
+	globalConfig = &Config{}
+	defer func() { stateDir, globalConfig = oldState, oldCfg }()
+
+	apk := filepath.Join(t.TempDir(), "foo-1.0-r0.apk")
+	writeTestApk(t, apk, map[string]string{".PKGINFO": "pkgname = foo\n", "usr/": "", "usr/bin/": "", "usr/bin/sh": "shell"})
+	srv := httptest.NewServer(http.FileServer(http.Dir(filepath.Dir(apk))))
+	defer srv.Close()
+	st, _ := os.Stat(apk)
+
+	root, staging := t.TempDir(), t.TempDir()
+	pkgMap := map[string]APKPackage{"foo": {Name: "foo", Version: "1.0-r0", Filename: "foo-1.0-r0.apk", Size: st.Size()}}
+	repos := map[string]string{"foo": srv.URL}
+	tx, err := beginTransaction(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digests, err := installStreamedPackages([]string{"foo"}, pkgMap, repos, staging, root, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digests["foo"] != fileSHA256(apk) {
+		t.Errorf("digest %q doesn't match the package", digests["foo"])
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "usr/bin/sh")); string(data) != "shell" {
+		t.Errorf("usr/bin/sh = %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(root, ".PKGINFO")); err == nil {
+		t.Error(".PKGINFO was installed into the root")
+	}
+	tx.commit()
+
+	// A size mismatch must fail so the transaction can be rolled back
+	pkgMap["foo"] = APKPackage{Name: "foo", Version: "1.0-r0", Filename: "foo-1.0-r0.apk", Size: st.Size() + 1}
+	tx, _ = beginTransaction(root)
+	if _, err := installStreamedPackages([]string{"foo"}, pkgMap, repos, staging, root, tx); err == nil {
+		t.Fatal("expected a size mismatch to fail")
+	}
+	if err := tx.rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "usr/bin/sh")); string(data) != "shell" {
+		t.Errorf("rollback didn't restore usr/bin/sh: %q", data)
+	}
+}
+
+func TestInstallStreamedChecksum(t *testing.T) {
+	oldState, oldCfg := stateDir, globalConfig
+	stateDir = t.TempDir()
+	globalConfig = &Config{}
+	defer func() { stateDir, globalConfig = oldState, oldCfg }()
+
+	apk, info := peerTestApk(t)
+	info.Filename = "foo-1.0-r0.apk"
+	served := apk
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(served)
+	}))
+	defer srv.Close()
+	repos := map[string]string{"foo": srv.URL}
+
+	// Data of the same size but other content streams fine, the checksum catches it
+	tampered := append([]byte(nil), apk...)
+	data := tarGz("usr/bin/foo", "#!/bin/su\n")
+	copy(tampered[len(apk)-len(data):], data)
+	served = tampered
+	root := t.TempDir()
+	tx, err := beginTransaction(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := installStreamedPackages([]string{"foo"}, map[string]APKPackage{"foo": info}, repos, t.TempDir(), root, tx); !errors.Is(err, errChecksum) {
+		t.Fatalf("expected errChecksum, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "usr/bin/foo")); err == nil {
+		t.Error("a file of the tampered package was installed")
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Errorf("the tampered package created %v in the root", entries)
+	}
+	tx.rollback()
+
+	// Entries leaving the root are refused
+	served = tarGz("../escape", "x")
+	tx, _ = beginTransaction(root)
+	if _, err := installStreamedPackages([]string{"foo"}, map[string]APKPackage{"foo": {Name: "foo", Filename: "foo-1.0-r0.apk"}}, repos, t.TempDir(), root, tx); err == nil || !strings.Contains(err.Error(), "outside the package") {
+		t.Errorf("expected ../escape to be refused, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "../escape")); err == nil {
+		t.Error("../escape was written outside the root")
+	}
+	tx.rollback()
+
+	served = apk
+	tx, _ = beginTransaction(root)
+	if _, err := installStreamedPackages([]string{"foo"}, map[string]APKPackage{"foo": info}, repos, t.TempDir(), root, tx); err != nil {
+		t.Fatal(err)
+	}
+	tx.commit()
+	if data, _ := os.ReadFile(filepath.Join(root, "usr/bin/foo")); string(data) != "#!/bin/sh\n" {
+		t.Errorf("usr/bin/foo = %q", data)
+	}
+}
+
+func TestInstallStreamedLinks(t *testing.T) {
+	oldState, oldCfg := stateDir, globalConfig
+	stateDir = t.TempDir()
+	globalConfig = &Config{}
+	defer func() { stateDir, globalConfig = oldState, oldCfg }()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for _, hdr := range []*tar.Header{
+		{Name: ".PKGINFO", Mode: 0644, Size: 14, Typeflag: tar.TypeReg},
+		{Name: "bin/busybox", Mode: 0755, Size: 2, Typeflag: tar.TypeReg},
+		{Name: "bin/sh", Linkname: "busybox", Mode: 0777, Typeflag: tar.TypeSymlink},
+		{Name: "bin/ash", Linkname: "bin/busybox", Mode: 0755, Typeflag: tar.TypeLink},
+	} {
+		tw.WriteHeader(hdr)
+		switch hdr.Name {
+		case ".PKGINFO":
+			tw.Write([]byte("pkgname = foo\n"))
+		case "bin/busybox":
+			tw.Write([]byte("bb"))
+		}
+	}
+	tw.Close()
+	zw.Close()
+	apk := buf.Bytes()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(apk)
+	}))
+	defer srv.Close()
+
+	root := t.TempDir()
+	tx, err := beginTransaction(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkgMap := map[string]APKPackage{"foo": {Name: "foo", Version: "1.0-r0", Filename: "foo-1.0-r0.apk", Size: int64(len(apk))}}
+	if _, err := installStreamedPackages([]string{"foo"}, pkgMap, map[string]string{"foo": srv.URL}, t.TempDir(), root, tx); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := os.Readlink(filepath.Join(root, "bin/sh")); err != nil || target != "busybox" {
+		t.Errorf("bin/sh links to %q (%v), want busybox", target, err)
+	}
+	bb, _ := os.Stat(filepath.Join(root, "bin/busybox"))
+	ash, err := os.Stat(filepath.Join(root, "bin/ash"))
+	if err != nil || !os.SameFile(bb, ash) {
+		t.Errorf("bin/ash isn't a hard link of bin/busybox: %v", err)
+	}
+	if got := strings.Join(tx.packageFiles("foo"), " "); got != "bin/busybox bin/sh bin/ash" {
+		t.Errorf("journaled files %q", got)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(root, "bin", "*.apkg-new")); len(matches) > 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+	if err := tx.rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(root, "bin/sh")); !os.IsNotExist(err) {
+		t.Error("rollback left bin/sh behind")
+	}
+}
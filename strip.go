@@ -0,0 +1,233 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// stripModeStrip removes symbols and debug info from installed ELF files
+	stripModeStrip = "strip"
+	// stripModeSplit moves the debug info into debugDir first, linked with .gnu_debuglink
+	stripModeSplit = "split"
+	// debugDir is where split debug info goes, mirroring the stripped file's path
+	debugDir = "usr/lib/debug"
+	// strippedFile (under the state dir) maps stripped paths to their sha256 after stripping,
+	// which no longer matches the package's
+	strippedFile = "stripped.yaml"
+)
+
+// readStripped reads the sha256 of every stripped path
+func readStripped() (map[string]string, error) {
+	data, err := os.ReadFile(statePath(strippedFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]string{}, nil
+		}
+		return nil, err
+	}
+	stripped := map[string]string{}
+	if err := yaml.Unmarshal(data, &stripped); err != nil {
+		return nil, err
+	}
+	return stripped, nil
+}
+
+// writeStripped writes the sha256 of every stripped path
+func writeStripped(stripped map[string]string) error {
+	if len(stripped) == 0 {
+		err := os.Remove(statePath(strippedFile))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	data, err := yaml.Marshal(stripped)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(statePath(strippedFile), data, 0644)
+}
+
+// forgetStripped drops uninstalled or replaced paths from stripped.yaml
+func forgetStripped(files []string) error {
+	stripped, err := readStripped()
+	if err != nil || len(stripped) == 0 {
+		return err
+	}
+	for _, f := range files {
+		delete(stripped, filepath.ToSlash(f))
+	}
+	return writeStripped(stripped)
+}
+
+// stripTool returns the first of the llvm (multi-arch) or binutils tool found
+func stripTool(name string) (string, error) {
+	for _, candidate := range []string{"llvm-" + name, name} {
+		if p, err := exec.LookPath(candidate); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("neither llvm-%s nor %s is installed", name, name)
+}
+
+// stripFile strips the ELF file rel of the install root in place (through a copy, so
+// hardlinks and a failed strip never leave a broken file). In split mode the debug info
+// is kept in debugDir first, journaled in tx, its path relative to the root is returned.
+func stripFile(tx *Transaction, rel, mode string) (string, error) {
+	strip, err := stripTool("strip")
+	if err != nil {
+		return "", err
+	}
+	full := installPath(tx.installDir, rel)
+	info, err := os.Stat(full)
+	if err != nil {
+		return "", err
+	}
+	tmp := full + ".apkg-strip"
+	if err := copyFile(full, tmp, info.Mode().Perm()); err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp)
+	debugRel := ""
+	if mode == stripModeSplit {
+		objcopy, err := stripTool("objcopy")
+		if err != nil {
+			return "", err
+		}
+		debugRel = filepath.Join(debugDir, rel+".debug")
+		if err := tx.mkdirAll(filepath.Dir(debugRel), dirMode()); err != nil {
+			return "", err
+		}
+		if err := tx.prepareWrite(debugRel); err != nil {
+			return "", err
+		}
+		debugPath := installPath(tx.installDir, debugRel)
+		if out, err := exec.Command(objcopy, "--only-keep-debug", tmp, debugPath).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("objcopy --only-keep-debug %s: %v\n%s", rel, err, out)
+		}
+		if out, err := exec.Command(strip, "--strip-unneeded", tmp).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("strip %s: %v\n%s", rel, err, out)
+		}
+		if out, err := exec.Command(objcopy, "--add-gnu-debuglink="+debugPath, tmp).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("objcopy --add-gnu-debuglink %s: %v\n%s", rel, err, out)
+		}
+	} else if out, err := exec.Command(strip, "--strip-unneeded", tmp).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("strip %s: %v\n%s", rel, err, out)
+	}
+	// Stripped files were just written by tx, this only journals ones it didn't write
+	if err := tx.prepareWrite(rel); err != nil {
+		return "", err
+	}
+	return debugRel, os.Rename(tmp, full)
+}
+
+// strippable reports whether rel is an ELF file of root that may be stripped.
+// Kernel modules are left alone since stripping breaks their signatures.
+func strippable(root, rel string) bool {
+	if strings.HasPrefix(rel, modulesDir+"/") || strings.HasPrefix(rel, debugDir+"/") {
+		return false
+	}
+	full := filepath.Join(root, rel)
+	info, err := os.Lstat(full)
+	return err == nil && info.Mode().IsRegular() && isELF(full)
+}
+
+// runStrip strips the ELF files changedPkgs wrote in tx per the strip option, skipping
+// packages with no_strip. It runs before tx commits, so the audit log and rollback see
+// the stripped files. Split debug files are added to the package's installed files so
+// they are removed with it, and the new sha256 of every stripped file goes to
+// stripped.yaml once tx commits.
+func runStrip(cfg *Config, tx *Transaction, changedPkgs []string) {
+	stripped, err := readStripped()
+	if err != nil {
+		eprintf("[WARN] Failed to read %s: %v\n", strippedFile, err)
+		return
+	}
+	// Installs and upgrades replaced whatever was stripped before
+	for _, pkg := range changedPkgs {
+		for _, rel := range tx.packageFiles(pkg) {
+			delete(stripped, filepath.ToSlash(rel))
+		}
+	}
+	tx.deferCommit(func() {
+		if err := writeStripped(stripped); err != nil {
+			eprintf("[WARN] Failed to update %s: %v\n", strippedFile, err)
+		}
+	})
+	if cfg.Strip == "" {
+		return
+	}
+	var saved int64
+	count := 0
+	for _, pkg := range changedPkgs {
+		if cfg.optionsOf(pkg).NoStrip {
+			continue
+		}
+		tx.setPackage(pkg)
+		var debugFiles []string
+		for _, rel := range tx.packageFiles(pkg) {
+			if !strippable(tx.installDir, rel) {
+				continue
+			}
+			full := installPath(tx.installDir, rel)
+			before, _ := os.Stat(full)
+			debugRel, err := stripFile(tx, rel, cfg.Strip)
+			if err != nil {
+				eprintf("[WARN] Not stripping %s: %v\n", rel, err)
+				continue
+			}
+			if debugRel != "" {
+				debugFiles = append(debugFiles, filepath.ToSlash(debugRel))
+			}
+			after, _ := os.Stat(full)
+			if before != nil && after != nil {
+				saved += before.Size() - after.Size()
+			}
+			if sum := fileSHA256(full); sum != "" {
+				stripped[filepath.ToSlash(rel)] = sum
+			}
+			count++
+		}
+		if len(debugFiles) > 0 {
+			pkg := pkg
+			// After recordPackage wrote the package's installed files
+			tx.deferCommit(func() {
+				files, _ := readInstalledFiles(pkg)
+				if err := writeInstalledFiles(pkg, mergeFileLists(files, debugFiles)); err != nil {
+					eprintf("[WARN] Failed to record debug files of %s: %v\n", pkg, err)
+				}
+			})
+		}
+	}
+	if count > 0 {
+		printf("Stripped %d ELF files, saved %s\n", count, humanSize(saved))
+	}
+}
+
+// mergeFileLists returns files with extra appended, without duplicates
+func mergeFileLists(files, extra []string) []string {
+	seen := make(map[string]bool, len(files))
+	merged := append([]string{}, files...)
+	for _, f := range files {
+		seen[f] = true
+	}
+	for _, f := range extra {
+		if !seen[f] {
+			seen[f] = true
+			merged = append(merged, f)
+		}
+	}
+	return merged
+}
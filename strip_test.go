@@ -0,0 +1,88 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunStripSplit(t *testing.T) {
+	if _, err := stripTool("objcopy"); err != nil {
+		t.Skip(err)
+	}
+	if _, err := stripTool("strip"); err != nil {
+		t.Skip(err)
+	}
+	oldState, oldConfig := stateDir, globalConfig
+	defer func() { stateDir, globalConfig = oldState, oldConfig }()
+	stateDir = t.TempDir()
+	root := t.TempDir()
+	globalConfig = &Config{AuditLog: filepath.Join(t.TempDir(), "audit.log")}
+	tx, err := beginTransaction(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(pkg, rel string, write func(string) error) {
+		tx.setPackage(pkg)
+		tx.mkdirAll(filepath.Dir(rel), 0755)
+		tx.prepareWrite(rel)
+		if err := write(filepath.Join(root, rel)); err != nil {
+			t.Skip(err)
+		}
+	}
+	write("coreutils", "bin/true", func(p string) error { return copyFile("/bin/true", p, 0755) })
+	write("coreutils", "bin/script", func(p string) error { return os.WriteFile(p, []byte("#!/bin/sh\n"), 0755) })
+	write("busybox", "bin/busybox", func(p string) error { return copyFile("/bin/true", p, 0755) })
+	writeInstalledFiles("coreutils", []string{"bin/true", "bin/script"})
+	writeInstalledFiles("busybox", []string{"bin/busybox"})
+	unstripped := fileSHA256(filepath.Join(root, "bin/true"))
+
+	cfg := &Config{InstallDir: root, Strip: stripModeSplit, PackageOptions: map[string]PackageOptions{"busybox": {NoStrip: true}}}
+	runStrip(cfg, tx, []string{"coreutils", "busybox"})
+	if _, err := os.Stat(statePath(strippedFile)); !os.IsNotExist(err) {
+		t.Error("stripped.yaml was written before the transaction committed")
+	}
+	if err := tx.commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := readInstalledFiles("coreutils")
+	if len(files) != 3 || files[2] != "usr/lib/debug/bin/true.debug" {
+		t.Fatalf("debug file wasn't recorded: %v", files)
+	}
+	stripped, _ := readStripped()
+	sum := fileSHA256(filepath.Join(root, "bin/true"))
+	if len(stripped) != 1 || stripped["bin/true"] != sum || sum == unstripped {
+		t.Errorf("unexpected stripped.yaml: %v", stripped)
+	}
+	// The audit log has the stripped content and the debug file
+	log, _ := os.ReadFile(globalConfig.AuditLog)
+	if !strings.Contains(string(log), `"path":"bin/true","action":"create","after_sha256":"`+sum+`"`) || !strings.Contains(string(log), "usr/lib/debug/bin/true.debug") {
+		t.Errorf("audit log doesn't have the stripped files:\n%s", log)
+	}
+	// verify checks stripped files against their sha256 after stripping
+	configPath := filepath.Join(t.TempDir(), "apkg.yaml")
+	os.WriteFile(configPath, []byte("install_dir: "+root+"\n"), 0644)
+	writeInstalledPkgs(statePath("installed.yaml"), map[string]string{"coreutils": "9.5-r0"})
+	if code := cmdVerify(configPath, nil); code != 0 {
+		t.Errorf("verify of the stripped root exited %d", code)
+	}
+	os.WriteFile(filepath.Join(root, "bin/true"), []byte("changed"), 0755)
+	if code := cmdVerify(configPath, nil); code != 1 {
+		t.Errorf("verify of a modified stripped file exited %d", code)
+	}
+
+	if err := forgetStripped(files); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(statePath(strippedFile)); !os.IsNotExist(err) {
+		t.Errorf("%s should be gone once nothing stripped is installed", strippedFile)
+	}
+}
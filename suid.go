@@ -0,0 +1,135 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// capabilityXattr is the PAX record carrying a file's capabilities
+const capabilityXattr = "SCHILY.xattr.security.capability"
+
+// allowSuid is set by -allow-suid, new setuid/setgid files and file capabilities are installed without review
+var allowSuid bool
+
+// suidGate holds the packages of this run whose privileged files need -allow-suid or allow_suid
+var suidGate = map[string]bool{}
+
+// PrivilegedFile is a file installed with setuid/setgid bits or file capabilities
+type PrivilegedFile struct {
+	Package string   `json:"package"`
+	Path    string   `json:"path"`
+	Reasons []string `json:"reasons"`
+	Allowed bool     `json:"allowed"`
+}
+
+// suidAllowed reports whether pkg may install privileged files
+func suidAllowed(pkg string) bool {
+	return allowSuid || packageOptions(pkg).AllowSuid
+}
+
+// gateSuid records which of the packages to install or upgrade get their privileged files reviewed
+func gateSuid(plan *Plan) {
+	for _, list := range [][]PlanItem{plan.Installs, plan.Upgrades} {
+		for _, it := range list {
+			if !suidAllowed(it.Name) {
+				suidGate[it.Name] = true
+			}
+		}
+	}
+}
+
+// privilegedReasons returns why a tar entry is privileged, nil if it isn't
+func privilegedReasons(hdr *tar.Header) []string {
+	var reasons []string
+	if hdr.Mode&04000 != 0 {
+		reasons = append(reasons, "setuid")
+	}
+	if hdr.Mode&02000 != 0 {
+		reasons = append(reasons, "setgid")
+	}
+	if _, ok := hdr.PAXRecords[capabilityXattr]; ok {
+		reasons = append(reasons, "capabilities")
+	}
+	return reasons
+}
+
+// checkPrivileged refuses a privileged entry of a gated package while it is streamed
+func checkPrivileged(pkg, rel string, hdr *tar.Header) error {
+	if reasons := privilegedReasons(hdr); reasons != nil && suidGate[pkg] {
+		return fmt.Errorf("%s installs %s with %s, review it and pass -allow-suid or set allow_suid for the package", pkg, rel, strings.Join(reasons, ", "))
+	}
+	return nil
+}
+
+// scanPrivileged lists the privileged files pkg would install from the .apk at path
+func scanPrivileged(pkg, path string) ([]PrivilegedFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rc, _, err := decompress(f)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	opts := packageOptions(pkg)
+	filter := defaultExtractFilter()
+	var found []PrivilegedFile
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return found, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		rel := filepath.Clean(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || filter.classify(hdr.Name) != entryPayload || !opts.wantsPath(rel) {
+			continue
+		}
+		if reasons := privilegedReasons(hdr); reasons != nil {
+			found = append(found, PrivilegedFile{Package: pkg, Path: opts.relocate(rel), Reasons: reasons, Allowed: !suidGate[pkg]})
+		}
+	}
+}
+
+// reportPrivileged prints the audit of privileged files and returns an error when any
+// of them isn't allowed
+func reportPrivileged(files []PrivilegedFile) error {
+	if len(files) == 0 {
+		return nil
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Package != files[j].Package {
+			return files[i].Package < files[j].Package
+		}
+		return files[i].Path < files[j].Path
+	})
+	printf("Files installed with setuid/setgid bits or capabilities:\n")
+	refused := 0
+	for _, f := range files {
+		mark := "allowed"
+		if !f.Allowed {
+			mark = "NOT ALLOWED"
+			refused++
+		}
+		printf("  %-20s %-40s %-24s %s\n", f.Package, f.Path, strings.Join(f.Reasons, ","), mark)
+	}
+	if refused > 0 {
+		return fmt.Errorf("%d privileged files need review, pass -allow-suid or set allow_suid in package_options for their packages", refused)
+	}
+	return nil
+}
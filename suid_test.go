@@ -0,0 +1,60 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScanPrivileged(t *testing.T) {
+	oldCfg, oldGate := globalConfig, suidGate
+	defer func() { globalConfig, suidGate = oldCfg, oldGate }()
+	globalConfig = &Config{PackageOptions: map[string]PackageOptions{"sudo": {AllowSuid: true}}}
+	suidGate = map[string]bool{}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for _, hdr := range []*tar.Header{
+		{Name: ".PKGINFO", Mode: 0644},
+		{Name: "usr/bin/ping", Mode: 0755, PAXRecords: map[string]string{capabilityXattr: "\x01\x00\x00\x02"}},
+		{Name: "usr/bin/su", Mode: 04755},
+		{Name: "usr/bin/wall", Mode: 02755},
+		{Name: "usr/bin/ls", Mode: 0755},
+	} {
+		hdr.Typeflag = tar.TypeReg
+		tw.WriteHeader(hdr)
+	}
+	tw.Close()
+	zw.Close()
+	apk := filepath.Join(t.TempDir(), "pkg.apk")
+	os.WriteFile(apk, buf.Bytes(), 0644)
+
+	gateSuid(&Plan{Installs: []PlanItem{{Name: "shadow"}, {Name: "sudo"}}})
+	if !suidGate["shadow"] || suidGate["sudo"] {
+		t.Fatalf("gated %v", suidGate)
+	}
+	files, err := scanPrivileged("shadow", apk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 || files[0].Path != "usr/bin/ping" || files[0].Reasons[0] != "capabilities" || files[1].Reasons[0] != "setuid" || files[2].Reasons[0] != "setgid" {
+		t.Fatalf("found %+v", files)
+	}
+	if err := reportPrivileged(files); err == nil {
+		t.Error("expected unreviewed setuid files to stop the apply")
+	}
+	files, _ = scanPrivileged("sudo", apk)
+	if err := reportPrivileged(files); err != nil {
+		t.Errorf("allow_suid package refused: %v", err)
+	}
+}
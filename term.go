@@ -0,0 +1,101 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unicode/utf8"
+	"unsafe"
+)
+
+// longOutput is set by -long, package lists are printed one per line even on a terminal
+var longOutput bool
+
+// columnGap separates the columns of a package list, lists are indented by the same amount
+const columnGap = 2
+
+// terminalWidth returns the width package lists are wrapped to: $COLUMNS when set,
+// otherwise the width of the terminal on stdout. 0 means one package per line, as with
+// -long or when stdout isn't a terminal so scripts keep getting the verbose form.
+func terminalWidth() int {
+	if longOutput {
+		return 0
+	}
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 0 {
+		return n
+	}
+	// struct winsize: unsigned short ws_row, ws_col, ws_xpixel, ws_ypixel
+	var ws [4]uint16
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, os.Stdout.Fd(), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws[0]))); errno != 0 {
+		return 0
+	}
+	return int(ws[1])
+}
+
+// truncateWidth shortens s to at most width characters, marking the cut with "~"
+func truncateWidth(s string, width int) string {
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	if width < 2 {
+		return "~"
+	}
+	r := []rune(s)
+	return string(r[:width-1]) + "~"
+}
+
+// printColumns prints items in columns filled top to bottom like ls, fitting width.
+// Items wider than a line are truncated, with width 0 every item gets its own line.
+func printColumns(w io.Writer, items []string, width int) {
+	indent := strings.Repeat(" ", columnGap)
+	if width <= 0 {
+		for _, it := range items {
+			fmt.Fprintf(w, "%s%s\n", indent, it)
+		}
+		return
+	}
+	avail := width - columnGap
+	if avail < 1 {
+		avail = 1
+	}
+	colWidth := 0
+	for _, it := range items {
+		if n := utf8.RuneCountInString(it); n > colWidth {
+			colWidth = n
+		}
+	}
+	if colWidth > avail {
+		colWidth = avail
+	}
+	cols := (avail + columnGap) / (colWidth + columnGap)
+	if cols < 1 {
+		cols = 1
+	}
+	rows := (len(items) + cols - 1) / cols
+	for r := 0; r < rows; r++ {
+		var line strings.Builder
+		line.WriteString(indent)
+		for c := 0; c < cols; c++ {
+			i := c*rows + r
+			if i >= len(items) {
+				break
+			}
+			it := truncateWidth(items[i], colWidth)
+			line.WriteString(it)
+			// Pad to the next column unless this is the last item of the row
+			if c < cols-1 && (c+1)*rows+r < len(items) {
+				line.WriteString(strings.Repeat(" ", colWidth-utf8.RuneCountInString(it)+columnGap))
+			}
+		}
+		fmt.Fprintln(w, line.String())
+	}
+}
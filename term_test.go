@@ -0,0 +1,33 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPrintColumns(t *testing.T) {
+	var buf bytes.Buffer
+	printColumns(&buf, []string{"musl", "busybox", "zlib", "openssl", "ca-certificates"}, 40)
+	want := "  musl             openssl\n  busybox          ca-certificates\n  zlib\n"
+	if buf.String() != want {
+		t.Errorf("got\n%q\nwant\n%q", buf.String(), want)
+	}
+
+	buf.Reset()
+	printColumns(&buf, []string{"a-very-long-package-name", "ok"}, 12)
+	if want := "  a-very-lo~\n  ok\n"; buf.String() != want {
+		t.Errorf("truncation: got %q", buf.String())
+	}
+
+	buf.Reset()
+	printColumns(&buf, []string{"musl 1.2.5-r0"}, 0)
+	if buf.String() != "  musl 1.2.5-r0\n" {
+		t.Errorf("long form: got %q", buf.String())
+	}
+}
@@ -0,0 +1,299 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// trafficFile (under the state dir) accumulates the transfers of every run and the most
+// recent package downloads the download speed is estimated from
+const trafficFile = "traffic.yaml"
+
+// legacyBandwidthFile kept the download speed samples before they moved to trafficFile
+const legacyBandwidthFile = "bandwidth.yaml"
+
+// Where the bytes of a transfer came from
+const (
+	fromMirror = "mirror"
+	fromPeer   = "peer"
+	fromCache  = "cache"
+	fromIndex  = "index"
+)
+
+// TrafficCounters are the bytes of packages and indexes by where they came from
+type TrafficCounters struct {
+	// Mirror are the package bytes downloaded from the repos
+	Mirror int64 `yaml:"mirror,omitempty" json:"mirror"`
+	// Peers are the package bytes fetched from peers instead
+	Peers int64 `yaml:"peers,omitempty" json:"peers"`
+	// Cache are the package bytes taken from cache_dir instead
+	Cache int64 `yaml:"cache,omitempty" json:"cache"`
+	// Indexes are the index bytes downloaded from the repos
+	Indexes int64 `yaml:"indexes,omitempty" json:"indexes"`
+	// Fetches counts the packages fetched from anywhere, Downloads those from the repos
+	Fetches   int `yaml:"fetches,omitempty" json:"fetches"`
+	Downloads int `yaml:"downloads,omitempty" json:"downloads"`
+}
+
+// add counts n bytes from source
+func (c *TrafficCounters) add(source string, n int64) {
+	switch source {
+	case fromMirror:
+		c.Mirror += n
+		c.Downloads++
+	case fromPeer:
+		c.Peers += n
+	case fromCache:
+		c.Cache += n
+	case fromIndex:
+		c.Indexes += n
+		return
+	}
+	c.Fetches++
+}
+
+// merge adds o to c
+func (c *TrafficCounters) merge(o TrafficCounters) {
+	c.Mirror += o.Mirror
+	c.Peers += o.Peers
+	c.Cache += o.Cache
+	c.Indexes += o.Indexes
+	c.Fetches += o.Fetches
+	c.Downloads += o.Downloads
+}
+
+// saved returns the package bytes that didn't have to come from the repos, and their share
+// of all package bytes in percent
+func (c TrafficCounters) saved() (int64, float64) {
+	saved := c.Peers + c.Cache
+	if total := saved + c.Mirror; total > 0 {
+		return saved, float64(saved) * 100 / float64(total)
+	}
+	return 0, 0
+}
+
+// TrafficStats are the transfers of all runs since Since, per repo and per package
+type TrafficStats struct {
+	Since    time.Time                   `yaml:"since" json:"since"`
+	Runs     int                         `yaml:"runs" json:"runs"`
+	Total    TrafficCounters             `yaml:"total" json:"total"`
+	Repos    map[string]*TrafficCounters `yaml:"repos,omitempty" json:"repos"`
+	Packages map[string]*TrafficCounters `yaml:"packages,omitempty" json:"packages"`
+	// Bandwidth are the most recent package downloads, oldest first
+	Bandwidth []bandwidthSample `yaml:"bandwidth,omitempty" json:"-"`
+}
+
+// count adds n bytes of pkg (empty for indexes) of repo from source
+func (s *TrafficStats) count(repo, pkg, source string, n int64) {
+	if s.Repos == nil {
+		s.Repos = map[string]*TrafficCounters{}
+		s.Packages = map[string]*TrafficCounters{}
+	}
+	s.Total.add(source, n)
+	if s.Repos[repo] == nil {
+		s.Repos[repo] = &TrafficCounters{}
+	}
+	s.Repos[repo].add(source, n)
+	if pkg != "" {
+		if s.Packages[pkg] == nil {
+			s.Packages[pkg] = &TrafficCounters{}
+		}
+		s.Packages[pkg].add(source, n)
+	}
+}
+
+// merge adds the counters of o to s
+func (s *TrafficStats) merge(o *TrafficStats) {
+	for repo, c := range o.Repos {
+		if s.Repos == nil {
+			s.Repos = map[string]*TrafficCounters{}
+		}
+		if s.Repos[repo] == nil {
+			s.Repos[repo] = &TrafficCounters{}
+		}
+		s.Repos[repo].merge(*c)
+	}
+	for pkg, c := range o.Packages {
+		if s.Packages == nil {
+			s.Packages = map[string]*TrafficCounters{}
+		}
+		if s.Packages[pkg] == nil {
+			s.Packages[pkg] = &TrafficCounters{}
+		}
+		s.Packages[pkg].merge(*c)
+	}
+	s.Total.merge(o.Total)
+}
+
+// runTraffic are the transfers of this run, fetches may run concurrently
+var runTraffic struct {
+	sync.Mutex
+	stats TrafficStats
+}
+
+// trafficFileMu serializes the updates of trafficFile by concurrent fetches
+var trafficFileMu sync.Mutex
+
+// countTraffic records n bytes of pkg (empty for an index) of repo fetched from source.
+// Bundles are read from disk and don't count.
+func countTraffic(repo, pkg, source string, n int64) {
+	if bundleDir != "" || n <= 0 {
+		return
+	}
+	runTraffic.Lock()
+	runTraffic.stats.count(repo, pkg, source, n)
+	runTraffic.Unlock()
+}
+
+// countFileTraffic records the size of the file at path like countTraffic
+func countFileTraffic(repo, pkg, source, path string) {
+	if st, err := os.Stat(path); err == nil {
+		countTraffic(repo, pkg, source, st.Size())
+	}
+}
+
+// readTraffic returns the accumulated transfers, empty ones starting now without a record
+func readTraffic() *TrafficStats {
+	s := &TrafficStats{}
+	if data, err := os.ReadFile(statePath(trafficFile)); err == nil {
+		yaml.Unmarshal(data, s)
+	}
+	if len(s.Bandwidth) == 0 {
+		if data, err := os.ReadFile(statePath(legacyBandwidthFile)); err == nil {
+			yaml.Unmarshal(data, &s.Bandwidth)
+		}
+	}
+	if s.Since.IsZero() {
+		s.Since = time.Now().UTC().Truncate(time.Second)
+	}
+	return s
+}
+
+// writeTraffic replaces the accumulated transfers with s
+func writeTraffic(s *TrafficStats) error {
+	data, err := yaml.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := statePath(trafficFile) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, statePath(trafficFile)); err != nil {
+		return err
+	}
+	os.Remove(statePath(legacyBandwidthFile)) // its samples were read into s
+	return nil
+}
+
+// finishTraffic adds the transfers of this run to the accumulated ones and prints them,
+// it returns them for the run result, nil when nothing was transferred
+func finishTraffic() *TrafficCounters {
+	runTraffic.Lock()
+	run := runTraffic.stats
+	runTraffic.stats = TrafficStats{}
+	runTraffic.Unlock()
+	if len(run.Repos) == 0 {
+		return nil
+	}
+	trafficFileMu.Lock()
+	all := readTraffic()
+	all.merge(&run)
+	all.Runs++
+	err := writeTraffic(all)
+	trafficFileMu.Unlock()
+	if err != nil {
+		eprintf("[WARN] Failed to record the transfers of this run: %v\n", err)
+	}
+	t := run.Total
+	printf("Transferred %s from the repos (%s of it indexes), %s from peers, %s from the cache\n", humanSize(t.Mirror+t.Indexes), humanSize(t.Indexes), humanSize(t.Peers), humanSize(t.Cache))
+	return &t
+}
+
+// cmdStats implements `apkg stats network`: the transfers of all runs per repo and the
+// packages that took the most, to see what the cache and peers save
+func cmdStats(configPath string, args []string) int {
+	if len(args) == 0 || args[0] != "network" {
+		eprintf("Usage: %s [flags] stats network [-top 10] [-reset]\n", os.Args[0])
+		return 1
+	}
+	if cfg, err := readConfig(configPath); err == nil {
+		globalConfig = cfg
+	}
+	fs := flag.NewFlagSet("stats network", flag.ExitOnError)
+	top := fs.Int("top", 10, "How many of the packages that transferred the most to show")
+	reset := fs.Bool("reset", false, "Forget the accumulated transfers and start counting anew")
+	fs.Parse(args[1:])
+	if *reset {
+		// The download speed samples aren't statistics, they are kept
+		if err := writeTraffic(&TrafficStats{Bandwidth: readTraffic().Bandwidth}); err != nil {
+			eprintf("[ERROR] %v\n", err)
+			return 1
+		}
+		printf("Transfer statistics reset\n")
+		return 0
+	}
+	s := readTraffic()
+	if jsonOut != nil {
+		enc := json.NewEncoder(jsonOut)
+		enc.SetIndent("", "  ")
+		enc.Encode(s)
+		return 0
+	}
+	if s.Runs == 0 {
+		printf("No transfers recorded yet.\n")
+		return 0
+	}
+	saved, share := s.Total.saved()
+	printf("Since %s (%d runs)\n", s.Since.Format(time.RFC3339), s.Runs)
+	printf("  From the repos: %s in %d packages, %s in indexes\n", humanSize(s.Total.Mirror), s.Total.Downloads, humanSize(s.Total.Indexes))
+	printf("  From peers:     %s\n", humanSize(s.Total.Peers))
+	printf("  From the cache: %s\n", humanSize(s.Total.Cache))
+	printf("  Saved:          %s (%.0f%% of the package bytes)\n", humanSize(saved), share)
+	printf("Per repo:\n")
+	repos := make([]string, 0, len(s.Repos))
+	for repo := range s.Repos {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	for _, repo := range repos {
+		c := s.Repos[repo]
+		printf("  %s\n    repos %s, indexes %s, peers %s, cache %s\n", repo, humanSize(c.Mirror), humanSize(c.Indexes), humanSize(c.Peers), humanSize(c.Cache))
+	}
+	pkgs := make([]string, 0, len(s.Packages))
+	for pkg := range s.Packages {
+		pkgs = append(pkgs, pkg)
+	}
+	total := func(c *TrafficCounters) int64 { return c.Mirror + c.Peers + c.Cache }
+	sort.Slice(pkgs, func(i, j int) bool {
+		ti, tj := total(s.Packages[pkgs[i]]), total(s.Packages[pkgs[j]])
+		if ti != tj {
+			return ti > tj
+		}
+		return pkgs[i] < pkgs[j]
+	})
+	if len(pkgs) > *top {
+		pkgs = pkgs[:*top]
+	}
+	if len(pkgs) > 0 {
+		printf("Top packages:\n")
+	}
+	for _, pkg := range pkgs {
+		c := s.Packages[pkg]
+		saved, _ := c.saved()
+		printf("  %-30s %10s in %d fetches, %s of it saved\n", pkg, humanSize(total(c)), c.Fetches, humanSize(saved))
+	}
+	return 0
+}
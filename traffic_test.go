@@ -0,0 +1,83 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTrafficAccounting(t *testing.T) {
+	oldConfig, oldState := globalConfig, stateDir
+	defer func() { globalConfig, stateDir = oldConfig, oldState }()
+	stateDir = t.TempDir()
+	runTraffic.stats = TrafficStats{}
+	payload := []byte("not really a package, 43 bytes of it though")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(payload)
+	}))
+	defer srv.Close()
+	repo := srv.URL + "/main"
+	retries := 0
+	globalConfig = &Config{CacheDir: t.TempDir(), Network: NetworkConfig{Retries: &retries}}
+	info := APKPackage{Name: "foo", Filename: "foo-1.0-r0.apk", Size: int64(len(payload))}
+	dir := t.TempDir()
+	// The first fetch downloads, the second is a cache hit
+	for i := 0; i < 2; i++ {
+		if _, err := cachedFetch(globalConfig.CacheDir, repo, info, filepath.Join(dir, "foo.apk")); err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(filepath.Join(dir, "foo.apk"))
+	}
+	countTraffic(repo, "", fromIndex, 1000)
+	run := finishTraffic()
+	n := int64(len(payload))
+	if run == nil || run.Mirror != n || run.Cache != n || run.Indexes != 1000 || run.Fetches != 2 || run.Downloads != 1 {
+		t.Fatalf("run traffic = %+v", run)
+	}
+	if finishTraffic() != nil {
+		t.Error("a run without transfers reported some")
+	}
+
+	// Runs add up in the state dir
+	countTraffic(repo, "foo", fromPeer, 7)
+	finishTraffic()
+	all := readTraffic()
+	if all.Runs != 2 || all.Total.Peers != 7 || all.Repos[repo].Mirror != n || all.Packages["foo"].Fetches != 3 || all.Total.Downloads != 1 {
+		t.Errorf("accumulated traffic = %+v, repo %+v, foo %+v", all, all.Repos[repo], all.Packages["foo"])
+	}
+	if saved, share := all.Total.saved(); saved != n+7 || share <= 50 {
+		t.Errorf("saved = %d (%.0f%%)", saved, share)
+	}
+	if _, ok := all.Packages[""]; ok {
+		t.Error("indexes were counted as a package")
+	}
+	if code := cmdStats("/nonexistent", []string{"network"}); code != 0 {
+		t.Errorf("stats network = %d", code)
+	}
+	if code := cmdStats("/nonexistent", []string{"network", "-reset"}); code != 0 || readTraffic().Runs != 0 {
+		t.Errorf("stats network -reset = %d, left %d runs", code, readTraffic().Runs)
+	}
+	if len(readBandwidth()) != 1 {
+		t.Errorf("the download speed samples were reset: %+v", readBandwidth())
+	}
+
+	// The samples of the former bandwidth.yaml move into traffic.yaml
+	os.Remove(statePath(trafficFile))
+	os.WriteFile(statePath(legacyBandwidthFile), []byte("- bytes: 100\n  seconds: 1\n"), 0644)
+	countTraffic(repo, "foo", fromPeer, 7)
+	finishTraffic()
+	if b := readBandwidth(); len(b) != 1 || b[0].Bytes != 100 {
+		t.Errorf("imported samples %+v", b)
+	}
+	if _, err := os.Stat(statePath(legacyBandwidthFile)); !os.IsNotExist(err) {
+		t.Errorf("bandwidth.yaml was kept: %v", err)
+	}
+}
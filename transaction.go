@@ -0,0 +1,393 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// transactionsDir (under the state dir) holds the journal and backups of every running transaction
+const transactionsDir = "transactions"
+
+// Journal actions, each line of a journal is "<action>\t<path relative to install_dir>"
+// or a txDone marker
+const (
+	txCreate  = "create"  // a new file was written, rollback deletes it
+	txReplace = "replace" // an existing file was backed up before being overwritten
+	txRemove  = "remove"  // a file was backed up and removed
+	txMkdir   = "mkdir"   // a directory was created, rollback removes it if empty
+	// txSave lines are "save\t<n>\t<path>": a file the transaction changed before its latest
+	// savepoint was moved to saved/<n> before being changed again, rollback puts it back
+	txSave = "save"
+)
+
+// txEntry is a single journaled change, pkg is the package it was made for
+type txEntry struct {
+	action string
+	rel    string
+	pkg    string
+	// saved is the copy a txSave entry kept, below saved/ of the transaction dir
+	saved string
+}
+
+// Transaction journals every change made to install_dir so a failed or
+// interrupted install/uninstall can be rolled back
+type Transaction struct {
+	ID         string
+	Dir        string
+	installDir string
+	journal    *os.File
+	entries    []txEntry
+	touched    map[string]bool
+	onCommit   []func()
+	// last maps journaled paths to their latest entry, mark is the number of entries at
+	// the latest savepoint and saves counts the txSave entries
+	last  map[string]int
+	mark  int
+	saves int
+	// removedPkgs are the packages being uninstalled by this transaction
+	removedPkgs map[string]bool
+	// pkg is the package the following changes are made for
+	pkg string
+	// owners maps installed files to their package, replaces holds the takeover rules
+	// of the packages involved, both are loaded on the first shared file
+	owners   map[string]string
+	replaces map[string]replacesInfo
+}
+
+// txSeq numbers the transactions of this process, so the ones begun within the same
+// microsecond get IDs of their own
+var txSeq int
+
+// beginTransaction starts a new journaled transaction against installDir. Its ID sorts
+// by start time, the directory is created exclusively so no two transactions share it.
+func beginTransaction(installDir string) (*Transaction, error) {
+	if runStarted.IsZero() {
+		runStarted = time.Now()
+	}
+	txSeq++
+	id := time.Now().UTC().Format("20060102T150405.000000") + fmt.Sprintf("-%d-%d", os.Getpid(), txSeq)
+	tx := &Transaction{ID: id, Dir: filepath.Join(statePath(transactionsDir), id), installDir: installDir, touched: make(map[string]bool), last: make(map[string]int), removedPkgs: make(map[string]bool), replaces: make(map[string]replacesInfo)}
+	if err := os.MkdirAll(statePath(transactionsDir), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(tx.Dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(filepath.Join(tx.Dir, "backup"), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(tx.Dir, "install_dir"), []byte(installDir), 0644); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(tx.Dir, "journal"), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	tx.journal = f
+	return tx, nil
+}
+
+// record appends an entry to the journal and syncs it before the change is made
+func (tx *Transaction) record(action, rel string) error {
+	return tx.recordEntry(txEntry{action: action, rel: rel, pkg: tx.pkg})
+}
+
+// recordEntry appends e to the journal and syncs it
+func (tx *Transaction) recordEntry(e txEntry) error {
+	debugf("tx", "%s: %s %s", tx.ID, e.action, e.rel)
+	line := e.action + "\t" + e.rel
+	if e.saved != "" {
+		line = e.action + "\t" + e.saved + "\t" + e.rel
+	}
+	if _, err := fmt.Fprintln(tx.journal, line); err != nil {
+		return err
+	}
+	tx.last[e.rel] = len(tx.entries)
+	tx.entries = append(tx.entries, e)
+	return tx.journal.Sync()
+}
+
+// savedPath returns where a txSave entry of the transaction in txDir keeps its copy
+func savedPath(txDir string, e txEntry) string {
+	return filepath.Join(txDir, "saved", e.saved, e.rel)
+}
+
+// saveForSavepoint journals that rel, which tx changed before its latest savepoint, is
+// about to change again. Its current content is moved aside so rollbackTo can restore
+// it, a file that isn't there is journaled as created.
+func (tx *Transaction) saveForSavepoint(rel string) error {
+	if i, ok := tx.last[rel]; ok && i >= tx.mark {
+		return nil // journaled since the savepoint already
+	}
+	target := installPath(tx.installDir, rel)
+	if _, err := os.Lstat(target); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		return tx.record(txCreate, rel)
+	}
+	tx.saves++
+	e := txEntry{action: txSave, rel: rel, pkg: tx.pkg, saved: strconv.Itoa(tx.saves)}
+	if err := tx.recordEntry(e); err != nil {
+		return err
+	}
+	return moveFile(target, savedPath(tx.Dir, e))
+}
+
+// setPackage attributes the following changes to pkg
+func (tx *Transaction) setPackage(pkg string) {
+	tx.pkg = pkg
+}
+
+// backupPath returns where the original of rel is kept during the transaction
+func (tx *Transaction) backupPath(rel string) string {
+	return filepath.Join(tx.Dir, "backup", rel)
+}
+
+// moveFile renames src to dest, falling back to copy+remove across filesystems
+func moveFile(src, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dest); err == nil {
+		return nil
+	}
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, dest); err != nil {
+			return err
+		}
+	} else if err := copyFile(src, dest, info.Mode()); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// prepareWrite journals that rel is about to be written, backing up any existing file
+func (tx *Transaction) prepareWrite(rel string) error {
+	if tx.touched[rel] {
+		return tx.saveForSavepoint(rel) // the original is already journaled
+	}
+	tx.touched[rel] = true
+	target := installPath(tx.installDir, rel)
+	if _, err := os.Lstat(target); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		return tx.record(txCreate, rel)
+	}
+	if err := tx.record(txReplace, rel); err != nil {
+		return err
+	}
+	return moveFile(target, tx.backupPath(rel))
+}
+
+// mkdirAll creates the directory rel in install_dir, journaling every directory it creates
+func (tx *Transaction) mkdirAll(rel string, mode os.FileMode) error {
+	var missing []string
+	for d := rel; d != "." && d != string(os.PathSeparator) && d != ""; d = filepath.Dir(d) {
+		if _, err := os.Stat(installPath(tx.installDir, d)); err == nil {
+			break
+		}
+		missing = append(missing, d)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := tx.record(txMkdir, missing[i]); err != nil {
+			return err
+		}
+	}
+	return os.MkdirAll(installPath(tx.installDir, rel), mode)
+}
+
+// removeFile backs up and removes rel from install_dir
+func (tx *Transaction) removeFile(rel string) error {
+	if tx.touched[rel] {
+		if _, err := os.Lstat(installPath(tx.installDir, rel)); os.IsNotExist(err) {
+			return nil
+		}
+		if err := tx.saveForSavepoint(rel); err != nil {
+			return err
+		}
+		if err := os.Remove(installPath(tx.installDir, rel)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	tx.touched[rel] = true
+	target := installPath(tx.installDir, rel)
+	if _, err := os.Lstat(target); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := tx.record(txRemove, rel); err != nil {
+		return err
+	}
+	return moveFile(target, tx.backupPath(rel))
+}
+
+// packageFiles returns the files tx wrote for pkg so far, in journal order
+func (tx *Transaction) packageFiles(pkg string) []string {
+	var files []string
+	seen := make(map[string]bool)
+	for _, e := range tx.entries {
+		if e.pkg == pkg && (e.action == txCreate || e.action == txReplace) && !seen[e.rel] {
+			seen[e.rel] = true
+			files = append(files, e.rel)
+		}
+	}
+	return files
+}
+
+// deferCommit registers a state update that only happens once the transaction commits
+func (tx *Transaction) deferCommit(fn func()) {
+	tx.onCommit = append(tx.onCommit, fn)
+}
+
+// commit applies the deferred state updates and drops the journal and backups
+func (tx *Transaction) commit() error {
+	if err := writeAuditLog(tx); err != nil {
+		eprintf("[WARN] Failed to write audit log: %v\n", err)
+	}
+	if err := recordChanges(tx); err != nil {
+		eprintf("[WARN] Failed to update %s: %v\n", lastChangesFile, err)
+	}
+	for _, fn := range tx.onCommit {
+		fn()
+	}
+	tx.journal.Close()
+	return os.RemoveAll(tx.Dir)
+}
+
+// rollback undoes every journaled change in reverse order
+func (tx *Transaction) rollback() error {
+	tx.journal.Close()
+	err := undoEntries(tx.installDir, tx.Dir, tx.entries)
+	if err == nil {
+		err = os.RemoveAll(tx.Dir)
+	}
+	return err
+}
+
+// txSavepoint marks a point of a transaction rollbackTo can return to
+type txSavepoint struct {
+	entries  int
+	onCommit int
+}
+
+// savepoint marks the current state of tx, files it changed before are saved again
+// before their next change
+func (tx *Transaction) savepoint() txSavepoint {
+	tx.mark = len(tx.entries)
+	return txSavepoint{entries: len(tx.entries), onCommit: len(tx.onCommit)}
+}
+
+// rollbackTo undoes the changes made since sp and forgets their deferred state updates,
+// the rest of the transaction stays. The undone entries stay in the journal, undoing
+// them again on recovery finds nothing to do. A file changed both before and after sp
+// gets the content it had at sp back from its txSave copy.
+func (tx *Transaction) rollbackTo(sp txSavepoint) error {
+	undone := tx.entries[sp.entries:]
+	if err := undoEntries(tx.installDir, tx.Dir, undone); err != nil {
+		return err
+	}
+	forget := make(map[string]bool)
+	for _, e := range undone {
+		forget[e.rel] = true
+		delete(tx.touched, e.rel)
+		delete(tx.last, e.rel)
+	}
+	tx.entries = tx.entries[:sp.entries]
+	for i, e := range tx.entries {
+		if forget[e.rel] {
+			tx.touched[e.rel] = true
+			tx.last[e.rel] = i
+		}
+	}
+	tx.mark = sp.entries
+	tx.onCommit = tx.onCommit[:sp.onCommit]
+	return nil
+}
+
+// undoEntries reverts journal entries of the transaction stored in txDir
+func undoEntries(installDir, txDir string, entries []txEntry) error {
+	var firstErr error
+	for i := len(entries) - 1; i >= 0; i-- {
+		action, rel := entries[i].action, entries[i].rel
+		target := installPath(installDir, rel)
+		backup := filepath.Join(txDir, "backup", rel)
+		if action == txSave {
+			backup = savedPath(txDir, entries[i])
+		}
+		var err error
+		switch action {
+		case txCreate:
+			err = os.Remove(target)
+		case txReplace, txRemove, txSave:
+			if _, statErr := os.Lstat(backup); statErr != nil {
+				continue // crashed before the backup was made, original is untouched
+			}
+			os.Remove(target)
+			err = moveFile(backup, target)
+		case txMkdir:
+			os.Remove(target) // only succeeds if empty
+		}
+		if err != nil && !os.IsNotExist(err) && firstErr == nil {
+			firstErr = fmt.Errorf("failed to undo %s of %s: %w", action, rel, err)
+		}
+	}
+	return firstErr
+}
+
+// recoverTransactions rolls back transactions left behind by an interrupted run
+func recoverTransactions() error {
+	dirs, err := os.ReadDir(statePath(transactionsDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, d := range dirs {
+		txDir := filepath.Join(statePath(transactionsDir), d.Name())
+		installDir, err := os.ReadFile(filepath.Join(txDir, "install_dir"))
+		if err != nil {
+			return fmt.Errorf("transaction %s is unreadable: %w", d.Name(), err)
+		}
+		entries, err := readJournal(txDir)
+		if err != nil {
+			return err
+		}
+		changes := 0
+		for _, e := range entries {
+			if e.action != txDone {
+				changes++
+			}
+		}
+		eprintf("[WARN] Rolling back interrupted transaction %s (%d changes)\n", d.Name(), changes)
+		if err := undoEntries(string(installDir), txDir, entries); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(txDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
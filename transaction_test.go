@@ -0,0 +1,130 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTransactionRollback(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	root := filepath.Join(dir, "root")
+	os.MkdirAll(filepath.Join(root, "etc"), 0755)
+	os.WriteFile(filepath.Join(root, "etc/keep.conf"), []byte("original"), 0644)
+	os.WriteFile(filepath.Join(root, "etc/gone.conf"), []byte("gone"), 0644)
+
+	tx, err := beginTransaction(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.prepareWrite("etc/keep.conf"); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(root, "etc/keep.conf"), []byte("new"), 0644)
+	if err := tx.mkdirAll("usr/bin", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.prepareWrite("usr/bin/tool"); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(root, "usr/bin/tool"), []byte("tool"), 0755)
+	if err := tx.removeFile("etc/gone.conf"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, _ := os.ReadFile(filepath.Join(root, "etc/keep.conf")); string(data) != "original" {
+		t.Errorf("replaced file not restored, got %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(root, "etc/gone.conf")); err != nil {
+		t.Errorf("removed file not restored: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "usr")); !os.IsNotExist(err) {
+		t.Errorf("created directories not removed")
+	}
+	if _, err := os.Stat(tx.Dir); !os.IsNotExist(err) {
+		t.Errorf("transaction dir left behind")
+	}
+}
+
+func TestTransactionIDsUnique(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	root := filepath.Join(dir, "root")
+	os.MkdirAll(root, 0755)
+	first, err := beginTransaction(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := beginTransaction(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID == second.ID || first.Dir == second.Dir {
+		t.Fatalf("transactions begun back to back share ID %s", first.ID)
+	}
+	if first.ID > second.ID {
+		t.Errorf("transaction IDs don't sort by start: %s > %s", first.ID, second.ID)
+	}
+	first.rollback()
+	second.rollback()
+}
+
+func TestTransactionRecoverAfterSavepoint(t *testing.T) {
+	dir := t.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	root := filepath.Join(dir, "root")
+	os.MkdirAll(root, 0755)
+	os.WriteFile(filepath.Join(root, "shared"), []byte("original"), 0644)
+	tx, err := beginTransaction(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{"first", "second"} {
+		tx.savepoint()
+		if err := tx.prepareWrite("shared"); err != nil {
+			t.Fatal(err)
+		}
+		os.WriteFile(filepath.Join(root, "shared"), []byte(content), 0644)
+	}
+	entries, err := readJournal(tx.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[1].action != txSave || entries[1].rel != "shared" || entries[1].saved != "1" {
+		t.Fatalf("journal %+v", entries)
+	}
+
+	// An interrupted run is rolled back from the journal, the saved copy included
+	tx.journal.Close()
+	if err := recoverTransactions(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "shared")); string(data) != "original" {
+		t.Errorf("recovery restored %q", data)
+	}
+}
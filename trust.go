@@ -0,0 +1,234 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/rsa"
+	_ "crypto/sha1" // .SIGN.RSA signatures are over SHA-1
+	_ "crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Trust levels of a repo, see trust in the config
+const (
+	trustOff     = "off"     // signatures aren't checked
+	trustWarn    = "warn"    // unsigned or badly signed indexes and packages are reported
+	trustEnforce = "enforce" // unsigned or badly signed indexes and packages are refused
+)
+
+// trustDefaultKey is the trust key applying to repos without their own entry
+const trustDefaultKey = "default"
+
+// defaultKeysDir is where the public keys signatures are checked against are looked up
+const defaultKeysDir = "/etc/apk/keys"
+
+// errUnsigned is returned for archives without a .SIGN entry
+var errUnsigned = errors.New("not signed")
+
+// validateTrust checks every configured trust level
+func validateTrust(cfg *Config) error {
+	for repo, level := range cfg.Trust {
+		if level != trustOff && level != trustWarn && level != trustEnforce {
+			return fmt.Errorf("unknown trust %q for %s (known: off, warn, enforce)", level, repo)
+		}
+	}
+	return nil
+}
+
+// trustLevel returns the effective trust level of repo
+func trustLevel(repo string) string {
+	if globalConfig == nil {
+		return trustOff
+	}
+	if level, ok := globalConfig.Trust[repo]; ok {
+		return level
+	}
+	if level, ok := globalConfig.Trust[trustDefaultKey]; ok {
+		return level
+	}
+	return trustOff
+}
+
+// keysDir returns the configured keys_dir or /etc/apk/keys
+func keysDir() string {
+	if globalConfig != nil && globalConfig.KeysDir != "" {
+		return globalConfig.KeysDir
+	}
+	return defaultKeysDir
+}
+
+// offsetReader counts the bytes read through it. It's a ByteReader so gzip reads no
+// further than the end of the current member and the count marks member boundaries.
+type offsetReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (o *offsetReader) Read(p []byte) (int, error) {
+	n, err := o.r.Read(p)
+	o.n += int64(n)
+	return n, err
+}
+
+func (o *offsetReader) ReadByte() (byte, error) {
+	b, err := o.r.ReadByte()
+	if err == nil {
+		o.n++
+	}
+	return b, err
+}
+
+// verifyAPKSignature checks the signature of a signed apk archive (index or package): its
+// first gzip member holds .SIGN.RSA[256].<key>, a signature over the raw bytes of the
+// second member. Nothing but padding may follow the signature, so no unsigned file can be
+// slipped in next to it. With whole set (indexes) nothing may follow the signed member,
+// otherwise (packages) the signed member is the control member and the data following it
+// has to match the datahash of its .PKGINFO. It returns the name of the key that signed it.
+func verifyAPKSignature(path string, whole bool) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	or := &offsetReader{r: bufio.NewReader(f)}
+	zr, err := gzip.NewReader(or)
+	if err != nil {
+		return "", errUnsigned
+	}
+	zr.Multistream(false)
+	hdr, err := tar.NewReader(zr).Next()
+	if err != nil || !strings.HasPrefix(hdr.Name, ".SIGN.") {
+		return "", errUnsigned
+	}
+	var hash crypto.Hash
+	var key string
+	switch {
+	case strings.HasPrefix(hdr.Name, ".SIGN.RSA256."):
+		hash, key = crypto.SHA256, strings.TrimPrefix(hdr.Name, ".SIGN.RSA256.")
+	case strings.HasPrefix(hdr.Name, ".SIGN.RSA."):
+		hash, key = crypto.SHA1, strings.TrimPrefix(hdr.Name, ".SIGN.RSA.")
+	default:
+		return "", fmt.Errorf("unsupported signature %s", hdr.Name)
+	}
+	// The tar entry is read through the gzip reader, draining it ends the first member
+	sig := make([]byte, hdr.Size)
+	if _, err := io.ReadFull(zr, sig); err != nil {
+		return "", err
+	}
+	rest, err := io.ReadAll(zr)
+	if err != nil {
+		return "", err
+	}
+	if len(bytes.Trim(rest, "\x00")) > 0 {
+		return key, fmt.Errorf("signature member carries more than the signature")
+	}
+	start := or.n
+	if err := zr.Reset(or); err != nil {
+		return "", fmt.Errorf("signature isn't followed by signed data: %w", err)
+	}
+	zr.Multistream(false)
+	if _, err := io.Copy(io.Discard, zr); err != nil {
+		return "", err
+	}
+	end := or.n
+	if _, err := or.ReadByte(); whole && err != io.EOF {
+		return key, fmt.Errorf("unsigned data follows the signed part")
+	}
+	h := hash.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, start, end-start)); err != nil {
+		return "", err
+	}
+	pub, err := findPublicKey(filepath.Base(key))
+	if err != nil {
+		return key, fmt.Errorf("signed by unknown key %s: %w", key, err)
+	}
+	if err := rsa.VerifyPKCS1v15(pub, hash, h.Sum(nil), sig); err != nil {
+		return key, fmt.Errorf("bad signature by %s", key)
+	}
+	if !whole {
+		st, err := f.Stat()
+		if err != nil {
+			return key, err
+		}
+		if err := checkDataHash(f, start, end, st.Size()); err != nil {
+			return key, fmt.Errorf("data isn't covered by the signed control member: %w", err)
+		}
+	}
+	return key, nil
+}
+
+// readPublicKey reads a PEM encoded RSA public key
+func readPublicKey(path string) (*rsa.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parsePublicKey(data, path)
+}
+
+// parsePublicKey parses a PEM encoded RSA public key, name says where it came from
+func parsePublicKey(data []byte, path string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM key", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an RSA key", path)
+	}
+	return pub, nil
+}
+
+// checkTrust applies the trust level of repo to the archive at path, what names it in messages.
+// Only an enforcing repo returns an error.
+func checkTrust(repo, what, path string) error {
+	level := trustLevel(repo)
+	if level == trustOff {
+		return nil
+	}
+	// An index is only the signature and the signed tarball, packages carry their data after it
+	_, err := verifyAPKSignature(path, what == "index")
+	switch {
+	case err == nil:
+		return nil
+	case level == trustWarn:
+		eprintf("[WARN] %s from %s: %v\n", what, repo, err)
+		return nil
+	}
+	return fmt.Errorf("%s from %s is refused by trust: enforce: %w", what, repo, err)
+}
+
+// printTrust lists the effective trust level of every repo when trust is configured,
+// apply shows it before fetching the indexes it applies to
+func printTrust(repos []string) {
+	if globalConfig == nil || len(globalConfig.Trust) == 0 {
+		return
+	}
+	sorted := append([]string(nil), repos...)
+	sort.Strings(sorted)
+	printf("Repository trust:\n")
+	for _, repo := range sorted {
+		printf("  %-7s %s\n", trustLevel(repo), repo)
+	}
+}
@@ -0,0 +1,149 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// gzipTar returns one gzip member holding a tar entry, without the end-of-archive
+// blocks when open is set, like the signature part of apk archives
+func gzipTar(name string, data []byte, open bool) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg})
+	tw.Write(data)
+	if open {
+		tw.Flush()
+	} else {
+		tw.Close()
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestCheckTrust(t *testing.T) {
+	oldConfig := globalConfig
+	defer func() { globalConfig = oldConfig }()
+	keys := t.TempDir()
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	os.WriteFile(filepath.Join(keys, "test-1.rsa.pub"), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644)
+
+	dir := t.TempDir()
+	payload := gzipTar("APKINDEX", []byte("P:busybox\nV:1.36.1-r0\n\n"), false)
+	digest := sha256.Sum256(payload)
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, digest[:])
+	signed := filepath.Join(dir, "signed.tar.gz")
+	os.WriteFile(signed, append(gzipTar(".SIGN.RSA256.test-1.rsa.pub", sig, true), payload...), 0644)
+	unsigned := filepath.Join(dir, "unsigned.tar.gz")
+	os.WriteFile(unsigned, payload, 0644)
+	tampered := filepath.Join(dir, "tampered.tar.gz")
+	os.WriteFile(tampered, append(gzipTar(".SIGN.RSA256.test-1.rsa.pub", sig, true), gzipTar("APKINDEX", []byte("P:evil\nV:1\n\n"), false)...), 0644)
+
+	globalConfig = &Config{KeysDir: keys, Trust: map[string]string{"default": trustEnforce, "https://internal": trustWarn, "https://open": trustOff}}
+	if key, err := verifyAPKSignature(signed, true); err != nil || key != "test-1.rsa.pub" {
+		t.Fatalf("verifyAPKSignature = %q, %v", key, err)
+	}
+	if _, err := verifyAPKSignature(unsigned, true); err != errUnsigned {
+		t.Errorf("expected errUnsigned, got %v", err)
+	}
+	if _, err := verifyAPKSignature(tampered, true); err == nil {
+		t.Error("tampered archive passed verification")
+	}
+	// An APKINDEX slipped into the unsigned signature member, or appended after the signed one
+	var injected bytes.Buffer
+	zw := gzip.NewWriter(&injected)
+	tw := tar.NewWriter(zw)
+	tw.WriteHeader(&tar.Header{Name: ".SIGN.RSA256.test-1.rsa.pub", Mode: 0644, Size: int64(len(sig)), Typeflag: tar.TypeReg})
+	tw.Write(sig)
+	tw.WriteHeader(&tar.Header{Name: "APKINDEX", Mode: 0644, Size: 13, Typeflag: tar.TypeReg})
+	tw.Write([]byte("P:evil\nV:1\n\n"))
+	tw.Flush()
+	zw.Close()
+	injectedPath := filepath.Join(dir, "injected.tar.gz")
+	os.WriteFile(injectedPath, append(injected.Bytes(), payload...), 0644)
+	if _, err := verifyAPKSignature(injectedPath, true); err == nil {
+		t.Error("a file next to the signature passed verification")
+	}
+	appended := filepath.Join(dir, "appended.tar.gz")
+	os.WriteFile(appended, append(append(gzipTar(".SIGN.RSA256.test-1.rsa.pub", sig, true), payload...), gzipTar("APKINDEX", []byte("P:evil\nV:1\n\n"), false)...), 0644)
+	if _, err := verifyAPKSignature(appended, true); err == nil {
+		t.Error("data after the signed index passed verification")
+	}
+	// A package's data follows its signed control member, the datahash of .PKGINFO covers it
+	data := gzipTar("usr/bin/foo", []byte("#!/bin/sh\n"), false)
+	datahash := sha256.Sum256(data)
+	control := gzipTar(".PKGINFO", []byte("pkgname = foo\ndatahash = "+hex.EncodeToString(datahash[:])+"\n"), true)
+	controlDigest := sha256.Sum256(control)
+	controlSig, _ := rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, controlDigest[:])
+	pkg := append(gzipTar(".SIGN.RSA256.test-1.rsa.pub", controlSig, true), control...)
+	goodPkg, badPkg := filepath.Join(dir, "good.apk"), filepath.Join(dir, "bad.apk")
+	os.WriteFile(goodPkg, append(append([]byte(nil), pkg...), data...), 0644)
+	os.WriteFile(badPkg, append(append([]byte(nil), pkg...), gzipTar("usr/bin/foo", []byte("#!/bin/su\n"), false)...), 0644)
+	if _, err := verifyAPKSignature(goodPkg, false); err != nil {
+		t.Errorf("a package with its data after the signed control member was refused: %v", err)
+	}
+	if _, err := verifyAPKSignature(badPkg, false); err == nil {
+		t.Error("a package with other data than its signed datahash passed verification")
+	}
+	if err := checkTrust("https://main", "bad.apk", badPkg); err == nil {
+		t.Error("enforce accepted a package with tampered data")
+	}
+	if _, err := verifyAPKSignature(appended, false); err == nil {
+		t.Error("a package without .PKGINFO passed verification")
+	}
+	if err := checkTrust("https://main", "index", tampered); err == nil {
+		t.Error("enforce accepted a bad signature")
+	}
+	if err := checkTrust("https://internal", "index", unsigned); err != nil {
+		t.Errorf("warn refused an unsigned index: %v", err)
+	}
+	if err := checkTrust("https://open", "index", tampered); err != nil {
+		t.Errorf("off checked the signature: %v", err)
+	}
+}
+
+func TestIndexDescription(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for _, f := range [][2]string{{"DESCRIPTION", "v3.22.1-52-g0d7f3c9e6a\n"}, {"APKINDEX", "P:busybox\nV:1.36.1-r0\n\n"}} {
+		tw.WriteHeader(&tar.Header{Name: f[0], Mode: 0644, Size: int64(len(f[1])), Typeflag: tar.TypeReg})
+		tw.Write([]byte(f[1]))
+	}
+	tw.Close()
+	zw.Close()
+	path := filepath.Join(t.TempDir(), "APKINDEX.tar.gz")
+	os.WriteFile(path, buf.Bytes(), 0644)
+	desc, err := indexDescription(path)
+	if err != nil || desc != "v3.22.1-52-g0d7f3c9e6a" {
+		t.Fatalf("indexDescription = %q, %v", desc, err)
+	}
+	if c := descriptionCommit(desc); c != "0d7f3c9e6a" {
+		t.Errorf("descriptionCommit = %q", c)
+	}
+	if c := descriptionCommit("v3.22.1"); c != "" {
+		t.Errorf("descriptionCommit of a tag = %q", c)
+	}
+}
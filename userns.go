@@ -0,0 +1,158 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// usernsEnv marks an apkg process re-executed in its own user namespace, it waits on fd 3
+// until its id mappings are in place
+const usernsEnv = "APKG_USERNS"
+
+// subIDRange returns the first subordinate id range of the user in /etc/subuid or
+// /etc/subgid format, entries may name the user or its numeric id
+func subIDRange(path, name string, id int) (start, count int, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		fields := strings.Split(strings.TrimSpace(sc.Text()), ":")
+		if len(fields) != 3 || (fields[0] != name && fields[0] != strconv.Itoa(id)) {
+			continue
+		}
+		start, err1 := strconv.Atoi(fields[1])
+		count, err2 := strconv.Atoi(fields[2])
+		if err1 != nil || err2 != nil || count <= 0 {
+			return 0, 0, fmt.Errorf("%s: bad entry %q", path, sc.Text())
+		}
+		return start, count, nil
+	}
+	return 0, 0, fmt.Errorf("%s has no range for %s", path, name)
+}
+
+// idMapArgs returns the newuidmap/newgidmap mapping of a namespace: the caller becomes
+// root and its subordinate range the ids from 1 on
+func idMapArgs(pid, id, start, count int) []string {
+	return []string{strconv.Itoa(pid), "0", strconv.Itoa(id), "1", "1", strconv.Itoa(start), strconv.Itoa(count)}
+}
+
+// enterUserNamespace re-executes an unprivileged apkg in a new user and mount namespace
+// where it is root and the ids of its /etc/subuid and /etc/subgid ranges exist, so files
+// keep the ownership of their packages, and exits with its status. Root and the
+// re-executed process return right away.
+func enterUserNamespace() error {
+	if os.Geteuid() == 0 || os.Getenv(usernsEnv) != "" {
+		return nil
+	}
+	u, err := user.Current()
+	if err != nil {
+		return err
+	}
+	uidStart, uidCount, err := subIDRange("/etc/subuid", u.Username, os.Getuid())
+	if err != nil {
+		return err
+	}
+	gidStart, gidCount, err := subIDRange("/etc/subgid", u.Username, os.Getuid())
+	if err != nil {
+		return err
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	ready, signal, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(self, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), usernsEnv+"=1")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if stdinConfig != nil {
+		// The config was already read from stdin, hand it over again
+		cmd.Stdin = bytes.NewReader(stdinConfig)
+	}
+	cmd.ExtraFiles = []*os.File{ready}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS}
+	if err := cmd.Start(); err != nil {
+		ready.Close()
+		signal.Close()
+		return fmt.Errorf("creating the user namespace failed: %w", err)
+	}
+	ready.Close()
+	// newuidmap and newgidmap are the setuid helpers allowed to map subordinate ranges
+	for _, m := range [][]string{
+		append([]string{"newuidmap"}, idMapArgs(cmd.Process.Pid, os.Getuid(), uidStart, uidCount)...),
+		append([]string{"newgidmap"}, idMapArgs(cmd.Process.Pid, os.Getgid(), gidStart, gidCount)...),
+	} {
+		if out, err := exec.Command(m[0], m[1:]...).CombinedOutput(); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			signal.Close()
+			return fmt.Errorf("%s failed: %v\n%s", m[0], err, out)
+		}
+	}
+	signal.Write([]byte{1})
+	signal.Close()
+	err = cmd.Wait()
+	if exit, ok := err.(*exec.ExitError); ok {
+		os.Exit(exit.ExitCode())
+	}
+	if err != nil {
+		eprintf("[FATAL] %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+	return nil
+}
+
+// waitUserNamespace blocks a re-executed apkg until its parent mapped its ids
+func waitUserNamespace() error {
+	if os.Getenv(usernsEnv) == "" {
+		return nil
+	}
+	ready := os.NewFile(3, "userns-ready")
+	defer ready.Close()
+	var b [1]byte
+	if n, _ := ready.Read(b[:]); n != 1 {
+		return fmt.Errorf("the user namespace wasn't set up")
+	}
+	// Helpers and scripts don't inherit the marker or the pipe
+	os.Unsetenv(usernsEnv)
+	return nil
+}
+
+// chownEntry gives a file the owner recorded in its package when apkg runs as root,
+// in a user namespace that includes unprivileged users
+func chownEntry(path string, uid, gid int) error {
+	if os.Geteuid() != 0 {
+		return nil
+	}
+	if err := os.Lchown(path, uid, gid); err != nil {
+		return fmt.Errorf("setting the owner of %s to %d:%d: %w", path, uid, gid, err)
+	}
+	return nil
+}
+
+// chownLike gives path the owner of the staged file described by info
+func chownLike(path string, info os.FileInfo) error {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return chownEntry(path, int(st.Uid), int(st.Gid))
+}
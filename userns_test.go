@@ -0,0 +1,31 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSubIDRange(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "subuid")
+	os.WriteFile(path, []byte("alice:100000:65536\n1001:165536:65536\n"), 0644)
+	if start, count, err := subIDRange(path, "alice", 1000); err != nil || start != 100000 || count != 65536 {
+		t.Errorf("alice: %d %d %v", start, count, err)
+	}
+	if start, _, err := subIDRange(path, "bob", 1001); err != nil || start != 165536 {
+		t.Errorf("bob by uid: %d %v", start, err)
+	}
+	if _, _, err := subIDRange(path, "carol", 1002); err == nil {
+		t.Error("expected no range for carol")
+	}
+	if got := strings.Join(idMapArgs(42, 1000, 100000, 65536), " "); got != "42 0 1000 1 1 100000 65536" {
+		t.Errorf("mapping %s", got)
+	}
+}
@@ -0,0 +1,80 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// cmdVerify implements `apkg verify [pkg...]`: every indexed file of the installed
+// packages must exist in install_dir, files left out by include/exclude filters are
+// reported but not flagged. Stripped files must still have their sha256 from stripping.
+func cmdVerify(configPath string, args []string) int {
+	cfg, err := readConfig(configPath)
+	if err != nil {
+		eprintf("[FATAL] Failed to read config: %v\n", err)
+		return 1
+	}
+	globalConfig = cfg
+	installedPkgs, err := readInstalledPkgs(statePath("installed.yaml"))
+	if err != nil {
+		eprintf("[FATAL] Failed to read installed.yaml: %v\n", err)
+		return 1
+	}
+	pkgs := args
+	if len(pkgs) == 0 {
+		for name := range installedPkgs {
+			pkgs = append(pkgs, name)
+		}
+		sort.Strings(pkgs)
+	}
+	stripped, err := readStripped()
+	if err != nil {
+		eprintf("[WARN] Failed to read %s: %v\n", strippedFile, err)
+	}
+	problems := 0
+	for _, pkg := range pkgs {
+		if _, ok := installedPkgs[pkg]; !ok {
+			eprintf("[ERROR] %s is not installed\n", pkg)
+			problems++
+			continue
+		}
+		files, err := readInstalledFiles(pkg)
+		if err != nil {
+			eprintf("[ERROR] %s: could not read installed files index: %v\n", pkg, err)
+			problems++
+			continue
+		}
+		missing := 0 // missing or modified
+		for _, rel := range files {
+			full := installPath(cfg.InstallDir, rel)
+			if _, err := os.Lstat(full); err != nil {
+				printf("%s: missing %s\n", pkg, rel)
+				missing++
+			} else if want, ok := stripped[filepath.ToSlash(rel)]; ok && fileSHA256(full) != want {
+				printf("%s: modified %s (differs from the stripped file)\n", pkg, rel)
+				missing++
+			}
+		}
+		omitted, _ := readOmittedFiles(pkg)
+		switch {
+		case missing > 0:
+			problems += missing
+		case len(omitted) > 0:
+			printf("%s: OK (%d files, %d omitted by filters)\n", pkg, len(files), len(omitted))
+		default:
+			printf("%s: OK (%d files)\n", pkg, len(files))
+		}
+	}
+	if problems > 0 {
+		printf("%d problem(s) found\n", problems)
+		return 1
+	}
+	return 0
+}
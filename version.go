@@ -0,0 +1,105 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// versionSuffixes orders the _suffixes of apk versions, pre-release ones sort
+// before the plain version (rank 0) and post-release ones after it
+var versionSuffixes = map[string]int{
+	"alpha": -4, "beta": -3, "pre": -2, "rc": -1,
+	"cvs": 1, "svn": 2, "git": 3, "hg": 4, "p": 5,
+}
+
+// apkVersion is a parsed apk version such as 1.2.3b_rc1-r4
+type apkVersion struct {
+	numbers  []int64
+	letter   byte
+	suffixes [][2]int64 // rank and number of every _suffix
+	revision int64
+}
+
+// parseAPKVersion parses v, unparseable parts are ignored
+func parseAPKVersion(v string) apkVersion {
+	var pv apkVersion
+	if i := strings.LastIndex(v, "-r"); i >= 0 {
+		if n, err := strconv.ParseInt(v[i+2:], 10, 64); err == nil {
+			pv.revision = n
+			v = v[:i]
+		}
+	}
+	// A ~<commit> marks snapshot builds and doesn't take part in ordering
+	if i := strings.Index(v, "~"); i >= 0 {
+		v = v[:i]
+	}
+	parts := strings.Split(v, "_")
+	base := parts[0]
+	for _, num := range strings.Split(base, ".") {
+		digits := strings.TrimRight(num, "abcdefghijklmnopqrstuvwxyz")
+		n, _ := strconv.ParseInt(digits, 10, 64)
+		pv.numbers = append(pv.numbers, n)
+		if len(digits) < len(num) {
+			pv.letter = num[len(digits)]
+		}
+	}
+	for _, suffix := range parts[1:] {
+		name := strings.TrimRight(suffix, "0123456789")
+		n, _ := strconv.ParseInt(suffix[len(name):], 10, 64)
+		pv.suffixes = append(pv.suffixes, [2]int64{int64(versionSuffixes[name]), n})
+	}
+	return pv
+}
+
+// cmpInt64 returns -1, 0 or 1 as a is less than, equal to or greater than b
+func cmpInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareAPKVersions returns -1, 0 or 1 as version a is older than, the same as or newer than b
+func compareAPKVersions(a, b string) int {
+	va, vb := parseAPKVersion(a), parseAPKVersion(b)
+	for i := 0; i < len(va.numbers) || i < len(vb.numbers); i++ {
+		var x, y int64
+		if i < len(va.numbers) {
+			x = va.numbers[i]
+		}
+		if i < len(vb.numbers) {
+			y = vb.numbers[i]
+		}
+		if c := cmpInt64(x, y); c != 0 {
+			return c
+		}
+	}
+	if c := cmpInt64(int64(va.letter), int64(vb.letter)); c != 0 {
+		return c
+	}
+	for i := 0; i < len(va.suffixes) || i < len(vb.suffixes); i++ {
+		var x, y [2]int64
+		if i < len(va.suffixes) {
+			x = va.suffixes[i]
+		}
+		if i < len(vb.suffixes) {
+			y = vb.suffixes[i]
+		}
+		if c := cmpInt64(x[0], y[0]); c != 0 {
+			return c
+		}
+		if c := cmpInt64(x[1], y[1]); c != 0 {
+			return c
+		}
+	}
+	return cmpInt64(va.revision, vb.revision)
+}
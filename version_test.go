@@ -0,0 +1,46 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import "testing"
+
+func TestCompareAPKVersions(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"1.36.1-r0", "1.36.1-r0", 0},
+		{"1.36.1-r0", "1.36.1-r1", -1},
+		{"1.36.10-r0", "1.36.9-r5", 1},
+		{"1.2-r0", "1.2.1-r0", -1},
+		{"1.2_rc1-r0", "1.2-r0", -1},
+		{"1.2_alpha2", "1.2_beta1", -1},
+		{"1.2_p1-r0", "1.2-r3", 1},
+		{"1.1a-r0", "1.1-r0", 1},
+		{"2.0_git20250101-r0", "2.0-r0", 1},
+		{"6.6.3~abc123-r0", "6.6.3-r0", 0},
+	} {
+		if got := compareAPKVersions(tc.a, tc.b); got != tc.want {
+			t.Errorf("compareAPKVersions(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+		if got := compareAPKVersions(tc.b, tc.a); got != -tc.want {
+			t.Errorf("compareAPKVersions(%q, %q) = %d, want %d", tc.b, tc.a, got, -tc.want)
+		}
+	}
+}
+
+func TestDiffIndexes(t *testing.T) {
+	old := map[string]APKPackage{"a": {Version: "1.0-r0"}, "b": {Version: "2.0-r0"}, "c": {Version: "3.0-r1"}, "d": {Version: "1-r0"}}
+	new := map[string]APKPackage{"a": {Version: "1.0-r0"}, "b": {Version: "2.1-r0", Size: 10}, "c": {Version: "3.0-r0"}, "e": {Version: "1-r0", Size: 5}}
+	d := diffIndexes(old, new)
+	if len(d.Added) != 1 || d.Added[0].Name != "e" || len(d.Removed) != 1 || d.Removed[0].Name != "d" {
+		t.Errorf("unexpected added/removed: %+v %+v", d.Added, d.Removed)
+	}
+	if len(d.Upgraded) != 1 || d.Upgraded[0].Name != "b" || len(d.Downgraded) != 1 || d.Downgraded[0].Name != "c" {
+		t.Errorf("unexpected upgraded/downgraded: %+v %+v", d.Upgraded, d.Downgraded)
+	}
+}
@@ -0,0 +1,100 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// exitWarnings is returned by -fail-on-warn when the run printed warnings
+const exitWarnings = 6
+
+// failOnWarn is set by -fail-on-warn
+var failOnWarn bool
+
+// ResultWarning is a warning of the run in a RunResult, repeated ones are counted
+type ResultWarning struct {
+	Message string `json:"message"`
+	Count   int    `json:"count"`
+}
+
+// runWarnings collects every [WARN] printed during the run, in order of first appearance
+var runWarnings struct {
+	sync.Mutex
+	list  []ResultWarning
+	index map[string]int
+}
+
+// recordWarning collects a message printed by eprintf if it's a warning
+func recordWarning(format string, a ...any) {
+	msg, ok := strings.CutPrefix(format, "[WARN] ")
+	if !ok {
+		return
+	}
+	msg = strings.TrimSpace(fmt.Sprintf(T(msg), a...))
+	runWarnings.Lock()
+	defer runWarnings.Unlock()
+	if i, ok := runWarnings.index[msg]; ok {
+		runWarnings.list[i].Count++
+		return
+	}
+	if runWarnings.index == nil {
+		runWarnings.index = map[string]int{}
+	}
+	runWarnings.index[msg] = len(runWarnings.list)
+	runWarnings.list = append(runWarnings.list, ResultWarning{Message: msg, Count: 1})
+}
+
+// collectedWarnings returns the warnings of the run so far
+func collectedWarnings() []ResultWarning {
+	runWarnings.Lock()
+	defer runWarnings.Unlock()
+	return append([]ResultWarning(nil), runWarnings.list...)
+}
+
+// printWarningSummary repeats every warning of the run in one block on stderr, so none
+// is missed among the rest of the output
+func printWarningSummary(warnings []ResultWarning) {
+	if len(warnings) == 0 {
+		return
+	}
+	fmt.Fprintln(os.Stderr)
+	eprintf("%d warnings during this run:\n", len(warnings))
+	for _, w := range warnings {
+		if w.Count > 1 {
+			eprintf("  - %s (%d times)\n", w.Message, w.Count)
+		} else {
+			eprintf("  - %s\n", w.Message)
+		}
+	}
+}
+
+// finishRun ends an apply: the warning summary, the -json result carrying the warnings and
+// failed packages, exit 4 when packages failed and exitWarnings with -fail-on-warn when
+// there were warnings
+func finishRun(r *RunResult) {
+	r.Warnings = collectedWarnings()
+	r.Failed = failedPackages
+	printWarningSummary(r.Warnings)
+	if len(r.Failed) > 0 {
+		eprintf("%d packages failed and were skipped:\n", len(r.Failed))
+		for _, f := range r.Failed {
+			eprintf("  - %s (%s): %s\n", f.Name, f.Step, f.Error)
+		}
+	}
+	r.Transfer = finishTraffic()
+	emitResult(r)
+	if len(r.Failed) > 0 {
+		os.Exit(4)
+	}
+	if failOnWarn && len(r.Warnings) > 0 {
+		os.Exit(exitWarnings)
+	}
+}
@@ -0,0 +1,45 @@
+/* This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at http://mozilla.org/MPL/2.0/. */
+
+/* Copyright (c) 2025 Lumiini */
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWarningSummary(t *testing.T) {
+	oldOut := jsonOut
+	defer func() {
+		jsonOut = oldOut
+		runWarnings.list, runWarnings.index = nil, nil
+	}()
+	runWarnings.list, runWarnings.index = nil, nil
+	out, err := os.Create(filepath.Join(t.TempDir(), "result.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	jsonOut = out
+
+	eprintf("[WARN] Could not find repo for %s\n", "foo")
+	eprintf("[ERROR] Not a warning\n")
+	eprintf("[WARN] Failed to clean up transaction %s: %v\n", "tx1", "busy")
+	eprintf("[WARN] Could not find repo for %s\n", "foo")
+	finishRun(newRunResult(&Plan{}, true, false))
+
+	var r RunResult
+	data, _ := os.ReadFile(out.Name())
+	if err := json.Unmarshal(data, &r); err != nil {
+		t.Fatal(err)
+	}
+	want := []ResultWarning{{"Could not find repo for foo", 2}, {"Failed to clean up transaction tx1: busy", 1}}
+	if len(r.Warnings) != len(want) || r.Warnings[0] != want[0] || r.Warnings[1] != want[1] {
+		t.Errorf("warnings: %+v", r.Warnings)
+	}
+}